@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// accessLogCombined 为 Apache combined 格式
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// AccessLogConfig 结构用于配置访问日志，默认以 Apache combined 格式输出到标准错误
+type AccessLogConfig struct {
+	// Disabled 为 true 时不输出访问日志
+	Disabled bool `json:"disabled"`
+	// Format 为 combined（默认）或 json
+	Format string `json:"format"`
+	// Output 为 stderr（默认）、stdout 或文件路径，文件被 logrotate 等移走后收到 SIGHUP 时重新打开
+	Output string `json:"output"`
+	// Rotate 为输出到文件时的轮转配置
+	Rotate LogRotateConfig `json:"rotate"`
+}
+
+// AccessLogEntry 结构是 json 格式的一条访问日志
+type AccessLogEntry struct {
+	Time time.Time `json:"time"`
+	// RequestID 与运行日志和审计日志中的 request_id 相同
+	RequestID  string  `json:"request_id,omitempty"`
+	RemoteIP   string  `json:"remote_ip"`
+	User       string  `json:"user,omitempty"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Query      string  `json:"query,omitempty"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+}
+
+// AccessLog 结构在每个请求结束后输出一行访问日志
+type AccessLog struct {
+	mu     sync.Mutex
+	format string
+	writer io.Writer
+}
+
+// accessLog 关闭访问日志时为 nil
+var accessLog *AccessLog
+
+// OpenAccessLog 按配置打开访问日志的输出，关闭时返回 nil
+func OpenAccessLog(config AccessLogConfig) (*AccessLog, error) {
+	if config.Disabled {
+		return nil, nil
+	}
+	a := &AccessLog{format: config.Format}
+	switch a.format {
+	case "":
+		a.format = accessLogCombined
+	case accessLogCombined, accessLogJSON:
+	default:
+		return nil, fmt.Errorf("不支持的访问日志格式 %s，应为 combined 或 json", config.Format)
+	}
+	switch config.Output {
+	case "", "stderr":
+		a.writer = os.Stderr
+	case "stdout":
+		a.writer = os.Stdout
+	default:
+		file, err := OpenRotatingFile(config.Output, config.Rotate)
+		if err != nil {
+			return nil, err
+		}
+		a.writer = file
+	}
+	return a, nil
+}
+
+// accessUserKey 是请求上下文中保存访问日志调用方名称的键
+type accessUserKey struct{}
+
+// accessLogIdentity 在访问日志中标记通过认证的调用方
+func accessLogIdentity(r *http.Request, identity *Identity) {
+	if user, ok := r.Context().Value(accessUserKey{}).(*string); ok {
+		*user = identity.Name
+	}
+}
+
+// Middleware 在请求结束后输出访问日志，关闭时直接返回 next；查询参数中的签名等敏感值被替换为 ***
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var user string
+		sw := newStatusWriter(w, 0)
+		ctx := context.WithValue(r.Context(), accessUserKey{}, &user)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		entry := AccessLogEntry{
+			Time:       start,
+			RequestID:  requestID(r),
+			User:       user,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Proto:      r.Proto,
+			Status:     sw.Status(),
+			Bytes:      sw.bytes,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		}
+		if r.URL.RawQuery != "" {
+			entry.Query = sanitizeQuery(r)
+		}
+		if ip := geoLocator.ClientIP(r); ip != nil {
+			entry.RemoteIP = ip.String()
+		}
+		a.write(entry)
+	})
+}
+
+// write 按配置的格式输出一行
+func (a *AccessLog) write(entry AccessLogEntry) {
+	var line []byte
+	if a.format == accessLogJSON {
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		line = append(line, '\n')
+	} else {
+		line = combinedLogLine(entry)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = a.writer.Write(line)
+}
+
+// combinedLogLine 按 Apache combined 格式输出，缺少的字段为 -
+func combinedLogLine(entry AccessLogEntry) []byte {
+	dash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+	target := entry.Path
+	if entry.Query != "" {
+		target += "?" + entry.Query
+	}
+	size := "-"
+	if entry.Bytes > 0 {
+		size = strconv.FormatInt(entry.Bytes, 10)
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+		dash(entry.RemoteIP),
+		dash(entry.User),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(entry.Method+" "+target+" "+entry.Proto),
+		entry.Status,
+		size,
+		strconv.Quote(dash(entry.Referer)),
+		strconv.Quote(dash(entry.UserAgent)),
+	))
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnomalyConfig 结构用于配置异常访问检测
+type AnomalyConfig struct {
+	Enabled bool `json:"enabled"`
+	// Window 统计窗口，单位秒，默认 60
+	Window int `json:"window"`
+	// MaxDownloads 同一调用方在窗口内的下载次数上限，未认证的请求按客户端 IP 统计，0 表示不检测
+	MaxDownloads int `json:"max_downloads"`
+	// MaxDeletes 同一调用方在窗口内的删除次数上限，0 表示不检测
+	MaxDeletes int `json:"max_deletes"`
+	// MaxUnauthorized 同一客户端 IP 在窗口内认证失败的次数上限，0 表示不检测
+	MaxUnauthorized int `json:"max_unauthorized"`
+	// AutoSuspend 为 true 时自动暂停触发下载或删除告警的调用方，直到管理员解除，拥有 admin 权限的调用方不会被暂停
+	AutoSuspend bool `json:"auto_suspend"`
+	// WebhookURL 告警以 JSON 格式 POST 到该地址
+	WebhookURL string `json:"webhook_url"`
+	// Email 告警邮件
+	Email *AlertEmailConfig `json:"email"`
+}
+
+// AlertEmailConfig 结构用于配置告警邮件
+type AlertEmailConfig struct {
+	// SMTPAddr SMTP 服务器地址，如 smtp.example.com:587
+	SMTPAddr string   `json:"smtp_addr"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// Alert 结构表示一次异常访问告警
+type Alert struct {
+	Kind    string    `json:"kind"`
+	Subject string    `json:"subject"`
+	Count   int       `json:"count"`
+	Window  int       `json:"window_seconds"`
+	Time    time.Time `json:"time"`
+	// Suspended 表示调用方已被自动暂停
+	Suspended bool `json:"suspended"`
+}
+
+// Suspension 结构表示被暂停的调用方
+type Suspension struct {
+	Name   string    `json:"name"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// anomalyCounter 是固定窗口计数器
+type anomalyCounter struct {
+	start   time.Time
+	count   int
+	alerted bool
+}
+
+// AnomalyDetector 结构用于检测异常访问并发送告警
+type AnomalyDetector struct {
+	config AnomalyConfig
+	window time.Duration
+	file   string
+	client *http.Client
+
+	mu          sync.Mutex
+	counters    map[string]*anomalyCounter
+	suspensions map[string]Suspension
+}
+
+// anomalyDetector 未启用检测时为 nil
+var anomalyDetector *AnomalyDetector
+
+// NewAnomalyDetector 创建异常访问检测，加载之前暂停的调用方
+func NewAnomalyDetector(config AnomalyConfig, file string) (*AnomalyDetector, error) {
+	if config.Window <= 0 {
+		config.Window = 60
+	}
+	d := &AnomalyDetector{
+		config:      config,
+		window:      time.Duration(config.Window) * time.Second,
+		file:        file,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		counters:    map[string]*anomalyCounter{},
+		suspensions: map[string]Suspension{},
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &d.suspensions)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Download 记录一次下载
+func (d *AnomalyDetector) Download(r *http.Request) {
+	if d == nil || d.config.MaxDownloads <= 0 {
+		return
+	}
+	d.observe("downloads", anomalySubject(r), identityFrom(r), d.config.MaxDownloads)
+}
+
+// Delete 记录一次删除
+func (d *AnomalyDetector) Delete(r *http.Request) {
+	if d == nil || d.config.MaxDeletes <= 0 {
+		return
+	}
+	d.observe("deletes", anomalySubject(r), identityFrom(r), d.config.MaxDeletes)
+}
+
+// Unauthorized 记录一次认证失败
+func (d *AnomalyDetector) Unauthorized(r *http.Request) {
+	if d == nil || d.config.MaxUnauthorized <= 0 {
+		return
+	}
+	d.observe("unauthorized", "ip:"+geoLocator.ClientIP(r).String(), nil, d.config.MaxUnauthorized)
+}
+
+// anomalySubject 返回统计的对象，已认证时为调用方名称，否则为客户端 IP
+func anomalySubject(r *http.Request) string {
+	if name := identityName(r); name != "" {
+		return name
+	}
+	return "ip:" + geoLocator.ClientIP(r).String()
+}
+
+// observe 累加计数，在窗口内首次达到上限时告警
+func (d *AnomalyDetector) observe(kind string, subject string, identity *Identity, limit int) {
+	now := time.Now()
+	key := kind + "\n" + subject
+
+	d.mu.Lock()
+	counter, ok := d.counters[key]
+	if !ok || now.Sub(counter.start) >= d.window {
+		counter = &anomalyCounter{start: now}
+		d.counters[key] = counter
+		d.pruneLocked(now)
+	}
+	counter.count++
+	if counter.alerted || counter.count < limit {
+		d.mu.Unlock()
+		return
+	}
+	counter.alerted = true
+	alert := Alert{Kind: kind, Subject: subject, Count: counter.count, Window: d.config.Window, Time: now}
+	// 只暂停已认证的调用方，管理员不会被暂停以免无法解除
+	if d.config.AutoSuspend && kind != "unauthorized" && identity != nil && !identity.HasScope(scopeAdmin) {
+		d.suspensions[identity.Name] = Suspension{
+			Name:   identity.Name,
+			Reason: fmt.Sprintf("%d 秒内 %s 次数达到 %d", d.config.Window, kind, counter.count),
+			Time:   now,
+		}
+		alert.Suspended = true
+	}
+	d.mu.Unlock()
+
+	slog.Warn("检测到异常访问", "kind", kind, "subject", subject, "count", alert.Count)
+	if alert.Suspended {
+		err := d.save()
+		if err != nil {
+			slog.Error("保存暂停列表失败", "err", err)
+		}
+	}
+	go d.notify(alert)
+}
+
+// pruneLocked 清理过期的计数器，避免大量不同 IP 占用内存
+func (d *AnomalyDetector) pruneLocked(now time.Time) {
+	if len(d.counters) < 10000 {
+		return
+	}
+	for key, counter := range d.counters {
+		if now.Sub(counter.start) >= d.window {
+			delete(d.counters, key)
+		}
+	}
+}
+
+// Suspended 判断调用方是否被暂停
+func (d *AnomalyDetector) Suspended(name string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.suspensions[name]
+	return ok
+}
+
+// Suspensions 返回被暂停的调用方，按暂停时间排序
+func (d *AnomalyDetector) Suspensions() []Suspension {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	suspensions := []Suspension{}
+	for _, s := range d.suspensions {
+		suspensions = append(suspensions, s)
+	}
+	sort.Slice(suspensions, func(i, j int) bool {
+		return suspensions[i].Time.Before(suspensions[j].Time)
+	})
+	return suspensions
+}
+
+// Lift 解除暂停，调用方不存在时返回 false
+func (d *AnomalyDetector) Lift(name string) (bool, error) {
+	d.mu.Lock()
+	_, ok := d.suspensions[name]
+	delete(d.suspensions, name)
+	d.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, d.save()
+}
+
+// save 保存暂停列表，重启后仍然有效
+func (d *AnomalyDetector) save() error {
+	d.mu.Lock()
+	data, err := json.Marshal(d.suspensions)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(d.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := d.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, d.file)
+}
+
+// notify 通过 webhook 和邮件发送告警
+func (d *AnomalyDetector) notify(alert Alert) {
+	if d.config.WebhookURL != "" {
+		err := postWebhook(d.client, d.config.WebhookURL, alert)
+		if err != nil {
+			slog.Error("发送告警失败", "err", err)
+		}
+	}
+	if d.config.Email != nil {
+		subject := fmt.Sprintf("[store] 异常访问: %s %s", alert.Kind, alert.Subject)
+		text := fmt.Sprintf("类型: %s\r\n对象: %s\r\n次数: %d（%d 秒内）\r\n时间: %s\r\n已暂停: %t\r\n",
+			alert.Kind, alert.Subject, alert.Count, alert.Window, alert.Time.Format(time.RFC3339), alert.Suspended)
+		err := sendAlertEmail(d.config.Email, subject, text)
+		if err != nil {
+			slog.Error("发送告警邮件失败", "err", err)
+		}
+	}
+}
+
+// postWebhook 将 payload 以 JSON 格式 POST 到 url
+func postWebhook(client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook 返回 %s", resp.Status)
+	}
+	return nil
+}
+
+// sendAlertEmail 通过 SMTP 发送纯文本告警邮件，未配置服务器或收件人时不发送
+func sendAlertEmail(email *AlertEmailConfig, subject string, text string) error {
+	if email == nil || email.SMTPAddr == "" || len(email.To) == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		email.From, strings.Join(email.To, ", "), mime.BEncoding.Encode("utf-8", subject), text)
+	var auth smtp.Auth
+	if email.Username != "" {
+		host := strings.Split(email.SMTPAddr, ":")[0]
+		auth = smtp.PlainAuth("", email.Username, email.Password, host)
+	}
+	return smtp.SendMail(email.SMTPAddr, auth, email.From, email.To, []byte(message))
+}
+
+// 查看被暂停的调用方
+func suspensionsHandler(w http.ResponseWriter, r *http.Request) {
+	if anomalyDetector == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用异常访问检测", nil, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", anomalyDetector.Suspensions(), nil, r.URL.Path)
+}
+
+// 解除调用方的暂停
+func liftSuspensionHandler(w http.ResponseWriter, r *http.Request) {
+	if anomalyDetector == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用异常访问检测", nil, r.URL.Path)
+		return
+	}
+	var request struct {
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "解析JSON数据失败", err, r.URL.Path)
+		return
+	}
+	ok, err := anomalyDetector.Lift(request.Name)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "保存暂停列表失败", err, r.URL.Path)
+		return
+	}
+	if !ok {
+		sendJSONResponse(w, http.StatusNotFound, "该调用方未被暂停", nil, r.URL.Path)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, "已解除暂停", nil, r.URL.Path)
+}
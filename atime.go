@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessTimeConfig 结构用于配置访问时间记录
+type AccessTimeConfig struct {
+	Enabled bool `json:"enabled"`
+	// FlushInterval 将内存中的访问时间批量写入索引的间隔，单位秒
+	FlushInterval int `json:"flush_interval"`
+	// RelatimeWindow 访问时间的最小更新间隔，单位秒，与 Linux relatime 行为一致
+	RelatimeWindow int `json:"relatime_window"`
+}
+
+// AccessTracker 以 relatime 方式在内存中记录文件访问时间，并定期批量写入索引
+type AccessTracker struct {
+	mu      sync.Mutex
+	index   *MetaIndex
+	pending map[string]time.Time
+	window  time.Duration
+}
+
+// NewAccessTracker 创建访问时间记录器
+func NewAccessTracker(index *MetaIndex, cfg AccessTimeConfig) *AccessTracker {
+	window := time.Duration(cfg.RelatimeWindow) * time.Second
+	if cfg.RelatimeWindow <= 0 {
+		window = 24 * time.Hour
+	}
+	return &AccessTracker{
+		index:   index,
+		pending: map[string]time.Time{},
+		window:  window,
+	}
+}
+
+// Touch 记录一次文件访问
+// 仅当上次访问时间早于修改时间或超过 relatime 间隔时才更新，避免每次读取都写入
+func (t *AccessTracker) Touch(key string, modTime time.Time) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last, ok := t.pending[key]
+	if !ok {
+		meta, _ := t.index.Get(key)
+		last = meta.ATime
+	}
+	if !last.IsZero() && !last.Before(modTime) && now.Sub(last) < t.window {
+		return
+	}
+	t.pending[key] = now
+}
+
+// ATime 返回文件最近一次记录的访问时间，包括尚未写入索引的部分
+func (t *AccessTracker) ATime(key string) (time.Time, bool) {
+	if t == nil {
+		return time.Time{}, false
+	}
+	t.mu.Lock()
+	atime, ok := t.pending[key]
+	t.mu.Unlock()
+	if ok {
+		return atime, true
+	}
+
+	meta, ok := t.index.Get(key)
+	if !ok || meta.ATime.IsZero() {
+		return time.Time{}, false
+	}
+	return meta.ATime, true
+}
+
+// Forget 丢弃指定路径下尚未写入的访问记录，用于文件被删除时
+func (t *AccessTracker) Forget(key string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k := range t.pending {
+		if key == "" || k == key || strings.HasPrefix(k, key+"/") {
+			delete(t.pending, k)
+		}
+	}
+}
+
+// Flush 将内存中的访问时间写入索引并保存
+func (t *AccessTracker) Flush() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = map[string]time.Time{}
+	t.mu.Unlock()
+
+	for key, atime := range pending {
+		t.index.Update(key, func(meta *FileMeta) {
+			meta.ATime = atime
+		})
+	}
+	err := t.index.Save()
+	if err != nil {
+		slog.Error("保存访问时间失败", "err", err)
+	}
+}
+
+// Run 按固定间隔定期刷新访问时间
+func (t *AccessTracker) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.Flush()
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig 结构用于配置审计日志，记录每一次接口调用的调用方、操作、路径和结果
+type AuditConfig struct {
+	Enabled bool `json:"enabled"`
+	// Dir 审计日志的目录，默认 data/.meta/audit
+	Dir string `json:"dir"`
+	// MaxSize 单个日志文件的大小上限（MB），超过时轮转，默认 100；轮转后的文件不会自动删除
+	MaxSize int64 `json:"max_size"`
+	// ExcludeReads 为 true 时不记录下载、列目录、搜索等 GET 和 HEAD 请求
+	ExcludeReads bool `json:"exclude_reads"`
+}
+
+// AuditRecord 结构是审计日志中的一条记录，每行一条 JSON
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	// Identity 为通过认证的调用方（token 名称、JWT 的 sub 等），Actor 为代表其操作的调用方
+	Identity string `json:"identity,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Actor    string `json:"actor,omitempty"`
+	Method   string `json:"method"`
+	// Action 为接口名称，如 upload、delete、get、admin/settings
+	Action string `json:"action"`
+	Path   string `json:"path,omitempty"`
+	Status int    `json:"status"`
+	// Result 为 success、denied（401、403）或 failure
+	Result   string `json:"result"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+	ClientIP string `json:"client_ip"`
+	// Country 和 ASN 在配置了 geoip 时记录客户端 IP 的国家和所属网络
+	Country    string  `json:"country,omitempty"`
+	ASN        uint64  `json:"asn,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+	// TLS 为连接协商的 TLS 参数和客户端证书，明文连接时为空
+	TLS *TLSInfo `json:"tls,omitempty"`
+}
+
+const (
+	auditFileName = "audit.log"
+	// auditRotatedPrefix 轮转后的文件名为 audit-<轮转时间>.log，按文件名排序即按时间排序
+	auditRotatedPrefix = "audit-"
+	auditTimeLayout    = "20060102T150405.000000000"
+)
+
+// AuditLog 结构将审计记录追加到日志文件，写入失败只记录日志，不影响请求
+type AuditLog struct {
+	mu           sync.Mutex
+	dir          string
+	maxSize      int64
+	excludeReads bool
+	file         *os.File
+	size         int64
+
+	records     int64
+	writeErrors int64
+}
+
+// auditLog 未启用审计日志时为 nil
+var auditLog *AuditLog
+
+// OpenAuditLog 打开审计日志目录，未启用时返回 nil
+func OpenAuditLog(config AuditConfig) (*AuditLog, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	dir := config.Dir
+	if dir == "" {
+		dir = filepath.Join("data", metaDirName, "audit")
+	}
+	maxSize := config.MaxSize
+	if maxSize <= 0 {
+		maxSize = 100
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLog{dir: dir, maxSize: maxSize << 20, excludeReads: config.ExcludeReads}
+	err = a.open()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open 以追加方式打开当前的日志文件，需要持有 mu 或在初始化时调用
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(filepath.Join(a.dir, auditFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate 将当前的日志文件改名为带时间的文件并重新打开，需要持有 mu
+func (a *AuditLog) rotate(now time.Time) error {
+	_ = a.file.Close()
+	a.file = nil
+	rotated := filepath.Join(a.dir, auditRotatedPrefix+now.UTC().Format(auditTimeLayout)+".log")
+	err := os.Rename(filepath.Join(a.dir, auditFileName), rotated)
+	if err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Append 追加一条记录，每条记录直接写入文件，进程崩溃时不会丢失已完成请求的记录
+func (a *AuditLog) Append(record AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		err = a.open()
+	} else if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		err = a.rotate(record.Time)
+	}
+	if err == nil {
+		var n int
+		n, err = a.file.Write(line)
+		a.size += int64(n)
+	}
+	if err != nil {
+		a.writeErrors++
+		slog.Error("写入审计日志失败", "err", err)
+		return
+	}
+	a.records++
+}
+
+// auditRecordKey 是请求上下文中保存正在记录的审计记录的键
+type auditRecordKey struct{}
+
+// auditIdentity 在审计记录中标记通过认证的调用方
+func auditIdentity(r *http.Request, identity *Identity) {
+	if record, ok := r.Context().Value(auditRecordKey{}).(*AuditRecord); ok {
+		record.Identity = identity.Name
+		record.Provider = identity.Provider
+		record.Actor = identity.Actor
+	}
+}
+
+// auditPathRoutes 是在 URL 中携带文件路径的接口
+var auditPathRoutes = []string{"/get/", "/thumb/", "/t/", "/catalog/download/"}
+
+// auditAction 返回请求的接口名称和 URL 中携带的文件路径
+func auditAction(urlPath string) (string, string) {
+	for _, route := range auditPathRoutes {
+		if strings.HasPrefix(urlPath, route) {
+			return strings.Trim(route, "/"), strings.TrimPrefix(urlPath, route)
+		}
+	}
+	return strings.Trim(urlPath, "/"), ""
+}
+
+// auditBodyLimit 为从请求体中读取 path 字段时最多保留的字节数
+const auditBodyLimit = 64 << 10
+
+// auditBodyPath 从 JSON 请求体中读取 path 字段，如 /delete 和 /versions/rollback
+func auditBodyPath(body []byte) string {
+	var request struct {
+		Path string `json:"path"`
+	}
+	if json.Unmarshal(body, &request) != nil {
+		return ""
+	}
+	return request.Path
+}
+
+// auditBody 统计读取的请求体字节数，并保留开头的一部分
+type auditBody struct {
+	io.ReadCloser
+	n    int64
+	head *limitedBuffer
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.head != nil && n > 0 {
+		_, _ = b.head.Write(p[:n])
+	}
+	return n, err
+}
+
+// Middleware 在请求结束后记录一条审计记录，未启用时直接返回 next；存活和就绪检查不记录
+func (a *AuditLog) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || (a.excludeReads && (r.Method == http.MethodGet || r.Method == http.MethodHead)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		record := AuditRecord{Time: time.Now(), RequestID: requestID(r), Method: r.Method, TLS: requestTLSInfo(r)}
+		record.Action, record.Path = auditAction(r.URL.Path)
+		if ip := geoLocator.ClientIP(r); ip != nil {
+			record.ClientIP = ip.String()
+		}
+		geo := geoLocator.Lookup(r)
+		record.Country, record.ASN = geo.Country, geo.ASN
+		// 路径依次取自上传的请求头、查询参数和 JSON 请求体
+		if record.Path == "" {
+			record.Path = r.Header.Get("X-FormFile-Path")
+		}
+		if record.Path == "" {
+			record.Path = r.URL.Query().Get("path")
+		}
+		var head bytes.Buffer
+		body := &auditBody{ReadCloser: r.Body}
+		if record.Path == "" && strings.Contains(r.Header.Get("Content-Type"), "json") {
+			body.head = &limitedBuffer{buf: &head, limit: auditBodyLimit}
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+
+		sw := newStatusWriter(w, 0)
+		ctx := context.WithValue(r.Context(), auditRecordKey{}, &record)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		if record.Path == "" && head.Len() > 0 {
+			record.Path = auditBodyPath(head.Bytes())
+		}
+		record.Status = sw.Status()
+		switch {
+		case record.Status == http.StatusUnauthorized || record.Status == http.StatusForbidden:
+			record.Result = "denied"
+		case record.Status >= 400:
+			record.Result = "failure"
+		default:
+			record.Result = "success"
+		}
+		record.BytesIn = body.n
+		record.BytesOut = sw.bytes
+		record.DurationMs = float64(time.Since(record.Time).Microseconds()) / 1000
+		a.Append(record)
+	})
+}
+
+// AuditQuery 结构是查询审计日志的条件，为空的条件不限制
+type AuditQuery struct {
+	Since    time.Time
+	Until    time.Time
+	Path     string
+	Identity string
+	Action   string
+	Result   string
+	// ClientCert 匹配客户端证书的 SHA-256 指纹或 CN
+	ClientCert string
+	Limit      int
+}
+
+func (q AuditQuery) match(record AuditRecord) bool {
+	if !q.Since.IsZero() && record.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !record.Time.Before(q.Until) {
+		return false
+	}
+	if q.Path != "" {
+		key := indexKey(record.Path)
+		if key != q.Path && !strings.HasPrefix(key, q.Path+"/") {
+			return false
+		}
+	}
+	if q.Identity != "" && record.Identity != q.Identity && record.Actor != q.Identity {
+		return false
+	}
+	if q.Action != "" && record.Action != q.Action {
+		return false
+	}
+	if q.ClientCert != "" {
+		if record.TLS == nil || record.TLS.ClientCert == nil {
+			return false
+		}
+		cert := record.TLS.ClientCert
+		if !strings.EqualFold(cert.FingerprintSHA256, q.ClientCert) && cert.CommonName != q.ClientCert {
+			return false
+		}
+	}
+	return q.Result == "" || record.Result == q.Result
+}
+
+// files 按时间从旧到新返回可能包含 since 之后记录的日志文件
+func (a *AuditLog) files(since time.Time) ([]string, error) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, auditRotatedPrefix) || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		// 轮转时间之前写入的记录都在该文件中，早于 since 时跳过
+		rotatedAt, err := time.Parse(auditTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, auditRotatedPrefix), ".log"))
+		if err == nil && !since.IsZero() && rotatedAt.Before(since) {
+			continue
+		}
+		files = append(files, filepath.Join(a.dir, name))
+	}
+	sort.Strings(files)
+	return append(files, filepath.Join(a.dir, auditFileName)), nil
+}
+
+// Query 按时间从旧到新返回符合条件的记录，超过 limit 时只返回最新的 limit 条，truncated 为 true
+func (a *AuditLog) Query(query AuditQuery) ([]AuditRecord, bool, error) {
+	files, err := a.files(query.Since)
+	if err != nil {
+		return nil, false, err
+	}
+	records := []AuditRecord{}
+	truncated := false
+	for _, name := range files {
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			var record AuditRecord
+			// 崩溃时写了一半的行跳过
+			if json.Unmarshal(scanner.Bytes(), &record) != nil || !query.match(record) {
+				continue
+			}
+			records = append(records, record)
+			if query.Limit > 0 && len(records) > query.Limit {
+				// 保留最新的 limit 条，定期整体前移避免切片无限增长
+				if len(records) > 2*query.Limit {
+					records = append(records[:0], records[len(records)-query.Limit:]...)
+				}
+				truncated = true
+			}
+		}
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if query.Limit > 0 && len(records) > query.Limit {
+		records = records[len(records)-query.Limit:]
+	}
+	return records, truncated, nil
+}
+
+// AuditResponse 结构是查询审计日志返回的内容
+type AuditResponse struct {
+	Records []AuditRecord `json:"records"`
+	// Truncated 为 true 时还有更早的记录，可以缩小时间范围或增大 limit
+	Truncated bool `json:"truncated"`
+}
+
+// parseAuditTime 解析 RFC3339 时间或 Unix 秒
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// 查询审计日志，可按时间、路径、调用方、操作和结果过滤
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if auditLog == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用审计日志", nil, r.URL.Path)
+		return
+	}
+	values := r.URL.Query()
+	query := AuditQuery{
+		Path:     indexKey(values.Get("path")),
+		Identity: values.Get("identity"),
+		Action:   strings.Trim(values.Get("action"), "/"),
+		Result:   values.Get("result"),
+		// 客户端证书的指纹或 CN，用于追溯某台设备的操作
+		ClientCert: values.Get("client_cert"),
+		Limit:      1000,
+	}
+	var err error
+	query.Since, err = parseAuditTime(values.Get("since"))
+	if err == nil {
+		query.Until, err = parseAuditTime(values.Get("until"))
+	}
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "时间格式错误，应为 RFC3339 或 Unix 秒", err, r.URL.Path)
+		return
+	}
+	if limit := values.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit <= 0 {
+			sendJSONResponse(w, http.StatusBadRequest, "limit 应为正整数", err, r.URL.Path)
+			return
+		}
+	}
+
+	records, truncated, err := auditLog.Query(query)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "读取审计日志失败", err, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", AuditResponse{Records: records, Truncated: truncated}, nil, r.URL.Path)
+}
+
+func (a *AuditLog) writeMetrics(w http.ResponseWriter) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP store_audit_records_total Requests written to the audit log.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_audit_records_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_audit_records_total %d\n", a.records)
+	_, _ = fmt.Fprintf(w, "# HELP store_audit_write_errors_total Audit records that could not be written.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_audit_write_errors_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_audit_write_errors_total %d\n", a.writeErrors)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 接口需要的权限范围
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+	// scopeReplicate 为复制目标之间推送使用的权限，只能显式授予，admin 和 * 不包含该权限
+	scopeReplicate = "replicate"
+)
+
+// Identity 表示通过认证的调用方
+type Identity struct {
+	// Name 为调用方的标识，如 token 名称、JWT 的 sub 或客户端证书的 CN
+	Name string `json:"name"`
+	// Provider 为完成认证的提供者名称
+	Provider string   `json:"provider"`
+	Scopes   []string `json:"scopes"`
+	// Actor 为代表 Name 执行操作的调用方，未代理时为空
+	Actor string `json:"actor,omitempty"`
+	// Warning 为凭证即将过期等需要提醒调用方的信息，通过 Warning 响应头返回
+	Warning string `json:"-"`
+	// Metadata 为凭证上附加的信息，目前只有静态 token 提供
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Priority 为传输的优先级，batch 的调用方不能通过请求头提高优先级，目前只有静态 token 提供
+	Priority string `json:"priority,omitempty"`
+}
+
+// HasScope 判断调用方是否拥有指定权限，admin 和 * 拥有所有权限
+func (id *Identity) HasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope || s == "*" || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// IsReplicationPeer 判断调用方是否显式拥有 replicate 权限，只有复制目标使用的 token 才应授予
+func (id *Identity) IsReplicationPeer() bool {
+	for _, s := range id.Scopes {
+		if s == scopeReplicate {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthProvider 是认证提供者的接口，可以实现该接口接入自定义的认证方式（如内部 SSO）
+type AuthProvider interface {
+	// ValidateCredentials 校验请求中的凭证并返回调用方身份
+	// 请求中没有该提供者能识别的凭证时返回 errNoCredentials，以便尝试下一个提供者
+	ValidateCredentials(ctx context.Context, r *http.Request) (*Identity, error)
+}
+
+var (
+	errNoCredentials      = errors.New("no credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errImpersonation      = errors.New("impersonation not allowed")
+)
+
+// AuthChain 依次尝试多个认证提供者
+type AuthChain []AuthProvider
+
+// ValidateCredentials 返回第一个识别出凭证的提供者的结果
+func (c AuthChain) ValidateCredentials(ctx context.Context, r *http.Request) (*Identity, error) {
+	for _, provider := range c {
+		identity, err := provider.ValidateCredentials(ctx, r)
+		if err == errNoCredentials {
+			continue
+		}
+		return identity, err
+	}
+	return nil, errNoCredentials
+}
+
+// AuthConfig 结构用于配置认证方式
+type AuthConfig struct {
+	Tokens []TokenConfig `json:"tokens"`
+	JWT    *JWTConfig    `json:"jwt"`
+	OIDC   *OIDCConfig   `json:"oidc"`
+	MTLS   *MTLSConfig   `json:"mtls"`
+	// TokenExpiry 静态 token 的过期提醒
+	TokenExpiry TokenExpiryConfig `json:"token_expiry"`
+	// Impersonation 允许 admin 权限的调用方代表其他身份执行操作
+	Impersonation ImpersonationConfig `json:"impersonation"`
+}
+
+// ImpersonationConfig 结构用于配置代理身份，编排服务可以代表用户操作而无需持有用户的凭证
+type ImpersonationConfig struct {
+	Enabled bool `json:"enabled"`
+	// Scopes 为被代理身份的权限，默认 read 和 write，不会继承代理方的 admin 权限
+	Scopes []string `json:"scopes"`
+}
+
+// TokenConfig 结构用于配置一个静态 token
+type TokenConfig struct {
+	Token string `json:"token"`
+	Name  string `json:"name"`
+	// Scopes 为空时拥有所有权限
+	Scopes []string `json:"scopes"`
+	// ExpiresAt 过期时间（RFC 3339 格式），为空时永不过期
+	ExpiresAt time.Time `json:"expires_at"`
+	// Metadata 为附加在 token 上的信息，如出口流量计费使用的计费账号
+	Metadata map[string]string `json:"metadata"`
+	// Priority 为 batch 时该 token 的上传和下载总是排在交互请求之后，用于备份和批量同步
+	Priority string `json:"priority"`
+}
+
+// NewAuthProvider 根据配置创建认证提供者链，兼容顶层的 token 配置
+func NewAuthProvider(config Config) (AuthProvider, error) {
+	var chain AuthChain
+
+	tokens := config.Auth.Tokens
+	if config.Token != "" {
+		tokens = append([]TokenConfig{{Token: config.Token, Name: "default"}}, tokens...)
+	}
+	for _, t := range tokens {
+		if t.Priority != "" && t.Priority != priorityInteractive && t.Priority != priorityBatch {
+			return nil, fmt.Errorf("token %s 的 priority 应为 interactive 或 batch", t.Name)
+		}
+	}
+	if len(tokens) > 0 {
+		chain = append(chain, NewStaticTokenProvider(tokens, config.Auth.TokenExpiry))
+	}
+	if config.Auth.JWT != nil {
+		provider, err := NewJWTProvider(*config.Auth.JWT)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, provider)
+	}
+	if config.Auth.OIDC != nil {
+		chain = append(chain, NewOIDCProvider(*config.Auth.OIDC))
+	}
+	if config.Auth.MTLS != nil && config.Auth.MTLS.Enabled {
+		chain = append(chain, &MTLSProvider{cfg: *config.Auth.MTLS})
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("未配置任何认证方式")
+	}
+	if config.Auth.Impersonation.Enabled {
+		return NewImpersonationProvider(chain, config.Auth.Impersonation), nil
+	}
+	return chain, nil
+}
+
+// ImpersonationProvider 在其他提供者认证通过后，允许 admin 权限的调用方通过 X-On-Behalf-Of 请求头代表其他身份操作
+type ImpersonationProvider struct {
+	next   AuthProvider
+	scopes []string
+}
+
+// NewImpersonationProvider 创建代理身份的提供者
+func NewImpersonationProvider(next AuthProvider, config ImpersonationConfig) *ImpersonationProvider {
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{scopeRead, scopeWrite}
+	}
+	return &ImpersonationProvider{next: next, scopes: scopes}
+}
+
+// ValidateCredentials 认证调用方，请求代理身份时返回被代理的身份，并在 Actor 中记录实际的调用方
+func (p *ImpersonationProvider) ValidateCredentials(ctx context.Context, r *http.Request) (*Identity, error) {
+	identity, err := p.next.ValidateCredentials(ctx, r)
+	subject := strings.TrimSpace(r.Header.Get("X-On-Behalf-Of"))
+	if err != nil || subject == "" || subject == identity.Name {
+		return identity, err
+	}
+	if !identity.HasScope(scopeAdmin) {
+		return nil, errImpersonation
+	}
+	return &Identity{
+		Name:     subject,
+		Provider: identity.Provider,
+		Scopes:   p.scopes,
+		Actor:    identity.Name,
+		Warning:  identity.Warning,
+		Priority: identity.Priority,
+	}, nil
+}
+
+// StaticTokenProvider 使用配置文件中的静态 token 认证
+type StaticTokenProvider struct {
+	tokens []TokenConfig
+	expiry TokenExpiryConfig
+}
+
+// NewStaticTokenProvider 创建静态 token 认证提供者
+func NewStaticTokenProvider(tokens []TokenConfig, expiry TokenExpiryConfig) *StaticTokenProvider {
+	return &StaticTokenProvider{tokens: tokens, expiry: expiry.withDefaults()}
+}
+
+// ValidateCredentials 比较 Authorization 请求头与配置的 token，支持直接传 token 或 Bearer 方式
+func (p *StaticTokenProvider) ValidateCredentials(_ context.Context, r *http.Request) (*Identity, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return nil, errNoCredentials
+	}
+	for _, t := range p.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) != 1 {
+			continue
+		}
+		name := t.Name
+		if name == "" {
+			name = tokenFingerprint(t.Token)
+		}
+		// 过期且超过宽限期的 token 不再有效
+		warning, valid := expiryWarning(t.ExpiresAt, p.expiry, time.Now())
+		if !valid {
+			slog.Warn("token 已过期", "name", name)
+			return nil, errInvalidCredentials
+		}
+		scopes := t.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"*"}
+		}
+		return &Identity{Name: name, Provider: "token", Scopes: scopes, Warning: warning, Metadata: t.Metadata, Priority: t.Priority}, nil
+	}
+	// 看起来像 JWT 的凭证交给后面的提供者处理
+	if strings.Count(token, ".") == 2 {
+		return nil, errNoCredentials
+	}
+	return nil, errInvalidCredentials
+}
+
+// identityKey 是请求上下文中保存调用方身份的键
+type identityKey struct{}
+
+// identityFrom 返回请求的调用方身份，未经过认证时返回 nil
+func identityFrom(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// identityName 返回请求的调用方名称，未经过认证时为空
+func identityName(r *http.Request) string {
+	if identity := identityFrom(r); identity != nil {
+		return identity.Name
+	}
+	return ""
+}
+
+// AuthMiddleware 是用于认证调用方并检查权限的中间件
+func AuthMiddleware(next http.Handler, auth AuthProvider, scope string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := auth.ValidateCredentials(r.Context(), r)
+		if err == errImpersonation {
+			http.Error(w, "Impersonation requires admin scope", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			if err != errNoCredentials && err != errInvalidCredentials {
+				slog.ErrorContext(r.Context(), "认证失败", "err", err)
+			} else {
+				slog.DebugContext(r.Context(), "认证失败", "err", err)
+			}
+			// 返回错误响应
+			anomalyDetector.Unauthorized(r)
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if identity.Warning != "" {
+			w.Header().Set("Warning", identity.Warning)
+		}
+		traceIdentity(r, identity)
+		auditIdentity(r, identity)
+		accessLogIdentity(r, identity)
+		logIdentity(r, identity)
+		debugStage(r, "auth")
+		if identity.Actor != "" {
+			slog.InfoContext(r.Context(), "代理访问", "actor", identity.Actor)
+		}
+		if anomalyDetector.Suspended(identity.Name) || anomalyDetector.Suspended(identity.Actor) {
+			http.Error(w, "Suspended", http.StatusForbidden)
+			return
+		}
+		if !checkRateLimit(w, identity.Name) {
+			return
+		}
+
+		// 检查权限，配置了策略引擎时再由策略引擎决策
+		if !identity.HasScope(scope) {
+			http.Error(w, "Insufficient scope", http.StatusForbidden)
+			return
+		}
+		allowed, err := authorizeRequest(r, identity, scope)
+		if err != nil || !allowed {
+			if err != nil {
+				slog.ErrorContext(r.Context(), "授权失败", "err", err)
+			}
+			http.Error(w, "Forbidden by policy", http.StatusForbidden)
+			return
+		}
+
+		// 只有复制目标的推送可以带 X-Replication，其他调用方带上时忽略，不能借此跳过撤销时间或阻止复制
+		if r.Header.Get(replicationHeader) != "" && !identity.IsReplicationPeer() {
+			slog.WarnContext(r.Context(), "忽略非复制目标的 X-Replication 请求头")
+			r.Header.Del(replicationHeader)
+		}
+
+		// 认证通过，调用下一个处理程序
+		ctx := context.WithValue(r.Context(), identityKey{}, identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// MTLSConfig 结构用于配置客户端证书认证，证书链的校验由 TLS 层完成
+type MTLSConfig struct {
+	Enabled bool     `json:"enabled"`
+	Scopes  []string `json:"scopes"`
+}
+
+// MTLSProvider 使用已通过 TLS 校验的客户端证书认证
+type MTLSProvider struct {
+	cfg MTLSConfig
+}
+
+// ValidateCredentials 以客户端证书的 CN 作为调用方名称
+func (p *MTLSProvider) ValidateCredentials(_ context.Context, r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, errNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	scopes := p.cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{scopeRead}
+	}
+	return &Identity{Name: cert.Subject.CommonName, Provider: "mtls", Scopes: scopes}, nil
+}
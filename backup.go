@@ -0,0 +1,506 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BackupConfig 结构用于配置备份快照
+type BackupConfig struct {
+	// Dir 快照的保存目录，需要与 data 目录位于同一文件系统才能使用硬链接，默认 data/.meta/backups
+	Dir string `json:"dir"`
+	// Interval 定期创建快照的间隔，单位小时，为 0 时只通过 /admin/backup 创建
+	Interval int `json:"interval"`
+	// Keep 保留最近的快照数量，默认 7
+	Keep int `json:"keep"`
+}
+
+// backupManifestName 是快照目录中清单的文件名
+const backupManifestName = "manifest.json"
+
+// backupChecksumsName 是带校验和下载时 tar 末尾的校验和文件，格式与 sha256sum 的输出相同
+const backupChecksumsName = "checksums.sha256"
+
+// BackupInfo 结构描述一个快照
+type BackupInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Files 和 Size 为快照中用户文件的数量和大小，不包括回收站、历史版本和元数据
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+	// MissingChecksums 为索引中没有哈希的文件数量
+	MissingChecksums int `json:"missing_checksums"`
+	// PausedMs 为创建快照时暂停写操作的时长，单位毫秒
+	PausedMs int64 `json:"paused_ms"`
+}
+
+// BackupFile 结构表示快照清单中的一个文件
+type BackupFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// BackupManifest 结构是快照中的清单，恢复后可以用来校验文件
+type BackupManifest struct {
+	BackupInfo
+	Entries []BackupFile `json:"entries"`
+}
+
+var errBackupRunning = errors.New("备份正在进行")
+
+// Backups 结构用于创建和管理备份快照，每个快照是一个目录，包括 data 目录的硬链接副本和清单
+type Backups struct {
+	config BackupConfig
+	// dir 为保存目录的绝对路径，遍历 data 目录时跳过
+	dir string
+
+	// running 保证同一时间只创建一个快照
+	running sync.Mutex
+}
+
+// backups 管理备份快照
+var backups *Backups
+
+// NewBackups 创建备份快照管理
+func NewBackups(config BackupConfig) (*Backups, error) {
+	if config.Dir == "" {
+		config.Dir = filepath.Join("data", metaDirName, "backups")
+	}
+	if config.Keep <= 0 {
+		config.Keep = 7
+	}
+	dir, err := filepath.Abs(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Backups{config: config, dir: dir}, nil
+}
+
+// Create 创建一个快照：暂停写操作，保存索引并为 data 目录中的文件创建硬链接，之后恢复写操作再生成清单；
+// retain 为 false 时不删除超出保留数量的旧快照，用于下载后即删除的快照
+func (b *Backups) Create(now time.Time, retain bool) (BackupInfo, error) {
+	if !b.running.TryLock() {
+		return BackupInfo{}, errBackupRunning
+	}
+	defer b.running.Unlock()
+
+	info := BackupInfo{ID: now.UTC().Format("20060102T150405Z"), CreatedAt: now.UTC()}
+	target := filepath.Join(b.dir, info.ID)
+	if _, err := os.Stat(target); err == nil {
+		return info, fmt.Errorf("快照 %s 已存在", info.ID)
+	}
+	// 先在临时目录中创建，完成后重命名，保存目录中不会出现不完整的快照
+	tmp := filepath.Join(b.dir, ".tmp-"+info.ID)
+	err := os.MkdirAll(tmp, os.ModePerm)
+	if err != nil {
+		return info, err
+	}
+
+	// 只有创建硬链接期间暂停写操作，不复制文件内容，暂停时间很短
+	resume := maintenanceGate.PauseWrites()
+	start := time.Now()
+	err = metaIndex.Save()
+	if err == nil {
+		err = b.link(filepath.Join(tmp, "data"))
+	}
+	info.PausedMs = time.Since(start).Milliseconds()
+	resume()
+
+	var manifest BackupManifest
+	if err == nil {
+		manifest, err = buildBackupManifest(info, filepath.Join(tmp, "data"))
+	}
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(manifest)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(tmp, backupManifestName), data, 0644)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return info, err
+	}
+	if retain {
+		b.prune()
+	}
+	return manifest.BackupInfo, nil
+}
+
+// link 将 data 目录复制到 dst：用户文件、回收站和历史版本创建硬链接，元数据文件直接复制；
+// 跳过缩略图缓存、去重的内容池、临时文件、预写日志和快照的保存目录
+func (b *Backups) link(dst string) error {
+	return filepath.WalkDir("data", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel("data", path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			if b.skip(rel, path) {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		// 元数据文件可能被原地覆盖，复制一份才不会随之变化
+		if strings.SplitN(filepath.ToSlash(rel), "/", 2)[0] == metaDirName {
+			err = copyBackupFile(path, target)
+		} else {
+			err = os.Link(path, target)
+			if errors.Is(err, syscall.EXDEV) {
+				err = copyBackupFile(path, target)
+			}
+		}
+		// 后台任务在遍历期间删除的文件不在快照中
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// skip 判断遍历 data 目录时是否跳过该目录
+func (b *Backups) skip(rel string, path string) bool {
+	switch filepath.ToSlash(rel) {
+	case thumbsDirName, blobsDirName, metaDirName + "/tmp", metaDirName + "/journal":
+		return true
+	}
+	abs, err := filepath.Abs(path)
+	return err == nil && abs == b.dir
+}
+
+// copyBackupFile 复制文件并保留修改时间
+func copyBackupFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func(in *os.File) {
+		_ = in.Close()
+	}(in)
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// buildBackupManifest 按快照中的用户文件生成清单，哈希取自索引，文件在快照之后被修改时留空
+func buildBackupManifest(info BackupInfo, root string) (BackupManifest, error) {
+	manifest := BackupManifest{BackupInfo: info, Entries: []BackupFile{}}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := indexKey(filepath.ToSlash(rel))
+		if d.IsDir() {
+			if isReservedPath(key) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := BackupFile{Path: key, Size: fileInfo.Size(), ModTime: fileInfo.ModTime().UTC()}
+		meta, ok := metaIndex.Get(key)
+		if ok && meta.SHA256 != "" && meta.Size == fileInfo.Size() && meta.ModTime.Equal(fileInfo.ModTime()) {
+			entry.SHA256 = meta.SHA256
+		} else {
+			manifest.MissingChecksums++
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		manifest.Files++
+		manifest.Size += fileInfo.Size()
+		return nil
+	})
+	return manifest, err
+}
+
+// List 返回所有快照，从旧到新排列
+func (b *Backups) List() ([]BackupInfo, error) {
+	entries, err := os.ReadDir(b.dir)
+	if os.IsNotExist(err) {
+		return []BackupInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	infos := []BackupInfo{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(b.dir, entry.Name(), backupManifestName))
+		if err != nil {
+			slog.Error("读取快照清单失败", "err", err)
+			continue
+		}
+		var info BackupInfo
+		err = json.Unmarshal(data, &info)
+		if err != nil {
+			slog.Error("解析快照清单失败", "name", entry.Name(), "err", err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	// 快照 ID 中的时间可以按字符串排序
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+// Remove 删除快照
+func (b *Backups) Remove(id string) error {
+	return os.RemoveAll(filepath.Join(b.dir, id))
+}
+
+// prune 删除超出保留数量的旧快照和中断后残留的临时目录
+func (b *Backups) prune() {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return
+	}
+	var ids []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			err = os.RemoveAll(filepath.Join(b.dir, entry.Name()))
+			if err != nil {
+				slog.Error("删除残留的快照失败", "err", err)
+			}
+			continue
+		}
+		ids = append(ids, entry.Name())
+	}
+	sort.Strings(ids)
+	for len(ids) > b.config.Keep {
+		err = b.Remove(ids[0])
+		if err != nil {
+			slog.Error("删除旧快照失败", "err", err)
+		}
+		ids = ids[1:]
+	}
+}
+
+// WriteTar 以 tar 格式输出快照，清单在最前面；checksums 为 true 时每个文件在 PAX 扩展头中记录 SHA-256，
+// 并在末尾写入 checksums.sha256，解压后可以用 sha256sum -c 离线校验
+func (b *Backups) WriteTar(w io.Writer, id string, checksums bool) error {
+	root := filepath.Join(b.dir, id)
+	writer := tar.NewWriter(w)
+	var sums *bytes.Buffer
+	if checksums {
+		sums = &bytes.Buffer{}
+	}
+	err := addTarFile(writer, filepath.Join(root, backupManifestName), backupManifestName, sums)
+	if err != nil {
+		return err
+	}
+	dataRoot := filepath.Join(root, "data")
+	err = filepath.WalkDir(dataRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return addTarFile(writer, path, filepath.ToSlash(rel), sums)
+	})
+	if err != nil {
+		return err
+	}
+	if sums != nil {
+		err = writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     backupChecksumsName,
+			Size:     int64(sums.Len()),
+			Mode:     0644,
+			ModTime:  time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(sums.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// addTarFile 将文件或目录写入 tar；sums 不为 nil 时先读取一遍文件计算 SHA-256，记录在 PAX 扩展头中并追加到 sums，
+// 哈希为 tar 中的内容，启用加密或压缩时与索引中的哈希不同
+func addTarFile(writer *tar.Writer, path string, name string, sums *bytes.Buffer) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+		return writer.WriteHeader(header)
+	}
+	if sums != nil {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		header.Format = tar.FormatPAX
+		header.PAXRecords = map[string]string{ociSHA256Record: sum}
+		_, _ = fmt.Fprintf(sums, "%s  %s\n", sum, name)
+	}
+	err = writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// fileSHA256 计算文件在磁盘上的原始内容的 SHA-256
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Run 按间隔定期创建快照
+func (b *Backups) Run() {
+	ticker := time.NewTicker(time.Duration(b.config.Interval) * time.Hour)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		info, err := b.Create(now, true)
+		if err != nil {
+			slog.Error("创建备份快照失败", "err", err)
+			continue
+		}
+		slog.Info("已创建备份快照", "id", info.ID, "files", info.Files, "paused_ms", info.PausedMs)
+	}
+}
+
+// 列出、创建或下载备份快照：GET 列出快照，带 id 时以 tar 格式下载该快照；
+// POST 创建快照，format=tar 时以 tar 格式返回新的快照并在返回后删除
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			infos, err := backups.List()
+			if err != nil {
+				sendJSONResponse(w, http.StatusInternalServerError, "读取快照失败", err, r.URL.Path)
+				return
+			}
+			sendContentResponse(w, http.StatusOK, "success", infos, nil, r.URL.Path)
+			return
+		}
+		if id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+			sendJSONResponse(w, http.StatusBadRequest, "非法的快照 ID", nil, r.URL.Path)
+			return
+		}
+		if _, err := os.Stat(filepath.Join(backups.dir, id, backupManifestName)); err != nil {
+			sendJSONResponse(w, http.StatusNotFound, "快照不存在", err, r.URL.Path)
+			return
+		}
+		sendBackupTar(w, r, id)
+	case http.MethodPost:
+		tarFormat := r.URL.Query().Get("format") == "tar"
+		info, err := backups.Create(time.Now(), !tarFormat)
+		if err == errBackupRunning {
+			sendJSONResponse(w, http.StatusConflict, "备份正在进行，请稍后重试", err, r.URL.Path)
+			return
+		} else if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "创建备份快照失败", err, r.URL.Path)
+			return
+		}
+		if !tarFormat {
+			sendContentResponse(w, http.StatusOK, "success", info, nil, r.URL.Path)
+			return
+		}
+		sendBackupTar(w, r, info.ID)
+		err = backups.Remove(info.ID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "删除已下载的快照失败", "err", err)
+		}
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+	}
+}
+
+// sendBackupTar 以 tar 格式返回快照，开始输出后出错时只能记录日志，客户端收到的 tar 不完整
+func sendBackupTar(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"backup-%s.tar\"", id))
+	err := backups.WriteTar(w, id, r.URL.Query().Get("checksums") == "1")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "输出备份快照失败", "id", id, "err", err)
+		return
+	}
+}
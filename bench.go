@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchOptions 是压测命令的参数
+type benchOptions struct {
+	url         string
+	token       string
+	workload    string
+	concurrency int
+	duration    time.Duration
+	size        int
+	prefix      string
+}
+
+// benchResult 记录某一类操作的耗时和传输量
+type benchResult struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	bytes     int64
+	errors    int
+}
+
+func (b *benchResult) add(latency time.Duration, n int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.errors++
+		return
+	}
+	b.latencies = append(b.latencies, latency)
+	b.bytes += n
+}
+
+// benchCommand 对运行中的实例执行上传、下载、列目录压测，并输出吞吐量和延迟分位数
+func benchCommand(args []string) int {
+	var opts benchOptions
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.StringVar(&opts.url, "url", "http://127.0.0.1:8082", "目标实例地址")
+	flags.StringVar(&opts.token, "token", "", "访问 token，为空时读取 config.json")
+	flags.StringVar(&opts.workload, "workload", "mixed", "压测类型：upload、download、list 或 mixed")
+	flags.IntVar(&opts.concurrency, "concurrency", 8, "并发数")
+	flags.DurationVar(&opts.duration, "duration", 10*time.Second, "压测时长")
+	flags.IntVar(&opts.size, "size", 1<<20, "上传和下载的文件大小，单位字节")
+	flags.StringVar(&opts.prefix, "prefix", "_bench", "压测文件存放的目录，结束后会被删除")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	opts.url = strings.TrimRight(opts.url, "/")
+	if opts.token == "" {
+		config, err := LoadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			return 1
+		}
+		opts.token = config.Token
+	}
+
+	ops := map[string]func(client *http.Client, worker int, n int) (int64, error){
+		"upload":   opts.upload,
+		"download": opts.download,
+		"list":     opts.list,
+	}
+	var names []string
+	switch opts.workload {
+	case "mixed":
+		names = []string{"upload", "download", "list"}
+	case "upload", "download", "list":
+		names = []string{opts.workload}
+	default:
+		fmt.Fprintf(os.Stderr, "未知的压测类型: %s\n", opts.workload)
+		return 2
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	payload := make([]byte, opts.size)
+	_, _ = rand.Read(payload)
+
+	// 下载需要预先为每个并发准备一个文件
+	for worker := 0; worker < opts.concurrency; worker++ {
+		_, err := opts.put(client, opts.seedPath(worker), payload)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: 准备压测文件失败 %s\n", err)
+			return 1
+		}
+	}
+
+	results := map[string]*benchResult{}
+	for _, name := range names {
+		results[name] = &benchResult{}
+	}
+
+	fmt.Printf("压测 %s，类型 %s，并发 %d，时长 %s\n", opts.url, opts.workload, opts.concurrency, opts.duration)
+	deadline := time.Now().Add(opts.duration)
+	var wg sync.WaitGroup
+	for worker := 0; worker < opts.concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; time.Now().Before(deadline); n++ {
+				name := names[mrand.Intn(len(names))]
+				start := time.Now()
+				transferred, err := ops[name](client, worker, n)
+				results[name].add(time.Since(start), transferred, err)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	for _, name := range names {
+		printBenchResult(name, results[name], opts.duration)
+	}
+
+	err = opts.cleanup(client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 清理压测文件失败 %s\n", err)
+	}
+	return 0
+}
+
+func (o *benchOptions) seedPath(worker int) string {
+	return fmt.Sprintf("%s/seed-%d.bin", o.prefix, worker)
+}
+
+func (o *benchOptions) upload(client *http.Client, worker int, n int) (int64, error) {
+	payload := make([]byte, o.size)
+	_, _ = rand.Read(payload)
+	return o.put(client, fmt.Sprintf("%s/w%d/%d.bin", o.prefix, worker, n%100), payload)
+}
+
+func (o *benchOptions) download(client *http.Client, worker int, _ int) (int64, error) {
+	resp, err := client.Get(o.url + "/get/" + o.seedPath(worker))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("下载返回 %s", resp.Status)
+	}
+	return n, nil
+}
+
+func (o *benchOptions) list(client *http.Client, _ int, _ int) (int64, error) {
+	body, _ := json.Marshal(map[string]string{"path": o.prefix})
+	return o.post(client, "/list", body)
+}
+
+func (o *benchOptions) cleanup(client *http.Client) error {
+	body, _ := json.Marshal(map[string]string{"path": o.prefix})
+	_, err := o.post(client, "/delete", body)
+	return err
+}
+
+// put 以 multipart 表单上传文件，返回上传的字节数
+func (o *benchOptions) put(client *http.Client, path string, payload []byte) (int64, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, err := writer.CreateFormFile("file", "bench.bin")
+	if err != nil {
+		return 0, err
+	}
+	_, err = part.Write(payload)
+	if err != nil {
+		return 0, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.url+"/upload", &buf)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", o.token)
+	req.Header.Set("X-FormFile-Path", path)
+	_, err = o.do(client, req)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(payload)), nil
+}
+
+// post 发送 JSON 请求，返回响应体的字节数
+func (o *benchOptions) post(client *http.Client, endpoint string, body []byte) (int64, error) {
+	req, err := http.NewRequest(http.MethodPost, o.url+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", o.token)
+	return o.do(client, req)
+}
+
+func (o *benchOptions) do(client *http.Client, req *http.Request) (int64, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s 返回 %s", req.URL.Path, resp.Status)
+	}
+	return n, nil
+}
+
+// printBenchResult 输出单类操作的吞吐量和延迟分位数
+func printBenchResult(name string, result *benchResult, duration time.Duration) {
+	latencies := result.latencies
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		i := int(math.Ceil(p*float64(len(latencies)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return latencies[i]
+	}
+
+	seconds := duration.Seconds()
+	fmt.Printf("%-8s 请求 %d  失败 %d  %.1f req/s  %.2f MB/s  p50 %s  p90 %s  p99 %s  max %s\n",
+		name, len(latencies), result.errors,
+		float64(len(latencies))/seconds, float64(result.bytes)/seconds/(1<<20),
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CatalogConfig 结构用于配置工具二进制的发布目录，制品按 名称/版本/平台/文件名 保存在 Prefix 目录下
+type CatalogConfig struct {
+	Enabled bool `json:"enabled"`
+	// Prefix 保存制品的目录，默认 catalog
+	Prefix string `json:"prefix"`
+	// AllowOverwrite 为 true 时允许覆盖已发布的版本，默认已发布的版本不可修改，固定版本的调用方总是得到相同的内容
+	AllowOverwrite bool `json:"allow_overwrite"`
+	// MirrorTimeout 从上游镜像制品的超时时间，单位秒，默认 600
+	MirrorTimeout int `json:"mirror_timeout"`
+}
+
+// catalogPlatformAny 是与平台无关的制品（如脚本）使用的平台名称，指定的平台没有制品时使用
+const catalogPlatformAny = "any"
+
+// catalogComponent 限制名称、版本、平台和渠道中可以使用的字符
+var catalogComponent = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+var (
+	errCatalogNotFound  = errors.New("没有匹配的版本")
+	errCatalogPublished = errors.New("该版本已发布，不能覆盖")
+	errCatalogLayout    = errors.New("制品路径应为 名称/版本/平台/文件名")
+)
+
+// CatalogArtifact 结构表示一个已发布的制品
+type CatalogArtifact struct {
+	Name     string    `json:"name"`
+	Version  string    `json:"version"`
+	Platform string    `json:"platform"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256,omitempty"`
+	ModTime  time.Time `json:"mod_time"`
+	// URL 为下载地址
+	URL string `json:"url"`
+}
+
+// Catalog 结构用于按坐标查找制品，渠道固定的版本保存在 data/.meta/catalog_pins.json
+type Catalog struct {
+	config CatalogConfig
+	client *http.Client
+	file   string
+
+	mu sync.Mutex
+	// pins 为每个名称下渠道固定的版本，如 tool -> stable -> 1.4.2
+	pins map[string]map[string]string
+}
+
+// catalog 未启用发布目录时为 nil
+var catalog *Catalog
+
+// NewCatalog 创建发布目录并加载渠道固定的版本
+func NewCatalog(config CatalogConfig, file string) (*Catalog, error) {
+	config.Prefix = indexKey(config.Prefix)
+	if config.Prefix == "" {
+		config.Prefix = "catalog"
+	}
+	if isReservedPath(config.Prefix) {
+		return nil, fmt.Errorf("catalog.prefix 不能使用保留目录 %s", config.Prefix)
+	}
+	if config.MirrorTimeout <= 0 {
+		config.MirrorTimeout = 600
+	}
+	c := &Catalog{
+		config: config,
+		client: &http.Client{Timeout: time.Duration(config.MirrorTimeout) * time.Second},
+		file:   file,
+		pins:   map[string]map[string]string{},
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &c.pins)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// artifactKey 返回制品的存储路径
+func (c *Catalog) artifactKey(name string, version string, platform string, filename string) string {
+	return path.Join(c.config.Prefix, name, version, platform, filename)
+}
+
+// parseKey 解析发布目录中的存储路径，不在发布目录中时返回 false
+func (c *Catalog) parseKey(key string) (name string, version string, platform string, filename string, ok bool, err error) {
+	if !strings.HasPrefix(key, c.config.Prefix+"/") {
+		return "", "", "", "", false, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(key, c.config.Prefix+"/"), "/")
+	if len(parts) != 4 {
+		return "", "", "", "", true, errCatalogLayout
+	}
+	for _, part := range parts[:3] {
+		if !catalogComponent.MatchString(part) {
+			return "", "", "", "", true, fmt.Errorf("名称、版本和平台只能包含字母、数字和 ._+-：%q", part)
+		}
+	}
+	return parts[0], parts[1], parts[2], parts[3], true, nil
+}
+
+// CheckPublish 在写入发布目录之前检查路径格式，已发布的版本不允许覆盖；不在发布目录中的路径不检查
+func (c *Catalog) CheckPublish(key string) error {
+	if c == nil {
+		return nil
+	}
+	_, _, _, _, ok, err := c.parseKey(key)
+	if !ok || err != nil {
+		return err
+	}
+	if c.config.AllowOverwrite {
+		return nil
+	}
+	_, err = os.Stat(filepath.Join("data", filepath.FromSlash(key)))
+	if err == nil {
+		return errCatalogPublished
+	}
+	return nil
+}
+
+// checkCatalogPublish 检查上传是否可以写入该路径，不可以时已写入响应
+func checkCatalogPublish(w http.ResponseWriter, r *http.Request, key string) bool {
+	err := catalog.CheckPublish(key)
+	if err == errCatalogPublished {
+		sendJSONResponse(w, http.StatusConflict, "该版本已发布，不能覆盖", err, r.URL.Path)
+		return false
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的发布目录路径", err, r.URL.Path)
+		return false
+	}
+	return true
+}
+
+// Artifacts 返回名称下所有已发布的制品，同一版本和平台下有多个文件时只取文件名最小的一个
+func (c *Catalog) Artifacts(name string) ([]CatalogArtifact, error) {
+	var artifacts []CatalogArtifact
+	root := filepath.Join("data", filepath.FromSlash(path.Join(c.config.Prefix, name)))
+	versions, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if !version.IsDir() {
+			continue
+		}
+		platforms, err := os.ReadDir(filepath.Join(root, version.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, platform := range platforms {
+			if !platform.IsDir() {
+				continue
+			}
+			files, err := os.ReadDir(filepath.Join(root, version.Name(), platform.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				if file.IsDir() {
+					continue
+				}
+				info, err := file.Info()
+				if err != nil {
+					continue
+				}
+				key := c.artifactKey(name, version.Name(), platform.Name(), file.Name())
+				artifact := CatalogArtifact{
+					Name:     name,
+					Version:  version.Name(),
+					Platform: platform.Name(),
+					Path:     key,
+					Size:     info.Size(),
+					ModTime:  info.ModTime(),
+					URL:      "/get/" + escapeKey(key),
+				}
+				if meta, ok := metaIndex.Get(key); ok && meta.ModTime.Equal(info.ModTime()) {
+					artifact.Size = meta.Size
+					artifact.SHA256 = meta.SHA256
+				}
+				artifacts = append(artifacts, artifact)
+				break
+			}
+		}
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		if cmp := compareCatalogVersions(artifacts[i].Version, artifacts[j].Version); cmp != 0 {
+			return cmp > 0
+		}
+		return artifacts[i].Platform < artifacts[j].Platform
+	})
+	return artifacts, nil
+}
+
+// Names 返回所有已发布的名称
+func (c *Catalog) Names() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join("data", filepath.FromSlash(c.config.Prefix)))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// splitCatalogVersion 将版本拆分为正式版本部分和预发布部分，忽略开头的 v
+func splitCatalogVersion(version string) (string, string) {
+	version = strings.TrimPrefix(strings.TrimPrefix(version, "v"), "V")
+	release, prerelease, _ := strings.Cut(version, "-")
+	return release, prerelease
+}
+
+// compareCatalogVersions 按语义化版本比较两个版本，数字部分按数值比较，预发布版本小于对应的正式版本
+func compareCatalogVersions(a string, b string) int {
+	releaseA, preA := splitCatalogVersion(a)
+	releaseB, preB := splitCatalogVersion(b)
+	partsA := strings.Split(releaseA, ".")
+	partsB := strings.Split(releaseB, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		if i >= len(partsA) {
+			return -1
+		}
+		if i >= len(partsB) {
+			return 1
+		}
+		if cmp := compareVersionPart(partsA[i], partsB[i]); cmp != 0 {
+			return cmp
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return compareVersionPart(preA, preB)
+}
+
+// compareVersionPart 比较版本中的一段，都是数字时按数值比较，否则按字符串比较
+func compareVersionPart(a string, b string) int {
+	numberA, errA := strconv.ParseUint(a, 10, 64)
+	numberB, errB := strconv.ParseUint(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case numberA < numberB:
+			return -1
+		case numberA > numberB:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// matchesCatalogConstraint 判断版本是否满足约束：latest 或空匹配所有版本，其他约束匹配相同的版本或以其为前缀的版本，
+// 如 1.2 匹配 1.2、1.2.0 和 1.2.7，不匹配 1.20
+func matchesCatalogConstraint(version string, constraint string) bool {
+	if constraint == "" || constraint == "latest" {
+		return true
+	}
+	v := strings.TrimPrefix(strings.TrimPrefix(version, "v"), "V")
+	c := strings.TrimPrefix(strings.TrimPrefix(constraint, "v"), "V")
+	return v == c || strings.HasPrefix(v, c+".") || strings.HasPrefix(v, c+"-")
+}
+
+// Resolve 返回满足约束的最新版本在指定平台上的制品：约束可以是渠道名、latest、完整的版本或版本前缀；
+// 除非约束本身是预发布版本或 prerelease 为 true，否则不选择预发布版本；指定平台没有制品时使用 any 平台的制品
+func (c *Catalog) Resolve(name string, constraint string, platform string, prerelease bool) (CatalogArtifact, error) {
+	c.mu.Lock()
+	if pinned, ok := c.pins[name][constraint]; ok {
+		constraint = pinned
+	}
+	c.mu.Unlock()
+	if platform == "" {
+		platform = catalogPlatformAny
+	}
+	artifacts, err := c.Artifacts(name)
+	if err != nil {
+		return CatalogArtifact{}, err
+	}
+	_, constraintPre := splitCatalogVersion(constraint)
+	for _, artifact := range artifacts {
+		if !matchesCatalogConstraint(artifact.Version, constraint) {
+			continue
+		}
+		_, pre := splitCatalogVersion(artifact.Version)
+		if pre != "" && !prerelease && constraintPre == "" && compareCatalogVersions(artifact.Version, constraint) != 0 {
+			continue
+		}
+		// 同一版本的制品相邻，平台匹配的优先于 any
+		var fallback *CatalogArtifact
+		for _, candidate := range artifacts {
+			if candidate.Version != artifact.Version {
+				continue
+			}
+			if candidate.Platform == platform {
+				return candidate, nil
+			}
+			if candidate.Platform == catalogPlatformAny {
+				found := candidate
+				fallback = &found
+			}
+		}
+		if fallback != nil {
+			return *fallback, nil
+		}
+	}
+	return CatalogArtifact{}, errCatalogNotFound
+}
+
+// Pins 返回名称下渠道固定的版本
+func (c *Catalog) Pins(name string) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pins := map[string]string{}
+	for channel, version := range c.pins[name] {
+		pins[channel] = version
+	}
+	return pins
+}
+
+// Pin 将渠道固定到版本，version 为空时删除该渠道
+func (c *Catalog) Pin(name string, channel string, version string) error {
+	c.mu.Lock()
+	if version == "" {
+		delete(c.pins[name], channel)
+		if len(c.pins[name]) == 0 {
+			delete(c.pins, name)
+		}
+	} else {
+		if c.pins[name] == nil {
+			c.pins[name] = map[string]string{}
+		}
+		c.pins[name][channel] = version
+	}
+	data, err := json.Marshal(c.pins)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(c.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := c.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, c.file)
+}
+
+// CatalogEntry 结构表示一个名称下的所有制品和渠道
+type CatalogEntry struct {
+	Name      string            `json:"name"`
+	Pins      map[string]string `json:"pins"`
+	Artifacts []CatalogArtifact `json:"artifacts"`
+}
+
+// 列出发布目录，不带 name 时返回所有名称，带 name 时返回该名称下的制品（按版本从新到旧）和渠道
+func catalogHandler(w http.ResponseWriter, r *http.Request) {
+	if catalog == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用发布目录", nil, r.URL.Path)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		names, err := catalog.Names()
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "读取发布目录失败", err, r.URL.Path)
+			return
+		}
+		sendContentResponse(w, http.StatusOK, "success", names, nil, r.URL.Path)
+		return
+	}
+	if !catalogComponent.MatchString(name) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的名称", nil, r.URL.Path)
+		return
+	}
+	artifacts, err := catalog.Artifacts(name)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "读取发布目录失败", err, r.URL.Path)
+		return
+	}
+	if artifacts == nil {
+		artifacts = []CatalogArtifact{}
+	}
+	sendContentResponse(w, http.StatusOK, "success", CatalogEntry{Name: name, Pins: catalog.Pins(name), Artifacts: artifacts}, nil, r.URL.Path)
+}
+
+// resolveCatalogRequest 按请求参数解析制品，失败时已写入响应
+func resolveCatalogRequest(w http.ResponseWriter, r *http.Request, name string, version string, platform string) (CatalogArtifact, bool) {
+	if catalog == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用发布目录", nil, r.URL.Path)
+		return CatalogArtifact{}, false
+	}
+	if !catalogComponent.MatchString(name) || (platform != "" && !catalogComponent.MatchString(platform)) ||
+		(version != "" && !catalogComponent.MatchString(version)) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的名称、版本或平台", nil, r.URL.Path)
+		return CatalogArtifact{}, false
+	}
+	prerelease := r.URL.Query().Get("prerelease") == "true"
+	artifact, err := catalog.Resolve(name, version, platform, prerelease)
+	if err == errCatalogNotFound {
+		sendJSONResponse(w, http.StatusNotFound, "没有匹配的版本", err, r.URL.Path)
+		return CatalogArtifact{}, false
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "读取发布目录失败", err, r.URL.Path)
+		return CatalogArtifact{}, false
+	}
+	// 调用方需要用哈希校验下载的制品，索引中没有时计算并缓存
+	if artifact.SHA256 == "" {
+		fullPath, fileInfo, err := statReadPath(artifact.Path)
+		if err == nil {
+			_, artifact.SHA256, err = statContent(artifact.Path, fullPath, fileInfo)
+		}
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+			return CatalogArtifact{}, false
+		}
+	}
+	return artifact, true
+}
+
+// 解析满足约束的最新版本，version 可以是渠道名、latest、完整版本或版本前缀
+func catalogResolveHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	artifact, ok := resolveCatalogRequest(w, r, query.Get("name"), query.Get("version"), query.Get("platform"))
+	if !ok {
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", artifact, nil, r.URL.Path)
+}
+
+// 按坐标 /catalog/download/名称/版本约束/平台 下载制品，重定向到 /get/ 以复用范围请求、缓存和下载统计
+func catalogDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/catalog/download/"), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		sendJSONResponse(w, http.StatusBadRequest, "下载路径应为 /catalog/download/名称/版本/平台", nil, r.URL.Path)
+		return
+	}
+	platform := ""
+	if len(parts) == 3 {
+		platform = parts[2]
+	}
+	artifact, ok := resolveCatalogRequest(w, r, parts[0], parts[1], platform)
+	if !ok {
+		return
+	}
+	w.Header().Set("X-Catalog-Version", artifact.Version)
+	w.Header().Set("X-Catalog-Platform", artifact.Platform)
+	if artifact.SHA256 != "" {
+		w.Header().Set("X-Content-SHA256", artifact.SHA256)
+	}
+	http.Redirect(w, r, artifact.URL, http.StatusFound)
+}
+
+// CatalogPinRequest 结构用于将渠道固定到版本
+type CatalogPinRequest struct {
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+	// Version 为空时删除该渠道
+	Version string `json:"version"`
+}
+
+// 将渠道（如 stable）固定到已发布的版本，调用方以渠道名作为版本约束即可得到固定的版本
+func catalogPinHandler(w http.ResponseWriter, r *http.Request) {
+	if catalog == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用发布目录", nil, r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+		return
+	}
+	var request CatalogPinRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Name == "" || request.Channel == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	if !catalogComponent.MatchString(request.Name) || !catalogComponent.MatchString(request.Channel) ||
+		(request.Version != "" && !catalogComponent.MatchString(request.Version)) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的名称、渠道或版本", nil, r.URL.Path)
+		return
+	}
+	if request.Channel == "latest" {
+		sendJSONResponse(w, http.StatusBadRequest, "latest 不能作为渠道名", nil, r.URL.Path)
+		return
+	}
+	if request.Version != "" {
+		artifacts, err := catalog.Artifacts(request.Name)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "读取发布目录失败", err, r.URL.Path)
+			return
+		}
+		found := false
+		for _, artifact := range artifacts {
+			if artifact.Version == request.Version {
+				found = true
+				break
+			}
+		}
+		if !found {
+			sendJSONResponse(w, http.StatusNotFound, "该版本未发布", nil, r.URL.Path)
+			return
+		}
+	}
+	err = catalog.Pin(request.Name, request.Channel, request.Version)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "保存渠道失败", err, r.URL.Path)
+		return
+	}
+	slog.InfoContext(r.Context(), "已固定渠道版本", "name", request.Name, "channel", request.Channel, "version", request.Version)
+	sendContentResponse(w, http.StatusOK, "success", catalog.Pins(request.Name), nil, r.URL.Path)
+}
+
+// CatalogMirrorRequest 结构用于从上游地址镜像制品
+type CatalogMirrorRequest struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Platform string `json:"platform"`
+	// URL 为上游的下载地址
+	URL string `json:"url"`
+	// Filename 为保存的文件名，为空时取 URL 的最后一段
+	Filename string `json:"filename"`
+	// SHA256 为上游公布的哈希，不一致时不保存
+	SHA256 string `json:"sha256"`
+}
+
+// 从上游地址下载制品并发布到发布目录，与上传一样检查配额、扫描病毒并复制到其他实例
+func catalogMirrorHandler(w http.ResponseWriter, r *http.Request) {
+	if catalog == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用发布目录", nil, r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+		return
+	}
+	var request CatalogMirrorRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Name == "" || request.Version == "" || request.Platform == "" || request.URL == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	if !strings.HasPrefix(request.URL, "http://") && !strings.HasPrefix(request.URL, "https://") {
+		sendJSONResponse(w, http.StatusBadRequest, "上游地址应为 http 或 https", nil, r.URL.Path)
+		return
+	}
+	if request.Filename == "" {
+		request.Filename = path.Base(strings.SplitN(strings.SplitN(request.URL, "?", 2)[0], "#", 2)[0])
+	}
+	if request.Filename == "" || request.Filename == "." || request.Filename == "/" || strings.Contains(request.Filename, "/") {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的文件名", nil, r.URL.Path)
+		return
+	}
+	// 名称、版本和平台中的 .. 会使制品保存到发布目录之外
+	if isUnsafePath(request.Name + "/" + request.Version + "/" + request.Platform + "/" + request.Filename) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的名称、版本或平台", nil, r.URL.Path)
+		return
+	}
+	key := catalog.artifactKey(request.Name, request.Version, request.Platform, request.Filename)
+	err = checkPathLength(key)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "存储路径过长", err, r.URL.Path)
+		return
+	}
+	if !checkCatalogPublish(w, r, key) {
+		return
+	}
+	release := lockWritePath(w, r, key, "镜像制品", true)
+	if release == nil {
+		return
+	}
+	defer release()
+	if !checkWORM(w, r, key) {
+		return
+	}
+
+	resp, err := catalog.client.Get(request.URL)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadGateway, "下载上游制品失败", err, r.URL.Path)
+		return
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		sendJSONResponse(w, http.StatusBadGateway, "下载上游制品失败", fmt.Errorf("上游返回 %s", resp.Status), r.URL.Path)
+		return
+	}
+	err = diskGuard.Check(resp.ContentLength)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInsufficientStorage, "磁盘剩余空间不足", err, r.URL.Path)
+		return
+	}
+
+	tmpFile, tmpPath, err := createTempDataFile(key, identityName(r))
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "创建文件失败", err, r.URL.Path)
+		return
+	}
+	defer func(tmpPath string) {
+		// 成功时临时文件已被重命名，这里只清理失败留下的文件
+		err := os.Remove(tmpPath)
+		if err != nil && !os.IsNotExist(err) {
+			slog.ErrorContext(r.Context(), "清理临时文件失败", "err", err)
+		}
+	}(tmpPath)
+	sha256Hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, sha256Hash), resp.Body)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadGateway, "下载上游制品失败", err, r.URL.Path)
+		return
+	}
+	result := UploadResult{Path: key, Size: size, SHA256: hex.EncodeToString(sha256Hash.Sum(nil))}
+	if request.SHA256 != "" && !strings.EqualFold(request.SHA256, result.SHA256) {
+		sendContentResponse(w, http.StatusBadRequest, "SHA-256 校验失败", result, nil, r.URL.Path)
+		return
+	}
+	newFilePath := filepath.Join("data", filepath.FromSlash(key))
+	err = os.MkdirAll(filepath.Dir(newFilePath), os.ModePerm)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "创建目录失败", err, r.URL.Path)
+		return
+	}
+	slog.InfoContext(r.Context(), "已镜像制品", "source", request.URL, "key", key)
+	storeUploadedFile(w, r, tmpPath, newFilePath, result, 0, "")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CDNSignConfig 结构用于配置 CDN 能够识别的签名链接格式，CDN 边缘节点缓存的文件仍按有效期和路径校验
+type CDNSignConfig struct {
+	// Scheme 签名格式：cloudfront 为 CloudFront 签名 URL（canned policy），hmac_path 为路径中携带 HMAC token
+	Scheme string `json:"scheme"`
+	// BaseURL 是 CDN 的访问地址，如 https://d111111abcdef8.cloudfront.net
+	BaseURL string `json:"base_url"`
+	// KeyPairID 和 PrivateKey 是 CloudFront 的公钥 ID 和对应的 PEM 私钥
+	KeyPairID  string `json:"key_pair_id"`
+	PrivateKey string `json:"private_key"`
+	// Secret 是 hmac_path 的密钥，CDN 边缘（如 Worker、nginx）和本服务使用同一个密钥校验，为空时使用 sign.secret
+	Secret string `json:"secret"`
+}
+
+// cdnSigner 结构用于生成 CDN 签名链接
+type cdnSigner struct {
+	config     CDNSignConfig
+	privateKey *rsa.PrivateKey
+	secret     []byte
+}
+
+// newCDNSigner 根据配置创建 CDN 签名器，未配置 scheme 时返回 nil
+func newCDNSigner(config CDNSignConfig, secret []byte) (*cdnSigner, error) {
+	if config.Scheme == "" {
+		return nil, nil
+	}
+	if config.BaseURL == "" {
+		return nil, fmt.Errorf("缺少 cdn.base_url")
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	signer := &cdnSigner{config: config, secret: secret}
+	if config.Secret != "" {
+		signer.secret = []byte(config.Secret)
+	}
+
+	switch config.Scheme {
+	case "cloudfront":
+		if config.KeyPairID == "" || config.PrivateKey == "" {
+			return nil, fmt.Errorf("cloudfront 签名需要 key_pair_id 和 private_key")
+		}
+		key, err := parseRSAPrivateKey(config.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		signer.privateKey = key
+	case "hmac_path":
+	default:
+		return nil, fmt.Errorf("不支持的 CDN 签名格式 %q", config.Scheme)
+	}
+	return signer, nil
+}
+
+// parseRSAPrivateKey 解析 PKCS#1 或 PKCS#8 格式的 PEM 私钥
+func parseRSAPrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("无效的 PEM 私钥")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("CloudFront 只支持 RSA 私钥")
+	}
+	return key, nil
+}
+
+// escapeKey 按路径段转义文件路径
+func escapeKey(key string) string {
+	return (&url.URL{Path: key}).EscapedPath()
+}
+
+// Sign 生成 CDN 签名链接
+func (s *cdnSigner) Sign(key string, expires time.Time) (string, error) {
+	switch s.config.Scheme {
+	case "cloudfront":
+		return s.signCloudFront(key, expires)
+	default:
+		token := s.pathToken(key, expires.Unix())
+		return fmt.Sprintf("%s/t/%d/%s/%s", s.config.BaseURL, expires.Unix(), token, escapeKey(key)), nil
+	}
+}
+
+// signCloudFront 按 CloudFront canned policy 生成签名 URL，由 CloudFront 校验有效期和资源路径
+func (s *cdnSigner) signCloudFront(key string, expires time.Time) (string, error) {
+	resource := s.config.BaseURL + "/get/" + escapeKey(key)
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`,
+		resource, expires.Unix())
+	digest := sha1.Sum([]byte(policy))
+	signature, err := rsa.SignPKCS1v15(nil, s.privateKey, crypto.SHA1, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// CloudFront 使用 URL 安全的 base64 变体
+	encoded := strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(signature))
+
+	query := url.Values{}
+	query.Set("Expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("Signature", encoded)
+	query.Set("Key-Pair-Id", s.config.KeyPairID)
+	return resource + "?" + query.Encode(), nil
+}
+
+// pathToken 计算 hmac_path 格式的 token：base64url(HMAC-SHA256(secret, "<过期时间>/<文件路径>"))
+func (s *cdnSigner) pathToken(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	_, _ = fmt.Fprintf(mac, "%d/%s", expires, key)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// PathTokenHandler 校验 /t/<过期时间>/<token>/<文件路径> 格式的链接，通过后按 /get/ 返回文件。
+// CDN 回源时本服务同样校验 token，边缘节点未校验时也不会泄露文件
+func (s *cdnSigner) PathTokenHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/t/"), "/", 3)
+		if s == nil || s.config.Scheme != "hmac_path" || len(parts) != 3 {
+			sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", nil, r.URL.Path)
+			return
+		}
+		expires, err := strconv.ParseInt(parts[0], 10, 64)
+		key := indexKey(parts[2])
+		if err != nil || time.Now().Unix() > expires ||
+			!hmac.Equal([]byte(s.pathToken(key, expires)), []byte(parts[1])) {
+			sendJSONResponse(w, http.StatusForbidden, "链接无效或已过期", nil, r.URL.Path)
+			return
+		}
+
+		// 过期前允许 CDN 缓存，缓存时间不超过链接的剩余有效期
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", expires-time.Now().Unix()))
+		forwarded := r.Clone(r.Context())
+		forwarded.URL.Path = "/get/" + key
+		forwarded.URL.RawPath = ""
+		next.ServeHTTP(w, forwarded)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// ChaosConfig 结构用于配置故障注入，仅用于测试环境验证客户端重试等容错逻辑
+type ChaosConfig struct {
+	Enabled bool `json:"enabled"`
+	// LatencyMs 每次存储操作前固定增加的延迟，单位毫秒
+	LatencyMs int `json:"latency_ms"`
+	// JitterMs 在固定延迟之外随机增加的延迟上限，单位毫秒
+	JitterMs int `json:"jitter_ms"`
+	// ErrorRate 打开、创建、删除以及每次读取时返回 IO 错误的概率，取值 0 到 1
+	ErrorRate float64 `json:"error_rate"`
+	// PartialWriteRate 每次写入只写入一部分数据并返回错误的概率，取值 0 到 1
+	PartialWriteRate float64 `json:"partial_write_rate"`
+}
+
+var (
+	errChaosIO      = errors.New("chaos: injected io error")
+	errChaosPartial = errors.New("chaos: injected partial write")
+)
+
+// ChaosInjector 在存储操作中注入延迟、IO 错误和部分写入
+type ChaosInjector struct {
+	cfg ChaosConfig
+}
+
+// chaos 是全局的故障注入器，未启用时为 nil
+var chaos *ChaosInjector
+
+// NewChaosInjector 创建故障注入器
+func NewChaosInjector(cfg ChaosConfig) *ChaosInjector {
+	slog.Warn("已启用故障注入，仅可用于测试环境",
+		"latency_ms", cfg.LatencyMs, "jitter_ms", cfg.JitterMs, "error_rate", cfg.ErrorRate, "partial_write_rate", cfg.PartialWriteRate)
+	return &ChaosInjector{cfg: cfg}
+}
+
+// inject 在存储操作前增加延迟，并按概率返回错误
+func (c *ChaosInjector) inject() error {
+	if c == nil {
+		return nil
+	}
+	delay := time.Duration(c.cfg.LatencyMs) * time.Millisecond
+	if c.cfg.JitterMs > 0 {
+		delay += time.Duration(rand.Intn(c.cfg.JitterMs)) * time.Millisecond
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if rand.Float64() < c.cfg.ErrorRate {
+		return errChaosIO
+	}
+	return nil
+}
+
+// wrapReader 包装读取的文件，按概率在读取时返回错误
+func (c *ChaosInjector) wrapReader(file io.ReadSeekCloser) io.ReadSeekCloser {
+	if c == nil {
+		return file
+	}
+	return &chaosReader{ReadSeekCloser: file, chaos: c}
+}
+
+// wrapWriter 包装写入的文件，按概率只写入部分数据
+func (c *ChaosInjector) wrapWriter(file io.WriteCloser) io.WriteCloser {
+	if c == nil {
+		return file
+	}
+	return &chaosWriter{WriteCloser: file, chaos: c}
+}
+
+type chaosReader struct {
+	io.ReadSeekCloser
+	chaos *ChaosInjector
+}
+
+func (r *chaosReader) Read(p []byte) (int, error) {
+	if rand.Float64() < r.chaos.cfg.ErrorRate {
+		return 0, errChaosIO
+	}
+	return r.ReadSeekCloser.Read(p)
+}
+
+type chaosWriter struct {
+	io.WriteCloser
+	chaos *ChaosInjector
+}
+
+func (w *chaosWriter) Write(p []byte) (int, error) {
+	if len(p) > 1 && rand.Float64() < w.chaos.cfg.PartialWriteRate {
+		n, err := w.WriteCloser.Write(p[:len(p)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, errChaosPartial
+	}
+	return w.WriteCloser.Write(p)
+}
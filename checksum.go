@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChecksumConfig 结构用于配置上传时计算的校验和
+type ChecksumConfig struct {
+	// MD5 上传时是否额外计算 MD5，SHA-256 总是会计算
+	MD5 bool `json:"md5"`
+}
+
+// ChecksumResult 结构用于返回文件的校验和
+type ChecksumResult struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5,omitempty"`
+	// Match 仅在请求中提供了 expected 时返回
+	Match *bool `json:"match,omitempty"`
+}
+
+// 计算文件的校验和，可选地与期望值比较
+func checksumHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	path := query.Get("path")
+	if path == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少路径参数", nil, r.URL.Path)
+		return
+	}
+	if isReservedPath(path) || isUnsafePath(path) {
+		sendJSONResponse(w, http.StatusNotFound, "文件不存在", nil, r.URL.Path)
+		return
+	}
+
+	fullPath := filepath.Join("data", path)
+	fileInfo, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		sendJSONResponse(w, http.StatusNotFound, "文件不存在", err, r.URL.Path)
+		return
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "无法获取文件信息", err, r.URL.Path)
+		return
+	}
+	if fileInfo.IsDir() {
+		sendJSONResponse(w, http.StatusBadRequest, "不能计算目录的校验和", nil, r.URL.Path)
+		return
+	}
+
+	withMD5 := query.Get("algo") == "md5"
+	result, err := fileChecksum(fullPath, withMD5)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+		return
+	}
+	result.Path = indexKey(path)
+
+	if expected := strings.ToLower(query.Get("expected")); expected != "" {
+		match := expected == result.SHA256 || expected == result.MD5
+		result.Match = &match
+	}
+
+	sendContentResponse(w, http.StatusOK, "success", result, nil, r.URL.Path)
+}
+
+// fileChecksum 读取整个文件计算 SHA-256，withMD5 为 true 时同时计算 MD5
+func fileChecksum(fullPath string, withMD5 bool) (ChecksumResult, error) {
+	var result ChecksumResult
+	file, err := openDataFile(fullPath)
+	if err != nil {
+		return result, err
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(file)
+
+	sha256Hash := sha256.New()
+	md5Hash := md5.New()
+	writer := io.Writer(sha256Hash)
+	if withMD5 {
+		writer = io.MultiWriter(sha256Hash, md5Hash)
+	}
+	_, err = io.Copy(writer, file)
+	if err != nil {
+		return result, err
+	}
+
+	result.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	if withMD5 {
+		result.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	}
+	return result, nil
+}
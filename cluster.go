@@ -0,0 +1,948 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClusterConfig 结构用于配置集群模式，节点共享成员列表，按路径的一致性哈希决定文件保存在哪个节点，
+// 请求到达其他节点时透明转发
+type ClusterConfig struct {
+	// Self 本节点供其他节点访问的地址，如 http://node1:8082，为空时不启用集群模式
+	Self string `json:"self"`
+	// Nodes 初始的成员列表，只在第一次启动时使用，之后以 data/.meta/cluster.json 中保存的成员列表为准
+	Nodes []string `json:"nodes"`
+	// Token 节点之间同步成员列表和迁移文件时使用的 token，需要在所有节点上拥有 read、write 和 admin 权限
+	Token string `json:"token"`
+	// VirtualNodes 每个节点在哈希环上的虚拟节点数，默认 128
+	VirtualNodes int `json:"virtual_nodes"`
+	// SyncInterval 从其他节点拉取成员列表的间隔，单位秒，默认 30
+	SyncInterval int `json:"sync_interval"`
+	// RebalanceInterval 检查不属于本节点的文件的间隔，单位秒，默认 3600；成员列表变化后立即检查
+	RebalanceInterval int `json:"rebalance_interval"`
+	// Timeout 节点之间请求的超时时间，单位秒，默认 300
+	Timeout int `json:"timeout"`
+}
+
+// clusterHeader 标记节点之间转发的请求，收到带该请求头的请求时在本节点处理，不再转发
+const clusterHeader = "X-Cluster-Forwarded"
+
+// clusterMaxBody 是需要从请求体中读取路径的请求的最大请求体
+const clusterMaxBody = 1 << 20
+
+// ClusterMembership 结构表示成员列表，Epoch 较大的成员列表较新
+type ClusterMembership struct {
+	Epoch uint64   `json:"epoch"`
+	Nodes []string `json:"nodes"`
+}
+
+// newerThan 判断成员列表是否比另一个新，Epoch 相同时按节点列表比较，保证所有节点选择相同的成员列表
+func (m ClusterMembership) newerThan(other ClusterMembership) bool {
+	if m.Epoch != other.Epoch {
+		return m.Epoch > other.Epoch
+	}
+	return strings.Join(m.Nodes, ",") > strings.Join(other.Nodes, ",")
+}
+
+// hashRing 是一致性哈希环，每个节点对应多个虚拟节点，成员变化时只有少量路径更换节点
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// clusterHash 使用 SHA-256 的前 4 个字节，相近的路径也能均匀地分布在环上
+func clusterHash(value string) uint32 {
+	sum := sha256.Sum256([]byte(value))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func newHashRing(nodes []string, virtualNodes int) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			point := clusterHash(node + "#" + strconv.Itoa(i))
+			if _, ok := ring.owners[point]; ok {
+				continue
+			}
+			ring.owners[point] = node
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// owner 返回路径所属的节点，环为空时返回空
+func (h *hashRing) owner(key string) string {
+	if len(h.points) == 0 {
+		return ""
+	}
+	point := clusterHash(key)
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= point })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]]
+}
+
+// ClusterRebalanceStatus 结构用于返回文件迁移的状态
+type ClusterRebalanceStatus struct {
+	Running   bool       `json:"running"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	Moved     int64      `json:"moved"`
+	Failed    int64      `json:"failed"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// ClusterStatus 结构用于返回集群状态
+type ClusterStatus struct {
+	Self      string                 `json:"self"`
+	Epoch     uint64                 `json:"epoch"`
+	Nodes     []string               `json:"nodes"`
+	Rebalance ClusterRebalanceStatus `json:"rebalance"`
+}
+
+// Cluster 结构用于维护成员列表、转发请求和在节点之间迁移文件
+type Cluster struct {
+	file         string
+	config       ClusterConfig
+	searchConfig SearchConfig
+	client       *http.Client
+	proxy        *httputil.ReverseProxy
+
+	mu         sync.RWMutex
+	membership ClusterMembership
+	ring       *hashRing
+	rebalance  chan struct{}
+	status     ClusterRebalanceStatus
+
+	proxied atomic.Int64
+}
+
+// cluster 未启用集群模式时为 nil
+var cluster *Cluster
+
+// clusterTargetKey 是转发目标在请求上下文中的键
+type clusterTargetKey struct{}
+
+// errServeLocal 表示目标节点没有该文件，改为在本节点处理
+var errServeLocal = errors.New("serve locally")
+
+// normalizeNodeURL 去掉节点地址末尾的 /
+func normalizeNodeURL(node string) string {
+	return strings.TrimSuffix(strings.TrimSpace(node), "/")
+}
+
+// OpenCluster 加载成员列表，未配置 Self 时返回 nil
+func OpenCluster(file string, config ClusterConfig, searchConfig SearchConfig) (*Cluster, error) {
+	if config.Self == "" {
+		return nil, nil
+	}
+	config.Self = normalizeNodeURL(config.Self)
+	if config.VirtualNodes <= 0 {
+		config.VirtualNodes = 128
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = 30
+	}
+	if config.RebalanceInterval <= 0 {
+		config.RebalanceInterval = 3600
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 300
+	}
+	c := &Cluster{
+		file:         file,
+		config:       config,
+		searchConfig: searchConfig,
+		client:       &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		rebalance:    make(chan struct{}, 1),
+	}
+	c.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(pr.In.Context().Value(clusterTargetKey{}).(*url.URL))
+			pr.SetXForwarded()
+			pr.Out.Header.Set(clusterHeader, config.Self)
+			injectTraceparent(pr.In.Context(), pr.Out)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// 迁移尚未完成时文件可能还在本节点上
+			r := resp.Request
+			if resp.StatusCode == http.StatusNotFound && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+				if key, ok := clusterRouteKey(r); ok && clusterHasLocal(key) {
+					_ = resp.Body.Close()
+					return errServeLocal
+				}
+			}
+			return nil
+		},
+	}
+
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &c.membership)
+		if err != nil {
+			return nil, err
+		}
+	} else if os.IsNotExist(err) {
+		c.membership = ClusterMembership{Epoch: 1, Nodes: []string{config.Self}}
+		for _, node := range config.Nodes {
+			c.membership.Nodes = appendNode(c.membership.Nodes, node)
+		}
+		sort.Strings(c.membership.Nodes)
+		err = c.save()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+	c.ring = newHashRing(c.membership.Nodes, config.VirtualNodes)
+	return c, nil
+}
+
+// appendNode 将节点加入列表，已存在时不重复加入
+func appendNode(nodes []string, node string) []string {
+	node = normalizeNodeURL(node)
+	for _, n := range nodes {
+		if n == node {
+			return nodes
+		}
+	}
+	return append(nodes, node)
+}
+
+// save 将成员列表写入文件，调用方需要持有锁或在初始化时调用
+func (c *Cluster) save() error {
+	data, err := json.MarshalIndent(c.membership, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(c.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmp := c.file + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+// Owner 返回路径所属的节点
+func (c *Cluster) Owner(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.owner(key)
+}
+
+// Membership 返回当前的成员列表
+func (c *Cluster) Membership() ClusterMembership {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return ClusterMembership{Epoch: c.membership.Epoch, Nodes: append([]string(nil), c.membership.Nodes...)}
+}
+
+// Adopt 在收到的成员列表较新时替换当前的成员列表，并开始迁移不属于本节点的文件
+func (c *Cluster) Adopt(membership ClusterMembership) (bool, error) {
+	nodes := make([]string, 0, len(membership.Nodes))
+	for _, node := range membership.Nodes {
+		nodes = appendNode(nodes, node)
+	}
+	sort.Strings(nodes)
+	membership.Nodes = nodes
+
+	c.mu.Lock()
+	if !membership.newerThan(c.membership) {
+		c.mu.Unlock()
+		return false, nil
+	}
+	c.membership = membership
+	c.ring = newHashRing(membership.Nodes, c.config.VirtualNodes)
+	err := c.save()
+	c.mu.Unlock()
+	if err != nil {
+		return true, err
+	}
+	slog.Info("集群成员列表已更新", "epoch", membership.Epoch, "nodes", membership.Nodes)
+	select {
+	case c.rebalance <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// Change 加入或移除节点，生成新的成员列表并通知变化前后的所有节点
+func (c *Cluster) Change(node string, join bool) (ClusterMembership, error) {
+	node = normalizeNodeURL(node)
+	current := c.Membership()
+	next := ClusterMembership{Epoch: current.Epoch + 1}
+	for _, n := range current.Nodes {
+		if n != node {
+			next.Nodes = append(next.Nodes, n)
+		}
+	}
+	if join {
+		next.Nodes = append(next.Nodes, node)
+	}
+	_, err := c.Adopt(next)
+	if err != nil {
+		return next, err
+	}
+	next = c.Membership()
+
+	// 被移除的节点同样需要收到新的成员列表，才能将文件迁移到其他节点
+	targets := appendNode(append([]string(nil), next.Nodes...), node)
+	data, err := json.Marshal(next)
+	if err != nil {
+		return next, err
+	}
+	for _, target := range targets {
+		if target == c.config.Self {
+			continue
+		}
+		req, err := http.NewRequest(http.MethodPost, target+"/cluster/members", bytes.NewReader(data))
+		if err != nil {
+			return next, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		err = c.do(req, nil)
+		if err != nil {
+			// 没有通知到的节点在下次同步时拉取新的成员列表
+			slog.Error("通知节点成员列表变化失败", "node", target, "err", err)
+		}
+	}
+	return next, nil
+}
+
+// clusterHTTPError 表示其他节点返回了 2xx 以外的响应
+type clusterHTTPError struct {
+	status  string
+	code    int
+	message string
+}
+
+func (e *clusterHTTPError) Error() string {
+	return e.status + " " + e.message
+}
+
+// do 发送节点之间的请求，2xx 以外的响应视为失败，result 不为 nil 时解析响应体
+func (c *Cluster) do(req *http.Request, result any) error {
+	req.Header.Set(clusterHeader, c.config.Self)
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", c.config.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &clusterHTTPError{status: resp.Status, code: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	if result == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Sync 从其他节点拉取成员列表，采用其中最新的一个
+func (c *Cluster) Sync() {
+	for _, node := range c.Membership().Nodes {
+		if node == c.config.Self {
+			continue
+		}
+		req, err := http.NewRequest(http.MethodGet, node+"/cluster/members", nil)
+		if err != nil {
+			continue
+		}
+		var response struct {
+			Content ClusterMembership `json:"content"`
+		}
+		err = c.do(req, &response)
+		if err != nil {
+			slog.Error("从节点同步成员列表失败", "node", node, "err", err)
+			continue
+		}
+		_, err = c.Adopt(response.Content)
+		if err != nil {
+			slog.Error("保存成员列表失败", "err", err)
+		}
+	}
+}
+
+// Run 定期同步成员列表，并在成员列表变化或定期将不属于本节点的文件迁移到所属的节点
+func (c *Cluster) Run() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.config.SyncInterval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.Sync()
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(c.config.RebalanceInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		c.Rebalance()
+		select {
+		case <-ticker.C:
+		case <-c.rebalance:
+		}
+	}
+}
+
+// Rebalance 遍历 data 目录，将不属于本节点的文件迁移到所属的节点，迁移成功后删除本地的文件
+func (c *Cluster) Rebalance() {
+	c.mu.Lock()
+	c.status.Running = true
+	c.mu.Unlock()
+
+	var moved, failed int64
+	var lastError string
+	_ = filepath.WalkDir("data", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel("data", p)
+		if err != nil || rel == "." {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if isReservedPath(key) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		owner := c.Owner(key)
+		if owner == "" || owner == c.config.Self {
+			return nil
+		}
+		err = c.move(key, owner)
+		if err != nil {
+			failed++
+			lastError = fmt.Sprintf("%s: %s", key, err)
+			slog.Error("迁移文件到节点失败", "node", owner, "key", key, "err", err)
+			return nil
+		}
+		moved++
+		return nil
+	})
+
+	now := time.Now()
+	c.mu.Lock()
+	c.status.Running = false
+	c.status.LastRun = &now
+	c.status.Moved += moved
+	c.status.Failed += failed
+	if lastError != "" {
+		c.status.LastError = lastError
+	}
+	c.mu.Unlock()
+	if moved > 0 || failed > 0 {
+		slog.Info("集群迁移完成", "moved", moved, "failed", failed)
+	}
+}
+
+// move 将一个文件迁移到所属的节点，目标节点上已有相同或更新的文件时只删除本地的文件
+func (c *Cluster) move(key string, owner string) error {
+	fullPath := filepath.Join("data", filepath.FromSlash(key))
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, owner+"/stat?path="+url.QueryEscape(key), nil)
+	if err != nil {
+		return err
+	}
+	var stat struct {
+		Status  int       `json:"status"`
+		Content StatEntry `json:"content"`
+	}
+	err = c.do(req, &stat)
+	var httpErr *clusterHTTPError
+	if err != nil && !(errors.As(err, &httpErr) && httpErr.code == http.StatusNotFound) {
+		return err
+	}
+	if err != nil || stat.Status != 1 || stat.Content.ModTime.Before(info.ModTime()) {
+		err = pushFileUpload(owner, key, func(req *http.Request) error {
+			var response struct {
+				Status  int    `json:"status"`
+				Message string `json:"message"`
+			}
+			err := c.do(req, &response)
+			if err != nil {
+				return err
+			}
+			if response.Status != 1 {
+				return errors.New(response.Message)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(fullPath)
+	if err != nil {
+		return err
+	}
+	forgetDeletedPath(key, 1)
+	// 删除迁移后留下的空目录
+	for dir := filepath.Dir(fullPath); dir != "data"; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+		if rel, err := filepath.Rel("data", dir); err == nil {
+			metaIndex.RemoveTree(filepath.ToSlash(rel))
+		}
+	}
+	return nil
+}
+
+// Status 返回集群状态
+func (c *Cluster) Status() ClusterStatus {
+	membership := c.Membership()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return ClusterStatus{
+		Self:      c.config.Self,
+		Epoch:     membership.Epoch,
+		Nodes:     membership.Nodes,
+		Rebalance: c.status,
+	}
+}
+
+// clusterHasLocal 判断本节点是否有该路径的文件
+func clusterHasLocal(key string) bool {
+	_, info, err := statReadPath(key)
+	return err == nil && !info.IsDir()
+}
+
+// clusterRouteKey 返回按路径转发的请求所操作的路径，不需要按路径转发的请求返回 false
+func clusterRouteKey(r *http.Request) (string, bool) {
+	var p string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/get/"):
+		p = strings.TrimPrefix(r.URL.Path, "/get/")
+	case strings.HasPrefix(r.URL.Path, "/thumb/"):
+		p = strings.TrimPrefix(r.URL.Path, "/thumb/")
+	case r.URL.Path == "/upload" || r.URL.Path == "/delta/apply":
+		// 预签名的上传按签名中的路径路由，同一链接总是由同一节点处理，一次性的记录保存在该节点上
+		p = r.Header.Get("X-FormFile-Path")
+		if p == "" || r.URL.Query().Get("signature") != "" {
+			p = r.URL.Query().Get("path")
+		}
+	case r.URL.Path == "/stat" || r.URL.Path == "/checksum" || r.URL.Path == "/versions" || r.URL.Path == "/delta/signature":
+		p = r.URL.Query().Get("path")
+	case r.URL.Path == "/exists" && r.Method == http.MethodGet:
+		p = r.URL.Query().Get("path")
+	case r.URL.Path == "/versions/rollback" || r.URL.Path == "/storage-class" || r.URL.Path == "/finalize":
+		var request struct {
+			Path string `json:"path"`
+		}
+		body, err := readClusterBody(r)
+		if err != nil || json.Unmarshal(body, &request) != nil {
+			return "", false
+		}
+		p = request.Path
+	default:
+		return "", false
+	}
+	// 暂存文件和标记文件按完成后的路径转发，与最终的文件位于同一个节点
+	key := partialUploads.Target(indexKey(p))
+	return key, key != ""
+}
+
+// readClusterBody 读取请求体并还原，供之后的处理程序再次读取
+func readClusterBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, clusterMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Middleware 将按路径操作的请求转发到所属的节点，列出目录、搜索和删除发送到所有节点后合并结果，
+// 节点之间转发的请求在本节点处理
+func (c *Cluster) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(clusterHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/list", "/search":
+			c.fanOutList(w, r, next)
+			return
+		case "/delete":
+			c.fanOutDelete(w, r)
+			return
+		}
+
+		key, ok := clusterRouteKey(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner := c.Owner(key)
+		if owner == "" || owner == c.config.Self {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target, err := url.Parse(owner)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "无效的节点地址", err, r.URL.Path)
+			return
+		}
+		c.proxied.Add(1)
+		ctx := context.WithValue(r.Context(), clusterTargetKey{}, target)
+		proxy := *c.proxy
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			// 所属节点不可用或没有该文件时，本节点上还有未迁移的文件则在本地处理读请求
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				if errors.Is(err, errServeLocal) || clusterHasLocal(key) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			sendJSONResponse(w, http.StatusBadGateway, "节点不可用", err, r.URL.Path)
+		}
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// nodes 返回需要发送请求的节点，包括已经离开集群、文件尚未迁移完的本节点
+func (c *Cluster) nodes() []string {
+	return appendNode(c.Membership().Nodes, c.config.Self)
+}
+
+// fanOut 将请求发送到所有节点，返回每个节点的响应体，任意节点失败时返回错误
+func (c *Cluster) fanOut(r *http.Request, body []byte) ([][]byte, error) {
+	nodes := c.nodes()
+	results := make([][]byte, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(r.Context(), r.Method, node+r.URL.RequestURI(), bytes.NewReader(body))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			// 使用客户端的凭证，每个节点各自认证
+			for _, name := range []string{"Authorization", "Cookie", "Content-Type"} {
+				if value := r.Header.Get(name); value != "" {
+					req.Header.Set(name, value)
+				}
+			}
+			req.Header.Set(clusterHeader, c.config.Self)
+			injectTraceparent(r.Context(), req)
+			resp, err := c.client.Do(req)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", node, err)
+				return
+			}
+			defer func(body io.ReadCloser) {
+				_ = body.Close()
+			}(resp.Body)
+			results[i], errs[i] = io.ReadAll(resp.Body)
+		}(i, node)
+	}
+	wg.Wait()
+	return results, errors.Join(errs...)
+}
+
+// fanOutList 在所有节点上列出目录或搜索，合并结果后在本节点过滤、排序和分页
+func (c *Cluster) fanOutList(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	body, err := readClusterBody(r)
+	if err != nil {
+		sendListResponse(w, http.StatusBadRequest, "缺少必要参数", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, err, r.URL.Path)
+		return
+	}
+
+	fields, err := parseFields(r, ListEntry{})
+	if err != nil {
+		sendListResponse(w, http.StatusBadRequest, err.Error(), ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, err, r.URL.Path)
+		return
+	}
+
+	// 游标只在一个节点内有效
+	if r.URL.Query().Has("if_changed_since") {
+		sendListResponse(w, http.StatusBadRequest, "集群模式下不支持 if_changed_since", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, nil, r.URL.Path)
+		return
+	}
+
+	// 每个节点返回过滤后的全部条目，分页在合并之后进行，选择字段同样在合并之后进行
+	var listRequest ListRequest
+	var searchRequest SearchRequest
+	nodeBody := body
+	if r.URL.Path == "/list" {
+		if json.Unmarshal(body, &listRequest) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// 快照保存在创建快照的节点上，带 token 的请求在本节点处理
+		if listRequest.SnapshotToken != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		nodeRequest := listRequest
+		nodeRequest.Limit, nodeRequest.Offset, nodeRequest.Snapshot = 0, 0, false
+		nodeBody, err = json.Marshal(nodeRequest)
+		if err != nil {
+			sendListResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", ListResponse{
+				Status:  0,
+				Content: []ListEntry{},
+			}, err, r.URL.Path)
+			return
+		}
+	} else if json.Unmarshal(body, &searchRequest) != nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	results, err := c.fanOut(withoutFields(r), nodeBody)
+	if err != nil {
+		sendListResponse(w, http.StatusBadGateway, "部分节点不可用", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, err, r.URL.Path)
+		return
+	}
+
+	// 目录可能在多个节点上都存在，只保留一个；迁移过程中重复的文件保留较新的
+	merged := map[string]ListEntry{}
+	var failure *ListResponse
+	found := false
+	for _, data := range results {
+		var response ListResponse
+		err = json.Unmarshal(data, &response)
+		if err != nil {
+			sendListResponse(w, http.StatusBadGateway, "节点返回了无效的响应", ListResponse{
+				Status:  0,
+				Content: []ListEntry{},
+			}, err, r.URL.Path)
+			return
+		}
+		if response.Status != 1 {
+			// 目录只在部分节点上存在
+			if response.Message != "该目录不存在" && failure == nil {
+				failure = &response
+			}
+			continue
+		}
+		found = true
+		for _, entry := range response.Content {
+			name := entryName(entry)
+			if existing, ok := merged[name]; !ok || entry.Date.After(existing.Date) {
+				merged[name] = entry
+			}
+		}
+	}
+	if failure != nil {
+		sendListResponse(w, http.StatusOK, failure.Message, ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, nil, r.URL.Path)
+		return
+	}
+	if !found {
+		sendListResponse(w, http.StatusOK, "该目录不存在", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, nil, r.URL.Path)
+		return
+	}
+	entries := make([]ListEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, entry)
+	}
+
+	if r.URL.Path == "/list" {
+		listRequest.Fields = fields
+		sendListPage(w, r, listRequest, entries, "")
+		return
+	}
+
+	limit := c.searchConfig.MaxResults
+	if limit <= 0 {
+		limit = 1000
+	}
+	if searchRequest.Limit > 0 && searchRequest.Limit < limit {
+		limit = searchRequest.Limit
+	}
+	entries, total, _ := applyListOptions(entries, ListRequest{Limit: limit})
+	sendListResponse(w, http.StatusOK, "success", ListResponse{
+		Status:  1,
+		Content: entries,
+		Total:   total,
+		Fields:  fields,
+	}, nil, r.URL.Path)
+}
+
+// fanOutDelete 在所有节点上删除文件或目录，任意节点删除成功即视为成功
+func (c *Cluster) fanOutDelete(w http.ResponseWriter, r *http.Request) {
+	body, err := readClusterBody(r)
+	if err != nil {
+		sendDeleteResponse(w, http.StatusBadRequest, DeleteResponse{
+			Status:  0,
+			Message: "缺少必要参数",
+		}, err, r.URL.Path)
+		return
+	}
+	results, err := c.fanOut(r, body)
+	if err != nil {
+		sendDeleteResponse(w, http.StatusBadGateway, DeleteResponse{
+			Status:  0,
+			Message: "部分节点不可用",
+		}, err, r.URL.Path)
+		return
+	}
+
+	var failure *DeleteResponse
+	for _, data := range results {
+		var response DeleteResponse
+		err = json.Unmarshal(data, &response)
+		if err != nil {
+			sendDeleteResponse(w, http.StatusBadGateway, DeleteResponse{
+				Status:  0,
+				Message: "节点返回了无效的响应",
+			}, err, r.URL.Path)
+			return
+		}
+		if response.Status == 1 {
+			sendDeleteResponse(w, http.StatusOK, response, nil, r.URL.Path)
+			return
+		}
+		if failure == nil || failure.Message == "文件或目录不存在" {
+			failure = &response
+		}
+	}
+	sendDeleteResponse(w, http.StatusOK, *failure, nil, r.URL.Path)
+}
+
+// writeMetrics 输出 Prometheus 格式的集群统计
+func (c *Cluster) writeMetrics(w io.Writer) {
+	if c == nil {
+		return
+	}
+	status := c.Status()
+	fmt.Fprintf(w, "# HELP store_cluster_nodes Nodes in the cluster membership list.\n")
+	fmt.Fprintf(w, "# TYPE store_cluster_nodes gauge\n")
+	fmt.Fprintf(w, "store_cluster_nodes %d\n", len(status.Nodes))
+	fmt.Fprintf(w, "# HELP store_cluster_proxied_requests_total Requests forwarded to the owning node.\n")
+	fmt.Fprintf(w, "# TYPE store_cluster_proxied_requests_total counter\n")
+	fmt.Fprintf(w, "store_cluster_proxied_requests_total %d\n", c.proxied.Load())
+	fmt.Fprintf(w, "# HELP store_cluster_rebalanced_files_total Files moved to their owning node by result.\n")
+	fmt.Fprintf(w, "# TYPE store_cluster_rebalanced_files_total counter\n")
+	fmt.Fprintf(w, "store_cluster_rebalanced_files_total{result=\"moved\"} %d\n", status.Rebalance.Moved)
+	fmt.Fprintf(w, "store_cluster_rebalanced_files_total{result=\"failed\"} %d\n", status.Rebalance.Failed)
+}
+
+// ClusterNodeRequest 结构用于加入或移除节点
+type ClusterNodeRequest struct {
+	URL string `json:"url"`
+}
+
+// 查询集群状态
+func clusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用集群模式", nil, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", cluster.Status(), nil, r.URL.Path)
+}
+
+// 加入或移除节点，新的成员列表发送到变化前后的所有节点
+func clusterChangeHandler(w http.ResponseWriter, r *http.Request, join bool) {
+	if cluster == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用集群模式", nil, r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+		return
+	}
+	var request ClusterNodeRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.URL == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	if _, err := url.ParseRequestURI(request.URL); err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的节点地址", err, r.URL.Path)
+		return
+	}
+	membership, err := cluster.Change(request.URL, join)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "保存成员列表失败", err, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", membership, nil, r.URL.Path)
+}
+
+// 节点之间交换成员列表，GET 返回本节点的成员列表，POST 在收到的成员列表较新时采用
+func clusterMembersHandler(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用集群模式", nil, r.URL.Path)
+		return
+	}
+	if r.Method == http.MethodPost {
+		var membership ClusterMembership
+		err := json.NewDecoder(r.Body).Decode(&membership)
+		if err != nil || membership.Epoch == 0 {
+			sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+			return
+		}
+		_, err = cluster.Adopt(membership)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "保存成员列表失败", err, r.URL.Path)
+			return
+		}
+	}
+	sendContentResponse(w, http.StatusOK, "success", cluster.Membership(), nil, r.URL.Path)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CompressionCodec 结构是一种压缩算法，存储时的透明压缩和响应压缩共用；
+// 服务只依赖标准库，内置 deflate、gzip 和 lz4，zstd、brotli 等可以在带构建标签的文件中通过 registerCompressionCodec 注册
+type CompressionCodec struct {
+	Name string
+	// ID 为压缩文件中记录的算法编号，0 表示不能用于存储时的压缩；写入文件后不能修改
+	ID byte
+	// Encoding 为 Content-Encoding 中的名称，为空时不能用于响应压缩
+	Encoding string
+	// MinLevel、MaxLevel 和 DefaultLevel 为压缩级别的范围和默认值，MaxLevel 为 0 时不支持设置级别
+	MinLevel     int
+	MaxLevel     int
+	DefaultLevel int
+	// NewWriter 和 NewReader 为流式的压缩和解压，返回的 Writer 实现 Reset(io.Writer) 时压缩分块时复用
+	NewWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+	// CompressBlock 和 DecompressBlock 为只支持整块压缩的算法，如 lz4，不为空时压缩分块优先使用
+	CompressBlock   func(src []byte, level int) []byte
+	DecompressBlock func(src []byte, size int) ([]byte, error)
+}
+
+// 压缩文件中记录的算法编号，zstd 和 brotli 的编号预留给注册的实现
+const (
+	codecIDDeflate = 1
+	codecIDGzip    = 2
+	codecIDLZ4     = 3
+	codecIDZstd    = 4
+	codecIDBrotli  = 5
+)
+
+// reservedCodecNames 是已预留编号但没有内置实现的算法
+var reservedCodecNames = map[string]byte{"zstd": codecIDZstd, "brotli": codecIDBrotli, "br": codecIDBrotli}
+
+var (
+	compressionCodecs     = map[string]*CompressionCodec{}
+	compressionCodecsByID = map[byte]*CompressionCodec{}
+)
+
+// registerCompressionCodec 注册一种压缩算法，名称或编号重复、或预留的算法没有使用预留的编号时 panic
+func registerCompressionCodec(codec *CompressionCodec) {
+	if _, ok := compressionCodecs[codec.Name]; ok {
+		panic("重复注册压缩算法 " + codec.Name)
+	}
+	if id, ok := reservedCodecNames[codec.Name]; ok && codec.ID != id {
+		panic("压缩算法 " + codec.Name + " 应使用预留的编号")
+	}
+	compressionCodecs[codec.Name] = codec
+	if codec.Encoding != "" && codec.Encoding != codec.Name {
+		compressionCodecs[codec.Encoding] = codec
+	}
+	if codec.ID != 0 {
+		if _, ok := compressionCodecsByID[codec.ID]; ok {
+			panic("重复注册压缩算法编号 " + codec.Name)
+		}
+		compressionCodecsByID[codec.ID] = codec
+	}
+}
+
+func init() {
+	registerCompressionCodec(&CompressionCodec{
+		Name: "deflate", ID: codecIDDeflate, Encoding: "deflate",
+		MinLevel: flate.BestSpeed, MaxLevel: flate.BestCompression, DefaultLevel: 6,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	})
+	registerCompressionCodec(&CompressionCodec{
+		Name: "gzip", ID: codecIDGzip, Encoding: "gzip",
+		MinLevel: gzip.BestSpeed, MaxLevel: gzip.BestCompression, DefaultLevel: 6,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+	// lz4 只用于存储时的压缩，压缩率低于 deflate 但速度快得多，适合写入频繁的大文件
+	registerCompressionCodec(&CompressionCodec{
+		Name: "lz4", ID: codecIDLZ4,
+		CompressBlock:   func(src []byte, _ int) []byte { return lz4CompressBlock(src) },
+		DecompressBlock: lz4DecompressBlock,
+	})
+}
+
+// lookupCompressionCodec 按名称查找压缩算法，预留但没有编译进当前版本的算法返回单独的错误
+func lookupCompressionCodec(name string) (*CompressionCodec, error) {
+	name = strings.ToLower(name)
+	if codec, ok := compressionCodecs[name]; ok {
+		return codec, nil
+	}
+	if _, ok := reservedCodecNames[name]; ok {
+		return nil, fmt.Errorf("压缩算法 %s 没有编译进当前版本，可选 %s", name, strings.Join(compressionCodecNames(), "、"))
+	}
+	return nil, fmt.Errorf("不支持的压缩算法 %q，可选 %s", name, strings.Join(compressionCodecNames(), "、"))
+}
+
+// compressionCodecNames 返回已注册的算法名称
+func compressionCodecNames() []string {
+	var names []string
+	for name, codec := range compressionCodecs {
+		if name == codec.Name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveLevel 检查压缩级别，0 时使用算法的默认级别
+func (c *CompressionCodec) resolveLevel(level int) (int, error) {
+	if c.MaxLevel == 0 {
+		if level != 0 {
+			return 0, fmt.Errorf("压缩算法 %s 不支持设置压缩级别", c.Name)
+		}
+		return 0, nil
+	}
+	if level == 0 {
+		return c.DefaultLevel, nil
+	}
+	if level < c.MinLevel || level > c.MaxLevel {
+		return 0, fmt.Errorf("无效的压缩级别 %d，%s 应为 %d 到 %d", level, c.Name, c.MinLevel, c.MaxLevel)
+	}
+	return level, nil
+}
+
+// decompressBlock 解压一个分块，结果超过 size 时返回错误，避免异常的文件占用大量内存
+func (c *CompressionCodec) decompressBlock(data []byte, size int64) ([]byte, error) {
+	if c.DecompressBlock != nil {
+		return c.DecompressBlock(data, int(size))
+	}
+	if c.NewReader == nil {
+		return nil, errCompressionFormat
+	}
+	reader, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func(reader io.ReadCloser) {
+		_ = reader.Close()
+	}(reader)
+	return io.ReadAll(io.LimitReader(reader, size+1))
+}
+
+// CompressionTypePolicy 结构按内容类型选择压缩算法和级别，如日志用高压缩级别，音视频不压缩
+type CompressionTypePolicy struct {
+	// Type 为内容类型，以 / 结尾时按前缀匹配，如 text/ 或 video/
+	Type string `json:"type"`
+	// Algorithm 为该类型使用的压缩算法，为空时使用默认算法
+	Algorithm string `json:"algorithm"`
+	// Level 为该类型的压缩级别，0 时使用算法的默认级别
+	Level int `json:"level"`
+	// Disabled 为 true 时该类型不压缩
+	Disabled bool `json:"disabled"`
+}
+
+// compressionTypeRule 是解析后的按类型的策略
+type compressionTypeRule struct {
+	mediaType string
+	// codec 为 nil 时使用默认算法，level 为 0 时使用默认级别
+	codec    *CompressionCodec
+	level    int
+	disabled bool
+}
+
+// parseCompressionTypes 解析按类型的策略，完整的类型排在前缀之前，前缀越长越靠前；
+// usable 检查算法能否用于当前用途，defaults 为没有指定算法时可能使用的算法，用于检查级别
+func parseCompressionTypes(types []CompressionTypePolicy, usable func(*CompressionCodec) error, defaults []*CompressionCodec) ([]compressionTypeRule, error) {
+	var rules []compressionTypeRule
+	for _, t := range types {
+		rule := compressionTypeRule{mediaType: strings.ToLower(strings.TrimSpace(t.Type)), level: t.Level, disabled: t.Disabled}
+		if rule.mediaType == "" {
+			return nil, errors.New("压缩策略缺少 type")
+		}
+		candidates := defaults
+		if t.Algorithm != "" {
+			codec, err := lookupCompressionCodec(t.Algorithm)
+			if err == nil {
+				err = usable(codec)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", t.Type, err)
+			}
+			rule.codec = codec
+			candidates = []*CompressionCodec{codec}
+		}
+		for _, codec := range candidates {
+			if _, err := codec.resolveLevel(t.Level); err != nil {
+				return nil, fmt.Errorf("%s: %w", t.Type, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		iPrefix, jPrefix := strings.HasSuffix(rules[i].mediaType, "/"), strings.HasSuffix(rules[j].mediaType, "/")
+		if iPrefix != jPrefix {
+			return !iPrefix
+		}
+		return len(rules[i].mediaType) > len(rules[j].mediaType)
+	})
+	return rules, nil
+}
+
+// matchCompressionType 返回内容类型（不带参数）匹配的策略
+func matchCompressionType(rules []compressionTypeRule, mediaType string) (compressionTypeRule, bool) {
+	mediaType = strings.ToLower(mediaType)
+	for _, rule := range rules {
+		if mediaType == rule.mediaType || (strings.HasSuffix(rule.mediaType, "/") && strings.HasPrefix(mediaType, rule.mediaType)) {
+			return rule, true
+		}
+	}
+	return compressionTypeRule{}, false
+}
+
+// extensionMediaType 按扩展名返回内容类型，存储时的压缩在写入之前决定，无法检测内容
+func extensionMediaType(key string) string {
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(key)))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// LZ4 块格式：每个序列为 1 字节标记（高 4 位为字面量长度，低 4 位为匹配长度减 4）、扩展的字面量长度、字面量、
+// 2 字节小端的匹配偏移和扩展的匹配长度；最后一个序列只有字面量。实现与 lz4 的块格式兼容，不包括帧格式
+const (
+	lz4MinMatch = 4
+	// lz4LastLiterals 为块末尾必须保留为字面量的字节数，lz4MatchLimit 为最后一个匹配开始位置到块末尾的最小距离
+	lz4LastLiterals = 5
+	lz4MatchLimit   = 12
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 16
+)
+
+var errLZ4Corrupt = errors.New("lz4 数据损坏")
+
+// lz4CompressBlock 用贪心的哈希匹配压缩一个分块
+func lz4CompressBlock(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	anchor := 0
+	if len(src) > lz4MatchLimit {
+		var table [1 << lz4HashLog]int32
+		limit := len(src) - lz4MatchLimit
+		for i := 0; i < limit; {
+			sequence := binary.LittleEndian.Uint32(src[i:])
+			hash := (sequence * 2654435761) >> (32 - lz4HashLog)
+			ref := int(table[hash]) - 1
+			table[hash] = int32(i + 1)
+			if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != sequence {
+				i++
+				continue
+			}
+			end := i + lz4MinMatch
+			for end < len(src)-lz4LastLiterals && src[end] == src[ref+end-i] {
+				end++
+			}
+			// 向前扩展匹配，减少字面量
+			for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+				i--
+				ref--
+			}
+			dst = lz4AppendSequence(dst, src[anchor:i], i-ref, end-i)
+			i = end
+			anchor = i
+		}
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence 写入一个序列，matchLength 为 0 时为最后一个只有字面量的序列
+func lz4AppendSequence(dst []byte, literals []byte, offset int, matchLength int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if matchLength > 0 {
+		token |= byte(min(matchLength-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if matchLength == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLength-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, matchLength-lz4MinMatch-15)
+	}
+	return dst
+}
+
+// lz4AppendLength 写入扩展的长度，每个 255 表示还有后续字节
+func lz4AppendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+// lz4DecompressBlock 解压一个分块，结果不是 size 字节时返回错误；
+// 输入来自磁盘上的文件，损坏或截断的数据只返回错误，不会越界读取或写入超过 size 字节
+func lz4DecompressBlock(src []byte, size int) ([]byte, error) {
+	if size < 0 {
+		return nil, errLZ4Corrupt
+	}
+	// 每个输入字节最多解压为 255 字节，异常的 size 不会预先分配过多内存
+	dst := make([]byte, 0, min(size, len(src)*255))
+	readLength := func(i int, n int) (int, int, error) {
+		for {
+			if i >= len(src) {
+				return 0, 0, errLZ4Corrupt
+			}
+			b := src[i]
+			i++
+			n += int(b)
+			if n > size {
+				return 0, 0, errLZ4Corrupt
+			}
+			if b != 255 {
+				return i, n, nil
+			}
+		}
+	}
+	var err error
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, errLZ4Corrupt
+		}
+		token := src[i]
+		i++
+		literals := int(token >> 4)
+		if literals == 15 {
+			i, literals, err = readLength(i, literals)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if i+literals > len(src) || len(dst)+literals > size {
+			return nil, errLZ4Corrupt
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			if len(dst) != size {
+				return nil, errLZ4Corrupt
+			}
+			return dst, nil
+		}
+		if i+2 > len(src) {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errLZ4Corrupt
+		}
+		length := int(token & 15)
+		if length == 15 {
+			i, length, err = readLength(i, length)
+			if err != nil {
+				return nil, err
+			}
+		}
+		length += lz4MinMatch
+		if len(dst)+length > size {
+			return nil, errLZ4Corrupt
+		}
+		// 匹配可能与正在写入的内容重叠，逐字节复制
+		start := len(dst) - offset
+		for k := 0; k < length; k++ {
+			dst = append(dst, dst[start+k])
+		}
+	}
+}
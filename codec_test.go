@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// randomBytes 返回固定种子生成的随机数据，结果可以重现
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// lz4Samples 是压缩和解压测试使用的数据
+func lz4Samples() []struct {
+	name string
+	data []byte
+} {
+	random := randomBytes(1, 70000)
+	return []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte("a")},
+		{"shorter than match limit", []byte("abcabcabcab")},
+		{"15 literals", randomBytes(2, 15)},
+		{"270 literals", randomBytes(3, 270)},
+		{"overlapping match", append([]byte("a"), bytes.Repeat([]byte("ab"), 5000)...)},
+		{"text", []byte(strings.Repeat("2026-10-17T06:55:44Z INFO upload path=logs/app.log size=1024\n", 2000))},
+		{"long match", make([]byte, 1<<20)},
+		{"incompressible", randomBytes(4, 256<<10)},
+		{"repeat beyond max offset", append(append([]byte{}, random...), random...)},
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	for _, tc := range lz4Samples() {
+		compressed := lz4CompressBlock(tc.data)
+		// 不可压缩的数据每 255 字节字面量最多多 1 字节长度，另有标记
+		if bound := len(tc.data) + len(tc.data)/255 + 16; len(compressed) > bound {
+			t.Errorf("%s: 压缩后 %d 字节，超过上限 %d", tc.name, len(compressed), bound)
+		}
+		plain, err := lz4DecompressBlock(compressed, len(tc.data))
+		if err != nil {
+			t.Errorf("%s: 解压失败 %v", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(plain, tc.data) {
+			t.Errorf("%s: 解压结果与原数据不同", tc.name)
+		}
+		// 大小与记录的不同时是损坏的数据
+		for _, size := range []int{len(tc.data) - 1, len(tc.data) + 1} {
+			_, err = lz4DecompressBlock(compressed, size)
+			if err == nil {
+				t.Errorf("%s: 按 %d 字节解压 %d 字节的数据没有返回错误", tc.name, size, len(tc.data))
+			}
+		}
+	}
+}
+
+func TestLZ4CompressesRepetitiveData(t *testing.T) {
+	for _, tc := range lz4Samples() {
+		var limit int
+		switch tc.name {
+		case "long match":
+			limit = len(tc.data) / 200
+		case "text", "overlapping match":
+			limit = len(tc.data) / 10
+		default:
+			continue
+		}
+		if compressed := lz4CompressBlock(tc.data); len(compressed) > limit {
+			t.Errorf("%s: 压缩后 %d 字节，应不超过 %d", tc.name, len(compressed), limit)
+		}
+	}
+}
+
+func TestLZ4DecompressRejectsCorruptInput(t *testing.T) {
+	tests := []struct {
+		name string
+		src  []byte
+		size int
+	}{
+		{"empty", nil, 0},
+		{"literals truncated", []byte{0x30, 'a', 'b'}, 3},
+		{"literal length truncated", []byte{0xf0}, 100},
+		{"literal length over size", append([]byte{0xf0}, bytes.Repeat([]byte{255}, 8)...), 100},
+		{"offset truncated", []byte{0x10, 'a', 1}, 5},
+		{"zero offset", []byte{0x10, 'a', 0, 0}, 5},
+		{"offset before start", []byte{0x10, 'a', 2, 0}, 5},
+		{"max offset on short output", []byte{0x10, 'a', 0xff, 0xff}, 5},
+		{"match length truncated", []byte{0x1f, 'a', 1, 0}, 100},
+		{"match over size", []byte{0x1f, 'a', 1, 0, 255, 255, 10}, 10},
+		{"missing last literals", []byte{0x10, 'a', 1, 0}, 5},
+		{"negative size", []byte{0x10, 'a'}, -1},
+		{"bomb", lz4CompressBlock(make([]byte, 1<<20)), 4096},
+	}
+	for _, tc := range tests {
+		plain, err := lz4DecompressBlock(tc.src, tc.size)
+		if err == nil {
+			t.Errorf("%s: 返回 %d 字节，没有返回错误", tc.name, len(plain))
+		}
+	}
+}
+
+func TestLZ4DecompressRejectsTruncatedInput(t *testing.T) {
+	for _, tc := range lz4Samples() {
+		compressed := lz4CompressBlock(tc.data)
+		// 较长的数据按间隔截断，每个样本最多解压约 1000 次
+		step := max(1, len(compressed)/1000)
+		for n := 0; n < len(compressed); n += step {
+			_, err := lz4DecompressBlock(compressed[:n], len(tc.data))
+			if err == nil {
+				t.Errorf("%s: 截断为 %d 字节（共 %d 字节）时没有返回错误", tc.name, n, len(compressed))
+				break
+			}
+		}
+	}
+}
+
+// 修改任意字节后解压不能 panic，成功时结果必须正好是记录的大小
+func TestLZ4DecompressMutatedInput(t *testing.T) {
+	data := []byte(strings.Repeat("store_go lz4 block ", 300))
+	compressed := lz4CompressBlock(data)
+	random := rand.New(rand.NewSource(5))
+	for k := 0; k < 20000; k++ {
+		mutated := append([]byte{}, compressed...)
+		for m := random.Intn(4) + 1; m > 0; m-- {
+			mutated[random.Intn(len(mutated))] = byte(random.Intn(256))
+		}
+		plain, err := lz4DecompressBlock(mutated, len(data))
+		if err == nil && len(plain) != len(data) {
+			t.Fatalf("解压修改后的数据得到 %d 字节，应为 %d", len(plain), len(data))
+		}
+	}
+}
+
+func FuzzLZ4DecompressBlock(f *testing.F) {
+	for _, tc := range lz4Samples() {
+		if len(tc.data) <= 1<<16 {
+			f.Add(lz4CompressBlock(tc.data), len(tc.data))
+		}
+	}
+	f.Add([]byte{0xf0, 255, 255}, 1000)
+	f.Fuzz(func(t *testing.T, src []byte, size int) {
+		size %= 1 << 20
+		plain, err := lz4DecompressBlock(src, size)
+		if err == nil && len(plain) != size {
+			t.Fatalf("返回 %d 字节，应为 %d", len(plain), size)
+		}
+	})
+}
+
+func TestLookupCompressionCodec(t *testing.T) {
+	for _, name := range []string{"deflate", "gzip", "lz4", "GZIP"} {
+		codec, err := lookupCompressionCodec(name)
+		if err != nil || codec.Name != strings.ToLower(name) {
+			t.Errorf("lookupCompressionCodec(%q) = %v, %v", name, codec, err)
+		}
+	}
+	_, err := lookupCompressionCodec("snappy")
+	if err == nil || !strings.Contains(err.Error(), "不支持") {
+		t.Errorf("lookupCompressionCodec(\"snappy\") = %v", err)
+	}
+	// 预留的算法通过构建标签注册时使用预留的编号，否则提示没有编译进当前版本
+	for name, id := range reservedCodecNames {
+		codec, err := lookupCompressionCodec(name)
+		if _, registered := compressionCodecs[name]; registered {
+			if err != nil || codec.ID != id {
+				t.Errorf("lookupCompressionCodec(%q) = %v, %v, want ID %d", name, codec, err, id)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "没有编译进当前版本") {
+			t.Errorf("lookupCompressionCodec(%q) = %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+//go:build zstd
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 使用 -tags zstd 构建时注册 zstd，存储时的压缩使用预留的算法编号，响应压缩的 Content-Encoding 为 zstd
+func init() {
+	registerCompressionCodec(&CompressionCodec{
+		Name: "zstd", ID: codecIDZstd, Encoding: "zstd",
+		MinLevel: int(zstd.SpeedFastest), MaxLevel: int(zstd.SpeedBestCompression), DefaultLevel: int(zstd.SpeedDefault),
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevel(level)))
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+		CompressBlock:   zstdCompressBlock,
+		DecompressBlock: zstdDecompressBlock,
+	})
+}
+
+var (
+	// zstdEncoders 按压缩级别缓存编码器，EncodeAll 可以并发调用
+	zstdEncodersMu sync.Mutex
+	zstdEncoders   = map[int]*zstd.Encoder{}
+
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+)
+
+// zstdCompressBlock 压缩一个分块，级别已由 resolveLevel 检查
+func zstdCompressBlock(src []byte, level int) []byte {
+	zstdEncodersMu.Lock()
+	encoder, ok := zstdEncoders[level]
+	if !ok {
+		// 只有无效的选项会返回错误，级别在范围内时不会失败
+		encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevel(level)), zstd.WithEncoderConcurrency(1))
+		zstdEncoders[level] = encoder
+	}
+	zstdEncodersMu.Unlock()
+	return encoder.EncodeAll(src, make([]byte, 0, len(src)/2))
+}
+
+// zstdDecompressBlock 解压一个分块，结果不是 size 字节时返回错误
+func zstdDecompressBlock(src []byte, size int) ([]byte, error) {
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, zstdDecoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	if zstdDecoderErr != nil {
+		return nil, zstdDecoderErr
+	}
+	// EncodeAll 在帧头中记录原始大小，与分块大小不符的数据不解压，损坏的文件不会分配过多内存
+	var header zstd.Header
+	if size < 0 || header.Decode(src) != nil || !header.HasFCS || header.FrameContentSize != uint64(size) {
+		return nil, errCompressionFormat
+	}
+	dst, err := zstdDecoder.DecodeAll(src, make([]byte, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if len(dst) != size {
+		return nil, fmt.Errorf("%w: zstd 分块解压后为 %d 字节，应为 %d 字节", errCompressionFormat, len(dst), size)
+	}
+	return dst, nil
+}
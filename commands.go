@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// runCommand 执行命令行子命令，返回进程退出码
+func runCommand(args []string) int {
+	switch args[0] {
+	case "reindex-content":
+		return reindexContentCommand()
+	case "bench":
+		return benchCommand(args[1:])
+	case "sync":
+		return syncCommand(args[1:])
+	case "oci-push":
+		return ociPushCommand(args[1:])
+	case "oci-pull":
+		return ociPullCommand(args[1:])
+	case "delta-upload":
+		return deltaUploadCommand(args[1:])
+	case "sign-release":
+		return signReleaseCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "未知命令: %s\n", args[0])
+		fmt.Fprintf(os.Stderr, "可用命令:\n")
+		fmt.Fprintf(os.Stderr, "  reindex-content    重建全文搜索索引\n")
+		fmt.Fprintf(os.Stderr, "  bench              对运行中的实例进行上传、下载、列目录压测\n")
+		fmt.Fprintf(os.Stderr, "  sync               将文件同步到另一个实例，只复制缺少或内容不同的文件\n")
+		fmt.Fprintf(os.Stderr, "  delta-upload       以增量方式上传修改过的大文件，只传输修改过的部分\n")
+		fmt.Fprintf(os.Stderr, "  oci-push           将目录打包为 OCI 制品推送到镜像仓库\n")
+		fmt.Fprintf(os.Stderr, "  oci-pull           从镜像仓库拉取 oci-push 推送的制品并上传到实例\n")
+		fmt.Fprintf(os.Stderr, "  sign-release       为自动更新的程序生成签名的 release.json\n")
+		return 2
+	}
+}
+
+// reindexContentCommand 重建全文搜索索引，需在服务停止时执行
+func reindexContentCommand() int {
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+		return 1
+	}
+
+	index, err := OpenContentIndex(filepath.Join("data", metaDirName, "content.json"), config.ContentSearch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 无法加载全文索引 %s\n", err)
+		return 1
+	}
+	err = index.Rebuild()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 重建全文索引失败 %s\n", err)
+		return 1
+	}
+	err = index.Save()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 保存全文索引失败 %s\n", err)
+		return 1
+	}
+	fmt.Printf("已索引 %d 个文件\n", len(index.docs))
+	return 0
+}
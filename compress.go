@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CompressionConfig 结构用于配置透明压缩，启用后写入 data 目录的文件分块压缩，读取时透明解压；
+// zstd 需要使用 -tags zstd 构建，默认构建只依赖标准库，使用 deflate
+type CompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Algorithm 默认的压缩算法，zstd（使用 -tags zstd 构建时的默认值）、deflate（默认）、gzip 或 lz4
+	Algorithm string `json:"algorithm"`
+	// Level 压缩级别，deflate 和 gzip 为 1 到 9，默认 6；zstd 为 1 到 4，默认 2；lz4 不支持设置级别
+	Level int `json:"level"`
+	// Types 按内容类型选择压缩算法和级别，内容类型按扩展名判断
+	Types []CompressionTypePolicy `json:"types"`
+	// BlockSize 压缩分块的大小，单位字节，默认 262144；Range 请求只解压涉及的分块
+	BlockSize int `json:"block_size"`
+	// SkipExtensions 不压缩的扩展名，为空时使用内置的已压缩格式列表
+	SkipExtensions []string `json:"skip_extensions"`
+	// Rules 按路径前缀开启或关闭压缩，匹配最长的前缀，没有匹配的规则时压缩
+	Rules []CompressionRule `json:"rules"`
+}
+
+// CompressionRule 结构表示一条压缩规则
+type CompressionRule struct {
+	// Prefix 路径前缀，按目录匹配，为空时匹配所有文件
+	Prefix  string `json:"prefix"`
+	Enabled bool   `json:"enabled"`
+}
+
+// defaultSkipExtensions 是默认不压缩的扩展名，这些格式已经压缩过，再压缩几乎没有收益
+var defaultSkipExtensions = []string{
+	".gz", ".tgz", ".zst", ".xz", ".bz2", ".lz4", ".br", ".zip", ".7z", ".rar", ".jar",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif", ".heic",
+	".mp3", ".m4a", ".aac", ".ogg", ".flac", ".mp4", ".m4v", ".mkv", ".mov", ".webm",
+	".docx", ".xlsx", ".pptx", ".pdf",
+}
+
+// 压缩文件的格式：文件头为 8 字节标识、1 字节算法编号和 4 字节分块大小，
+// 之后每个分块为 1 字节类型（0 为原样保存，其他为压缩算法的编号，如 1 为 deflate）、4 字节长度和数据，
+// 文件末尾为每个分块的偏移量、分块数、原始大小和 8 字节索引标识
+const (
+	compressionMagic      = "STORECMP"
+	compressionIndexMagic = "STORECIX"
+	compressionHeaderLen  = len(compressionMagic) + 1 + 4
+	compressionTrailerLen = 8 + 8 + len(compressionIndexMagic)
+
+	blockStored = 0
+)
+
+var errCompressionFormat = errors.New("压缩文件格式错误")
+
+// compressionRule 是解析后的压缩规则
+type compressionRule struct {
+	prefix  string
+	enabled bool
+}
+
+// Compressor 结构用于压缩和解压 data 目录下的文件
+type Compressor struct {
+	codec     *CompressionCodec
+	level     int
+	types     []compressionTypeRule
+	blockSize int
+	skip      map[string]bool
+	// rules 按前缀长度从长到短排列
+	rules []compressionRule
+}
+
+// compressor 未启用透明压缩时为 nil，已压缩的文件仍然可以读取
+var compressor *Compressor
+
+// usableAtRest 检查算法能否用于存储时的压缩
+func usableAtRest(codec *CompressionCodec) error {
+	if codec.ID == 0 {
+		return fmt.Errorf("压缩算法 %s 不能用于存储时的压缩", codec.Name)
+	}
+	return nil
+}
+
+// defaultCompressionAlgorithm 返回默认的压缩算法，使用 -tags zstd 构建时为 zstd，否则为 deflate
+func defaultCompressionAlgorithm() string {
+	if _, ok := compressionCodecs["zstd"]; ok {
+		return "zstd"
+	}
+	return "deflate"
+}
+
+// NewCompressor 解析压缩配置，不支持的算法返回错误
+func NewCompressor(config CompressionConfig) (*Compressor, error) {
+	if config.Algorithm == "" {
+		config.Algorithm = defaultCompressionAlgorithm()
+	}
+	codec, err := lookupCompressionCodec(config.Algorithm)
+	if err == nil {
+		err = usableAtRest(codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	level, err := codec.resolveLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	types, err := parseCompressionTypes(config.Types, usableAtRest, []*CompressionCodec{codec})
+	if err != nil {
+		return nil, err
+	}
+	if config.BlockSize <= 0 {
+		config.BlockSize = 256 << 10
+	}
+	extensions := config.SkipExtensions
+	if len(extensions) == 0 {
+		extensions = defaultSkipExtensions
+	}
+	c := &Compressor{codec: codec, level: level, types: types, blockSize: config.BlockSize, skip: map[string]bool{}}
+	for _, ext := range extensions {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		c.skip[strings.ToLower(ext)] = true
+	}
+	for _, rule := range config.Rules {
+		c.rules = append(c.rules, compressionRule{prefix: indexKey(rule.Prefix), enabled: rule.Enabled})
+	}
+	sort.SliceStable(c.rules, func(i, j int) bool {
+		return len(c.rules[i].prefix) > len(c.rules[j].prefix)
+	})
+	return c, nil
+}
+
+// ShouldCompress 判断路径对应的文件是否需要压缩
+func (c *Compressor) ShouldCompress(key string) bool {
+	if c == nil || key == "" {
+		return false
+	}
+	if c.skip[strings.ToLower(path.Ext(key))] {
+		return false
+	}
+	if rule, ok := matchCompressionType(c.types, extensionMediaType(key)); ok && rule.disabled {
+		return false
+	}
+	for _, rule := range c.rules {
+		if rule.prefix == "" || key == rule.prefix || strings.HasPrefix(key, rule.prefix+"/") {
+			return rule.enabled
+		}
+	}
+	return true
+}
+
+// choose 返回路径按内容类型使用的压缩算法和级别
+func (c *Compressor) choose(key string) (*CompressionCodec, int) {
+	codec, level := c.codec, c.level
+	rule, ok := matchCompressionType(c.types, extensionMediaType(key))
+	if !ok {
+		return codec, level
+	}
+	if rule.codec != nil && rule.codec != codec {
+		codec, level = rule.codec, rule.codec.DefaultLevel
+	}
+	if rule.level != 0 {
+		level = rule.level
+	}
+	return codec, level
+}
+
+// compressWriter 将写入的内容按分块压缩后写入 file，关闭时写入分块索引
+type compressWriter struct {
+	c     *Compressor
+	file  io.WriteCloser
+	codec *CompressionCodec
+	level int
+	// stream 为流式算法的压缩器，实现 Reset 时每个分块复用
+	stream  io.WriteCloser
+	scratch bytes.Buffer
+	buf     []byte
+	offsets []uint64
+	offset  uint64
+	size    uint64
+	err     error
+}
+
+// Writer 返回压缩写入 file 的 Writer，按 key 的内容类型选择算法，创建时先写入文件头
+func (c *Compressor) Writer(file io.WriteCloser, key string) (io.WriteCloser, error) {
+	codec, level := c.choose(key)
+	header := make([]byte, compressionHeaderLen)
+	copy(header, compressionMagic)
+	header[len(compressionMagic)] = codec.ID
+	binary.BigEndian.PutUint32(header[len(compressionMagic)+1:], uint32(c.blockSize))
+	_, err := file.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	w := &compressWriter{c: c, file: file, codec: codec, level: level, buf: make([]byte, 0, c.blockSize), offset: uint64(len(header))}
+	return w, nil
+}
+
+// compressBlock 压缩缓冲区中的一块
+func (w *compressWriter) compressBlock() ([]byte, error) {
+	if w.codec.CompressBlock != nil {
+		return w.codec.CompressBlock(w.buf, w.level), nil
+	}
+	w.scratch.Reset()
+	if resetter, ok := w.stream.(interface{ Reset(io.Writer) }); ok {
+		resetter.Reset(&w.scratch)
+	} else {
+		stream, err := w.codec.NewWriter(&w.scratch, w.level)
+		if err != nil {
+			return nil, err
+		}
+		w.stream = stream
+	}
+	_, err := w.stream.Write(w.buf)
+	if err == nil {
+		err = w.stream.Close()
+	}
+	return w.scratch.Bytes(), err
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):w.c.blockSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == w.c.blockSize {
+			w.err = w.flush()
+			if w.err != nil {
+				return written, w.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush 压缩并写出缓冲区中的一块，压缩后没有明显变小的分块原样保存，每个分块记录使用的算法
+func (w *compressWriter) flush() error {
+	data, err := w.compressBlock()
+	if err != nil {
+		return err
+	}
+	kind := w.codec.ID
+	if len(data) >= len(w.buf)-len(w.buf)/20 {
+		kind, data = blockStored, w.buf
+	}
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	_, err = w.file.Write(header)
+	if err == nil {
+		_, err = w.file.Write(data)
+	}
+	if err != nil {
+		return err
+	}
+	w.offsets = append(w.offsets, w.offset)
+	w.offset += uint64(len(header) + len(data))
+	w.size += uint64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *compressWriter) Close() error {
+	err := w.err
+	if err == nil && len(w.buf) > 0 {
+		err = w.flush()
+	}
+	if err == nil {
+		trailer := make([]byte, 8*len(w.offsets)+compressionTrailerLen)
+		for i, offset := range w.offsets {
+			binary.BigEndian.PutUint64(trailer[8*i:], offset)
+		}
+		tail := trailer[8*len(w.offsets):]
+		binary.BigEndian.PutUint64(tail, uint64(len(w.offsets)))
+		binary.BigEndian.PutUint64(tail[8:], w.size)
+		copy(tail[16:], compressionIndexMagic)
+		_, err = w.file.Write(trailer)
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decompressReader 按分块解压文件，支持 Seek，可以直接用于 http.ServeContent
+type decompressReader struct {
+	src       io.ReadSeekCloser
+	blockSize int64
+	offsets   []uint64
+	size      int64
+
+	pos   int64
+	index int64
+	plain []byte
+}
+
+// newDecompressReader 读取文件末尾的分块索引并返回解压 src 的 Reader，src 必须以压缩文件头开始
+func newDecompressReader(src io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	header := make([]byte, compressionHeaderLen)
+	_, err := src.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.ReadFull(src, header)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := compressionCodecsByID[header[len(compressionMagic)]]; !ok {
+		return nil, errCompressionFormat
+	}
+	blockSize := int64(binary.BigEndian.Uint32(header[len(compressionMagic)+1:]))
+
+	end, err := src.Seek(-int64(compressionTrailerLen), io.SeekEnd)
+	if err != nil {
+		return nil, errCompressionFormat
+	}
+	tail := make([]byte, compressionTrailerLen)
+	_, err = io.ReadFull(src, tail)
+	if err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint64(tail)
+	size := int64(binary.BigEndian.Uint64(tail[8:]))
+	// 除最后一块外每块都是完整的，没有分块时内容为空
+	valid := string(tail[16:]) == compressionIndexMagic && blockSize > 0 && count <= uint64(end)/8
+	if count == 0 {
+		valid = valid && size == 0
+	} else {
+		valid = valid && size > (int64(count)-1)*blockSize && size <= int64(count)*blockSize
+	}
+	if !valid {
+		return nil, errCompressionFormat
+	}
+	index := make([]byte, 8*count)
+	_, err = src.Seek(end-int64(len(index)), io.SeekStart)
+	if err == nil {
+		_, err = io.ReadFull(src, index)
+	}
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, count)
+	for i := range offsets {
+		offsets[i] = binary.BigEndian.Uint64(index[8*i:])
+	}
+	return &decompressReader{src: src, blockSize: blockSize, offsets: offsets, size: size, index: -1}, nil
+}
+
+// load 读取并解压第 i 块
+func (r *decompressReader) load(i int64) error {
+	if r.index == i {
+		return nil
+	}
+	expected := r.blockSize
+	if i == int64(len(r.offsets))-1 {
+		expected = r.size - i*r.blockSize
+	}
+	_, err := r.src.Seek(int64(r.offsets[i]), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 5)
+	_, err = io.ReadFull(r.src, header)
+	if err != nil {
+		return err
+	}
+	length := int64(binary.BigEndian.Uint32(header[1:]))
+	if length > 2*r.blockSize+64 {
+		return errCompressionFormat
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r.src, data)
+	if err != nil {
+		return err
+	}
+	if header[0] != blockStored {
+		codec, ok := compressionCodecsByID[header[0]]
+		if !ok {
+			return errCompressionFormat
+		}
+		data, err = codec.decompressBlock(data, expected)
+		if err != nil {
+			return fmt.Errorf("解压文件失败: %w", err)
+		}
+	}
+	if int64(len(data)) != expected {
+		return errCompressionFormat
+	}
+	r.index = i
+	r.plain = data
+	return nil
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := r.pos / r.blockSize
+	err := r.load(i)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, r.plain[r.pos-i*r.blockSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decompressReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("无效的 whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("负的偏移量")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *decompressReader) Close() error {
+	return r.src.Close()
+}
+
+// isCompressedStream 判断内容是否以压缩文件头开始，读取后回到开头
+func isCompressedStream(src io.ReadSeeker) (bool, error) {
+	magic := make([]byte, len(compressionMagic))
+	n, err := io.ReadFull(src, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	_, err = src.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	return n == len(magic) && string(magic) == compressionMagic, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig 结构用于配置浏览器跨域访问
+type CORSConfig struct {
+	// AllowedOrigins 允许跨域访问的来源，如 https://app.example.com，* 表示允许所有来源
+	AllowedOrigins []string `json:"allowed_origins"`
+	// MaxAge 浏览器缓存预检结果的时间，单位秒，默认 600
+	MaxAge int `json:"max_age"`
+}
+
+// corsMethods 是允许跨域使用的请求方法
+const corsMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// corsExposedHeaders 是允许浏览器脚本读取的响应头
+const corsExposedHeaders = "Content-Disposition, Content-Length, ETag, Last-Modified, Location, Retry-After, X-Preview-Truncated, " +
+	"Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires, Upload-Metadata"
+
+// CORSMiddleware 为允许的来源添加跨域响应头，并直接响应预检请求。
+// 预检请求在认证之前处理，浏览器发送预检时不会携带 Authorization
+func CORSMiddleware(next http.Handler, config CORSConfig) http.Handler {
+	allowed := map[string]bool{}
+	for _, origin := range config.AllowedOrigins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+	maxAge := config.MaxAge
+	if maxAge <= 0 {
+		maxAge = 600
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			header.Set("Access-Control-Allow-Methods", corsMethods)
+			// X-FormFile-Path、X-Meta-* 等自定义请求头较多，直接允许预检请求中列出的请求头
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				header.Set("Access-Control-Allow-Headers", requested)
+			}
+			header.Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestDebug 结构是请求带 X-Debug: true 时收集的诊断信息，只返回给有 admin 权限的调用方，
+// 只在处理请求的 goroutine 中修改
+type RequestDebug struct {
+	// Stages 为各阶段的耗时，按完成的顺序排列
+	Stages  []DebugStage `json:"stages"`
+	TotalMs float64      `json:"total_ms"`
+	// Backend 为读写文件使用的后端：data、archive（归档层）、migration（双写迁移的旧后端）或 dedup（内容池）
+	Backend string `json:"backend,omitempty"`
+	// PhysicalPath 为文件在磁盘上的实际路径
+	PhysicalPath string `json:"physical_path,omitempty"`
+	// Cache 为各缓存是否命中，值为 hit 或 miss
+	Cache map[string]string `json:"cache,omitempty"`
+
+	start time.Time
+	last  time.Time
+}
+
+// DebugStage 结构是一个阶段的耗时，从上一个阶段结束时开始计算
+type DebugStage struct {
+	Name string  `json:"name"`
+	Ms   float64 `json:"ms"`
+}
+
+// debugKey 是请求上下文中保存诊断信息的键
+type debugKey struct{}
+
+// requestDebug 返回请求的诊断信息，请求没有带 X-Debug 时返回 nil
+func requestDebug(r *http.Request) *RequestDebug {
+	d, _ := r.Context().Value(debugKey{}).(*RequestDebug)
+	return d
+}
+
+// debugStage 结束一个阶段，同时记录在诊断信息和追踪中
+func debugStage(r *http.Request, name string) {
+	if d := requestDebug(r); d != nil {
+		d.mark(name)
+	}
+	traceStage(r, name)
+}
+
+// debugCache 记录缓存是否命中
+func debugCache(r *http.Request, name string, hit bool) {
+	d := requestDebug(r)
+	if d == nil {
+		return
+	}
+	if d.Cache == nil {
+		d.Cache = map[string]string{}
+	}
+	d.Cache[name] = "miss"
+	if hit {
+		d.Cache[name] = "hit"
+	}
+}
+
+// debugPath 记录文件的实际路径，未指定后端时按路径判断
+func debugPath(r *http.Request, backend string, physicalPath string) {
+	d := requestDebug(r)
+	if d == nil {
+		return
+	}
+	if backend == "" {
+		backend = readBackend(physicalPath)
+	}
+	d.Backend = backend
+	d.PhysicalPath = physicalPath
+}
+
+// readBackend 判断 statReadPath 返回的路径属于哪个后端
+func readBackend(fullPath string) string {
+	if storageClasses != nil && storageClasses.config.ArchiveDir != "" && isWithinDir(storageClasses.config.ArchiveDir, fullPath) {
+		return "archive"
+	}
+	if migration != nil && isWithinDir(migration.oldDir, fullPath) {
+		return "migration"
+	}
+	return "data"
+}
+
+func (d *RequestDebug) mark(name string) {
+	now := time.Now()
+	d.Stages = append(d.Stages, DebugStage{Name: name, Ms: float64(now.Sub(d.last).Microseconds()) / 1000})
+	d.last = now
+}
+
+// DebugMiddleware 处理带 X-Debug: true 的请求：JSON 响应中增加 debug 字段，
+// 文件下载等其他响应在 X-Debug-Info 响应头中返回开始发送响应之前收集的信息。
+// 公开文件和签名链接不经过认证，因此在这里单独确认调用方有 admin 权限，否则忽略该请求头
+func DebugMiddleware(next http.Handler, auth AuthProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enabled, _ := strconv.ParseBool(r.Header.Get("X-Debug")); !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity, err := auth.ValidateCredentials(r.Context(), r)
+		if err != nil || !identity.HasScope(scopeAdmin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		d := &RequestDebug{Stages: []DebugStage{}, start: now, last: now}
+		dw := &debugWriter{ResponseWriter: w, debug: d}
+		next.ServeHTTP(dw, r.WithContext(context.WithValue(r.Context(), debugKey{}, d)))
+		dw.finish()
+	})
+}
+
+// debugWriter 缓冲 JSON 响应，结束后加入诊断信息
+type debugWriter struct {
+	http.ResponseWriter
+	debug *RequestDebug
+
+	wroteHeader bool
+	status      int
+	buffered    bool
+	body        bytes.Buffer
+}
+
+func (w *debugWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	if strings.Contains(w.Header().Get("Content-Type"), "json") {
+		w.buffered = true
+		w.Header().Del("Content-Length")
+		return
+	}
+	w.debug.TotalMs = float64(time.Since(w.debug.start).Microseconds()) / 1000
+	info, err := json.Marshal(w.debug)
+	if err == nil {
+		w.Header().Set("X-Debug-Info", string(info))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *debugWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffered {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush 支持流式响应，缓冲的 JSON 响应在结束时一起写出
+func (w *debugWriter) Flush() {
+	if w.buffered {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *debugWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish 将诊断信息加入缓冲的 JSON 响应并写出，响应不是 JSON 对象时原样写出
+func (w *debugWriter) finish() {
+	if !w.buffered {
+		return
+	}
+	w.debug.TotalMs = float64(time.Since(w.debug.start).Microseconds()) / 1000
+	data := w.body.Bytes()
+	var response map[string]json.RawMessage
+	if json.Unmarshal(data, &response) == nil {
+		info, err := json.Marshal(w.debug)
+		if err == nil {
+			response["debug"] = info
+			if encoded, err := json.Marshal(response); err == nil {
+				data = append(encoded, '\n')
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(data)
+	if err != nil {
+		slog.Warn("写入响应失败", "err", err)
+	}
+}
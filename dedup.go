@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// blobsDirName 是 data 目录下按内容哈希保存文件内容的目录名
+const blobsDirName = ".blobs"
+
+// DedupConfig 结构用于配置按内容去重，相同内容的文件只占用一份空间
+type DedupConfig struct {
+	Enabled bool `json:"enabled"`
+	// MinSize 小于该大小的文件不去重，单位字节，默认 0 表示所有文件都去重
+	MinSize int64 `json:"min_size"`
+	// GCInterval 清理没有引用的内容的间隔，单位小时，默认 24
+	GCInterval int `json:"gc_interval"`
+}
+
+var errDedupUnsupported = errors.New("当前平台不支持按内容去重")
+
+// BlobStore 结构用于按内容去重：文件内容保存在 data/.blobs/<sha256 前两位>/<sha256>，
+// 路径树中的文件是指向它的硬链接，引用计数即硬链接数减一，没有引用的内容由 GC 删除
+type BlobStore struct {
+	config DedupConfig
+
+	// mu 保证 GC 不会删除正在被链接的内容
+	mu sync.Mutex
+}
+
+// blobStore 未启用去重时为 nil
+var blobStore *BlobStore
+
+// BlobStats 结构表示去重的统计信息
+type BlobStats struct {
+	Blobs int `json:"blobs"`
+	// References 为路径树中引用这些内容的文件数，包括历史版本和回收站中的文件
+	References uint64 `json:"references"`
+	// PhysicalBytes 为实际占用的空间，LogicalBytes 为不去重时需要的空间
+	PhysicalBytes int64 `json:"physical_bytes"`
+	LogicalBytes  int64 `json:"logical_bytes"`
+	// Orphaned 为没有引用、等待 GC 删除的内容数
+	Orphaned int `json:"orphaned"`
+}
+
+// BlobGCResult 结构表示一次 GC 的结果
+type BlobGCResult struct {
+	Removed    int   `json:"removed"`
+	FreedBytes int64 `json:"freed_bytes"`
+}
+
+// NewBlobStore 创建按内容去重的存储，依赖硬链接数作为引用计数，不支持的平台上返回错误
+func NewBlobStore(config DedupConfig) (*BlobStore, error) {
+	if !linkCountSupported {
+		return nil, errDedupUnsupported
+	}
+	if config.GCInterval <= 0 {
+		config.GCInterval = 24
+	}
+	err := os.MkdirAll(filepath.Join("data", blobsDirName), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobStore{config: config}, nil
+}
+
+// blobPath 返回内容哈希对应的完整路径
+func blobPath(sum string) string {
+	return filepath.Join("data", blobsDirName, sum[:2], sum)
+}
+
+// placeDataFile 将已写完的临时文件放到目标位置，启用去重时相同内容只保留一份；dedup 为功能开关是否对该文件启用去重
+func placeDataFile(tmpPath string, sum string, target string, dedup bool) (bool, error) {
+	if blobStore == nil || !dedup {
+		return false, os.Rename(tmpPath, target)
+	}
+	return blobStore.Place(tmpPath, sum, target)
+}
+
+// Place 将临时文件放到目标位置：内容已存在时链接到已有的内容并删除临时文件，
+// 否则将临时文件加入内容池；返回是否复用了已有的内容
+func (b *BlobStore) Place(tmpPath string, sum string, target string) (bool, error) {
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return false, err
+	}
+	if len(sum) < 2 || info.Size() < b.config.MinSize {
+		return false, os.Rename(tmpPath, target)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	blob := blobPath(sum)
+	blobInfo, err := os.Stat(blob)
+	if err == nil && blobInfo.Size() == info.Size() {
+		// 先在临时目录中创建链接再重命名，覆盖目标文件时不会出现文件不存在的间隙
+		linkPath := tmpPath + ".link"
+		err = os.Link(blob, linkPath)
+		if err != nil {
+			return false, err
+		}
+		err = os.Rename(linkPath, target)
+		if err != nil {
+			_ = os.Remove(linkPath)
+			return false, err
+		}
+		// 目标已经是同一内容的链接时重命名不做任何操作，需要删除多余的链接
+		_ = os.Remove(linkPath)
+		_ = os.Remove(tmpPath)
+		// 更新修改时间，按修改时间计算的过期规则不会误删刚上传的文件
+		now := time.Now()
+		if err := os.Chtimes(blob, now, now); err != nil {
+			slog.Error("更新内容修改时间失败", "err", err)
+		}
+		return true, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(blob), os.ModePerm)
+	if err != nil {
+		return false, err
+	}
+	// 大小不一致说明内容池中的文件已损坏，用新内容替换，已有的引用不受影响
+	_ = os.Remove(blob)
+	err = os.Link(tmpPath, blob)
+	if err != nil {
+		return false, err
+	}
+	existenceFilter.AddHash(sum)
+	return false, os.Rename(tmpPath, target)
+}
+
+// walk 遍历内容池中的所有内容
+func (b *BlobStore) walk(fn func(path string, info os.FileInfo, links uint64)) error {
+	root := filepath.Join("data", blobsDirName)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		links, _ := linkCount(info)
+		fn(path, info, links)
+		return nil
+	})
+}
+
+// Stats 返回去重的统计信息
+func (b *BlobStore) Stats() (BlobStats, error) {
+	var stats BlobStats
+	err := b.walk(func(_ string, info os.FileInfo, links uint64) {
+		stats.Blobs++
+		stats.PhysicalBytes += info.Size()
+		if links <= 1 {
+			stats.Orphaned++
+			return
+		}
+		stats.References += links - 1
+		stats.LogicalBytes += int64(links-1) * info.Size()
+	})
+	return stats, err
+}
+
+// GC 删除没有任何引用的内容
+func (b *BlobStore) GC() (BlobGCResult, error) {
+	var result BlobGCResult
+	var orphans []string
+	err := b.walk(func(path string, _ os.FileInfo, links uint64) {
+		if links <= 1 {
+			orphans = append(orphans, path)
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, path := range orphans {
+		// 遍历之后可能又被链接，删除前再检查一次
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if links, _ := linkCount(info); links > 1 {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			slog.Error("删除没有引用的内容失败", "err", err)
+			continue
+		}
+		result.Removed++
+		result.FreedBytes += info.Size()
+	}
+	existenceFilter.Forget(result.Removed)
+	return result, nil
+}
+
+// Run 定期清理没有引用的内容
+func (b *BlobStore) Run() {
+	ticker := time.NewTicker(time.Duration(b.config.GCInterval) * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		result, err := b.GC()
+		if err != nil {
+			slog.Error("清理没有引用的内容失败", "err", err)
+			continue
+		}
+		if result.Removed > 0 {
+			slog.Info("已清理没有引用的内容", "removed", result.Removed, "freed_bytes", result.FreedBytes)
+		}
+	}
+}
+
+// 查看去重的统计信息
+func blobStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if blobStore == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用去重", nil, r.URL.Path)
+		return
+	}
+	stats, err := blobStore.Stats()
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", stats, nil, r.URL.Path)
+}
+
+// 立即清理没有引用的内容
+func blobGCHandler(w http.ResponseWriter, r *http.Request) {
+	if blobStore == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用去重", nil, r.URL.Path)
+		return
+	}
+	result, err := blobStore.GC()
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "清理失败", err, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", result, nil, r.URL.Path)
+}
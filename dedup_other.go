@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// linkCountSupported 表示当前平台能否读取硬链接数
+const linkCountSupported = false
+
+// linkCount 在非 Linux 平台上无法读取硬链接数
+func linkCount(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
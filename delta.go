@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 增量上传的分块大小范围，未指定时按文件大小的平方根选取
+const (
+	deltaMinBlockSize = 512
+	deltaMaxBlockSize = 8 << 20
+)
+
+// 增量上传请求体中的指令：C 后跟 8 字节起始块号和 4 字节块数，从原文件复制连续的块；
+// D 后跟 4 字节长度和数据，写入新的数据。整数均为大端序
+const (
+	deltaOpCopy = 'C'
+	deltaOpData = 'D'
+)
+
+// deltaMaxLiteral 是一条数据指令的长度上限
+const deltaMaxLiteral = 64 << 20
+
+// DeltaBlock 结构表示一个块的签名，Weak 为 rsync 的滚动校验和，Strong 为块的 SHA-256 的前 16 字节
+type DeltaBlock struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// DeltaSignature 结构是文件的块签名，客户端据此计算与新内容的差异
+type DeltaSignature struct {
+	Path      string       `json:"path"`
+	Size      int64        `json:"size"`
+	SHA256    string       `json:"sha256"`
+	BlockSize int          `json:"block_size"`
+	Blocks    []DeltaBlock `json:"blocks"`
+}
+
+// rollingChecksum 是 rsync 的滚动校验和，窗口滑动一个字节时可以在常数时间内更新
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+// newRollingChecksum 计算一个窗口的校验和
+func newRollingChecksum(window []byte) *rollingChecksum {
+	c := &rollingChecksum{n: uint32(len(window))}
+	for i, x := range window {
+		c.a += uint32(x)
+		c.b += uint32(len(window)-i) * uint32(x)
+	}
+	return c
+}
+
+// Sum 返回校验和，低 16 位为 a，高 16 位为 b
+func (c *rollingChecksum) Sum() uint32 {
+	return c.a&0xffff | c.b<<16
+}
+
+// Roll 将窗口向后移动一个字节，out 为移出窗口的字节，in 为移入的字节
+func (c *rollingChecksum) Roll(out byte, in byte) {
+	c.a += uint32(in) - uint32(out)
+	c.b += c.a - c.n*uint32(out)
+}
+
+// strongBlockSum 返回块的强校验和
+func strongBlockSum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+// deltaBlockSize 返回文件默认的分块大小，为文件大小的平方根按 1 KiB 取整并限制在范围内
+func deltaBlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size))) &^ 1023
+	return min(max(blockSize, deltaMinBlockSize), deltaMaxBlockSize)
+}
+
+// computeDeltaSignature 读取文件计算每个块的签名和整个文件的哈希
+func computeDeltaSignature(reader io.Reader, blockSize int) (DeltaSignature, error) {
+	signature := DeltaSignature{BlockSize: blockSize, Blocks: []DeltaBlock{}}
+	whole := sha256.New()
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			block := buf[:n]
+			whole.Write(block)
+			signature.Size += int64(n)
+			signature.Blocks = append(signature.Blocks, DeltaBlock{
+				Weak:   newRollingChecksum(block).Sum(),
+				Strong: strongBlockSum(block),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return signature, err
+		}
+	}
+	signature.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return signature, nil
+}
+
+// 返回文件的块签名，block_size 可选
+func deltaSignatureHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少路径参数", nil, r.URL.Path)
+		return
+	}
+	if isReservedPath(path) || isUnsafePath(path) {
+		sendJSONResponse(w, http.StatusNotFound, "文件不存在", nil, r.URL.Path)
+		return
+	}
+	fullPath, fileInfo, err := statReadPath(path)
+	if err != nil || fileInfo.IsDir() {
+		sendJSONResponse(w, http.StatusNotFound, "文件不存在", err, r.URL.Path)
+		return
+	}
+
+	file, err := openDataFile(fullPath)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+		return
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "closing file", "err", err)
+		}
+	}(file)
+
+	// 压缩或加密的文件大小与内容大小不同，按内容大小选取分块大小
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+		return
+	}
+	blockSize := deltaBlockSize(size)
+	if value := r.URL.Query().Get("block_size"); value != "" {
+		blockSize, err = strconv.Atoi(value)
+		if err != nil || blockSize < deltaMinBlockSize || blockSize > deltaMaxBlockSize {
+			sendJSONResponse(w, http.StatusBadRequest, fmt.Sprintf("block_size 应在 %d 到 %d 之间", deltaMinBlockSize, deltaMaxBlockSize), err, r.URL.Path)
+			return
+		}
+	}
+
+	signature, err := computeDeltaSignature(bufio.NewReaderSize(file, blockSize), blockSize)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+		return
+	}
+	signature.Path = indexKey(path)
+	sendContentResponse(w, http.StatusOK, "success", signature, nil, r.URL.Path)
+}
+
+// applyDelta 按指令从原文件和请求体生成新的内容写入 w，返回从原文件复用的字节数
+func applyDelta(w io.Writer, base io.ReadSeeker, baseSize int64, blockSize int64, ops io.Reader) (int64, error) {
+	reader := bufio.NewReader(ops)
+	blocks := (baseSize + blockSize - 1) / blockSize
+	var reused int64
+	header := make([]byte, 12)
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			return reused, nil
+		} else if err != nil {
+			return reused, err
+		}
+		switch op {
+		case deltaOpCopy:
+			_, err = io.ReadFull(reader, header[:12])
+			if err != nil {
+				return reused, errors.New("增量指令不完整")
+			}
+			start := int64(binary.BigEndian.Uint64(header[:8]))
+			count := int64(binary.BigEndian.Uint32(header[8:12]))
+			if start < 0 || count <= 0 || start+count > blocks {
+				return reused, fmt.Errorf("块 %d 到 %d 超出原文件的范围", start, start+count)
+			}
+			offset := start * blockSize
+			length := min(count*blockSize, baseSize-offset)
+			_, err = base.Seek(offset, io.SeekStart)
+			if err == nil {
+				_, err = io.CopyN(w, base, length)
+			}
+			if err != nil {
+				return reused, err
+			}
+			reused += length
+		case deltaOpData:
+			_, err = io.ReadFull(reader, header[:4])
+			if err != nil {
+				return reused, errors.New("增量指令不完整")
+			}
+			length := int64(binary.BigEndian.Uint32(header[:4]))
+			if length > deltaMaxLiteral {
+				return reused, fmt.Errorf("数据指令的长度 %d 超过上限 %d", length, deltaMaxLiteral)
+			}
+			_, err = io.CopyN(w, reader, length)
+			if err != nil {
+				return reused, errors.New("增量指令不完整")
+			}
+		default:
+			return reused, fmt.Errorf("未知的增量指令 %q", op)
+		}
+	}
+}
+
+// 按增量指令修改已有的文件：新的内容写入临时文件并通过哈希校验后，与普通上传一样原子替换原文件
+func deltaApplyHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.Header.Get("X-FormFile-Path")
+	if path == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少存储路径", nil, r.URL.Path)
+		return
+	}
+	if isReservedPath(path) || isUnsafePath(path) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的存储路径", nil, r.URL.Path)
+		return
+	}
+	if !checkCatalogPublish(w, r, indexKey(path)) {
+		return
+	}
+	baseSHA256 := strings.ToLower(r.Header.Get("X-Delta-Base-SHA256"))
+	expectedSHA256 := strings.ToLower(r.Header.Get("X-Content-SHA256"))
+	blockSize, err := strconv.Atoi(r.Header.Get("X-Delta-Block-Size"))
+	if baseSHA256 == "" || expectedSHA256 == "" || err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少 X-Delta-Base-SHA256、X-Delta-Block-Size 或 X-Content-SHA256", err, r.URL.Path)
+		return
+	}
+	if blockSize < deltaMinBlockSize || blockSize > deltaMaxBlockSize {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 X-Delta-Block-Size", nil, r.URL.Path)
+		return
+	}
+	ttl, err := parseTTL(r.Header.Get("X-Expire-After"))
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 X-Expire-After", err, r.URL.Path)
+		return
+	}
+	storageClass, err := storageClasses.ParseClass(r.Header.Get("X-Storage-Class"))
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 X-Storage-Class", err, r.URL.Path)
+		return
+	}
+
+	// 原文件在获取签名之后被修改时，指令中的块号不再对应原来的内容
+	key := indexKey(path)
+	release := lockWritePath(w, r, key, "增量上传", true)
+	if release == nil {
+		return
+	}
+	defer release()
+	if !checkWORM(w, r, key) {
+		return
+	}
+	fullPath, fileInfo, err := statReadPath(path)
+	if err != nil || fileInfo.IsDir() {
+		sendJSONResponse(w, http.StatusNotFound, "原文件不存在", err, r.URL.Path)
+		return
+	}
+	_, currentSHA256, err := statContent(key, fullPath, fileInfo)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+		return
+	}
+	if currentSHA256 != baseSHA256 {
+		sendJSONResponse(w, http.StatusConflict, "原文件已被修改，请重新获取签名", nil, r.URL.Path)
+		return
+	}
+
+	base, err := openDataFile(fullPath)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+		return
+	}
+	defer func(base io.ReadSeekCloser) {
+		err := base.Close()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "closing file", "err", err)
+		}
+	}(base)
+	baseSize, err := base.Seek(0, io.SeekEnd)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+		return
+	}
+
+	// 新文件的大小未知，按原文件加上请求体的大小检查剩余空间
+	err = diskGuard.Check(baseSize + r.ContentLength)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInsufficientStorage, "磁盘剩余空间不足", err, r.URL.Path)
+		return
+	}
+
+	tmpFile, tmpPath, err := createTempDataFile(key, identityName(r))
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "创建文件失败", err, r.URL.Path)
+		return
+	}
+	defer func(tmpPath string) {
+		// 成功时临时文件已被重命名，这里只清理失败留下的文件
+		err := os.Remove(tmpPath)
+		if err != nil && !os.IsNotExist(err) {
+			slog.ErrorContext(r.Context(), "清理临时文件失败", "err", err)
+		}
+	}(tmpPath)
+
+	sha256Hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmpFile, sha256Hash)}
+	reused, err := applyDelta(counter, base, baseSize, int64(blockSize), r.Body)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "应用增量失败", err, r.URL.Path)
+		return
+	}
+	// 配置了大小上限或通过签名链接上传时限制新文件的大小
+	if limit, limited := r.Context().Value(uploadLimitKey{}).(int64); limited && counter.n > limit {
+		sendJSONResponse(w, http.StatusRequestEntityTooLarge, "文件超过允许的大小", nil, r.URL.Path)
+		return
+	}
+
+	result := UploadResult{
+		Path:        key,
+		Size:        counter.n,
+		SHA256:      hex.EncodeToString(sha256Hash.Sum(nil)),
+		ReusedBytes: reused,
+	}
+	if result.SHA256 != expectedSHA256 {
+		sendContentResponse(w, http.StatusBadRequest, "SHA-256 校验失败", result, nil, r.URL.Path)
+		return
+	}
+	storeUploadedFile(w, r, tmpPath, filepath.Join("data", filepath.FromSlash(key)), result, ttl, storageClass)
+}
+
+// countingWriter 记录写入的字节数
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// deltaEncoder 将本地文件与签名比较，生成增量指令；相邻的复制指令合并为一条
+type deltaEncoder struct {
+	w         *bufio.Writer
+	copyStart int64
+	copyCount int64
+	// Literal 为写入的新数据的字节数
+	Literal int64
+}
+
+func (e *deltaEncoder) copyBlock(index int64) error {
+	if e.copyCount > 0 && e.copyStart+e.copyCount == index && e.copyCount < math.MaxUint32 {
+		e.copyCount++
+		return nil
+	}
+	err := e.flushCopy()
+	e.copyStart, e.copyCount = index, 1
+	return err
+}
+
+func (e *deltaEncoder) flushCopy() error {
+	if e.copyCount == 0 {
+		return nil
+	}
+	header := make([]byte, 13)
+	header[0] = deltaOpCopy
+	binary.BigEndian.PutUint64(header[1:9], uint64(e.copyStart))
+	binary.BigEndian.PutUint32(header[9:13], uint32(e.copyCount))
+	e.copyCount = 0
+	_, err := e.w.Write(header)
+	return err
+}
+
+func (e *deltaEncoder) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	err := e.flushCopy()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 5)
+	header[0] = deltaOpData
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(data)))
+	_, err = e.w.Write(header)
+	if err == nil {
+		_, err = e.w.Write(data)
+	}
+	e.Literal += int64(len(data))
+	return err
+}
+
+// deltaLiteralChunk 是客户端一条数据指令的最大长度，未匹配的数据达到该长度时写出，不必在内存中保留
+const deltaLiteralChunk = 1 << 20
+
+// encodeDelta 读取新的内容，按滚动校验和在任意偏移处查找与原文件相同的块，生成增量指令写入 w
+func encodeDelta(w io.Writer, content io.Reader, signature DeltaSignature) (int64, error) {
+	blockSize := signature.BlockSize
+	// 只有最后一块可能不满一块，单独比较
+	full := map[uint32][]int64{}
+	var tail *DeltaBlock
+	tailSize := int(signature.Size % int64(blockSize))
+	for i, block := range signature.Blocks {
+		if tailSize > 0 && i == len(signature.Blocks)-1 {
+			tail = &signature.Blocks[i]
+			break
+		}
+		full[block.Weak] = append(full[block.Weak], int64(i))
+	}
+
+	encoder := &deltaEncoder{w: bufio.NewWriter(w)}
+	var data []byte
+	pos, lit := 0, 0
+	eof := false
+	chunk := make([]byte, max(blockSize, 64<<10))
+	// fill 保证窗口之后至少还有 need 字节，丢弃已经处理过的数据
+	fill := func(need int) error {
+		for !eof && len(data)-pos < need {
+			if lit > 0 {
+				data = append(data[:0], data[lit:]...)
+				pos -= lit
+				lit = 0
+			}
+			n, err := content.Read(chunk)
+			data = append(data, chunk[:n]...)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var sum *rollingChecksum
+	for {
+		err := fill(blockSize + 1)
+		if err != nil {
+			return encoder.Literal, err
+		}
+		if len(data)-pos < blockSize {
+			break
+		}
+		window := data[pos : pos+blockSize]
+		if sum == nil {
+			sum = newRollingChecksum(window)
+		}
+		matched := int64(-1)
+		if candidates, ok := full[sum.Sum()]; ok {
+			strong := strongBlockSum(window)
+			for _, index := range candidates {
+				if signature.Blocks[index].Strong == strong {
+					matched = index
+					break
+				}
+			}
+		}
+		if matched >= 0 {
+			err = encoder.literal(data[lit:pos])
+			if err == nil {
+				err = encoder.copyBlock(matched)
+			}
+			if err != nil {
+				return encoder.Literal, err
+			}
+			pos += blockSize
+			lit = pos
+			sum = nil
+			continue
+		}
+		if pos+blockSize >= len(data) {
+			break
+		}
+		sum.Roll(data[pos], data[pos+blockSize])
+		pos++
+		if pos-lit >= deltaLiteralChunk {
+			err = encoder.literal(data[lit:pos])
+			if err != nil {
+				return encoder.Literal, err
+			}
+			lit = pos
+		}
+	}
+
+	// 剩余不满一块的数据可能与原文件最后一块相同
+	rest := data[pos:]
+	var err error
+	if tail != nil && len(rest) == tailSize && newRollingChecksum(rest).Sum() == tail.Weak && strongBlockSum(rest) == tail.Strong {
+		err = encoder.literal(data[lit:pos])
+		if err == nil {
+			err = encoder.copyBlock(int64(len(signature.Blocks) - 1))
+		}
+	} else {
+		err = encoder.literal(data[lit:])
+	}
+	if err == nil {
+		err = encoder.flushCopy()
+	}
+	if err == nil {
+		err = encoder.w.Flush()
+	}
+	return encoder.Literal, err
+}
+
+// deltaUploadCommand 将本地文件以增量方式上传到已有的路径，只传输修改过的部分
+func deltaUploadCommand(args []string) int {
+	flags := flag.NewFlagSet("delta-upload", flag.ContinueOnError)
+	to := flags.String("to", "", "实例地址")
+	token := flags.String("token", "", "访问 token，为空时读取 config.json")
+	key := flags.String("path", "", "实例上的存储路径")
+	blockSize := flags.Int("block-size", 0, "分块大小，为 0 时由实例按文件大小选取")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *to == "" || *key == "" || flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "用法: delta-upload -to <实例地址> -path <存储路径> <本地文件>\n")
+		return 2
+	}
+	if *token == "" {
+		config, err := LoadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			return 1
+		}
+		*token = config.Token
+	}
+	store := newRemoteSyncStore(*to, *token, time.Hour)
+	localPath := flags.Arg(0)
+
+	// 获取原文件的签名
+	query := url.Values{"path": {*key}}
+	if *blockSize > 0 {
+		query.Set("block_size", strconv.Itoa(*blockSize))
+	}
+	req, err := http.NewRequest(http.MethodGet, store.url+"/delta/signature?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	var signatureResponse struct {
+		Status  int            `json:"status"`
+		Message string         `json:"message"`
+		Content DeltaSignature `json:"content"`
+	}
+	err = store.do(req, &signatureResponse)
+	if err == nil && signatureResponse.Status != 1 {
+		err = errors.New(signatureResponse.Message)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 获取签名失败 %s\n", err)
+		return 1
+	}
+	signature := signatureResponse.Content
+
+	// 请求头中需要新内容的哈希，先读一遍文件
+	file, err := os.Open(localPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 读取文件失败 %s\n", err)
+		return 1
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 读取文件失败 %s\n", err)
+		return 1
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum == signature.SHA256 {
+		fmt.Printf("%s 内容未修改\n", *key)
+		return 0
+	}
+
+	body, writer := io.Pipe()
+	go func() {
+		_, err := encodeDelta(writer, file, signature)
+		_ = writer.CloseWithError(err)
+	}()
+	req, err = http.NewRequest(http.MethodPost, store.url+"/delta/apply", body)
+	if err != nil {
+		_ = body.Close()
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-FormFile-Path", *key)
+	req.Header.Set("X-Delta-Base-SHA256", signature.SHA256)
+	req.Header.Set("X-Delta-Block-Size", strconv.Itoa(signature.BlockSize))
+	req.Header.Set("X-Content-SHA256", sum)
+	var applyResponse struct {
+		Status  int          `json:"status"`
+		Message string       `json:"message"`
+		Content UploadResult `json:"content"`
+	}
+	err = store.do(req, &applyResponse)
+	_ = body.Close()
+	if err == nil && applyResponse.Status != 1 {
+		err = errors.New(applyResponse.Message)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 增量上传失败 %s\n", err)
+		return 1
+	}
+	result := applyResponse.Content
+	fmt.Printf("%s 已更新：%d 字节，复用 %d 字节，传输 %d 字节\n", result.Path, result.Size, result.ReusedBytes, result.Size-result.ReusedBytes)
+	return 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// DiskGuardConfig 结构用于配置上传前检查 data 目录所在卷的剩余空间
+type DiskGuardConfig struct {
+	// MinFreeMB 上传后至少保留的剩余空间，单位 MB，0 表示不检查
+	MinFreeMB int64 `json:"min_free_mb"`
+	// MinFreePercent 上传后至少保留的剩余空间占总空间的百分比，0 表示不检查
+	MinFreePercent float64 `json:"min_free_percent"`
+}
+
+var (
+	errDiskSpaceLow        = errors.New("磁盘剩余空间不足")
+	errDiskFreeUnsupported = errors.New("当前平台不支持检查磁盘剩余空间")
+)
+
+// DiskGuard 结构用于在上传前检查剩余空间，避免写入一半时磁盘写满留下不完整的文件
+type DiskGuard struct {
+	config DiskGuardConfig
+	dir    string
+	// warnOnce 保证不支持的平台上只记录一次日志
+	warnOnce sync.Once
+}
+
+// diskGuard 未配置剩余空间下限时为 nil
+var diskGuard *DiskGuard
+
+// NewDiskGuard 创建剩余空间检查，未配置下限时返回 nil
+func NewDiskGuard(config DiskGuardConfig, dir string) *DiskGuard {
+	if config.MinFreeMB <= 0 && config.MinFreePercent <= 0 {
+		return nil
+	}
+	return &DiskGuard{config: config, dir: dir}
+}
+
+// Check 判断写入 incoming 字节后剩余空间是否仍然高于下限，无法获取剩余空间时不拒绝上传
+func (g *DiskGuard) Check(incoming int64) error {
+	if g == nil {
+		return nil
+	}
+	free, total, err := diskFree(g.dir)
+	if err != nil {
+		g.warnOnce.Do(func() {
+			slog.Error("无法获取磁盘剩余空间", "err", err)
+		})
+		return nil
+	}
+	if incoming < 0 {
+		incoming = 0
+	}
+	remaining := int64(free) - incoming
+	if g.config.MinFreeMB > 0 && remaining < g.config.MinFreeMB<<20 {
+		return fmt.Errorf("%w：剩余 %d MB，下限 %d MB", errDiskSpaceLow, remaining>>20, g.config.MinFreeMB)
+	}
+	if g.config.MinFreePercent > 0 && total > 0 {
+		percent := float64(remaining) / float64(total) * 100
+		if percent < g.config.MinFreePercent {
+			return fmt.Errorf("%w：剩余 %.1f%%，下限 %.1f%%", errDiskSpaceLow, percent, g.config.MinFreePercent)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// diskFree 返回 dir 所在卷上非特权用户可用的剩余空间和总空间，单位字节
+func diskFree(dir string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+// sameFilesystem 判断两个路径是否位于同一文件系统，不同文件系统之间无法原子重命名
+func sameFilesystem(a string, b string) (bool, error) {
+	var statA, statB syscall.Stat_t
+	err := syscall.Stat(a, &statA)
+	if err != nil {
+		return false, err
+	}
+	err = syscall.Stat(b, &statB)
+	if err != nil {
+		return false, err
+	}
+	return statA.Dev == statB.Dev, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// diskFree 在非 Linux 平台上不检查剩余空间
+func diskFree(dir string) (uint64, uint64, error) {
+	return 0, 0, errDiskFreeUnsupported
+}
+
+// sameFilesystem 在非 Linux 平台上不检查，视为同一文件系统
+func sameFilesystem(a string, b string) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EgressConfig 结构用于配置出口流量计费，按调用方和分享链接每天汇总返回的字节数
+type EgressConfig struct {
+	Enabled bool `json:"enabled"`
+	// AccountKey token 元数据中计费账号的键名，默认 billing_account
+	AccountKey string `json:"account_key"`
+	// PricePerGB 每 GB（10^9 字节）出口流量的价格，用于导出时计算费用
+	PricePerGB float64 `json:"price_per_gb"`
+	// Currency 价格的币种，默认 USD
+	Currency string `json:"currency"`
+	// RetentionDays 汇总数据保留的天数，默认 400
+	RetentionDays int `json:"retention_days"`
+}
+
+// EgressRollup 结构表示某一天某个调用方或分享链接的出口流量
+type EgressRollup struct {
+	Date string `json:"date"`
+	// Account 为计费账号，token 元数据中没有计费账号时为空
+	Account string `json:"account"`
+	// Kind 为 token（按调用方）、share（按分享链接）或 anonymous（预签名链接等未认证的下载）
+	Kind     string `json:"kind"`
+	Subject  string `json:"subject"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// EgressExportRow 结构表示导出的一行，包括按价格计算的费用
+type EgressExportRow struct {
+	EgressRollup
+	Cost     float64 `json:"cost"`
+	Currency string  `json:"currency"`
+}
+
+// EgressAccounting 结构用于记录出口流量，汇总数据保存在 data/.meta 目录下
+type EgressAccounting struct {
+	file   string
+	config EgressConfig
+
+	mu      sync.Mutex
+	rollups map[string]*EgressRollup
+	dirty   bool
+}
+
+// egressAccounting 未启用出口流量计费时为 nil
+var egressAccounting *EgressAccounting
+
+// OpenEgressAccounting 加载已有的汇总数据，文件不存在时返回空记录
+func OpenEgressAccounting(file string, config EgressConfig) (*EgressAccounting, error) {
+	if config.AccountKey == "" {
+		config.AccountKey = "billing_account"
+	}
+	if config.Currency == "" {
+		config.Currency = "USD"
+	}
+	if config.RetentionDays <= 0 {
+		config.RetentionDays = 400
+	}
+	e := &EgressAccounting{file: file, config: config, rollups: map[string]*EgressRollup{}}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var rollups []*EgressRollup
+	err = json.Unmarshal(data, &rollups)
+	if err != nil {
+		return nil, err
+	}
+	for _, rollup := range rollups {
+		e.rollups[rollupKey(rollup)] = rollup
+	}
+	return e, nil
+}
+
+// rollupKey 返回汇总记录的键
+func rollupKey(rollup *EgressRollup) string {
+	return rollup.Date + "|" + rollup.Kind + "|" + rollup.Subject + "|" + rollup.Account
+}
+
+// egressAccount 返回请求的调用方在 token 元数据中的计费账号
+func egressAccount(r *http.Request) string {
+	if egressAccounting == nil {
+		return ""
+	}
+	if identity := identityFrom(r); identity != nil {
+		return identity.Metadata[egressAccounting.config.AccountKey]
+	}
+	return ""
+}
+
+// Record 记录一次经过认证的下载
+func (e *EgressAccounting) Record(r *http.Request, bytes int64) {
+	if e == nil {
+		return
+	}
+	kind, subject := "anonymous", ""
+	if name := identityName(r); name != "" {
+		kind, subject = "token", name
+	}
+	e.add(kind, subject, egressAccount(r), bytes)
+}
+
+// RecordShare 记录一次通过分享链接的下载，计入创建分享的调用方的计费账号
+func (e *EgressAccounting) RecordShare(share Share, bytes int64) {
+	if e == nil {
+		return
+	}
+	e.add("share", share.ID, share.BillingAccount, bytes)
+}
+
+// add 将字节数累加到当天的汇总记录
+func (e *EgressAccounting) add(kind string, subject string, account string, bytes int64) {
+	rollup := &EgressRollup{
+		Date:    time.Now().UTC().Format("2006-01-02"),
+		Account: account,
+		Kind:    kind,
+		Subject: subject,
+	}
+	key := rollupKey(rollup)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if existing, ok := e.rollups[key]; ok {
+		rollup = existing
+	} else {
+		e.rollups[key] = rollup
+	}
+	rollup.Requests++
+	rollup.Bytes += bytes
+	e.dirty = true
+}
+
+// Export 返回 from 到 to（包含）之间的汇总记录，account 不为空时只返回该计费账号的记录
+func (e *EgressAccounting) Export(from string, to string, account string) []EgressExportRow {
+	e.mu.Lock()
+	rows := []EgressExportRow{}
+	for _, rollup := range e.rollups {
+		if (from != "" && rollup.Date < from) || (to != "" && rollup.Date > to) {
+			continue
+		}
+		if account != "" && rollup.Account != account {
+			continue
+		}
+		rows = append(rows, EgressExportRow{
+			EgressRollup: *rollup,
+			Cost:         float64(rollup.Bytes) / 1e9 * e.config.PricePerGB,
+			Currency:     e.config.Currency,
+		})
+	}
+	e.mu.Unlock()
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Subject < b.Subject
+	})
+	return rows
+}
+
+// Save 删除超过保留天数的记录，并将有修改的汇总数据写回磁盘
+func (e *EgressAccounting) Save() error {
+	cutoff := time.Now().UTC().AddDate(0, 0, -e.config.RetentionDays).Format("2006-01-02")
+	e.mu.Lock()
+	for key, rollup := range e.rollups {
+		if rollup.Date < cutoff {
+			delete(e.rollups, key)
+			e.dirty = true
+		}
+	}
+	if !e.dirty {
+		e.mu.Unlock()
+		return nil
+	}
+	rollups := make([]*EgressRollup, 0, len(e.rollups))
+	for _, rollup := range e.rollups {
+		rollups = append(rollups, rollup)
+	}
+	data, err := json.Marshal(rollups)
+	e.dirty = false
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(e.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := e.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, e.file)
+}
+
+// Run 定期保存汇总数据
+func (e *EgressAccounting) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := e.Save()
+		if err != nil {
+			slog.Error("保存出口流量失败", "err", err)
+		}
+	}
+}
+
+// 导出出口流量汇总，format=csv 时返回 CSV，否则返回 JSON
+func egressExportHandler(w http.ResponseWriter, r *http.Request) {
+	if egressAccounting == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用出口流量计费", nil, r.URL.Path)
+		return
+	}
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	for _, date := range []string{from, to} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, "日期格式应为 YYYY-MM-DD", err, r.URL.Path)
+			return
+		}
+	}
+	rows := egressAccounting.Export(from, to, query.Get("account"))
+
+	if strings.EqualFold(query.Get("format"), "csv") {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", fmt.Sprintf("egress-%s-%s.csv", from, to)))
+		writer := csv.NewWriter(w)
+		_ = writer.Write([]string{"date", "account", "kind", "subject", "requests", "bytes", "cost", "currency"})
+		for _, row := range rows {
+			_ = writer.Write([]string{
+				row.Date,
+				row.Account,
+				row.Kind,
+				row.Subject,
+				strconv.FormatInt(row.Requests, 10),
+				strconv.FormatInt(row.Bytes, 10),
+				strconv.FormatFloat(row.Cost, 'f', 6, 64),
+				row.Currency,
+			})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			slog.WarnContext(r.Context(), "写入出口流量导出失败", "err", err)
+		}
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", rows, nil, r.URL.Path)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// EncryptionConfig 结构用于配置静态加密，启用后写入 data 目录的文件内容使用 AES-256-GCM 分块加密，读取时透明解密
+type EncryptionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Key 32 字节的密钥，十六进制或 base64 编码，支持 file:、env: 和 vault: 引用
+	Key string `json:"key"`
+	// ChunkSize 加密分块的大小，单位字节，默认 65536；修改后已加密的文件仍然可以读取
+	ChunkSize int `json:"chunk_size"`
+}
+
+// 加密文件的格式：文件头为 8 字节标识、4 字节分块大小和 12 字节随机 nonce，
+// 之后每个分块为密文加 16 字节认证标签。第 i 个分块的 nonce 为文件 nonce 的后 8 字节异或 i，
+// 附加数据包括文件头、分块序号和是否为最后一块，分块被调换、截断或追加时解密失败
+const (
+	encryptionMagic     = "STOREENC"
+	encryptionHeaderLen = len(encryptionMagic) + 4 + 12
+)
+
+var (
+	errEncryptedNoKey   = errors.New("文件已加密但未配置密钥")
+	errEncryptionFormat = errors.New("加密文件格式错误")
+)
+
+// Encryptor 结构用于加密和解密 data 目录下的文件
+type Encryptor struct {
+	aead      cipher.AEAD
+	chunkSize int
+}
+
+// encryptor 未启用静态加密时为 nil，已加密的文件仍然需要密钥才能读取
+var encryptor *Encryptor
+
+// NewEncryptor 解析密钥并创建加密器
+func NewEncryptor(config EncryptionConfig) (*Encryptor, error) {
+	key, err := parseEncryptionKey(config.Key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = 64 << 10
+	}
+	return &Encryptor{aead: aead, chunkSize: config.ChunkSize}, nil
+}
+
+// parseEncryptionKey 解析十六进制或 base64 编码的 32 字节密钥
+func parseEncryptionKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if key, err := hex.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("加密密钥必须是 32 字节，十六进制或 base64 编码")
+}
+
+// chunkNonce 返回第 i 个分块的 nonce
+func chunkNonce(base []byte, i uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	counter := binary.BigEndian.Uint64(nonce[4:])
+	binary.BigEndian.PutUint64(nonce[4:], counter^i)
+	return nonce
+}
+
+// chunkAAD 返回第 i 个分块的附加数据
+func chunkAAD(header []byte, i uint64, final bool) []byte {
+	aad := make([]byte, len(header)+9)
+	copy(aad, header)
+	binary.BigEndian.PutUint64(aad[len(header):], i)
+	if final {
+		aad[len(aad)-1] = 1
+	}
+	return aad
+}
+
+// encryptWriter 将写入的内容按分块加密后写入 file，关闭时写入最后一块
+type encryptWriter struct {
+	e      *Encryptor
+	file   io.WriteCloser
+	header []byte
+	nonce  []byte
+	buf    []byte
+	index  uint64
+	err    error
+}
+
+// Writer 返回加密写入 file 的 Writer，创建时先写入文件头
+func (e *Encryptor) Writer(file io.WriteCloser) (io.WriteCloser, error) {
+	header := make([]byte, encryptionHeaderLen)
+	copy(header, encryptionMagic)
+	binary.BigEndian.PutUint32(header[len(encryptionMagic):], uint32(e.chunkSize))
+	nonce := header[len(encryptionMagic)+4:]
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{e: e, file: file, header: header, nonce: nonce, buf: make([]byte, 0, e.chunkSize)}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// 缓冲区满且还有数据时才写出，保证最后一块在关闭时写出
+		if len(w.buf) == w.e.chunkSize {
+			w.err = w.flush(false)
+			if w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buf[len(w.buf):w.e.chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// flush 加密并写出缓冲区中的一块
+func (w *encryptWriter) flush(final bool) error {
+	sealed := w.e.aead.Seal(nil, chunkNonce(w.nonce, w.index), w.buf, chunkAAD(w.header, w.index, final))
+	_, err := w.file.Write(sealed)
+	w.index++
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *encryptWriter) Close() error {
+	err := w.err
+	if err == nil {
+		err = w.flush(true)
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decryptReader 按分块解密文件，支持 Seek，可以直接用于 http.ServeContent
+type decryptReader struct {
+	file      *os.File
+	aead      cipher.AEAD
+	header    []byte
+	nonce     []byte
+	chunkSize int64
+	chunks    int64
+	size      int64
+
+	pos   int64
+	index int64
+	plain []byte
+}
+
+// Reader 返回解密 file 的 Reader，file 必须以加密文件头开始
+func (e *Encryptor) Reader(file *os.File) (io.ReadSeekCloser, error) {
+	if e == nil {
+		return nil, errEncryptedNoKey
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptionHeaderLen)
+	_, err = file.ReadAt(header, 0)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[len(encryptionMagic):]))
+	overhead := int64(e.aead.Overhead())
+	body := info.Size() - int64(encryptionHeaderLen)
+	if chunkSize <= 0 || body < overhead {
+		return nil, errEncryptionFormat
+	}
+	// 除最后一块外每块都是完整的，最后一块可能为空（仅当内容为空时）
+	sealedSize := chunkSize + overhead
+	chunks := (body + sealedSize - 1) / sealedSize
+	last := body - (chunks-1)*sealedSize - overhead
+	if last < 0 {
+		return nil, errEncryptionFormat
+	}
+	return &decryptReader{
+		file:      file,
+		aead:      e.aead,
+		header:    header,
+		nonce:     header[len(encryptionMagic)+4:],
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		size:      (chunks-1)*chunkSize + last,
+		index:     -1,
+	}, nil
+}
+
+// load 读取并解密第 i 块
+func (r *decryptReader) load(i int64) error {
+	if r.index == i {
+		return nil
+	}
+	sealedSize := r.chunkSize + int64(r.aead.Overhead())
+	length := sealedSize
+	final := i == r.chunks-1
+	if final {
+		length = r.size - i*r.chunkSize + int64(r.aead.Overhead())
+	}
+	sealed := make([]byte, length)
+	_, err := r.file.ReadAt(sealed, int64(encryptionHeaderLen)+i*sealedSize)
+	if err != nil {
+		return err
+	}
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.nonce, uint64(i)), sealed, chunkAAD(r.header, uint64(i), final))
+	if err != nil {
+		return fmt.Errorf("解密文件失败: %w", err)
+	}
+	r.index = i
+	r.plain = plain
+	return nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := r.pos / r.chunkSize
+	err := r.load(i)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, r.plain[r.pos-i*r.chunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("无效的 whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("负的偏移量")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.file.Close()
+}
+
+// isEncryptedFile 判断文件是否以加密文件头开始
+func isEncryptedFile(file *os.File) (bool, error) {
+	magic := make([]byte, len(encryptionMagic))
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return n == len(magic) && string(magic) == encryptionMagic, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EventBusConfig 结构用于配置消息总线，每个文件变更都以固定格式的 JSON 发布到 NATS subject 或 Kafka topic，供数据管道消费
+type EventBusConfig struct {
+	// Type 为 nats 或 kafka，为空时不启用
+	Type string `json:"type"`
+	// Servers 为 NATS 服务器或 Kafka broker 的地址 host:port，按顺序尝试连接
+	Servers []string `json:"servers"`
+	// Topic 为 NATS 的 subject 或 Kafka 的 topic
+	Topic string `json:"topic"`
+	// TLS 为 true 时使用 TLS 连接，NATS 服务器要求 TLS 时自动使用
+	TLS bool `json:"tls"`
+	// Token、User 和 Password 为 NATS 的认证信息，支持 env:、file:、vault:// 引用
+	Token    string `json:"token"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// Acks 为 Kafka 需要的确认：-1（默认）等待所有同步副本写入，1 只等待 leader 写入
+	Acks int `json:"acks"`
+	// BatchSize 每次最多发布的事件数，默认 500
+	BatchSize int `json:"batch_size"`
+	// MaxPending 最多积压的事件数，默认 100000，超过时丢弃最早的事件
+	MaxPending int `json:"max_pending"`
+	// Timeout 连接和每次发布的超时时间，单位秒，默认 10
+	Timeout int `json:"timeout"`
+	// Node 为事件中的节点名，默认为主机名
+	Node string `json:"node"`
+}
+
+// busEventSchema 是事件格式的版本，只增加字段时不变，修改或删除字段时升级
+const busEventSchema = "store.file.v1"
+
+// BusEvent 结构是发布到消息总线的事件
+type BusEvent struct {
+	Schema string `json:"schema"`
+	// ID 为事件的唯一 ID，重试时不变，消费方可以用于去重
+	ID string `json:"id"`
+	// Type 为 created、modified 或 deleted
+	Type string `json:"type"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// SHA256 为变更后的内容哈希，删除时和未知时为空
+	SHA256 string `json:"sha256,omitempty"`
+	// Source 与 webhook 事件的 source 相同
+	Source string `json:"source"`
+	// Actor 为执行操作的调用方，后台任务产生的事件为空
+	Actor string `json:"actor,omitempty"`
+	// TrashID 为删除时移入回收站的 ID
+	TrashID string    `json:"trash_id,omitempty"`
+	Node    string    `json:"node"`
+	Time    time.Time `json:"time"`
+}
+
+// busPublisher 是消息总线的客户端，Publish 只在所有事件都被服务器接受后返回 nil，失败时下次调用重新连接
+type busPublisher interface {
+	Publish(events []BusEvent) error
+	Close()
+}
+
+// busState 结构是积压和统计，与积压一起持久化
+type busState struct {
+	Pending     []BusEvent `json:"pending"`
+	Published   int64      `json:"published"`
+	Failures    int64      `json:"failures"`
+	Dropped     int64      `json:"dropped"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt time.Time  `json:"last_error_at"`
+}
+
+// EventBus 结构用于将文件变更事件按顺序批量发布到消息总线，失败时重试直到成功，积压保存在 data/.meta 目录下，重启后继续发布
+type EventBus struct {
+	file      string
+	config    EventBusConfig
+	publisher busPublisher
+
+	mu    sync.Mutex
+	state busState
+	wake  chan struct{}
+	dirty bool
+}
+
+// eventBus 未配置消息总线时为 nil
+var eventBus *EventBus
+
+// OpenEventBus 加载积压并启动发布的 goroutine，未配置类型时返回 nil
+func OpenEventBus(file string, config EventBusConfig) (*EventBus, error) {
+	if config.Type == "" {
+		return nil, nil
+	}
+	if len(config.Servers) == 0 || config.Topic == "" {
+		return nil, fmt.Errorf("event_bus 需要 servers 和 topic")
+	}
+	if config.Acks == 0 {
+		config.Acks = -1
+	}
+	if config.Acks != -1 && config.Acks != 1 {
+		return nil, fmt.Errorf("event_bus.acks 应为 -1 或 1")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = 100000
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10
+	}
+	if config.Node == "" {
+		config.Node, _ = os.Hostname()
+	}
+	b := &EventBus{
+		file:   file,
+		config: config,
+		wake:   make(chan struct{}, 1),
+	}
+	switch config.Type {
+	case "nats":
+		b.publisher = newNATSPublisher(config)
+	case "kafka":
+		b.publisher = newKafkaPublisher(config)
+	default:
+		return nil, fmt.Errorf("event_bus.type 应为 nats 或 kafka")
+	}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &b.state)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	go b.run()
+	return b, nil
+}
+
+// Publish 在文件变更成功后排队发布事件，r 为产生变更的请求，后台任务产生的变更为 nil；未带大小时从文件读取
+func (b *EventBus) Publish(r *http.Request, event BusEvent) {
+	if b == nil {
+		return
+	}
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		slog.Error("生成事件 ID 失败", "err", err)
+		return
+	}
+	event.Schema = busEventSchema
+	event.ID = hex.EncodeToString(id)
+	event.Node = b.config.Node
+	event.Time = time.Now().UTC()
+	if r != nil {
+		event.Actor = identityName(r)
+	}
+	if event.Type != changeDeleted && event.Size == 0 {
+		if info, err := os.Stat(filepath.Join("data", filepath.FromSlash(event.Path))); err == nil && !info.IsDir() {
+			event.Size = info.Size()
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.state.Pending) >= b.config.MaxPending {
+		slog.Error("消息总线积压已满，丢弃事件", "type", b.state.Pending[0].Type, "path", b.state.Pending[0].Path)
+		b.state.Pending = b.state.Pending[1:]
+		b.state.Dropped++
+	}
+	b.state.Pending = append(b.state.Pending, event)
+	b.dirty = true
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// PublishTree 为路径下的每个文件排队发布 created 事件，用于从回收站恢复目录；索引中有记录时带上哈希
+func (b *EventBus) PublishTree(r *http.Request, key string, source string) {
+	if b == nil {
+		return
+	}
+	walkDataFiles(key, func(fileKey string) {
+		event := BusEvent{Type: changeCreated, Path: fileKey, Source: source}
+		if meta, ok := metaIndex.Get(fileKey); ok {
+			event.SHA256 = meta.SHA256
+		}
+		b.Publish(r, event)
+	})
+}
+
+// next 返回下一批需要发布的事件
+func (b *EventBus) next() []BusEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.state.Pending)
+	if n > b.config.BatchSize {
+		n = b.config.BatchSize
+	}
+	return append([]BusEvent(nil), b.state.Pending[:n]...)
+}
+
+// run 按顺序批量发布事件，失败时重新连接并按指数退避重试，最长间隔 1 分钟
+func (b *EventBus) run() {
+	backoff := time.Second
+	for {
+		batch := b.next()
+		if len(batch) == 0 {
+			<-b.wake
+			continue
+		}
+		err := b.publisher.Publish(batch)
+		b.finish(batch, err)
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// finish 记录发布结果，成功时从积压中移除这批事件；发布期间事件可能因积压已满被丢弃
+func (b *EventBus) finish(batch []BusEvent, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dirty = true
+	if err != nil {
+		slog.Error("发布事件失败", "count", len(batch), "type", b.config.Type, "err", err)
+		b.state.Failures++
+		b.state.LastError = err.Error()
+		b.state.LastErrorAt = time.Now()
+		return
+	}
+	sent := make(map[string]bool, len(batch))
+	for _, event := range batch {
+		sent[event.ID] = true
+	}
+	for len(b.state.Pending) > 0 && sent[b.state.Pending[0].ID] {
+		b.state.Pending = b.state.Pending[1:]
+		b.state.Published++
+	}
+}
+
+// Save 将有修改的积压写回磁盘
+func (b *EventBus) Save() error {
+	b.mu.Lock()
+	if !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(b.state)
+	b.dirty = false
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(b.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := b.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, b.file)
+}
+
+// Run 定期保存积压
+func (b *EventBus) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := b.Save()
+		if err != nil {
+			slog.Error("保存消息总线积压失败", "err", err)
+		}
+	}
+}
+
+// writeMetrics 输出积压、发布成功、失败和丢弃的事件数
+func (b *EventBus) writeMetrics(w http.ResponseWriter) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP store_event_bus_pending Number of events waiting to be published.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_event_bus_pending gauge\n")
+	_, _ = fmt.Fprintf(w, "store_event_bus_pending{type=%q} %d\n", b.config.Type, len(b.state.Pending))
+	_, _ = fmt.Fprintf(w, "# HELP store_event_bus_published_total Events accepted by the event bus.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_event_bus_published_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_event_bus_published_total{type=%q} %d\n", b.config.Type, b.state.Published)
+	_, _ = fmt.Fprintf(w, "# HELP store_event_bus_failures_total Failed publish attempts.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_event_bus_failures_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_event_bus_failures_total{type=%q} %d\n", b.config.Type, b.state.Failures)
+	_, _ = fmt.Fprintf(w, "# HELP store_event_bus_dropped_total Events dropped when the backlog was full.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_event_bus_dropped_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_event_bus_dropped_total{type=%q} %d\n", b.config.Type, b.state.Dropped)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventsConfig 结构用于配置 /events 变更推送，界面和同步客户端通过 Server-Sent Events 实时得知文件变更，不必轮询 /list
+type EventsConfig struct {
+	Enabled bool `json:"enabled"`
+	// History 保留的最近事件数，客户端断线重连时按 Last-Event-ID 补发，默认 1000
+	History int `json:"history"`
+	// Buffer 每个连接最多积压的事件数，默认 256，超过时断开该连接，客户端重连后补发
+	Buffer int `json:"buffer"`
+	// MaxClients 最多同时连接的客户端数，默认 100
+	MaxClients int `json:"max_clients"`
+	// Heartbeat 没有事件时发送心跳的间隔，单位秒，默认 15，避免代理因空闲断开连接
+	Heartbeat int `json:"heartbeat"`
+}
+
+// 变更事件的类型
+const (
+	changeCreated  = "created"
+	changeModified = "modified"
+	changeDeleted  = "deleted"
+	// changeReset 表示补发的事件已不在历史中，客户端需要重新列出文件
+	changeReset = "reset"
+)
+
+// ChangeEvent 结构是推送给客户端的变更事件
+type ChangeEvent struct {
+	// ID 为 启动时间-序号，重启后序号重新开始，客户端以此判断是否需要重新列出文件
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+	// Size 为变更后的大小，删除时为 0
+	Size int64 `json:"size"`
+	// Source 为变更的来源，与 webhook 事件的 source 相同
+	Source string    `json:"source,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Time   time.Time `json:"time"`
+
+	seq uint64
+}
+
+// changeSubscriber 是一个 /events 连接，events 被关闭时表示积压已满，连接需要断开
+type changeSubscriber struct {
+	prefixes []string
+	events   chan ChangeEvent
+}
+
+// matches 判断事件是否在连接关注的目录中，删除上级目录时同样通知只关注其中子目录的连接
+func (s *changeSubscriber) matches(event ChangeEvent) bool {
+	if len(s.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if prefix == "" || event.Path == prefix || strings.HasPrefix(event.Path, prefix+"/") ||
+			(event.Type == changeDeleted && strings.HasPrefix(prefix, event.Path+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChangeFeed 结构用于向 /events 的连接广播变更事件，事件只保存在内存中
+type ChangeFeed struct {
+	config EventsConfig
+	// epoch 为启动时间，作为事件 ID 的前缀
+	epoch string
+
+	mu          sync.Mutex
+	seq         uint64
+	history     []ChangeEvent
+	subscribers map[*changeSubscriber]struct{}
+	// published 和 disconnected 为发布的事件数和因积压已满断开的连接数
+	published    int64
+	disconnected int64
+}
+
+// changeFeed 未启用变更推送时为 nil
+var changeFeed *ChangeFeed
+
+// NewChangeFeed 创建变更推送，未启用时返回 nil
+func NewChangeFeed(config EventsConfig) *ChangeFeed {
+	if !config.Enabled {
+		return nil
+	}
+	if config.History <= 0 {
+		config.History = 1000
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = 256
+	}
+	if config.MaxClients <= 0 {
+		config.MaxClients = 100
+	}
+	if config.Heartbeat <= 0 {
+		config.Heartbeat = 15
+	}
+	return &ChangeFeed{
+		config:      config,
+		epoch:       strconv.FormatInt(time.Now().UnixMilli(), 10),
+		subscribers: map[*changeSubscriber]struct{}{},
+	}
+}
+
+// Publish 在文件变更成功后广播事件，r 为产生变更的请求，后台任务产生的变更为 nil；未带大小时从文件读取
+func (f *ChangeFeed) Publish(r *http.Request, event ChangeEvent) {
+	// /list 的长轮询不依赖变更推送，总是需要通知
+	listWatch.Changed(event.Path)
+	if f == nil {
+		return
+	}
+	if event.Type != changeDeleted && event.Size == 0 {
+		if info, err := os.Stat(filepath.Join("data", filepath.FromSlash(event.Path))); err == nil && !info.IsDir() {
+			event.Size = info.Size()
+		}
+	}
+	if r != nil {
+		event.Actor = identityName(r)
+	}
+	event.Time = time.Now().UTC()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	event.seq = f.seq
+	event.ID = fmt.Sprintf("%s-%d", f.epoch, f.seq)
+	f.history = append(f.history, event)
+	if len(f.history) > f.config.History {
+		f.history = f.history[len(f.history)-f.config.History:]
+	}
+	f.published++
+	for subscriber := range f.subscribers {
+		if !subscriber.matches(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			// 客户端读取太慢时断开连接，重连后从历史中补发，不阻塞写操作
+			delete(f.subscribers, subscriber)
+			close(subscriber.events)
+			f.disconnected++
+		}
+	}
+}
+
+// PublishTree 为路径下的每个文件广播 created 事件，用于从回收站恢复目录
+func (f *ChangeFeed) PublishTree(r *http.Request, key string, source string) {
+	if f == nil {
+		listWatch.Changed(key)
+		return
+	}
+	walkDataFiles(key, func(fileKey string) {
+		f.Publish(r, ChangeEvent{Type: changeCreated, Path: fileKey, Source: source})
+	})
+}
+
+// subscribe 注册连接并返回需要补发的事件：lastEventID 为空时不补发，已不在历史中或来自之前的进程时返回 reset 事件
+func (f *ChangeFeed) subscribe(subscriber *changeSubscriber, lastEventID string) ([]ChangeEvent, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subscribers) >= f.config.MaxClients {
+		return nil, false
+	}
+	f.subscribers[subscriber] = struct{}{}
+	if lastEventID == "" {
+		return nil, true
+	}
+	epoch, seqText, _ := strings.Cut(lastEventID, "-")
+	seq, err := strconv.ParseUint(seqText, 10, 64)
+	reset := []ChangeEvent{{ID: fmt.Sprintf("%s-%d", f.epoch, f.seq), Type: changeReset, Time: time.Now().UTC()}}
+	if epoch != f.epoch || err != nil || seq > f.seq {
+		return reset, true
+	}
+	if seq < f.seq && (len(f.history) == 0 || f.history[0].seq > seq+1) {
+		return reset, true
+	}
+	var replay []ChangeEvent
+	for _, event := range f.history {
+		if event.seq > seq && subscriber.matches(event) {
+			replay = append(replay, event)
+		}
+	}
+	return replay, true
+}
+
+// unsubscribe 移除连接，积压已满时连接已被移除
+func (f *ChangeFeed) unsubscribe(subscriber *changeSubscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subscribers[subscriber]; ok {
+		delete(f.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// writeChangeEvent 以 Server-Sent Events 格式写出事件
+func writeChangeEvent(w http.ResponseWriter, event ChangeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", event.ID, data)
+	return err
+}
+
+// 以 Server-Sent Events 推送文件变更，prefix 可以重复以关注多个目录；断线重连时浏览器自动带上 Last-Event-ID 补发错过的事件
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if changeFeed == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用变更推送", nil, r.URL.Path)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendJSONResponse(w, http.StatusInternalServerError, "不支持流式响应", nil, r.URL.Path)
+		return
+	}
+	subscriber := &changeSubscriber{events: make(chan ChangeEvent, changeFeed.config.Buffer)}
+	for _, prefix := range r.URL.Query()["prefix"] {
+		subscriber.prefixes = append(subscriber.prefixes, indexKey(prefix))
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	replay, ok := changeFeed.subscribe(subscriber, lastEventID)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(changeFeed.config.Heartbeat))
+		sendJSONResponse(w, http.StatusServiceUnavailable, "连接数已满，请稍后重试", nil, r.URL.Path)
+		return
+	}
+	defer changeFeed.unsubscribe(subscriber)
+	slog.InfoContext(r.Context(), "开始接收变更事件")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// 避免 nginx 等反向代理缓冲响应
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "retry: 3000\n\n")
+	for _, event := range replay {
+		if writeChangeEvent(w, event) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(time.Duration(changeFeed.config.Heartbeat) * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-subscriber.events:
+			if !ok {
+				slog.ErrorContext(r.Context(), "客户端读取变更事件太慢，已断开", "identity", identityName(r))
+				return
+			}
+			if writeChangeEvent(w, event) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			_, err := fmt.Fprintf(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-stopping:
+			// 停止服务时断开，客户端重连到其他实例
+			return
+		}
+	}
+}
+
+// writeMetrics 输出连接数、发布的事件数和因积压已满断开的连接数
+func (f *ChangeFeed) writeMetrics(w http.ResponseWriter) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP store_events_clients Number of connected /events clients.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_events_clients gauge\n")
+	_, _ = fmt.Fprintf(w, "store_events_clients %d\n", len(f.subscribers))
+	_, _ = fmt.Fprintf(w, "# HELP store_events_published_total Change events published to /events.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_events_published_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_events_published_total %d\n", f.published)
+	_, _ = fmt.Fprintf(w, "# HELP store_events_disconnected_total Clients disconnected because they fell behind.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_events_disconnected_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_events_disconnected_total %d\n", f.disconnected)
+}
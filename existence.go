@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ExistsFilterConfig 结构用于配置存在性检查的布隆过滤器，/exists 和 /dedup-hint 先查询内存中的过滤器，
+// 过滤器判定不存在时直接返回，不访问文件系统
+type ExistsFilterConfig struct {
+	Enabled bool `json:"enabled"`
+	// FalsePositiveRate 过滤器的误判率，误判时再访问文件系统确认，默认 0.01
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+	// RebuildInterval 重建过滤器的间隔，单位小时，默认 6；删除的条目较多时会提前重建
+	RebuildInterval int `json:"rebuild_interval"`
+	// MaxBatch 单次请求最多检查的条目数，默认 10000
+	MaxBatch int `json:"max_batch"`
+}
+
+// bloomFilter 是固定大小的布隆过滤器，使用双重哈希生成 k 个位置
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// newBloomFilter 按预计的条目数和误判率创建过滤器
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1024 {
+		n = 1024
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+func (b *bloomFilter) hashes(value string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = io.WriteString(h, value)
+	sum := h.Sum64()
+	return sum & 0xffffffff, sum>>32 | 1
+}
+
+func (b *bloomFilter) add(value string) {
+	h1, h2 := b.hashes(value)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(value string) bool {
+	h1, h2 := b.hashes(value)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ExistenceFilter 结构用于在内存中记录已知的路径和内容哈希，写入时增量添加，删除的条目在重建时移除
+type ExistenceFilter struct {
+	config ExistsFilterConfig
+
+	mu     sync.RWMutex
+	paths  *bloomFilter
+	hashes *bloomFilter
+	// rebuilding 为 true 时新增的条目同时记录到 pending 中，遍历完成后添加到新的过滤器
+	rebuilding    bool
+	pendingPaths  []string
+	pendingHashes []string
+	ready         bool
+	items         int
+	removed       int
+	rebuild       chan struct{}
+
+	filtered      atomic.Int64
+	confirmed     atomic.Int64
+	falsePositive atomic.Int64
+}
+
+// existenceFilter 未启用时为 nil
+var existenceFilter *ExistenceFilter
+
+// NewExistenceFilter 创建过滤器，过滤器在后台建立，建立完成之前的查询直接访问文件系统
+func NewExistenceFilter(config ExistsFilterConfig) *ExistenceFilter {
+	if config.FalsePositiveRate <= 0 || config.FalsePositiveRate >= 1 {
+		config.FalsePositiveRate = 0.01
+	}
+	if config.RebuildInterval <= 0 {
+		config.RebuildInterval = 6
+	}
+	if config.MaxBatch <= 0 {
+		config.MaxBatch = 10000
+	}
+	return &ExistenceFilter{config: config, rebuild: make(chan struct{}, 1)}
+}
+
+// AddPath 记录写入的路径及其所有上级目录
+func (f *ExistenceFilter) AddPath(key string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ; key != "" && key != "."; key = path.Dir(key) {
+		if f.paths != nil {
+			f.paths.add(key)
+		}
+		if f.rebuilding {
+			f.pendingPaths = append(f.pendingPaths, key)
+		}
+		f.items++
+	}
+}
+
+// AddHash 记录内容池中新增的内容
+func (f *ExistenceFilter) AddHash(sum string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hashes != nil {
+		f.hashes.add(sum)
+	}
+	if f.rebuilding {
+		f.pendingHashes = append(f.pendingHashes, sum)
+	}
+	f.items++
+}
+
+// Forget 记录删除的条目数，过滤器无法移除条目，删除过多时提前重建以保持误判率
+func (f *ExistenceFilter) Forget(n int) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.removed += n
+	tooMany := f.ready && f.removed > f.items/10+1000
+	f.mu.Unlock()
+	if tooMany {
+		select {
+		case f.rebuild <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Entries 返回删除 fullPath 时移除的条目数，目录包括其下所有的文件和子目录，在删除之前调用；未启用时返回 0
+func (f *ExistenceFilter) Entries(fullPath string) int {
+	if f == nil {
+		return 0
+	}
+	n := 0
+	err := filepath.WalkDir(fullPath, func(_ string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	// 只存在于旧后端或读取失败时按一个条目计算
+	if err != nil || n == 0 {
+		return 1
+	}
+	return n
+}
+
+// Rebuild 遍历 data 目录、归档层、旧后端和内容池重新建立过滤器
+func (f *ExistenceFilter) Rebuild() error {
+	f.mu.Lock()
+	f.rebuilding = true
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.rebuilding = false
+		f.pendingPaths, f.pendingHashes = nil, nil
+		f.mu.Unlock()
+	}()
+
+	var keys []string
+	var sums []string
+	collect := func(root string, fn func(key string)) error {
+		return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil || rel == "." {
+				return nil
+			}
+			key := filepath.ToSlash(rel)
+			if root == "data" && d.IsDir() && isReservedPath(key) {
+				return filepath.SkipDir
+			}
+			fn(key)
+			return nil
+		})
+	}
+
+	err := collect("data", func(key string) { keys = append(keys, key) })
+	if err != nil {
+		return err
+	}
+	if storageClasses != nil && storageClasses.config.ArchiveDir != "" {
+		err = collect(storageClasses.config.ArchiveDir, func(key string) {
+			if !strings.HasPrefix(path.Base(key), ".copy-") {
+				keys = append(keys, key)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if migration != nil {
+		err = collect(migration.oldDir, func(key string) { keys = append(keys, key) })
+		if err != nil {
+			return err
+		}
+	}
+	if blobStore != nil {
+		err = blobStore.walk(func(p string, _ os.FileInfo, _ uint64) {
+			sums = append(sums, filepath.Base(p))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// 按当前条目数的两倍分配，之后的写入不会很快使误判率上升
+	paths := newBloomFilter(2*len(keys), f.config.FalsePositiveRate)
+	for _, key := range keys {
+		paths.add(key)
+	}
+	hashes := newBloomFilter(2*len(sums), f.config.FalsePositiveRate)
+	for _, sum := range sums {
+		hashes.add(sum)
+	}
+
+	// 遍历期间写入的条目可能没有被遍历到
+	f.mu.Lock()
+	for _, key := range f.pendingPaths {
+		paths.add(key)
+	}
+	for _, sum := range f.pendingHashes {
+		hashes.add(sum)
+	}
+	f.paths, f.hashes = paths, hashes
+	f.items = len(keys) + len(sums)
+	f.removed = 0
+	f.ready = true
+	f.mu.Unlock()
+	return nil
+}
+
+// Run 建立过滤器并定期重建
+func (f *ExistenceFilter) Run() {
+	ticker := time.NewTicker(time.Duration(f.config.RebuildInterval) * time.Hour)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := f.Rebuild()
+		if err != nil {
+			slog.Error("建立存在性过滤器失败", "err", err)
+		} else {
+			f.mu.RLock()
+			items := f.items
+			f.mu.RUnlock()
+			slog.Info("存在性过滤器已建立", "items", items, "elapsed", time.Since(start))
+		}
+		select {
+		case <-ticker.C:
+		case <-f.rebuild:
+		}
+	}
+}
+
+// mayContainPath 判断路径是否可能存在，过滤器未建立时返回 true
+func (f *ExistenceFilter) mayContainPath(key string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return !f.ready || f.paths.mayContain(key)
+}
+
+// mayContainHash 判断内容是否可能存在，过滤器未建立时返回 true
+func (f *ExistenceFilter) mayContainHash(sum string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return !f.ready || f.hashes.mayContain(sum)
+}
+
+// check 先查询过滤器，可能存在时再调用 confirm 确认
+func (f *ExistenceFilter) check(mayContain bool, confirm func() bool) bool {
+	if !mayContain {
+		f.filtered.Add(1)
+		return false
+	}
+	if confirm() {
+		f.confirmed.Add(1)
+		return true
+	}
+	f.falsePositive.Add(1)
+	return false
+}
+
+// PathExists 判断路径是否存在，包括只在归档层或旧后端中的文件
+func (f *ExistenceFilter) PathExists(key string) bool {
+	return f.check(f.mayContainPath(key), func() bool {
+		_, _, err := statReadPath(key)
+		return err == nil
+	})
+}
+
+// HashExists 判断内容池中是否已有该内容
+func (f *ExistenceFilter) HashExists(sum string) bool {
+	return f.check(f.mayContainHash(sum), func() bool {
+		_, err := os.Stat(blobPath(sum))
+		return err == nil
+	})
+}
+
+// writeMetrics 输出 Prometheus 格式的存在性检查统计
+func (f *ExistenceFilter) writeMetrics(w io.Writer) {
+	if f == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP store_exists_probes_total Existence probes by how they were answered.\n")
+	fmt.Fprintf(w, "# TYPE store_exists_probes_total counter\n")
+	fmt.Fprintf(w, "store_exists_probes_total{result=\"filtered\"} %d\n", f.filtered.Load())
+	fmt.Fprintf(w, "store_exists_probes_total{result=\"confirmed\"} %d\n", f.confirmed.Load())
+	fmt.Fprintf(w, "store_exists_probes_total{result=\"false_positive\"} %d\n", f.falsePositive.Load())
+}
+
+// ExistsRequest 结构用于批量检查路径或内容哈希是否存在
+type ExistsRequest struct {
+	Paths  []string `json:"paths"`
+	SHA256 []string `json:"sha256"`
+}
+
+// 检查路径是否存在，GET 时通过 path 参数检查一个路径，POST 时批量检查
+func existsHandler(w http.ResponseWriter, r *http.Request) {
+	if existenceFilter == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用存在性检查", nil, r.URL.Path)
+		return
+	}
+	var paths []string
+	if r.Method == http.MethodGet {
+		paths = []string{r.URL.Query().Get("path")}
+	} else {
+		var request ExistsRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+			return
+		}
+		paths = request.Paths
+	}
+	if len(paths) == 0 || len(paths) > existenceFilter.config.MaxBatch {
+		sendJSONResponse(w, http.StatusBadRequest, fmt.Sprintf("路径数量应为 1 到 %d", existenceFilter.config.MaxBatch), nil, r.URL.Path)
+		return
+	}
+
+	results := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		key := indexKey(p)
+		// 策略引擎不允许读取的路径按不存在返回，避免探测其他前缀下的文件
+		results[p] = key != "" && !isReservedPath(key) && authorizePath(r, scopeRead, key) && existenceFilter.PathExists(key)
+	}
+	sendContentResponse(w, http.StatusOK, "success", results, nil, r.URL.Path)
+}
+
+// 检查内容池中是否已有指定 SHA-256 的内容，客户端可以据此跳过重复内容的上传
+func dedupHintHandler(w http.ResponseWriter, r *http.Request) {
+	if existenceFilter == nil || blobStore == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用存在性检查或去重", nil, r.URL.Path)
+		return
+	}
+	var request ExistsRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	if len(request.SHA256) == 0 || len(request.SHA256) > existenceFilter.config.MaxBatch {
+		sendJSONResponse(w, http.StatusBadRequest, fmt.Sprintf("哈希数量应为 1 到 %d", existenceFilter.config.MaxBatch), nil, r.URL.Path)
+		return
+	}
+
+	results := make(map[string]bool, len(request.SHA256))
+	for _, sum := range request.SHA256 {
+		normalized := strings.ToLower(sum)
+		results[sum] = isSHA256Hex(normalized) && existenceFilter.HashExists(normalized)
+	}
+	sendContentResponse(w, http.StatusOK, "success", results, nil, r.URL.Path)
+}
+
+// isSHA256Hex 判断字符串是否是十六进制的 SHA-256
+func isSHA256Hex(value string) bool {
+	if len(value) != 64 {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// 可以按路径和调用方灰度启用的功能
+const (
+	featureVersioning = "versioning"
+	featureDedup      = "dedup"
+	featureEncryption = "encryption"
+	featureThumbnail  = "thumbnail"
+)
+
+var featureNames = []string{featureVersioning, featureDedup, featureEncryption, featureThumbnail}
+
+// FeatureFlag 结构用于配置一个功能的启用范围，路径前缀和调用方满足其一即启用；
+// 配置了开关但 All、Prefixes 和 Tenants 都为空时在所有路径上关闭该功能
+type FeatureFlag struct {
+	// All 为 true 时在所有路径上启用，相当于没有配置开关
+	All bool `json:"all"`
+	// Prefixes 为启用该功能的路径前缀，按目录匹配，如 beta 匹配 beta 和 beta/a.txt，不匹配 beta2
+	Prefixes []string `json:"prefixes"`
+	// Tenants 为启用该功能的调用方名称，如 token 名称、JWT 的 sub 或客户端证书的 CN
+	Tenants []string `json:"tenants"`
+}
+
+// FeatureFlags 结构用于判断功能在某个路径上是否启用。开关只限制已在配置中启用的功能的范围，
+// 通过管理接口修改的开关保存在运行时设置中（键为 features.功能名称），覆盖配置文件中的同名开关
+type FeatureFlags struct {
+	config   map[string]FeatureFlag
+	settings *Settings
+}
+
+// featureFlags 判断功能在某个路径上是否启用
+var featureFlags *FeatureFlags
+
+// NewFeatureFlags 检查配置中的开关，legacyFile 为之前保存通过管理接口修改的开关的文件，
+// 存在时将其中的开关导入运行时设置后删除
+func NewFeatureFlags(config map[string]FeatureFlag, settings *Settings, legacyFile string) (*FeatureFlags, error) {
+	for name := range config {
+		if !isFeatureName(name) {
+			return nil, fmt.Errorf("未知的功能 %q，应为 %s 之一", name, strings.Join(featureNames, "、"))
+		}
+	}
+	f := &FeatureFlags{config: config, settings: settings}
+	data, err := os.ReadFile(legacyFile)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var overrides map[string]json.RawMessage
+	err = json.Unmarshal(data, &overrides)
+	if err != nil {
+		return nil, err
+	}
+	for name, flag := range overrides {
+		key := settingFeaturePrefix + name
+		if settings.has(key) {
+			continue
+		}
+		err = settings.Set(key, flag, "")
+		if err != nil {
+			return nil, fmt.Errorf("导入功能开关 %s 失败 %w", name, err)
+		}
+	}
+	slog.Info("已将功能开关导入运行时设置", "file", legacyFile)
+	return f, os.Remove(legacyFile)
+}
+
+func isFeatureName(name string) bool {
+	for _, n := range featureNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// flag 返回功能当前生效的开关，没有配置开关时返回 false
+func (f *FeatureFlags) flag(name string) (FeatureFlag, bool) {
+	if flag, ok := f.settings.value(settingFeaturePrefix + name).(*FeatureFlag); ok {
+		return *flag, true
+	}
+	flag, ok := f.config[name]
+	return flag, ok
+}
+
+// Enabled 判断功能对路径 key 和调用方 tenant 是否启用，没有配置该功能的开关时总是启用
+func (f *FeatureFlags) Enabled(name string, key string, tenant string) bool {
+	if f == nil {
+		return true
+	}
+	flag, ok := f.flag(name)
+	if !ok || flag.All {
+		return true
+	}
+	for _, prefix := range flag.Prefixes {
+		prefix = indexKey(prefix)
+		if prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	for _, t := range flag.Tenants {
+		if tenant != "" && t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// Set 修改功能的开关并保存，by 为修改开关的调用方
+func (f *FeatureFlags) Set(name string, flag FeatureFlag, by string) error {
+	data, err := json.Marshal(flag)
+	if err != nil {
+		return err
+	}
+	return f.settings.Set(settingFeaturePrefix+name, data, by)
+}
+
+// Reset 删除通过管理接口修改的开关，恢复为配置文件中的开关
+func (f *FeatureFlags) Reset(name string) error {
+	return f.settings.Reset(settingFeaturePrefix + name)
+}
+
+// FeatureStatus 结构表示一个功能的开关状态
+type FeatureStatus struct {
+	Name string `json:"name"`
+	// Available 为功能是否已在配置中启用，未启用的功能不受开关影响，始终关闭
+	Available bool `json:"available"`
+	// Flag 为当前生效的开关，为空时在所有路径上启用
+	Flag *FeatureFlag `json:"flag,omitempty"`
+	// Source 为开关的来源：config 或 admin
+	Source string `json:"source,omitempty"`
+}
+
+// Status 返回所有功能的开关状态
+func (f *FeatureFlags) Status() []FeatureStatus {
+	available := map[string]bool{
+		featureVersioning: versioning != nil,
+		featureDedup:      blobStore != nil,
+		featureEncryption: encryptor != nil,
+		featureThumbnail:  true,
+	}
+	var statuses []FeatureStatus
+	for _, name := range featureNames {
+		status := FeatureStatus{Name: name, Available: available[name]}
+		if flag, ok := f.flag(name); ok {
+			status.Flag = &flag
+			status.Source = "config"
+			if f.settings.has(settingFeaturePrefix + name) {
+				status.Source = "admin"
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// writeMetrics 输出每个功能的开关状态，1 表示在所有路径上启用
+func (f *FeatureFlags) writeMetrics(w http.ResponseWriter) {
+	if f == nil {
+		return
+	}
+	_, _ = fmt.Fprintf(w, "# HELP store_feature_flag_global Whether a feature is enabled on all paths.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_feature_flag_global gauge\n")
+	for _, status := range f.Status() {
+		global := 0
+		if status.Flag == nil || status.Flag.All {
+			global = 1
+		}
+		_, _ = fmt.Fprintf(w, "store_feature_flag_global{feature=%q} %d\n", status.Name, global)
+	}
+}
+
+// FeatureFlagRequest 结构是修改功能开关的请求
+type FeatureFlagRequest struct {
+	Feature string `json:"feature"`
+	FeatureFlag
+	// Reset 为 true 时删除通过管理接口修改的开关，恢复为配置文件中的开关
+	Reset bool `json:"reset"`
+}
+
+// 查询或修改功能开关，GET 返回所有功能的开关状态，POST 修改一个功能的开关
+func featuresHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		sendContentResponse(w, http.StatusOK, "success", featureFlags.Status(), nil, r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+		return
+	}
+	var request FeatureFlagRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Feature == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	if !isFeatureName(request.Feature) {
+		sendJSONResponse(w, http.StatusBadRequest, "未知的功能", nil, r.URL.Path)
+		return
+	}
+	if request.Reset {
+		err = featureFlags.Reset(request.Feature)
+	} else {
+		err = featureFlags.Set(request.Feature, request.FeatureFlag, identityName(r))
+	}
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "保存功能开关失败", err, r.URL.Path)
+		return
+	}
+	slog.InfoContext(r.Context(), "功能开关已修改", "feature", request.Feature)
+	sendContentResponse(w, http.StatusOK, "success", featureFlags.Status(), nil, r.URL.Path)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// FieldSelection 是客户端通过 fields 参数选择返回的字段，nil 表示返回全部字段
+type FieldSelection map[string]bool
+
+// jsonFieldNames 返回结构体在 JSON 中的字段名
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		if name, _ := jsonFieldTag(t.Field(i)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// jsonFieldTag 返回字段在 JSON 中的名称以及是否带有 omitempty，不输出的字段名称为空
+func jsonFieldTag(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" || !field.IsExported() {
+		return "", false
+	}
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, strings.Contains(","+options+",", ",omitempty,")
+}
+
+// parseFields 解析查询参数 fields（如 name,size），entry 为响应中条目的类型，用于检查字段名；未指定时返回 nil
+func parseFields(r *http.Request, entry any) (FieldSelection, error) {
+	value := r.URL.Query().Get("fields")
+	if value == "" {
+		return nil, nil
+	}
+	names := jsonFieldNames(reflect.TypeOf(entry))
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+	selection := FieldSelection{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("不支持的字段 %s，可选字段为 %s", name, strings.Join(names, ","))
+		}
+		selection[name] = true
+	}
+	if len(selection) == 0 {
+		return nil, nil
+	}
+	return selection, nil
+}
+
+// Has 判断是否需要返回字段 name，用于跳过计算哈希等开销较大的字段
+func (s FieldSelection) Has(name string) bool {
+	return s == nil || s[name]
+}
+
+// Project 只保留选择的字段，未选择字段时原样返回；带有 omitempty 的空字段与完整响应一样省略
+func (s FieldSelection) Project(entry any) any {
+	if s == nil {
+		return entry
+	}
+	v := reflect.ValueOf(entry)
+	t := v.Type()
+	projected := make(map[string]any, len(s))
+	for i := 0; i < t.NumField(); i++ {
+		name, omitEmpty := jsonFieldTag(t.Field(i))
+		if name == "" || !s[name] {
+			continue
+		}
+		field := v.Field(i)
+		if omitEmpty && field.IsZero() {
+			continue
+		}
+		projected[name] = field.Interface()
+	}
+	return projected
+}
+
+// withoutFields 返回去掉 fields 参数的请求，集群转发时各节点需要返回完整的条目用于合并
+func withoutFields(r *http.Request) *http.Request {
+	query := r.URL.Query()
+	if !query.Has("fields") {
+		return r
+	}
+	query.Del("fields")
+	stripped := *r
+	stripped.URL = new(url.URL)
+	*stripped.URL = *r.URL
+	stripped.URL.RawQuery = query.Encode()
+	return &stripped
+}
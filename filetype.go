@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// FileTypeConfig 结构用于限制允许上传的文件类型，文件名的扩展名和嗅探到的内容类型都需要通过检查
+type FileTypeConfig struct {
+	// AllowExtensions 不为空时只允许这些扩展名，如 [".jpg", ".tar.gz"]，不区分大小写
+	AllowExtensions []string `json:"allow_extensions"`
+	// DenyExtensions 禁止的扩展名，文件名中任意一段扩展名匹配即拒绝，如 .php 同时拒绝 a.php 和 a.php.jpg
+	DenyExtensions []string `json:"deny_extensions"`
+	// AllowTypes 不为空时只允许这些内容类型，支持 image/* 形式的通配
+	AllowTypes []string `json:"allow_types"`
+	// DenyTypes 禁止的内容类型，如 application/x-msdownload、application/x-executable
+	DenyTypes []string `json:"deny_types"`
+}
+
+// FileTypeRejection 结构是文件类型不被允许时返回的内容
+type FileTypeRejection struct {
+	// Reason 为 extension 或 content_type，表示被拒绝的依据
+	Reason      string `json:"reason"`
+	Extension   string `json:"extension"`
+	ContentType string `json:"content_type,omitempty"`
+	// Allowed 为配置的允许列表，被禁止列表拒绝时为空
+	Allowed []string `json:"allowed,omitempty"`
+}
+
+// FileTypeFilter 结构用于按配置检查上传的文件类型
+type FileTypeFilter struct {
+	config FileTypeConfig
+}
+
+// fileTypeFilter 未配置文件类型限制时为 nil
+var fileTypeFilter *FileTypeFilter
+
+// NewFileTypeFilter 创建文件类型检查，未配置任何列表时返回 nil
+func NewFileTypeFilter(config FileTypeConfig) *FileTypeFilter {
+	if len(config.AllowExtensions)+len(config.DenyExtensions)+len(config.AllowTypes)+len(config.DenyTypes) == 0 {
+		return nil
+	}
+	normalize := func(values []string, dot bool) []string {
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			value = strings.ToLower(strings.TrimSpace(value))
+			if dot && !strings.HasPrefix(value, ".") {
+				value = "." + value
+			}
+			if value != "" && value != "." {
+				result = append(result, value)
+			}
+		}
+		return result
+	}
+	return &FileTypeFilter{config: FileTypeConfig{
+		AllowExtensions: normalize(config.AllowExtensions, true),
+		DenyExtensions:  normalize(config.DenyExtensions, true),
+		AllowTypes:      normalize(config.AllowTypes, false),
+		DenyTypes:       normalize(config.DenyTypes, false),
+	}}
+}
+
+// CheckName 按文件名的扩展名检查，在接收文件内容之前调用
+func (f *FileTypeFilter) CheckName(key string) *FileTypeRejection {
+	if f == nil {
+		return nil
+	}
+	name := strings.ToLower(path.Base(key))
+	rejection := &FileTypeRejection{Reason: "extension", Extension: path.Ext(name)}
+	for _, ext := range f.config.DenyExtensions {
+		if strings.HasSuffix(name, ext) || strings.Contains(name, ext+".") {
+			rejection.Extension = ext
+			return rejection
+		}
+	}
+	if len(f.config.AllowExtensions) == 0 {
+		return nil
+	}
+	for _, ext := range f.config.AllowExtensions {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return nil
+		}
+	}
+	rejection.Allowed = f.config.AllowExtensions
+	return rejection
+}
+
+// CheckContent 按嗅探到的内容类型检查，tmpPath 为已写完的临时文件，加密或压缩的内容先还原再嗅探
+func (f *FileTypeFilter) CheckContent(key string, tmpPath string) (*FileTypeRejection, error) {
+	if f == nil || len(f.config.AllowTypes)+len(f.config.DenyTypes) == 0 {
+		return nil, nil
+	}
+	file, err := openDataFile(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(file)
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	contentType := sniffContentType(buf[:n])
+	rejection := &FileTypeRejection{Reason: "content_type", Extension: path.Ext(strings.ToLower(key)), ContentType: contentType}
+	for _, pattern := range f.config.DenyTypes {
+		if matchContentType(pattern, contentType) {
+			return rejection, nil
+		}
+	}
+	if len(f.config.AllowTypes) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range f.config.AllowTypes {
+		if matchContentType(pattern, contentType) {
+			return nil, nil
+		}
+	}
+	rejection.Allowed = f.config.AllowTypes
+	return rejection, nil
+}
+
+// executableSignatures 是 http.DetectContentType 不识别、但通常需要拦截的可执行内容
+var executableSignatures = []struct {
+	prefix      []byte
+	contentType string
+}{
+	{[]byte("MZ"), "application/x-msdownload"},
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xca\xfe\xba\xbe"), "application/x-mach-binary"},
+	{[]byte("#!"), "text/x-shellscript"},
+	{[]byte("<?php"), "application/x-httpd-php"},
+}
+
+// sniffContentType 嗅探内容类型，不带 charset 等参数
+func sniffContentType(head []byte) string {
+	for _, signature := range executableSignatures {
+		if bytes.HasPrefix(head, signature.prefix) {
+			return signature.contentType
+		}
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return strings.TrimSpace(contentType)
+}
+
+// matchContentType 判断内容类型是否匹配 image/png 或 image/* 形式的规则
+func matchContentType(pattern string, contentType string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(contentType, prefix+"/")
+	}
+	return pattern == contentType
+}
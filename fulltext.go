@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ContentSearchConfig 结构用于配置全文搜索
+type ContentSearchConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxFileSize 参与索引的文件大小上限，单位字节，默认 10MB
+	MaxFileSize int64 `json:"max_file_size"`
+}
+
+// ContentIndex 是文本文件内容的倒排索引，持久化在 data/.meta/content.json
+type ContentIndex struct {
+	mu      sync.RWMutex
+	file    string
+	maxSize int64
+	// docs 记录每个文件包含的词，持久化时只保存这一部分
+	docs map[string][]string
+	// terms 是由 docs 生成的倒排表
+	terms map[string]map[string]bool
+	dirty bool
+}
+
+// OpenContentIndex 打开全文索引，文件不存在时返回空索引
+func OpenContentIndex(file string, cfg ContentSearchConfig) (*ContentIndex, error) {
+	ci := &ContentIndex{
+		file:    file,
+		maxSize: cfg.MaxFileSize,
+		docs:    map[string][]string{},
+		terms:   map[string]map[string]bool{},
+	}
+	if ci.maxSize <= 0 {
+		ci.maxSize = 10 << 20
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ci, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &ci.docs)
+	if err != nil {
+		return nil, err
+	}
+	for key, words := range ci.docs {
+		ci.addTerms(key, words)
+	}
+	return ci, nil
+}
+
+// isTextMimeType 判断 MIME 类型是否为可以索引的文本
+func isTextMimeType(mimeType string) bool {
+	mimeType = strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	switch mimeType {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-yaml", "application/yaml", "application/toml", "application/x-sh":
+		return true
+	}
+	return false
+}
+
+// tokenize 将文本切分为小写的词，中日韩文字按单字和相邻两字切分
+func tokenize(text string) []string {
+	seen := map[string]bool{}
+	var words []string
+	add := func(word string) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+
+	var word []rune
+	var han []rune
+	flush := func() {
+		if len(word) > 0 {
+			add(strings.ToLower(string(word)))
+			word = word[:0]
+		}
+		for i := range han {
+			add(string(han[i]))
+			if i+1 < len(han) {
+				add(string(han[i : i+2]))
+			}
+		}
+		han = han[:0]
+	}
+
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+			if len(word) > 0 {
+				flush()
+			}
+			han = append(han, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			if len(han) > 0 {
+				flush()
+			}
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+// queryTerms 将查询切分为需要全部命中的词，连续的中文使用相邻两字匹配
+func queryTerms(query string) []string {
+	var terms []string
+	for _, field := range strings.FieldsFunc(query, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+	}) {
+		runes := []rune(field)
+		if len(runes) > 1 && unicode.Is(unicode.Han, runes[0]) {
+			for i := 0; i+1 < len(runes); i++ {
+				terms = append(terms, string(runes[i:i+2]))
+			}
+			continue
+		}
+		terms = append(terms, tokenize(field)...)
+	}
+	return terms
+}
+
+// IndexFile 读取文件内容并更新索引，非文本文件或超过大小上限的文件会从索引中移除
+func (ci *ContentIndex) IndexFile(key string, fullPath string) error {
+	if ci == nil {
+		return nil
+	}
+	ci.Remove(key)
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Size() > ci.maxSize {
+		return nil
+	}
+	file, err := openDataFile(fullPath)
+	if err != nil {
+		return err
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(file)
+	mimeType, err := detectMimeType(fullPath, file)
+	if err != nil {
+		return err
+	}
+	if !isTextMimeType(mimeType) {
+		return nil
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	words := tokenize(string(content))
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.docs[key] = words
+	ci.addTerms(key, words)
+	ci.dirty = true
+	return nil
+}
+
+// addTerms 将文件的词加入倒排表，调用方需持有写锁
+func (ci *ContentIndex) addTerms(key string, words []string) {
+	for _, word := range words {
+		keys, ok := ci.terms[word]
+		if !ok {
+			keys = map[string]bool{}
+			ci.terms[word] = keys
+		}
+		keys[key] = true
+	}
+}
+
+// Remove 从索引中移除指定路径及其子路径
+func (ci *ContentIndex) Remove(key string) {
+	if ci == nil {
+		return
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	for k, words := range ci.docs {
+		if key != "" && k != key && !strings.HasPrefix(k, key+"/") {
+			continue
+		}
+		for _, word := range words {
+			delete(ci.terms[word], k)
+			if len(ci.terms[word]) == 0 {
+				delete(ci.terms, word)
+			}
+		}
+		delete(ci.docs, k)
+		ci.dirty = true
+	}
+}
+
+// Search 返回包含查询中所有词的文件路径
+func (ci *ContentIndex) Search(query string, root string, limit int) []string {
+	terms := queryTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	var keys []string
+	for key := range ci.terms[terms[0]] {
+		if root != "" && !strings.HasPrefix(key, root+"/") {
+			continue
+		}
+		matched := true
+		for _, term := range terms[1:] {
+			if !ci.terms[term][key] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// Rebuild 清空索引并重新索引 data 目录下的所有文件
+func (ci *ContentIndex) Rebuild() error {
+	ci.mu.Lock()
+	ci.docs = map[string][]string{}
+	ci.terms = map[string]map[string]bool{}
+	ci.dirty = true
+	ci.mu.Unlock()
+
+	return filepath.WalkDir("data", func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel("data", fullPath)
+		if err != nil {
+			return err
+		}
+		key := indexKey(rel)
+		if isReservedPath(key) {
+			return filepath.SkipDir
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		err = ci.IndexFile(key, fullPath)
+		if err != nil {
+			slog.Error("索引文件内容失败", "err", err)
+		}
+		return nil
+	})
+}
+
+// Save 将有修改的索引写回磁盘
+func (ci *ContentIndex) Save() error {
+	if ci == nil {
+		return nil
+	}
+	ci.mu.Lock()
+	if !ci.dirty {
+		ci.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(ci.docs)
+	ci.dirty = false
+	ci.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(ci.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := ci.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, ci.file)
+}
+
+// Run 按固定间隔将索引的修改保存到磁盘
+func (ci *ContentIndex) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := ci.Save()
+		if err != nil {
+			slog.Error("保存全文索引失败", "err", err)
+		}
+	}
+}
+
+// 按文件内容搜索
+func contentSearchHandler(w http.ResponseWriter, r *http.Request, searchConfig SearchConfig) {
+	if contentIndex == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用全文搜索", nil, r.URL.Path)
+		return
+	}
+
+	var searchRequest SearchRequest
+	err := json.NewDecoder(r.Body).Decode(&searchRequest)
+	if err != nil || strings.TrimSpace(searchRequest.Query) == "" {
+		sendListResponse(w, http.StatusBadRequest, "缺少必要参数", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, err, r.URL.Path)
+		return
+	}
+
+	limit := searchConfig.MaxResults
+	if limit <= 0 {
+		limit = 1000
+	}
+	if searchRequest.Limit > 0 && searchRequest.Limit < limit {
+		limit = searchRequest.Limit
+	}
+
+	entries := []ListEntry{}
+	for _, key := range contentIndex.Search(searchRequest.Query, indexKey(searchRequest.Path), limit) {
+		info, err := os.Stat(filepath.Join("data", key))
+		if err != nil {
+			// 索引中的文件已被删除
+			continue
+		}
+		entries = append(entries, ListEntry{
+			Name:  info.Name(),
+			Path:  key,
+			IsDir: false,
+			Size:  info.Size(),
+			Date:  info.ModTime(),
+		})
+	}
+
+	sendListResponse(w, http.StatusOK, "success", ListResponse{
+		Status:  1,
+		Content: entries,
+		Total:   len(entries),
+	}, nil, r.URL.Path)
+}
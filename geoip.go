@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GeoIPConfig 结构用于配置客户端 IP 的地理位置标记
+type GeoIPConfig struct {
+	// CountryDB 是 MaxMind 格式的国家数据库（如 GeoLite2-Country.mmdb 或 GeoLite2-City.mmdb）
+	CountryDB string `json:"country_db"`
+	// ASNDB 是 MaxMind 格式的 ASN 数据库（如 GeoLite2-ASN.mmdb）
+	ASNDB string `json:"asn_db"`
+	// TrustedProxies 是可信的反向代理地址段，来自这些地址的请求使用 X-Forwarded-For 中的客户端 IP
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// GeoInfo 结构表示客户端 IP 的地理位置
+type GeoInfo struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint64 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// GeoLocator 结构用于查询客户端 IP 的国家和 ASN
+type GeoLocator struct {
+	country *mmdbReader
+	asn     *mmdbReader
+	proxies []*net.IPNet
+}
+
+// geoLocator 未配置时不标记地理位置
+var geoLocator *GeoLocator
+
+// NewGeoLocator 加载 GeoIP 数据库
+func NewGeoLocator(config GeoIPConfig) (*GeoLocator, error) {
+	g := &GeoLocator{}
+	var err error
+	if config.CountryDB != "" {
+		g.country, err = openMMDB(config.CountryDB)
+		if err != nil {
+			return nil, fmt.Errorf("加载 %s 失败: %w", config.CountryDB, err)
+		}
+	}
+	if config.ASNDB != "" {
+		g.asn, err = openMMDB(config.ASNDB)
+		if err != nil {
+			return nil, fmt.Errorf("加载 %s 失败: %w", config.ASNDB, err)
+		}
+	}
+	for _, cidr := range config.TrustedProxies {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		g.proxies = append(g.proxies, network)
+	}
+	return g, nil
+}
+
+// ClientIP 返回请求的客户端 IP，请求来自可信代理时取 X-Forwarded-For 中最后一个不可信的地址
+func (g *GeoLocator) ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if g == nil || ip == nil || !g.trusted(ip) {
+		return ip
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		candidate := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if candidate == nil {
+			break
+		}
+		ip = candidate
+		if !g.trusted(candidate) {
+			break
+		}
+	}
+	return ip
+}
+
+func (g *GeoLocator) trusted(ip net.IP) bool {
+	for _, network := range g.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup 查询请求的客户端 IP 的地理位置，未配置或查询不到时返回零值
+func (g *GeoLocator) Lookup(r *http.Request) GeoInfo {
+	var info GeoInfo
+	if g == nil {
+		return info
+	}
+	ip := g.ClientIP(r)
+	if ip == nil {
+		return info
+	}
+	if record, ok := g.country.lookup(ip); ok {
+		info.Country, _ = mmdbPath(record, "country", "iso_code").(string)
+		if info.Country == "" {
+			info.Country, _ = mmdbPath(record, "registered_country", "iso_code").(string)
+		}
+	}
+	if record, ok := g.asn.lookup(ip); ok {
+		info.ASN, _ = mmdbPath(record, "autonomous_system_number").(uint64)
+		info.ASOrg, _ = mmdbPath(record, "autonomous_system_organization").(string)
+	}
+	return info
+}
+
+// DownloadStats 结构按国家统计下载次数和字节数
+type DownloadStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	bytes  map[string]int64
+}
+
+// downloadStats 在配置了 GeoIP 时统计下载
+var downloadStats *DownloadStats
+
+// NewDownloadStats 创建下载统计
+func NewDownloadStats() *DownloadStats {
+	return &DownloadStats{counts: map[string]int64{}, bytes: map[string]int64{}}
+}
+
+// Record 记录一次下载，无法判断国家时记为 unknown
+func (s *DownloadStats) Record(r *http.Request, size int64) {
+	if s == nil {
+		return
+	}
+	country := geoLocator.Lookup(r).Country
+	if country == "" {
+		country = "unknown"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[country]++
+	s.bytes[country] += size
+}
+
+// writeMetrics 以 Prometheus 文本格式输出下载统计
+func (s *DownloadStats) writeMetrics(w io.Writer) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	countries := make([]string, 0, len(s.counts))
+	for country := range s.counts {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+
+	fmt.Fprintf(w, "# HELP store_downloads_total File downloads by client country.\n")
+	fmt.Fprintf(w, "# TYPE store_downloads_total counter\n")
+	for _, country := range countries {
+		fmt.Fprintf(w, "store_downloads_total{country=%q} %d\n", country, s.counts[country])
+	}
+	fmt.Fprintf(w, "# HELP store_download_bytes_total Bytes of file downloads by client country.\n")
+	fmt.Fprintf(w, "# TYPE store_download_bytes_total counter\n")
+	for _, country := range countries {
+		fmt.Fprintf(w, "store_download_bytes_total{country=%q} %d\n", country, s.bytes[country])
+	}
+}
+
+// mmdbReader 结构用于读取 MaxMind DB 格式的数据库，整个文件读入内存
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	// data 是数据区，位于搜索树和 16 字节分隔符之后
+	data []byte
+	// ipv4Start 是 IPv6 数据库中 IPv4 地址（::/96）对应的节点
+	ipv4Start uint64
+}
+
+// mmdbMetadataMarker 标记元数据的开始位置
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// openMMDB 加载 MaxMind DB 文件
+func openMMDB(file string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	index := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if index < 0 {
+		return nil, fmt.Errorf("不是有效的 MaxMind DB 文件")
+	}
+	decoder := mmdbDecoder{data: buf[index+len(mmdbMetadataMarker):]}
+	value, _, err := decoder.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("无效的元数据")
+	}
+
+	m := &mmdbReader{buf: buf}
+	m.nodeCount, _ = metadata["node_count"].(uint64)
+	m.recordSize, _ = metadata["record_size"].(uint64)
+	m.ipVersion, _ = metadata["ip_version"].(uint64)
+	if m.recordSize != 24 && m.recordSize != 28 && m.recordSize != 32 {
+		return nil, fmt.Errorf("不支持的 record_size %d", m.recordSize)
+	}
+	treeSize := m.nodeCount * m.recordSize / 4
+	if treeSize+16 > uint64(index) {
+		return nil, fmt.Errorf("无效的搜索树大小")
+	}
+	m.data = buf[treeSize+16 : index]
+
+	if m.ipVersion == 6 {
+		node := uint64(0)
+		for i := 0; i < 96 && node < m.nodeCount; i++ {
+			node = m.record(node, 0)
+		}
+		m.ipv4Start = node
+	}
+	return m, nil
+}
+
+// record 读取节点的左（bit 为 0）或右记录
+func (m *mmdbReader) record(node uint64, bit uint) uint64 {
+	switch m.recordSize {
+	case 24:
+		offset := node*6 + uint64(bit)*3
+		b := m.buf[offset : offset+3]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		b := m.buf[node*7 : node*7+7]
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		offset := node*8 + uint64(bit)*4
+		return uint64(binary.BigEndian.Uint32(m.buf[offset : offset+4]))
+	}
+}
+
+// lookup 在搜索树中查找 IP 对应的记录
+func (m *mmdbReader) lookup(ip net.IP) (interface{}, bool) {
+	if m == nil {
+		return nil, false
+	}
+	node := uint64(0)
+	address := ip.To16()
+	bits := 128
+	if ipv4 := ip.To4(); ipv4 != nil {
+		address = ipv4
+		bits = 32
+		node = m.ipv4Start
+	} else if m.ipVersion == 4 {
+		return nil, false
+	}
+
+	for i := 0; i < bits && node < m.nodeCount; i++ {
+		bit := uint(address[i/8]>>(7-uint(i%8))) & 1
+		node = m.record(node, bit)
+	}
+	if node <= m.nodeCount {
+		return nil, false
+	}
+	offset := node - m.nodeCount - 16
+	decoder := mmdbDecoder{data: m.data}
+	value, _, err := decoder.decode(offset)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// mmdbPath 按键名逐层取出 map 中的值
+func mmdbPath(value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// mmdbDecoder 结构用于解码 MaxMind DB 数据区中的值
+type mmdbDecoder struct {
+	data []byte
+}
+
+// decode 解码 offset 处的值，返回值和下一个值的位置
+func (d *mmdbDecoder) decode(offset uint64) (interface{}, uint64, error) {
+	if offset >= uint64(len(d.data)) {
+		return nil, 0, fmt.Errorf("mmdb: offset %d out of range", offset)
+	}
+	control := d.data[offset]
+	offset++
+	kind := uint64(control >> 5)
+	if kind == 1 {
+		// 指针，目标相对数据区起始位置
+		pointer, next, err := d.pointer(control, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer)
+		return value, next, err
+	}
+	if kind == 0 {
+		if offset >= uint64(len(d.data)) {
+			return nil, 0, fmt.Errorf("mmdb: truncated data")
+		}
+		kind = 7 + uint64(d.data[offset])
+		offset++
+	}
+
+	size := uint64(control & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint64(len(d.data)) {
+			return nil, 0, fmt.Errorf("mmdb: truncated data")
+		}
+		extra := uint64(0)
+		for _, b := range d.data[offset : offset+n] {
+			extra = extra<<8 | uint64(b)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch kind {
+	case 7:
+		result := make(map[string]interface{}, size)
+		for i := uint64(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, _ := key.(string)
+			result[name] = value
+			offset = next
+		}
+		return result, offset, nil
+	case 11:
+		result := make([]interface{}, 0, size)
+		for i := uint64(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			result = append(result, value)
+			offset = next
+		}
+		return result, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint64(len(d.data)) {
+		return nil, 0, fmt.Errorf("mmdb: truncated data")
+	}
+	payload := d.data[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2:
+		return string(payload), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("mmdb: invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), offset, nil
+	case 4:
+		return payload, offset, nil
+	case 5, 6, 9:
+		value := uint64(0)
+		for _, b := range payload {
+			value = value<<8 | uint64(b)
+		}
+		return value, offset, nil
+	case 8:
+		value := int32(0)
+		for _, b := range payload {
+			value = value<<8 | int32(b)
+		}
+		return value, offset, nil
+	case 10:
+		return payload, offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("mmdb: invalid float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(payload)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unknown type %d", kind)
+}
+
+// pointer 解析指针，返回指针的目标和指针之后的位置
+func (d *mmdbDecoder) pointer(control byte, offset uint64) (uint64, uint64, error) {
+	size := uint64(control>>3) & 0x3
+	n := size + 1
+	if offset+n > uint64(len(d.data)) {
+		return 0, 0, fmt.Errorf("mmdb: truncated pointer")
+	}
+	value := uint64(0)
+	if size != 3 {
+		value = uint64(control & 0x7)
+	}
+	for _, b := range d.data[offset : offset+n] {
+		value = value<<8 | uint64(b)
+	}
+	switch size {
+	case 1:
+		value += 2048
+	case 2:
+		value += 526336
+	}
+	return value, offset + n, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PreviewConfig 结构用于配置预览模式
+type PreviewConfig struct {
+	// MaxTextKB 预览文本文件时最多返回的大小，单位 KB，默认 256
+	MaxTextKB int64 `json:"max_text_kb"`
+}
+
+// 获取文件
+func getFileHandler(w http.ResponseWriter, r *http.Request, previewConfig PreviewConfig, imageConfig ImageConfig) {
+	filePath := r.URL.Path[len("/get/"):]
+	if isReservedPath(filePath) || isUnsafePath(filePath) {
+		sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", nil, r.URL.Path)
+		return
+	}
+	// 带有 version 参数时返回历史版本，文件已被删除时历史版本仍然可以下载
+	if version := r.URL.Query().Get("version"); version != "" {
+		serveFileVersion(w, r, indexKey(filePath), version)
+		return
+	}
+	// 检查路径是否是文件夹，双写迁移期间新后端不存在时从旧后端读取
+	fullPath, fileInfo, err := statReadPath(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// 文件不存在，记录日志并返回 JSON 提示未找到
+			sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", err, r.URL.Path)
+			return
+		}
+		// 其他错误，记录日志并返回 JSON 提示服务器错误
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+
+	debugPath(r, "", fullPath)
+	debugStage(r, "stat")
+
+	if fileInfo.IsDir() {
+		// 如果是文件夹，记录日志并返回 JSON 提示未找到
+		sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", err, r.URL.Path)
+		return
+	}
+
+	// 启用读取时校验时先确认文件内容与索引一致
+	key := indexKey(filePath)
+	if !verifyServedFile(w, r, key, fullPath, fileInfo) {
+		return
+	}
+	debugStage(r, "verify")
+
+	// 带有 w、h、fmt 等参数时返回处理后的图片
+	if isImageTransform(r) {
+		imageTransformHandler(w, r, key, fullPath, fileInfo, imageConfig)
+		return
+	}
+
+	// 如果是文件，将文件流式返回
+	file, err := openDataFile(fullPath)
+	if err != nil {
+		// 文件打开失败，记录日志并返回 JSON 提示服务器错误
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "closing file", "err", err)
+		}
+	}(file)
+
+	// 设置响应头，ServeContent 会根据 ETag 和修改时间处理 If-None-Match / If-Modified-Since
+	w.Header().Set("ETag", fileETag(key, fileInfo))
+
+	// 根据扩展名和文件内容判断类型，浏览器可以直接显示图片、PDF 等文件
+	contentType, err := detectMimeType(fileInfo.Name(), file)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	preview := r.URL.Query().Get("preview") == "1"
+	disposition := "inline"
+	if preview {
+		// 预览时可能执行脚本的文件按纯文本显示源码
+		if isActiveContent(contentType) {
+			contentType = "text/plain; charset=utf-8"
+		}
+	} else if r.URL.Query().Get("download") == "1" || isActiveContent(contentType) {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, fileInfo.Name()))
+
+	// 预览过大的文本文件时只返回开头部分
+	maxText := previewConfig.MaxTextKB << 10
+	if maxText <= 0 {
+		maxText = 256 << 10
+	}
+	if preview && isTextMimeType(contentType) && fileInfo.Size() > maxText {
+		w.Header().Del("ETag")
+		w.Header().Set("X-Preview-Truncated", "true")
+		w.Header().Set("Content-Length", strconv.FormatInt(maxText, 10))
+		w.WriteHeader(http.StatusOK)
+		n, err := io.CopyN(w, file, maxText)
+		if err != nil {
+			slog.WarnContext(r.Context(), "输出文本预览失败", "err", err)
+		}
+		egressAccounting.Record(r, n)
+		accessTracker.Touch(key, fileInfo.ModTime())
+		return
+	}
+
+	// 将文件内容写入响应
+	sw := newStatusWriter(w, 0)
+	http.ServeContent(sw, r, fileInfo.Name(), fileInfo.ModTime(), file)
+	downloadStats.Record(r, sw.bytes)
+	egressAccounting.Record(r, sw.bytes)
+	anomalyDetector.Download(r)
+	accessTracker.Touch(key, fileInfo.ModTime())
+}
+
+// fileETag 生成文件的 ETag，索引中有有效的内容哈希时使用强 ETag，否则使用由大小和修改时间生成的弱 ETag
+func fileETag(key string, fileInfo os.FileInfo) string {
+	meta, ok := metaIndex.Get(key)
+	if ok && meta.SHA256 != "" && meta.Size == fileInfo.Size() && meta.ModTime.Equal(fileInfo.ModTime()) {
+		return fmt.Sprintf(`"%s"`, meta.SHA256)
+	}
+	return fmt.Sprintf(`W/"%x-%x"`, fileInfo.Size(), fileInfo.ModTime().UnixNano())
+}
+
+// isActiveContent 判断内容是否可能在浏览器中执行脚本，这类文件总是作为附件下载，避免在存储的域名下执行
+func isActiveContent(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml",
+		"text/javascript", "application/javascript":
+		return true
+	}
+	return false
+}
+
+// contentDisposition 生成 Content-Disposition 响应头，非 ASCII 文件名按 RFC 5987 编码，
+// 同时提供 ASCII 文件名供不支持 filename* 的客户端使用
+func contentDisposition(disposition string, name string) string {
+	var fallback strings.Builder
+	for _, r := range name {
+		if r > 0x7e || r < 0x20 || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	if fallback.String() == name {
+		return fmt.Sprintf(`%s; filename="%s"`, disposition, name)
+	}
+
+	var encoded strings.Builder
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback.String(), encoded.String())
+}
+
+// isAttrChar 判断字节是否为 RFC 5987 中无需编码的 attr-char
+func isAttrChar(b byte) bool {
+	if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
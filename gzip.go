@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ResponseCompressionConfig 结构用于配置响应压缩，客户端通过 Accept-Encoding 声明支持的算法时压缩响应
+type ResponseCompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	// MinSize 小于该大小的响应不压缩，单位字节，默认 1024
+	MinSize int `json:"min_size"`
+	// Level 压缩级别，0 或超出算法的范围时使用算法的默认级别，gzip 和 deflate 为 1 到 9，默认 6
+	Level int `json:"level"`
+	// Algorithms 按优先顺序排列的压缩算法，默认 gzip、deflate，使用客户端支持的第一个
+	Algorithms []string `json:"algorithms"`
+	// ExcludeTypes 不压缩的内容类型，以 / 结尾时按前缀匹配，为空时使用内置的已压缩类型列表
+	ExcludeTypes []string `json:"exclude_types"`
+	// Types 按内容类型优先使用的算法和级别，或者不压缩
+	Types []CompressionTypePolicy `json:"types"`
+}
+
+// compressiblePaths 是压缩响应的接口，/get/ 只压缩内容类型不在排除列表中的文件
+var compressiblePaths = []string{"/list", "/search", "/get/"}
+
+// defaultExcludeTypes 是默认不压缩的内容类型，这些格式已经压缩过
+var defaultExcludeTypes = []string{
+	"image/", "video/", "audio/", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2", "application/x-xz",
+	"application/pdf", "application/octet-stream",
+}
+
+// responseCompression 是解析后的响应压缩配置
+type responseCompression struct {
+	config ResponseCompressionConfig
+	codecs []*CompressionCodec
+	types  []compressionTypeRule
+}
+
+// usableForResponse 检查算法能否用于响应压缩
+func usableForResponse(codec *CompressionCodec) error {
+	if codec.Encoding == "" || codec.NewWriter == nil {
+		return fmt.Errorf("压缩算法 %s 不能用于响应压缩", codec.Name)
+	}
+	return nil
+}
+
+// ResponseCompressionMiddleware 为 compressiblePaths 中的接口压缩响应，Range 请求和 HEAD 请求不压缩；不支持的算法返回错误
+func ResponseCompressionMiddleware(next http.Handler, config ResponseCompressionConfig) (http.Handler, error) {
+	if config.MinSize <= 0 {
+		config.MinSize = 1024
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = []string{"gzip", "deflate"}
+	}
+	if len(config.ExcludeTypes) == 0 {
+		config.ExcludeTypes = defaultExcludeTypes
+	}
+	rc := &responseCompression{config: config}
+	for _, name := range config.Algorithms {
+		codec, err := lookupCompressionCodec(name)
+		if err == nil {
+			err = usableForResponse(codec)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rc.codecs = append(rc.codecs, codec)
+	}
+	var err error
+	rc.types, err = parseCompressionTypes(config.Types, usableForResponse, rc.codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasCompressiblePath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// 压缩与否取决于 Accept-Encoding，缓存需要区分
+		w.Header().Add("Vary", "Accept-Encoding")
+		accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+		if !rc.acceptsAny(accepted) || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, rc: rc, accepted: accepted}
+		next.ServeHTTP(cw, r)
+		cw.finish()
+	}), nil
+}
+
+// acceptsAny 判断客户端是否支持任意一个可能使用的算法
+func (rc *responseCompression) acceptsAny(accepted map[string]bool) bool {
+	for _, codec := range rc.codecs {
+		if accepted[codec.Encoding] {
+			return true
+		}
+	}
+	for _, rule := range rc.types {
+		if rule.codec != nil && accepted[rule.codec.Encoding] {
+			return true
+		}
+	}
+	return false
+}
+
+// choose 按内容类型和客户端支持的算法选择压缩算法和级别，不压缩时返回 nil
+func (rc *responseCompression) choose(mediaType string, accepted map[string]bool) (*CompressionCodec, int) {
+	rule, matched := matchCompressionType(rc.types, mediaType)
+	if matched && rule.disabled {
+		return nil, 0
+	}
+	candidates := rc.codecs
+	if matched && rule.codec != nil {
+		candidates = append([]*CompressionCodec{rule.codec}, candidates...)
+	}
+	for _, codec := range candidates {
+		if !accepted[codec.Encoding] {
+			continue
+		}
+		level, err := codec.resolveLevel(rc.config.Level)
+		if err != nil {
+			level = codec.DefaultLevel
+		}
+		if matched && rule.level != 0 && (rule.codec == nil || rule.codec == codec) {
+			level = rule.level
+		}
+		return codec, level
+	}
+	return nil, 0
+}
+
+// hasCompressiblePath 判断请求的接口是否需要压缩响应
+func hasCompressiblePath(path string) bool {
+	for _, prefix := range compressiblePaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedEncodings 解析 Accept-Encoding，返回客户端支持的压缩方式
+func acceptedEncodings(header string) map[string]bool {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(name)] = q > 0
+	}
+	return accepted
+}
+
+// compressResponseWriter 先缓冲响应的开头部分，达到大小下限后再决定是否压缩
+type compressResponseWriter struct {
+	http.ResponseWriter
+	rc       *responseCompression
+	accepted map[string]bool
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	// writer 为压缩时的压缩器，不压缩时为 nil
+	writer io.WriteCloser
+}
+
+func (w *compressResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	// 1xx 响应直接写出，最终的状态码等决定是否压缩后再写出
+	if statusCode < 200 {
+		w.ResponseWriter.WriteHeader(statusCode)
+		w.status = 0
+	}
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf.Write(p)
+		// 响应头中声明的长度已经小于下限时不再等待
+		length, err := strconv.Atoi(w.Header().Get("Content-Length"))
+		if w.buf.Len() >= w.rc.config.MinSize || (err == nil && length < w.rc.config.MinSize) {
+			err := w.decide(w.buf.Len() >= w.rc.config.MinSize)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	if w.writer != nil {
+		return w.writer.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// compressionCodec 按响应的状态码和内容类型选择压缩算法和级别，不压缩时返回 nil
+func (w *compressResponseWriter) compressionCodec() (*CompressionCodec, int) {
+	header := w.Header()
+	if w.status != http.StatusOK || header.Get("Content-Encoding") != "" {
+		return nil, 0
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(w.buf.Bytes())
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, 0
+	}
+	for _, excluded := range w.rc.config.ExcludeTypes {
+		if mediaType == excluded || (strings.HasSuffix(excluded, "/") && strings.HasPrefix(mediaType, excluded)) {
+			return nil, 0
+		}
+	}
+	return w.rc.choose(mediaType, w.accepted)
+}
+
+// decide 决定是否压缩，写出响应头和已缓冲的内容
+func (w *compressResponseWriter) decide(large bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var codec *CompressionCodec
+	var level int
+	if large {
+		codec, level = w.compressionCodec()
+	}
+	if codec != nil {
+		header := w.Header()
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", codec.Encoding)
+		// 压缩后的内容与原内容不是逐字节相同，强 ETag 改为弱 ETag
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		w.writer, _ = codec.NewWriter(w.ResponseWriter, level)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.writer != nil {
+		_, err = w.writer.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf = bytes.Buffer{}
+	return err
+}
+
+// finish 在处理程序返回后写出剩余的内容并结束压缩流
+func (w *compressResponseWriter) finish() {
+	if !w.decided {
+		if w.status == 0 && w.buf.Len() == 0 {
+			return
+		}
+		_ = w.decide(w.buf.Len() >= w.rc.config.MinSize)
+	}
+	if w.writer != nil {
+		_ = w.writer.Close()
+	}
+}
+
+// Flush 支持流式响应，立即决定是否压缩并写出已压缩的内容
+func (w *compressResponseWriter) Flush() {
+	if !w.decided {
+		_ = w.decide(true)
+	}
+	if flusher, ok := w.writer.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap 供 http.ResponseController 获取底层的 ResponseWriter
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthConfig 结构用于配置存储后端的健康检查
+type HealthConfig struct {
+	Enabled bool `json:"enabled"`
+	// Interval 检查间隔，单位秒，默认 30
+	Interval int `json:"interval"`
+	// FailureThreshold 连续失败多少次后判定为不健康，默认 3
+	FailureThreshold int `json:"failure_threshold"`
+	// Degrade 不健康时的处理方式：read_only 拒绝写操作（默认），redirect 将请求重定向到 replica_url
+	Degrade string `json:"degrade"`
+	// ReplicaURL 副本的地址，如 http://replica:8082
+	ReplicaURL string `json:"replica_url"`
+}
+
+// HealthStatus 结构表示存储后端最近的检查结果
+type HealthStatus struct {
+	Healthy   bool      `json:"healthy"`
+	Mode      string    `json:"mode"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+	// Failures 是连续失败的次数
+	Failures int `json:"failures"`
+	// LatencyMs 是最近一次检查的耗时
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// BackendHealth 结构用于定期写入、读取并删除探测文件，检查存储后端是否可用
+type BackendHealth struct {
+	config HealthConfig
+
+	mu     sync.Mutex
+	status HealthStatus
+	// probes 和 probeFailures 是累计的检查次数，用于监控指标
+	probes        int64
+	probeFailures int64
+}
+
+// backendHealth 是存储后端的健康状态，未启用检查时总是健康
+var backendHealth *BackendHealth
+
+// NewBackendHealth 创建存储后端健康检查
+func NewBackendHealth(config HealthConfig) (*BackendHealth, error) {
+	if config.Interval <= 0 {
+		config.Interval = 30
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 3
+	}
+	switch config.Degrade {
+	case "":
+		config.Degrade = "read_only"
+	case "read_only":
+	case "redirect":
+		if config.ReplicaURL == "" {
+			return nil, fmt.Errorf("degrade 为 redirect 时需要配置 replica_url")
+		}
+		config.ReplicaURL = strings.TrimSuffix(config.ReplicaURL, "/")
+	default:
+		return nil, fmt.Errorf("无效的 degrade %q", config.Degrade)
+	}
+	return &BackendHealth{
+		config: config,
+		status: HealthStatus{Healthy: true, Mode: "normal"},
+	}, nil
+}
+
+// Run 定期检查存储后端
+func (h *BackendHealth) Run() {
+	for {
+		h.Check()
+		time.Sleep(time.Duration(h.config.Interval) * time.Second)
+	}
+}
+
+// Check 执行一次检查，连续失败达到阈值时进入降级模式，成功一次即恢复
+func (h *BackendHealth) Check() {
+	start := time.Now()
+	err := probeBackend()
+	latency := time.Since(start)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probes++
+	h.status.LastCheck = start
+	h.status.LatencyMs = latency.Milliseconds()
+	if err != nil {
+		h.probeFailures++
+		h.status.Failures++
+		h.status.LastError = err.Error()
+		if h.status.Healthy && h.status.Failures >= h.config.FailureThreshold {
+			h.status.Healthy = false
+			h.status.Mode = h.config.Degrade
+			slog.Error("存储后端不可用，进入降级模式", "mode", h.config.Degrade, "err", err)
+		}
+		return
+	}
+	if !h.status.Healthy {
+		slog.Info("存储后端已恢复")
+	}
+	h.status = HealthStatus{Healthy: true, Mode: "normal", LastCheck: start, LatencyMs: latency.Milliseconds()}
+}
+
+// Status 返回最近的检查结果
+func (h *BackendHealth) Status() HealthStatus {
+	if h == nil {
+		return HealthStatus{Healthy: true, Mode: "normal"}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// ReadOnly 判断是否因存储后端不健康而拒绝写操作
+func (h *BackendHealth) ReadOnly() bool {
+	status := h.Status()
+	return !status.Healthy && status.Mode == "read_only"
+}
+
+// Middleware 在 redirect 模式下将请求以 307 重定向到副本，/healthz、/readyz、/metrics 和管理接口仍由本实例响应
+func (h *BackendHealth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := h.Status()
+		local := r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/metrics" || strings.HasPrefix(r.URL.Path, "/admin/")
+		if status.Healthy || status.Mode != "redirect" || local {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, h.config.ReplicaURL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+// writeMetrics 以 Prometheus 文本格式输出健康检查指标
+func (h *BackendHealth) writeMetrics(w io.Writer) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	status := h.status
+	probes, failures := h.probes, h.probeFailures
+	h.mu.Unlock()
+
+	healthy := 0
+	if status.Healthy {
+		healthy = 1
+	}
+	fmt.Fprintf(w, "# HELP store_backend_healthy Whether the storage backend passed its health probe.\n")
+	fmt.Fprintf(w, "# TYPE store_backend_healthy gauge\n")
+	fmt.Fprintf(w, "store_backend_healthy %d\n", healthy)
+	fmt.Fprintf(w, "# HELP store_backend_probes_total Storage backend health probes.\n")
+	fmt.Fprintf(w, "# TYPE store_backend_probes_total counter\n")
+	fmt.Fprintf(w, "store_backend_probes_total %d\n", probes)
+	fmt.Fprintf(w, "# HELP store_backend_probe_failures_total Failed storage backend health probes.\n")
+	fmt.Fprintf(w, "# TYPE store_backend_probe_failures_total counter\n")
+	fmt.Fprintf(w, "store_backend_probe_failures_total %d\n", failures)
+	fmt.Fprintf(w, "# HELP store_backend_probe_latency_seconds Duration of the last storage backend health probe.\n")
+	fmt.Fprintf(w, "# TYPE store_backend_probe_latency_seconds gauge\n")
+	fmt.Fprintf(w, "store_backend_probe_latency_seconds %g\n", float64(status.LatencyMs)/1000)
+}
+
+// probeBackend 写入、读取并删除一个探测文件
+func probeBackend() error {
+	canary := []byte(fmt.Sprintf("store health probe %d", time.Now().UnixNano()))
+
+	file, path, err := createTempDataFile("", "")
+	if err != nil {
+		return fmt.Errorf("写入探测文件失败: %w", err)
+	}
+	_, err = file.Write(canary)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = removeDataPath(path)
+		return fmt.Errorf("写入探测文件失败: %w", err)
+	}
+
+	reader, err := openDataFile(path)
+	if err != nil {
+		_ = removeDataPath(path)
+		return fmt.Errorf("读取探测文件失败: %w", err)
+	}
+	content, err := io.ReadAll(reader)
+	_ = reader.Close()
+	if err == nil && !bytes.Equal(content, canary) {
+		err = fmt.Errorf("内容不一致")
+	}
+	if err != nil {
+		_ = removeDataPath(path)
+		return fmt.Errorf("读取探测文件失败: %w", err)
+	}
+
+	err = removeDataPath(path)
+	if err != nil {
+		return fmt.Errorf("删除探测文件失败: %w", err)
+	}
+	return nil
+}
+
+// processStartedAt 为进程启动的时间，用于 /healthz 返回运行时长
+var processStartedAt = time.Now()
+
+// LivenessStatus 结构是 /healthz 的响应内容
+type LivenessStatus struct {
+	Status        string `json:"status"`
+	Version       string `json:"version"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+// ReadinessCheck 结构是一项就绪检查的结果
+type ReadinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ReadinessStatus 结构是 /readyz 的响应内容，存储后端的检查结果位于顶层，与之前的响应兼容
+type ReadinessStatus struct {
+	HealthStatus
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// checkDataWritable 在 data 目录的临时目录中创建并删除一个文件，判断 data 目录是否可写
+func checkDataWritable() error {
+	err := os.MkdirAll(tmpDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(tmpDir, "readyz-*")
+	if err != nil {
+		return err
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
+
+// 存活检查，进程能够处理请求时总是返回 200，供 Kubernetes 的 livenessProbe 使用
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	sendContentResponse(w, http.StatusOK, "ok", LivenessStatus{
+		Status:        "ok",
+		Version:       buildVersion,
+		UptimeSeconds: int64(time.Since(processStartedAt).Seconds()),
+	}, nil, r.URL.Path)
+}
+
+// 就绪检查，data 目录不可写、磁盘剩余空间低于 disk_guard 的下限或存储后端不健康时返回 503，供负载均衡摘除实例
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := ReadinessStatus{HealthStatus: backendHealth.Status(), Ready: true}
+	message := "ready"
+	check := func(name string, err error, failure string) {
+		result := ReadinessCheck{Name: name, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			if status.Ready {
+				message = failure
+			}
+			status.Ready = false
+		}
+		status.Checks = append(status.Checks, result)
+	}
+	check("data_writable", checkDataWritable(), "data 目录不可写")
+	check("disk_space", diskGuard.Check(0), "磁盘剩余空间不足")
+	var backendErr error
+	if !status.Healthy {
+		backendErr = errors.New(status.LastError)
+	}
+	check("backend", backendErr, "存储后端不可用")
+	if !status.Ready {
+		sendContentResponse(w, http.StatusServiceUnavailable, message, status, nil, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, message, status, nil, r.URL.Path)
+}
+
+// 以 Prometheus 文本格式输出监控指标
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	backendHealth.writeMetrics(w)
+	tusUploads.writeMetrics(w)
+	downloadStats.writeMetrics(w)
+	metaIndex.writeMetrics(w)
+	requestShadow.writeMetrics(w)
+	existenceFilter.writeMetrics(w)
+	cluster.writeMetrics(w)
+	featureFlags.writeMetrics(w)
+	transferScheduler.writeMetrics(w)
+	webhooks.writeMetrics(w)
+	changeFeed.writeMetrics(w)
+	eventBus.writeMetrics(w)
+	s3Mirror.writeMetrics(w)
+	pathLocks.writeMetrics(w)
+	runtimeSettings.writeMetrics(w)
+	rateLimiter.writeMetrics(w)
+	auditLog.writeMetrics(w)
+	requestMetrics.writeMetrics(w)
+	dataUsage.writeMetrics(w)
+	deferredDeletes.writeMetrics(w)
+	partialUploads.writeMetrics(w)
+	tracer.writeMetrics(w)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ImageConfig 结构用于配置 /get/ 的图片处理参数
+type ImageConfig struct {
+	// MaxSize 输出图片宽高的上限，默认 4096
+	MaxSize int `json:"max_size"`
+	// MaxSourcePixels 允许处理的原图像素上限，默认 5000 万
+	MaxSourcePixels int `json:"max_source_pixels"`
+	// CacheMB 缓存处理结果的内存上限，单位 MB，默认 64
+	CacheMB int `json:"cache_mb"`
+}
+
+var errCropOutOfBounds = fmt.Errorf("crop out of bounds")
+
+// imageCache 缓存处理后的图片，未初始化时不缓存
+var imageCache *ImageCache
+
+// ImageTransform 结构表示一次图片处理的参数
+type ImageTransform struct {
+	Width   int
+	Height  int
+	Fit     string
+	Crop    image.Rectangle
+	Format  string
+	Quality int
+}
+
+// isImageTransform 判断请求是否带有图片处理参数
+func isImageTransform(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, name := range []string{"w", "h", "fit", "crop", "fmt", "q"} {
+		if query.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseImageTransform 解析图片处理参数
+func parseImageTransform(r *http.Request, maxSize int) (ImageTransform, error) {
+	query := r.URL.Query()
+	transform := ImageTransform{
+		Fit:     query.Get("fit"),
+		Format:  strings.ToLower(query.Get("fmt")),
+		Quality: 85,
+	}
+
+	var err error
+	if value := query.Get("w"); value != "" {
+		transform.Width, err = strconv.Atoi(value)
+		if err != nil || transform.Width <= 0 || transform.Width > maxSize {
+			return transform, fmt.Errorf("宽度必须在 1 到 %d 之间", maxSize)
+		}
+	}
+	if value := query.Get("h"); value != "" {
+		transform.Height, err = strconv.Atoi(value)
+		if err != nil || transform.Height <= 0 || transform.Height > maxSize {
+			return transform, fmt.Errorf("高度必须在 1 到 %d 之间", maxSize)
+		}
+	}
+	switch transform.Fit {
+	case "", "contain":
+		transform.Fit = "contain"
+	case "cover":
+		if transform.Width == 0 || transform.Height == 0 {
+			return transform, fmt.Errorf("fit=cover 需要同时指定 w 和 h")
+		}
+	default:
+		return transform, fmt.Errorf("不支持的缩放方式 %s", transform.Fit)
+	}
+	if value := query.Get("crop"); value != "" {
+		parts := strings.Split(value, ",")
+		if len(parts) != 4 {
+			return transform, fmt.Errorf("crop 格式为 x,y,宽,高")
+		}
+		var n [4]int
+		for i, part := range parts {
+			n[i], err = strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || n[i] < 0 {
+				return transform, fmt.Errorf("crop 格式为 x,y,宽,高")
+			}
+		}
+		if n[2] == 0 || n[3] == 0 {
+			return transform, fmt.Errorf("crop 区域不能为空")
+		}
+		transform.Crop = image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3])
+	}
+	switch transform.Format {
+	case "", "png", "gif":
+	case "jpg", "jpeg":
+		transform.Format = "jpeg"
+	default:
+		return transform, fmt.Errorf("不支持的输出格式 %s", transform.Format)
+	}
+	if value := query.Get("q"); value != "" {
+		transform.Quality, err = strconv.Atoi(value)
+		if err != nil || transform.Quality < 1 || transform.Quality > 100 {
+			return transform, fmt.Errorf("质量必须在 1 到 100 之间")
+		}
+	}
+	return transform, nil
+}
+
+// String 返回参数的规范形式，用作缓存键
+func (t ImageTransform) String() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&crop=%v&fmt=%s&q=%d", t.Width, t.Height, t.Fit, t.Crop, t.Format, t.Quality)
+}
+
+// 按请求参数处理图片并返回
+func imageTransformHandler(w http.ResponseWriter, r *http.Request, key string, fullPath string, fileInfo os.FileInfo, imageConfig ImageConfig) {
+	maxSize := imageConfig.MaxSize
+	if maxSize <= 0 {
+		maxSize = 4096
+	}
+	transform, err := parseImageTransform(r, maxSize)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, err.Error(), nil, r.URL.Path)
+		return
+	}
+
+	// 原文件修改后缓存键随之变化，旧的结果会被逐渐淘汰
+	etag := fileETag(key, fileInfo)
+	cacheKey := etag + " " + key + "?" + transform.String()
+	variant, ok := imageCache.Get(cacheKey)
+	debugCache(r, "image", ok)
+	if !ok {
+		variant, err = renderImage(fullPath, transform, imageConfig.MaxSourcePixels)
+		if err == errNotImage {
+			sendJSONResponse(w, http.StatusUnsupportedMediaType, "不支持的图片格式", err, r.URL.Path)
+			return
+		} else if err == errImageTooLarge {
+			sendJSONResponse(w, http.StatusRequestEntityTooLarge, "图片尺寸过大", err, r.URL.Path)
+			return
+		} else if err == errCropOutOfBounds {
+			sendJSONResponse(w, http.StatusBadRequest, "crop 区域超出图片范围", err, r.URL.Path)
+			return
+		} else if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "图片处理失败", err, r.URL.Path)
+			return
+		}
+		imageCache.Put(cacheKey, variant)
+		debugStage(r, "render")
+	}
+
+	name := strings.TrimSuffix(fileInfo.Name(), filepath.Ext(fileInfo.Name())) + "." + variant.Format
+	w.Header().Set("Content-Type", "image/"+variant.Format)
+	w.Header().Set("Content-Disposition", contentDisposition("inline", name))
+	w.Header().Set("ETag", fmt.Sprintf(`W/"%x"`, hashString(cacheKey)))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	sw := newStatusWriter(w, 0)
+	http.ServeContent(sw, r, name, fileInfo.ModTime(), bytes.NewReader(variant.Data))
+	egressAccounting.Record(r, sw.bytes)
+	accessTracker.Touch(key, fileInfo.ModTime())
+}
+
+// ImageVariant 结构表示处理后的图片
+type ImageVariant struct {
+	Format string
+	Data   []byte
+}
+
+// renderImage 解码原图，依次裁剪、缩放并编码为目标格式
+func renderImage(fullPath string, transform ImageTransform, maxPixels int) (*ImageVariant, error) {
+	img, format, err := decodeImageFile(fullPath, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+
+	if !transform.Crop.Empty() {
+		crop := transform.Crop.Add(img.Bounds().Min).Intersect(img.Bounds())
+		if crop.Empty() {
+			return nil, errCropOutOfBounds
+		}
+		img = subImage(img, crop)
+	}
+
+	if transform.Width > 0 || transform.Height > 0 {
+		if transform.Fit == "cover" {
+			img = subImage(img, coverRect(img.Bounds(), transform.Width, transform.Height))
+			img = resizeImage(img, image.Point{X: transform.Width, Y: transform.Height})
+		} else {
+			img = resizeImage(img, fitSize(img.Bounds(), transform.Width, transform.Height))
+		}
+	}
+
+	if transform.Format != "" {
+		format = transform.Format
+	}
+	var buf bytes.Buffer
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		format = "jpeg"
+		err = jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: transform.Quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ImageVariant{Format: format, Data: buf.Bytes()}, nil
+}
+
+// subImage 返回图片的一部分，不支持 SubImage 的图片类型先复制
+func subImage(img image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba.SubImage(rect)
+}
+
+// coverRect 计算与 width x height 宽高比相同的居中区域，缩放后铺满目标尺寸
+func coverRect(bounds image.Rectangle, width int, height int) image.Rectangle {
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	cropW, cropH := srcW, srcW*height/width
+	if cropH > srcH {
+		cropW, cropH = srcH*width/height, srcH
+	}
+	if cropW < 1 {
+		cropW = 1
+	}
+	if cropH < 1 {
+		cropH = 1
+	}
+	x := bounds.Min.X + (srcW-cropW)/2
+	y := bounds.Min.Y + (srcH-cropH)/2
+	return image.Rect(x, y, x+cropW, y+cropH)
+}
+
+// hashString 计算字符串的 FNV-1a 哈希
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// ImageCache 结构是按字节数限制的 LRU 缓存
+type ImageCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type imageCacheEntry struct {
+	key     string
+	variant *ImageVariant
+}
+
+// NewImageCache 创建图片缓存
+func NewImageCache(cacheMB int) *ImageCache {
+	if cacheMB <= 0 {
+		cacheMB = 64
+	}
+	return &ImageCache{
+		maxBytes: cacheMB << 20,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get 获取缓存的图片，并将其移到最近使用的位置
+func (c *ImageCache) Get(key string) (*ImageVariant, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*imageCacheEntry).variant, true
+}
+
+// Put 缓存图片，超过上限时淘汰最久未使用的图片
+func (c *ImageCache) Put(key string, variant *ImageVariant) {
+	if c == nil || len(variant.Data) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.bytes -= len(elem.Value.(*imageCacheEntry).variant.Data)
+		c.order.Remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&imageCacheEntry{key: key, variant: variant})
+	c.bytes += len(variant.Data)
+	for c.bytes > c.maxBytes {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*imageCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.bytes -= len(entry.variant.Data)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// ImageUploadRule 结构指定存放图片的目录，上传到这些目录的文件必须是可以解码的图片，并且尺寸不超过上限，
+// 避免解压炸弹等超大图片在生成缩略图时占满内存
+type ImageUploadRule struct {
+	// Prefix 路径前缀，按目录匹配，匹配最长的前缀
+	Prefix string `json:"prefix"`
+	// Formats 允许的图片格式，可选 jpeg、png、gif，为空时全部允许
+	Formats []string `json:"formats"`
+	// MaxWidth 和 MaxHeight 为宽高的上限，单位像素，0 表示不限制
+	MaxWidth  int `json:"max_width"`
+	MaxHeight int `json:"max_height"`
+	// MaxPixels 宽乘以高的上限，默认 5000 万
+	MaxPixels int `json:"max_pixels"`
+}
+
+// ImageRejection 结构是上传的文件不是允许的图片时返回的内容
+type ImageRejection struct {
+	// Reason 为 decode、format、dimensions 或 pixels，表示被拒绝的依据
+	Reason string `json:"reason"`
+	Format string `json:"format,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// Rule 为匹配的图片目录，其余字段为该目录的限制
+	Rule      string   `json:"rule"`
+	Formats   []string `json:"formats,omitempty"`
+	MaxWidth  int      `json:"max_width,omitempty"`
+	MaxHeight int      `json:"max_height,omitempty"`
+	MaxPixels int      `json:"max_pixels,omitempty"`
+}
+
+// ImageUploadValidator 结构用于检查上传到图片目录的文件
+type ImageUploadValidator struct {
+	// rules 已按前缀长度从长到短排列
+	rules []ImageUploadRule
+}
+
+// imageUploadValidator 未配置图片目录时为 nil
+var imageUploadValidator *ImageUploadValidator
+
+// NewImageUploadValidator 创建图片上传检查，未配置图片目录时返回 nil
+func NewImageUploadValidator(rules []ImageUploadRule) (*ImageUploadValidator, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	v := &ImageUploadValidator{}
+	for _, rule := range rules {
+		rule.Prefix = indexKey(rule.Prefix)
+		formats := make([]string, 0, len(rule.Formats))
+		for _, format := range rule.Formats {
+			format = strings.ToLower(strings.TrimSpace(format))
+			if format == "jpg" {
+				format = "jpeg"
+			}
+			if format != "jpeg" && format != "png" && format != "gif" {
+				return nil, fmt.Errorf("图片目录 %q 的格式 %q 不支持", rule.Prefix, format)
+			}
+			formats = append(formats, format)
+		}
+		rule.Formats = formats
+		if rule.MaxWidth < 0 || rule.MaxHeight < 0 || rule.MaxPixels < 0 {
+			return nil, fmt.Errorf("图片目录 %q 的尺寸上限不能为负数", rule.Prefix)
+		}
+		if rule.MaxPixels == 0 {
+			rule.MaxPixels = 50000000
+		}
+		v.rules = append(v.rules, rule)
+	}
+	sort.SliceStable(v.rules, func(i, j int) bool {
+		return len(v.rules[i].Prefix) > len(v.rules[j].Prefix)
+	})
+	return v, nil
+}
+
+// rule 返回路径匹配的图片目录，不在图片目录中时返回 nil
+func (v *ImageUploadValidator) rule(key string) *ImageUploadRule {
+	if v == nil {
+		return nil
+	}
+	for i, rule := range v.rules {
+		if rule.Prefix == "" || key == rule.Prefix || strings.HasPrefix(key, rule.Prefix+"/") {
+			return &v.rules[i]
+		}
+	}
+	return nil
+}
+
+// Check 检查上传到图片目录的临时文件，加密或压缩的内容先还原；先只读取图片头部检查尺寸，
+// 通过之后才完整解码，确认文件不是伪造或截断的图片
+func (v *ImageUploadValidator) Check(key string, tmpPath string) (*ImageRejection, error) {
+	rule := v.rule(key)
+	if rule == nil {
+		return nil, nil
+	}
+	file, err := openDataFile(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(file)
+
+	rejection := &ImageRejection{
+		Reason:    "decode",
+		Rule:      rule.Prefix,
+		Formats:   rule.Formats,
+		MaxWidth:  rule.MaxWidth,
+		MaxHeight: rule.MaxHeight,
+		MaxPixels: rule.MaxPixels,
+	}
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return rejection, nil
+	}
+	rejection.Format, rejection.Width, rejection.Height = format, config.Width, config.Height
+	if len(rule.Formats) > 0 {
+		allowed := false
+		for _, value := range rule.Formats {
+			allowed = allowed || value == format
+		}
+		if !allowed {
+			rejection.Reason = "format"
+			return rejection, nil
+		}
+	}
+	if (rule.MaxWidth > 0 && config.Width > rule.MaxWidth) || (rule.MaxHeight > 0 && config.Height > rule.MaxHeight) {
+		rejection.Reason = "dimensions"
+		return rejection, nil
+	}
+	if int64(config.Width)*int64(config.Height) > int64(rule.MaxPixels) {
+		rejection.Reason = "pixels"
+		return rejection, nil
+	}
+
+	// 尺寸在上限之内，完整解码一次，GIF 只解码第一帧
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = image.Decode(file)
+	if err != nil {
+		rejection.Reason = "decode"
+		return rejection, nil
+	}
+	return nil, nil
+}
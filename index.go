@@ -0,0 +1,854 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metaDirName 是 data 目录下用于保存索引等内部数据的目录名
+const metaDirName = ".meta"
+
+// FileMeta 结构用于表示索引中单个文件的元数据
+type FileMeta struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	IsDir   bool      `json:"is_dir"`
+	ATime   time.Time `json:"atime"`
+	// SHA256 为文件内容哈希，文件大小或修改时间变化后会被清空
+	SHA256 string `json:"sha256,omitempty"`
+	// Uploader 为上传者的身份名称，未命名的 token 使用其指纹，不保存 token 原文
+	Uploader string `json:"uploader,omitempty"`
+	// Metadata 为上传时通过 X-Meta-* 请求头设置的自定义元数据
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// StorageClass 为通过 X-Storage-Class 或 /storage-class 指定的存储类型，为空时使用默认类型
+	StorageClass string `json:"storage_class,omitempty"`
+}
+
+// MetaIndex 是持久化在 data/.meta 目录下的文件元数据索引，默认保存为 JSON 文件，backend 为 sqlite 时保存在 SQLite 数据库中，
+// 由预写日志（journal）保证崩溃后的一致性。
+// 配置了 shard_depth 时按路径的前几级目录分片保存，路径层级不超过 shard_depth 的条目在根分片（index.json）中，
+// 其余条目按前 shard_depth 级目录保存在 data/.meta/index/ 下的分片文件中；
+// 根分片常驻内存，其他分片按需加载，常驻的分片数超过 hot_shards 时释放最久未访问且已保存的分片
+type MetaIndex struct {
+	mu      sync.RWMutex
+	storage indexStorage
+	depth   int
+	hot     int
+	// shards 为已加载到内存中的分片，根分片的名称为空
+	shards map[string]*indexShard
+	// counts 记录每个分片的条目数，包括未加载的分片，没有条目的分片不在其中
+	counts map[string]int
+	// stale 为已经没有条目、等待删除的分片文件
+	stale []string
+	clock atomic.Int64
+	// dirty 标记分片清单是否有尚未保存的修改
+	dirty bool
+	// journal 为预写日志，未启用时为 nil
+	journal *indexJournal
+
+	// saving 保证同一时间只有一次保存
+	saving sync.Mutex
+}
+
+// indexShard 是索引的一个分片
+type indexShard struct {
+	entries map[string]*FileMeta
+	// version 在每次修改时递增，保存完成时版本未变才标记为已保存
+	version uint64
+	saved   uint64
+	// used 为最近一次访问的序号，用于选择释放的分片
+	used atomic.Int64
+}
+
+func (s *indexShard) dirty() bool {
+	return s.version != s.saved
+}
+
+// indexManifest 结构用于保存分片的层级和每个分片的条目数
+type indexManifest struct {
+	Depth  int            `json:"depth"`
+	Shards map[string]int `json:"shards"`
+}
+
+// 索引的保存方式
+const (
+	indexBackendJSON   = "json"
+	indexBackendSQLite = "sqlite"
+)
+
+// indexStorage 是索引的保存方式，分片以 JSON 编码的条目写入，根分片的名称为空
+type indexStorage interface {
+	// readShard 读取分片的条目，分片不存在时返回空的条目
+	readShard(name string) (map[string]*FileMeta, error)
+	writeShard(name string, data []byte) error
+	// removeShard 删除已经没有条目的分片，分片不存在时不返回错误
+	removeShard(name string) error
+	readManifest() (indexManifest, error)
+	writeManifest(manifest indexManifest) error
+}
+
+// jsonIndexStorage 将根分片保存在 file，其他分片和分片清单保存在 dir 目录下的 JSON 文件中
+type jsonIndexStorage struct {
+	file string
+	dir  string
+}
+
+// shardFile 返回分片文件的路径，文件名为分片名称的哈希，避免路径过长或包含特殊字符
+func (s *jsonIndexStorage) shardFile(name string) string {
+	if name == "" {
+		return s.file
+	}
+	sum := sha256.Sum256([]byte(name))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:12])+".json")
+}
+
+func (s *jsonIndexStorage) manifestFile() string {
+	return filepath.Join(s.dir, "shards.json")
+}
+
+func (s *jsonIndexStorage) readShard(name string) (map[string]*FileMeta, error) {
+	entries := map[string]*FileMeta{}
+	data, err := os.ReadFile(s.shardFile(name))
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *jsonIndexStorage) writeShard(name string, data []byte) error {
+	return writeIndexFile(s.shardFile(name), data)
+}
+
+func (s *jsonIndexStorage) removeShard(name string) error {
+	err := os.Remove(s.shardFile(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *jsonIndexStorage) readManifest() (indexManifest, error) {
+	var manifest indexManifest
+	data, err := os.ReadFile(s.manifestFile())
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+func (s *jsonIndexStorage) writeManifest(manifest indexManifest) error {
+	// 未分片且从未分片过时保持只有 index.json 的布局
+	if manifest.Depth <= 0 && !fileExists(s.manifestFile()) {
+		return nil
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeIndexFile(s.manifestFile(), data)
+}
+
+// OpenMetaIndex 打开索引，文件不存在时返回空索引；分片层级与上次不同时重新分片。
+// backend 为 sqlite 时索引保存在 file 所在目录下的 index.db 中
+func OpenMetaIndex(file string, config IndexConfig) (*MetaIndex, error) {
+	if config.HotShards <= 0 {
+		config.HotShards = 64
+	}
+	var storage indexStorage
+	switch config.Backend {
+	case "", indexBackendJSON:
+		storage = &jsonIndexStorage{file: file, dir: filepath.Join(filepath.Dir(file), "index")}
+	case indexBackendSQLite:
+		s, err := openSQLiteIndexStorage(filepath.Join(filepath.Dir(file), "index.db"))
+		if err != nil {
+			return nil, err
+		}
+		storage = s
+	default:
+		return nil, fmt.Errorf("不支持的索引保存方式 %q，可选 json 或 sqlite", config.Backend)
+	}
+	idx := &MetaIndex{
+		storage: storage,
+		depth:   config.ShardDepth,
+		hot:     config.HotShards,
+		shards:  map[string]*indexShard{},
+		counts:  map[string]int{},
+	}
+
+	entries, err := storage.readShard("")
+	if err != nil {
+		return nil, err
+	}
+	root := &indexShard{entries: entries}
+	idx.shards[""] = root
+	if len(root.entries) > 0 {
+		idx.counts[""] = len(root.entries)
+	}
+
+	manifest, err := storage.readManifest()
+	if err != nil {
+		return nil, err
+	}
+	for name, count := range manifest.Shards {
+		idx.counts[name] = count
+	}
+
+	// 分片层级变化或首次分片时，将所有条目按新的层级重新分片
+	if manifest.Depth != idx.depth || (idx.depth == 0 && len(manifest.Shards) > 0) {
+		err = idx.reshard()
+		if err != nil {
+			return nil, err
+		}
+		err = idx.Save()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Journal {
+		err = idx.replayJournal(filepath.Join(filepath.Dir(file), "journal"), config.JournalSync)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// replayJournal 打开预写日志，回放上次保存索引之后的修改并立即保存
+func (idx *MetaIndex) replayJournal(dir string, sync bool) error {
+	journal, records, err := openIndexJournal(dir, sync)
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	applied := 0
+	for _, record := range records {
+		switch record.Op {
+		case journalPut:
+			if record.Meta == nil {
+				continue
+			}
+			err = idx.putLocked(record.Key, *record.Meta)
+		case journalRemove:
+			idx.removeTreeLocked(record.Key)
+		default:
+			continue
+		}
+		if err != nil {
+			idx.mu.Unlock()
+			return err
+		}
+		applied++
+	}
+	idx.journal = journal
+	idx.mu.Unlock()
+	if applied == 0 {
+		return nil
+	}
+	slog.Info("已从预写日志恢复索引修改", "applied", applied)
+	return idx.Save()
+}
+
+// reshard 加载所有分片并按当前的层级重新分配条目
+func (idx *MetaIndex) reshard() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entries := map[string]*FileMeta{}
+	for name := range idx.counts {
+		s, err := idx.readShard(name)
+		if err != nil {
+			return err
+		}
+		for key, meta := range s.entries {
+			entries[key] = meta
+		}
+		if name != "" {
+			idx.stale = append(idx.stale, name)
+		}
+	}
+	idx.shards = map[string]*indexShard{"": {entries: map[string]*FileMeta{}}}
+	idx.counts = map[string]int{}
+	for key, meta := range entries {
+		s := idx.createShard(idx.shardOf(key))
+		s.entries[key] = meta
+		idx.counts[idx.shardOf(key)]++
+	}
+	for _, s := range idx.shards {
+		s.version++
+	}
+	idx.dirty = true
+	slog.Info("索引已重新分片", "depth", idx.depth, "shards", len(idx.counts))
+	return nil
+}
+
+// indexKey 将请求中的路径规范化为索引使用的键
+func indexKey(path string) string {
+	key := filepath.ToSlash(filepath.Clean("/" + path))
+	return strings.TrimPrefix(key, "/")
+}
+
+// shardOf 返回路径所在的分片名称
+func (idx *MetaIndex) shardOf(key string) string {
+	if idx.depth <= 0 {
+		return ""
+	}
+	parts := strings.SplitN(key, "/", idx.depth+1)
+	if len(parts) <= idx.depth {
+		return ""
+	}
+	return strings.Join(parts[:idx.depth], "/")
+}
+
+// readShard 从磁盘读取分片，分片不存在时返回空分片
+func (idx *MetaIndex) readShard(name string) (*indexShard, error) {
+	if s, ok := idx.shards[name]; ok {
+		return s, nil
+	}
+	entries, err := idx.storage.readShard(name)
+	if err != nil {
+		return nil, err
+	}
+	return &indexShard{entries: entries}, nil
+}
+
+// loadShard 加载分片并放入内存，分片没有条目时创建空分片，调用方需持有写锁
+func (idx *MetaIndex) loadShard(name string) (*indexShard, error) {
+	if s, ok := idx.shards[name]; ok {
+		s.used.Store(idx.clock.Add(1))
+		return s, nil
+	}
+	if _, ok := idx.counts[name]; !ok {
+		return idx.createShard(name), nil
+	}
+	s, err := idx.readShard(name)
+	if err != nil {
+		return nil, err
+	}
+	s.used.Store(idx.clock.Add(1))
+	idx.shards[name] = s
+	idx.evict()
+	return s, nil
+}
+
+// createShard 在内存中创建空分片，调用方需持有写锁
+func (idx *MetaIndex) createShard(name string) *indexShard {
+	if s, ok := idx.shards[name]; ok {
+		return s
+	}
+	s := &indexShard{entries: map[string]*FileMeta{}}
+	s.used.Store(idx.clock.Add(1))
+	idx.shards[name] = s
+	return s
+}
+
+// evict 常驻的分片超过上限时释放最久未访问的分片，有未保存修改的分片在保存之后才能释放，调用方需持有写锁
+func (idx *MetaIndex) evict() {
+	for len(idx.shards)-1 > idx.hot {
+		victim := ""
+		var oldest int64
+		for name, s := range idx.shards {
+			if name == "" || s.dirty() {
+				continue
+			}
+			if used := s.used.Load(); victim == "" || used < oldest {
+				victim, oldest = name, used
+			}
+		}
+		if victim == "" {
+			return
+		}
+		delete(idx.shards, victim)
+	}
+}
+
+// rlockShard 以读锁返回已加载的分片，未加载时先加载；分片不存在或加载失败时返回 nil 且不持有锁
+func (idx *MetaIndex) rlockShard(name string) *indexShard {
+	for {
+		idx.mu.RLock()
+		if s, ok := idx.shards[name]; ok {
+			s.used.Store(idx.clock.Add(1))
+			return s
+		}
+		_, exists := idx.counts[name]
+		idx.mu.RUnlock()
+		if !exists {
+			return nil
+		}
+
+		idx.mu.Lock()
+		_, err := idx.loadShard(name)
+		idx.mu.Unlock()
+		if err != nil {
+			slog.Error("加载索引分片失败", "name", name, "err", err)
+			return nil
+		}
+	}
+}
+
+// Get 返回指定路径的元数据副本
+func (idx *MetaIndex) Get(key string) (FileMeta, bool) {
+	if idx == nil {
+		return FileMeta{}, false
+	}
+	s := idx.rlockShard(idx.shardOf(key))
+	if s == nil {
+		return FileMeta{}, false
+	}
+	defer idx.mu.RUnlock()
+
+	meta, ok := s.entries[key]
+	if !ok {
+		return FileMeta{}, false
+	}
+	return *meta, true
+}
+
+// Update 修改指定路径的元数据，不存在时自动创建
+func (idx *MetaIndex) Update(key string, fn func(meta *FileMeta)) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	name := idx.shardOf(key)
+	s, err := idx.loadShard(name)
+	if err != nil {
+		slog.Error("加载索引分片失败", "name", name, "err", err)
+		return
+	}
+	var meta FileMeta
+	if current, ok := s.entries[key]; ok {
+		meta = *current
+	}
+	fn(&meta)
+
+	// 先写预写日志再修改内存中的索引
+	if idx.journal != nil {
+		_, err = idx.journal.append(indexJournalRecord{Op: journalPut, Key: key, Meta: &meta})
+		if err != nil {
+			slog.Error("写入预写日志失败", "err", err)
+		}
+	}
+	err = idx.putLocked(key, meta)
+	if err != nil {
+		slog.Error("加载索引分片失败", "name", name, "err", err)
+	}
+}
+
+// putLocked 保存指定路径的元数据，调用方需要持有写锁
+func (idx *MetaIndex) putLocked(key string, meta FileMeta) error {
+	name := idx.shardOf(key)
+	s, err := idx.loadShard(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.entries[key]; !ok {
+		idx.counts[name]++
+		idx.dirty = true
+	}
+	s.entries[key] = &meta
+	s.version++
+	return nil
+}
+
+// Record 根据文件信息更新索引中的大小、修改时间等字段
+func (idx *MetaIndex) Record(key string, info os.FileInfo) {
+	idx.Update(key, func(meta *FileMeta) {
+		if meta.Size != info.Size() || !meta.ModTime.Equal(info.ModTime()) {
+			meta.SHA256 = ""
+		}
+		meta.Size = info.Size()
+		meta.ModTime = info.ModTime()
+		meta.IsDir = info.IsDir()
+	})
+}
+
+// Children 返回索引中指定目录的直接子项，只需要读取子项所在的分片
+func (idx *MetaIndex) Children(dirKey string) []string {
+	if idx == nil {
+		return nil
+	}
+	prefix := ""
+	if dirKey != "" {
+		prefix = dirKey + "/"
+	}
+	s := idx.rlockShard(idx.shardOf(prefix + "_"))
+	if s == nil {
+		return nil
+	}
+	defer idx.mu.RUnlock()
+
+	var keys []string
+	for k := range s.entries {
+		if strings.HasPrefix(k, prefix) && !strings.Contains(k[len(prefix):], "/") {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Len 返回索引中的条目数
+func (idx *MetaIndex) Len() int {
+	if idx == nil {
+		return 0
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	total := 0
+	for _, count := range idx.counts {
+		total += count
+	}
+	return total
+}
+
+// Range 遍历索引中的所有条目，fn 返回 false 时停止遍历
+func (idx *MetaIndex) Range(fn func(key string, meta FileMeta) bool) {
+	idx.RangePrefix("", fn)
+}
+
+// RangePrefix 遍历索引中指定目录下的所有条目（不包括目录本身），只读取可能包含这些条目的分片，fn 返回 false 时停止遍历
+func (idx *MetaIndex) RangePrefix(root string, fn func(key string, meta FileMeta) bool) {
+	if idx == nil {
+		return
+	}
+	prefix := ""
+	if root != "" {
+		prefix = root + "/"
+	}
+	idx.mu.RLock()
+	var names []string
+	for name := range idx.counts {
+		if idx.shardMayContain(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	idx.mu.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := idx.rlockShard(name)
+		if s == nil {
+			continue
+		}
+		for k, meta := range s.entries {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			if !fn(k, *meta) {
+				idx.mu.RUnlock()
+				return
+			}
+		}
+		idx.mu.RUnlock()
+	}
+}
+
+// shardMayContain 判断分片中是否可能有以 prefix 开始的条目
+func (idx *MetaIndex) shardMayContain(name string, prefix string) bool {
+	return name == "" || prefix == "" || strings.HasPrefix(name+"/", prefix) || strings.HasPrefix(prefix, name+"/")
+}
+
+// RemoveTree 删除指定路径及其下所有子路径的元数据
+func (idx *MetaIndex) RemoveTree(key string) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.journal != nil {
+		_, err := idx.journal.append(indexJournalRecord{Op: journalRemove, Key: key})
+		if err != nil {
+			slog.Error("写入预写日志失败", "err", err)
+		}
+	}
+	idx.removeTreeLocked(key)
+}
+
+// removeTreeLocked 删除指定路径及其下所有子路径的元数据，调用方需要持有写锁
+func (idx *MetaIndex) removeTreeLocked(key string) {
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+	var names []string
+	for name := range idx.counts {
+		if idx.shardMayContain(name, prefix) || name == key {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		// 整个分片都在删除的范围内时不需要加载
+		if name != "" && (key == "" || name == key || strings.HasPrefix(name, prefix)) {
+			delete(idx.counts, name)
+			delete(idx.shards, name)
+			idx.stale = append(idx.stale, name)
+			idx.dirty = true
+			continue
+		}
+		s, err := idx.loadShard(name)
+		if err != nil {
+			slog.Error("加载索引分片失败", "name", name, "err", err)
+			continue
+		}
+		for k := range s.entries {
+			if key == "" || k == key || strings.HasPrefix(k, prefix) {
+				delete(s.entries, k)
+				idx.counts[name]--
+				s.version++
+				idx.dirty = true
+			}
+		}
+		if idx.counts[name] <= 0 && name != "" {
+			delete(idx.counts, name)
+			delete(idx.shards, name)
+			idx.stale = append(idx.stale, name)
+		} else if idx.counts[name] <= 0 {
+			delete(idx.counts, name)
+		}
+	}
+}
+
+// indexWrite 是一次保存中需要写入的分片
+type indexWrite struct {
+	name    string
+	shard   *indexShard
+	version uint64
+	data    []byte
+}
+
+// Save 将有修改的分片和分片清单写回磁盘，先写临时文件再重命名以免写坏索引
+func (idx *MetaIndex) Save() error {
+	if idx == nil {
+		return nil
+	}
+	idx.saving.Lock()
+	defer idx.saving.Unlock()
+
+	idx.mu.Lock()
+	// 切换到新的段，之前的段中的修改都包含在本次保存的数据中
+	var checkpoint uint64
+	if idx.journal != nil {
+		start, err := idx.journal.rotate()
+		if err != nil {
+			idx.mu.Unlock()
+			return err
+		}
+		checkpoint = start
+	}
+	var writes []indexWrite
+	for name, s := range idx.shards {
+		if !s.dirty() {
+			continue
+		}
+		data, err := json.Marshal(s.entries)
+		if err != nil {
+			idx.mu.Unlock()
+			return err
+		}
+		writes = append(writes, indexWrite{name: name, shard: s, version: s.version, data: data})
+	}
+	var manifest *indexManifest
+	if idx.dirty {
+		shards := map[string]int{}
+		for name, count := range idx.counts {
+			if name != "" {
+				shards[name] = count
+			}
+		}
+		manifest = &indexManifest{Depth: idx.depth, Shards: shards}
+		idx.dirty = false
+	}
+	var stale []string
+	for _, name := range idx.stale {
+		// 删除后又写入了条目的分片由本次保存覆盖
+		if _, ok := idx.counts[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	idx.stale = nil
+	idx.mu.Unlock()
+
+	for _, write := range writes {
+		err := idx.storage.writeShard(write.name, write.data)
+		if err != nil {
+			idx.restoreUnsaved(manifest != nil, stale)
+			return err
+		}
+		idx.mu.Lock()
+		write.shard.saved = write.version
+		idx.mu.Unlock()
+	}
+	if manifest != nil {
+		err := idx.storage.writeManifest(*manifest)
+		if err != nil {
+			idx.restoreUnsaved(true, stale)
+			return err
+		}
+	}
+	for _, name := range stale {
+		err := idx.storage.removeShard(name)
+		if err != nil {
+			slog.Error("删除索引分片失败", "err", err)
+		}
+	}
+
+	idx.mu.Lock()
+	idx.evict()
+	idx.mu.Unlock()
+	if idx.journal != nil {
+		idx.journal.truncate(checkpoint)
+	}
+	return nil
+}
+
+// restoreUnsaved 在保存失败时恢复未写入的清单和待删除的分片，下次保存时重试
+func (idx *MetaIndex) restoreUnsaved(manifest bool, stale []string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if manifest {
+		idx.dirty = true
+	}
+	idx.stale = append(idx.stale, stale...)
+}
+
+// JournalEvent 在预写日志中记录一个事件并返回其序号，与索引修改使用同一序号空间；未启用预写日志时返回 0
+func (idx *MetaIndex) JournalEvent(event string, key string) uint64 {
+	if idx == nil {
+		return 0
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.journal == nil {
+		return 0
+	}
+	seq, err := idx.journal.append(indexJournalRecord{Op: journalEvent, Key: key, Event: event})
+	if err != nil {
+		slog.Error("写入预写日志失败", "err", err)
+	}
+	return seq
+}
+
+// AdvanceJournal 保证之后分配的序号大于 seq
+func (idx *MetaIndex) AdvanceJournal(seq uint64) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.journal != nil && idx.journal.seq < seq {
+		idx.journal.seq = seq
+	}
+}
+
+// writeIndexFile 先写临时文件再重命名
+func writeIndexFile(file string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// fileExists 判断文件是否存在
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// writeMetrics 输出 Prometheus 格式的索引统计
+func (idx *MetaIndex) writeMetrics(w io.Writer) {
+	if idx == nil {
+		return
+	}
+	idx.mu.RLock()
+	entries := 0
+	for _, count := range idx.counts {
+		entries += count
+	}
+	shards, hot := len(idx.counts), len(idx.shards)
+	var seq uint64
+	if idx.journal != nil {
+		seq = idx.journal.seq
+	}
+	idx.mu.RUnlock()
+	fmt.Fprintf(w, "# HELP store_index_entries Entries in the metadata index.\n")
+	fmt.Fprintf(w, "# TYPE store_index_entries gauge\n")
+	fmt.Fprintf(w, "store_index_entries %d\n", entries)
+	fmt.Fprintf(w, "# HELP store_index_shards Metadata index shards with at least one entry.\n")
+	fmt.Fprintf(w, "# TYPE store_index_shards gauge\n")
+	fmt.Fprintf(w, "store_index_shards %d\n", shards)
+	fmt.Fprintf(w, "# HELP store_index_hot_shards Metadata index shards resident in memory.\n")
+	fmt.Fprintf(w, "# TYPE store_index_hot_shards gauge\n")
+	fmt.Fprintf(w, "store_index_hot_shards %d\n", hot)
+	if seq > 0 {
+		fmt.Fprintf(w, "# HELP store_index_journal_seq Last sequence number written to the index journal.\n")
+		fmt.Fprintf(w, "# TYPE store_index_journal_seq counter\n")
+		fmt.Fprintf(w, "store_index_journal_seq %d\n", seq)
+	}
+}
+
+// Run 按固定间隔将索引的修改保存到磁盘
+func (idx *MetaIndex) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := idx.Save()
+		if err != nil {
+			slog.Error("保存索引失败", "err", err)
+		}
+	}
+}
+
+// tokenFingerprint 返回 token 的短指纹，用于在索引中标识上传者而不泄露 token
+func tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// uploadMetadata 从 X-Meta-* 请求头中读取自定义元数据
+func uploadMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for name, values := range header {
+		if !strings.HasPrefix(name, "X-Meta-") || len(values) == 0 {
+			continue
+		}
+		metadata[strings.ToLower(strings.TrimPrefix(name, "X-Meta-"))] = values[0]
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
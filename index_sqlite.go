@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// sqliteDriverName 是 SQLite 驱动注册的名称，驱动在 index_sqlite_driver.go 中引入，只有使用 -tags sqlite 构建时才编译进来
+const sqliteDriverName = "sqlite3"
+
+// sqliteIndexSchema 为索引的表结构：files 每行一个文件或目录，shard 为所在的分片，settings 保存分片层级等设置
+const sqliteIndexSchema = `
+CREATE TABLE IF NOT EXISTS files (
+	path          TEXT PRIMARY KEY,
+	shard         TEXT NOT NULL,
+	size          INTEGER NOT NULL,
+	mtime         TEXT NOT NULL,
+	is_dir        INTEGER NOT NULL,
+	atime         TEXT NOT NULL,
+	sha256        TEXT NOT NULL,
+	uploader      TEXT NOT NULL,
+	metadata      TEXT NOT NULL,
+	storage_class TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_shard ON files (shard);
+CREATE TABLE IF NOT EXISTS settings (
+	name  TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);`
+
+// sqliteIndexStorage 将索引保存在 SQLite 数据库中，每个文件一行，可以直接用 SQL 查询和统计；
+// 保存分片时在一个事务中替换该分片的所有行，中途失败时数据库保持上次保存的状态
+type sqliteIndexStorage struct {
+	db *sql.DB
+}
+
+// openSQLiteIndexStorage 打开或创建索引数据库，没有编译 SQLite 驱动时返回错误
+func openSQLiteIndexStorage(file string) (*sqliteIndexStorage, error) {
+	if !slices.Contains(sql.Drivers(), sqliteDriverName) {
+		return nil, fmt.Errorf("index.backend 为 sqlite 时需要使用 -tags sqlite 构建")
+	}
+	db, err := sql.Open(sqliteDriverName, file)
+	if err != nil {
+		return nil, err
+	}
+	// 同一时间只使用一个连接，保存分片的事务和按需加载分片的查询不会因为锁冲突失败
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(sqliteIndexSchema)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &sqliteIndexStorage{db: db}, nil
+}
+
+func (s *sqliteIndexStorage) readShard(name string) (map[string]*FileMeta, error) {
+	rows, err := s.db.Query(`SELECT path, size, mtime, is_dir, atime, sha256, uploader, metadata, storage_class FROM files WHERE shard = ?`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+	entries := map[string]*FileMeta{}
+	for rows.Next() {
+		var key, mtime, atime, metadata string
+		meta := &FileMeta{}
+		err = rows.Scan(&key, &meta.Size, &mtime, &meta.IsDir, &atime, &meta.SHA256, &meta.Uploader, &metadata, &meta.StorageClass)
+		if err != nil {
+			return nil, err
+		}
+		meta.ModTime, err = time.Parse(time.RFC3339Nano, mtime)
+		if err != nil {
+			return nil, err
+		}
+		meta.ATime, err = time.Parse(time.RFC3339Nano, atime)
+		if err != nil {
+			return nil, err
+		}
+		if metadata != "" {
+			err = json.Unmarshal([]byte(metadata), &meta.Metadata)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries[key] = meta
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteIndexStorage) writeShard(name string, data []byte) error {
+	var entries map[string]*FileMeta
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	_, err = tx.Exec(`DELETE FROM files WHERE shard = ?`, name)
+	if err != nil {
+		return err
+	}
+	// 重新分片时条目可能仍在旧分片的行中，旧分片的行在之后删除
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO files (path, shard, size, mtime, is_dir, atime, sha256, uploader, metadata, storage_class) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_ = stmt.Close()
+	}(stmt)
+	for key, meta := range entries {
+		metadata := ""
+		if len(meta.Metadata) > 0 {
+			encoded, err := json.Marshal(meta.Metadata)
+			if err != nil {
+				return err
+			}
+			metadata = string(encoded)
+		}
+		_, err = stmt.Exec(key, name, meta.Size, meta.ModTime.Format(time.RFC3339Nano), meta.IsDir, meta.ATime.Format(time.RFC3339Nano),
+			meta.SHA256, meta.Uploader, metadata, meta.StorageClass)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteIndexStorage) removeShard(name string) error {
+	_, err := s.db.Exec(`DELETE FROM files WHERE shard = ?`, name)
+	return err
+}
+
+// readManifest 返回保存的分片层级和按 files 表统计的每个分片的条目数
+func (s *sqliteIndexStorage) readManifest() (indexManifest, error) {
+	manifest := indexManifest{Shards: map[string]int{}}
+	var depth string
+	err := s.db.QueryRow(`SELECT value FROM settings WHERE name = 'shard_depth'`).Scan(&depth)
+	if err == nil {
+		manifest.Depth, err = strconv.Atoi(depth)
+		if err != nil {
+			return manifest, err
+		}
+	} else if err != sql.ErrNoRows {
+		return manifest, err
+	}
+	rows, err := s.db.Query(`SELECT shard, COUNT(*) FROM files WHERE shard != '' GROUP BY shard`)
+	if err != nil {
+		return manifest, err
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+	for rows.Next() {
+		var name string
+		var count int
+		err = rows.Scan(&name, &count)
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Shards[name] = count
+	}
+	return manifest, rows.Err()
+}
+
+// writeManifest 只保存分片层级，每个分片的条目数由 files 表统计
+func (s *sqliteIndexStorage) writeManifest(manifest indexManifest) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO settings (name, value) VALUES ('shard_depth', ?)`, strconv.Itoa(manifest.Depth))
+	return err
+}
@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package main
+
+// 使用 -tags sqlite 构建时引入 SQLite 驱动（需要 cgo），index.backend 可以配置为 sqlite
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InventoryConfig 结构用于配置定期导出的文件清单，格式与 S3 Inventory 的 CSV 清单类似
+type InventoryConfig struct {
+	// Destination 清单的输出目录，为空时不导出
+	Destination string `json:"destination"`
+	// Interval 导出的间隔，单位小时，默认 24
+	Interval int `json:"interval"`
+	// Keep 保留最近的清单数量，默认 7
+	Keep int `json:"keep"`
+	// ComputeChecksums 为 true 时为索引中没有哈希的文件计算 SHA-256，默认 false 时留空
+	ComputeChecksums bool `json:"compute_checksums"`
+}
+
+// inventoryHeader 是清单 CSV 的表头
+var inventoryHeader = []string{"path", "size", "sha256", "last_modified", "storage_class"}
+
+// InventoryManifest 结构描述一次导出的清单，与 CSV 一起写入输出目录，供下游工具确认清单完整
+type InventoryManifest struct {
+	CreatedAt time.Time `json:"created_at"`
+	File      string    `json:"file"`
+	Format    string    `json:"format"`
+	Rows      int       `json:"rows"`
+	Size      int64     `json:"size"`
+	// SHA256 为 CSV 文件的哈希
+	SHA256 string `json:"sha256"`
+	// MissingChecksums 为没有哈希的文件数量
+	MissingChecksums int `json:"missing_checksums"`
+}
+
+var errInventoryRunning = errors.New("清单正在导出")
+
+// Inventory 结构用于定期导出所有文件的清单
+type Inventory struct {
+	config InventoryConfig
+
+	// running 保证同一时间只有一次导出
+	running sync.Mutex
+}
+
+// inventory 未配置输出目录时为 nil
+var inventory *Inventory
+
+// NewInventory 创建文件清单导出，未配置输出目录时返回 nil
+func NewInventory(config InventoryConfig) *Inventory {
+	if config.Destination == "" {
+		return nil
+	}
+	if config.Interval <= 0 {
+		config.Interval = 24
+	}
+	if config.Keep <= 0 {
+		config.Keep = 7
+	}
+	return &Inventory{config: config}
+}
+
+// Export 遍历 data 目录导出一次清单，先写入临时文件再重命名，输出目录中不会出现不完整的清单
+func (inv *Inventory) Export(now time.Time) (InventoryManifest, error) {
+	if !inv.running.TryLock() {
+		return InventoryManifest{}, errInventoryRunning
+	}
+	defer inv.running.Unlock()
+
+	manifest := InventoryManifest{
+		CreatedAt: now.UTC(),
+		File:      "inventory-" + now.UTC().Format("20060102T150405Z") + ".csv",
+		Format:    "CSV",
+	}
+	err := os.MkdirAll(inv.config.Destination, os.ModePerm)
+	if err != nil {
+		return manifest, err
+	}
+	target := filepath.Join(inv.config.Destination, manifest.File)
+	tmp, err := createTempFile(target, "inventory-*")
+	if err != nil {
+		return manifest, err
+	}
+	hash := sha256.New()
+	err = inv.write(io.MultiWriter(tmp, hash), &manifest)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		var info os.FileInfo
+		info, err = os.Stat(tmp.Name())
+		if err == nil {
+			manifest.Size = info.Size()
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return manifest, err
+	}
+	manifest.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	manifestFile := strings.TrimSuffix(target, ".csv") + ".manifest.json"
+	err = os.WriteFile(manifestFile+".tmp", data, 0644)
+	if err != nil {
+		return manifest, err
+	}
+	err = os.Rename(manifestFile+".tmp", manifestFile)
+	if err != nil {
+		return manifest, err
+	}
+	inv.prune()
+	return manifest, nil
+}
+
+// write 将所有文件按路径顺序写入 CSV
+func (inv *Inventory) write(w io.Writer, manifest *InventoryManifest) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(inventoryHeader)
+	if err != nil {
+		return err
+	}
+	err = filepath.WalkDir("data", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		key := indexKey(strings.TrimPrefix(filepath.ToSlash(path), "data"))
+		if d.IsDir() {
+			if isReservedPath(key) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// 遍历期间被删除的文件不写入清单
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		return inv.writeRow(writer, manifest, key, path, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	// 已移动到归档层的文件不在 data 目录中，单独遍历归档层
+	if storageClasses != nil && storageClasses.config.ArchiveDir != "" {
+		root := storageClasses.config.ArchiveDir
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || strings.HasPrefix(d.Name(), ".copy-") {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			// 正在从归档层移回的文件已经写入 data 目录
+			if _, err := os.Stat(filepath.Join("data", rel)); err == nil {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			return inv.writeRow(writer, manifest, key, path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeRow 写入一个文件，未启用存储类型时所有文件都是 STANDARD
+func (inv *Inventory) writeRow(writer *csv.Writer, manifest *InventoryManifest, key string, fullPath string, info os.FileInfo) error {
+	sum := inv.checksum(key, fullPath, info)
+	if sum == "" {
+		manifest.MissingChecksums++
+	}
+	class := storageClasses.Class(key, fullPath)
+	if class == "" {
+		class = StorageStandard
+	}
+	manifest.Rows++
+	return writer.Write([]string{
+		key,
+		strconv.FormatInt(info.Size(), 10),
+		sum,
+		info.ModTime().UTC().Format(time.RFC3339),
+		class,
+	})
+}
+
+// checksum 返回索引中记录的 SHA-256，索引中没有或已过期时按配置计算
+func (inv *Inventory) checksum(key string, fullPath string, info os.FileInfo) string {
+	meta, ok := metaIndex.Get(key)
+	if ok && meta.SHA256 != "" && meta.Size == info.Size() && meta.ModTime.Equal(info.ModTime()) {
+		return meta.SHA256
+	}
+	if !inv.config.ComputeChecksums {
+		return ""
+	}
+	result, err := fileChecksum(fullPath, false)
+	if err != nil {
+		slog.Error("计算清单中的哈希失败", "key", key, "err", err)
+		return ""
+	}
+	return result.SHA256
+}
+
+// prune 删除超出保留数量的旧清单
+func (inv *Inventory) prune() {
+	files, err := filepath.Glob(filepath.Join(inv.config.Destination, "inventory-*.csv"))
+	if err != nil {
+		return
+	}
+	// 文件名中的时间可以按字符串排序
+	sort.Strings(files)
+	for len(files) > inv.config.Keep {
+		for _, file := range []string{files[0], strings.TrimSuffix(files[0], ".csv") + ".manifest.json"} {
+			err = os.Remove(file)
+			if err != nil && !os.IsNotExist(err) {
+				slog.Error("删除旧清单失败", "err", err)
+			}
+		}
+		files = files[1:]
+	}
+}
+
+// Run 按间隔定期导出清单
+func (inv *Inventory) Run() {
+	ticker := time.NewTicker(time.Duration(inv.config.Interval) * time.Hour)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		manifest, err := inv.Export(now)
+		if err != nil {
+			slog.Error("导出文件清单失败", "err", err)
+			continue
+		}
+		slog.Info("已导出文件清单", "file", manifest.File, "rows", manifest.Rows)
+	}
+}
+
+// 立即导出一次文件清单
+func inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if inventory == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未配置文件清单", nil, r.URL.Path)
+		return
+	}
+	manifest, err := inventory.Export(time.Now())
+	if err == errInventoryRunning {
+		sendJSONResponse(w, http.StatusConflict, "清单正在导出，请稍后重试", err, r.URL.Path)
+		return
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "导出文件清单失败", err, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", manifest, nil, r.URL.Path)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	journalPut    = "put"
+	journalRemove = "remove"
+	// journalEvent 只分配序号，回放时忽略，用于为复制等后续操作生成与索引修改统一编号的事件序号
+	journalEvent = "event"
+)
+
+// indexJournalRecord 是预写日志中的一条记录，put 记录修改后的完整元数据，回放时可以重复应用
+type indexJournalRecord struct {
+	Seq  uint64    `json:"seq"`
+	Op   string    `json:"op"`
+	Key  string    `json:"key"`
+	Meta *FileMeta `json:"meta,omitempty"`
+	// Event 为 event 记录的事件类型
+	Event string `json:"event,omitempty"`
+}
+
+// indexJournal 是索引的预写日志，按段保存在 data/.meta/journal 下，段文件以起始序号命名；
+// 索引保存前切换到新的段，保存完成后删除之前的段，重启时回放剩余的段即可恢复未保存的修改
+type indexJournal struct {
+	dir  string
+	sync bool
+	file *os.File
+	// seq 为最后分配的序号
+	seq uint64
+}
+
+// journalSegments 返回目录中的段的起始序号，从小到大排列
+func journalSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var starts []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".log")
+		if !ok {
+			continue
+		}
+		start, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts, nil
+}
+
+func (j *indexJournal) segmentFile(start uint64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%020d.log", start))
+}
+
+// openIndexJournal 读取所有段中的记录并打开新的段，返回需要回放的记录
+func openIndexJournal(dir string, sync bool) (*indexJournal, []indexJournalRecord, error) {
+	j := &indexJournal{dir: dir, sync: sync}
+	starts, err := journalSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var records []indexJournalRecord
+	for _, start := range starts {
+		if start > 0 && start-1 > j.seq {
+			j.seq = start - 1
+		}
+		segment, err := readJournalSegment(j.segmentFile(start))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, record := range segment {
+			if record.Seq > j.seq {
+				j.seq = record.Seq
+			}
+		}
+		records = append(records, segment...)
+	}
+	sort.SliceStable(records, func(a, b int) bool { return records[a].Seq < records[b].Seq })
+
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = j.rotate()
+	if err != nil {
+		return nil, nil, err
+	}
+	return j, records, nil
+}
+
+// readJournalSegment 读取一个段，崩溃时没有写完的最后一条记录被忽略
+func readJournalSegment(file string) ([]indexJournalRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	var records []indexJournalRecord
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if len(line) > 0 {
+				slog.Error("忽略预写日志中不完整的记录", "file", file)
+			}
+			break
+		}
+		var record indexJournalRecord
+		if json.Unmarshal(line, &record) != nil {
+			slog.Error("忽略预写日志中无法解析的记录", "file", file)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// append 分配序号并追加一条记录，返回记录的序号
+func (j *indexJournal) append(record indexJournalRecord) (uint64, error) {
+	if j.file == nil {
+		return 0, fmt.Errorf("预写日志 %s 未打开", j.dir)
+	}
+	j.seq++
+	record.Seq = j.seq
+	data, err := json.Marshal(record)
+	if err != nil {
+		return record.Seq, err
+	}
+	_, err = j.file.Write(append(data, '\n'))
+	if err != nil {
+		return record.Seq, err
+	}
+	if j.sync {
+		err = j.file.Sync()
+	}
+	return record.Seq, err
+}
+
+// rotate 关闭当前的段并打开新的段，返回新段的起始序号，起始序号之前的记录在索引保存后不再需要
+func (j *indexJournal) rotate() (uint64, error) {
+	if j.file != nil {
+		err := j.file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+		j.file = nil
+	}
+	start := j.seq + 1
+	file, err := os.OpenFile(j.segmentFile(start), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return start, err
+	}
+	j.file = file
+	return start, nil
+}
+
+// truncate 删除起始序号小于 before 的段
+func (j *indexJournal) truncate(before uint64) {
+	starts, err := journalSegments(j.dir)
+	if err != nil {
+		slog.Error("读取预写日志失败", "err", err)
+		return
+	}
+	for _, start := range starts {
+		if start >= before {
+			break
+		}
+		err := os.Remove(j.segmentFile(start))
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("删除预写日志失败", "err", err)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTConfig 结构用于配置 JWT 认证
+type JWTConfig struct {
+	// Secret 为 HS256/HS384/HS512 使用的共享密钥
+	Secret string `json:"secret"`
+	// PublicKeyFile 为 RS256 使用的 PEM 格式公钥文件
+	PublicKeyFile string `json:"public_key_file"`
+	Issuer        string `json:"issuer"`
+	Audience      string `json:"audience"`
+	// ScopesClaim 为保存权限的声明名称，默认 scope
+	ScopesClaim string `json:"scopes_claim"`
+}
+
+// OIDCConfig 结构用于配置 OIDC 认证，签名公钥从签发方的 JWKS 获取
+type OIDCConfig struct {
+	Issuer      string `json:"issuer"`
+	Audience    string `json:"audience"`
+	ScopesClaim string `json:"scopes_claim"`
+}
+
+// jwtClaims 是 JWT 中会用到的声明
+type jwtClaims map[string]interface{}
+
+// verifyJWT 校验 JWT 的签名和有效期，keyFor 根据算法和 kid 返回校验使用的密钥
+func verifyJWT(token string, keyFor func(alg string, kid string) (interface{}, error)) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errNoCredentials
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	err = json.Unmarshal(headerData, &header)
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	key, err := keyFor(header.Alg, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Alg {
+	case "HS256", "HS384", "HS512":
+		secret, ok := key.([]byte)
+		if !ok {
+			return nil, errInvalidCredentials
+		}
+		var newHash func() hash.Hash
+		switch header.Alg {
+		case "HS256":
+			newHash = sha256.New
+		case "HS384":
+			newHash = sha512.New384
+		default:
+			newHash = sha512.New
+		}
+		mac := hmac.New(newHash, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errInvalidCredentials
+		}
+	case "RS256":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errInvalidCredentials
+		}
+		digest := sha256.Sum256(signed)
+		err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return nil, errInvalidCredentials
+		}
+	default:
+		return nil, errInvalidCredentials
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	var claims jwtClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, errInvalidCredentials
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, errInvalidCredentials
+	}
+	return claims, nil
+}
+
+// identity 检查签发方和受众，并从声明中生成调用方身份
+func (c jwtClaims) identity(provider string, issuer string, audience string, scopesClaim string) (*Identity, error) {
+	if issuer != "" && c["iss"] != issuer {
+		return nil, errInvalidCredentials
+	}
+	if audience != "" && !c.hasAudience(audience) {
+		return nil, errInvalidCredentials
+	}
+
+	if scopesClaim == "" {
+		scopesClaim = "scope"
+	}
+	var scopes []string
+	switch v := c[scopesClaim].(type) {
+	case string:
+		scopes = strings.Fields(v)
+	case []interface{}:
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+	}
+
+	name, _ := c["sub"].(string)
+	return &Identity{Name: name, Provider: provider, Scopes: scopes}, nil
+}
+
+func (c jwtClaims) hasAudience(audience string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bearerToken 返回 Authorization 请求头中的 Bearer 凭证
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// JWTProvider 使用共享密钥或固定公钥校验 JWT
+type JWTProvider struct {
+	cfg       JWTConfig
+	publicKey *rsa.PublicKey
+}
+
+// NewJWTProvider 创建 JWT 认证提供者
+func NewJWTProvider(cfg JWTConfig) (*JWTProvider, error) {
+	p := &JWTProvider{cfg: cfg}
+	if cfg.PublicKeyFile != "" {
+		data, err := os.ReadFile(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("无法解析 JWT 公钥文件")
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("JWT 公钥不是 RSA 公钥")
+		}
+		p.publicKey = publicKey
+	}
+	return p, nil
+}
+
+// ValidateCredentials 校验 Bearer JWT
+func (p *JWTProvider) ValidateCredentials(_ context.Context, r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errNoCredentials
+	}
+	claims, err := verifyJWT(token, func(alg string, _ string) (interface{}, error) {
+		if strings.HasPrefix(alg, "HS") && p.cfg.Secret != "" {
+			return []byte(p.cfg.Secret), nil
+		}
+		if alg == "RS256" && p.publicKey != nil {
+			return p.publicKey, nil
+		}
+		return nil, errNoCredentials
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims.identity("jwt", p.cfg.Issuer, p.cfg.Audience, p.cfg.ScopesClaim)
+}
+
+// OIDCProvider 使用 OIDC 签发方发布的 JWKS 校验 ID Token / Access Token
+type OIDCProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewOIDCProvider 创建 OIDC 认证提供者，公钥在首次使用时获取并每小时刷新
+func NewOIDCProvider(cfg OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ValidateCredentials 校验 Bearer JWT
+func (p *OIDCProvider) ValidateCredentials(ctx context.Context, r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errNoCredentials
+	}
+	claims, err := verifyJWT(token, func(alg string, kid string) (interface{}, error) {
+		if alg != "RS256" {
+			return nil, errInvalidCredentials
+		}
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims.identity("oidc", p.cfg.Issuer, p.cfg.Audience, p.cfg.ScopesClaim)
+}
+
+// key 返回 kid 对应的公钥，未知的 kid 会触发刷新以支持签发方轮换密钥
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[kid]
+	if ok && time.Since(p.fetchedAt) < time.Hour {
+		return key, nil
+	}
+	// 限制刷新频率，避免伪造的 kid 导致频繁请求签发方
+	if time.Since(p.fetchedAt) < time.Minute && p.keys != nil {
+		if ok {
+			return key, nil
+		}
+		return nil, errInvalidCredentials
+	}
+
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	p.fetchedAt = time.Now()
+	key, ok = p.keys[kid]
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+	return key, nil
+}
+
+// fetchKeys 通过 OIDC 发现文档获取签发方的 JWKS
+func (p *OIDCProvider) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	err := p.getJSON(ctx, strings.TrimRight(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err = p.getJSON(ctx, discovery.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("获取 %s 失败: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
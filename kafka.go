@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Kafka 协议中用到的请求，使用 Kafka 1.0 起支持且 4.0 仍然支持的版本
+const (
+	kafkaProduceKey      = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadataKey     = 3
+	kafkaMetadataVersion = 4
+)
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaPublisher 通过 Kafka 协议发布事件，以路径为 key，分区的选择与 Java 客户端的默认分区器相同，
+// 同一路径的事件总是进入同一分区，保持顺序
+type kafkaPublisher struct {
+	config  EventBusConfig
+	timeout time.Duration
+
+	correlationID int32
+	// brokers 为 broker ID 对应的地址，leaders 为每个分区的 leader，元数据过期时清空
+	brokers map[int32]string
+	leaders []int32
+	conns   map[int32]net.Conn
+}
+
+func newKafkaPublisher(config EventBusConfig) *kafkaPublisher {
+	return &kafkaPublisher{
+		config:  config,
+		timeout: time.Duration(config.Timeout) * time.Second,
+		conns:   map[int32]net.Conn{},
+	}
+}
+
+// kafkaWriter 按 Kafka 协议的格式编码请求
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.WriteByte(byte(v)) }
+func (w *kafkaWriter) int16(v int16) { _ = binary.Write(w, binary.BigEndian, v) }
+func (w *kafkaWriter) int32(v int32) { _ = binary.Write(w, binary.BigEndian, v) }
+func (w *kafkaWriter) int64(v int64) { _ = binary.Write(w, binary.BigEndian, v) }
+
+func (w *kafkaWriter) string(v string) {
+	w.int16(int16(len(v)))
+	w.WriteString(v)
+}
+
+// varint 写入 zigzag 编码的变长整数，用于 record 中的字段
+func (w *kafkaWriter) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+// kafkaReader 按 Kafka 协议的格式解码响应，数据不足时记录错误并返回零值
+type kafkaReader struct {
+	data []byte
+	err  error
+}
+
+func (r *kafkaReader) take(n int) []byte {
+	if r.err != nil || n < 0 || len(r.data) < n {
+		r.err = errors.New("Kafka 响应格式错误")
+		return make([]byte, n&0xffff)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.take(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.take(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.take(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.take(8))) }
+
+func (r *kafkaReader) string() string {
+	n := int(r.int16())
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(n))
+}
+
+// count 读取数组的长度，长度不合理时记录错误
+func (r *kafkaReader) count() int {
+	n := int(r.int32())
+	if n < 0 || n > len(r.data) {
+		if n != -1 {
+			r.err = errors.New("Kafka 响应格式错误")
+		}
+		return 0
+	}
+	return n
+}
+
+// kafkaMurmur2 与 Java 客户端的 Utils.murmur2 相同
+func kafkaMurmur2(data []byte) int32 {
+	const seed uint32 = 0x9747b28c
+	const m uint32 = 0x5bd1e995
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// dial 连接 broker，配置了 TLS 时使用 TLS
+func (p *kafkaPublisher) dial(address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	if p.config.TLS {
+		host, _, _ := net.SplitHostPort(address)
+		return tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: host})
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// roundTrip 发送请求并读取响应体
+func (p *kafkaPublisher) roundTrip(conn net.Conn, apiKey int16, apiVersion int16, body []byte) (*kafkaReader, error) {
+	p.correlationID++
+	var request kafkaWriter
+	request.int32(0)
+	request.int16(apiKey)
+	request.int16(apiVersion)
+	request.int32(p.correlationID)
+	request.string("store_go")
+	request.Write(body)
+	data := request.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+
+	_ = conn.SetDeadline(time.Now().Add(p.timeout))
+	_, err := conn.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	_, err = io.ReadFull(conn, size[:])
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint32(size[:]))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, err
+	}
+	reader := &kafkaReader{data: response}
+	if reader.int32() != p.correlationID {
+		return nil, errors.New("Kafka 响应的 correlation ID 不匹配")
+	}
+	return reader, reader.err
+}
+
+// refreshMetadata 依次向配置的 broker 查询 topic 的分区和 leader
+func (p *kafkaPublisher) refreshMetadata() error {
+	var body kafkaWriter
+	body.int32(1)
+	body.string(p.config.Topic)
+	// allow_auto_topic_creation，topic 需要预先创建
+	body.int8(0)
+
+	var lastErr error
+	for _, server := range p.config.Servers {
+		conn, err := p.dial(server)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", server, err)
+			continue
+		}
+		reader, err := p.roundTrip(conn, kafkaMetadataKey, kafkaMetadataVersion, body.Bytes())
+		_ = conn.Close()
+		if err == nil {
+			err = p.parseMetadata(reader)
+		}
+		if err == nil {
+			return nil
+		}
+		lastErr = fmt.Errorf("%s: %w", server, err)
+	}
+	return lastErr
+}
+
+func (p *kafkaPublisher) parseMetadata(r *kafkaReader) error {
+	r.int32() // throttle_time_ms
+	brokers := map[int32]string{}
+	for i, n := 0, r.count(); i < n; i++ {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		if rack := int(r.int16()); rack > 0 {
+			r.take(rack)
+		}
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	if clusterID := int(r.int16()); clusterID > 0 {
+		r.take(clusterID)
+	}
+	r.int32() // controller_id
+	var leaders []int32
+	for i, n := 0, r.count(); i < n; i++ {
+		errorCode := r.int16()
+		name := r.string()
+		r.int8() // is_internal
+		partitions := map[int32]int32{}
+		for j, m := 0, r.count(); j < m; j++ {
+			r.int16() // 分区的 error_code，leader 不可用时 leader 为 -1
+			partition := r.int32()
+			partitions[partition] = r.int32()
+			for k, l := 0, r.count(); k < l; k++ {
+				r.int32()
+			}
+			for k, l := 0, r.count(); k < l; k++ {
+				r.int32()
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+		if name != p.config.Topic {
+			continue
+		}
+		if errorCode != 0 {
+			return fmt.Errorf("topic %s 的元数据错误码 %d", name, errorCode)
+		}
+		leaders = make([]int32, len(partitions))
+		for partition, leader := range partitions {
+			if int(partition) >= len(leaders) || leader < 0 {
+				return fmt.Errorf("topic %s 的分区 %d 没有 leader", name, partition)
+			}
+			leaders[partition] = leader
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("topic %s 不存在", p.config.Topic)
+	}
+	p.brokers = brokers
+	p.leaders = leaders
+	return nil
+}
+
+// recordBatch 将事件编码为 v2 格式的 record batch
+func (p *kafkaPublisher) recordBatch(events []BusEvent) ([]byte, error) {
+	now := time.Now().UnixMilli()
+	var records kafkaWriter
+	for i, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		var record kafkaWriter
+		record.int8(0) // attributes
+		record.varint(0)
+		record.varint(int64(i))
+		record.varint(int64(len(event.Path)))
+		record.WriteString(event.Path)
+		record.varint(int64(len(value)))
+		record.Write(value)
+		record.varint(0) // headers
+		records.varint(int64(record.Len()))
+		records.Write(record.Bytes())
+	}
+
+	// attributes 之后的部分计算 CRC-32C
+	var tail kafkaWriter
+	tail.int16(0) // attributes，不压缩
+	tail.int32(int32(len(events) - 1))
+	tail.int64(now)
+	tail.int64(now)
+	tail.int64(-1) // producer_id
+	tail.int16(-1) // producer_epoch
+	tail.int32(-1) // base_sequence
+	tail.int32(int32(len(events)))
+	tail.Write(records.Bytes())
+
+	var batch kafkaWriter
+	batch.int64(0) // base_offset
+	batch.int32(int32(4 + 1 + 4 + tail.Len()))
+	batch.int32(-1) // partition_leader_epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(tail.Bytes(), kafkaCRCTable)))
+	batch.Write(tail.Bytes())
+	return batch.Bytes(), nil
+}
+
+// produce 将各分区的事件发送到同一个 leader
+func (p *kafkaPublisher) produce(leader int32, partitions map[int32][]BusEvent) error {
+	conn, ok := p.conns[leader]
+	if !ok {
+		address, ok := p.brokers[leader]
+		if !ok {
+			return fmt.Errorf("未知的 broker %d", leader)
+		}
+		var err error
+		conn, err = p.dial(address)
+		if err != nil {
+			return err
+		}
+		p.conns[leader] = conn
+	}
+
+	var body kafkaWriter
+	body.int16(-1) // transactional_id
+	body.int16(int16(p.config.Acks))
+	body.int32(int32(p.timeout.Milliseconds()))
+	body.int32(1)
+	body.string(p.config.Topic)
+	body.int32(int32(len(partitions)))
+	for partition, events := range partitions {
+		batch, err := p.recordBatch(events)
+		if err != nil {
+			return err
+		}
+		body.int32(partition)
+		body.int32(int32(len(batch)))
+		body.Write(batch)
+	}
+	r, err := p.roundTrip(conn, kafkaProduceKey, kafkaProduceVersion, body.Bytes())
+	if err != nil {
+		return err
+	}
+	for i, n := 0, r.count(); i < n; i++ {
+		r.string()
+		for j, m := 0, r.count(); j < m; j++ {
+			partition := r.int32()
+			errorCode := r.int16()
+			r.int64() // base_offset
+			r.int64() // log_append_time
+			if r.err == nil && errorCode != 0 {
+				return fmt.Errorf("分区 %d 写入失败，错误码 %d", partition, errorCode)
+			}
+		}
+	}
+	return r.err
+}
+
+func (p *kafkaPublisher) Publish(events []BusEvent) error {
+	if p.leaders == nil {
+		err := p.refreshMetadata()
+		if err != nil {
+			return err
+		}
+	}
+	// 按 leader 和分区分组，同一分区中的事件保持原来的顺序
+	groups := map[int32]map[int32][]BusEvent{}
+	for _, event := range events {
+		partition := (kafkaMurmur2([]byte(event.Path)) & 0x7fffffff) % int32(len(p.leaders))
+		leader := p.leaders[partition]
+		if groups[leader] == nil {
+			groups[leader] = map[int32][]BusEvent{}
+		}
+		groups[leader][partition] = append(groups[leader][partition], event)
+	}
+	for leader, partitions := range groups {
+		err := p.produce(leader, partitions)
+		if err != nil {
+			// leader 可能已经变化，下次重新获取元数据；已写入的分区重试时会重复，消费方按事件 ID 去重
+			p.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *kafkaPublisher) Close() {
+	for id, conn := range p.conns {
+		_ = conn.Close()
+		delete(p.conns, id)
+	}
+	p.leaders = nil
+}
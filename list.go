@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// applyListOptions 按请求中的条件对目录条目进行过滤、排序和分页，返回当前页和过滤后的总数
+func applyListOptions(entries []ListEntry, listRequest ListRequest) ([]ListEntry, int, error) {
+	entries, err := filterListEntries(entries, listRequest)
+	if err != nil {
+		return nil, 0, err
+	}
+	page, total := paginateListEntries(entries, listRequest)
+	return page, total, nil
+}
+
+// filterListEntries 按请求中的条件对目录条目进行过滤和排序
+func filterListEntries(entries []ListEntry, listRequest ListRequest) ([]ListEntry, error) {
+	// 按名称过滤
+	if listRequest.Pattern != "" {
+		var matched []ListEntry
+		for _, entry := range entries {
+			ok, err := path.Match(listRequest.Pattern, entry.Name)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched = append(matched, entry)
+			}
+		}
+		entries = matched
+	}
+
+	// 排序，目录始终排在文件前面
+	var less func(a, b ListEntry) bool
+	switch listRequest.Sort {
+	case "size":
+		less = func(a, b ListEntry) bool { return a.Size < b.Size }
+	case "mtime":
+		less = func(a, b ListEntry) bool { return a.Date.Before(b.Date) }
+	default:
+		less = func(a, b ListEntry) bool { return entryName(a) < entryName(b) }
+	}
+	desc := strings.EqualFold(listRequest.Order, "desc")
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		if desc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+	return entries, nil
+}
+
+// paginateListEntries 按请求中的 offset 和 limit 取出当前页，返回当前页和总数
+func paginateListEntries(entries []ListEntry, listRequest ListRequest) ([]ListEntry, int) {
+	total := len(entries)
+	offset := listRequest.Offset
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if listRequest.Limit > 0 && offset+listRequest.Limit < total {
+		end = offset + listRequest.Limit
+	}
+	return entries[offset:end], total
+}
+
+// entryName 返回用于排序的名称，递归列出时使用相对路径
+func entryName(entry ListEntry) string {
+	if entry.Path != "" {
+		return entry.Path
+	}
+	return entry.Name
+}
+
+// sendListPage 对目录条目进行过滤、排序和分页后发送响应，请求 snapshot 时保存过滤和排序后的结果；cursor 为列出之前的变更游标
+func sendListPage(w http.ResponseWriter, r *http.Request, listRequest ListRequest, entries []ListEntry, cursor string) {
+	// 过滤和排序
+	entries, err := filterListEntries(entries, listRequest)
+	if err != nil {
+		sendListResponse(w, http.StatusBadRequest, "无效的匹配模式", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, err, r.URL.Path)
+		return
+	}
+
+	// 需要一致性列表时保存过滤和排序后的结果，之后的分页请求从快照中读取
+	var snapshotToken string
+	var snapshotAt *time.Time
+	if listRequest.Snapshot {
+		token, createdAt, err := listSnapshots.Create(indexKey(listRequest.Path), listRequest.Recursive, entries)
+		if err != nil {
+			sendListResponse(w, http.StatusInternalServerError, "无法创建快照", ListResponse{
+				Status:  0,
+				Content: []ListEntry{},
+			}, err, r.URL.Path)
+			return
+		}
+		snapshotToken, snapshotAt = token, &createdAt
+	}
+
+	// 分页
+	entries, total := paginateListEntries(entries, listRequest)
+	if entries == nil {
+		entries = []ListEntry{}
+	}
+
+	// 构建响应
+	response := ListResponse{
+		Status:        1,
+		Message:       "success",
+		Content:       entries,
+		Total:         total,
+		SnapshotToken: snapshotToken,
+		SnapshotAt:    snapshotAt,
+		Cursor:        cursor,
+		Fields:        listRequest.Fields,
+	}
+
+	// 发送响应
+	sendListResponse(w, http.StatusOK, "success", response, nil, r.URL.Path)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultListen 是未配置 listen 时公共 API 监听的地址
+const defaultListen = "0.0.0.0:8082"
+
+// serverTLS 为配置了 tls 时 TCP 监听器使用的 TLS 配置，未配置时为 nil
+var serverTLS *tls.Config
+
+// listen 根据地址创建监听器，地址以 unix: 开头时监听 unix socket，否则配置了 tls 时使用 TLS
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		socket := strings.TrimPrefix(address, "unix:")
+		// 清理上次运行遗留的 socket 文件
+		err := os.Remove(socket)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", socket)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil || serverTLS == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, serverTLS), nil
+}
+
+// serveAdmin 在独立的监听器上提供管理接口，返回的服务在停止时与公共 API 一起关闭，监听失败时返回 nil
+func serveAdmin(address string, handler http.Handler) *http.Server {
+	listener, err := listen(address)
+	if err != nil {
+		slog.Error("管理接口监听失败", "err", err)
+		return nil
+	}
+	slog.Info("管理接口监听", "address", address)
+	server := &http.Server{Handler: handler}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("管理接口服务失败", "err", err)
+		}
+	}()
+	return server
+}
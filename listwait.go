@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listWatchHistory 为判断目录是否变化保留的最近变更数，游标早于最旧的变更时视为已变化
+const listWatchHistory = 1000
+
+// listChange 是一次文件变更的序号和路径
+type listChange struct {
+	seq  uint64
+	path string
+}
+
+// ListWatch 结构记录最近的文件变更，用于 /list 的条件请求和长轮询，不依赖 events 配置
+type ListWatch struct {
+	// epoch 为启动时间，作为游标的前缀，重启后之前的游标视为已变化
+	epoch string
+
+	mu      sync.Mutex
+	seq     uint64
+	history []listChange
+	// wake 在每次变更时关闭并替换，唤醒所有等待的请求
+	wake chan struct{}
+}
+
+// listWatch 总是启用，文件变更时由 ChangeFeed.Publish 通知
+var listWatch = &ListWatch{
+	epoch: strconv.FormatInt(time.Now().UnixMilli(), 10),
+	wake:  make(chan struct{}),
+}
+
+// Changed 记录路径的变更并唤醒等待的请求
+func (l *ListWatch) Changed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.history = append(l.history, listChange{seq: l.seq, path: key})
+	if len(l.history) > listWatchHistory {
+		l.history = l.history[len(l.history)-listWatchHistory:]
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// Cursor 返回当前的游标，列出目录之前获取，列出期间的变更在下一次请求时返回
+func (l *ListWatch) Cursor() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return fmt.Sprintf("%s-%d", l.epoch, l.seq)
+}
+
+// parseCursor 解析游标，来自之前的进程或晚于当前序号时返回 false
+func (l *ListWatch) parseCursor(cursor string) (uint64, bool, error) {
+	epoch, seqText, found := strings.Cut(cursor, "-")
+	seq, err := strconv.ParseUint(seqText, 10, 64)
+	if !found || err != nil {
+		return 0, false, errors.New("无效的 if_changed_since")
+	}
+	return seq, epoch == l.epoch && seq <= l.seq, nil
+}
+
+// changedSince 判断 seq 之后目录 dir 及其子目录中是否有变更，需要持有 mu；删除或恢复上级目录同样视为变更
+func (l *ListWatch) changedSince(dir string, seq uint64) bool {
+	if seq < l.seq && (len(l.history) == 0 || l.history[0].seq > seq+1) {
+		return true
+	}
+	for i := len(l.history) - 1; i >= 0 && l.history[i].seq > seq; i-- {
+		key := l.history[i].path
+		if dir == "" || key == dir || strings.HasPrefix(key, dir+"/") || strings.HasPrefix(dir, key+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait 等待目录在游标之后发生变更，最多等待 wait；返回目录是否已变化，游标无效时返回错误
+func (l *ListWatch) Wait(ctx context.Context, dir string, cursor string, wait time.Duration) (bool, error) {
+	l.mu.Lock()
+	seq, ok, err := l.parseCursor(cursor)
+	l.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return true, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		changed := l.changedSince(dir, seq)
+		wake := l.wake
+		l.mu.Unlock()
+		if changed {
+			return true, nil
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			return false, nil
+		case <-ctx.Done():
+			return false, nil
+		case <-stopping:
+			return false, nil
+		}
+	}
+}
+
+// parseListWait 解析查询参数 wait，支持 30s 等时长或秒数，超过 maxWait 时使用 maxWait
+func parseListWait(r *http.Request, maxWait time.Duration) (time.Duration, error) {
+	value := r.URL.Query().Get("wait")
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, errors.New("无效的 wait")
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, errors.New("无效的 wait")
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	return wait, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// LogConfig 结构用于配置运行日志的级别、格式和输出
+type LogConfig struct {
+	// Level 为 debug、info（默认）、warn 或 error
+	Level string `json:"level"`
+	// Format 为 text（默认）或 json
+	Format string `json:"format"`
+	// Output 为 stderr（默认）、stdout 或文件路径
+	Output string `json:"output"`
+	// Rotate 为输出到文件时的轮转配置
+	Rotate LogRotateConfig `json:"rotate"`
+}
+
+// setupLogging 按配置设置默认的 slog 日志，标准库 log 包的输出同样经过该日志
+func setupLogging(config LogConfig) error {
+	var level slog.Level
+	switch config.Level {
+	case "", "info":
+		level = slog.LevelInfo
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return fmt.Errorf("不支持的日志级别 %s，应为 debug、info、warn 或 error", config.Level)
+	}
+	var output io.Writer
+	switch config.Output {
+	case "", "stderr":
+		output = os.Stderr
+	case "stdout":
+		output = os.Stdout
+	default:
+		file, err := OpenRotatingFile(config.Output, config.Rotate)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch config.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(output, options)
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	default:
+		return fmt.Errorf("不支持的日志格式 %s，应为 text 或 json", config.Format)
+	}
+	slog.SetDefault(slog.New(requestLogHandler{handler}))
+	return nil
+}
+
+// requestLogFields 是请求处理期间写入日志的字段，调用方在认证之后补充
+type requestLogFields struct {
+	ID       string
+	Method   string
+	Path     string
+	Identity string
+	// TraceID 为启用追踪且被采样时的追踪 ID
+	TraceID string
+}
+
+// requestLogKey 是请求上下文中保存日志字段的键
+type requestLogKey struct{}
+
+// requestLogHandler 为带有请求上下文的日志加上请求 ID、方法、路径和调用方，便于与访问日志和审计日志关联
+type requestLogHandler struct {
+	slog.Handler
+}
+
+func (h requestLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if fields, ok := ctx.Value(requestLogKey{}).(*requestLogFields); ok {
+		record.AddAttrs(slog.String("request_id", fields.ID), slog.String("method", fields.Method), slog.String("path", fields.Path))
+		if fields.Identity != "" {
+			record.AddAttrs(slog.String("identity", fields.Identity))
+		}
+		if fields.TraceID != "" {
+			record.AddAttrs(slog.String("trace_id", fields.TraceID))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestLogHandler) WithGroup(name string) slog.Handler {
+	return requestLogHandler{h.Handler.WithGroup(name)}
+}
+
+// validRequestID 判断客户端或上游代理提供的请求 ID 是否可以直接使用
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDMiddleware 为每个请求分配请求 ID，通过 X-Request-Id 响应头返回；请求带有合法的 X-Request-Id 时沿用
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			buf := make([]byte, 8)
+			_, _ = rand.Read(buf)
+			id = hex.EncodeToString(buf)
+		}
+		w.Header().Set("X-Request-Id", id)
+		fields := &requestLogFields{ID: id, Method: r.Method, Path: r.URL.Path}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, fields)))
+	})
+}
+
+// logIdentity 在请求的日志字段中标记通过认证的调用方
+func logIdentity(r *http.Request, identity *Identity) {
+	if fields, ok := r.Context().Value(requestLogKey{}).(*requestLogFields); ok {
+		fields.Identity = identity.Name
+	}
+}
+
+// requestID 返回请求的 ID，未经过 RequestIDMiddleware 时为空
+func requestID(r *http.Request) string {
+	if fields, ok := r.Context().Value(requestLogKey{}).(*requestLogFields); ok {
+		return fields.ID
+	}
+	return ""
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// logRotateTimeLayout 是轮转后文件名中的时间，按文件名排序即按时间排序
+const logRotateTimeLayout = "20060102T150405.000000000"
+
+// LogRotateConfig 结构用于配置日志文件的轮转，不需要另外配置 logrotate
+type LogRotateConfig struct {
+	// MaxSize 单个文件的大小上限（MB），超过时轮转，0 表示不按大小轮转
+	MaxSize int64 `json:"max_size"`
+	// MaxAge 单个文件写入的天数上限，超过时轮转，如 1 表示每天轮转，0 表示不按时间轮转
+	MaxAge int `json:"max_age"`
+	// MaxBackups 保留的轮转文件个数，超过时删除最旧的，0 表示全部保留
+	MaxBackups int `json:"max_backups"`
+	// Compress 为 true 时用 gzip 压缩轮转后的文件
+	Compress bool `json:"compress"`
+}
+
+// RotatingFile 结构是按大小和时间轮转的日志文件，轮转后的文件名为 <名称>-<轮转时间><扩展名>
+type RotatingFile struct {
+	mu     sync.Mutex
+	path   string
+	config LogRotateConfig
+	file   *os.File
+	size   int64
+	// openedAt 为当前文件开始写入的时间，用于按时间轮转
+	openedAt time.Time
+
+	// cleanup 使压缩和清理串行执行，避免两次轮转同时处理同一个文件
+	cleanup sync.Mutex
+}
+
+// OpenRotatingFile 以追加方式打开日志文件，收到 SIGHUP 时重新打开，外部的 logrotate 移走文件后继续写入新的文件
+func OpenRotatingFile(path string, config LogRotateConfig) (*RotatingFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return nil, err
+	}
+	f := &RotatingFile{path: path, config: config}
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+	// 重启后从上一次轮转的时间开始计算，频繁重启时仍然按时间轮转
+	f.openedAt = time.Now()
+	if backups := f.backups(); len(backups) > 0 {
+		if rotatedAt, ok := f.rotatedAt(backups[len(backups)-1]); ok {
+			f.openedAt = rotatedAt
+		}
+	}
+	// 处理上次退出前没有压缩或清理的文件
+	go f.compressAndPrune()
+	go f.reopenOnHangup()
+	return f, nil
+}
+
+// open 打开当前的日志文件，需要持有 mu 或在初始化时调用
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// due 判断写入 n 字节之前是否需要轮转，空文件不轮转
+func (f *RotatingFile) due(n int, now time.Time) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.config.MaxSize > 0 && f.size+int64(n) > f.config.MaxSize<<20 {
+		return true
+	}
+	return f.config.MaxAge > 0 && now.Sub(f.openedAt) >= time.Duration(f.config.MaxAge)*24*time.Hour
+}
+
+// rotate 将当前文件改名为带时间的文件并打开新的文件，需要持有 mu
+func (f *RotatingFile) rotate(now time.Time) error {
+	_ = f.file.Close()
+	f.file = nil
+	ext := filepath.Ext(f.path)
+	rotated := strings.TrimSuffix(f.path, ext) + "-" + now.UTC().Format(logRotateTimeLayout) + ext
+	err := os.Rename(f.path, rotated)
+	if err != nil {
+		return err
+	}
+	f.openedAt = now
+	go f.compressAndPrune()
+	return f.open()
+}
+
+// Write 写入一条日志，需要时先轮转；轮转失败时继续写入原来的文件
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.file != nil && f.due(len(p), now) {
+		_ = f.rotate(now)
+	}
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen 关闭并重新打开日志文件
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		_ = f.file.Close()
+		f.file = nil
+	}
+	f.openedAt = time.Now()
+	return f.open()
+}
+
+// reopenOnHangup 在收到 SIGHUP 时重新打开日志文件
+func (f *RotatingFile) reopenOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		err := f.Reopen()
+		if err != nil {
+			slog.Error("重新打开日志文件失败", "path", f.path, "err", err)
+			continue
+		}
+		slog.Info("已重新打开日志文件", "path", f.path)
+	}
+}
+
+// backups 返回轮转后的文件，按轮转时间从旧到新排列
+func (f *RotatingFile) backups() []string {
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		name := filepath.Join(filepath.Dir(f.path), entry.Name())
+		if _, ok := f.rotatedAt(name); ok && !entry.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rotatedAt 解析轮转后的文件名中的时间，不是该日志轮转后的文件时返回 false
+func (f *RotatingFile) rotatedAt(name string) (time.Time, bool) {
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(f.path, ext) + "-"
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, false
+	}
+	stamp := strings.TrimPrefix(name, prefix)
+	stamp = strings.TrimSuffix(stamp, ".gz")
+	if !strings.HasSuffix(stamp, ext) {
+		return time.Time{}, false
+	}
+	rotatedAt, err := time.Parse(logRotateTimeLayout, strings.TrimSuffix(stamp, ext))
+	return rotatedAt, err == nil
+}
+
+// compressAndPrune 压缩轮转后的文件，并删除超过保留个数的最旧的文件
+func (f *RotatingFile) compressAndPrune() {
+	f.cleanup.Lock()
+	defer f.cleanup.Unlock()
+	if f.config.Compress {
+		for _, name := range f.backups() {
+			if strings.HasSuffix(name, ".gz") {
+				continue
+			}
+			err := compressLogFile(name)
+			if err != nil {
+				slog.Error("压缩日志文件失败", "path", name, "err", err)
+			}
+		}
+	}
+	if f.config.MaxBackups <= 0 {
+		return
+	}
+	backups := f.backups()
+	for len(backups) > f.config.MaxBackups {
+		err := os.Remove(backups[0])
+		if err != nil {
+			slog.Error("删除日志文件失败", "path", backups[0], "err", err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// compressLogFile 将文件压缩为 <文件名>.gz 后删除原文件，压缩完成之前原文件保持不变
+func compressLogFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func(src *os.File) {
+		_ = src.Close()
+	}(src)
+	tmp := name + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(name)
+}
@@ -1,212 +1,912 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"mime/multipart"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+var (
+	// metaIndex 是文件元数据索引，未启用相关功能时为 nil
+	metaIndex *MetaIndex
+	// accessTracker 记录文件访问时间，未启用时为 nil
+	accessTracker *AccessTracker
+	// indexScanner 在后台建立索引，未启用索引时为 nil
+	indexScanner *IndexScanner
+	// contentIndex 是全文搜索索引，未启用时为 nil
+	contentIndex *ContentIndex
+	// maintenanceGate 判断当前是否处于维护窗口
+	maintenanceGate *MaintenanceGate
+)
+
 func main() {
+	// 带参数运行时执行子命令
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	// 检查当前目录下是否有 data 目录
 	_, err := os.Stat("data")
 	if os.IsNotExist(err) {
 		// 不存在，创建 data 目录
 		err := os.MkdirAll("data", os.ModePerm)
 		if err != nil {
-			log.Printf("Error: 无法创建 data 目录 %s\n", err)
+			slog.Error("无法创建 data 目录", "err", err)
 		}
 	} else if err != nil {
 		// 其他错误
-		log.Printf("Error: 无法获取 data 目录信息 %s\n", err)
+		slog.Error("无法获取 data 目录信息", "err", err)
+	}
+
+	// 清理上次运行留下的临时文件
+	err = prepareTempDir()
+	if err != nil {
+		slog.Error("无法准备临时目录", "err", err)
+		return
 	}
-	http.HandleFunc("/get/", getFileHandler)
 
 	// 读取配置文件中的 token
 	config, err := LoadConfig()
 	if err != nil {
-		log.Printf("Error loading config: %s\n", err)
+		slog.Error("加载配置失败", "err", err)
+		return
+	}
+	err = setupLogging(config.Log)
+	if err != nil {
+		slog.Error("日志配置错误", "err", err)
 		return
 	}
+	// 路径锁在启动任何后台任务之前创建，回收站清理、延迟删除等后台任务同样使用
+	pathLocks = NewPathLocks(config.Upload)
 
-	// 如果需要拦截的接口，应用 TokenMiddleware 中间件
-	http.Handle("/list", TokenMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		listHandler(w, r)
-	}), config.Token))
+	// 启用静态加密时写入的文件内容加密保存，读取时透明解密
+	if config.Encryption.Enabled {
+		encryptor, err = NewEncryptor(config.Encryption)
+		if err != nil {
+			slog.Error("无法启用静态加密", "err", err)
+			return
+		}
+	}
 
-	http.Handle("/upload", TokenMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		uploadHandler(w, r)
-	}), config.Token))
+	// 启用透明压缩时写入的文件先压缩再加密，读取时透明解压
+	if config.Compression.Enabled {
+		compressor, err = NewCompressor(config.Compression)
+		if err != nil {
+			slog.Error("无法启用透明压缩", "err", err)
+			return
+		}
+	}
 
-	http.Handle("/delete", TokenMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		deleteHandler(w, r)
-	}), config.Token))
+	// 管理接口（监控、调试等）注册在 adminMux 上，未配置独立监听地址时与公共 API 共用
+	adminMux := http.DefaultServeMux
+	if config.AdminListen != "" {
+		adminMux = http.NewServeMux()
+	}
 
-	err = http.ListenAndServe("0.0.0.0:8082", nil)
-	if err != nil {
-		log.Printf("Error: 服务启动失败 %s\n", err)
+	// 启用索引或访问时间记录时加载索引
+	if config.Index.Enabled || config.AccessTime.Enabled || config.Quota.Enabled || config.Verify.Enabled || config.StorageClass.Enabled {
+		metaIndex, err = OpenMetaIndex(filepath.Join("data", metaDirName, "index.json"), config.Index)
+		if err != nil {
+			slog.Error("无法加载索引", "err", err)
+			return
+		}
+		go metaIndex.Run(5 * time.Second)
+		onShutdown("index", metaIndex.Save)
 	}
-}
 
-// Config 结构用于解析配置文件中的 JSON 数据
-type Config struct {
-	Token string `json:"token"`
-}
+	// 启用索引时在后台扫描已有数据，不阻塞启动
+	if config.Index.Enabled {
+		indexScanner, err = NewIndexScanner(metaIndex, filepath.Join("data", metaDirName, "scan.json"), config.Index)
+		if err != nil {
+			slog.Error("无法加载索引扫描进度", "err", err)
+			return
+		}
+		go indexScanner.Run()
+		if config.Index.Watch {
+			go watchIndex(metaIndex, config.Index)
+		}
+		if config.Index.ReconcileInterval > 0 {
+			go reconcileIndex(metaIndex, indexScanner, time.Duration(config.Index.ReconcileInterval)*time.Second)
+		}
+	}
 
-// LoadConfig 从配置文件中加载配置信息
-func LoadConfig() (Config, error) {
-	var config Config
+	// 从备份恢复后启用读取时校验，以索引中记录的哈希为准
+	if config.Verify.Enabled {
+		readVerifier = NewReadVerifier(config.Verify)
+	}
 
-	// 读取配置文件
-	data, err := os.ReadFile("config.json")
+	// 启用存储配额时按索引中记录的上传者统计用量
+	if config.Quota.Enabled {
+		quotaTracker = NewQuotaTracker(config.Quota, metaIndex)
+	}
+
+	// 启用访问时间记录时定期批量写入索引
+	if config.AccessTime.Enabled {
+		accessTracker = NewAccessTracker(metaIndex, config.AccessTime)
+		interval := time.Duration(config.AccessTime.FlushInterval) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		go accessTracker.Run(interval)
+		onShutdown("access_time", func() error {
+			accessTracker.Flush()
+			return nil
+		})
+	}
+
+	// 启用全文搜索时加载索引
+	if config.ContentSearch.Enabled {
+		contentIndex, err = OpenContentIndex(filepath.Join("data", metaDirName, "content.json"), config.ContentSearch)
+		if err != nil {
+			slog.Error("无法加载全文索引", "err", err)
+			return
+		}
+		go contentIndex.Run(5 * time.Second)
+		onShutdown("content_search", contentIndex.Save)
+	}
+
+	shareStore, err = OpenShareStore(filepath.Join("data", metaDirName, "shares.json"))
 	if err != nil {
-		return config, err
+		slog.Error("无法加载分享", "err", err)
+		return
 	}
+	go shareStore.Run(5 * time.Second)
+	onShutdown("shares", shareStore.Save)
 
-	// 解析 JSON 数据
-	err = json.Unmarshal(data, &config)
+	// 删除的文件先移入回收站，超过保留时间后自动清除
+	if !config.Trash.Disabled {
+		trash, err = OpenTrash(filepath.Join("data", metaDirName, "trash.json"), config.Trash)
+		if err != nil {
+			slog.Error("无法加载回收站", "err", err)
+			return
+		}
+		go trash.Run()
+	}
+
+	// 配置了撤销时间时删除在到期后执行
+	deferredDeletes, err = OpenDeferredDeletes(filepath.Join("data", metaDirName, "undo.json"), config.Undo)
 	if err != nil {
-		return config, err
+		slog.Error("无法加载等待执行的删除", "err", err)
+		return
+	}
+	if deferredDeletes != nil {
+		go deferredDeletes.Run()
 	}
 
-	return config, nil
-}
+	// 启用 .part 约定时上传到 name.part 的文件先暂存，完成后才保存为 name
+	partialUploads, err = OpenPartialUploads(filepath.Join("data", metaDirName, "partial"), filepath.Join("data", metaDirName, "partial.json"), config.Upload.Partial)
+	if err != nil {
+		slog.Error("无法加载暂存文件", "err", err)
+		return
+	}
+	if partialUploads != nil {
+		go partialUploads.Run()
+	}
 
-// TokenMiddleware 是用于检查请求头中 token 的中间件
-func TokenMiddleware(next http.Handler, validToken string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// 从请求头中获取 token
-		token := r.Header.Get("Authorization")
+	// 覆盖上传时保留历史版本
+	if config.Versioning.Enabled {
+		versioning = NewVersioning(config.Versioning)
+	}
 
-		// 检查 token 是否有效
-		if token != validToken {
-			// 返回错误响应
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+	// 启用去重时相同内容的文件只保存一份
+	if config.Dedup.Enabled {
+		blobStore, err = NewBlobStore(config.Dedup)
+		if err != nil {
+			slog.Error("无法启用去重", "err", err)
 			return
 		}
+		go blobStore.Run()
+	}
 
-		// 如果 token 有效，调用下一个处理程序
-		next.ServeHTTP(w, r)
-	})
-}
+	// 运行时设置通过管理接口修改，保存在 data 目录中，config.json 中的同名配置只作为初始值
+	settingDefaults := map[string]any{}
+	if config.RateLimit.RequestsPerSecond > 0 || len(config.RateLimit.Tenants) > 0 {
+		settingDefaults[settingRateLimit] = &config.RateLimit
+	}
+	runtimeSettings, err = OpenSettings(filepath.Join("data", metaDirName, "settings.json"), settingDefaults)
+	if err != nil {
+		slog.Error("无法加载运行时设置", "err", err)
+		return
+	}
 
-// 获取文件
-func getFileHandler(w http.ResponseWriter, r *http.Request) {
-	filePath := r.URL.Path[len("/get/"):]
-	fullPath := filepath.Join("data", filePath)
+	// 功能开关将历史版本、去重、静态加密和缩略图限制在部分路径和调用方上，用于灰度上线
+	featureFlags, err = NewFeatureFlags(config.Features, runtimeSettings, filepath.Join("data", metaDirName, "features.json"))
+	if err != nil {
+		slog.Error("功能开关配置错误", "err", err)
+		return
+	}
 
-	// 检查路径是否是文件夹
-	fileInfo, err := os.Stat(fullPath)
+	// 启用存储类型时由后台任务按存储类型移动文件和同步副本
+	if config.StorageClass.Enabled {
+		storageClasses, err = NewStorageClasses(config.StorageClass)
+		if err != nil {
+			slog.Error("无法启用存储类型", "err", err)
+			return
+		}
+		go storageClasses.Run()
+	}
+
+	// 配置输出目录时定期导出文件清单
+	inventory = NewInventory(config.Inventory)
+	if inventory != nil {
+		go inventory.Run()
+	}
+
+	// 备份快照只在创建硬链接期间短暂暂停写操作，配置了间隔时定期创建
+	backups, err = NewBackups(config.Backup)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// 文件不存在，记录日志并返回 JSON 提示未找到
-			sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", err, r.URL.Path)
+		slog.Error("备份配置错误", "err", err)
+		return
+	}
+	if config.Backup.Interval > 0 {
+		go backups.Run()
+	}
+
+	// 上传回执使用独立的 Ed25519 私钥签名，审计方通过公钥校验
+	if config.Receipt.Enabled {
+		receiptSigner, err = NewReceiptSigner(config.Receipt, filepath.Join("data", metaDirName, "receipt_key.pem"))
+		if err != nil {
+			slog.Error("无法启用上传回执", "err", err)
+			return
+		}
+	}
+
+	// 按调用方和分享链接记录出口流量，供计费导出
+	if config.Egress.Enabled {
+		egressAccounting, err = OpenEgressAccounting(filepath.Join("data", metaDirName, "egress.json"), config.Egress)
+		if err != nil {
+			slog.Error("无法加载出口流量", "err", err)
 			return
 		}
-		// 其他错误，记录日志并返回 JSON 提示服务器错误
-		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		go egressAccounting.Run(30 * time.Second)
+		onShutdown("egress", egressAccounting.Save)
+	}
+
+	// 配置了复制目标时将上传和删除异步推送到其他实例
+	replicator, err = OpenReplicator(filepath.Join("data", metaDirName, "replication.json"), config.Replication)
+	if err != nil {
+		slog.Error("无法加载复制积压", "err", err)
+		return
+	}
+	if replicator != nil {
+		go replicator.Run(time.Second)
+		onShutdown("replication", replicator.Save)
+	}
+
+	// 配置了 S3 镜像时将上传的文件异步复制到外部存储桶作为备份
+	s3Mirror, err = OpenS3Mirror(filepath.Join("data", metaDirName, "s3_mirror.json"), config.S3Mirror)
+	if err != nil {
+		slog.Error("无法启用 S3 镜像", "err", err)
 		return
 	}
+	if s3Mirror != nil {
+		go s3Mirror.Run(time.Second)
+		onShutdown("s3_mirror", s3Mirror.Save)
+	}
 
-	if fileInfo.IsDir() {
-		// 如果是文件夹，记录日志并返回 JSON 提示未找到
-		sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", err, r.URL.Path)
+	// 配置了 webhook 时将上传和删除事件发送给下游服务
+	webhooks, err = OpenWebhooks(filepath.Join("data", metaDirName, "webhooks.json"), config.Webhooks)
+	if err != nil {
+		slog.Error("无法加载 webhook 积压", "err", err)
 		return
 	}
+	if webhooks != nil {
+		go webhooks.Run(time.Second)
+		onShutdown("webhooks", webhooks.Save)
+	}
 
-	// 如果是文件，将文件流式返回
-	file, err := os.Open(fullPath)
+	// 配置了消息总线时将文件变更发布到 NATS 或 Kafka
+	eventBus, err = OpenEventBus(filepath.Join("data", metaDirName, "event_bus.json"), config.EventBus)
 	if err != nil {
-		// 文件打开失败，记录日志并返回 JSON 提示服务器错误
-		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		slog.Error("无法启用消息总线", "err", err)
 		return
 	}
-	defer func(file *os.File) {
-		err := file.Close()
+	if eventBus != nil {
+		go eventBus.Run(time.Second)
+		onShutdown("event_bus", eventBus.Save)
+	}
+
+	// 通过 /events 向界面和同步客户端实时推送文件变更
+	changeFeed = NewChangeFeed(config.Events)
+
+	// 发布目录按名称、版本和平台查找工具二进制
+	if config.Catalog.Enabled {
+		catalog, err = NewCatalog(config.Catalog, filepath.Join("data", metaDirName, "catalog_pins.json"))
 		if err != nil {
-			log.Printf("Error: closing file %s\n", err)
+			slog.Error("无法启用发布目录", "err", err)
+			return
 		}
-	}(file)
+	}
 
-	// 设置响应头
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileInfo.Name()))
+	// 一致性列表的快照
+	listSnapshots = NewListSnapshots(config.List)
 
-	// 将文件内容写入响应
-	http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), file)
-	log.Printf("info: %s \n", r.URL.Path)
-}
+	// 集群模式下按路径的一致性哈希将请求转发到所属的节点
+	cluster, err = OpenCluster(filepath.Join("data", metaDirName, "cluster.json"), config.Cluster, config.Search)
+	if err != nil {
+		slog.Error("无法加载集群成员列表", "err", err)
+		return
+	}
+	if cluster != nil {
+		go cluster.Run()
+	}
 
-// 获取上传的文件并存储
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	// 获取存储路径
-	path := r.Header.Get("X-FormFile-Path")
-	if path == "" {
-		sendJSONResponse(w, http.StatusBadRequest, "缺少存储路径", nil, r.URL.Path)
+	// 用内存中的布隆过滤器加速存在性检查
+	if config.ExistsFilter.Enabled {
+		existenceFilter = NewExistenceFilter(config.ExistsFilter)
+		go existenceFilter.Run()
+	}
+
+	// 通过 X-Expire-After 或 ttl 规则设置了保留时间的文件过期后由后台任务删除
+	fileExpiry, err = OpenFileExpiry(filepath.Join("data", metaDirName, "expiry.json"), config.TTL)
+	if err != nil {
+		slog.Error("无法加载文件过期时间", "err", err)
 		return
 	}
+	go fileExpiry.Run()
+	onShutdown("ttl", fileExpiry.Save)
 
-	// 获取上传的文件
-	file, _, err := r.FormFile("file")
+	// 配置了 GeoIP 数据库时在请求记录和下载统计中标记客户端的国家和 ASN
+	if config.GeoIP.CountryDB != "" || config.GeoIP.ASNDB != "" {
+		geoLocator, err = NewGeoLocator(config.GeoIP)
+		if err != nil {
+			slog.Error("GeoIP 配置错误", "err", err)
+			return
+		}
+		downloadStats = NewDownloadStats()
+	}
+
+	// 启用异常访问检测时按调用方统计下载、删除和认证失败的次数
+	if config.Anomaly.Enabled {
+		anomalyDetector, err = NewAnomalyDetector(config.Anomaly, filepath.Join("data", metaDirName, "suspensions.json"))
+		if err != nil {
+			slog.Error("无法加载暂停列表", "err", err)
+			return
+		}
+	}
+
+	// tus 断点续传的上传在完成之前暂存在 data/.meta/tus
+	tusUploads, err = OpenTusUploads(filepath.Join("data", metaDirName, "tus"), filepath.Join("data", metaDirName, "tus.json"), config.Upload)
 	if err != nil {
-		sendJSONResponse(w, http.StatusBadRequest, "接收文件失败", err, "")
+		slog.Error("无法加载 tus 上传", "err", err)
 		return
 	}
-	defer func(file multipart.File) {
-		err := file.Close()
+	if tusUploads != nil {
+		go tusUploads.Run()
+	}
+
+	if config.Chaos.Enabled {
+		chaos = NewChaosInjector(config.Chaos)
+	}
+
+	if config.VirusScan.Enabled {
+		virusScanner, err = NewVirusScanner(config.VirusScan)
 		if err != nil {
-			log.Printf("Error: closing file %s\n", err)
+			slog.Error("病毒扫描配置错误", "err", err)
+			return
+		}
+		if virusScanner.config.QuarantineDays > 0 {
+			go virusScanner.RunQuarantineCleanup()
 		}
-	}(file)
+	}
+
+	maintenanceGate, err = NewMaintenanceGate(config.Maintenance)
+	if err != nil {
+		slog.Error("维护窗口配置错误", "err", err)
+		return
+	}
+
+	if config.Health.Enabled {
+		backendHealth, err = NewBackendHealth(config.Health)
+		if err != nil {
+			slog.Error("健康检查配置错误", "err", err)
+			return
+		}
+		go backendHealth.Run()
+	}
+
+	imageCache = NewImageCache(config.Image.CacheMB)
+
+	// 配置了旧后端时进入双写迁移模式
+	migration, err = NewMigration(config.Migration)
+	if err != nil {
+		slog.Error("双写迁移配置错误", "err", err)
+		return
+	}
+	diskGuard = NewDiskGuard(config.DiskGuard, "data")
+	fileTypeFilter = NewFileTypeFilter(config.Upload.Types)
+	imageUploadValidator, err = NewImageUploadValidator(config.Upload.Images)
+	if err != nil {
+		slog.Error("图片目录配置错误", "err", err)
+		return
+	}
+
+	// 按目录配置的上传文件命名策略
+	uploadNaming, err = NewUploadNaming(config.Naming)
+	if err != nil {
+		slog.Error("命名策略配置错误", "err", err)
+		return
+	}
 
-	// 获取目录部分
-	dir := filepath.Dir(path)
+	// 一次写入的目录中已存在的文件不能通过接口覆盖或删除
+	wormPolicy, err = NewWORMPolicy(config.WORM)
+	if err != nil {
+		slog.Error("一次写入的目录配置错误", "err", err)
+		return
+	}
+	transferScheduler, err = NewTransferScheduler(config.Transfer)
+	if err != nil {
+		slog.Error("传输并发配置错误", "err", err)
+		return
+	}
 
-	// 根据文件名生成存储路径
-	fullPath := filepath.Join("data", dir)
+	// 根据配置创建认证提供者
+	auth, err := NewAuthProvider(config)
+	if err != nil {
+		slog.Error("认证配置错误", "err", err)
+		return
+	}
 
-	// 检查目录是否存在，不存在则创建
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		err := os.MkdirAll(fullPath, os.ModePerm)
+	// 静态 token 配置了过期时间时在过期前发送提醒
+	if anyTokenExpires(config.Auth.Tokens) {
+		reminders, err := NewTokenReminders(config.Auth.Tokens, config.Auth.TokenExpiry, filepath.Join("data", metaDirName, "token_reminders.json"))
 		if err != nil {
-			sendJSONResponse(w, http.StatusInternalServerError, "创建目录失败", err, r.URL.Path)
+			slog.Error("无法加载 token 提醒记录", "err", err)
 			return
 		}
+		go reminders.Run()
 	}
 
-	// 创建文件
-	newFilePath := filepath.Join(fullPath, filepath.Base(path))
-	newFile, err := os.Create(newFilePath)
+	if config.Policy.OPAURL != "" {
+		policyEngine = NewOPAPolicy(config.Policy)
+	}
+
+	signer, err := NewURLSigner(config.Sign, filepath.Join("data", metaDirName, "upload_nonces.json"))
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, "创建文件失败", err, r.URL.Path)
+		slog.Error("签名配置错误", "err", err)
 		return
 	}
-	defer func(newFile *os.File) {
-		err := newFile.Close()
+
+	// 下载接口默认公开，按 visibility 配置不公开的路径需要认证或有效的签名
+	visibility, err := NewVisibility(config.Visibility, config.Sign.Private)
+	if err != nil {
+		slog.Error("可见性配置错误", "err", err)
+		return
+	}
+	// 上传和下载在并发数已满时按优先级排队
+	getHandler := TransferMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getFileHandler(w, r, config.Preview, config.Image)
+	}))
+	thumbnailHandler := TransferMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		thumbHandler(w, r, config.Thumbnail)
+	}))
+	if signer.cdn != nil && config.Sign.CDN.Scheme == "hmac_path" {
+		http.Handle("/t/", signer.cdn.PathTokenHandler(getHandler))
+	}
+	http.Handle("/get/", signer.Middleware(getHandler, auth, visibility, "/get/"))
+	http.Handle("/thumb/", signer.Middleware(thumbnailHandler, auth, visibility, "/thumb/"))
+
+	http.Handle("/sign", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signHandler(w, r, signer)
+	}), auth, scopeRead))
+
+	// 分享链接的页面公开访问，由分享自身的密码和有效期控制
+	http.HandleFunc("/s/", sharePageHandler)
+	http.Handle("/share", AuthMiddleware(http.HandlerFunc(createShareHandler), auth, scopeWrite))
+	http.Handle("/share/list", AuthMiddleware(http.HandlerFunc(listSharesHandler), auth, scopeRead))
+	http.Handle("/share/revoke", AuthMiddleware(http.HandlerFunc(revokeShareHandler), auth, scopeWrite))
+
+	http.Handle("/sign/upload", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signUploadHandler(w, r, signer)
+	}), auth, scopeWrite))
+
+	// 如果需要拦截的接口，应用 AuthMiddleware 中间件
+	http.Handle("/list", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listHandler(w, r, config.List)
+	}), auth, scopeRead))
+
+	// 写操作在维护期间被拒绝
+	http.Handle("/upload", signer.UploadMiddleware(MaintenanceMiddleware(UploadLimitMiddleware(TransferMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploadHandler(w, r, config.Checksum)
+	})), config.Upload)), auth))
+
+	// tus 断点续传，OPTIONS 用于查询支持的版本和扩展，不需要认证
+	http.Handle("/tus/", TusMiddleware(AuthMiddleware(MaintenanceMiddleware(TransferMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tusHandler(w, r, config.Checksum)
+	}))), auth, scopeWrite)))
+
+	// 增量上传只传输修改过的块，适合大文件的小范围修改
+	http.Handle("/delta/signature", AuthMiddleware(http.HandlerFunc(deltaSignatureHandler), auth, scopeRead))
+	http.Handle("/delta/apply", AuthMiddleware(MaintenanceMiddleware(UploadLimitMiddleware(TransferMiddleware(http.HandlerFunc(deltaApplyHandler)), config.Upload)), auth, scopeWrite))
+
+	// 发布目录的制品通过 /upload 发布，下载重定向到 /get/
+	http.Handle("/catalog", AuthMiddleware(http.HandlerFunc(catalogHandler), auth, scopeRead))
+	http.Handle("/catalog/resolve", AuthMiddleware(http.HandlerFunc(catalogResolveHandler), auth, scopeRead))
+	http.Handle("/catalog/download/", AuthMiddleware(http.HandlerFunc(catalogDownloadHandler), auth, scopeRead))
+	http.Handle("/catalog/pins", AuthMiddleware(MaintenanceMiddleware(http.HandlerFunc(catalogPinHandler)), auth, scopeWrite))
+	http.Handle("/catalog/mirror", AuthMiddleware(MaintenanceMiddleware(TransferMiddleware(http.HandlerFunc(catalogMirrorHandler))), auth, scopeAdmin))
+
+	http.Handle("/delete", AuthMiddleware(MaintenanceMiddleware(HoldWritesMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleteHandler(w, r)
+	}))), auth, scopeWrite))
+
+	http.Handle("/finalize", AuthMiddleware(MaintenanceMiddleware(http.HandlerFunc(finalizeHandler)), auth, scopeWrite))
+	http.Handle("/partial/list", AuthMiddleware(http.HandlerFunc(partialListHandler), auth, scopeRead))
+	http.Handle("/undo/list", AuthMiddleware(http.HandlerFunc(undoListHandler), auth, scopeRead))
+	http.Handle("/undo", AuthMiddleware(MaintenanceMiddleware(HoldWritesMiddleware(http.HandlerFunc(undoHandler))), auth, scopeWrite))
+	http.Handle("/trash/list", AuthMiddleware(http.HandlerFunc(trashListHandler), auth, scopeRead))
+	http.Handle("/trash/restore", AuthMiddleware(MaintenanceMiddleware(HoldWritesMiddleware(http.HandlerFunc(trashRestoreHandler))), auth, scopeWrite))
+	http.Handle("/trash/purge", AuthMiddleware(MaintenanceMiddleware(HoldWritesMiddleware(http.HandlerFunc(trashPurgeHandler))), auth, scopeWrite))
+
+	http.Handle("/versions", AuthMiddleware(http.HandlerFunc(versionsHandler), auth, scopeRead))
+	http.Handle("/versions/rollback", AuthMiddleware(MaintenanceMiddleware(HoldWritesMiddleware(http.HandlerFunc(versionRollbackHandler))), auth, scopeWrite))
+
+	http.Handle("/storage-class", AuthMiddleware(MaintenanceMiddleware(HoldWritesMiddleware(http.HandlerFunc(storageClassHandler))), auth, scopeWrite))
+
+	http.Handle("/events", AuthMiddleware(http.HandlerFunc(eventsHandler), auth, scopeRead))
+	http.Handle("/stat", AuthMiddleware(http.HandlerFunc(statHandler), auth, scopeRead))
+	http.Handle("/exists", AuthMiddleware(http.HandlerFunc(existsHandler), auth, scopeRead))
+	http.Handle("/verify-receipt", AuthMiddleware(http.HandlerFunc(verifyReceiptHandler), auth, scopeRead))
+	http.Handle("/dedup-hint", AuthMiddleware(http.HandlerFunc(dedupHintHandler), auth, scopeWrite))
+
+	http.Handle("/checksum", AuthMiddleware(http.HandlerFunc(checksumHandler), auth, scopeRead))
+
+	http.Handle("/quota", AuthMiddleware(http.HandlerFunc(quotaHandler), auth, scopeRead))
+
+	http.Handle("/search", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		searchHandler(w, r, config.Search)
+	}), auth, scopeRead))
+
+	http.Handle("/search/content", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentSearchHandler(w, r, config.Search)
+	}), auth, scopeRead))
+
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	adminMux.Handle("/metrics", AuthMiddleware(http.HandlerFunc(metricsHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/migration/report", AuthMiddleware(http.HandlerFunc(migrationReportHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/blobs", AuthMiddleware(http.HandlerFunc(blobStatsHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/blobs/gc", AuthMiddleware(http.HandlerFunc(blobGCHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/quarantine", AuthMiddleware(http.HandlerFunc(quarantineHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/inventory", AuthMiddleware(http.HandlerFunc(inventoryHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/backup", AuthMiddleware(http.HandlerFunc(backupHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/restore", AuthMiddleware(MaintenanceMiddleware(HoldWritesMiddleware(http.HandlerFunc(restoreHandler))), auth, scopeAdmin))
+	adminMux.Handle("/replication/status", AuthMiddleware(http.HandlerFunc(replicationStatusHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/s3-mirror", AuthMiddleware(http.HandlerFunc(s3MirrorHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/cluster", AuthMiddleware(http.HandlerFunc(clusterStatusHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/cluster/join", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clusterChangeHandler(w, r, true)
+	}), auth, scopeAdmin))
+	adminMux.Handle("/admin/cluster/leave", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clusterChangeHandler(w, r, false)
+	}), auth, scopeAdmin))
+	// 节点之间通过公共 API 端口交换成员列表
+	http.Handle("/cluster/members", AuthMiddleware(http.HandlerFunc(clusterMembersHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/egress/export", AuthMiddleware(http.HandlerFunc(egressExportHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/suspensions", AuthMiddleware(http.HandlerFunc(suspensionsHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/features", AuthMiddleware(http.HandlerFunc(featuresHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/settings", AuthMiddleware(http.HandlerFunc(settingsHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/self-update", AuthMiddleware(http.HandlerFunc(selfUpdateHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/audit", AuthMiddleware(http.HandlerFunc(auditHandler), auth, scopeAdmin))
+	adminMux.Handle("/admin/suspensions/lift", AuthMiddleware(http.HandlerFunc(liftSuspensionHandler), auth, scopeAdmin))
+	// 启用性能分析时在管理接口上提供 /debug/pprof/ 和 /debug/vars
+	NewProfiler(config.Profiling).Register(adminMux, auth)
+
+	// 带 X-Debug: true 的 admin 请求在响应中返回诊断信息，放在最内层，在响应压缩之前加入
+	var handler http.Handler = DebugMiddleware(http.DefaultServeMux, auth)
+
+	// 集群模式下将不属于本节点的请求转发到所属的节点，列出目录、搜索和删除在所有节点上执行
+	if cluster != nil {
+		handler = cluster.Middleware(handler)
+	}
+
+	// 存储后端不健康时将请求重定向到副本
+	if config.Health.Enabled && config.Health.Degrade == "redirect" {
+		handler = backendHealth.Middleware(handler)
+	}
+
+	// 客户端支持时压缩列目录、搜索和文件下载的响应
+	if config.ResponseCompression.Enabled {
+		handler, err = ResponseCompressionMiddleware(handler, config.ResponseCompression)
 		if err != nil {
-			log.Printf("Error: closing file %s\n", err)
+			slog.Error("响应压缩配置错误", "err", err)
+			return
 		}
-	}(newFile)
+	}
 
-	// 将上传的文件内容复制到新文件
-	_, err = io.Copy(newFile, file)
+	// 启用请求记录时包装整个公共 API
+	if config.Trace.Enabled {
+		recorder := NewTraceRecorder(config.Trace)
+		handler = recorder.Middleware(handler)
+		adminMux.Handle("/admin/trace", AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceHandler(w, r, recorder)
+		}), auth, scopeAdmin))
+	}
+
+	// 启用审计日志时记录每一次接口调用，包括独立监听的管理接口
+	auditLog, err = OpenAuditLog(config.Audit)
+	if err != nil {
+		slog.Error("无法打开审计日志", "err", err)
+		return
+	}
+	handler = auditLog.Middleware(handler)
+
+	// 访问日志在审计日志之外，记录包括审计在内的完整耗时
+	accessLog, err = OpenAccessLog(config.AccessLog)
+	if err != nil {
+		slog.Error("无法打开访问日志", "err", err)
+		return
+	}
+	handler = accessLog.Middleware(handler)
+
+	// 按路由统计请求数、耗时和流量，包括认证失败和限流的请求
+	handler = requestMetrics.Middleware(http.DefaultServeMux, handler)
+
+	// 配置了 tracing.endpoint 时为每个请求及其各阶段生成 span，通过 OTLP 导出
+	tracer, err = NewTracer(config.Tracing)
+	if err != nil {
+		slog.Error("追踪配置错误", "err", err)
+		return
+	}
+	if tracer != nil {
+		go tracer.Run()
+		onShutdown("tracing", tracer.Flush)
+	}
+	handler = tracer.Middleware(http.DefaultServeMux, handler)
+
+	// PUT /upload/<路径> 转换为普通上传，之后的处理按 X-FormFile-Path 识别路径
+	handler = PutUploadMiddleware(handler)
+
+	// 请求 ID 在访问日志、审计日志和运行日志中关联同一个请求
+	handler = RequestIDMiddleware(handler)
+
+	// 配置了预发布实例时镜像抽样的请求，在请求记录之外，镜像本身不影响记录的耗时
+	requestShadow = NewRequestShadow(config.Shadow)
+	if requestShadow != nil {
+		handler = requestShadow.Middleware(handler)
+	}
+
+	// 跨域处理放在最外层，预检请求不需要认证
+	if len(config.CORS.AllowedOrigins) > 0 {
+		handler = CORSMiddleware(handler, config.CORS)
+	}
+
+	// 定期统计 data 目录的占用空间和文件数
+	dataUsage = NewDataUsage(config.Metrics)
+	if dataUsage != nil {
+		go dataUsage.Run()
+	}
+
+	// 启用自动更新时定期检查上游发布目录中本平台的新版本
+	selfUpdater, err = NewSelfUpdater(config.SelfUpdate)
 	if err != nil {
-		sendJSONResponse(w, http.StatusInternalServerError, "文件复制失败", err, r.URL.Path)
+		slog.Error("自动更新配置错误", "err", err)
 		return
 	}
+	if selfUpdater != nil {
+		slog.Info("已启用自动更新", "version", buildVersion, "platform", currentPlatform(), "release_dir", selfUpdater.releaseDir())
+		go selfUpdater.Run()
+	}
+
+	address := config.Listen
+	if address == "" {
+		address = defaultListen
+	}
+	serverTLS, err = newServerTLSConfig(config.TLS)
+	if err != nil {
+		slog.Error("TLS 配置错误", "err", err)
+		return
+	}
+	listener, err := listen(address)
+	if err != nil {
+		slog.Error("服务启动失败", "err", err)
+		return
+	}
+
+	// 配置了 admin_listen 时管理接口使用独立的监听器，不经过公共 API 端口暴露
+	var adminServer *http.Server
+	if config.AdminListen != "" {
+		adminServer = serveAdmin(config.AdminListen, RequestIDMiddleware(tracer.Middleware(adminMux, requestMetrics.Middleware(adminMux, accessLog.Middleware(auditLog.Middleware(adminMux))))))
+	}
+
+	// 使用 HTTPS 时可以在另一个端口上将明文 HTTP 请求重定向到 HTTPS
+	var redirectServer *http.Server
+	if serverTLS != nil && config.TLS.RedirectListen != "" {
+		redirectServer = serveRedirect(config.TLS.RedirectListen, address)
+	}
+	if serverTLS != nil && config.TLS.HSTSMaxAge > 0 {
+		handler = HSTSMiddleware(handler, config.TLS.HSTSMaxAge)
+	}
+
+	// 收到 SIGTERM 或 SIGINT 时停止接受新连接，等待进行中的上传和下载完成，保存索引和积压后退出
+	err = serveUntilSignal(&http.Server{Handler: handler}, listener, config.Shutdown, adminServer, redirectServer)
+	if err != nil {
+		slog.Error("服务启动失败", "err", err)
+	}
+}
+
+// Config 结构用于解析配置文件中的 JSON 数据
+type Config struct {
+	// Token 为拥有所有权限的 token，更多 token 和认证方式在 auth 中配置
+	Token string     `json:"token"`
+	Auth  AuthConfig `json:"auth"`
+	// Policy 外部策略引擎，在权限范围检查之后进行细粒度授权
+	Policy PolicyConfig `json:"policy"`
+	// Listen 公共 API 的监听地址，默认 0.0.0.0:8082，以 unix: 开头时监听 unix socket
+	Listen string `json:"listen"`
+	// AdminListen 管理接口的独立监听地址，为空时管理接口与公共 API 共用端口
+	AdminListen string `json:"admin_listen"`
+	// TLS 公共 API 和管理接口的证书，未配置时使用明文 HTTP
+	TLS TLSConfig `json:"tls"`
+	// Shutdown 停止服务时等待进行中的请求的时间
+	Shutdown ShutdownConfig `json:"shutdown"`
+
+	AccessTime AccessTimeConfig `json:"access_time"`
+	Index      IndexConfig      `json:"index"`
+	List       ListConfig       `json:"list"`
+	Search     SearchConfig     `json:"search"`
+
+	ContentSearch ContentSearchConfig `json:"content_search"`
+	Maintenance   MaintenanceConfig   `json:"maintenance"`
+	Checksum      ChecksumConfig      `json:"checksum"`
+	Upload        UploadConfig        `json:"upload"`
+	Transfer      TransferConfig      `json:"transfer"`
+	Quota         QuotaConfig         `json:"quota"`
+	DiskGuard     DiskGuardConfig     `json:"disk_guard"`
+	Migration     MigrationConfig     `json:"migration"`
+	TTL           TTLConfig           `json:"ttl"`
+	Verify        VerifyConfig        `json:"verify"`
+	Trash         TrashConfig         `json:"trash"`
+	Undo          UndoConfig          `json:"undo"`
+	Versioning    VersioningConfig    `json:"versioning"`
+	Inventory     InventoryConfig     `json:"inventory"`
+	Backup        BackupConfig        `json:"backup"`
+	Receipt       ReceiptConfig       `json:"receipt"`
+	Dedup         DedupConfig         `json:"dedup"`
+	StorageClass  StorageClassConfig  `json:"storage_class"`
+	Encryption    EncryptionConfig    `json:"encryption"`
+	Compression   CompressionConfig   `json:"compression"`
+	Egress        EgressConfig        `json:"egress"`
+	Shadow        ShadowConfig        `json:"shadow"`
+	Replication   ReplicationConfig   `json:"replication"`
+	S3Mirror      S3MirrorConfig      `json:"s3_mirror"`
+	Webhooks      WebhookConfig       `json:"webhooks"`
+	Events        EventsConfig        `json:"events"`
+	EventBus      EventBusConfig      `json:"event_bus"`
+	Catalog       CatalogConfig       `json:"catalog"`
+	ExistsFilter  ExistsFilterConfig  `json:"exists_filter"`
+	Cluster       ClusterConfig       `json:"cluster"`
+	Trace         TraceConfig         `json:"trace"`
+	Preview       PreviewConfig       `json:"preview"`
+	Thumbnail     ThumbnailConfig     `json:"thumbnail"`
+	Image         ImageConfig         `json:"image"`
+	VirusScan     VirusScanConfig     `json:"virus_scan"`
+	Sign          SignConfig          `json:"sign"`
+	Health        HealthConfig        `json:"health"`
+	CORS          CORSConfig          `json:"cors"`
+	GeoIP         GeoIPConfig         `json:"geoip"`
+	Visibility    VisibilityConfig    `json:"visibility"`
+	Anomaly       AnomalyConfig       `json:"anomaly"`
+
+	// Features 按功能名称配置灰度启用的范围，未配置的功能在所有路径上启用
+	Features map[string]FeatureFlag `json:"features"`
+	// RateLimit 为按调用方限制请求速率的初始值，可以通过运行时设置修改
+	RateLimit RateLimitSetting `json:"rate_limit"`
+	// SelfUpdate 从上游实例检查并切换到签名的新版本
+	SelfUpdate SelfUpdateConfig `json:"self_update"`
+	// WORM 为一次写入的目录，已存在的文件不能覆盖或删除
+	WORM WORMConfig `json:"worm"`
+	// Audit 审计日志，记录每一次接口调用
+	Audit AuditConfig `json:"audit"`
+	// Naming 按目录配置上传文件的命名策略
+	Naming NamingConfig `json:"naming"`
+	// AccessLog 访问日志的格式和输出位置
+	AccessLog AccessLogConfig `json:"access_log"`
+	// Log 运行日志的级别和格式
+	Log LogConfig `json:"log"`
+	// Metrics 为 /metrics 中定期统计的指标
+	Metrics MetricsConfig `json:"metrics"`
+	// Tracing 为请求生成的 span 的 OTLP 导出地址
+	Tracing TracingConfig `json:"tracing"`
+	// Profiling 为管理接口上的 /debug/pprof/ 和 /debug/vars
+	Profiling ProfilingConfig `json:"profiling"`
+
+	// ResponseCompression 为传输时的响应压缩，与 Compression（存储时的压缩）相互独立
+	ResponseCompression ResponseCompressionConfig `json:"response_compression"`
+	// Chaos 故障注入，仅用于测试环境
+	Chaos ChaosConfig `json:"chaos"`
+}
+
+// ListConfig 结构用于配置目录列表的限制
+type ListConfig struct {
+	// MaxDepth 递归列出时允许的最大深度，默认 16
+	MaxDepth int `json:"max_depth"`
+	// MaxEntries 单次递归列出允许返回的最大条目数，默认 10000
+	MaxEntries int `json:"max_entries"`
+	// SnapshotTTL 一致性列表的快照超过该时间没有读取时删除，单位秒，默认 300
+	SnapshotTTL int `json:"snapshot_ttl"`
+	// MaxSnapshots 同时保存的快照数上限，默认 100
+	MaxSnapshots int `json:"max_snapshots"`
+	// MaxWait 长轮询请求的 wait 上限，单位秒，默认 60
+	MaxWait int `json:"max_wait"`
+}
+
+// LoadConfig 从配置文件中加载配置信息
+func LoadConfig() (Config, error) {
+	var config Config
+
+	// 读取配置文件
+	data, err := os.ReadFile("config.json")
+	if err != nil {
+		return config, err
+	}
+
+	// 解析 JSON 数据
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, err
+	}
+
+	// 解析以文件、环境变量或 Vault 引用方式配置的敏感值
+	err = resolveConfigSecrets(&config)
+	if err != nil {
+		return config, err
+	}
 
-	sendJSONResponse(w, http.StatusOK, "文件上传成功", nil, r.URL.Path)
-	log.Printf("info: %s \n", r.URL.Path)
+	return config, nil
+}
+
+// reservedNames 是 data 目录下的内部目录，不会出现在列表中，也不能通过接口直接访问
+var reservedNames = map[string]bool{
+	metaDirName:     true,
+	thumbsDirName:   true,
+	trashDirName:    true,
+	versionsDirName: true,
+	blobsDirName:    true,
+}
+
+// isReservedPath 判断路径是否指向 data 目录下的内部目录
+func isReservedPath(path string) bool {
+	first := strings.SplitN(indexKey(path), "/", 2)[0]
+	return reservedNames[first]
+}
+
+// isUnsafePath 判断请求中的路径是否可能访问 data 目录之外：包含 .. 段或空字符，
+// 或路径中已存在的部分经过符号链接指向 data 目录之外；开头的 / 视为 data 目录本身
+func isUnsafePath(path string) bool {
+	if strings.ContainsRune(path, 0) {
+		return true
+	}
+	for _, segment := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return true
+		}
+	}
+	return !withinDataRoot(filepath.Join("data", filepath.FromSlash(indexKey(path))))
 }
 
 // ListRequest 结构用于解析列出目录的请求的 JSON 数据
 type ListRequest struct {
-	Path string `json:"path"`
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+	MaxDepth  int    `json:"max_depth"`
+	Limit     int    `json:"limit"`
+	Offset    int    `json:"offset"`
+	Sort      string `json:"sort"`
+	Order     string `json:"order"`
+	Pattern   string `json:"pattern"`
+	// Snapshot 为 true 时保存本次列出的结果并返回 snapshot_token，之后的分页请求带上 token 从快照中读取
+	Snapshot      bool   `json:"snapshot"`
+	SnapshotToken string `json:"snapshot_token"`
+	// Fields 为查询参数 fields 选择的字段，不在请求体中
+	Fields FieldSelection `json:"-"`
 }
 
 // ListResponse 结构用于组织列出目录的响应
@@ -214,16 +914,27 @@ type ListResponse struct {
 	Status  int         `json:"status"`
 	Message string      `json:"message"`
 	Content []ListEntry `json:"content"`
+	Total   int         `json:"total"`
+	// SnapshotToken 和 SnapshotAt 为一致性列表的快照及其时间
+	SnapshotToken string     `json:"snapshot_token,omitempty"`
+	SnapshotAt    *time.Time `json:"snapshot_at,omitempty"`
+	// Cursor 为列出之前的变更游标，作为下一次请求的 if_changed_since；NotModified 为 true 时目录在游标之后没有变化，不返回条目
+	Cursor      string `json:"cursor,omitempty"`
+	NotModified bool   `json:"not_modified,omitempty"`
+	// Fields 不为空时每个条目只返回选择的字段
+	Fields FieldSelection `json:"-"`
 }
 
 // ListEntry 结构用于表示目录中的文件或文件夹信息
 type ListEntry struct {
 	Name  string    `json:"name"`
+	Path  string    `json:"path,omitempty"`
 	IsDir bool      `json:"is_dir"`
+	Size  int64     `json:"size"`
 	Date  time.Time `json:"date"`
 }
 
-func listHandler(w http.ResponseWriter, r *http.Request) {
+func listHandler(w http.ResponseWriter, r *http.Request, listConfig ListConfig) {
 	// 解析 JSON 请求体
 	var listRequest ListRequest
 	err := json.NewDecoder(r.Body).Decode(&listRequest)
@@ -234,9 +945,64 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 		}, err, r.URL.Path)
 		return
 	}
+	listRequest.Fields, err = parseFields(r, ListEntry{})
+	if err != nil {
+		sendListResponse(w, http.StatusBadRequest, err.Error(), ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, err, r.URL.Path)
+		return
+	}
 
 	// 获取 path 参数
 	path := listRequest.Path
+	if isReservedPath(path) || isUnsafePath(path) {
+		sendListResponse(w, http.StatusOK, "该目录不存在", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, nil, r.URL.Path)
+		return
+	}
+
+	// 带快照 token 的分页请求从快照中读取，不受之后的写入影响
+	if listRequest.SnapshotToken != "" {
+		serveListSnapshot(w, r, listRequest)
+		return
+	}
+
+	// 带 if_changed_since 时先等待目录变化，没有变化时不列出目录
+	if since := r.URL.Query().Get("if_changed_since"); since != "" {
+		maxWait := time.Duration(listConfig.MaxWait) * time.Second
+		if maxWait <= 0 {
+			maxWait = 60 * time.Second
+		}
+		wait, err := parseListWait(r, maxWait)
+		if err != nil {
+			sendListResponse(w, http.StatusBadRequest, err.Error(), ListResponse{
+				Status:  0,
+				Content: []ListEntry{},
+			}, err, r.URL.Path)
+			return
+		}
+		changed, err := listWatch.Wait(r.Context(), indexKey(path), since, wait)
+		if err != nil {
+			sendListResponse(w, http.StatusBadRequest, err.Error(), ListResponse{
+				Status:  0,
+				Content: []ListEntry{},
+			}, err, r.URL.Path)
+			return
+		}
+		if !changed {
+			sendListResponse(w, http.StatusOK, "目录未变化", ListResponse{
+				Status:      1,
+				Content:     []ListEntry{},
+				Cursor:      since,
+				NotModified: true,
+			}, nil, r.URL.Path)
+			return
+		}
+	}
+	cursor := listWatch.Cursor()
 
 	// 如果 path 为空，则列出 data 目录下的文件和文件夹
 	if path == "" {
@@ -258,8 +1024,23 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 索引尚未建立完成时，优先扫描正在被列出的目录
+	indexScanner.Prioritize(indexKey(listRequest.Path))
+
 	// 列出目录内容
-	entries, err := listDirectory(fullPath)
+	var entries []ListEntry
+	if listRequest.Recursive {
+		entries, err = listRecursive(fullPath, listRequest.MaxDepth, listConfig)
+		if err == errTooManyEntries {
+			sendListResponse(w, http.StatusBadRequest, "条目数超过上限，请减小 max_depth", ListResponse{
+				Status:  0,
+				Content: []ListEntry{},
+			}, err, r.URL.Path)
+			return
+		}
+	} else {
+		entries, err = listDirectory(fullPath)
+	}
 	if err != nil {
 		sendListResponse(w, http.StatusInternalServerError, "无法列出目录内容", ListResponse{
 			Status:  0,
@@ -268,16 +1049,8 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 构建响应
-	response := ListResponse{
-		Status:  1,
-		Message: "success",
-		Content: entries,
-	}
-
-	// 发送响应
-	sendListResponse(w, http.StatusOK, "success", response, err, r.URL.Path)
-	log.Printf("info: %s \n", r.URL.Path)
+	// 过滤、排序和分页
+	sendListPage(w, r, listRequest, entries, cursor)
 }
 
 func listDirectory(path string) ([]ListEntry, error) {
@@ -291,7 +1064,7 @@ func listDirectory(path string) ([]ListEntry, error) {
 	defer func(dir *os.File) {
 		err := dir.Close()
 		if err != nil {
-			log.Printf("Error: closing file %s\n", err)
+			slog.Error("closing file", "err", err)
 		}
 	}(dir)
 
@@ -303,14 +1076,71 @@ func listDirectory(path string) ([]ListEntry, error) {
 
 	// 遍历文件和文件夹
 	for _, fileInfo := range fileInfos {
+		// 跳过内部目录
+		if path == "data" && reservedNames[fileInfo.Name()] {
+			continue
+		}
 		entry := ListEntry{
 			Name:  fileInfo.Name(),
 			IsDir: fileInfo.IsDir(),
+			Size:  fileInfo.Size(),
 			Date:  fileInfo.ModTime(),
 		}
 		entries = append(entries, entry)
 	}
 
+	// 已移动到归档层的文件同样列出
+	if rel, err := filepath.Rel("data", path); err == nil && !strings.HasPrefix(rel, "..") {
+		entries = append(entries, storageClasses.ArchivedEntries(indexKey(filepath.ToSlash(rel)), entries)...)
+	}
+
+	return entries, nil
+}
+
+// errTooManyEntries 表示递归列出的条目数超过上限
+var errTooManyEntries = errors.New("too many entries")
+
+// listRecursive 递归列出目录内容，条目的 Path 为相对于 root 的路径
+func listRecursive(root string, maxDepth int, listConfig ListConfig) ([]ListEntry, error) {
+	depthLimit := listConfig.MaxDepth
+	if depthLimit <= 0 {
+		depthLimit = 16
+	}
+	entryLimit := listConfig.MaxEntries
+	if entryLimit <= 0 {
+		entryLimit = 10000
+	}
+	if maxDepth <= 0 || maxDepth > depthLimit {
+		maxDepth = depthLimit
+	}
+
+	return listTree(root, "", maxDepth, entryLimit)
+}
+
+// listTree 从 root 下的 rel 目录开始递归列出，最多 depth 层
+func listTree(root string, rel string, depth int, limit int) ([]ListEntry, error) {
+	children, err := listDirectory(filepath.Join(root, rel))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ListEntry
+	for _, child := range children {
+		child.Path = filepath.ToSlash(filepath.Join(rel, child.Name))
+		entries = append(entries, child)
+		if len(entries) > limit {
+			return nil, errTooManyEntries
+		}
+		if !child.IsDir || depth <= 1 {
+			continue
+		}
+
+		subEntries, err := listTree(root, child.Path, depth-1, limit-len(entries))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, subEntries...)
+	}
 	return entries, nil
 }
 
@@ -320,15 +1150,40 @@ func sendListResponse(w http.ResponseWriter, statusCode int, message string, res
 
 	response.Message = message
 	if err != nil {
-		log.Printf("Error: %s %s\n", err, url)
+		logResponse(w, statusCode, message, err, url)
 	}
-	err = json.NewEncoder(w).Encode(response)
+	var body any = response
+	if response.Fields != nil {
+		content := make([]any, len(response.Content))
+		for i, entry := range response.Content {
+			content[i] = response.Fields.Project(entry)
+		}
+		// 外层的 Content 覆盖 ListResponse 中的同名字段
+		body = struct {
+			ListResponse
+			Content []any `json:"content"`
+		}{response, content}
+	}
+	err = json.NewEncoder(w).Encode(body)
 	if err != nil {
-		log.Printf("Error: %s\n", err)
+		slog.Warn("写入响应失败", "err", err, "url", url)
 		return
 	}
 }
 
+// logResponse 记录失败的请求，5xx 为 error 级别，其他为 warn 级别；请求 ID 取自响应头
+func logResponse(w http.ResponseWriter, statusCode int, message string, err error, url string) {
+	level := slog.LevelWarn
+	if statusCode >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs := []any{"status", statusCode, "url", url, "request_id", w.Header().Get("X-Request-Id")}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	slog.Log(context.Background(), level, message, attrs...)
+}
+
 // sendJSONResponse 发送 JSON 格式的响应
 func sendJSONResponse(w http.ResponseWriter, statusCode int, message string, err error, url string) {
 	w.Header().Set("Content-Type", "application/json")
@@ -341,7 +1196,7 @@ func sendJSONResponse(w http.ResponseWriter, statusCode int, message string, err
 		}
 		err = json.NewEncoder(w).Encode(response)
 		if err != nil {
-			log.Printf("Error: %s %s\n", err, url)
+			slog.Warn("写入响应失败", "err", err, "url", url)
 			return
 		}
 		return
@@ -352,15 +1207,36 @@ func sendJSONResponse(w http.ResponseWriter, statusCode int, message string, err
 		"message": message,
 	}
 
+	logResponse(w, statusCode, message, err, url)
+
+	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		log.Printf("Error: %s %s\n", err, url)
-	} else {
-		log.Printf("Error: %s %s\n", message, url)
+		slog.Warn("写入响应失败", "err", err, "url", url)
+		return
 	}
+}
+
+// sendContentResponse 发送带有 content 字段的 JSON 响应
+func sendContentResponse(w http.ResponseWriter, statusCode int, message string, content interface{}, err error, url string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 
+	status := 0
+	if statusCode == http.StatusOK {
+		status = 1
+	}
+	if err != nil {
+		logResponse(w, statusCode, message, err, url)
+	}
+
+	response := map[string]interface{}{
+		"status":  status,
+		"message": message,
+		"content": content,
+	}
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		log.Printf("Error: %s %s\n", err, url)
+		slog.Warn("写入响应失败", "err", err, "url", url)
 		return
 	}
 }
@@ -374,6 +1250,11 @@ type DeleteRequest struct {
 type DeleteResponse struct {
 	Status  int    `json:"status"`
 	Message string `json:"message"`
+	// TrashID 为移入回收站后的 ID，可用于恢复
+	TrashID string `json:"trash_id,omitempty"`
+	// UndoID 为配置了撤销时间时等待执行的删除的 ID，在 ExecuteAt 之前可以通过 /undo 撤销
+	UndoID    string     `json:"undo_id,omitempty"`
+	ExecuteAt *time.Time `json:"execute_at,omitempty"`
 }
 
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -400,11 +1281,37 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 获取完整路径
-	fullPath := filepath.Join("data", path)
+	if isReservedPath(path) || isUnsafePath(path) || indexKey(path) == "" {
+		sendDeleteResponse(w, http.StatusBadRequest, DeleteResponse{
+			Status:  0,
+			Message: "非法的路径参数",
+		}, nil, r.URL.Path)
+		return
+	}
 
-	// 检查文件或目录是否存在
-	_, err = os.Stat(fullPath)
+	// 正在写入的文件或包含正在写入的文件的目录不能删除，删除期间同一路径的上传等待或被拒绝
+	release, err := pathLocks.Lock(r.Context(), indexKey(path), "删除", false)
+	if err != nil {
+		sendDeleteResponse(w, http.StatusConflict, DeleteResponse{
+			Status:  0,
+			Message: "文件或目录正在写入，请稍后重试",
+		}, err, r.URL.Path)
+		return
+	}
+	defer release()
+
+	// 一次写入的目录中的文件在保留期内不能删除，包含这些文件的目录同样不能删除
+	err = wormPolicy.Protected(indexKey(path))
+	if err != nil {
+		sendDeleteResponse(w, http.StatusForbidden, DeleteResponse{
+			Status:  0,
+			Message: err.Error(),
+		}, err, r.URL.Path)
+		return
+	}
+
+	// 检查文件或目录是否存在，双写迁移期间只存在于旧后端的文件同样删除
+	_, _, err = statReadPath(path)
 	if os.IsNotExist(err) {
 		sendDeleteResponse(w, http.StatusOK, DeleteResponse{
 			Status:  0,
@@ -419,8 +1326,29 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 删除文件或目录
-	err = os.RemoveAll(fullPath)
+	// 配置了撤销时间时只登记删除，到期后执行；复制产生的删除已在源实例上等待过，立即执行
+	key := indexKey(path)
+	if deferredDeletes != nil && !fromReplicationPeer(r) {
+		item, err := deferredDeletes.Schedule(key, identityName(r))
+		if err != nil {
+			sendDeleteResponse(w, http.StatusInternalServerError, DeleteResponse{
+				Status:  0,
+				Message: "删除失败",
+			}, err, r.URL.Path)
+			return
+		}
+		anomalyDetector.Delete(r)
+		sendDeleteResponse(w, http.StatusOK, DeleteResponse{
+			Status:    1,
+			Message:   fmt.Sprintf("将在 %d 分钟后删除，可以通过 /undo 撤销", int(deferredDeletes.window.Minutes())),
+			UndoID:    item.ID,
+			ExecuteAt: &item.ExecuteAt,
+		}, nil, r.URL.Path)
+		return
+	}
+
+	// 启用回收站时移入回收站，否则直接删除
+	trashID, err := executeDelete(r, key, identityName(r))
 	if err != nil {
 		sendDeleteResponse(w, http.StatusInternalServerError, DeleteResponse{
 			Status:  0,
@@ -428,27 +1356,73 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		}, err, r.URL.Path)
 		return
 	}
-
-	// 构建响应
+	anomalyDetector.Delete(r)
 	response := DeleteResponse{
 		Status:  1,
 		Message: "删除成功",
+		TrashID: trashID,
+	}
+	if trashID != "" {
+		response.Message = "已移入回收站"
 	}
 
 	// 发送响应
 	sendDeleteResponse(w, http.StatusOK, response, nil, r.URL.Path)
-	log.Printf("info: %s \n", r.URL.Path)
+}
+
+// executeDelete 将文件或目录移入回收站或直接删除，清理索引并发送通知，返回回收站中的 ID；只存在于旧后端的文件直接删除。
+// r 为 nil 时为到期执行的延迟删除，actor 为请求删除的调用方
+func executeDelete(r *http.Request, key string, actor string) (string, error) {
+	removed := existenceFilter.Entries(filepath.Join("data", filepath.FromSlash(key)))
+	var trashID string
+	if trash != nil {
+		item, err := trash.Move(key, actor)
+		if err == nil {
+			trashID = item.ID
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	if trashID == "" {
+		err := removeDataPath(filepath.Join("data", filepath.FromSlash(key)))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// 清理索引中的记录
+	forgetDeletedPath(key, removed)
+	replicator.Delete(r, key)
+	webhooks.Emit(r, WebhookEvent{Event: webhookDelete, Path: key, Source: "delete", TrashID: trashID, Actor: actor})
+	changeFeed.Publish(r, ChangeEvent{Type: changeDeleted, Path: key, Source: "delete", Actor: actor})
+	eventBus.Publish(r, BusEvent{Type: changeDeleted, Path: key, Source: "delete", TrashID: trashID, Actor: actor})
+	return trashID, nil
+}
+
+// forgetDeletedPath 在文件或目录被删除后清理索引、缩略图等相关记录，removed 为删除的文件和目录数
+func forgetDeletedPath(key string, removed int) {
+	err := migration.Remove(key)
+	if err != nil {
+		slog.Error("删除旧后端中的文件失败", "err", err)
+	}
+	accessTracker.Forget(key)
+	metaIndex.RemoveTree(key)
+	contentIndex.Remove(key)
+	removeThumbnails(key)
+	fileExpiry.Forget(key)
+	storageClasses.Remove(key)
+	existenceFilter.Forget(removed)
 }
 
 func sendDeleteResponse(w http.ResponseWriter, statusCode int, response DeleteResponse, err error, url string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	if err != nil {
-		log.Printf("Error: %s %s\n", err, url)
+		logResponse(w, statusCode, response.Message, err, url)
 	}
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		log.Printf("Error: %s\n", err)
+		slog.Warn("写入响应失败", "err", err, "url", url)
 		return
 	}
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaintenanceWindow 结构用于配置一个周期性的维护窗口，窗口内拒绝写操作
+type MaintenanceWindow struct {
+	// Start 和 End 为本地时间 HH:MM，End 小于 Start 时表示跨越午夜
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Days 为窗口开始的星期（sun、mon ...），为空时表示每天
+	Days    []string `json:"days"`
+	Message string   `json:"message"`
+}
+
+// MaintenanceConfig 结构用于配置维护窗口
+type MaintenanceConfig struct {
+	Windows []MaintenanceWindow `json:"windows"`
+}
+
+// maintenanceWindow 是解析后的维护窗口
+type maintenanceWindow struct {
+	start   time.Duration
+	end     time.Duration
+	days    map[time.Weekday]bool
+	message string
+}
+
+// MaintenanceGate 判断当前是否处于维护窗口，后台任务也可以临时开启维护状态
+type MaintenanceGate struct {
+	mu      sync.Mutex
+	windows []maintenanceWindow
+	// manual 是由后台任务（如备份）开启的维护状态
+	manual string
+	// writes 在创建备份快照时短暂暂停写操作，写操作提交期间持有读锁
+	writes sync.RWMutex
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// NewMaintenanceGate 解析配置中的维护窗口
+func NewMaintenanceGate(cfg MaintenanceConfig) (*MaintenanceGate, error) {
+	g := &MaintenanceGate{}
+	for _, w := range cfg.Windows {
+		start, err := parseClock(w.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(w.End)
+		if err != nil {
+			return nil, err
+		}
+		window := maintenanceWindow{
+			start:   start,
+			end:     end,
+			days:    map[time.Weekday]bool{},
+			message: w.Message,
+		}
+		for _, day := range w.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("无效的星期 %q", day)
+			}
+			window.days[weekday] = true
+		}
+		g.windows = append(g.windows, window)
+	}
+	return g, nil
+}
+
+// parseClock 将 HH:MM 解析为距离午夜的时长
+func parseClock(clock string) (time.Duration, error) {
+	parts := strings.SplitN(clock, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("无效的时间 %q", clock)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("无效的时间 %q", clock)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("无效的时间 %q", clock)
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+// Begin 开启维护状态，直到调用 End
+func (g *MaintenanceGate) Begin(message string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.manual = message
+}
+
+// End 结束由 Begin 开启的维护状态
+func (g *MaintenanceGate) End() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.manual = ""
+}
+
+// HoldWrites 在写操作修改 data 目录期间调用，创建备份快照时等待快照完成；返回的函数用于释放
+func (g *MaintenanceGate) HoldWrites() func() {
+	if g == nil {
+		return func() {}
+	}
+	g.writes.RLock()
+	return g.writes.RUnlock
+}
+
+// PauseWrites 等待正在提交的写操作完成并暂停新的写操作，直到调用返回的函数
+func (g *MaintenanceGate) PauseWrites() func() {
+	if g == nil {
+		return func() {}
+	}
+	g.writes.Lock()
+	return g.writes.Unlock
+}
+
+// Active 返回当前是否处于维护中，以及提示信息和预计结束时间（未知时为零值）
+func (g *MaintenanceGate) Active(now time.Time) (string, time.Time, bool) {
+	if g == nil {
+		return "", time.Time{}, false
+	}
+	g.mu.Lock()
+	manual := g.manual
+	g.mu.Unlock()
+	if manual != "" {
+		return manual, time.Time{}, true
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, w := range g.windows {
+		// 跨越午夜的窗口可能从前一天开始
+		for _, dayStart := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+			if len(w.days) > 0 && !w.days[dayStart.Weekday()] {
+				continue
+			}
+			start := dayStart.Add(w.start)
+			end := dayStart.Add(w.end)
+			if w.end <= w.start {
+				end = end.AddDate(0, 0, 1)
+			}
+			if !now.Before(start) && now.Before(end) {
+				return w.message, end, true
+			}
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// MaintenanceMiddleware 在维护期间或存储后端不健康时拒绝写操作，读操作不受影响
+func MaintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if backendHealth.ReadOnly() {
+			sendJSONResponse(w, http.StatusServiceUnavailable, "存储后端异常，暂停写入", nil, r.URL.Path)
+			return
+		}
+		// 通过运行时设置开启的只读模式，关闭前一直拒绝写操作
+		if readOnly := runtimeSettings.ReadOnly(); readOnly.Enabled {
+			message := readOnly.Message
+			if message == "" {
+				message = "只读模式，暂停写入"
+			}
+			sendJSONResponse(w, http.StatusServiceUnavailable, message, nil, r.URL.Path)
+			return
+		}
+
+		message, end, ok := maintenanceGate.Active(time.Now())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if message == "" {
+			message = "系统维护中，暂停写入"
+		}
+		if !end.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(end).Seconds())+1))
+			message = fmt.Sprintf("%s，预计 %s 恢复", message, end.Format("2006-01-02 15:04"))
+		}
+		sendJSONResponse(w, http.StatusServiceUnavailable, message, nil, r.URL.Path)
+	})
+}
+
+// HoldWritesMiddleware 在整个请求期间持有写操作的读锁，用于请求体较小的写操作；上传只在提交时持有
+func HoldWritesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer maintenanceGate.HoldWrites()()
+		next.ServeHTTP(w, r)
+	})
+}
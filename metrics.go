@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MetricsConfig 结构用于配置 /metrics 中需要定期统计的指标
+type MetricsConfig struct {
+	// UsageInterval 统计 data 目录占用空间和文件数的间隔，单位秒，默认 300；为负数时不统计
+	UsageInterval int `json:"usage_interval"`
+}
+
+// requestDurationBuckets 为请求耗时直方图的上界，单位秒，上传和下载大文件时耗时较长
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// requestCountKey 是请求计数的标签
+type requestCountKey struct {
+	endpoint string
+	method   string
+	status   int
+}
+
+// durationHistogram 是一个接口的请求耗时直方图，counts 与 requestDurationBuckets 一一对应，不累加
+type durationHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// RequestMetrics 结构按接口统计请求数、耗时和收发的字节数；接口为注册的路由，如 /get/，未注册的路径为 other
+type RequestMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestCountKey]int64
+	durations map[string]*durationHistogram
+	// received 和 sent 为请求体和响应体的字节数，即上传和下载的流量
+	received map[string]int64
+	sent     map[string]int64
+}
+
+// requestMetrics 总是启用，由 /metrics 输出
+var requestMetrics = &RequestMetrics{
+	requests:  map[requestCountKey]int64{},
+	durations: map[string]*durationHistogram{},
+	received:  map[string]int64{},
+	sent:      map[string]int64{},
+}
+
+// metricsBody 统计读取的请求体字节数
+type metricsBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *metricsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// Middleware 在请求结束后记录指标，mux 用于确定请求对应的路由，标签的取值不会随路径无限增长
+func (m *RequestMetrics) Middleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, endpoint := mux.Handler(r)
+		if endpoint == "" {
+			endpoint = "other"
+		}
+		body := &metricsBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		sw := newStatusWriter(w, 0)
+		next.ServeHTTP(sw, r)
+		m.record(requestCountKey{endpoint: endpoint, method: r.Method, status: sw.Status()}, time.Since(start), body.n, sw.bytes)
+	})
+}
+
+// record 记录一个已完成的请求
+func (m *RequestMetrics) record(key requestCountKey, elapsed time.Duration, received int64, sent int64) {
+	seconds := elapsed.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[key]++
+	histogram, ok := m.durations[key.endpoint]
+	if !ok {
+		histogram = &durationHistogram{counts: make([]int64, len(requestDurationBuckets))}
+		m.durations[key.endpoint] = histogram
+	}
+	for i, bound := range requestDurationBuckets {
+		if seconds <= bound {
+			histogram.counts[i]++
+			break
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+	m.received[key.endpoint] += received
+	m.sent[key.endpoint] += sent
+}
+
+// writeMetrics 输出请求数、耗时直方图和收发的字节数
+func (m *RequestMetrics) writeMetrics(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]requestCountKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	endpoints := make([]string, 0, len(m.durations))
+	for endpoint := range m.durations {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	fmt.Fprintf(w, "# HELP store_http_requests_total HTTP requests by endpoint, method and status.\n")
+	fmt.Fprintf(w, "# TYPE store_http_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "store_http_requests_total{endpoint=%q,method=%q,status=\"%d\"} %d\n", key.endpoint, key.method, key.status, m.requests[key])
+	}
+	fmt.Fprintf(w, "# HELP store_http_request_duration_seconds HTTP request latency by endpoint.\n")
+	fmt.Fprintf(w, "# TYPE store_http_request_duration_seconds histogram\n")
+	for _, endpoint := range endpoints {
+		histogram := m.durations[endpoint]
+		var cumulative int64
+		for i, bound := range requestDurationBuckets {
+			cumulative += histogram.counts[i]
+			fmt.Fprintf(w, "store_http_request_duration_seconds_bucket{endpoint=%q,le=%q} %d\n", endpoint, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "store_http_request_duration_seconds_bucket{endpoint=%q,le=\"+Inf\"} %d\n", endpoint, histogram.count)
+		fmt.Fprintf(w, "store_http_request_duration_seconds_sum{endpoint=%q} %g\n", endpoint, histogram.sum)
+		fmt.Fprintf(w, "store_http_request_duration_seconds_count{endpoint=%q} %d\n", endpoint, histogram.count)
+	}
+	fmt.Fprintf(w, "# HELP store_http_received_bytes_total Request body bytes received by endpoint, e.g. uploads.\n")
+	fmt.Fprintf(w, "# TYPE store_http_received_bytes_total counter\n")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "store_http_received_bytes_total{endpoint=%q} %d\n", endpoint, m.received[endpoint])
+	}
+	fmt.Fprintf(w, "# HELP store_http_sent_bytes_total Response body bytes sent by endpoint, e.g. downloads.\n")
+	fmt.Fprintf(w, "# TYPE store_http_sent_bytes_total counter\n")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "store_http_sent_bytes_total{endpoint=%q} %d\n", endpoint, m.sent[endpoint])
+	}
+}
+
+// DataUsage 结构定期遍历 data 目录，统计用户文件占用的空间和文件数，不包括回收站、历史版本等元数据
+type DataUsage struct {
+	interval time.Duration
+
+	mu        sync.Mutex
+	files     int64
+	bytes     int64
+	scannedAt time.Time
+}
+
+// dataUsage 未启用统计时为 nil
+var dataUsage *DataUsage
+
+// NewDataUsage 创建 data 目录的统计，usage_interval 为负数时返回 nil
+func NewDataUsage(config MetricsConfig) *DataUsage {
+	if config.UsageInterval < 0 {
+		return nil
+	}
+	interval := time.Duration(config.UsageInterval) * time.Second
+	if interval == 0 {
+		interval = 300 * time.Second
+	}
+	return &DataUsage{interval: interval}
+}
+
+// Run 立即统计一次，之后按间隔定期统计
+func (u *DataUsage) Run() {
+	for {
+		u.scan()
+		time.Sleep(u.interval)
+	}
+}
+
+// scan 遍历 data 目录，跳过保留的目录
+func (u *DataUsage) scan() {
+	var files, bytes int64
+	err := filepath.WalkDir("data", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// 遍历过程中被删除的文件和目录不影响统计
+			return nil
+		}
+		rel, err := filepath.Rel("data", path)
+		if err != nil {
+			return nil
+		}
+		key := indexKey(filepath.ToSlash(rel))
+		if d.IsDir() {
+			if key != "" && isReservedPath(key) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files++
+		bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		slog.Error("统计 data 目录失败", "err", err)
+		return
+	}
+	u.mu.Lock()
+	u.files, u.bytes, u.scannedAt = files, bytes, time.Now()
+	u.mu.Unlock()
+}
+
+// writeMetrics 输出最近一次统计的结果和 data 所在卷的空间，尚未完成第一次统计时只输出卷的空间
+func (u *DataUsage) writeMetrics(w io.Writer) {
+	if u == nil {
+		return
+	}
+	if free, total, err := diskFree("data"); err == nil {
+		fmt.Fprintf(w, "# HELP store_disk_free_bytes Free space on the volume holding data/.\n")
+		fmt.Fprintf(w, "# TYPE store_disk_free_bytes gauge\n")
+		fmt.Fprintf(w, "store_disk_free_bytes %d\n", free)
+		fmt.Fprintf(w, "# HELP store_disk_total_bytes Size of the volume holding data/.\n")
+		fmt.Fprintf(w, "# TYPE store_disk_total_bytes gauge\n")
+		fmt.Fprintf(w, "store_disk_total_bytes %d\n", total)
+	}
+	u.mu.Lock()
+	files, bytes, scannedAt := u.files, u.bytes, u.scannedAt
+	u.mu.Unlock()
+	if scannedAt.IsZero() {
+		return
+	}
+	fmt.Fprintf(w, "# HELP store_data_bytes Total size of user files in data/.\n")
+	fmt.Fprintf(w, "# TYPE store_data_bytes gauge\n")
+	fmt.Fprintf(w, "store_data_bytes %d\n", bytes)
+	fmt.Fprintf(w, "# HELP store_data_files Number of user files in data/.\n")
+	fmt.Fprintf(w, "# TYPE store_data_files gauge\n")
+	fmt.Fprintf(w, "store_data_files %d\n", files)
+	fmt.Fprintf(w, "# HELP store_data_usage_scan_timestamp_seconds When data/ was last scanned.\n")
+	fmt.Fprintf(w, "# TYPE store_data_usage_scan_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "store_data_usage_scan_timestamp_seconds %d\n", scannedAt.Unix())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// statusWriter 包装 http.ResponseWriter，记录响应状态码、字节数，并可选地保留响应体开头的一部分
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// body 保存响应体的前 bodyLimit 个字节，bodyLimit 为 0 时不保存
+	body      bytes.Buffer
+	bodyLimit int
+}
+
+func newStatusWriter(w http.ResponseWriter, bodyLimit int) *statusWriter {
+	return &statusWriter{ResponseWriter: w, bodyLimit: bodyLimit}
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if remaining := w.bodyLimit - w.body.Len(); remaining > 0 {
+		if len(p) < remaining {
+			remaining = len(p)
+		}
+		w.body.Write(p[:remaining])
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush 支持流式响应
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap 供 http.ResponseController 获取底层的 ResponseWriter
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status 返回响应状态码，处理程序未写入任何内容时为 200
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MigrationConfig 结构用于配置迁移期间的双写模式：data 目录为新后端，OldDir 为旧后端
+type MigrationConfig struct {
+	// OldDir 旧后端的数据目录（如旧的 NFS 挂载点），为空时不启用双写
+	OldDir string `json:"old_dir"`
+}
+
+// Migration 结构用于在迁移期间将写操作同步到旧后端，读取时优先读取新后端，不存在时回退到旧后端
+type Migration struct {
+	oldDir string
+}
+
+// migration 未启用双写时为 nil
+var migration *Migration
+
+// NewMigration 创建双写模式，旧后端目录必须存在
+func NewMigration(config MigrationConfig) (*Migration, error) {
+	if config.OldDir == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(config.OldDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: config.OldDir, Err: fs.ErrInvalid}
+	}
+	return &Migration{oldDir: config.OldDir}, nil
+}
+
+// oldPath 返回文件在旧后端中的路径
+func (m *Migration) oldPath(key string) string {
+	return filepath.Join(m.oldDir, filepath.FromSlash(key))
+}
+
+// statReadPath 返回读取 path 时使用的完整路径和文件信息，新后端不存在时回退到旧后端，
+// 已移动到归档层的文件从归档层读取
+func statReadPath(path string) (string, os.FileInfo, error) {
+	fullPath := filepath.Join("data", path)
+	fileInfo, err := os.Stat(fullPath)
+	if !os.IsNotExist(err) {
+		return fullPath, fileInfo, err
+	}
+	if storageClasses != nil && storageClasses.config.ArchiveDir != "" {
+		archivePath := storageClasses.archivePath(indexKey(path))
+		if archiveInfo, archiveErr := os.Stat(archivePath); archiveErr == nil {
+			return archivePath, archiveInfo, nil
+		}
+	}
+	if migration == nil {
+		return fullPath, fileInfo, err
+	}
+	oldPath := migration.oldPath(indexKey(path))
+	oldInfo, oldErr := os.Stat(oldPath)
+	if oldErr != nil {
+		return fullPath, fileInfo, err
+	}
+	return oldPath, oldInfo, nil
+}
+
+// Mirror 将新后端中已写入的文件复制到旧后端，先写入临时文件再重命名，避免旧后端出现不完整的文件
+func (m *Migration) Mirror(key string, fullPath string) error {
+	if m == nil {
+		return nil
+	}
+	target := m.oldPath(key)
+	err := os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer func(src *os.File) {
+		err := src.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(src)
+
+	tmp, err := createTempFile(target, "mirror-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Remove 删除旧后端中的文件或目录
+func (m *Migration) Remove(key string) error {
+	if m == nil || key == "" {
+		return nil
+	}
+	return os.RemoveAll(m.oldPath(key))
+}
+
+// MigrationReport 结构表示新旧后端的一致性报告
+type MigrationReport struct {
+	NewFiles   int `json:"new_files"`
+	OldFiles   int `json:"old_files"`
+	Consistent int `json:"consistent"`
+	// OnlyInNew 为只存在于新后端的文件，OnlyInOld 为尚未迁移的文件
+	OnlyInNew []string `json:"only_in_new"`
+	OnlyInOld []string `json:"only_in_old"`
+	// Mismatched 为两边大小或内容不一致的文件
+	Mismatched []MigrationMismatch `json:"mismatched"`
+	// Truncated 表示列表超过上限被截断，计数仍然准确
+	Truncated bool `json:"truncated"`
+}
+
+// MigrationMismatch 结构表示新旧后端不一致的文件
+type MigrationMismatch struct {
+	Path    string `json:"path"`
+	NewSize int64  `json:"new_size"`
+	OldSize int64  `json:"old_size"`
+	// NewSHA256 和 OldSHA256 只在比较内容时返回
+	NewSHA256 string `json:"new_sha256,omitempty"`
+	OldSHA256 string `json:"old_sha256,omitempty"`
+}
+
+// migrationReportLimit 是报告中每个列表最多返回的条目数
+const migrationReportLimit = 1000
+
+// walkFiles 返回 root 下所有文件的大小，不包括内部目录
+func walkFiles(root string) (map[string]int64, error) {
+	files := map[string]int64{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if reservedNames[key] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// 跳过双写时未完成的临时文件
+		if strings.HasPrefix(d.Name(), ".mirror-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[key] = info.Size()
+		return nil
+	})
+	return files, err
+}
+
+// Report 比较新旧后端中的文件，withHash 为 true 时还会比较大小相同的文件的内容
+func (m *Migration) Report(withHash bool) (MigrationReport, error) {
+	report := MigrationReport{OnlyInNew: []string{}, OnlyInOld: []string{}, Mismatched: []MigrationMismatch{}}
+	newFiles, err := walkFiles("data")
+	if err != nil {
+		return report, err
+	}
+	oldFiles, err := walkFiles(m.oldDir)
+	if err != nil {
+		return report, err
+	}
+	report.NewFiles, report.OldFiles = len(newFiles), len(oldFiles)
+
+	for key, newSize := range newFiles {
+		oldSize, ok := oldFiles[key]
+		if !ok {
+			report.OnlyInNew = appendLimited(report.OnlyInNew, key, &report.Truncated)
+			continue
+		}
+		mismatch := MigrationMismatch{Path: key, NewSize: newSize, OldSize: oldSize}
+		if newSize == oldSize && withHash {
+			newSum, err := fileChecksum(filepath.Join("data", key), false)
+			if err != nil {
+				return report, err
+			}
+			oldSum, err := fileChecksum(m.oldPath(key), false)
+			if err != nil {
+				return report, err
+			}
+			mismatch.NewSHA256, mismatch.OldSHA256 = newSum.SHA256, oldSum.SHA256
+		}
+		if newSize == oldSize && mismatch.NewSHA256 == mismatch.OldSHA256 {
+			report.Consistent++
+			continue
+		}
+		if len(report.Mismatched) < migrationReportLimit {
+			report.Mismatched = append(report.Mismatched, mismatch)
+		} else {
+			report.Truncated = true
+		}
+	}
+	for key := range oldFiles {
+		if _, ok := newFiles[key]; !ok {
+			report.OnlyInOld = appendLimited(report.OnlyInOld, key, &report.Truncated)
+		}
+	}
+	return report, nil
+}
+
+// appendLimited 在列表未达到上限时追加，否则标记为已截断
+func appendLimited(list []string, value string, truncated *bool) []string {
+	if len(list) >= migrationReportLimit {
+		*truncated = true
+		return list
+	}
+	return append(list, value)
+}
+
+// 查看新旧后端的一致性报告，hash=1 时比较文件内容
+func migrationReportHandler(w http.ResponseWriter, r *http.Request) {
+	if migration == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用双写模式", nil, r.URL.Path)
+		return
+	}
+	report, err := migration.Report(r.URL.Query().Get("hash") == "1")
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "生成一致性报告失败", err, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", report, nil, r.URL.Path)
+}
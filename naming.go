@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// namingKeep 使用客户端提供的文件名
+	namingKeep = "keep"
+	// namingUUID 使用随机的 UUID 作为文件名，保留扩展名
+	namingUUID = "uuid"
+	// namingTimestamp 在客户端的文件名前加上接收时间
+	namingTimestamp = "timestamp"
+	// namingHash 使用内容的 SHA-256 作为文件名，保留扩展名，相同内容只保存一份
+	namingHash = "hash"
+)
+
+// NamingConfig 结构用于按目录配置上传文件的命名策略，解决不同设备上传同名文件时互相覆盖的问题
+type NamingConfig struct {
+	Rules []NamingRule `json:"rules"`
+}
+
+// NamingRule 结构是一个目录的命名策略
+type NamingRule struct {
+	// Prefix 按目录匹配并以最长的前缀为准
+	Prefix string `json:"prefix"`
+	// Strategy 为 keep、uuid、timestamp 或 hash
+	Strategy string `json:"strategy"`
+}
+
+// UploadNaming 结构按目录选择上传文件的命名策略
+type UploadNaming struct {
+	// rules 按前缀从长到短排列
+	rules []NamingRule
+}
+
+// uploadNaming 未配置命名策略时为 nil，所有上传使用客户端的文件名
+var uploadNaming *UploadNaming
+
+// validNamingStrategy 判断是否为支持的命名策略
+func validNamingStrategy(strategy string) bool {
+	switch strategy {
+	case namingKeep, namingUUID, namingTimestamp, namingHash:
+		return true
+	}
+	return false
+}
+
+// NewUploadNaming 检查命名规则，未配置时返回 nil
+func NewUploadNaming(config NamingConfig) (*UploadNaming, error) {
+	if len(config.Rules) == 0 {
+		return nil, nil
+	}
+	rules := make([]NamingRule, 0, len(config.Rules))
+	for _, rule := range config.Rules {
+		if !validNamingStrategy(rule.Strategy) {
+			return nil, fmt.Errorf("%s 的命名策略 %q 无效，应为 keep、uuid、timestamp 或 hash", rule.Prefix, rule.Strategy)
+		}
+		rule.Prefix = indexKey(rule.Prefix)
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+	return &UploadNaming{rules: rules}, nil
+}
+
+// Strategy 返回上传到 key 时使用的命名策略，没有匹配的规则时为 keep
+func (n *UploadNaming) Strategy(key string) string {
+	if n == nil {
+		return namingKeep
+	}
+	for _, rule := range n.rules {
+		if rule.Prefix == "" || key == rule.Prefix || strings.HasPrefix(key, rule.Prefix+"/") {
+			return rule.Strategy
+		}
+	}
+	return namingKeep
+}
+
+// nameExtension 返回文件名的扩展名，.tar.gz 等压缩的归档包保留两段
+func nameExtension(name string) string {
+	ext := path.Ext(name)
+	if ext == name {
+		// .bashrc 等以点开头的文件没有扩展名
+		return ""
+	}
+	if inner := path.Ext(strings.TrimSuffix(name, ext)); strings.EqualFold(inner, ".tar") {
+		return inner + ext
+	}
+	return ext
+}
+
+// newUUID 生成随机的 UUID（版本 4）
+func newUUID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+// assignName 按命名策略返回保存的路径，目录保持不变；hash 策略需要内容的 sha256
+func assignName(key string, strategy string, now time.Time, sha256 string) (string, error) {
+	dir, name := path.Split(key)
+	switch strategy {
+	case namingUUID:
+		id, err := newUUID()
+		if err != nil {
+			return "", err
+		}
+		name = id + nameExtension(name)
+	case namingTimestamp:
+		name = now.UTC().Format("20060102T150405.000Z") + "-" + name
+	case namingHash:
+		name = sha256 + nameExtension(name)
+	}
+	return dir + name, nil
+}
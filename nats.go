@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// natsInfo 是 NATS 服务器在连接后发送的 INFO 中用到的字段
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// natsPublisher 通过 NATS 的文本协议发布事件，支持 headers 的服务器使用 HPUB 并带上 Nats-Msg-Id，
+// 发布到 JetStream 的 subject 时由服务器按事件 ID 去重
+type natsPublisher struct {
+	config  EventBusConfig
+	timeout time.Duration
+
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	info   natsInfo
+	// next 为下次连接时首先尝试的服务器
+	next int
+}
+
+func newNATSPublisher(config EventBusConfig) *natsPublisher {
+	return &natsPublisher{config: config, timeout: time.Duration(config.Timeout) * time.Second}
+}
+
+// connect 依次尝试配置的服务器，完成 TLS 升级和 CONNECT
+func (p *natsPublisher) connect() error {
+	var lastErr error
+	for i := range p.config.Servers {
+		server := p.config.Servers[(p.next+i)%len(p.config.Servers)]
+		err := p.dial(server)
+		if err == nil {
+			return nil
+		}
+		lastErr = fmt.Errorf("%s: %w", server, err)
+		p.Close()
+	}
+	p.next++
+	return lastErr
+}
+
+func (p *natsPublisher) dial(server string) error {
+	conn, err := net.DialTimeout("tcp", server, p.timeout)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	_ = conn.SetDeadline(time.Now().Add(p.timeout))
+	p.reader = bufio.NewReader(conn)
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("NATS 服务器返回 %q", strings.TrimSpace(line))
+	}
+	p.info = natsInfo{}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &p.info)
+	if err != nil {
+		return err
+	}
+	if p.config.TLS || p.info.TLSRequired {
+		host, _, _ := net.SplitHostPort(server)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		err = tlsConn.Handshake()
+		if err != nil {
+			return err
+		}
+		p.conn = tlsConn
+		p.reader = bufio.NewReader(tlsConn)
+	}
+	p.writer = bufio.NewWriter(p.conn)
+
+	connect, err := json.Marshal(map[string]any{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": p.config.TLS || p.info.TLSRequired,
+		"name":         "store_go",
+		"lang":         "go",
+		"version":      "1",
+		"protocol":     1,
+		"headers":      p.info.Headers,
+		"auth_token":   p.config.Token,
+		"user":         p.config.User,
+		"pass":         p.config.Password,
+	})
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(p.writer, "CONNECT %s\r\n", connect)
+	// 认证失败时服务器在 PONG 之前返回 -ERR
+	return p.flush()
+}
+
+// flush 发送 PING 并等待 PONG，收到 PONG 时之前发送的消息都已被服务器处理
+func (p *natsPublisher) flush() error {
+	_, _ = p.writer.WriteString("PING\r\n")
+	err := p.writer.Flush()
+	if err != nil {
+		return err
+	}
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			_, _ = p.writer.WriteString("PONG\r\n")
+			err = p.writer.Flush()
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("NATS 服务器返回 " + line)
+		}
+		// +OK 和 INFO 无需处理
+	}
+}
+
+func (p *natsPublisher) Publish(events []BusEvent) error {
+	if p.conn == nil {
+		err := p.connect()
+		if err != nil {
+			return err
+		}
+	}
+	_ = p.conn.SetDeadline(time.Now().Add(p.timeout))
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if p.info.MaxPayload > 0 && len(payload) > p.info.MaxPayload {
+			return fmt.Errorf("事件 %s 超过服务器的 max_payload", event.ID)
+		}
+		if p.info.Headers {
+			header := "NATS/1.0\r\nNats-Msg-Id: " + event.ID + "\r\n\r\n"
+			_, _ = fmt.Fprintf(p.writer, "HPUB %s %d %d\r\n%s%s\r\n", p.config.Topic, len(header), len(header)+len(payload), header, payload)
+		} else {
+			_, _ = fmt.Fprintf(p.writer, "PUB %s %d\r\n%s\r\n", p.config.Topic, len(payload), payload)
+		}
+	}
+	err := p.flush()
+	if err != nil {
+		p.Close()
+	}
+	return err
+}
+
+func (p *natsPublisher) Close() {
+	if p.conn != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ociManifestType 是 OCI 镜像清单的媒体类型
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	// ociArtifactType 标识由 oci-push 打包的目录
+	ociArtifactType = "application/vnd.store-go.tree.v1"
+	// ociLayerType 是目录内容的 tar+gzip 层
+	ociLayerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	// ociEmptyType 是制品不需要配置时使用的空配置，内容为 {}
+	ociEmptyType = "application/vnd.oci.empty.v1+json"
+	// ociPathAnnotation 记录打包的存储路径，oci-pull 未指定 -path 时恢复到该目录
+	ociPathAnnotation = "io.store-go.path"
+	// ociSHA256Record 是 tar 条目中记录文件 SHA-256 的 PAX 扩展头，拉取时由目标实例校验
+	ociSHA256Record = "STOREGO.sha256"
+)
+
+// ociEmptyConfig 是空配置的内容
+var ociEmptyConfig = []byte("{}")
+
+// ociDescriptor 是 OCI 内容描述符
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest 是 OCI 镜像清单，只使用制品需要的字段
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociReference 是解析后的制品引用，如 registry.example.com/datasets/images:v1
+type ociReference struct {
+	registry   string
+	repository string
+	// reference 为标签或 sha256: 开头的摘要
+	reference string
+}
+
+// parseOCIReference 解析 registry/repository[:tag|@digest]，未指定标签时使用 latest
+func parseOCIReference(ref string) (ociReference, error) {
+	registry, rest, ok := strings.Cut(ref, "/")
+	if !ok || registry == "" || rest == "" {
+		return ociReference{}, fmt.Errorf("制品引用 %s 需要包含仓库地址，如 registry.example.com/repo:tag", ref)
+	}
+	result := ociReference{registry: registry, reference: "latest"}
+	if repository, digest, ok := strings.Cut(rest, "@"); ok {
+		result.repository = repository
+		result.reference = digest
+	} else if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		result.repository = rest[:i]
+		result.reference = rest[i+1:]
+	} else {
+		result.repository = rest
+	}
+	if result.repository == "" || result.reference == "" {
+		return ociReference{}, fmt.Errorf("无效的制品引用 %s", ref)
+	}
+	return result, nil
+}
+
+// ociRegistry 是只实现了推送和拉取制品所需接口的 OCI Distribution 客户端，
+// 支持 Bearer token 认证（通过 WWW-Authenticate 获取 token）和 Basic 认证
+type ociRegistry struct {
+	baseURL    string
+	repository string
+	username   string
+	password   string
+	client     *http.Client
+	// authorization 为认证后使用的 Authorization 请求头
+	authorization string
+}
+
+// newOCIRegistry 创建访问制品所在仓库的客户端，plainHTTP 为 true 时使用 http
+func newOCIRegistry(ref ociReference, username string, password string, plainHTTP bool) *ociRegistry {
+	scheme := "https"
+	if plainHTTP {
+		scheme = "http"
+	}
+	return &ociRegistry{
+		baseURL:    scheme + "://" + ref.registry + "/v2/" + ref.repository,
+		repository: ref.repository,
+		username:   username,
+		password:   password,
+		client:     &http.Client{Timeout: time.Hour},
+	}
+}
+
+// do 发送请求，返回 401 时按 WWW-Authenticate 认证后重新发送一次；
+// newRequest 每次创建新的请求，请求体可以重新读取
+func (c *ociRegistry) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		err = c.authenticate(challenge)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate 按 WWW-Authenticate 认证：Basic 时直接使用用户名和密码，Bearer 时向 realm 请求 token
+func (c *ociRegistry) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" && c.password == "" {
+			return errors.New("仓库需要认证，请指定 -username 和 -password")
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(c.username, c.password)
+		c.authorization = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("不支持的认证方式 %q", challenge)
+	}
+
+	values := parseAuthParams(params)
+	realm, err := url.Parse(values["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("无效的认证地址 %q", values["realm"])
+	}
+	query := realm.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	scope := values["scope"]
+	if scope == "" {
+		scope = "repository:" + c.repository + ":pull,push"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("获取仓库 token 返回 %s %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return errors.New("仓库没有返回 token")
+	}
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// parseAuthParams 解析 realm="...",service="...",scope="..." 形式的认证参数
+func parseAuthParams(params string) map[string]string {
+	values := map[string]string{}
+	for params != "" {
+		name, rest, ok := strings.Cut(strings.TrimLeft(params, " ,"), "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		values[strings.ToLower(strings.TrimSpace(name))] = value
+		params = rest
+	}
+	return values
+}
+
+// checkRegistryResponse 在状态码不是 expected 时返回仓库的错误信息并关闭响应体
+func checkRegistryResponse(resp *http.Response, action string, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	_ = resp.Body.Close()
+	return fmt.Errorf("%s 返回 %s %s", action, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// PushBlob 上传 blob，仓库中已存在相同摘要时跳过；open 每次返回从头读取的内容
+func (c *ociRegistry) PushBlob(digest string, size int64, open func() (io.ReadCloser, error)) error {
+	resp, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, c.baseURL+"/blobs/"+digest, nil)
+	})
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = c.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, c.baseURL+"/blobs/uploads/", nil)
+	})
+	if err != nil {
+		return err
+	}
+	err = checkRegistryResponse(resp, "开始上传 blob", http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	resp, err = c.do(func() (*http.Request, error) {
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPut, location.String(), body)
+		if err != nil {
+			_ = body.Close()
+			return nil, err
+		}
+		req.ContentLength = size
+		if size == 0 {
+			_ = body.Close()
+			req.Body = http.NoBody
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	err = checkRegistryResponse(resp, "上传 blob", http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// PushManifest 上传清单并打上标签，返回清单的摘要
+func (c *ociRegistry) PushManifest(reference string, manifest []byte) (string, error) {
+	resp, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, c.baseURL+"/manifests/"+reference, bytes.NewReader(manifest))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", ociManifestType)
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	err = checkRegistryResponse(resp, "上传清单", http.StatusCreated, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	return ociDigest(manifest), nil
+}
+
+// FetchManifest 获取清单，返回清单和它的摘要；引用为摘要时校验内容
+func (c *ociRegistry) FetchManifest(reference string) (ociManifest, string, error) {
+	var manifest ociManifest
+	resp, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, c.baseURL+"/manifests/"+reference, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ociManifestType)
+		return req, nil
+	})
+	if err != nil {
+		return manifest, "", err
+	}
+	err = checkRegistryResponse(resp, "获取清单", http.StatusOK)
+	if err != nil {
+		return manifest, "", err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return manifest, "", err
+	}
+	digest := ociDigest(data)
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		return manifest, "", fmt.Errorf("清单摘要 %s 与引用 %s 不一致", digest, reference)
+	}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return manifest, "", err
+	}
+	return manifest, digest, nil
+}
+
+// FetchBlob 下载 blob 到 w 并校验摘要和大小
+func (c *ociRegistry) FetchBlob(descriptor ociDescriptor, w io.Writer) error {
+	resp, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.baseURL+"/blobs/"+descriptor.Digest, nil)
+	})
+	if err != nil {
+		return err
+	}
+	err = checkRegistryResponse(resp, "下载 blob", http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), io.LimitReader(resp.Body, descriptor.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != descriptor.Size {
+		return fmt.Errorf("blob %s 大小为 %d，清单中为 %d", descriptor.Digest, n, descriptor.Size)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != descriptor.Digest {
+		return fmt.Errorf("blob 摘要 %s 与清单中的 %s 不一致", digest, descriptor.Digest)
+	}
+	return nil
+}
+
+func ociDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ociCredentialFlags 注册仓库认证的参数，密码为空时读取 STORE_OCI_PASSWORD 环境变量
+func ociCredentialFlags(flags *flag.FlagSet) (username *string, password *string, plainHTTP *bool) {
+	username = flags.String("username", "", "仓库用户名")
+	password = flags.String("password", "", "仓库密码或访问 token，为空时读取 STORE_OCI_PASSWORD 环境变量")
+	plainHTTP = flags.Bool("plain-http", false, "使用 http 访问仓库")
+	return username, password, plainHTTP
+}
+
+// ociPushCommand 将一个目录打包为 OCI 制品推送到镜像仓库
+func ociPushCommand(args []string) int {
+	flags := flag.NewFlagSet("oci-push", flag.ContinueOnError)
+	from := flags.String("from", "local", "源实例地址，local 表示当前目录下的 data 目录")
+	token := flags.String("token", "", "源实例的 token，为空时读取 config.json")
+	prefix := flags.String("path", "", "打包的目录，为空时打包全部文件")
+	username, password, plainHTTP := ociCredentialFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "用法: oci-push [-from <实例地址>] -path <目录> <仓库地址/仓库名:标签>\n")
+		return 2
+	}
+	ref, err := parseOCIReference(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+	if strings.HasPrefix(ref.reference, "sha256:") {
+		fmt.Fprintf(os.Stderr, "Error: 推送时需要指定标签\n")
+		return 2
+	}
+	if *password == "" {
+		*password = os.Getenv("STORE_OCI_PASSWORD")
+	}
+
+	local := *from == "local"
+	if local || *token == "" {
+		config, err := LoadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			return 1
+		}
+		if *token == "" {
+			*token = config.Token
+		}
+		if local && config.Encryption.Enabled {
+			encryptor, err = NewEncryptor(config.Encryption)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: 无法启用静态加密 %s\n", err)
+				return 1
+			}
+		}
+	}
+	var source syncStore = localSyncStore{}
+	if !local {
+		source = newRemoteSyncStore(*from, *token, time.Hour)
+	}
+	root := indexKey(*prefix)
+	keys, err := source.Files(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 列出源文件失败 %s\n", err)
+		return 1
+	}
+	if len(keys) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: %s 中没有文件\n", root)
+		return 1
+	}
+	sort.Strings(keys)
+
+	// 层需要先算出摘要才能上传，打包到临时文件
+	layerFile, err := os.CreateTemp("", "store-oci-*.tar.gz")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(layerFile.Name())
+	layerHash := sha256.New()
+	var total int64
+	err = writeOCILayer(io.MultiWriter(layerFile, layerHash), source, root, keys, &total)
+	if err == nil {
+		err = layerFile.Close()
+	} else {
+		_ = layerFile.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 打包失败 %s\n", err)
+		return 1
+	}
+	info, err := os.Stat(layerFile.Name())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	layer := ociDescriptor{
+		MediaType: ociLayerType,
+		Digest:    "sha256:" + hex.EncodeToString(layerHash.Sum(nil)),
+		Size:      info.Size(),
+		Annotations: map[string]string{
+			"org.opencontainers.image.title": path.Base("/"+root) + ".tar.gz",
+		},
+	}
+	config := ociDescriptor{MediaType: ociEmptyType, Digest: ociDigest(ociEmptyConfig), Size: int64(len(ociEmptyConfig))}
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		ArtifactType:  ociArtifactType,
+		Config:        config,
+		Layers:        []ociDescriptor{layer},
+		Annotations: map[string]string{
+			"org.opencontainers.image.created": time.Now().UTC().Format(time.RFC3339),
+			ociPathAnnotation:                  root,
+			"io.store-go.files":                strconv.Itoa(len(keys)),
+			"io.store-go.size":                 strconv.FormatInt(total, 10),
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	registry := newOCIRegistry(ref, *username, *password, *plainHTTP)
+	err = registry.PushBlob(config.Digest, config.Size, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(ociEmptyConfig)), nil
+	})
+	if err == nil {
+		err = registry.PushBlob(layer.Digest, layer.Size, func() (io.ReadCloser, error) {
+			return os.Open(layerFile.Name())
+		})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 上传 blob 失败 %s\n", err)
+		return 1
+	}
+	digest, err := registry.PushManifest(ref.reference, manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("已推送 %d 个文件（%d 字节，压缩后 %d 字节）到 %s/%s:%s@%s\n",
+		len(keys), total, layer.Size, ref.registry, ref.repository, ref.reference, digest)
+	return 0
+}
+
+// writeOCILayer 将文件按相对 root 的路径写入 tar+gzip 层，每个条目在 PAX 扩展头中记录 SHA-256。
+// 条目的修改时间固定为 0，相同的内容打包出相同的层，仓库中不会重复存储
+func writeOCILayer(w io.Writer, source syncStore, root string, keys []string, total *int64) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, key := range keys {
+		// tar 头中需要文件大小，已加密或压缩的文件读取后才知道，先读入临时文件
+		size, sum, content, err := spoolFile(source, key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		name := key
+		if root != "" {
+			name = strings.TrimPrefix(key, root+"/")
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       name,
+			Size:       size,
+			Mode:       0644,
+			ModTime:    time.Unix(0, 0),
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{ociSHA256Record: sum},
+		})
+		if err == nil {
+			_, err = io.Copy(tw, content)
+		}
+		_ = content.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		*total += size
+	}
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// spoolFile 将文件内容读入临时文件，返回大小、SHA-256 和从头读取的内容，关闭时删除临时文件
+func spoolFile(source syncStore, key string) (int64, string, io.ReadCloser, error) {
+	content, err := source.Open(key)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer func(content io.ReadCloser) {
+		_ = content.Close()
+	}(content)
+	tmp, err := os.CreateTemp("", "store-oci-file-*")
+	if err != nil {
+		return 0, "", nil, err
+	}
+	spooled := &removeOnClose{File: tmp}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), content)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = spooled.Close()
+		return 0, "", nil, err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), spooled, nil
+}
+
+// removeOnClose 是关闭时删除的临时文件
+type removeOnClose struct {
+	*os.File
+}
+
+func (f *removeOnClose) Close() error {
+	err := f.File.Close()
+	_ = os.Remove(f.Name())
+	return err
+}
+
+// ociPullCommand 从镜像仓库拉取 oci-push 推送的制品，上传到实例的目录中
+func ociPullCommand(args []string) int {
+	flags := flag.NewFlagSet("oci-pull", flag.ContinueOnError)
+	to := flags.String("to", "", "目标实例地址")
+	token := flags.String("token", "", "目标实例的 token，为空时读取 config.json")
+	prefix := flags.String("path", "", "恢复到的目录，为空时恢复到推送时的目录")
+	username, password, plainHTTP := ociCredentialFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *to == "" || flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "用法: oci-pull -to <实例地址> [-path <目录>] <仓库地址/仓库名:标签或@摘要>\n")
+		return 2
+	}
+	ref, err := parseOCIReference(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+	if *password == "" {
+		*password = os.Getenv("STORE_OCI_PASSWORD")
+	}
+	if *token == "" {
+		config, err := LoadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			return 1
+		}
+		*token = config.Token
+	}
+
+	registry := newOCIRegistry(ref, *username, *password, *plainHTTP)
+	manifest, digest, err := registry.FetchManifest(ref.reference)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	if manifest.ArtifactType != ociArtifactType || len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != ociLayerType {
+		fmt.Fprintf(os.Stderr, "Error: %s 不是 oci-push 推送的制品\n", flags.Arg(0))
+		return 1
+	}
+	root := manifest.Annotations[ociPathAnnotation]
+	if *prefix != "" {
+		root = *prefix
+	}
+	root = indexKey(root)
+
+	// 先下载并校验整个层，摘要不一致时不写入任何文件
+	layerFile, err := os.CreateTemp("", "store-oci-*.tar.gz")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}(layerFile)
+	err = registry.FetchBlob(manifest.Layers[0], layerFile)
+	if err == nil {
+		_, err = layerFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 下载失败 %s\n", err)
+		return 1
+	}
+
+	target := newRemoteSyncStore(*to, *token, time.Hour)
+	count, err := extractOCILayer(layerFile, target, root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 已恢复 %d 个文件，%s\n", count, err)
+		return 1
+	}
+	fmt.Printf("已从 %s/%s@%s 恢复 %d 个文件到 /%s\n", ref.registry, ref.repository, digest, count, root)
+	return 0
+}
+
+// extractOCILayer 将层中的文件逐个上传到 root 目录，由目标实例校验 SHA-256，返回上传的文件数；
+// 只接受普通文件，路径不能是绝对路径或包含 ..。上传失败时停止，已上传的文件保留，重新执行会覆盖
+func extractOCILayer(r io.Reader, target *remoteSyncStore, root string) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+	count := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		name := header.Name
+		if header.Typeflag != tar.TypeReg || name == "" || strings.HasPrefix(name, "/") || path.Clean(name) != name ||
+			name == ".." || strings.HasPrefix(name, "../") {
+			return count, fmt.Errorf("制品中包含不安全的条目 %q", header.Name)
+		}
+		key := name
+		if root != "" {
+			key = root + "/" + name
+		}
+		if isReservedPath(key) {
+			return count, fmt.Errorf("制品中包含保留路径 %q", header.Name)
+		}
+		sum := header.PAXRecords[ociSHA256Record]
+		if sum == "" {
+			return count, fmt.Errorf("条目 %q 缺少 SHA-256", header.Name)
+		}
+		err = target.Upload(key, tr, sum)
+		if err != nil {
+			return count, fmt.Errorf("上传 %s 失败 %s", key, err)
+		}
+		count++
+	}
+}
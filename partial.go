@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PartialConfig 结构用于配置 .part 上传约定：上传到 name.part 的文件暂存在元数据目录中，不出现在列表和搜索中，
+// 调用 /finalize 或上传空的标记文件 name.done 后原子地保存为 name，读取方不会读到未写完的文件
+type PartialConfig struct {
+	Enabled bool `json:"enabled"`
+	// Suffix 暂存文件的后缀，默认 .part
+	Suffix string `json:"suffix"`
+	// MarkerSuffix 标记文件的后缀，默认 .done；为 - 时不使用标记文件，只能调用 /finalize
+	MarkerSuffix string `json:"marker_suffix"`
+	// ExpireHours 暂存文件未完成时保留的时间，单位小时，默认 24
+	ExpireHours int `json:"expire_hours"`
+}
+
+// PartialUpload 结构是一个暂存的 .part 文件，Path 为暂存文件的路径，Target 为完成后的路径
+type PartialUpload struct {
+	Path     string    `json:"path"`
+	Target   string    `json:"target"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	MD5      string    `json:"md5,omitempty"`
+	StagedBy string    `json:"staged_by,omitempty"`
+	StagedAt time.Time `json:"staged_at"`
+}
+
+var errPartialNotFound = errors.New("暂存文件不存在或已完成")
+
+// PartialUploads 结构保存暂存的 .part 文件，文件位于 data/.meta/partial 下，记录保存在 data/.meta/partial.json
+type PartialUploads struct {
+	dir    string
+	file   string
+	suffix string
+	marker string
+	expire time.Duration
+
+	mu    sync.Mutex
+	items map[string]*PartialUpload
+	// saveMu 保证记录按修改的顺序写入，较早的快照不会覆盖较新的
+	saveMu sync.Mutex
+	// finalized 和 expired 为已完成和过期删除的暂存文件数，用于监控指标
+	finalized int64
+	expired   int64
+}
+
+// partialUploads 未启用 .part 约定时为 nil，name.part 作为普通文件保存
+var partialUploads *PartialUploads
+
+// OpenPartialUploads 加载暂存文件的记录，未启用时返回 nil
+func OpenPartialUploads(dir string, file string, config PartialConfig) (*PartialUploads, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	if config.Suffix == "" {
+		config.Suffix = ".part"
+	}
+	if config.MarkerSuffix == "" {
+		config.MarkerSuffix = ".done"
+	} else if config.MarkerSuffix == "-" {
+		config.MarkerSuffix = ""
+	}
+	if !strings.HasPrefix(config.Suffix, ".") || (config.MarkerSuffix != "" && !strings.HasPrefix(config.MarkerSuffix, ".")) {
+		return nil, fmt.Errorf("upload.partial 的后缀应以 . 开头")
+	}
+	if config.Suffix == config.MarkerSuffix {
+		return nil, fmt.Errorf("upload.partial 的 suffix 和 marker_suffix 不能相同")
+	}
+	if config.ExpireHours <= 0 {
+		config.ExpireHours = 24
+	}
+	p := &PartialUploads{
+		dir:    dir,
+		file:   file,
+		suffix: config.Suffix,
+		marker: config.MarkerSuffix,
+		expire: time.Duration(config.ExpireHours) * time.Hour,
+		items:  map[string]*PartialUpload{},
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &p.items)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Staged 判断路径是否为需要暂存的 .part 文件
+func (p *PartialUploads) Staged(key string) bool {
+	return p != nil && strings.HasSuffix(key, p.suffix) && path.Base(key) != p.suffix
+}
+
+// Marker 判断路径是否为标记文件，返回对应的暂存文件路径
+func (p *PartialUploads) Marker(key string) (string, bool) {
+	if p == nil || p.marker == "" || !strings.HasSuffix(key, p.marker) || path.Base(key) == p.marker {
+		return "", false
+	}
+	return strings.TrimSuffix(key, p.marker) + p.suffix, true
+}
+
+// Target 返回暂存文件和标记文件完成后的路径，其他路径原样返回；用于按最终的路径检查文件类型、一次写入等规则，
+// 以及在集群模式下将暂存文件和最终的文件放在同一个节点
+func (p *PartialUploads) Target(key string) string {
+	if p.Staged(key) {
+		return strings.TrimSuffix(key, p.suffix)
+	}
+	if part, ok := p.Marker(key); ok {
+		return strings.TrimSuffix(part, p.suffix)
+	}
+	return key
+}
+
+// stagedPath 返回暂存文件在磁盘上的路径
+func (p *PartialUploads) stagedPath(key string) string {
+	return filepath.Join(p.dir, filepath.FromSlash(key))
+}
+
+// Stage 将已写完的临时文件移动到暂存目录，同一路径再次上传时覆盖之前的暂存文件
+func (p *PartialUploads) Stage(tmpPath string, result UploadResult, stagedBy string) (PartialUpload, error) {
+	item := PartialUpload{
+		Path:     result.Path,
+		Target:   p.Target(result.Path),
+		Size:     result.Size,
+		SHA256:   result.SHA256,
+		MD5:      result.MD5,
+		StagedBy: stagedBy,
+		StagedAt: time.Now(),
+	}
+	staged := p.stagedPath(item.Path)
+	err := os.MkdirAll(filepath.Dir(staged), os.ModePerm)
+	if err != nil {
+		return item, err
+	}
+	err = os.Rename(tmpPath, staged)
+	if err != nil {
+		return item, err
+	}
+	p.mu.Lock()
+	p.items[item.Path] = &item
+	p.mu.Unlock()
+	return item, p.save()
+}
+
+// Item 返回暂存文件的记录
+func (p *PartialUploads) Item(key string) (PartialUpload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	item, ok := p.items[key]
+	if !ok {
+		return PartialUpload{}, false
+	}
+	return *item, true
+}
+
+// Remove 删除暂存文件及其记录，finalized 为 true 时暂存文件已被移动到最终的路径
+func (p *PartialUploads) Remove(key string, finalized bool) error {
+	staged := p.stagedPath(key)
+	err := os.Remove(staged)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// 删除暂存目录中已经为空的上级目录
+	for dir := filepath.Dir(staged); dir != p.dir && strings.HasPrefix(dir, p.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	p.mu.Lock()
+	delete(p.items, key)
+	if finalized {
+		p.finalized++
+	}
+	p.mu.Unlock()
+	return p.save()
+}
+
+// List 返回路径在 prefix 下的暂存文件，按暂存时间排列
+func (p *PartialUploads) List(prefix string) []PartialUpload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	items := []PartialUpload{}
+	for _, item := range p.items {
+		if prefix == "" || item.Path == prefix || strings.HasPrefix(item.Path, prefix+"/") {
+			items = append(items, *item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].StagedAt.Before(items[j].StagedAt)
+	})
+	return items
+}
+
+// save 保存暂存文件的记录，同一时间只有一个保存，后开始的保存写入的是更新的内容
+func (p *PartialUploads) save() error {
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	p.mu.Lock()
+	data, err := json.Marshal(p.items)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := p.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, p.file)
+}
+
+// Run 每小时删除超过保留时间仍未完成的暂存文件
+func (p *PartialUploads) Run() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		p.expireBefore(time.Now().Add(-p.expire))
+		<-ticker.C
+	}
+}
+
+// expireBefore 删除在 before 之前暂存的文件，正在写入或完成的路径留到下一次
+func (p *PartialUploads) expireBefore(before time.Time) {
+	for _, item := range p.List("") {
+		if !item.StagedAt.Before(before) {
+			continue
+		}
+		release, err := pathLocks.Lock(context.Background(), item.Path, "删除过期的暂存文件", false)
+		if err != nil {
+			continue
+		}
+		// 加锁期间可能已被重新上传或完成
+		current, ok := p.Item(item.Path)
+		if ok && current.StagedAt.Equal(item.StagedAt) {
+			err = p.Remove(item.Path, false)
+			if err != nil {
+				slog.Error("删除过期的暂存文件失败", "path", item.Path, "err", err)
+			} else {
+				p.mu.Lock()
+				p.expired++
+				p.mu.Unlock()
+				slog.Info("已删除过期的暂存文件", "path", item.Path, "staged_at", item.StagedAt)
+			}
+		}
+		release()
+	}
+}
+
+// writeMetrics 输出暂存中、已完成和过期删除的暂存文件数
+func (p *PartialUploads) writeMetrics(w io.Writer) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(w, "# HELP store_partial_uploads_staged Staged .part uploads waiting to be finalized.\n")
+	fmt.Fprintf(w, "# TYPE store_partial_uploads_staged gauge\n")
+	fmt.Fprintf(w, "store_partial_uploads_staged %d\n", len(p.items))
+	fmt.Fprintf(w, "# HELP store_partial_uploads_total Staged .part uploads by outcome.\n")
+	fmt.Fprintf(w, "# TYPE store_partial_uploads_total counter\n")
+	fmt.Fprintf(w, "store_partial_uploads_total{result=\"finalized\"} %d\n", p.finalized)
+	fmt.Fprintf(w, "store_partial_uploads_total{result=\"expired\"} %d\n", p.expired)
+}
+
+// stagePartialUpload 暂存上传的 .part 文件，不更新索引，也不触发复制、webhook 等后续处理
+func stagePartialUpload(w http.ResponseWriter, r *http.Request, tmpPath string, result UploadResult) {
+	item, err := partialUploads.Stage(tmpPath, result, identityName(r))
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "暂存文件失败", err, r.URL.Path)
+		return
+	}
+	debugStage(r, "store")
+	slog.InfoContext(r.Context(), "已暂存文件", "path", item.Path, "target", item.Target, "size", item.Size)
+	sendContentResponse(w, http.StatusOK, "文件已暂存，完成后可见", item, nil, r.URL.Path)
+}
+
+// finalizePartialUpload 将暂存文件保存到最终的路径，之后与普通上传相同：检查文件类型、扫描病毒、检查配额、更新索引和通知；
+// 调用方已持有暂存文件路径的锁，这里再锁定最终的路径。被拒绝或失败时保留暂存文件，可以重试或等待过期删除
+func finalizePartialUpload(w http.ResponseWriter, r *http.Request, key string, ttl time.Duration, storageClass string) {
+	item, ok := partialUploads.Item(key)
+	if !ok {
+		sendJSONResponse(w, http.StatusNotFound, "暂存文件不存在或已完成", errPartialNotFound, r.URL.Path)
+		return
+	}
+	release := lockWritePath(w, r, item.Target, "完成上传", true)
+	if release == nil {
+		return
+	}
+	defer release()
+	if !checkWORM(w, r, item.Target) || !checkCatalogPublish(w, r, item.Target) {
+		return
+	}
+
+	newFilePath := filepath.Join("data", filepath.FromSlash(item.Target))
+	staged := partialUploads.stagedPath(key)
+	result := UploadResult{Path: item.Target, Size: item.Size, SHA256: item.SHA256, MD5: item.MD5}
+	storeUploadedFile(w, r, staged, newFilePath, result, ttl, storageClass)
+
+	// 暂存文件已被移动到最终的路径或隔离目录时删除记录
+	if _, err := os.Stat(staged); os.IsNotExist(err) {
+		err = partialUploads.Remove(key, true)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "删除暂存记录失败", "path", key, "err", err)
+		}
+	}
+}
+
+// FinalizeRequest 结构用于完成暂存文件，Path 可以是暂存文件 name.part 或最终的路径 name
+type FinalizeRequest struct {
+	Path string `json:"path"`
+}
+
+// 完成暂存文件，X-Expire-After 和 X-Storage-Class 等请求头与上传时相同
+func finalizeHandler(w http.ResponseWriter, r *http.Request) {
+	if partialUploads == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用 .part 上传", nil, r.URL.Path)
+		return
+	}
+	var request FinalizeRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Path == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	if isReservedPath(request.Path) || isUnsafePath(request.Path) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的路径参数", nil, r.URL.Path)
+		return
+	}
+	key := indexKey(request.Path)
+	if !partialUploads.Staged(key) {
+		key += partialUploads.suffix
+	}
+	ttl, err := parseTTL(r.Header.Get("X-Expire-After"))
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 X-Expire-After", err, r.URL.Path)
+		return
+	}
+	storageClass, err := storageClasses.ParseClass(r.Header.Get("X-Storage-Class"))
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 X-Storage-Class", err, r.URL.Path)
+		return
+	}
+	release := lockWritePath(w, r, key, "完成上传", true)
+	if release == nil {
+		return
+	}
+	defer release()
+	finalizePartialUpload(w, r, key, ttl, storageClass)
+}
+
+// 列出暂存中的文件
+func partialListHandler(w http.ResponseWriter, r *http.Request) {
+	if partialUploads == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用 .part 上传", nil, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", partialUploads.List(indexKey(r.URL.Query().Get("path"))), nil, r.URL.Path)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PolicyConfig 结构用于配置外部策略引擎
+type PolicyConfig struct {
+	// OPAURL 为 OPA 决策接口地址，如 http://127.0.0.1:8181/v1/data/store_go/allow
+	OPAURL string `json:"opa_url"`
+	// TimeoutMs 请求策略引擎的超时时间，单位毫秒，默认 500
+	TimeoutMs int `json:"timeout_ms"`
+	// FailOpen 策略引擎不可用时是否放行，默认拒绝
+	FailOpen bool `json:"fail_open"`
+	// DecisionLog 是否在日志中记录每次决策
+	DecisionLog bool `json:"decision_log"`
+}
+
+// PolicyInput 结构是提交给策略引擎的决策输入
+type PolicyInput struct {
+	Identity   *Identity         `json:"identity"`
+	Scope      string            `json:"scope"`
+	Action     string            `json:"action"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	RemoteAddr string            `json:"remote_addr"`
+	// TLS 为连接协商的 TLS 版本、密码套件和客户端证书，明文连接时为空
+	TLS *TLSInfo `json:"tls,omitempty"`
+}
+
+// PolicyEngine 是授权决策的接口
+type PolicyEngine interface {
+	Authorize(ctx context.Context, input PolicyInput) (bool, error)
+}
+
+// policyEngine 是全局的策略引擎，未配置时为 nil，只按权限范围授权
+var policyEngine PolicyEngine
+
+// OPAPolicy 将授权决策交给 OPA 边车
+type OPAPolicy struct {
+	cfg    PolicyConfig
+	client *http.Client
+}
+
+// NewOPAPolicy 创建 OPA 策略引擎
+func NewOPAPolicy(cfg PolicyConfig) *OPAPolicy {
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 500 * time.Millisecond
+	}
+	return &OPAPolicy{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Authorize 请求 OPA 决策，结果为 true 时放行
+func (p *OPAPolicy) Authorize(ctx context.Context, input PolicyInput) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.OPAURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	allowed, err := p.decide(req)
+	if err != nil {
+		slog.Error("策略引擎不可用", "err", err)
+		allowed = p.cfg.FailOpen
+	}
+	if p.cfg.DecisionLog {
+		slog.InfoContext(ctx, "policy", "identity", identityLabel(input.Identity), "method", input.Method, "action", input.Action, "path", input.Path, "allow", allowed)
+	}
+	return allowed, nil
+}
+
+func (p *OPAPolicy) decide(req *http.Request) (bool, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("OPA 返回 %s", resp.Status)
+	}
+
+	var result struct {
+		Result interface{} `json:"result"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return false, err
+	}
+	// 规则未定义时 result 缺失，视为拒绝
+	allowed, _ := result.Result.(bool)
+	return allowed, nil
+}
+
+func identityLabel(identity *Identity) string {
+	if identity == nil {
+		return "-"
+	}
+	return identity.Provider + ":" + identity.Name
+}
+
+// requestTargetPath 提取请求操作的文件路径，依次检查查询参数、上传请求头和 JSON 请求体
+// 读取请求体后会将其还原，处理程序可以照常解析
+func requestTargetPath(r *http.Request) string {
+	if path := r.URL.Query().Get("path"); path != "" {
+		return indexKey(path)
+	}
+	if path := r.Header.Get("X-FormFile-Path"); path != "" {
+		return indexKey(path)
+	}
+	if strings.HasPrefix(r.URL.Path, "/get/") {
+		return indexKey(strings.TrimPrefix(r.URL.Path, "/get/"))
+	}
+	if r.Body == nil || r.Method != http.MethodPost || strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+	var request struct {
+		Path string `json:"path"`
+	}
+	if json.Unmarshal(body, &request) != nil {
+		return ""
+	}
+	return indexKey(request.Path)
+}
+
+// authorizeRequest 在权限范围检查通过后，按策略引擎的决策授权
+func authorizeRequest(r *http.Request, identity *Identity, scope string) (bool, error) {
+	if policyEngine == nil {
+		return true, nil
+	}
+	input := PolicyInput{
+		Identity:   identity,
+		Scope:      scope,
+		Action:     r.URL.Path,
+		Method:     r.Method,
+		Path:       requestTargetPath(r),
+		Metadata:   uploadMetadata(r.Header),
+		RemoteAddr: r.RemoteAddr,
+		TLS:        requestTLSInfo(r),
+	}
+	return policyEngine.Authorize(r.Context(), input)
+}
+
+// authorizePath 按策略引擎的决策判断调用方能否以 scope 权限操作 key，用于请求中没有路径、
+// 操作的路径来自服务端记录的接口，如撤销删除；未配置策略引擎时总是允许，决策失败时拒绝
+func authorizePath(r *http.Request, scope string, key string) bool {
+	if policyEngine == nil {
+		return true
+	}
+	input := PolicyInput{
+		Identity:   identityFrom(r),
+		Scope:      scope,
+		Action:     r.URL.Path,
+		Method:     r.Method,
+		Path:       key,
+		RemoteAddr: r.RemoteAddr,
+		TLS:        requestTLSInfo(r),
+	}
+	allowed, err := policyEngine.Authorize(r.Context(), input)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "授权失败", "err", err, "path", key)
+		return false
+	}
+	return allowed
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProfilingConfig 结构用于配置性能分析接口，接口注册在管理接口上，需要 admin 权限；
+// 不使用 net/http/pprof 和 expvar，它们会在默认的 ServeMux 上注册不需要认证的接口
+type ProfilingConfig struct {
+	// Enabled 启用 /debug/pprof/ 和 /debug/vars
+	Enabled bool `json:"enabled"`
+	// MaxSeconds CPU 采样和执行跟踪的最长时间，单位秒，默认 60
+	MaxSeconds int `json:"max_seconds"`
+	// BlockProfileRate 和 MutexProfileFraction 为阻塞和锁竞争的采样率，默认 0 不采样，
+	// 含义同 runtime.SetBlockProfileRate 和 runtime.SetMutexProfileFraction
+	BlockProfileRate     int `json:"block_profile_rate"`
+	MutexProfileFraction int `json:"mutex_profile_fraction"`
+}
+
+// profileSummary 结构是 /debug/pprof/ 中的一项
+type profileSummary struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Path  string `json:"path"`
+}
+
+// Profiler 结构提供性能分析接口
+type Profiler struct {
+	maxSeconds int
+}
+
+// NewProfiler 创建性能分析接口，未启用时返回 nil
+func NewProfiler(config ProfilingConfig) *Profiler {
+	if !config.Enabled {
+		return nil
+	}
+	if config.MaxSeconds <= 0 {
+		config.MaxSeconds = 60
+	}
+	runtime.SetBlockProfileRate(config.BlockProfileRate)
+	runtime.SetMutexProfileFraction(config.MutexProfileFraction)
+	return &Profiler{maxSeconds: config.MaxSeconds}
+}
+
+// Register 在管理接口上注册 /debug/pprof/ 和 /debug/vars
+func (p *Profiler) Register(mux *http.ServeMux, auth AuthProvider) {
+	if p == nil {
+		return
+	}
+	mux.Handle("/debug/pprof/", AuthMiddleware(http.HandlerFunc(p.pprofHandler), auth, scopeAdmin))
+	mux.Handle("/debug/vars", AuthMiddleware(http.HandlerFunc(varsHandler), auth, scopeAdmin))
+}
+
+// seconds 解析查询参数 seconds，默认 def，不超过配置的上限
+func (p *Profiler) seconds(r *http.Request, def int) (time.Duration, error) {
+	value := r.URL.Query().Get("seconds")
+	if value == "" {
+		return time.Duration(def) * time.Second, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, errors.New("无效的 seconds")
+	}
+	if seconds > p.maxSeconds {
+		return 0, fmt.Errorf("seconds 不能超过 %d", p.maxSeconds)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// pprofHandler 处理 /debug/pprof/ 下的请求：不带名称时列出可用的分析，profile 为 CPU 采样，trace 为执行跟踪，
+// 其余为 runtime/pprof 中的分析，如 heap、goroutine、allocs；输出的格式可以直接用 go tool pprof 查看
+func (p *Profiler) pprofHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	switch name {
+	case "":
+		profiles := []profileSummary{
+			{Name: "profile", Path: "/debug/pprof/profile?seconds=30"},
+			{Name: "trace", Path: "/debug/pprof/trace?seconds=5"},
+		}
+		for _, profile := range pprof.Profiles() {
+			profiles = append(profiles, profileSummary{Name: profile.Name(), Count: profile.Count(), Path: "/debug/pprof/" + profile.Name()})
+		}
+		sort.SliceStable(profiles[2:], func(i, j int) bool {
+			return profiles[2+i].Name < profiles[2+j].Name
+		})
+		sendContentResponse(w, http.StatusOK, "success", profiles, nil, r.URL.Path)
+	case "profile":
+		p.sample(w, r, 30, "CPU 采样", pprof.StartCPUProfile, pprof.StopCPUProfile)
+	case "trace":
+		p.sample(w, r, 5, "执行跟踪", trace.Start, trace.Stop)
+	default:
+		profile := pprof.Lookup(name)
+		if profile == nil {
+			sendJSONResponse(w, http.StatusNotFound, "分析不存在", nil, r.URL.Path)
+			return
+		}
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if name == "heap" && r.URL.Query().Get("gc") != "" {
+			runtime.GC()
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		}
+		err := profile.WriteTo(w, debug)
+		if err != nil {
+			slog.WarnContext(r.Context(), "写入分析失败", "name", name, "err", err)
+		}
+	}
+}
+
+// sample 持续采样一段时间后输出结果，同一时间只能有一个 CPU 采样或执行跟踪，客户端断开时提前结束
+func (p *Profiler) sample(w http.ResponseWriter, r *http.Request, def int, kind string, start func(w io.Writer) error, stop func()) {
+	duration, err := p.seconds(r, def)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, err.Error(), err, r.URL.Path)
+		return
+	}
+	// 先写入缓冲，开始失败时仍然可以返回 JSON 错误
+	var buf bytes.Buffer
+	err = start(&buf)
+	if err != nil {
+		sendJSONResponse(w, http.StatusConflict, kind+"正在进行", err, r.URL.Path)
+		return
+	}
+	slog.InfoContext(r.Context(), "开始"+kind, "seconds", duration.Seconds())
+	timer := time.NewTimer(duration)
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		timer.Stop()
+	}
+	stop()
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.TrimPrefix(r.URL.Path, "/debug/pprof/")))
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		slog.WarnContext(r.Context(), "写入"+kind+"失败", "err", err)
+	}
+}
+
+// runtimeVars 结构是 /debug/vars 的内容，字段与 expvar 的输出兼容，可以直接用于 expvarmon 等工具
+type runtimeVars struct {
+	Cmdline       []string         `json:"cmdline"`
+	Memstats      runtime.MemStats `json:"memstats"`
+	Goroutines    int              `json:"goroutines"`
+	NumCPU        int              `json:"num_cpu"`
+	GOMAXPROCS    int              `json:"gomaxprocs"`
+	GoVersion     string           `json:"go_version"`
+	Version       string           `json:"version"`
+	UptimeSeconds int64            `json:"uptime_seconds"`
+}
+
+// varsHandler 返回运行时的内存、GC 和协程统计，不按统一的响应格式包装
+func varsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := runtimeVars{
+		Cmdline:       os.Args,
+		Goroutines:    runtime.NumGoroutine(),
+		NumCPU:        runtime.NumCPU(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		GoVersion:     runtime.Version(),
+		Version:       buildVersion,
+		UptimeSeconds: int64(time.Since(processStartedAt).Seconds()),
+	}
+	runtime.ReadMemStats(&vars.Memstats)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(vars)
+	if err != nil {
+		slog.WarnContext(r.Context(), "写入响应失败", "err", err, "url", r.URL.Path)
+	}
+}
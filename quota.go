@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// QuotaConfig 结构用于配置每个调用方的存储配额，用量按索引中记录的上传者统计
+type QuotaConfig struct {
+	Enabled bool `json:"enabled"`
+	// Default 未单独配置的调用方的配额，单位字节，0 表示不限制
+	Default int64 `json:"default"`
+	// Limits 按调用方名称（token 的 name、JWT 的 sub 等）配置配额，0 表示不限制
+	Limits map[string]int64 `json:"limits"`
+}
+
+// QuotaUsage 结构用于返回调用方的存储用量
+type QuotaUsage struct {
+	Name  string `json:"name"`
+	Used  int64  `json:"used"`
+	Files int    `json:"files"`
+	// Limit 为 0 表示不限制
+	Limit int64 `json:"limit"`
+}
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaTracker 结构用于检查上传是否超出配额
+type QuotaTracker struct {
+	config QuotaConfig
+	index  *MetaIndex
+
+	mu sync.Mutex
+	// pending 为正在上传、尚未写入索引的字节数，避免并发上传同时通过检查
+	pending map[string]int64
+}
+
+// quotaTracker 未启用配额时为 nil
+var quotaTracker *QuotaTracker
+
+// NewQuotaTracker 创建配额检查
+func NewQuotaTracker(config QuotaConfig, index *MetaIndex) *QuotaTracker {
+	return &QuotaTracker{config: config, index: index, pending: map[string]int64{}}
+}
+
+// limit 返回调用方的配额
+func (q *QuotaTracker) limit(name string) int64 {
+	if limit, ok := q.config.Limits[name]; ok {
+		return limit
+	}
+	return q.config.Default
+}
+
+// Usage 返回调用方的存储用量
+func (q *QuotaTracker) Usage(name string) QuotaUsage {
+	usage := QuotaUsage{Name: name, Limit: q.limit(name)}
+	q.index.Range(func(key string, meta FileMeta) bool {
+		if !meta.IsDir && meta.Uploader == name {
+			usage.Used += meta.Size
+			usage.Files++
+		}
+		return true
+	})
+	return usage
+}
+
+// Reserve 为即将写入 key 的 size 字节预留配额，超出配额时返回 errQuotaExceeded。
+// 覆盖调用方自己的文件时不重复计算原文件的大小；上传结束后需要调用返回的函数释放预留
+func (q *QuotaTracker) Reserve(name string, key string, size int64) (func(), error) {
+	if q == nil || name == "" {
+		return func() {}, nil
+	}
+	limit := q.limit(name)
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used := q.Usage(name).Used + q.pending[name]
+	if meta, ok := q.index.Get(key); ok && !meta.IsDir && meta.Uploader == name {
+		used -= meta.Size
+	}
+	if used+size > limit {
+		return nil, errQuotaExceeded
+	}
+	q.pending[name] += size
+	return func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.pending[name] -= size
+		if q.pending[name] <= 0 {
+			delete(q.pending, name)
+		}
+	}, nil
+}
+
+// 查询存储用量，默认返回调用方自己的用量，admin 权限可以通过 name 参数查询其他调用方
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+	if quotaTracker == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用存储配额", nil, r.URL.Path)
+		return
+	}
+	identity := identityFrom(r)
+	name := identity.Name
+	if other := r.URL.Query().Get("name"); other != "" && other != name {
+		if !identity.HasScope(scopeAdmin) {
+			sendJSONResponse(w, http.StatusForbidden, "没有权限查询其他调用方的用量", nil, r.URL.Path)
+			return
+		}
+		name = other
+	}
+	sendContentResponse(w, http.StatusOK, "success", quotaTracker.Usage(name), nil, r.URL.Path)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReceiptConfig 结构用于配置上传回执，回执使用 Ed25519 签名，审计方只需要公钥即可校验
+type ReceiptConfig struct {
+	Enabled bool `json:"enabled"`
+	// PrivateKey PKCS#8 格式的 PEM 私钥，支持 env:、file:、vault:// 引用；为空时生成并保存在 data/.meta/receipt_key.pem
+	PrivateKey string `json:"private_key"`
+	// Always 为 true 时每次上传都返回回执，否则只在请求头 X-Receipt 为 true 时返回
+	Always bool `json:"always"`
+	// TrustedKeys 为轮换之前使用的公钥，键为 key ID，值为 PKIX 格式的 PEM 公钥，用于校验之前签发的回执
+	TrustedKeys map[string]string `json:"trusted_keys"`
+}
+
+// receiptVersion 是签名内容的版本前缀
+const receiptVersion = "store-receipt-v1"
+
+// UploadReceipt 结构是上传成功后签发的回执，证明文件在 StoredAt 时以该内容保存
+type UploadReceipt struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	StoredAt time.Time `json:"stored_at"`
+	KeyID    string    `json:"key_id"`
+	// Signature 为签名内容的 Ed25519 签名，base64 编码
+	Signature string `json:"signature"`
+}
+
+// signedContent 返回回执中被签名的内容，各字段按行拼接，审计方可以不依赖 JSON 的格式自行构造
+func (receipt UploadReceipt) signedContent() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%d\n%s\n%s\n%s", receiptVersion, receipt.Path, receipt.Size,
+		receipt.SHA256, receipt.StoredAt.UTC().Format(time.RFC3339Nano), receipt.KeyID))
+}
+
+// ReceiptSigner 结构用于签发和校验上传回执
+type ReceiptSigner struct {
+	config     ReceiptConfig
+	privateKey ed25519.PrivateKey
+	keyID      string
+	// publicKeys 为可以用于校验的公钥，包括当前的公钥和 TrustedKeys
+	publicKeys map[string]ed25519.PublicKey
+}
+
+// receiptSigner 未启用上传回执时为 nil
+var receiptSigner *ReceiptSigner
+
+// NewReceiptSigner 加载签名私钥，未配置时使用 file 中保存的私钥，不存在时生成新的私钥并保存
+func NewReceiptSigner(config ReceiptConfig, file string) (*ReceiptSigner, error) {
+	data := config.PrivateKey
+	if data == "" {
+		content, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			content, err = generateReceiptKey(file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = string(content)
+	}
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("回执私钥不是有效的 PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("回执私钥不是 Ed25519 私钥")
+	}
+
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	s := &ReceiptSigner{
+		config:     config,
+		privateKey: privateKey,
+		keyID:      receiptKeyID(publicKey),
+		publicKeys: map[string]ed25519.PublicKey{},
+	}
+	for id, value := range config.TrustedKeys {
+		key, err := parseReceiptPublicKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_keys 中的公钥 %s 无效: %w", id, err)
+		}
+		s.publicKeys[id] = key
+	}
+	s.publicKeys[s.keyID] = publicKey
+	return s, nil
+}
+
+// generateReceiptKey 生成新的私钥并以 PEM 格式保存，只有当前用户可以读取
+func generateReceiptKey(file string) ([]byte, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	err = os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	tmpFile := file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmpFile, file)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("已生成上传回执的签名私钥", "file", file)
+	return data, nil
+}
+
+// parseReceiptPublicKey 解析 PKIX 格式的 PEM 公钥
+func parseReceiptPublicKey(data string) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("不是有效的 PEM")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("不是 Ed25519 公钥")
+	}
+	return key, nil
+}
+
+// receiptKeyID 返回公钥的 ID，为公钥 SHA-256 的前 8 字节
+func receiptKeyID(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Wanted 判断本次上传是否需要返回回执
+func (s *ReceiptSigner) Wanted(r *http.Request) bool {
+	if s == nil {
+		return false
+	}
+	return s.config.Always || strings.EqualFold(r.Header.Get("X-Receipt"), "true")
+}
+
+// Sign 为已保存的文件签发回执
+func (s *ReceiptSigner) Sign(key string, size int64, sum string, storedAt time.Time) *UploadReceipt {
+	receipt := &UploadReceipt{
+		Path:     key,
+		Size:     size,
+		SHA256:   sum,
+		StoredAt: storedAt.UTC(),
+		KeyID:    s.keyID,
+	}
+	receipt.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, receipt.signedContent()))
+	return receipt
+}
+
+// Verify 校验回执的签名，签名的公钥未知时返回错误
+func (s *ReceiptSigner) Verify(receipt UploadReceipt) (bool, error) {
+	publicKey, ok := s.publicKeys[receipt.KeyID]
+	if !ok {
+		return false, fmt.Errorf("未知的 key ID %s", receipt.KeyID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(receipt.Signature)
+	if err != nil {
+		return false, nil
+	}
+	return ed25519.Verify(publicKey, receipt.signedContent(), signature), nil
+}
+
+// ReceiptPublicKey 结构用于公开校验回执的公钥
+type ReceiptPublicKey struct {
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Current   bool   `json:"current"`
+}
+
+// PublicKeys 返回所有可以用于校验的公钥，PEM 格式
+func (s *ReceiptSigner) PublicKeys() []ReceiptPublicKey {
+	var keys []ReceiptPublicKey
+	for id, key := range s.publicKeys {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, ReceiptPublicKey{
+			KeyID:     id,
+			PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			Current:   id == s.keyID,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KeyID < keys[j].KeyID })
+	return keys
+}
+
+// ReceiptVerification 结构是校验回执的结果
+type ReceiptVerification struct {
+	// Valid 为签名是否有效
+	Valid bool   `json:"valid"`
+	KeyID string `json:"key_id"`
+	// Current 为文件当前的状态：match 表示内容与回执一致，modified 表示已被修改，missing 表示已不存在；签名无效时为空
+	Current string `json:"current,omitempty"`
+}
+
+// 校验上传回执，GET 返回校验用的公钥，POST 校验回执的签名并比较文件当前的内容
+func verifyReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	if receiptSigner == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用上传回执", nil, r.URL.Path)
+		return
+	}
+	if r.Method == http.MethodGet {
+		sendContentResponse(w, http.StatusOK, "success", receiptSigner.PublicKeys(), nil, r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+		return
+	}
+	var receipt UploadReceipt
+	err := json.NewDecoder(r.Body).Decode(&receipt)
+	if err != nil || receipt.Path == "" || receipt.Signature == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	valid, err := receiptSigner.Verify(receipt)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无法校验回执", err, r.URL.Path)
+		return
+	}
+	result := ReceiptVerification{Valid: valid, KeyID: receipt.KeyID}
+	if !valid {
+		sendContentResponse(w, http.StatusOK, "签名无效", result, nil, r.URL.Path)
+		return
+	}
+
+	// 签名有效时比较文件当前的内容，索引中的哈希仍然有效时不读取整个文件
+	result.Current = "missing"
+	if !isReservedPath(receipt.Path) {
+		fullPath, fileInfo, err := statReadPath(receipt.Path)
+		if err == nil && !fileInfo.IsDir() {
+			_, sum, err := statContent(indexKey(receipt.Path), fullPath, fileInfo)
+			if err != nil {
+				sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+				return
+			}
+			result.Current = "modified"
+			if sum == receipt.SHA256 {
+				result.Current = "match"
+			}
+		} else if err != nil && !os.IsNotExist(err) {
+			sendJSONResponse(w, http.StatusInternalServerError, "无法获取文件信息", err, r.URL.Path)
+			return
+		}
+	}
+	sendContentResponse(w, http.StatusOK, "签名有效", result, nil, r.URL.Path)
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicationConfig 结构用于配置异步复制，上传和删除成功后排队推送到其他 store_go 实例，用作热备
+type ReplicationConfig struct {
+	Peers []ReplicationPeer `json:"peers"`
+	// RetryInterval 首次重试的间隔，单位秒，默认 30，之后每次失败翻倍，最长 1 小时
+	RetryInterval int `json:"retry_interval"`
+	// Timeout 每次推送的超时时间，单位秒，默认 300
+	Timeout int `json:"timeout"`
+}
+
+// ReplicationPeer 结构表示一个复制目标
+type ReplicationPeer struct {
+	// URL 目标实例的地址，如 http://standby:8082
+	URL string `json:"url"`
+	// Token 目标实例上拥有 write 和 replicate 权限的 token，支持 file:、env: 和 vault: 引用
+	Token string `json:"token"`
+}
+
+// replicationHeader 标记复制产生的请求，目标实例收到后不会再次复制，互为备份时不会循环；
+// 只有拥有 replicate 权限的调用方发送时有效
+const replicationHeader = "X-Replication"
+
+// fromReplicationPeer 判断请求是否是复制目标推送的：带有 X-Replication 请求头，且调用方显式拥有 replicate 权限
+func fromReplicationPeer(r *http.Request) bool {
+	if r == nil || r.Header.Get(replicationHeader) == "" {
+		return false
+	}
+	identity := identityFrom(r)
+	return identity != nil && identity.IsReplicationPeer()
+}
+
+const (
+	replicationPut    = "put"
+	replicationDelete = "delete"
+)
+
+// replicationOp 结构表示一个等待推送的操作，同一路径只保留最新的操作
+type replicationOp struct {
+	Seq         uint64    `json:"seq"`
+	Op          string    `json:"op"`
+	Key         string    `json:"key"`
+	QueuedAt    time.Time `json:"queued_at"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// replicationPeerState 结构表示一个目标的积压和统计，与积压一起持久化
+type replicationPeerState struct {
+	Pending     map[string]*replicationOp `json:"pending"`
+	Replicated  int64                     `json:"replicated"`
+	Failures    int64                     `json:"failures"`
+	LastSuccess time.Time                 `json:"last_success"`
+	LastError   string                    `json:"last_error,omitempty"`
+	LastErrorAt time.Time                 `json:"last_error_at"`
+}
+
+// ReplicationPeerStatus 结构用于返回一个目标的复制状态
+type ReplicationPeerStatus struct {
+	URL     string `json:"url"`
+	Pending int    `json:"pending"`
+	// OldestQueuedAt 为最早排队的操作的时间，LagSeconds 为其距今的秒数，没有积压时为 0
+	OldestQueuedAt *time.Time `json:"oldest_queued_at,omitempty"`
+	LagSeconds     float64    `json:"lag_seconds"`
+	Replicated     int64      `json:"replicated"`
+	Failures       int64      `json:"failures"`
+	LastSuccess    *time.Time `json:"last_success,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+	// Retrying 为至少失败过一次、正在等待重试的操作
+	Retrying []replicationOp `json:"retrying,omitempty"`
+}
+
+// Replicator 结构用于将写操作异步推送到其他实例，积压保存在 data/.meta 目录下，重启后继续推送
+type Replicator struct {
+	file   string
+	config ReplicationConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	seq   uint64
+	peers map[string]*replicationPeerState
+	wake  map[string]chan struct{}
+	dirty bool
+}
+
+// replicator 未配置复制目标时为 nil
+var replicator *Replicator
+
+// OpenReplicator 加载积压并为每个目标启动推送的 goroutine，未配置目标时返回 nil
+func OpenReplicator(file string, config ReplicationConfig) (*Replicator, error) {
+	if len(config.Peers) == 0 {
+		return nil, nil
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 30
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 300
+	}
+	rep := &Replicator{
+		file:   file,
+		config: config,
+		client: &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		peers:  map[string]*replicationPeerState{},
+		wake:   map[string]chan struct{}{},
+	}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &rep.peers)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for i := range config.Peers {
+		peer := &config.Peers[i]
+		peer.URL = strings.TrimSuffix(peer.URL, "/")
+		state, ok := rep.peers[peer.URL]
+		if !ok || state.Pending == nil {
+			state = &replicationPeerState{Pending: map[string]*replicationOp{}}
+			rep.peers[peer.URL] = state
+		}
+		for _, op := range state.Pending {
+			if op.Seq > rep.seq {
+				rep.seq = op.Seq
+			}
+		}
+		rep.wake[peer.URL] = make(chan struct{}, 1)
+	}
+	// 之后由预写日志分配的序号需要大于积压中的序号
+	metaIndex.AdvanceJournal(rep.seq)
+
+	// 已经从配置中移除的目标不再推送
+	for url := range rep.peers {
+		if _, ok := rep.wake[url]; !ok {
+			delete(rep.peers, url)
+		}
+	}
+	for _, peer := range config.Peers {
+		go rep.run(peer)
+	}
+	return rep, nil
+}
+
+// Put 在文件写入成功后排队推送，复制产生的请求不会再次复制
+func (rep *Replicator) Put(r *http.Request, key string) {
+	rep.enqueue(r, replicationPut, key)
+}
+
+// PutTree 排队推送路径下的所有文件，用于从回收站恢复目录
+func (rep *Replicator) PutTree(r *http.Request, key string) {
+	if rep == nil {
+		return
+	}
+	root := filepath.Join("data", filepath.FromSlash(key))
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel("data", p)
+		if err != nil {
+			return nil
+		}
+		rep.enqueue(r, replicationPut, indexKey(rel))
+		return nil
+	})
+}
+
+// Delete 在文件或目录删除成功后排队推送
+func (rep *Replicator) Delete(r *http.Request, key string) {
+	rep.enqueue(r, replicationDelete, key)
+}
+
+func (rep *Replicator) enqueue(r *http.Request, op string, key string) {
+	if rep == nil || fromReplicationPeer(r) {
+		return
+	}
+	rep.mu.Lock()
+	now := time.Now()
+	// 启用索引的预写日志时使用日志分配的事件序号，与索引的修改统一编号
+	seq := metaIndex.JournalEvent("replicate-"+op, key)
+	if seq == 0 {
+		rep.seq++
+		seq = rep.seq
+	} else if seq > rep.seq {
+		rep.seq = seq
+	}
+	for url, state := range rep.peers {
+		// 同一路径的新操作覆盖旧操作，删除目录时目录下等待推送的文件也不再需要推送
+		if op == replicationDelete {
+			for k := range state.Pending {
+				if strings.HasPrefix(k, key+"/") {
+					delete(state.Pending, k)
+				}
+			}
+		}
+		state.Pending[key] = &replicationOp{Seq: seq, Op: op, Key: key, QueuedAt: now, NextAttempt: now}
+		select {
+		case rep.wake[url] <- struct{}{}:
+		default:
+		}
+	}
+	rep.dirty = true
+	rep.mu.Unlock()
+}
+
+// next 返回目标下一个可以推送的操作，以及没有可推送的操作时需要等待的时间
+func (rep *Replicator) next(url string) (*replicationOp, time.Duration) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	now := time.Now()
+	var next *replicationOp
+	wait := time.Hour
+	pending := rep.peers[url].Pending
+	for _, op := range pending {
+		if blockedByAncestor(pending, op) {
+			continue
+		}
+		if op.NextAttempt.After(now) {
+			if d := op.NextAttempt.Sub(now); d < wait {
+				wait = d
+			}
+			continue
+		}
+		if next == nil || op.Seq < next.Seq {
+			next = op
+		}
+	}
+	if next == nil {
+		return nil, wait
+	}
+	copied := *next
+	return &copied, 0
+}
+
+// blockedByAncestor 判断上级目录是否有更早排队、尚未完成的操作，
+// 例如删除目录失败等待重试时，之后上传到该目录下的文件要等删除完成后再推送，否则会被重试的删除删掉
+func blockedByAncestor(pending map[string]*replicationOp, op *replicationOp) bool {
+	for dir := path.Dir(op.Key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if ancestor, ok := pending[dir]; ok && ancestor.Seq < op.Seq {
+			return true
+		}
+	}
+	return false
+}
+
+// run 按排队顺序推送操作，失败的操作按指数退避重试，不阻塞其他路径
+func (rep *Replicator) run(peer ReplicationPeer) {
+	for {
+		op, wait := rep.next(peer.URL)
+		if op == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-rep.wake[peer.URL]:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		err := rep.push(peer, *op)
+		rep.finish(peer.URL, *op, err)
+	}
+}
+
+// finish 记录推送结果，推送期间同一路径有新操作时保留新操作
+func (rep *Replicator) finish(url string, op replicationOp, err error) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	state := rep.peers[url]
+	rep.dirty = true
+	current, ok := state.Pending[op.Key]
+	if err == nil {
+		state.Replicated++
+		state.LastSuccess = time.Now()
+		if ok && current.Seq == op.Seq {
+			delete(state.Pending, op.Key)
+		}
+		return
+	}
+
+	slog.Error("复制失败", "peer", url, "op", op.Op, "key", op.Key, "err", err)
+	state.Failures++
+	state.LastError = err.Error()
+	state.LastErrorAt = time.Now()
+	if !ok || current.Seq != op.Seq {
+		return
+	}
+	current.Attempts++
+	current.LastError = err.Error()
+	backoff := time.Duration(rep.config.RetryInterval) * time.Second
+	for i := 1; i < current.Attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+	current.NextAttempt = time.Now().Add(backoff)
+}
+
+// push 将一个操作推送到目标实例
+func (rep *Replicator) push(peer ReplicationPeer, op replicationOp) error {
+	if op.Op == replicationDelete {
+		return rep.pushDelete(peer, op.Key)
+	}
+	return rep.pushPut(peer, op.Key)
+}
+
+// pushPut 通过目标实例的 /upload 上传文件的当前内容，文件已被删除时跳过，之后排队的删除会同步到目标
+func (rep *Replicator) pushPut(peer ReplicationPeer, key string) error {
+	return pushFileUpload(peer.URL, key, func(req *http.Request) error {
+		return rep.do(peer, req)
+	})
+}
+
+// pushFileUpload 构造上传文件当前内容的 /upload 请求并交给 send 发送，文件已被删除或是目录时跳过
+func pushFileUpload(baseURL string, key string, send func(req *http.Request) error) error {
+	fullPath := filepath.Join("data", filepath.FromSlash(key))
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	file, err := openDataFile(fullPath)
+	if err != nil {
+		return err
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(file)
+
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", path.Base(key))
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		_ = writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/upload", body)
+	if err != nil {
+		_ = body.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-FormFile-Path", key)
+	// 目标按原路径保存，不使用目标上配置的命名策略
+	req.Header.Set("X-Naming-Strategy", namingKeep)
+	// 复制在后台进行，不与目标实例上的交互请求争抢并发数
+	req.Header.Set("X-Priority", priorityBatch)
+	// 带上索引中的哈希、存储类型和自定义元数据，目标实例写入前校验内容
+	if meta, ok := metaIndex.Get(key); ok && meta.Size == info.Size() && meta.ModTime.Equal(info.ModTime()) {
+		if meta.SHA256 != "" {
+			req.Header.Set("X-Content-SHA256", meta.SHA256)
+		}
+		if meta.StorageClass != "" {
+			req.Header.Set("X-Storage-Class", meta.StorageClass)
+		}
+		for name, value := range meta.Metadata {
+			req.Header.Set("X-Meta-"+name, value)
+		}
+	}
+	return send(req)
+}
+
+// pushDelete 通过目标实例的 /delete 删除文件或目录，目标上不存在时视为成功
+func (rep *Replicator) pushDelete(peer ReplicationPeer, key string) error {
+	data, err := json.Marshal(DeleteRequest{Path: key})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, peer.URL+"/delete", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return rep.do(peer, req)
+}
+
+// do 发送请求，2xx 以外的响应视为失败
+func (rep *Replicator) do(peer ReplicationPeer, req *http.Request) error {
+	req.Header.Set(replicationHeader, "true")
+	if peer.Token != "" {
+		req.Header.Set("Authorization", peer.Token)
+	}
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(message)))
+}
+
+// Status 返回每个目标的复制状态
+func (rep *Replicator) Status() []ReplicationPeerStatus {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	now := time.Now()
+	statuses := []ReplicationPeerStatus{}
+	for _, peer := range rep.config.Peers {
+		state := rep.peers[peer.URL]
+		status := ReplicationPeerStatus{
+			URL:        peer.URL,
+			Pending:    len(state.Pending),
+			Replicated: state.Replicated,
+			Failures:   state.Failures,
+			LastError:  state.LastError,
+			Retrying:   []replicationOp{},
+		}
+		if !state.LastSuccess.IsZero() {
+			lastSuccess := state.LastSuccess
+			status.LastSuccess = &lastSuccess
+		}
+		if !state.LastErrorAt.IsZero() {
+			lastErrorAt := state.LastErrorAt
+			status.LastErrorAt = &lastErrorAt
+		}
+		for _, op := range state.Pending {
+			if status.OldestQueuedAt == nil || op.QueuedAt.Before(*status.OldestQueuedAt) {
+				queuedAt := op.QueuedAt
+				status.OldestQueuedAt = &queuedAt
+			}
+			if op.Attempts > 0 {
+				status.Retrying = append(status.Retrying, *op)
+			}
+		}
+		if status.OldestQueuedAt != nil {
+			status.LagSeconds = now.Sub(*status.OldestQueuedAt).Seconds()
+		}
+		sort.Slice(status.Retrying, func(i, j int) bool {
+			return status.Retrying[i].Seq < status.Retrying[j].Seq
+		})
+		// 只返回最早的一部分，积压很多时响应不会过大
+		if len(status.Retrying) > 100 {
+			status.Retrying = status.Retrying[:100]
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Save 将有修改的积压写回磁盘
+func (rep *Replicator) Save() error {
+	rep.mu.Lock()
+	if !rep.dirty {
+		rep.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(rep.peers)
+	rep.dirty = false
+	rep.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(rep.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := rep.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, rep.file)
+}
+
+// Run 定期保存积压
+func (rep *Replicator) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := rep.Save()
+		if err != nil {
+			slog.Error("保存复制积压失败", "err", err)
+		}
+	}
+}
+
+// 查看每个复制目标的积压和最近的结果
+func replicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if replicator == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未配置复制", nil, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", replicator.Status(), nil, r.URL.Path)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// RestoreRequest 结构用于从快照恢复文件
+type RestoreRequest struct {
+	// ID 为快照的 ID
+	ID string `json:"id"`
+	// Paths 为要恢复的文件或目录，为空时恢复快照中的所有文件
+	Paths []string `json:"paths"`
+	// Delete 为 true 时删除恢复范围内快照中没有的文件，恢复为快照时的状态
+	Delete bool `json:"delete"`
+	// DryRun 为 true 时只返回需要恢复和删除的文件，不做修改
+	DryRun bool `json:"dry_run"`
+}
+
+// RestoreResult 结构是恢复的结果
+type RestoreResult struct {
+	ID     string `json:"id"`
+	DryRun bool   `json:"dry_run"`
+	// Restored 为缺少或内容与快照不同、已从快照恢复的文件
+	Restored []string `json:"restored"`
+	// Deleted 为快照中没有、已删除的文件
+	Deleted []string `json:"deleted"`
+	// Unchanged 为与快照相同的文件数量
+	Unchanged int `json:"unchanged"`
+	// Failed 为恢复或删除失败的文件和原因
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+var errSnapshotNotFound = errors.New("快照不存在")
+
+// loadBackupManifest 读取快照的清单
+func (b *Backups) loadBackupManifest(id string) (BackupManifest, error) {
+	var manifest BackupManifest
+	data, err := os.ReadFile(filepath.Join(b.dir, id, backupManifestName))
+	if os.IsNotExist(err) {
+		return manifest, errSnapshotNotFound
+	} else if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+// inRestoreScope 判断文件是否在恢复范围内，范围为空时包括所有文件
+func inRestoreScope(key string, scope []string) bool {
+	if len(scope) == 0 {
+		return true
+	}
+	for _, prefix := range scope {
+		if key == prefix || strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unchangedSinceBackup 判断当前文件与快照中的文件是否相同：仍是同一个硬链接，或索引中的哈希与清单一致
+func unchangedSinceBackup(entry BackupFile, snapshotPath string, fullPath string) bool {
+	current, err := os.Stat(fullPath)
+	if err != nil || current.IsDir() {
+		return false
+	}
+	saved, err := os.Stat(snapshotPath)
+	if err == nil && os.SameFile(current, saved) {
+		return true
+	}
+	if entry.SHA256 == "" {
+		return false
+	}
+	meta, ok := metaIndex.Get(entry.Path)
+	return ok && meta.SHA256 == entry.SHA256 && meta.Size == current.Size() && meta.ModTime.Equal(current.ModTime())
+}
+
+// Restore 将快照中的文件恢复到 data 目录，只恢复缺少或内容不同的文件；被覆盖的文件在启用历史版本时保留为历史版本，
+// 删除的文件在启用回收站时移入回收站
+func (b *Backups) Restore(r *http.Request, request RestoreRequest) (RestoreResult, error) {
+	result := RestoreResult{ID: request.ID, DryRun: request.DryRun, Restored: []string{}, Deleted: []string{}}
+	manifest, err := b.loadBackupManifest(request.ID)
+	if err != nil {
+		return result, err
+	}
+	var scope []string
+	for _, p := range request.Paths {
+		if key := indexKey(p); key != "" {
+			scope = append(scope, key)
+		}
+	}
+	root := filepath.Join(b.dir, request.ID, "data")
+	fail := func(key string, err error) {
+		if result.Failed == nil {
+			result.Failed = map[string]string{}
+		}
+		result.Failed[key] = err.Error()
+		slog.ErrorContext(r.Context(), "从快照恢复失败", "key", key, "err", err)
+	}
+
+	saved := make(map[string]bool, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		if !inRestoreScope(entry.Path, scope) {
+			continue
+		}
+		saved[entry.Path] = true
+		// 目录在备份之后被替换为指向 data 目录之外的符号链接时不能经过它写入
+		if isUnsafePath(entry.Path) {
+			fail(entry.Path, errors.New("非法的存储路径"))
+			continue
+		}
+		snapshotPath := filepath.Join(root, filepath.FromSlash(entry.Path))
+		fullPath := filepath.Join("data", filepath.FromSlash(entry.Path))
+		if unchangedSinceBackup(entry, snapshotPath, fullPath) {
+			result.Unchanged++
+			continue
+		}
+		// 一次写入的目录中已存在的文件不能被快照中的内容覆盖
+		if err := wormPolicy.Protected(entry.Path); err != nil {
+			fail(entry.Path, err)
+			continue
+		}
+		if !request.DryRun {
+			err = restoreBackupFile(r, entry, snapshotPath, fullPath)
+			if err != nil {
+				fail(entry.Path, err)
+				continue
+			}
+		}
+		result.Restored = append(result.Restored, entry.Path)
+	}
+
+	if request.Delete {
+		for _, key := range currentFilesInScope(scope) {
+			if saved[key] {
+				continue
+			}
+			if err := wormPolicy.Protected(key); err != nil {
+				fail(key, err)
+				continue
+			}
+			if !request.DryRun {
+				err = deleteForRestore(r, key)
+				if err != nil {
+					fail(key, err)
+					continue
+				}
+			}
+			result.Deleted = append(result.Deleted, key)
+		}
+	}
+	return result, nil
+}
+
+// restoreBackupFile 将快照中的文件链接到临时目录再重命名到目标位置，之后更新索引等记录；
+// 与上传和删除一样持有路径锁，同一路径正在写入时等待
+func restoreBackupFile(r *http.Request, entry BackupFile, snapshotPath string, fullPath string) error {
+	release, err := pathLocks.Lock(r.Context(), entry.Path, "恢复", true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	tmp, err := createTempFile(fullPath, "restore-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	_ = os.Remove(tmpPath)
+	err = os.Link(snapshotPath, tmpPath)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyBackupFile(snapshotPath, tmpPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer func(tmpPath string) {
+		err := os.Remove(tmpPath)
+		if err != nil && !os.IsNotExist(err) {
+			slog.ErrorContext(r.Context(), "清理临时文件失败", "err", err)
+		}
+	}(tmpPath)
+
+	err = os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	changeType := changeModified
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		changeType = changeCreated
+	}
+	if featureFlags.Enabled(featureVersioning, entry.Path, identityName(r)) {
+		_, err = versioning.Keep(entry.Path)
+		if err != nil {
+			return err
+		}
+	}
+	err = renameDataPath(tmpPath, fullPath)
+	if err != nil {
+		return err
+	}
+
+	removeThumbnails(entry.Path)
+	reindexRestored(entry.Path)
+	if entry.SHA256 != "" {
+		metaIndex.Update(entry.Path, func(meta *FileMeta) {
+			meta.SHA256 = entry.SHA256
+		})
+	}
+	replicator.Put(r, entry.Path)
+	s3Mirror.Put(entry.Path)
+	webhooks.Emit(r, WebhookEvent{Event: webhookUpload, Path: entry.Path, Source: "snapshot_restore", Size: entry.Size, SHA256: entry.SHA256})
+	changeFeed.Publish(r, ChangeEvent{Type: changeType, Path: entry.Path, Source: "snapshot_restore", Size: entry.Size})
+	eventBus.Publish(r, BusEvent{Type: changeType, Path: entry.Path, Source: "snapshot_restore", Size: entry.Size, SHA256: entry.SHA256})
+	return nil
+}
+
+// currentFilesInScope 返回恢复范围内当前的所有文件
+func currentFilesInScope(scope []string) []string {
+	roots := scope
+	if len(roots) == 0 {
+		roots = []string{""}
+	}
+	var keys []string
+	for _, root := range roots {
+		_ = filepath.WalkDir(filepath.Join("data", filepath.FromSlash(root)), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel("data", p)
+			if err != nil {
+				return nil
+			}
+			key := indexKey(filepath.ToSlash(rel))
+			if d.IsDir() {
+				if isReservedPath(key) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deleteForRestore 删除快照中没有的文件，与 /delete 一样启用回收站时移入回收站
+func deleteForRestore(r *http.Request, key string) error {
+	release, err := pathLocks.Lock(r.Context(), key, "恢复", true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	removed := existenceFilter.Entries(filepath.Join("data", filepath.FromSlash(key)))
+	moved := false
+	if trash != nil {
+		_, err := trash.Move(key, identityName(r))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		moved = err == nil
+	}
+	if !moved {
+		err := removeDataPath(filepath.Join("data", filepath.FromSlash(key)))
+		if err != nil {
+			return err
+		}
+	}
+	forgetDeletedPath(key, removed)
+	replicator.Delete(r, key)
+	webhooks.Emit(r, WebhookEvent{Event: webhookDelete, Path: key, Source: "snapshot_restore"})
+	changeFeed.Publish(r, ChangeEvent{Type: changeDeleted, Path: key, Source: "snapshot_restore"})
+	eventBus.Publish(r, BusEvent{Type: changeDeleted, Path: key, Source: "snapshot_restore"})
+	return nil
+}
+
+// 从快照恢复整个快照或部分路径，dry_run 时只返回需要恢复和删除的文件
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+		return
+	}
+	var request RestoreRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.ID == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	if request.ID != filepath.Base(request.ID) || strings.HasPrefix(request.ID, ".") {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的快照 ID", nil, r.URL.Path)
+		return
+	}
+	for _, p := range request.Paths {
+		if isReservedPath(p) || isUnsafePath(p) {
+			sendJSONResponse(w, http.StatusBadRequest, "非法的路径参数", nil, r.URL.Path)
+			return
+		}
+	}
+
+	result, err := backups.Restore(r, request)
+	if err == errSnapshotNotFound {
+		sendJSONResponse(w, http.StatusNotFound, "快照不存在", err, r.URL.Path)
+		return
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "读取快照失败", err, r.URL.Path)
+		return
+	}
+	message := "恢复成功"
+	if len(result.Failed) > 0 {
+		message = "部分文件恢复失败"
+	}
+	sendContentResponse(w, http.StatusOK, message, result, nil, r.URL.Path)
+}
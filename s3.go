@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client 是只实现了镜像需要的 PutObject 和 ListObjectsV2 的 S3 客户端，使用 Signature Version 4 签名，
+// 兼容 MinIO 等 S3 协议的对象存储
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	client       *http.Client
+}
+
+// s3Object 是 ListObjectsV2 返回的对象
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// s3ListResult 是 ListObjectsV2 的响应
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// s3Error 是 S3 返回的错误
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// bucketURL 返回存储桶的地址，pathStyle 为 false 时使用 bucket.host 形式的虚拟主机地址
+func (c *s3Client) bucketURL() url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	return u
+}
+
+// PutObject 上传对象，body 的长度需要为 size，由调用方关闭；header 中的 x-amz-* 请求头一起签名
+func (c *s3Client) PutObject(key string, body io.Reader, size int64, header http.Header) error {
+	u := c.bucketURL()
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	// 实际发送的路径与签名中的路径使用相同的编码
+	u.RawPath = s3Escape(u.Path, false)
+	req, err := http.NewRequest(http.MethodPut, u.String(), io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	// 长度为 0 时需要使用 NoBody，否则请求会以 chunked 编码发送
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	// 文件以流的方式上传，不预先计算整个请求体的哈希，完整性由 x-amz-checksum-sha256 保证
+	c.sign(req, "UNSIGNED-PAYLOAD", time.Now())
+	return c.do(req, nil)
+}
+
+// ListObjects 按键的顺序列出前缀下的所有对象
+func (c *s3Client) ListObjects(prefix string, fn func(object s3Object)) error {
+	token := ""
+	for {
+		u := c.bucketURL()
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = s3Query(query)
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		c.sign(req, emptyPayloadHash, time.Now())
+		var result s3ListResult
+		err = c.do(req, &result)
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			fn(object)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do 发送请求，2xx 时将 XML 响应解析到 result，否则返回 S3 的错误码和信息
+func (c *s3Client) do(req *http.Request, result any) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		var s3Err s3Error
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+			return fmt.Errorf("%s %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+		}
+		return fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if result == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(result)
+}
+
+// emptyPayloadHash 是空请求体的 SHA-256
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign 按 Signature Version 4 为请求签名，签名包含 host 和所有 x-amz-* 请求头
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := req.URL.Path
+	if uri == "" {
+		uri = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(uri, false),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Query 按签名要求的方式编码查询参数：按名称排序，除未保留字符外都进行百分号编码
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape 对 A-Z、a-z、0-9、-、_、.、~ 以外的字节进行百分号编码，encodeSlash 为 false 时保留 /
+func s3Escape(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3MirrorConfig 结构用于配置 S3 镜像，每次上传成功后异步将文件复制到外部的 S3 存储桶，作为独立于本机磁盘的备份
+type S3MirrorConfig struct {
+	// Endpoint 为 S3 服务的地址，如 https://s3.us-east-1.amazonaws.com 或 http://minio:9000，为空时不启用
+	Endpoint string `json:"endpoint"`
+	// Region 为签名使用的区域，默认 us-east-1
+	Region string `json:"region"`
+	Bucket string `json:"bucket"`
+	// Prefix 为对象键的前缀，如 store/，文件 a/b.txt 保存为 store/a/b.txt
+	Prefix string `json:"prefix"`
+	// AccessKey、SecretKey 和 SessionToken 为访问凭据，支持 env:、file:、vault:// 引用
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token"`
+	// PathStyle 为 true 时使用 endpoint/bucket 形式的地址，MinIO 等通常需要；否则使用 bucket.endpoint
+	PathStyle bool `json:"path_style"`
+	// SSE 为服务端加密方式，如 AES256 或 aws:kms，为空时使用存储桶的默认设置
+	SSE string `json:"sse"`
+	// StorageClass 为对象的存储类型，如 STANDARD_IA，为空时使用默认类型
+	StorageClass string `json:"storage_class"`
+	// RetryInterval 首次重试的间隔，单位秒，默认 30，之后每次失败翻倍，最长 1 小时
+	RetryInterval int `json:"retry_interval"`
+	// Timeout 每次上传的超时时间，单位秒，默认 300
+	Timeout int `json:"timeout"`
+	// ReconcileInterval 核对镜像的间隔，单位小时，默认 24，小于 0 时只在手动触发时核对
+	ReconcileInterval int `json:"reconcile_interval"`
+}
+
+// s3MirrorOp 结构表示一个等待上传到镜像的文件，同一文件只保留一个
+type s3MirrorOp struct {
+	Key         string    `json:"key"`
+	QueuedAt    time.Time `json:"queued_at"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// S3MirrorReport 结构是一次核对的结果
+type S3MirrorReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Checked 为核对的本地文件数
+	Checked int `json:"checked"`
+	// Missing 为镜像中不存在的文件，Stale 为本地修改时间晚于镜像中对象的文件，均不包括还在等待上传的文件；
+	// 列表最多返回 1000 个，总数见 MissingCount 和 StaleCount
+	Missing      []string `json:"missing"`
+	MissingCount int      `json:"missing_count"`
+	Stale        []string `json:"stale"`
+	StaleCount   int      `json:"stale_count"`
+	// Requeued 为核对后重新排队上传的文件数
+	Requeued int    `json:"requeued"`
+	Error    string `json:"error,omitempty"`
+}
+
+// errReconcileRunning 表示上一次核对尚未完成
+var errReconcileRunning = errors.New("正在核对")
+
+// maxReportEntries 是核对结果中最多返回的文件数
+const maxReportEntries = 1000
+
+// s3MirrorState 结构是积压、统计和最近一次核对的结果，一起持久化
+type s3MirrorState struct {
+	Pending     map[string]*s3MirrorOp `json:"pending"`
+	Mirrored    int64                  `json:"mirrored"`
+	Failures    int64                  `json:"failures"`
+	LastSuccess time.Time              `json:"last_success"`
+	LastError   string                 `json:"last_error,omitempty"`
+	LastErrorAt time.Time              `json:"last_error_at"`
+	Report      *S3MirrorReport        `json:"report,omitempty"`
+}
+
+// S3MirrorStatus 结构用于返回镜像的状态
+type S3MirrorStatus struct {
+	Bucket      string     `json:"bucket"`
+	Prefix      string     `json:"prefix"`
+	Pending     int        `json:"pending"`
+	Mirrored    int64      `json:"mirrored"`
+	Failures    int64      `json:"failures"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// Reconciling 为 true 表示正在核对
+	Reconciling bool            `json:"reconciling"`
+	Report      *S3MirrorReport `json:"report,omitempty"`
+}
+
+// S3Mirror 结构用于将上传的文件异步复制到 S3 存储桶，积压保存在 data/.meta 目录下，重启后继续上传；
+// 只复制写入，删除本地文件时不删除镜像中的对象，误删后仍可以从镜像中找回
+type S3Mirror struct {
+	file   string
+	config S3MirrorConfig
+	client *s3Client
+
+	mu          sync.Mutex
+	state       s3MirrorState
+	wake        chan struct{}
+	reconciling bool
+	dirty       bool
+}
+
+// s3Mirror 未配置 S3 镜像时为 nil
+var s3Mirror *S3Mirror
+
+// OpenS3Mirror 加载积压并启动上传的 goroutine，未配置 endpoint 时返回 nil
+func OpenS3Mirror(file string, config S3MirrorConfig) (*S3Mirror, error) {
+	if config.Endpoint == "" {
+		return nil, nil
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3_mirror.endpoint 应为 http 或 https 地址")
+	}
+	if config.Bucket == "" || config.AccessKey == "" || config.SecretKey == "" {
+		return nil, fmt.Errorf("s3_mirror 需要 bucket、access_key 和 secret_key")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 30
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 300
+	}
+	if config.ReconcileInterval == 0 {
+		config.ReconcileInterval = 24
+	}
+	m := &S3Mirror{
+		file:   file,
+		config: config,
+		client: &s3Client{
+			endpoint:     endpoint,
+			region:       config.Region,
+			bucket:       config.Bucket,
+			accessKey:    config.AccessKey,
+			secretKey:    config.SecretKey,
+			sessionToken: config.SessionToken,
+			pathStyle:    config.PathStyle,
+			client:       &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		},
+		wake: make(chan struct{}, 1),
+	}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &m.state)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if m.state.Pending == nil {
+		m.state.Pending = map[string]*s3MirrorOp{}
+	}
+	go m.run()
+	if config.ReconcileInterval > 0 {
+		go m.runReconcile(time.Duration(config.ReconcileInterval) * time.Hour)
+	}
+	return m, nil
+}
+
+// objectKey 返回文件在存储桶中的键
+func (m *S3Mirror) objectKey(key string) string {
+	return m.config.Prefix + key
+}
+
+// Put 在文件写入成功后排队上传到镜像
+func (m *S3Mirror) Put(key string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enqueue(key)
+}
+
+// PutTree 排队上传路径下的所有文件，用于从回收站恢复目录
+func (m *S3Mirror) PutTree(key string) {
+	if m == nil {
+		return
+	}
+	walkDataFiles(key, m.Put)
+}
+
+// enqueue 排队上传，调用方需要持有锁；已在排队的文件重新从头计算重试次数
+func (m *S3Mirror) enqueue(key string) {
+	now := time.Now()
+	m.state.Pending[key] = &s3MirrorOp{Key: key, QueuedAt: now, NextAttempt: now}
+	m.dirty = true
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next 返回下一个可以上传的文件，以及没有可上传的文件时需要等待的时间
+func (m *S3Mirror) next() (*s3MirrorOp, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var next *s3MirrorOp
+	wait := time.Hour
+	for _, op := range m.state.Pending {
+		if op.NextAttempt.After(now) {
+			if d := op.NextAttempt.Sub(now); d < wait {
+				wait = d
+			}
+			continue
+		}
+		if next == nil || op.QueuedAt.Before(next.QueuedAt) {
+			next = op
+		}
+	}
+	if next == nil {
+		return nil, wait
+	}
+	copied := *next
+	return &copied, 0
+}
+
+// run 按排队顺序上传文件，失败的文件按指数退避重试，不阻塞其他文件
+func (m *S3Mirror) run() {
+	for {
+		op, wait := m.next()
+		if op == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-m.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		err := m.upload(op.Key)
+		m.finish(*op, err)
+	}
+}
+
+// finish 记录上传结果，上传期间文件再次被修改并排队时保留新的排队
+func (m *S3Mirror) finish(op s3MirrorOp, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dirty = true
+	current, ok := m.state.Pending[op.Key]
+	if err == nil {
+		m.state.Mirrored++
+		m.state.LastSuccess = time.Now()
+		if ok && current.QueuedAt.Equal(op.QueuedAt) {
+			delete(m.state.Pending, op.Key)
+		}
+		return
+	}
+
+	slog.Error("上传到 S3 镜像失败", "key", op.Key, "err", err)
+	m.state.Failures++
+	m.state.LastError = err.Error()
+	m.state.LastErrorAt = time.Now()
+	if !ok || !current.QueuedAt.Equal(op.QueuedAt) {
+		return
+	}
+	current.Attempts++
+	current.LastError = err.Error()
+	backoff := time.Duration(m.config.RetryInterval) * time.Second
+	for i := 1; i < current.Attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+	current.NextAttempt = time.Now().Add(backoff)
+}
+
+// upload 将文件的当前内容上传到镜像，上传的是解密和解压后的内容，不依赖本实例的密钥即可恢复；
+// 文件已被删除或是目录时跳过
+func (m *S3Mirror) upload(key string) error {
+	fullPath, info, err := statReadPath(key)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	file, err := openDataFile(fullPath)
+	if err != nil {
+		return err
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(file)
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if m.config.SSE != "" {
+		header.Set("X-Amz-Server-Side-Encryption", m.config.SSE)
+	}
+	if m.config.StorageClass != "" {
+		header.Set("X-Amz-Storage-Class", m.config.StorageClass)
+	}
+	// 索引中有有效的哈希时由 S3 校验上传的内容
+	if meta, ok := metaIndex.Get(key); ok && meta.SHA256 != "" && meta.Size == info.Size() && meta.ModTime.Equal(info.ModTime()) {
+		if sum, err := hex.DecodeString(meta.SHA256); err == nil {
+			header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sum))
+			header.Set("X-Amz-Meta-Sha256", meta.SHA256)
+		}
+	}
+	return m.client.PutObject(m.objectKey(key), file, size, header)
+}
+
+// Reconcile 列出存储桶中的对象并与本地文件比较，报告镜像中缺少和过期的文件；requeue 为 true 时将这些文件重新排队上传
+func (m *S3Mirror) Reconcile(requeue bool) (*S3MirrorReport, error) {
+	m.mu.Lock()
+	if m.reconciling {
+		m.mu.Unlock()
+		return nil, errReconcileRunning
+	}
+	m.reconciling = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.reconciling = false
+		m.mu.Unlock()
+	}()
+
+	report := &S3MirrorReport{StartedAt: time.Now(), Missing: []string{}, Stale: []string{}}
+	objects := map[string]time.Time{}
+	err := m.client.ListObjects(m.config.Prefix, func(object s3Object) {
+		objects[strings.TrimPrefix(object.Key, m.config.Prefix)] = object.LastModified
+	})
+	if err == nil {
+		err = filepath.WalkDir("data", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel("data", p)
+			if err != nil || rel == "." {
+				return nil
+			}
+			key := indexKey(filepath.ToSlash(rel))
+			if d.IsDir() {
+				if isReservedPath(key) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			report.Checked++
+			m.compare(report, key, info.ModTime(), objects, requeue)
+			return nil
+		})
+	}
+	report.FinishedAt = time.Now()
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	m.mu.Lock()
+	m.state.Report = report
+	m.dirty = true
+	m.mu.Unlock()
+	if err != nil {
+		return report, err
+	}
+	slog.Info("S3 镜像核对完成", "checked", report.Checked, "missing", report.MissingCount, "stale", report.StaleCount)
+	return report, nil
+}
+
+// compare 比较一个本地文件与镜像中的对象，等待上传的文件不计入结果
+func (m *S3Mirror) compare(report *S3MirrorReport, key string, modTime time.Time, objects map[string]time.Time, requeue bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, pending := m.state.Pending[key]; pending {
+		return
+	}
+	lastModified, ok := objects[key]
+	switch {
+	case !ok:
+		report.MissingCount++
+		if len(report.Missing) < maxReportEntries {
+			report.Missing = append(report.Missing, key)
+		}
+	case modTime.After(lastModified.Add(time.Second)):
+		// 对象的修改时间是上传完成的时间，只精确到秒
+		report.StaleCount++
+		if len(report.Stale) < maxReportEntries {
+			report.Stale = append(report.Stale, key)
+		}
+	default:
+		return
+	}
+	if requeue {
+		m.enqueue(key)
+		report.Requeued++
+	}
+}
+
+// runReconcile 定期核对镜像
+func (m *S3Mirror) runReconcile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, err := m.Reconcile(false)
+		if err != nil {
+			slog.Error("核对 S3 镜像失败", "err", err)
+		}
+	}
+}
+
+// Status 返回镜像的积压、统计和最近一次核对的结果
+func (m *S3Mirror) Status() S3MirrorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := S3MirrorStatus{
+		Bucket:      m.config.Bucket,
+		Prefix:      m.config.Prefix,
+		Pending:     len(m.state.Pending),
+		Mirrored:    m.state.Mirrored,
+		Failures:    m.state.Failures,
+		LastError:   m.state.LastError,
+		Reconciling: m.reconciling,
+		Report:      m.state.Report,
+	}
+	if !m.state.LastSuccess.IsZero() {
+		lastSuccess := m.state.LastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+	if !m.state.LastErrorAt.IsZero() {
+		lastErrorAt := m.state.LastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	return status
+}
+
+// Save 将有修改的积压写回磁盘
+func (m *S3Mirror) Save() error {
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(m.state)
+	m.dirty = false
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(m.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := m.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, m.file)
+}
+
+// Run 定期保存积压
+func (m *S3Mirror) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := m.Save()
+		if err != nil {
+			slog.Error("保存 S3 镜像积压失败", "err", err)
+		}
+	}
+}
+
+// writeMetrics 输出积压、上传成功和失败的次数以及最近一次核对发现缺少的文件数
+func (m *S3Mirror) writeMetrics(w http.ResponseWriter) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP store_s3_mirror_pending Number of files waiting to be copied to the S3 mirror.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_s3_mirror_pending gauge\n")
+	_, _ = fmt.Fprintf(w, "store_s3_mirror_pending %d\n", len(m.state.Pending))
+	_, _ = fmt.Fprintf(w, "# HELP store_s3_mirror_mirrored_total Files copied to the S3 mirror.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_s3_mirror_mirrored_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_s3_mirror_mirrored_total %d\n", m.state.Mirrored)
+	_, _ = fmt.Fprintf(w, "# HELP store_s3_mirror_failures_total Failed copies to the S3 mirror.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_s3_mirror_failures_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_s3_mirror_failures_total %d\n", m.state.Failures)
+	if m.state.Report != nil && m.state.Report.Error == "" {
+		_, _ = fmt.Fprintf(w, "# HELP store_s3_mirror_missing Files missing from the S3 mirror at the last reconciliation.\n")
+		_, _ = fmt.Fprintf(w, "# TYPE store_s3_mirror_missing gauge\n")
+		_, _ = fmt.Fprintf(w, "store_s3_mirror_missing %d\n", m.state.Report.MissingCount)
+	}
+}
+
+// S3MirrorReconcileRequest 结构用于解析手动核对的请求
+type S3MirrorReconcileRequest struct {
+	// Requeue 为 true 时将缺少和过期的文件重新排队上传
+	Requeue bool `json:"requeue"`
+}
+
+// 查看 S3 镜像的状态和最近一次核对的结果，POST 在后台开始一次核对
+func s3MirrorHandler(w http.ResponseWriter, r *http.Request) {
+	if s3Mirror == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未配置 S3 镜像", nil, r.URL.Path)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		sendContentResponse(w, http.StatusOK, "success", s3Mirror.Status(), nil, r.URL.Path)
+	case http.MethodPost:
+		var request S3MirrorReconcileRequest
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				sendJSONResponse(w, http.StatusBadRequest, "解析JSON数据失败", err, r.URL.Path)
+				return
+			}
+		}
+		if s3Mirror.Status().Reconciling {
+			sendJSONResponse(w, http.StatusConflict, "正在核对", nil, r.URL.Path)
+			return
+		}
+		go func() {
+			_, err := s3Mirror.Reconcile(request.Requeue)
+			if err != nil && err != errReconcileRunning {
+				slog.ErrorContext(r.Context(), "核对 S3 镜像失败", "err", err)
+			}
+		}()
+		sendJSONResponse(w, http.StatusOK, "已开始核对，完成后通过 GET 查看结果", nil, r.URL.Path)
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+		return
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// IndexConfig 结构用于配置元数据索引
+type IndexConfig struct {
+	Enabled bool `json:"enabled"`
+	// SaveEvery 扫描多少个目录后保存一次索引和扫描进度
+	SaveEvery int `json:"save_every"`
+	// Watch 是否持续跟踪绕过 API 对 data 目录的修改，Linux 上使用 inotify，其他平台定期扫描
+	Watch bool `json:"watch"`
+	// RescanInterval 定期扫描的间隔，单位秒，默认 600
+	RescanInterval int `json:"rescan_interval"`
+	// ReconcileInterval 与磁盘对账的间隔，单位秒，为 0 时不对账
+	ReconcileInterval int `json:"reconcile_interval"`
+	// ShardDepth 按路径的前几级目录将索引分片保存，为 0 时整个索引保存在一个文件中
+	ShardDepth int `json:"shard_depth"`
+	// HotShards 常驻内存的分片数上限，默认 64
+	HotShards int `json:"hot_shards"`
+	// Journal 为 true 时索引的修改先写入预写日志，崩溃后重启时回放，不需要重新扫描
+	Journal bool `json:"journal"`
+	// JournalSync 为 true 时每条记录写入后立即刷盘，断电时也不丢失，写入变慢
+	JournalSync bool `json:"journal_sync"`
+	// Backend 为索引的保存方式，json（默认）或 sqlite，sqlite 需要使用 -tags sqlite 构建
+	Backend string `json:"backend"`
+}
+
+// scanState 结构用于持久化后台扫描的进度，重启后可以从断点继续
+type scanState struct {
+	Queue    []string `json:"queue"`
+	Complete bool     `json:"complete"`
+}
+
+// IndexScanner 在后台逐个目录扫描 data 目录以建立索引，不阻塞服务启动
+type IndexScanner struct {
+	mu        sync.Mutex
+	index     *MetaIndex
+	stateFile string
+	state     scanState
+	saveEvery int
+	// visited 记录本次运行中已经扫描过的目录，避免优先扫描的目录被重复扫描
+	visited  map[string]bool
+	priority chan string
+}
+
+// NewIndexScanner 创建扫描器并加载上次的扫描进度
+func NewIndexScanner(index *MetaIndex, stateFile string, cfg IndexConfig) (*IndexScanner, error) {
+	s := &IndexScanner{
+		index:     index,
+		stateFile: stateFile,
+		saveEvery: cfg.SaveEvery,
+		visited:   map[string]bool{},
+		priority:  make(chan string, 64),
+	}
+	if s.saveEvery <= 0 {
+		s.saveEvery = 100
+	}
+
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		// 首次运行，从根目录开始扫描
+		s.state.Queue = []string{""}
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.state)
+	if err != nil {
+		return nil, err
+	}
+	// 扫描已完成但索引为空时（切换了保存方式或索引文件被删除）重新扫描
+	if s.state.Complete && index.Len() == 0 {
+		s.state = scanState{Queue: []string{""}}
+	}
+	return s, nil
+}
+
+// Complete 返回索引是否已经完整建立
+func (s *IndexScanner) Complete() bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Complete
+}
+
+// Prioritize 请求优先扫描正在被列出的目录
+func (s *IndexScanner) Prioritize(dirKey string) {
+	if s.Complete() {
+		return
+	}
+	select {
+	case s.priority <- dirKey:
+	default:
+		// 队列已满时放弃，该目录之后仍会按顺序被扫描
+	}
+}
+
+// Run 执行后台扫描直到全部目录扫描完成
+func (s *IndexScanner) Run() {
+	if s.Complete() {
+		return
+	}
+	slog.Info("开始后台扫描建立索引")
+	start := time.Now()
+	count := 0
+
+	for {
+		dirKey, ok := s.next()
+		if !ok {
+			break
+		}
+		if s.visited[dirKey] {
+			continue
+		}
+		s.visited[dirKey] = true
+
+		subDirs, err := scanDirectory(s.index, dirKey)
+		if err != nil {
+			slog.Error("扫描目录失败", "err", err)
+		}
+		s.mu.Lock()
+		s.state.Queue = append(s.state.Queue, subDirs...)
+		s.mu.Unlock()
+
+		count++
+		if count%s.saveEvery == 0 {
+			s.save()
+		}
+	}
+
+	s.mu.Lock()
+	s.state.Complete = true
+	s.state.Queue = nil
+	s.mu.Unlock()
+	s.visited = nil
+	s.save()
+	slog.Info("索引扫描完成", "dirs", count, "elapsed", time.Since(start))
+}
+
+// next 取出下一个需要扫描的目录，优先处理正在被列出的目录
+func (s *IndexScanner) next() (string, bool) {
+	select {
+	case dirKey := <-s.priority:
+		return dirKey, true
+	default:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.state.Queue) == 0 {
+		return "", false
+	}
+	dirKey := s.state.Queue[0]
+	s.state.Queue = s.state.Queue[1:]
+	return dirKey, true
+}
+
+// save 保存索引和扫描进度
+func (s *IndexScanner) save() {
+	err := s.index.Save()
+	if err != nil {
+		slog.Error("保存索引失败", "err", err)
+		return
+	}
+
+	s.mu.Lock()
+	data, err := json.Marshal(s.state)
+	s.mu.Unlock()
+	if err != nil {
+		slog.Error("保存扫描进度失败", "err", err)
+		return
+	}
+	err = os.WriteFile(s.stateFile, data, 0644)
+	if err != nil {
+		slog.Error("保存扫描进度失败", "err", err)
+	}
+}
+
+// scanDirectory 扫描单个目录，更新其直接子项的索引并清理已不存在的记录，返回子目录列表
+func scanDirectory(index *MetaIndex, dirKey string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join("data", dirKey))
+	if err != nil {
+		return nil, err
+	}
+
+	var subDirs []string
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if dirKey == "" && reservedNames[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// 扫描期间文件被删除
+			continue
+		}
+		key := path.Join(dirKey, entry.Name())
+		seen[key] = true
+		index.Record(key, info)
+		if info.IsDir() {
+			subDirs = append(subDirs, key)
+		}
+	}
+
+	for _, key := range index.Children(dirKey) {
+		if !seen[key] {
+			index.RemoveTree(key)
+		}
+	}
+	return subDirs, nil
+}
+
+// rescanTree 全量扫描 data 目录，使索引与磁盘一致
+func rescanTree(index *MetaIndex) {
+	scanTree(index, "")
+}
+
+// scanTree 扫描指定目录及其所有子目录
+func scanTree(index *MetaIndex, rootKey string) {
+	queue := []string{rootKey}
+	for len(queue) > 0 {
+		dirKey := queue[0]
+		queue = queue[1:]
+		subDirs, err := scanDirectory(index, dirKey)
+		if err != nil {
+			slog.Error("扫描目录失败", "err", err)
+			continue
+		}
+		queue = append(queue, subDirs...)
+	}
+}
+
+// pollIndex 按固定间隔全量扫描，用于无法使用 inotify 的情况
+func pollIndex(index *MetaIndex, cfg IndexConfig) {
+	interval := time.Duration(cfg.RescanInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rescanTree(index)
+	}
+}
+
+// reconcileIndex 在初始扫描完成后定期与磁盘对账，修正遗漏或过期的记录
+func reconcileIndex(index *MetaIndex, scanner *IndexScanner, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !scanner.Complete() {
+			continue
+		}
+		start := time.Now()
+		before := index.Len()
+		rescanTree(index)
+		slog.Info("索引对账完成", "before", before, "after", index.Len(), "elapsed", time.Since(start))
+	}
+}
+
+// refreshIndexPath 在写入后更新指定路径及其所有上级目录的索引
+func refreshIndexPath(key string) {
+	existenceFilter.AddPath(key)
+	if metaIndex == nil {
+		return
+	}
+	for key != "" && key != "." {
+		info, err := os.Stat(filepath.Join("data", key))
+		if err != nil {
+			slog.Error("更新索引失败", "err", err)
+			return
+		}
+		metaIndex.Record(key, info)
+		key = path.Dir(key)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SearchConfig 结构用于配置文件名搜索
+type SearchConfig struct {
+	// MaxResults 单次搜索返回的最大结果数，默认 1000
+	MaxResults int `json:"max_results"`
+}
+
+// SearchRequest 结构用于解析搜索请求的 JSON 数据
+type SearchRequest struct {
+	// Query 为通配符模式（包含 * ? [ 时）或不区分大小写的子串
+	Query string `json:"query"`
+	// Path 为搜索的起始目录，为空时搜索整个 data 目录
+	Path  string `json:"path"`
+	Limit int    `json:"limit"`
+}
+
+// 按文件名搜索文件和目录
+func searchHandler(w http.ResponseWriter, r *http.Request, searchConfig SearchConfig) {
+	var searchRequest SearchRequest
+	err := json.NewDecoder(r.Body).Decode(&searchRequest)
+	if err != nil || searchRequest.Query == "" {
+		sendListResponse(w, http.StatusBadRequest, "缺少必要参数", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, err, r.URL.Path)
+		return
+	}
+	fields, err := parseFields(r, ListEntry{})
+	if err != nil {
+		sendListResponse(w, http.StatusBadRequest, err.Error(), ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, err, r.URL.Path)
+		return
+	}
+	if isReservedPath(searchRequest.Path) || isUnsafePath(searchRequest.Path) {
+		sendListResponse(w, http.StatusOK, "该目录不存在", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, nil, r.URL.Path)
+		return
+	}
+
+	limit := searchConfig.MaxResults
+	if limit <= 0 {
+		limit = 1000
+	}
+	if searchRequest.Limit > 0 && searchRequest.Limit < limit {
+		limit = searchRequest.Limit
+	}
+
+	match, err := nameMatcher(searchRequest.Query)
+	if err != nil {
+		sendListResponse(w, http.StatusBadRequest, "无效的匹配模式", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, err, r.URL.Path)
+		return
+	}
+
+	root := indexKey(searchRequest.Path)
+	var entries []ListEntry
+	if metaIndex != nil && indexScanner.Complete() {
+		entries = searchIndex(metaIndex, root, match, limit)
+	} else {
+		entries, err = searchTree(root, match, limit)
+		if os.IsNotExist(err) {
+			sendListResponse(w, http.StatusOK, "该目录不存在", ListResponse{
+				Status:  0,
+				Content: []ListEntry{},
+			}, err, r.URL.Path)
+			return
+		} else if err != nil {
+			sendListResponse(w, http.StatusInternalServerError, "搜索失败", ListResponse{
+				Status:  0,
+				Content: []ListEntry{},
+			}, err, r.URL.Path)
+			return
+		}
+	}
+
+	entries, total, _ := applyListOptions(entries, ListRequest{})
+	if entries == nil {
+		entries = []ListEntry{}
+	}
+	sendListResponse(w, http.StatusOK, "success", ListResponse{
+		Status:  1,
+		Content: entries,
+		Total:   total,
+		Fields:  fields,
+	}, nil, r.URL.Path)
+}
+
+// nameMatcher 根据查询字符串生成文件名匹配函数
+func nameMatcher(query string) (func(name string) bool, error) {
+	if strings.ContainsAny(query, "*?[") {
+		// 提前检查模式是否合法
+		_, err := path.Match(query, "")
+		if err != nil {
+			return nil, err
+		}
+		return func(name string) bool {
+			ok, _ := path.Match(query, name)
+			return ok
+		}, nil
+	}
+
+	query = strings.ToLower(query)
+	return func(name string) bool {
+		return strings.Contains(strings.ToLower(name), query)
+	}, nil
+}
+
+// searchIndex 在索引中搜索，避免遍历磁盘
+func searchIndex(index *MetaIndex, root string, match func(name string) bool, limit int) []ListEntry {
+	var entries []ListEntry
+	index.RangePrefix(root, func(key string, meta FileMeta) bool {
+		if !match(path.Base(key)) {
+			return true
+		}
+		entries = append(entries, ListEntry{
+			Name:  path.Base(key),
+			Path:  key,
+			IsDir: meta.IsDir,
+			Size:  meta.Size,
+			Date:  meta.ModTime,
+		})
+		return len(entries) < limit
+	})
+	return entries
+}
+
+// searchTree 遍历磁盘上的目录树进行搜索
+func searchTree(root string, match func(name string) bool, limit int) ([]ListEntry, error) {
+	rootPath := filepath.Join("data", root)
+	_, err := os.Stat(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ListEntry
+	err = filepath.WalkDir(rootPath, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// 跳过无法读取的目录
+			slog.Warn("跳过无法读取的目录", "err", err)
+			return nil
+		}
+		if fullPath == rootPath {
+			return nil
+		}
+		rel, err := filepath.Rel("data", fullPath)
+		if err != nil {
+			return err
+		}
+		key := indexKey(rel)
+		if isReservedPath(key) {
+			return filepath.SkipDir
+		}
+		if !match(entry.Name()) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, ListEntry{
+			Name:  entry.Name(),
+			Path:  key,
+			IsDir: info.IsDir(),
+			Size:  info.Size(),
+			Date:  info.ModTime(),
+		})
+		if len(entries) >= limit {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// resolveSecret 解析配置中的敏感值，支持以下引用方式，其他值按原文使用：
+//
+//	env:NAME              读取环境变量
+//	file:/path/to/secret  读取文件内容（去掉首尾空白）
+//	vault://path#field    从 Vault 读取，地址和 token 取自 VAULT_ADDR、VAULT_TOKEN 环境变量
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("环境变量 %s 未设置", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(value, "vault://"):
+		return readVaultSecret(strings.TrimPrefix(value, "vault://"))
+	}
+	return value, nil
+}
+
+// readVaultSecret 从 Vault 的 KV 引擎读取密钥，同时兼容 KV v1 和 v2 的响应格式
+func readVaultSecret(ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return "", fmt.Errorf("Vault 引用缺少字段名: %s", ref)
+	}
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return "", fmt.Errorf("读取 %s 需要设置 VAULT_ADDR", ref)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, addr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("读取 Vault 密钥 %s 失败: %s", path, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+	data := body.Data
+	// KV v2 的值位于 data.data 中
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	secret, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault 密钥 %s 中没有字段 %s", path, field)
+	}
+	return secret, nil
+}
+
+// resolveConfigSecrets 解析配置中所有敏感字段的引用
+func resolveConfigSecrets(config *Config) error {
+	secrets := []*string{&config.Token, &config.Sign.Secret, &config.Sign.CDN.PrivateKey, &config.Sign.CDN.Secret}
+	for i := range config.Auth.Tokens {
+		secrets = append(secrets, &config.Auth.Tokens[i].Token)
+	}
+	if config.Auth.JWT != nil {
+		secrets = append(secrets, &config.Auth.JWT.Secret)
+	}
+	if config.Auth.TokenExpiry.Email != nil {
+		secrets = append(secrets, &config.Auth.TokenExpiry.Email.Password)
+	}
+	if config.Anomaly.Email != nil {
+		secrets = append(secrets, &config.Anomaly.Email.Password)
+	}
+	secrets = append(secrets, &config.Encryption.Key, &config.Shadow.Token, &config.Cluster.Token, &config.Receipt.PrivateKey)
+	for i := range config.Replication.Peers {
+		secrets = append(secrets, &config.Replication.Peers[i].Token)
+	}
+	for i := range config.Webhooks.Endpoints {
+		secrets = append(secrets, &config.Webhooks.Endpoints[i].Secret)
+	}
+	secrets = append(secrets, &config.EventBus.Token, &config.EventBus.Password)
+	secrets = append(secrets, &config.S3Mirror.AccessKey, &config.S3Mirror.SecretKey, &config.S3Mirror.SessionToken)
+	secrets = append(secrets, &config.SelfUpdate.Token)
+
+	for _, secret := range secrets {
+		if *secret == "" {
+			continue
+		}
+		value, err := resolveSecret(*secret)
+		if err != nil {
+			return err
+		}
+		*secret = value
+	}
+	return nil
+}
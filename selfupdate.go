@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildVersion 是当前程序的版本，发布时通过 -ldflags "-X main.buildVersion=1.4.2" 设置
+var buildVersion = "dev"
+
+// SelfUpdateConfig 结构用于配置自动更新：从上游实例的 Path 目录中检查本平台的新版本，校验签名后替换程序并重启
+type SelfUpdateConfig struct {
+	Enabled bool `json:"enabled"`
+	// URL 上游实例的地址，可以是 unix:/run/store.sock
+	URL string `json:"url"`
+	// Token 访问上游实例的 token，支持 env:、file:、vault:// 引用
+	Token string `json:"token"`
+	// Path 发布目录，每个平台的程序保存在 Path/平台/ 中，平台为 linux-amd64、linux-arm64 等
+	Path string `json:"path"`
+	// PublicKey 校验发布签名的 PKIX 格式的 PEM 公钥（Ed25519）
+	PublicKey string `json:"public_key"`
+	// Interval 自动检查的间隔，单位秒，0 表示只通过管理接口检查
+	Interval int `json:"interval"`
+	// AutoApply 为 true 时自动检查发现新版本后直接更新并重启，否则只记录
+	AutoApply bool `json:"auto_apply"`
+}
+
+const (
+	// releaseFileName 是发布目录中每个平台的版本信息
+	releaseFileName = "release.json"
+	// releaseBinaryName 是发布目录中每个平台的程序
+	releaseBinaryName = "store_go"
+	// releaseSignatureVersion 是签名内容的版本前缀
+	releaseSignatureVersion = "store-release-v1"
+)
+
+// Release 结构是发布目录中一个平台的版本信息
+type Release struct {
+	Version string `json:"version"`
+	// Platform 为 GOOS-GOARCH，与所在的目录一致
+	Platform string `json:"platform"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	// Signature 为签名内容的 Ed25519 签名，base64 编码
+	Signature string `json:"signature"`
+}
+
+// signedContent 返回被签名的内容，包含平台，不能将一个平台的签名用于其他平台的程序
+func (release Release) signedContent() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n%d\n%s", releaseSignatureVersion, release.Platform, release.Version, release.Size, release.SHA256))
+}
+
+// currentPlatform 返回当前程序的平台
+func currentPlatform() string {
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// SelfUpdateStatus 结构是最近一次检查的结果
+type SelfUpdateStatus struct {
+	CurrentVersion string     `json:"current_version"`
+	Platform       string     `json:"platform"`
+	Latest         *Release   `json:"latest,omitempty"`
+	Available      bool       `json:"available"`
+	CheckedAt      *time.Time `json:"checked_at,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	// Applying 为 true 时正在下载新版本或即将重启
+	Applying bool `json:"applying"`
+}
+
+// SelfUpdater 结构用于检查、下载并切换到上游发布的新版本
+type SelfUpdater struct {
+	config    SelfUpdateConfig
+	publicKey ed25519.PublicKey
+	upstream  *remoteSyncStore
+	// restart 请求停止服务后用新的程序替换当前进程
+	restart func(executable string) error
+
+	mu     sync.Mutex
+	status SelfUpdateStatus
+}
+
+// selfUpdater 未启用自动更新时为 nil
+var selfUpdater *SelfUpdater
+
+// errUpdateInProgress 表示已经在更新
+var errUpdateInProgress = errors.New("正在更新")
+
+// NewSelfUpdater 检查自动更新的配置，未启用时返回 nil
+func NewSelfUpdater(config SelfUpdateConfig) (*SelfUpdater, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	if config.URL == "" || config.Path == "" || config.PublicKey == "" {
+		return nil, errors.New("需要配置 url、path 和 public_key")
+	}
+	publicKey, err := parseReceiptPublicKey(config.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("public_key: %w", err)
+	}
+	return &SelfUpdater{
+		config:    config,
+		publicKey: publicKey,
+		upstream:  newRemoteSyncStore(config.URL, config.Token, 10*time.Minute),
+		restart:   requestRestart,
+		status:    SelfUpdateStatus{CurrentVersion: buildVersion, Platform: currentPlatform()},
+	}, nil
+}
+
+// releaseDir 返回本平台的发布目录
+func (u *SelfUpdater) releaseDir() string {
+	return path.Join(indexKey(u.config.Path), currentPlatform())
+}
+
+// Status 返回最近一次检查的结果
+func (u *SelfUpdater) Status() SelfUpdateStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.status
+}
+
+// Check 获取上游的版本信息并校验签名，返回是否有新版本
+func (u *SelfUpdater) Check() (SelfUpdateStatus, error) {
+	release, err := u.fetchRelease()
+	now := time.Now().UTC()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status.CheckedAt = &now
+	if err != nil {
+		u.status.Error = err.Error()
+		return u.status, err
+	}
+	u.status.Error = ""
+	u.status.Latest = &release
+	u.status.Available = compareVersions(release.Version, buildVersion) > 0
+	return u.status, nil
+}
+
+// fetchRelease 下载并校验本平台的版本信息
+func (u *SelfUpdater) fetchRelease() (Release, error) {
+	var release Release
+	body, err := u.upstream.Open(path.Join(u.releaseDir(), releaseFileName))
+	if err != nil {
+		return release, err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(body)
+	err = json.NewDecoder(io.LimitReader(body, 64<<10)).Decode(&release)
+	if err != nil {
+		return release, fmt.Errorf("解析 %s 失败 %w", releaseFileName, err)
+	}
+	if release.Platform != currentPlatform() {
+		return release, fmt.Errorf("发布的平台 %s 与当前平台 %s 不一致", release.Platform, currentPlatform())
+	}
+	signature, err := base64.StdEncoding.DecodeString(release.Signature)
+	if err != nil || !ed25519.Verify(u.publicKey, release.signedContent(), signature) {
+		return release, errors.New("发布的签名无效")
+	}
+	return release, nil
+}
+
+// Apply 下载新版本，校验大小和 SHA-256 后替换当前程序，原程序保留为 .old，然后请求重启进入新版本。
+// 重启经过与 SIGTERM 相同的停止过程，进行中的请求完成、收尾工作执行之后才执行新的程序
+func (u *SelfUpdater) Apply(release Release) error {
+	u.mu.Lock()
+	if u.status.Applying {
+		u.mu.Unlock()
+		return errUpdateInProgress
+	}
+	u.status.Applying = true
+	u.mu.Unlock()
+	err := u.apply(release)
+	if err != nil {
+		u.mu.Lock()
+		u.status.Applying = false
+		u.status.Error = err.Error()
+		u.mu.Unlock()
+	}
+	return err
+}
+
+func (u *SelfUpdater) apply(release Release) error {
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		return fmt.Errorf("无法确定程序路径 %w", err)
+	}
+
+	// 下载到程序所在目录，替换时是同一文件系统内的重命名
+	tmp, err := os.CreateTemp(filepath.Dir(executable), "."+filepath.Base(executable)+".update-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		_ = os.Remove(tmpPath)
+	}()
+	body, err := u.upstream.Open(path.Join(u.releaseDir(), releaseBinaryName))
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, release.Size+1))
+	_ = body.Close()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("下载新版本失败 %w", err)
+	}
+	if size != release.Size || hex.EncodeToString(hash.Sum(nil)) != release.SHA256 {
+		return errors.New("下载的程序与发布的大小或 SHA-256 不一致")
+	}
+	err = os.Chmod(tmpPath, 0755)
+	if err != nil {
+		return err
+	}
+
+	// 替换后与收到停止信号一样重启：拒绝新的写操作，等待进行中的上传和下载完成，保存索引和积压后再执行新的程序
+	maintenanceGate.Begin("正在更新到 " + release.Version + "，暂停写入")
+	backup := executable + ".old"
+	err = os.Rename(executable, backup)
+	if err == nil {
+		err = os.Rename(tmpPath, executable)
+		if err != nil {
+			_ = os.Rename(backup, executable)
+		}
+	}
+	if err != nil {
+		maintenanceGate.End()
+		return fmt.Errorf("替换程序失败 %w", err)
+	}
+	err = u.restart(executable)
+	if err != nil {
+		// 新程序已就位，下次启动时生效
+		maintenanceGate.End()
+		return fmt.Errorf("重启失败，新版本将在下次启动时生效 %w", err)
+	}
+	slog.Info("已更新，停止服务后重启", "version", release.Version, "backup", backup)
+	return nil
+}
+
+// Run 定期检查新版本，配置了 auto_apply 时直接更新
+func (u *SelfUpdater) Run() {
+	if u.config.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(u.config.Interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		status, err := u.Check()
+		if err != nil {
+			slog.Error("检查新版本失败", "err", err)
+			continue
+		}
+		if !status.Available {
+			continue
+		}
+		slog.Info("发现新版本", "version", status.Latest.Version, "current", buildVersion)
+		if !u.config.AutoApply {
+			continue
+		}
+		err = u.Apply(*status.Latest)
+		if err != nil {
+			slog.Error("自动更新失败", "err", err)
+		}
+	}
+}
+
+// compareVersions 比较 1.4.2 形式的版本号，开头的 v 忽略，逐段按数字比较；
+// 无法解析的段按字符串比较，dev 比任何版本都旧
+func compareVersions(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	if b == "dev" {
+		return 1
+	}
+	if a == "dev" {
+		return -1
+	}
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, errX := strconv.Atoi(x)
+		yn, errY := strconv.Atoi(y)
+		switch {
+		case errX == nil && errY == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (errX != nil || errY != nil) && x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+// SelfUpdateRequest 结构是检查更新的请求
+type SelfUpdateRequest struct {
+	// Apply 为 true 时有新版本则更新并重启
+	Apply bool `json:"apply"`
+}
+
+// 查看或检查自动更新，GET 返回最近一次检查的结果，POST 立即检查，apply 为 true 时有新版本则更新并重启
+func selfUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if selfUpdater == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用自动更新", nil, r.URL.Path)
+		return
+	}
+	if r.Method == http.MethodGet {
+		sendContentResponse(w, http.StatusOK, "success", selfUpdater.Status(), nil, r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+		return
+	}
+	var request SelfUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的请求", err, r.URL.Path)
+		return
+	}
+	status, err := selfUpdater.Check()
+	if err != nil {
+		sendContentResponse(w, http.StatusBadGateway, "检查新版本失败", status, err, r.URL.Path)
+		return
+	}
+	if !request.Apply || !status.Available {
+		sendContentResponse(w, http.StatusOK, "success", status, nil, r.URL.Path)
+		return
+	}
+
+	// 先返回响应，再在后台下载并重启
+	status.Applying = true
+	sendContentResponse(w, http.StatusAccepted, "正在更新", status, nil, r.URL.Path)
+	slog.InfoContext(r.Context(), "开始更新", "version", status.Latest.Version)
+	release := *status.Latest
+	go func() {
+		err := selfUpdater.Apply(release)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "更新失败", "err", err)
+		}
+	}()
+}
+
+// signReleaseCommand 为一个平台的程序生成签名的 release.json，与程序一起上传到发布目录
+func signReleaseCommand(args []string) int {
+	flags := flag.NewFlagSet("sign-release", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "PKCS#8 格式的 PEM 私钥文件（Ed25519）")
+	version := flags.String("version", "", "版本号，如 1.4.2")
+	platform := flags.String("platform", currentPlatform(), "程序的平台，GOOS-GOARCH")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *keyFile == "" || *version == "" || flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "用法: sign-release -key <私钥文件> -version <版本号> [-platform linux-arm64] <程序文件>\n")
+		return 2
+	}
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 读取私钥失败 %s\n", err)
+		return 1
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		fmt.Fprintf(os.Stderr, "Error: 私钥不是有效的 PEM\n")
+		return 1
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	privateKey, ok := parsed.(ed25519.PrivateKey)
+	if err != nil || !ok {
+		fmt.Fprintf(os.Stderr, "Error: 私钥不是 Ed25519 私钥 %v\n", err)
+		return 1
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 读取程序失败 %s\n", err)
+		return 1
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 读取程序失败 %s\n", err)
+		return 1
+	}
+	release := Release{Version: *version, Platform: *platform, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	release.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, release.signedContent()))
+	output, err := json.MarshalIndent(release, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Println(string(output))
+	return 0
+}
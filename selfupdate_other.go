@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// restartProcess 在不支持 exec 的平台上无法原地重启，需要由服务管理器重新启动
+func restartProcess(executable string) error {
+	return errors.New("当前平台不支持原地重启")
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartProcess 以相同的参数和环境变量执行新的程序，替换当前进程，进程号不变
+func restartProcess(executable string) error {
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 可以在运行时修改的设置
+const (
+	// settingReadOnly 开启后拒绝写操作，值为 ReadOnlySetting
+	settingReadOnly = "read_only"
+	// settingRateLimit 限制每个调用方的请求速率，值为 RateLimitSetting
+	settingRateLimit = "rate_limit"
+	// settingFeaturePrefix 加功能名称是功能开关的键，如 features.dedup，值为 FeatureFlag
+	settingFeaturePrefix = "features."
+)
+
+// ReadOnlySetting 结构是只读模式的设置
+type ReadOnlySetting struct {
+	Enabled bool `json:"enabled"`
+	// Message 为拒绝写操作时返回的提示，为空时使用默认提示
+	Message string `json:"message"`
+}
+
+// RateLimitRule 结构是一个调用方的请求速率限制
+type RateLimitRule struct {
+	// RequestsPerSecond 每秒允许的请求数，0 表示不限制
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// Burst 允许的突发请求数，默认为 RequestsPerSecond 向上取整，至少为 1
+	Burst int `json:"burst"`
+}
+
+// RateLimitSetting 结构按调用方限制请求速率
+type RateLimitSetting struct {
+	RateLimitRule
+	// Tenants 按调用方名称单独设置，覆盖默认的限制
+	Tenants map[string]RateLimitRule `json:"tenants"`
+}
+
+// rule 返回调用方适用的限制
+func (s RateLimitSetting) rule(name string) RateLimitRule {
+	if rule, ok := s.Tenants[name]; ok {
+		return rule
+	}
+	return s.RateLimitRule
+}
+
+// SettingEntry 结构是保存的一项设置
+type SettingEntry struct {
+	Value     json.RawMessage `json:"value"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	UpdatedBy string          `json:"updated_by,omitempty"`
+}
+
+// SettingStatus 结构是一项设置当前生效的值
+type SettingStatus struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	// Source 为设置的来源：config（配置文件中的初始值）或 admin（通过管理接口修改）
+	Source    string     `json:"source"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+}
+
+// Settings 结构保存通过管理接口修改的运行时设置。设置保存在 data/.meta/settings.json，
+// 重启后仍然有效；config.json 只在启动时读取，不会被修改，其中的同名配置作为设置的初始值
+type Settings struct {
+	mu      sync.Mutex
+	file    string
+	entries map[string]SettingEntry
+	// values 为 entries 解析后的值，defaults 为配置文件中的初始值
+	values   map[string]any
+	defaults map[string]any
+}
+
+// runtimeSettings 总是启用，启动前为 nil 时所有设置为零值
+var runtimeSettings *Settings
+
+// OpenSettings 加载保存的设置，defaults 为配置文件中的初始值
+func OpenSettings(file string, defaults map[string]any) (*Settings, error) {
+	s := &Settings{
+		file:     file,
+		entries:  map[string]SettingEntry{},
+		values:   map[string]any{},
+		defaults: defaults,
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.entries)
+	if err != nil {
+		return nil, err
+	}
+	for key, entry := range s.entries {
+		value, err := parseSetting(key, entry.Value)
+		if err != nil {
+			return nil, fmt.Errorf("设置 %s: %w", key, err)
+		}
+		s.values[key] = value
+	}
+	return s, nil
+}
+
+// parseSetting 检查并解析设置的值，不允许未知的键和字段
+func parseSetting(key string, raw json.RawMessage) (any, error) {
+	var value any
+	switch {
+	case key == settingReadOnly:
+		value = &ReadOnlySetting{}
+	case key == settingRateLimit:
+		value = &RateLimitSetting{}
+	case strings.HasPrefix(key, settingFeaturePrefix):
+		if !isFeatureName(strings.TrimPrefix(key, settingFeaturePrefix)) {
+			return nil, fmt.Errorf("未知的功能，应为 %s 之一", strings.Join(featureNames, "、"))
+		}
+		value = &FeatureFlag{}
+	default:
+		return nil, errors.New("未知的设置")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(value)
+	if err != nil {
+		return nil, err
+	}
+	if limit, ok := value.(*RateLimitSetting); ok {
+		rules := []RateLimitRule{limit.RateLimitRule}
+		for _, rule := range limit.Tenants {
+			rules = append(rules, rule)
+		}
+		for _, rule := range rules {
+			if rule.RequestsPerSecond < 0 || rule.Burst < 0 {
+				return nil, errors.New("requests_per_second 和 burst 不能为负数")
+			}
+		}
+	}
+	return value, nil
+}
+
+// value 返回设置当前生效的值，没有设置时返回 nil
+func (s *Settings) value(key string) any {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value, ok := s.values[key]; ok {
+		return value
+	}
+	return s.defaults[key]
+}
+
+// has 判断设置是否通过管理接口修改过
+func (s *Settings) has(key string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.entries[key]
+	return ok
+}
+
+// ReadOnly 返回只读模式的设置
+func (s *Settings) ReadOnly() ReadOnlySetting {
+	if value, ok := s.value(settingReadOnly).(*ReadOnlySetting); ok {
+		return *value
+	}
+	return ReadOnlySetting{}
+}
+
+// RateLimit 返回请求速率限制的设置
+func (s *Settings) RateLimit() RateLimitSetting {
+	if value, ok := s.value(settingRateLimit).(*RateLimitSetting); ok {
+		return *value
+	}
+	return RateLimitSetting{}
+}
+
+// Set 检查并保存一项设置，by 为修改设置的调用方
+func (s *Settings) Set(key string, raw json.RawMessage, by string) error {
+	value, err := parseSetting(key, raw)
+	if err != nil {
+		return err
+	}
+	// 保存格式化后的值，去掉请求中的空白
+	compact, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.entries[key] = SettingEntry{Value: compact, UpdatedAt: time.Now().UTC(), UpdatedBy: by}
+	s.values[key] = value
+	s.mu.Unlock()
+	return s.save()
+}
+
+// Reset 删除通过管理接口修改的设置，恢复为配置文件中的初始值
+func (s *Settings) Reset(key string) error {
+	s.mu.Lock()
+	_, ok := s.entries[key]
+	delete(s.entries, key)
+	delete(s.values, key)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.save()
+}
+
+// List 返回所有已设置的项，按键排序
+func (s *Settings) List() []SettingStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := []SettingStatus{}
+	for key, entry := range s.entries {
+		updatedAt := entry.UpdatedAt
+		statuses = append(statuses, SettingStatus{Key: key, Value: entry.Value, Source: "admin", UpdatedAt: &updatedAt, UpdatedBy: entry.UpdatedBy})
+	}
+	for key, value := range s.defaults {
+		if _, ok := s.entries[key]; ok {
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			continue
+		}
+		statuses = append(statuses, SettingStatus{Key: key, Value: data, Source: "config"})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Key < statuses[j].Key
+	})
+	return statuses
+}
+
+// save 保存通过管理接口修改的设置
+func (s *Settings) save() error {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := s.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, s.file)
+}
+
+func (s *Settings) writeMetrics(w http.ResponseWriter) {
+	readOnly := 0
+	if s.ReadOnly().Enabled {
+		readOnly = 1
+	}
+	_, _ = fmt.Fprintf(w, "# HELP store_read_only Whether read-only mode is enabled through the settings API.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_read_only gauge\n")
+	_, _ = fmt.Fprintf(w, "store_read_only %d\n", readOnly)
+}
+
+// RateLimiter 结构按调用方的令牌桶限制请求速率，限制从运行时设置中读取，修改后立即生效
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	limited int64
+}
+
+// tokenBucket 是一个调用方的令牌桶，rule 改变时重新装满
+type tokenBucket struct {
+	rule   RateLimitRule
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiterMaxBuckets 是令牌桶数量的上限，超过时清理空闲的桶
+const rateLimiterMaxBuckets = 10000
+
+var rateLimiter = &RateLimiter{buckets: map[string]*tokenBucket{}}
+
+// Allow 判断调用方的请求是否允许，不允许时返回需要等待的时间
+func (l *RateLimiter) Allow(name string, now time.Time) (bool, time.Duration) {
+	rule := runtimeSettings.RateLimit().rule(name)
+	if rule.RequestsPerSecond <= 0 {
+		return true, 0
+	}
+	burst := float64(rule.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(rule.RequestsPerSecond))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[name]
+	if !ok || bucket.rule != rule {
+		if len(l.buckets) >= rateLimiterMaxBuckets {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{rule: rule, tokens: burst, last: now}
+		l.buckets[name] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rule.RequestsPerSecond)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	l.limited++
+	wait := time.Duration((1 - bucket.tokens) / rule.RequestsPerSecond * float64(time.Second))
+	return false, wait
+}
+
+// prune 删除一分钟内没有请求的令牌桶，这些桶已经重新装满，需要持有锁
+func (l *RateLimiter) prune(now time.Time) {
+	for name, bucket := range l.buckets {
+		if now.Sub(bucket.last) > time.Minute {
+			delete(l.buckets, name)
+		}
+	}
+}
+
+func (l *RateLimiter) writeMetrics(w http.ResponseWriter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP store_rate_limited_total Requests rejected by the per-caller rate limit.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_rate_limited_total counter\n")
+	_, _ = fmt.Fprintf(w, "store_rate_limited_total %d\n", l.limited)
+}
+
+// checkRateLimit 检查调用方的请求速率，超过限制时返回 429 和 Retry-After
+func checkRateLimit(w http.ResponseWriter, name string) bool {
+	allowed, wait := rateLimiter.Allow(name, time.Now())
+	if allowed {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
+
+// SettingRequest 结构是修改设置的请求
+type SettingRequest struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	// Reset 为 true 时删除通过管理接口修改的设置，恢复为配置文件中的初始值
+	Reset bool `json:"reset"`
+}
+
+// 查询或修改运行时设置，GET 返回所有设置，POST 修改一项设置
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		sendContentResponse(w, http.StatusOK, "success", runtimeSettings.List(), nil, r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+		return
+	}
+	var request SettingRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Key == "" || (!request.Reset && len(request.Value) == 0) {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	// 恢复初始值时只检查键
+	value := request.Value
+	if request.Reset {
+		value = json.RawMessage("{}")
+	}
+	_, err = parseSetting(request.Key, value)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的设置", err, r.URL.Path)
+		return
+	}
+	if request.Reset {
+		err = runtimeSettings.Reset(request.Key)
+	} else {
+		err = runtimeSettings.Set(request.Key, request.Value, identityName(r))
+	}
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "保存设置失败", err, r.URL.Path)
+		return
+	}
+	slog.InfoContext(r.Context(), "设置已修改", "key", request.Key)
+	sendContentResponse(w, http.StatusOK, "success", runtimeSettings.List(), nil, r.URL.Path)
+}
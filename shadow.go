@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowConfig 结构用于配置请求镜像，将抽样的生产请求异步发送到预发布实例，用于用真实流量验证新的存储后端和策略
+type ShadowConfig struct {
+	// Target 预发布实例的地址，如 http://staging:8082，为空时不镜像
+	Target string `json:"target"`
+	// SampleRate 镜像的请求比例，0 到 1，默认 0.01
+	SampleRate float64 `json:"sample_rate"`
+	// IncludeBodies 为 true 时写请求带上请求体，否则只镜像方法、路径和请求头
+	IncludeBodies bool `json:"include_bodies"`
+	// MaxBodyBytes 镜像的请求体的最大字节数，超过时只镜像元数据，默认 8 MiB
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// Token 发往预发布实例时使用的 Authorization，为空时不带认证信息；生产请求的凭证不会被转发
+	Token string `json:"token"`
+	// Queue 等待发送的请求数上限，队列满时丢弃，默认 256
+	Queue int `json:"queue"`
+	// Workers 并发发送的数量，默认 4
+	Workers int `json:"workers"`
+	// Timeout 发往预发布实例的超时时间，单位秒，默认 10
+	Timeout int `json:"timeout"`
+}
+
+// shadowHeader 标记镜像的请求，预发布实例收到带该请求头的请求时不会再次镜像
+const shadowHeader = "X-Shadow-Request"
+
+// shadowSkipHeaders 是镜像时不转发的请求头，包括逐跳请求头和凭证
+var shadowSkipHeaders = []string{"Authorization", "Cookie", "Connection", "Keep-Alive", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length"}
+
+// shadowRequest 结构表示一个等待发送的镜像请求
+type shadowRequest struct {
+	method     string
+	uri        string
+	header     http.Header
+	body       []byte
+	omitted    bool
+	remoteAddr string
+	// status 为生产实例的响应状态码，用于与预发布实例的结果比较
+	status int
+}
+
+// RequestShadow 结构用于抽样并异步镜像请求，发送失败或队列已满不影响生产请求
+type RequestShadow struct {
+	config ShadowConfig
+	client *http.Client
+	queue  chan shadowRequest
+
+	sent       atomic.Int64
+	dropped    atomic.Int64
+	failed     atomic.Int64
+	mismatched atomic.Int64
+}
+
+// requestShadow 未配置镜像时为 nil
+var requestShadow *RequestShadow
+
+// NewRequestShadow 创建请求镜像并启动发送的 goroutine，未配置预发布实例时返回 nil
+func NewRequestShadow(config ShadowConfig) *RequestShadow {
+	if config.Target == "" {
+		return nil
+	}
+	config.Target = strings.TrimSuffix(config.Target, "/")
+	if config.SampleRate <= 0 {
+		config.SampleRate = 0.01
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = 8 << 20
+	}
+	if config.Queue <= 0 {
+		config.Queue = 256
+	}
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10
+	}
+	s := &RequestShadow{
+		config: config,
+		client: &http.Client{
+			Timeout: time.Duration(config.Timeout) * time.Second,
+			// 重定向的结果也作为预发布实例的响应比较，不跟随
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queue: make(chan shadowRequest, config.Queue),
+	}
+	for i := 0; i < config.Workers; i++ {
+		go s.run()
+	}
+	return s
+}
+
+// shadowBody 在处理请求时记录读取的请求体，超过上限后不再保存
+type shadowBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	eof      bool
+}
+
+func (b *shadowBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// isWriteMethod 判断请求是否是写请求
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Middleware 在生产请求处理完成后将抽样的请求放入发送队列，管理接口和已经是镜像的请求不镜像
+func (s *RequestShadow) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") || r.Header.Get(shadowHeader) != "" || rand.Float64() >= s.config.SampleRate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		request := shadowRequest{
+			method:     r.Method,
+			uri:        r.URL.RequestURI(),
+			header:     r.Header.Clone(),
+			remoteAddr: r.RemoteAddr,
+		}
+		var body *shadowBody
+		if isWriteMethod(r.Method) && r.Body != nil && r.Body != http.NoBody {
+			if s.config.IncludeBodies && r.ContentLength <= s.config.MaxBodyBytes {
+				body = &shadowBody{ReadCloser: r.Body, limit: s.config.MaxBodyBytes}
+				r.Body = body
+			} else {
+				request.omitted = true
+			}
+		}
+
+		sw := newStatusWriter(w, 0)
+		next.ServeHTTP(sw, r)
+		request.status = sw.Status()
+
+		// 处理请求时没有读完或超过上限的请求体无法完整镜像，只镜像元数据
+		if body != nil {
+			if body.eof && !body.overflow {
+				request.body = body.buf.Bytes()
+			} else {
+				request.omitted = true
+			}
+		}
+		select {
+		case s.queue <- request:
+		default:
+			s.dropped.Add(1)
+		}
+	})
+}
+
+// run 从队列中取出请求发往预发布实例
+func (s *RequestShadow) run() {
+	for request := range s.queue {
+		err := s.send(request)
+		if err != nil {
+			s.failed.Add(1)
+			slog.Error("镜像请求失败", "method", request.method, "uri", request.uri, "err", err)
+		}
+	}
+}
+
+// send 发送一个镜像请求，并比较预发布实例与生产实例的状态码
+func (s *RequestShadow) send(request shadowRequest) error {
+	req, err := http.NewRequest(request.method, s.config.Target+request.uri, bytes.NewReader(request.body))
+	if err != nil {
+		return err
+	}
+	req.Header = request.header
+	for _, name := range shadowSkipHeaders {
+		req.Header.Del(name)
+	}
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", s.config.Token)
+	}
+	req.Header.Set(shadowHeader, "true")
+	if request.omitted {
+		req.Header.Set("X-Shadow-Body-Omitted", "true")
+	}
+	if host, _, err := net.SplitHostPort(request.remoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	_ = resp.Body.Close()
+	s.sent.Add(1)
+	if resp.StatusCode != request.status {
+		s.mismatched.Add(1)
+		slog.Info("镜像请求的状态码不一致", "method", request.method, "uri", request.uri, "status", request.status, "shadow_status", resp.StatusCode)
+	}
+	return nil
+}
+
+// writeMetrics 输出 Prometheus 格式的镜像统计
+func (s *RequestShadow) writeMetrics(w io.Writer) {
+	if s == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP store_shadow_requests_total Requests mirrored to the staging instance by result.\n")
+	fmt.Fprintf(w, "# TYPE store_shadow_requests_total counter\n")
+	fmt.Fprintf(w, "store_shadow_requests_total{result=\"sent\"} %d\n", s.sent.Load())
+	fmt.Fprintf(w, "store_shadow_requests_total{result=\"dropped\"} %d\n", s.dropped.Load())
+	fmt.Fprintf(w, "store_shadow_requests_total{result=\"failed\"} %d\n", s.failed.Load())
+	fmt.Fprintf(w, "# HELP store_shadow_status_mismatches_total Mirrored requests whose staging status differed from production.\n")
+	fmt.Fprintf(w, "# TYPE store_shadow_status_mismatches_total counter\n")
+	fmt.Fprintf(w, "store_shadow_status_mismatches_total %d\n", s.mismatched.Load())
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Share 结构表示一个分享链接
+type Share struct {
+	ID    string `json:"id"`
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir"`
+	// PasswordSalt 和 PasswordHash 是访问密码的 PBKDF2 哈希，为空表示无需密码
+	PasswordSalt string    `json:"password_salt,omitempty"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	CreatedBy    string    `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+	// ExpiresAt 为零值表示永不过期
+	ExpiresAt time.Time `json:"expires_at"`
+	Downloads int64     `json:"downloads"`
+	// BillingAccount 为创建分享的调用方的计费账号，通过分享链接的下载计入该账号
+	BillingAccount string `json:"billing_account,omitempty"`
+}
+
+// ShareInfo 结构用于返回分享的信息，不包含密码哈希
+type ShareInfo struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	Protected bool      `json:"protected"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Downloads int64     `json:"downloads"`
+}
+
+// ShareRequest 结构用于解析创建分享的请求
+type ShareRequest struct {
+	Path     string `json:"path"`
+	Password string `json:"password"`
+	// ExpiresIn 有效期，单位秒，为 0 表示永不过期
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// ShareStore 结构用于保存分享链接，持久化在 data/.meta/shares.json
+type ShareStore struct {
+	mu     sync.Mutex
+	file   string
+	shares map[string]*Share
+	dirty  bool
+}
+
+// shareStore 保存所有分享链接
+var shareStore *ShareStore
+
+// OpenShareStore 从文件加载分享链接，文件不存在时返回空的集合
+func OpenShareStore(file string) (*ShareStore, error) {
+	store := &ShareStore{
+		file:   file,
+		shares: map[string]*Share{},
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &store.shares)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Get 返回未过期的分享
+func (s *ShareStore) Get(id string) (Share, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share, ok := s.shares[id]
+	if !ok || share.expired(time.Now()) {
+		return Share{}, false
+	}
+	return *share, true
+}
+
+// Add 添加分享并立即保存
+func (s *ShareStore) Add(share *Share) error {
+	s.mu.Lock()
+	s.shares[share.ID] = share
+	s.dirty = true
+	s.mu.Unlock()
+	return s.Save()
+}
+
+// Revoke 撤销分享并立即保存，分享不存在时返回 false
+func (s *ShareStore) Revoke(id string) (bool, error) {
+	s.mu.Lock()
+	_, ok := s.shares[id]
+	delete(s.shares, id)
+	// 不能清除 CountDownload 留下的未保存标记
+	s.dirty = s.dirty || ok
+	s.mu.Unlock()
+	return ok, s.Save()
+}
+
+// CountDownload 增加下载次数，由 Run 定期保存
+func (s *ShareStore) CountDownload(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if share, ok := s.shares[id]; ok {
+		share.Downloads++
+		s.dirty = true
+	}
+}
+
+// List 返回路径前缀匹配的分享，按创建时间排序
+func (s *ShareStore) List(prefix string) []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var shares []Share
+	for _, share := range s.shares {
+		if prefix == "" || share.Path == prefix || strings.HasPrefix(share.Path, prefix+"/") {
+			shares = append(shares, *share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].CreatedAt.Before(shares[j].CreatedAt)
+	})
+	return shares
+}
+
+// Save 将修改写入磁盘，过期的分享在保存时清理
+func (s *ShareStore) Save() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	for id, share := range s.shares {
+		if share.expired(now) {
+			delete(s.shares, id)
+		}
+	}
+	data, err := json.Marshal(s.shares)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := s.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, s.file)
+}
+
+// Run 按固定间隔保存下载次数等修改
+func (s *ShareStore) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := s.Save()
+		if err != nil {
+			slog.Error("保存分享失败", "err", err)
+		}
+	}
+}
+
+func (share *Share) expired(now time.Time) bool {
+	return !share.ExpiresAt.IsZero() && now.After(share.ExpiresAt)
+}
+
+// hashSharePassword 使用 PBKDF2 计算访问密码的哈希
+func hashSharePassword(password string, salt []byte) (string, error) {
+	key, err := pbkdf2.Key(sha256.New, password, salt, 100000, 32)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// checkPassword 校验访问密码
+func (share *Share) checkPassword(password string) bool {
+	salt, err := hex.DecodeString(share.PasswordSalt)
+	if err != nil {
+		return false
+	}
+	hash, err := hashSharePassword(password, salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(share.PasswordHash)) == 1
+}
+
+// 分享密码的尝试限制：同一客户端对同一分享连续失败 sharePasswordClientAttempts 次后、同一分享所有客户端累计失败
+// sharePasswordShareAttempts 次后，每次失败的等待时间从 1 秒开始翻倍，最长 sharePasswordMaxDelay；
+// 最后一次失败超过 sharePasswordResetAfter 后重新计数
+const (
+	sharePasswordClientAttempts = 5
+	sharePasswordShareAttempts  = 50
+	sharePasswordMaxDelay       = 15 * time.Minute
+	sharePasswordResetAfter     = time.Hour
+)
+
+// passwordFailures 结构是一个客户端或一个分享的连续失败记录
+type passwordFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// SharePasswordGuard 结构限制分享密码的尝试次数，防止在线暴力破解；记录只保存在内存中
+type SharePasswordGuard struct {
+	mu       sync.Mutex
+	failures map[string]*passwordFailures
+}
+
+// sharePasswordGuard 总是启用
+var sharePasswordGuard = &SharePasswordGuard{failures: map[string]*passwordFailures{}}
+
+// passwordGuardKeys 返回分享和客户端的记录的键，以及各自开始等待的失败次数
+func passwordGuardKeys(id string, ip string) ([2]string, [2]int) {
+	return [2]string{"share\n" + id, "client\n" + id + "\n" + ip}, [2]int{sharePasswordShareAttempts, sharePasswordClientAttempts}
+}
+
+// Wait 返回还需要等待多久才能再次尝试，为 0 时可以尝试
+func (g *SharePasswordGuard) Wait(id string, ip string, now time.Time) time.Duration {
+	keys, _ := passwordGuardKeys(id, ip)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if f, ok := g.failures[key]; ok && f.until.After(now) && f.until.Sub(now) > wait {
+			wait = f.until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Fail 记录一次失败的尝试
+func (g *SharePasswordGuard) Fail(id string, ip string, now time.Time) {
+	keys, thresholds := passwordGuardKeys(id, ip)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// 记录过多时清理已经重新计数的记录
+	if len(g.failures) > 10000 {
+		for key, f := range g.failures {
+			if now.Sub(f.last) > sharePasswordResetAfter {
+				delete(g.failures, key)
+			}
+		}
+	}
+	for i, key := range keys {
+		f, ok := g.failures[key]
+		if !ok || now.Sub(f.last) > sharePasswordResetAfter {
+			f = &passwordFailures{}
+			g.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count >= thresholds[i] {
+			delay := sharePasswordMaxDelay
+			if shift := f.count - thresholds[i]; shift < 10 {
+				delay = min(time.Second<<shift, sharePasswordMaxDelay)
+			}
+			f.until = now.Add(delay)
+		}
+	}
+}
+
+// Succeed 在密码正确后清除该客户端的失败记录
+func (g *SharePasswordGuard) Succeed(id string, ip string) {
+	keys, _ := passwordGuardKeys(id, ip)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.failures, keys[1])
+}
+
+// cookieValue 是输入密码后保存在浏览器中的凭证，由密码哈希派生，撤销或重新分享后失效
+func (share *Share) cookieValue() string {
+	sum := sha256.Sum256([]byte("share\n" + share.ID + "\n" + share.PasswordHash))
+	return hex.EncodeToString(sum[:])
+}
+
+// info 返回分享的公开信息
+func (share *Share) info(r *http.Request) ShareInfo {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link := url.URL{Scheme: scheme, Host: r.Host, Path: "/s/" + share.ID}
+	return ShareInfo{
+		ID:        share.ID,
+		URL:       link.String(),
+		Path:      share.Path,
+		IsDir:     share.IsDir,
+		Protected: share.PasswordHash != "",
+		CreatedBy: share.CreatedBy,
+		CreatedAt: share.CreatedAt,
+		ExpiresAt: share.ExpiresAt,
+		Downloads: share.Downloads,
+	}
+}
+
+// 创建分享链接
+func createShareHandler(w http.ResponseWriter, r *http.Request) {
+	var request ShareRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "解析JSON数据失败", err, r.URL.Path)
+		return
+	}
+	key := indexKey(request.Path)
+	if key == "" || isReservedPath(request.Path) || isUnsafePath(request.Path) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的分享路径", nil, r.URL.Path)
+		return
+	}
+	fileInfo, err := os.Stat(filepath.Join("data", key))
+	if err != nil {
+		sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", err, r.URL.Path)
+		return
+	}
+	if request.ExpiresIn < 0 {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的有效期", nil, r.URL.Path)
+		return
+	}
+
+	id := make([]byte, 9)
+	_, err = rand.Read(id)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	share := &Share{
+		ID:             base64.RawURLEncoding.EncodeToString(id),
+		Path:           key,
+		IsDir:          fileInfo.IsDir(),
+		CreatedBy:      identityName(r),
+		CreatedAt:      time.Now(),
+		BillingAccount: egressAccount(r),
+	}
+	if request.ExpiresIn > 0 {
+		share.ExpiresAt = share.CreatedAt.Add(time.Duration(request.ExpiresIn) * time.Second)
+	}
+	if request.Password != "" {
+		salt := make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err == nil {
+			share.PasswordSalt = hex.EncodeToString(salt)
+			share.PasswordHash, err = hashSharePassword(request.Password, salt)
+		}
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+			return
+		}
+	}
+
+	err = shareStore.Add(share)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "保存分享失败", err, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "分享成功", share.info(r), nil, r.URL.Path)
+}
+
+// 列出分享链接，可以按路径前缀过滤；只返回调用方可以读取的路径，链接本身即可下载文件
+func listSharesHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := indexKey(r.URL.Query().Get("path"))
+	infos := []ShareInfo{}
+	for _, share := range shareStore.List(prefix) {
+		if !authorizePath(r, scopeRead, share.Path) {
+			continue
+		}
+		infos = append(infos, share.info(r))
+	}
+	sendContentResponse(w, http.StatusOK, "success", infos, nil, r.URL.Path)
+}
+
+// 撤销分享链接，调用方需要对分享的路径有写权限
+func revokeShareHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ID string `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "解析JSON数据失败", err, r.URL.Path)
+		return
+	}
+	share, ok := shareStore.Get(request.ID)
+	if !ok {
+		sendJSONResponse(w, http.StatusNotFound, "分享不存在", nil, r.URL.Path)
+		return
+	}
+	if !authorizePath(r, scopeWrite, share.Path) {
+		sendJSONResponse(w, http.StatusForbidden, "无权撤销该分享", nil, r.URL.Path)
+		return
+	}
+	ok, err = shareStore.Revoke(request.ID)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "保存分享失败", err, r.URL.Path)
+		return
+	}
+	if !ok {
+		sendJSONResponse(w, http.StatusNotFound, "分享不存在", nil, r.URL.Path)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, "撤销成功", nil, r.URL.Path)
+}
+
+// ShareEntry 结构表示分享页面中的文件或目录
+type ShareEntry struct {
+	Name  string    `json:"name"`
+	Path  string    `json:"path"`
+	IsDir bool      `json:"is_dir"`
+	Size  int64     `json:"size"`
+	Date  time.Time `json:"date"`
+}
+
+// SharePage 结构是分享页面的内容
+type SharePage struct {
+	ShareInfo
+	Name    string       `json:"name"`
+	Size    int64        `json:"size"`
+	Date    time.Time    `json:"date"`
+	Entries []ShareEntry `json:"entries,omitempty"`
+	// Sub 是当前页面在分享目录中的相对路径
+	Sub string `json:"sub,omitempty"`
+}
+
+// 分享页面，浏览器访问时返回 HTML，其他客户端返回 JSON；
+// /s/<id> 显示分享的文件或目录，目录分享可以通过 /s/<id>/<子路径> 浏览，带 download=1 时下载文件
+func sharePageHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/s/")
+	id, sub, _ := strings.Cut(rest, "/")
+	share, ok := shareStore.Get(id)
+	if !ok {
+		sendJSONResponse(w, http.StatusNotFound, "分享不存在或已过期", nil, r.URL.Path)
+		return
+	}
+	wantHTML := strings.Contains(r.Header.Get("Accept"), "text/html")
+
+	// 校验访问密码，浏览器通过表单提交密码后保存在 cookie 中
+	if share.PasswordHash != "" {
+		cookieName := "share_" + share.ID
+		cookie, err := r.Cookie(cookieName)
+		authorized := err == nil && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(share.cookieValue())) == 1
+		password := ""
+		if !authorized {
+			password = r.Header.Get("X-Share-Password")
+			if r.Method == http.MethodPost {
+				password = r.PostFormValue("password")
+			}
+			if password != "" {
+				ip := geoLocator.ClientIP(r).String()
+				now := time.Now()
+				if wait := sharePasswordGuard.Wait(share.ID, ip, now); wait > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					sendJSONResponse(w, http.StatusTooManyRequests, "密码错误次数过多，请稍后重试", nil, r.URL.Path)
+					return
+				}
+				authorized = share.checkPassword(password)
+				if authorized {
+					sharePasswordGuard.Succeed(share.ID, ip)
+				} else {
+					sharePasswordGuard.Fail(share.ID, ip, now)
+				}
+			}
+			if authorized && r.Method == http.MethodPost {
+				http.SetCookie(w, &http.Cookie{
+					Name:     cookieName,
+					Value:    share.cookieValue(),
+					Path:     "/s/" + share.ID,
+					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteLaxMode,
+				})
+				http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+				return
+			}
+		}
+		if !authorized {
+			if wantHTML {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(http.StatusUnauthorized)
+				renderSharePage(w, nil, password != "")
+				return
+			}
+			sendJSONResponse(w, http.StatusUnauthorized, "需要访问密码", nil, r.URL.Path)
+			return
+		}
+	}
+
+	// 只有目录分享可以访问子路径，子路径经过规范化，不能跳出分享的目录
+	sub = indexKey(sub)
+	if sub != "" && !share.IsDir {
+		sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", nil, r.URL.Path)
+		return
+	}
+	target := share.Path
+	if sub != "" {
+		target = share.Path + "/" + sub
+	}
+	if isReservedPath(target) || isUnsafePath(target) {
+		sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", nil, r.URL.Path)
+		return
+	}
+	fullPath := filepath.Join("data", target)
+	fileInfo, err := os.Stat(fullPath)
+	if err != nil {
+		sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", err, r.URL.Path)
+		return
+	}
+
+	if !fileInfo.IsDir() && r.URL.Query().Get("download") == "1" {
+		serveSharedFile(w, r, share, target, fileInfo)
+		return
+	}
+
+	page := SharePage{
+		ShareInfo: share.info(r),
+		Name:      fileInfo.Name(),
+		Size:      fileInfo.Size(),
+		Date:      fileInfo.ModTime(),
+		Sub:       sub,
+	}
+	if fileInfo.IsDir() {
+		entries, err := os.ReadDir(fullPath)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "读取目录失败", err, r.URL.Path)
+			return
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			page.Entries = append(page.Entries, ShareEntry{
+				Name:  entry.Name(),
+				Path:  strings.TrimPrefix(sub+"/"+entry.Name(), "/"),
+				IsDir: entry.IsDir(),
+				Size:  info.Size(),
+				Date:  info.ModTime(),
+			})
+		}
+	}
+
+	if wantHTML {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		renderSharePage(w, &page, false)
+	} else {
+		sendContentResponse(w, http.StatusOK, "success", page, nil, r.URL.Path)
+	}
+}
+
+// serveSharedFile 以附件形式返回分享的文件
+func serveSharedFile(w http.ResponseWriter, r *http.Request, share Share, key string, fileInfo os.FileInfo) {
+	if !verifyServedFile(w, r, key, filepath.Join("data", key), fileInfo) {
+		return
+	}
+	file, err := openDataFile(filepath.Join("data", key))
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "closing file", "err", err)
+		}
+	}(file)
+
+	contentType, err := detectMimeType(fileInfo.Name(), file)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", fileInfo.Name()))
+	sw := newStatusWriter(w, 0)
+	http.ServeContent(sw, r, fileInfo.Name(), fileInfo.ModTime(), file)
+	shareStore.CountDownload(share.ID)
+	downloadStats.Record(r, sw.bytes)
+	egressAccounting.RecordShare(share, sw.bytes)
+	accessTracker.Touch(key, fileInfo.ModTime())
+}
+
+var sharePageTemplate = template.Must(template.New("share").Funcs(template.FuncMap{
+	"pathEscape": func(path string) string {
+		return (&url.URL{Path: path}).EscapedPath()
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Page}}{{.Page.Name}}{{else}}需要访问密码{{end}}</title>
+<style>
+body{font-family:sans-serif;max-width:720px;margin:40px auto;padding:0 16px;color:#222}
+table{width:100%;border-collapse:collapse}td{padding:6px 4px;border-bottom:1px solid #eee}
+.muted{color:#888;font-size:0.9em}a.button{display:inline-block;padding:8px 16px;background:#1677ff;color:#fff;text-decoration:none;border-radius:4px}
+</style>
+</head>
+<body>
+{{if .Page}}{{with .Page}}
+<h2>{{.Name}}</h2>
+<p class="muted">由 {{.CreatedBy}} 分享{{if not .ExpiresAt.IsZero}}，{{.ExpiresAt.Format "2006-01-02 15:04"}} 过期{{end}}</p>
+{{if .IsDir}}
+{{if .Sub}}<p><a href="../">返回上一级</a></p>{{end}}
+<table>
+{{range .Entries}}<tr><td>{{if .IsDir}}<a href="/s/{{$.Page.ID}}/{{pathEscape .Path}}/">{{.Name}}/</a>{{else}}<a href="/s/{{$.Page.ID}}/{{pathEscape .Path}}?download=1">{{.Name}}</a>{{end}}</td><td class="muted">{{if not .IsDir}}{{.Size}} 字节{{end}}</td><td class="muted">{{.Date.Format "2006-01-02 15:04"}}</td></tr>
+{{else}}<tr><td class="muted">空目录</td></tr>{{end}}
+</table>
+{{else}}
+<p class="muted">{{.Size}} 字节，修改于 {{.Date.Format "2006-01-02 15:04"}}</p>
+<p><a class="button" href="?download=1">下载</a></p>
+{{end}}
+{{end}}{{else}}
+<h2>需要访问密码</h2>
+{{if .Wrong}}<p style="color:#d00">密码错误</p>{{end}}
+<form method="post"><input type="password" name="password" autofocus> <button type="submit">确定</button></form>
+{{end}}
+</body>
+</html>
+`))
+
+// renderSharePage 渲染分享页面，page 为空时显示密码表单
+func renderSharePage(w io.Writer, page *SharePage, wrong bool) {
+	err := sharePageTemplate.Execute(w, struct {
+		Page  *SharePage
+		Wrong bool
+	}{page, wrong})
+	if err != nil {
+		slog.Error("渲染分享页面失败", "err", err)
+	}
+}
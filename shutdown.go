@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownConfig 结构用于配置收到 SIGTERM 或 SIGINT 后的停止过程
+type ShutdownConfig struct {
+	// Timeout 等待进行中的请求（如上传和下载）完成的最长时间，单位秒，默认 30，超时后强制断开
+	Timeout int `json:"timeout"`
+}
+
+// shutdownHook 是停止服务时执行的一项收尾工作
+type shutdownHook struct {
+	name string
+	fn   func() error
+}
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []shutdownHook
+	// stopping 在开始停止服务时关闭，变更推送和长轮询等不会自行结束的请求随之返回
+	stopping = make(chan struct{})
+	// restartRequests 接收重启的请求，内容为重启后执行的程序路径，重启与收到停止信号一样先等待请求完成并执行收尾工作
+	restartRequests = make(chan string, 1)
+)
+
+// errRestartPending 表示已经在重启或停止服务
+var errRestartPending = errors.New("已经在重启或停止服务")
+
+// requestRestart 请求停止服务后执行 executable 替换当前进程，只登记请求，立即返回
+func requestRestart(executable string) error {
+	select {
+	case <-stopping:
+		return errRestartPending
+	default:
+	}
+	select {
+	case restartRequests <- executable:
+		return nil
+	default:
+		return errRestartPending
+	}
+}
+
+// onShutdown 登记停止服务时执行的收尾工作，如保存索引和积压；所有请求结束之后按登记的相反顺序执行，
+// 先启动的组件（如索引）最后保存
+func onShutdown(name string, fn func() error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// runShutdownHooks 执行登记的收尾工作，失败只记录日志，继续执行其余的
+func runShutdownHooks() {
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		err := hooks[i].fn()
+		if err != nil {
+			slog.Error("停止服务时保存失败", "name", hooks[i].name, "err", err)
+		}
+	}
+}
+
+// serveUntilSignal 在 listener 上提供服务，收到 SIGTERM 或 SIGINT 后停止接受新连接，等待进行中的请求完成，
+// 之后执行收尾工作再返回；收到重启请求时同样停止，收尾后执行新的程序。
+// others 为一起停止的其他服务，如独立监听的管理接口，未配置的为 nil
+func serveUntilSignal(server *http.Server, listener net.Listener, config ShutdownConfig, others ...*http.Server) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	reason, executable := "", ""
+	select {
+	case err := <-served:
+		return err
+	case sig := <-signals:
+		reason = sig.String()
+	case executable = <-restartRequests:
+		reason = "restart"
+	}
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	slog.Info("开始停止服务，等待进行中的请求完成", "reason", reason, "timeout", timeout.String())
+	close(stopping)
+	// 等待期间再次收到信号时立即停止
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			slog.Warn("再次收到停止信号，不再等待进行中的请求")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, s := range append([]*http.Server{server}, others...) {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			err := s.Shutdown(ctx)
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				slog.Warn("等待请求完成超时，强制断开剩余的连接")
+				_ = s.Close()
+			} else if err != nil {
+				slog.Error("停止服务失败", "err", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	runShutdownHooks()
+	if executable == "" {
+		slog.Info("服务已停止")
+		return nil
+	}
+	slog.Info("服务已停止，正在重启", "executable", executable)
+	err := restartProcess(executable)
+	return fmt.Errorf("重启失败，新版本将在下次启动时生效 %w", err)
+}
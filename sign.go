@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SignConfig 结构用于配置预签名的下载和上传链接
+type SignConfig struct {
+	// Secret 签名密钥，支持 env:、file:、vault:// 引用；为空时每次启动随机生成，重启后之前的链接失效
+	Secret string `json:"secret"`
+	// DefaultTTL 未指定有效期时链接的有效时间，单位秒，默认 3600
+	DefaultTTL int64 `json:"default_ttl"`
+	// MaxTTL 链接有效期的上限，单位秒，默认 7 天
+	MaxTTL int64 `json:"max_ttl"`
+	// Private 为 true 时 /get/ 和 /thumb/ 默认需要认证或有效的签名才能访问，等同于 visibility.default 为 private
+	Private bool `json:"private"`
+	// CDN 生成 CDN 能够识别的签名链接
+	CDN CDNSignConfig `json:"cdn"`
+}
+
+// SignResult 结构用于返回签名后的链接
+type SignResult struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// URLSigner 结构用于生成和校验预签名链接
+type URLSigner struct {
+	secret []byte
+	config SignConfig
+	// cdn 在未配置 CDN 签名时为 nil
+	cdn *cdnSigner
+
+	mu sync.Mutex
+	// nonces 记录正在上传的链接，值为链接的过期时间
+	nonces map[string]int64
+	// used 记录已上传成功的链接，值为链接的过期时间，保存在 file 中，重启后仍然不能再次使用，过期后清理
+	used   map[string]int64
+	file   string
+	saveMu sync.Mutex
+}
+
+// NewURLSigner 创建链接签名器，file 保存已使用的一次性上传链接
+func NewURLSigner(config SignConfig, file string) (*URLSigner, error) {
+	if config.DefaultTTL <= 0 {
+		config.DefaultTTL = 3600
+	}
+	if config.MaxTTL <= 0 {
+		config.MaxTTL = 7 * 24 * 3600
+	}
+	secret := []byte(config.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("未配置 sign.secret，使用随机密钥，重启后已签发的链接失效")
+	}
+	cdn, err := newCDNSigner(config.CDN, secret)
+	if err != nil {
+		return nil, err
+	}
+	s := &URLSigner{secret: secret, config: config, cdn: cdn, nonces: make(map[string]int64), used: make(map[string]int64), file: file}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.used)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// signature 计算文件路径、历史版本和过期时间的签名，version 为空时表示当前版本，与之前签发的链接兼容
+func (s *URLSigner) signature(key string, version string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	if version == "" {
+		_, _ = fmt.Fprintf(mac, "get\n%s\n%d", key, expires)
+	} else {
+		_, _ = fmt.Fprintf(mac, "get\n%s\n%d\nversion=%s", key, expires, version)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 校验请求中的签名，签名覆盖文件路径、过期时间和 version 参数，download、w 等参数可以自由添加；
+// 当前版本的链接加上 version 参数后签名不匹配，不能用来下载历史版本
+func (s *URLSigner) Verify(r *http.Request, key string) bool {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := s.signature(key, query.Get("version"), expires)
+	return hmac.Equal([]byte(expected), []byte(query.Get("signature")))
+}
+
+// Middleware 公开的文件直接放行；不公开的文件在签名有效时放行，否则按普通请求认证
+func (s *URLSigner) Middleware(next http.Handler, auth AuthProvider, visibility *Visibility, prefix string) http.Handler {
+	authenticated := AuthMiddleware(next, auth, scopeRead)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := indexKey(strings.TrimPrefix(r.URL.Path, prefix))
+		if r.URL.Query().Get("signature") != "" {
+			if !s.Verify(r, key) {
+				sendJSONResponse(w, http.StatusForbidden, "链接无效或已过期", nil, r.URL.Path)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if visibility.IsPublic(key) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authenticated.ServeHTTP(w, r)
+	})
+}
+
+// 为文件生成限时的下载链接，持有链接的浏览器或第三方无需 Authorization 请求头即可下载
+func signHandler(w http.ResponseWriter, r *http.Request, signer *URLSigner) {
+	path := r.URL.Query().Get("path")
+	key := indexKey(path)
+	if key == "" || isReservedPath(path) || isUnsafePath(path) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的文件路径", nil, r.URL.Path)
+		return
+	}
+	// 带有 version 参数时为历史版本生成链接，文件已被删除时历史版本仍然可以签名
+	version := r.URL.Query().Get("version")
+	if version != "" {
+		n, err := strconv.Atoi(version)
+		if err != nil || n <= 0 || versioning == nil {
+			sendJSONResponse(w, http.StatusNotFound, "历史版本不存在", err, r.URL.Path)
+			return
+		}
+		_, err = os.Stat(versionPath(key, n))
+		if err != nil {
+			sendJSONResponse(w, http.StatusNotFound, "历史版本不存在", err, r.URL.Path)
+			return
+		}
+	} else {
+		fileInfo, err := os.Stat(filepath.Join("data", key))
+		if err != nil || fileInfo.IsDir() {
+			sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", err, r.URL.Path)
+			return
+		}
+	}
+
+	ttl := signer.config.DefaultTTL
+	if value := r.URL.Query().Get("expires_in"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			sendJSONResponse(w, http.StatusBadRequest, "非法的有效期", err, r.URL.Path)
+			return
+		}
+		ttl = parsed
+	}
+	if ttl > signer.config.MaxTTL {
+		sendJSONResponse(w, http.StatusBadRequest, fmt.Sprintf("有效期不能超过 %d 秒", signer.config.MaxTTL), nil, r.URL.Path)
+		return
+	}
+
+	expires := time.Now().Add(time.Duration(ttl) * time.Second).Truncate(time.Second)
+
+	// cdn=1 时生成 CDN 签名链接
+	if r.URL.Query().Get("cdn") == "1" {
+		if signer.cdn == nil {
+			sendJSONResponse(w, http.StatusBadRequest, "未配置 CDN 签名", nil, r.URL.Path)
+			return
+		}
+		// CDN 签名不覆盖查询参数，不能用于历史版本
+		if version != "" {
+			sendJSONResponse(w, http.StatusBadRequest, "CDN 签名链接不支持历史版本", nil, r.URL.Path)
+			return
+		}
+		signed, err := signer.cdn.Sign(key, expires)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "签名失败", err, r.URL.Path)
+			return
+		}
+		sendContentResponse(w, http.StatusOK, "success", SignResult{URL: signed, Expires: expires}, nil, r.URL.Path)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if version != "" {
+		query.Set("version", version)
+	}
+	query.Set("signature", signer.signature(key, version, expires.Unix()))
+	signed := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     "/get/" + key,
+		RawQuery: query.Encode(),
+	}
+
+	sendContentResponse(w, http.StatusOK, "success", SignResult{URL: signed.String(), Expires: expires}, nil, r.URL.Path)
+}
+
+// UploadSignResult 结构用于返回签名后的上传链接
+type UploadSignResult struct {
+	URL     string    `json:"url"`
+	Method  string    `json:"method"`
+	Field   string    `json:"field"`
+	MaxSize int64     `json:"max_size"`
+	Expires time.Time `json:"expires"`
+}
+
+// uploadLimitKey 是请求上下文中保存上传大小上限的键
+type uploadLimitKey struct{}
+
+// uploadSignature 计算上传链接的签名，覆盖目标路径、大小上限、过期时间、一次性随机数和签发者的身份
+func (s *URLSigner) uploadSignature(query url.Values) string {
+	mac := hmac.New(sha256.New, s.secret)
+	_, _ = fmt.Fprintf(mac, "upload\n%s\n%s\n%s\n%s\n%s\n%s\n%s",
+		query.Get("path"), query.Get("max_size"), query.Get("expires"), query.Get("nonce"),
+		query.Get("issuer"), query.Get("provider"), query.Get("actor"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// reserve 占用上传链接，已上传成功或正在上传时返回 false
+func (s *URLSigner) reserve(nonce string, expires int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, pending := s.nonces[nonce]
+	_, used := s.used[nonce]
+	if pending || used {
+		return false
+	}
+	s.nonces[nonce] = expires
+	return true
+}
+
+// release 上传失败时释放链接以便重试，成功时记录为已使用并保存，直到链接过期
+func (s *URLSigner) release(nonce string, used bool) {
+	s.mu.Lock()
+	expires := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	if !used {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now().Unix()
+	for n, nonceExpires := range s.used {
+		if nonceExpires < now {
+			delete(s.used, n)
+		}
+	}
+	s.used[nonce] = expires
+	s.mu.Unlock()
+	err := s.save()
+	if err != nil {
+		slog.Error("保存已使用的上传链接失败", "err", err)
+	}
+}
+
+// save 保存已使用的上传链接
+func (s *URLSigner) save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	data, err := json.Marshal(s.used)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := s.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, s.file)
+}
+
+// UploadMiddleware 带有签名的上传请求按签名中的路径和大小上限上传，每个链接只能成功上传一次；
+// 上传以签发者的身份进行，签发者被暂停、超过限流或策略引擎不允许写入该路径时拒绝。其他请求按普通请求认证
+func (s *URLSigner) UploadMiddleware(next http.Handler, auth AuthProvider) http.Handler {
+	authenticated := AuthMiddleware(next, auth, scopeWrite)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("signature") == "" {
+			authenticated.ServeHTTP(w, r)
+			return
+		}
+
+		expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+		maxSize, sizeErr := strconv.ParseInt(query.Get("max_size"), 10, 64)
+		expected := s.uploadSignature(query)
+		if err != nil || sizeErr != nil || time.Now().Unix() > expires || query.Get("nonce") == "" ||
+			!hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+			sendJSONResponse(w, http.StatusForbidden, "链接无效或已过期", nil, r.URL.Path)
+			return
+		}
+
+		// 目标路径以签名为准，忽略客户端提供的路径；请求体多留一些空间给 multipart 的边界和表单头
+		r.Header.Set("X-FormFile-Path", query.Get("path"))
+		r.Header.Del(replicationHeader)
+		identity := &Identity{Name: query.Get("issuer"), Provider: query.Get("provider"), Actor: query.Get("actor"), Scopes: []string{scopeWrite}}
+		traceIdentity(r, identity)
+		auditIdentity(r, identity)
+		accessLogIdentity(r, identity)
+		logIdentity(r, identity)
+		if anomalyDetector.Suspended(identity.Name) || anomalyDetector.Suspended(identity.Actor) {
+			http.Error(w, "Suspended", http.StatusForbidden)
+			return
+		}
+		if !checkRateLimit(w, identity.Name) {
+			return
+		}
+		allowed, err := authorizeRequest(r, identity, scopeWrite)
+		if err != nil || !allowed {
+			if err != nil {
+				slog.ErrorContext(r.Context(), "授权失败", "err", err)
+			}
+			http.Error(w, "Forbidden by policy", http.StatusForbidden)
+			return
+		}
+
+		nonce := query.Get("nonce")
+		if !s.reserve(nonce, expires) {
+			sendJSONResponse(w, http.StatusConflict, "链接已被使用", nil, r.URL.Path)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+64<<10)
+		ctx := context.WithValue(r.Context(), identityKey{}, identity)
+		ctx = context.WithValue(ctx, uploadLimitKey{}, maxSize)
+
+		sw := newStatusWriter(w, 0)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		s.release(nonce, sw.Status() == http.StatusOK)
+	})
+}
+
+// 为指定路径生成一次性的上传链接，终端用户的浏览器可以直接上传而无需获得 API token
+func signUploadHandler(w http.ResponseWriter, r *http.Request, signer *URLSigner) {
+	path := r.URL.Query().Get("path")
+	key := indexKey(path)
+	if key == "" || isReservedPath(path) || isUnsafePath(path) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的存储路径", nil, r.URL.Path)
+		return
+	}
+	maxSize, err := strconv.ParseInt(r.URL.Query().Get("max_size"), 10, 64)
+	if err != nil || maxSize <= 0 {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少文件大小上限 max_size", err, r.URL.Path)
+		return
+	}
+
+	ttl := signer.config.DefaultTTL
+	if value := r.URL.Query().Get("expires_in"); value != "" {
+		ttl, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || ttl <= 0 {
+			sendJSONResponse(w, http.StatusBadRequest, "非法的有效期", err, r.URL.Path)
+			return
+		}
+	}
+	if ttl > signer.config.MaxTTL {
+		sendJSONResponse(w, http.StatusBadRequest, fmt.Sprintf("有效期不能超过 %d 秒", signer.config.MaxTTL), nil, r.URL.Path)
+		return
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	expires := time.Now().Add(time.Duration(ttl) * time.Second).Truncate(time.Second)
+	query := url.Values{}
+	query.Set("path", key)
+	query.Set("max_size", strconv.FormatInt(maxSize, 10))
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("nonce", hex.EncodeToString(nonce))
+	// 签发者的身份随链接签名，上传时按签发者检查暂停、限流和策略
+	if identity := identityFrom(r); identity != nil {
+		query.Set("issuer", identity.Name)
+		query.Set("provider", identity.Provider)
+		if identity.Actor != "" {
+			query.Set("actor", identity.Actor)
+		}
+	}
+	query.Set("signature", signer.uploadSignature(query))
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	signed := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     "/upload",
+		RawQuery: query.Encode(),
+	}
+
+	sendContentResponse(w, http.StatusOK, "success", UploadSignResult{
+		URL:     signed.String(),
+		Method:  http.MethodPost,
+		Field:   "file",
+		MaxSize: maxSize,
+		Expires: expires,
+	}, nil, r.URL.Path)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// listSnapshot 结构表示某一时刻已过滤和排序的目录列表，分页时从中取出
+type listSnapshot struct {
+	key       string
+	recursive bool
+	entries   []ListEntry
+	createdAt time.Time
+	// usedAt 为最后一次读取的时间，超过有效期没有读取的快照被删除
+	usedAt time.Time
+}
+
+// ListSnapshots 结构用于保存一致性列表的快照，快照只保存在内存中，重启后失效
+type ListSnapshots struct {
+	mu        sync.Mutex
+	snapshots map[string]*listSnapshot
+	ttl       time.Duration
+	max       int
+}
+
+// listSnapshots 保存一致性列表的快照
+var listSnapshots *ListSnapshots
+
+// NewListSnapshots 按目录列表的配置创建快照存储
+func NewListSnapshots(config ListConfig) *ListSnapshots {
+	if config.SnapshotTTL <= 0 {
+		config.SnapshotTTL = 300
+	}
+	if config.MaxSnapshots <= 0 {
+		config.MaxSnapshots = 100
+	}
+	return &ListSnapshots{
+		snapshots: make(map[string]*listSnapshot),
+		ttl:       time.Duration(config.SnapshotTTL) * time.Second,
+		max:       config.MaxSnapshots,
+	}
+}
+
+// Create 保存快照并返回快照的 token，快照数达到上限时删除最久没有读取的快照
+func (s *ListSnapshots) Create(key string, recursive bool, entries []ListEntry) (string, time.Time, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(id)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	for len(s.snapshots) >= s.max {
+		var oldest string
+		for t, snapshot := range s.snapshots {
+			if oldest == "" || snapshot.usedAt.Before(s.snapshots[oldest].usedAt) {
+				oldest = t
+			}
+		}
+		delete(s.snapshots, oldest)
+	}
+	s.snapshots[token] = &listSnapshot{
+		key:       key,
+		recursive: recursive,
+		entries:   entries,
+		createdAt: now,
+		usedAt:    now,
+	}
+	return token, now, nil
+}
+
+// Get 返回快照，每次读取都会延长快照的有效期
+func (s *ListSnapshots) Get(token string) (*listSnapshot, bool) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	snapshot, ok := s.snapshots[token]
+	if ok {
+		snapshot.usedAt = now
+	}
+	return snapshot, ok
+}
+
+// expire 删除超过有效期没有读取的快照，调用方需要持有锁
+func (s *ListSnapshots) expire(now time.Time) {
+	for token, snapshot := range s.snapshots {
+		if now.Sub(snapshot.usedAt) > s.ttl {
+			delete(s.snapshots, token)
+		}
+	}
+}
+
+// serveListSnapshot 从快照中返回请求的一页，快照与请求的目录不一致或已过期时返回错误
+func serveListSnapshot(w http.ResponseWriter, r *http.Request, listRequest ListRequest) {
+	snapshot, ok := listSnapshots.Get(listRequest.SnapshotToken)
+	if !ok {
+		sendListResponse(w, http.StatusOK, "快照不存在或已过期", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, nil, r.URL.Path)
+		return
+	}
+	if snapshot.key != indexKey(listRequest.Path) || snapshot.recursive != listRequest.Recursive {
+		sendListResponse(w, http.StatusOK, "快照与请求的目录不一致", ListResponse{
+			Status:  0,
+			Content: []ListEntry{},
+		}, nil, r.URL.Path)
+		return
+	}
+
+	// 快照中的条目已经过滤和排序，只需要分页
+	entries, total := paginateListEntries(snapshot.entries, listRequest)
+	if entries == nil {
+		entries = []ListEntry{}
+	}
+	createdAt := snapshot.createdAt
+	response := ListResponse{
+		Status:        1,
+		Message:       "success",
+		Content:       entries,
+		Total:         total,
+		SnapshotToken: listRequest.SnapshotToken,
+		SnapshotAt:    &createdAt,
+		Fields:        listRequest.Fields,
+	}
+	sendListResponse(w, http.StatusOK, "success", response, nil, r.URL.Path)
+}
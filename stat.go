@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StatEntry 结构用于表示单个文件或目录的元数据
+type StatEntry struct {
+	Path     string     `json:"path"`
+	Name     string     `json:"name"`
+	Size     int64      `json:"size"`
+	ModTime  time.Time  `json:"mtime"`
+	Mode     string     `json:"mode"`
+	IsDir    bool       `json:"is_dir"`
+	MimeType string     `json:"mime_type,omitempty"`
+	SHA256   string     `json:"sha256,omitempty"`
+	ATime    *time.Time `json:"atime,omitempty"`
+	// 以下字段仅在启用索引时返回
+	Uploader string            `json:"uploader,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// 以下字段仅在启用存储类型时返回，StorageClassPending 为 true 表示文件正在后台移动或同步副本
+	StorageClass        string `json:"storage_class,omitempty"`
+	StorageClassPending bool   `json:"storage_class_pending,omitempty"`
+}
+
+// 获取单个文件或目录的元数据
+func statHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少路径参数", nil, r.URL.Path)
+		return
+	}
+	fields, err := parseFields(r, StatEntry{})
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, err.Error(), err, r.URL.Path)
+		return
+	}
+	if isReservedPath(path) || isUnsafePath(path) {
+		sendJSONResponse(w, http.StatusNotFound, "文件或目录不存在", nil, r.URL.Path)
+		return
+	}
+
+	fullPath, fileInfo, err := statReadPath(path)
+	if os.IsNotExist(err) {
+		sendJSONResponse(w, http.StatusNotFound, "文件或目录不存在", err, r.URL.Path)
+		return
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "无法获取文件或目录信息", err, r.URL.Path)
+		return
+	}
+
+	debugPath(r, "", fullPath)
+	key := indexKey(path)
+	entry := StatEntry{
+		Path:    key,
+		Name:    fileInfo.Name(),
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+		Mode:    fileInfo.Mode().String(),
+		IsDir:   fileInfo.IsDir(),
+	}
+
+	// 目录没有内容类型和哈希；没有选择这两个字段时不读取文件内容
+	if !fileInfo.IsDir() && (fields.Has("mime_type") || fields.Has("sha256")) {
+		entry.MimeType, entry.SHA256, err = statContent(key, fullPath, fileInfo)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "无法读取文件内容", err, r.URL.Path)
+			return
+		}
+	}
+
+	if meta, ok := metaIndex.Get(key); ok {
+		entry.Uploader = meta.Uploader
+		entry.Metadata = meta.Metadata
+	}
+
+	if !fileInfo.IsDir() {
+		entry.StorageClass = storageClasses.Class(key, fullPath)
+		entry.StorageClassPending = storageClasses.Pending(key)
+	}
+
+	if atime, ok := accessTracker.ATime(key); ok {
+		entry.ATime = &atime
+	}
+	debugStage(r, "stat")
+
+	sendContentResponse(w, http.StatusOK, "success", fields.Project(entry), nil, r.URL.Path)
+}
+
+// statContent 返回文件的 MIME 类型和哈希，索引中的哈希仍然有效时不再读取整个文件
+func statContent(key string, fullPath string, fileInfo os.FileInfo) (string, string, error) {
+	meta, ok := metaIndex.Get(key)
+	if ok && meta.SHA256 != "" && meta.Size == fileInfo.Size() && meta.ModTime.Equal(fileInfo.ModTime()) {
+		file, err := openDataFile(fullPath)
+		if err != nil {
+			return "", "", err
+		}
+		defer func(file io.ReadSeekCloser) {
+			err := file.Close()
+			if err != nil {
+				slog.Error("closing file", "err", err)
+			}
+		}(file)
+
+		mimeType, err := detectMimeType(fullPath, file)
+		return mimeType, meta.SHA256, err
+	}
+
+	mimeType, sha, err := inspectFile(fullPath)
+	if err != nil {
+		return "", "", err
+	}
+	if metaIndex != nil {
+		metaIndex.Record(key, fileInfo)
+		metaIndex.Update(key, func(meta *FileMeta) {
+			meta.SHA256 = sha
+		})
+	}
+	return mimeType, sha, nil
+}
+
+// inspectFile 读取文件内容，返回 MIME 类型和 SHA-256 哈希
+func inspectFile(fullPath string) (string, string, error) {
+	file, err := openDataFile(fullPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(file)
+
+	mimeType, err := detectMimeType(fullPath, file)
+	if err != nil {
+		return "", "", err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", "", err
+	}
+	return mimeType, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// detectMimeType 先按扩展名判断 MIME 类型，无法判断时读取文件开头进行嗅探
+// 调用结束后文件读取位置会重置到开头
+func detectMimeType(name string, file io.ReadSeeker) (string, error) {
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if mimeType != "" {
+		return mimeType, nil
+	}
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
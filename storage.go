@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// withinDataRoot 判断 fullPath 解析符号链接后是否仍在 data 目录下，路径不存在时检查已存在的上级目录；
+// 指向不存在的目标的符号链接无法确认，按不在 data 目录下处理
+func withinDataRoot(fullPath string) bool {
+	root, err := filepath.EvalSymlinks("data")
+	if err != nil {
+		// data 目录尚未创建时其中不会有符号链接
+		return os.IsNotExist(err)
+	}
+	// 符号链接的目标可能是绝对路径，比较前都转换为绝对路径
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	for existing := fullPath; ; existing = filepath.Dir(existing) {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			resolved, err := filepath.EvalSymlinks(existing)
+			if err == nil {
+				resolved, err = filepath.Abs(resolved)
+			}
+			return err == nil && isWithinDir(root, resolved)
+		}
+		if !os.IsNotExist(err) || existing == "data" || existing == filepath.Dir(existing) {
+			return false
+		}
+	}
+}
+
+// isWithinDir 判断 path 是否在 dir 目录下
+func isWithinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// tmpDir 是上传、恢复、缩略图等操作使用的临时目录，与 data 位于同一文件系统以便原子重命名；
+// 位于 .meta 中，不会出现在列目录、搜索和同步中
+var tmpDir = filepath.Join("data", metaDirName, "tmp")
+
+// prepareTempDir 在启动时清空临时目录，删除上次进程退出时未完成的上传等留下的文件，
+// 并检查临时目录与 data 位于同一文件系统
+func prepareTempDir() error {
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(tmpDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	if len(entries) > 0 {
+		slog.Info("已清理临时目录", "files", len(entries))
+	}
+	err = os.MkdirAll(tmpDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	same, err := sameFilesystem(tmpDir, "data")
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("临时目录 %s 与 data 不在同一文件系统，无法原子重命名", tmpDir)
+	}
+	return nil
+}
+
+// 存储路径的长度限制，常见文件系统的单个路径段最长 255 字节，系统调用的路径最长 4096 字节
+const (
+	maxPathSegmentBytes = 255
+	// maxFileNameBytes 为文件名的上限，为历史版本的 @v 版本号后缀预留空间
+	maxFileNameBytes = 240
+	// maxPathBytes 为存储路径的上限，为 data/.meta/versions 等前缀预留空间
+	maxPathBytes = 4000
+)
+
+// checkPathLength 在写入之前检查存储路径是否超过文件系统的长度限制，超过时返回说明哪一段过长的错误，
+// 避免在创建文件时才失败
+func checkPathLength(key string) error {
+	if len(key) > maxPathBytes {
+		return fmt.Errorf("路径长度为 %d 字节，最长 %d 字节", len(key), maxPathBytes)
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		limit := maxPathSegmentBytes
+		if i == len(segments)-1 {
+			limit = maxFileNameBytes
+		}
+		if len(segment) > limit {
+			return fmt.Errorf("路径中第 %d 段（%.32s…）为 %d 字节，最长 %d 字节", i+1, segment, len(segment), limit)
+		}
+	}
+	return nil
+}
+
+// walkDataFiles 对 data 目录中 key 路径下的每个文件调用 fn，key 为文件时只调用一次
+func walkDataFiles(key string, fn func(fileKey string)) {
+	root := filepath.Join("data", filepath.FromSlash(key))
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel("data", p)
+		if err != nil {
+			return nil
+		}
+		fn(indexKey(filepath.ToSlash(rel)))
+		return nil
+	})
+}
+
+// inDataDir 判断路径是否在 data 目录中
+func inDataDir(target string) bool {
+	rel, err := filepath.Rel("data", target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// createTempFile 创建用于原子写入 target 的临时文件：target 在 data 目录中时创建在临时目录，
+// 在归档层、副本目录等其他目录中时创建在 target 所在目录并以 . 开头，保证可以重命名到 target
+func createTempFile(target string, pattern string) (*os.File, error) {
+	if inDataDir(target) {
+		err := os.MkdirAll(tmpDir, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		return os.CreateTemp(tmpDir, pattern)
+	}
+	return os.CreateTemp(filepath.Dir(target), "."+pattern)
+}
+
+// openDataFile 打开 data 目录下的文件用于读取，已加密的文件透明解密，已压缩的文件透明解压
+func openDataFile(fullPath string) (io.ReadSeekCloser, error) {
+	err := chaos.inject()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := isEncryptedFile(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	var reader io.ReadSeekCloser = file
+	if encrypted {
+		reader, err = encryptor.Reader(file)
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	compressed, err := isCompressedStream(reader)
+	if err == nil && compressed {
+		reader, err = newDecompressReader(reader)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return chaos.wrapReader(reader), nil
+}
+
+// removeDataPath 删除 data 目录下的文件或目录
+func removeDataPath(fullPath string) error {
+	err := chaos.inject()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(fullPath)
+}
+
+// renameDataPath 移动 data 目录下的文件或目录
+func renameDataPath(oldPath string, newPath string) error {
+	err := chaos.inject()
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// createTempDataFile 在临时目录中创建文件用于写入，返回文件和路径；key 为文件最终的路径，按压缩规则决定是否压缩，为空时不压缩；
+// tenant 为写入文件的调用方，与 key 一起决定功能开关是否启用静态加密
+func createTempDataFile(key string, tenant string) (io.WriteCloser, string, error) {
+	err := chaos.inject()
+	if err != nil {
+		return nil, "", err
+	}
+	err = os.MkdirAll(tmpDir, os.ModePerm)
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		return nil, "", err
+	}
+	writer := chaos.wrapWriter(file)
+	// 启用静态加密时写入的内容先加密，明文不会落盘
+	if encryptor != nil && featureFlags.Enabled(featureEncryption, key, tenant) {
+		writer, err = encryptor.Writer(writer)
+	}
+	// 压缩在加密之前进行，加密后的内容无法压缩
+	if err == nil && compressor.ShouldCompress(key) {
+		writer, err = compressor.Writer(writer, key)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, "", err
+	}
+	return writer, file.Name(), nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupDataRoot 在临时目录中创建 data 目录并切换工作目录，返回 data 目录之外的 secret.txt 所在的目录。
+// data 中包含指向外部目录的符号链接 escape、指向不存在目标的 dangling 和指向内部目录的 inner
+func setupDataRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{filepath.Join(root, "data", "sub"), outside} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(outside, "secret.txt"):             "secret",
+		filepath.Join(root, "data", "sub", "inside.txt"): "inside",
+	}
+	for name, content := range files {
+		err := os.WriteFile(name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(root, "data", "escape"):   outside,
+		filepath.Join(root, "data", "dangling"): filepath.Join(root, "missing"),
+		filepath.Join(root, "data", "inner"):    filepath.Join(root, "data", "sub"),
+	}
+	for name, target := range links {
+		err := os.Symlink(target, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(root)
+	return outside
+}
+
+// maliciousPaths 是应当被拒绝的路径
+var maliciousPaths = []struct {
+	name string
+	path string
+}{
+	{"parent", "../outside/secret.txt"},
+	{"nested parent", "sub/../../outside/secret.txt"},
+	{"absolute parent", "/../outside/secret.txt"},
+	{"trailing parent", "sub/.."},
+	{"backslash parent", `..\outside\secret.txt`},
+	{"mixed separators", `sub\..\../outside/secret.txt`},
+	{"nul", "sub/inside.txt\x00.jpg"},
+	{"symlink escape", "escape/secret.txt"},
+	{"symlink escape dir", "escape"},
+	{"symlink escape new file", "escape/new.txt"},
+	{"symlink escape new dir", "escape/a/b/new.txt"},
+	{"dangling symlink", "dangling"},
+	{"dangling symlink child", "dangling/new.txt"},
+}
+
+func TestIsUnsafePath(t *testing.T) {
+	setupDataRoot(t)
+	for _, tc := range maliciousPaths {
+		if !isUnsafePath(tc.path) {
+			t.Errorf("%s: isUnsafePath(%q) = false, want true", tc.name, tc.path)
+		}
+	}
+
+	safe := []struct {
+		name string
+		path string
+	}{
+		{"relative", "sub/inside.txt"},
+		{"absolute is rooted at data", "/sub/inside.txt"},
+		{"absolute system path is rooted at data", "/etc/passwd"},
+		{"root", "/"},
+		{"empty", ""},
+		{"not yet created", "new/dir/file.txt"},
+		{"dots in name", "sub/..inside..txt"},
+		{"backslash in name", `sub\inside.txt`},
+		{"symlink inside data", "inner/inside.txt"},
+		{"new file under symlink inside data", "inner/new.txt"},
+	}
+	for _, tc := range safe {
+		if isUnsafePath(tc.path) {
+			t.Errorf("%s: isUnsafePath(%q) = true, want false", tc.name, tc.path)
+		}
+	}
+}
+
+func TestWithinDataRoot(t *testing.T) {
+	outside := setupDataRoot(t)
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join("data", "sub", "inside.txt"), true},
+		{filepath.Join("data", "inner", "inside.txt"), true},
+		{filepath.Join("data", "missing", "file.txt"), true},
+		{"data", true},
+		{filepath.Join("data", "escape", "secret.txt"), false},
+		{filepath.Join("data", "dangling"), false},
+		{filepath.Join("data", "dangling", "file.txt"), false},
+		{filepath.Join(outside, "secret.txt"), false},
+		{".", false},
+	}
+	for _, tc := range tests {
+		if got := withinDataRoot(tc.path); got != tc.want {
+			t.Errorf("withinDataRoot(%q) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+// checkOutsideUntouched 检查 data 目录之外的文件没有被修改，也没有新建文件
+func checkOutsideUntouched(t *testing.T, outside string, name string) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(outside, "secret.txt"))
+	if err != nil || string(data) != "secret" {
+		t.Errorf("%s: secret.txt 被修改: %q %v", name, data, err)
+	}
+	entries, err := os.ReadDir(outside)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("%s: data 目录之外出现了新的文件: %v %v", name, entries, err)
+	}
+}
+
+func TestGetRejectsUnsafePaths(t *testing.T) {
+	outside := setupDataRoot(t)
+	for _, tc := range maliciousPaths {
+		r := httptest.NewRequest(http.MethodGet, "/get/", nil)
+		r.URL.Path = "/get/" + tc.path
+		w := httptest.NewRecorder()
+		getFileHandler(w, r, PreviewConfig{}, ImageConfig{})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: GET /get/%q = %d, want %d", tc.name, tc.path, w.Code, http.StatusNotFound)
+		}
+		if strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("%s: 响应中包含 data 目录之外的文件内容", tc.name)
+		}
+		checkOutsideUntouched(t, outside, tc.name)
+	}
+}
+
+func TestUploadRejectsUnsafePaths(t *testing.T) {
+	outside := setupDataRoot(t)
+	for _, tc := range maliciousPaths {
+		r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("overwritten"))
+		r.Header.Set("X-FormFile-Path", tc.path)
+		w := httptest.NewRecorder()
+		uploadHandler(w, r, ChecksumConfig{})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: X-FormFile-Path %q = %d, want %d", tc.name, tc.path, w.Code, http.StatusBadRequest)
+		}
+		checkOutsideUntouched(t, outside, tc.name)
+	}
+}
+
+func TestListRejectsUnsafePaths(t *testing.T) {
+	outside := setupDataRoot(t)
+	for _, tc := range maliciousPaths {
+		body, _ := json.Marshal(ListRequest{Path: tc.path})
+		w := httptest.NewRecorder()
+		listHandler(w, httptest.NewRequest(http.MethodPost, "/list", strings.NewReader(string(body))), ListConfig{})
+		var response ListResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatalf("%s: 无法解析响应 %v", tc.name, err)
+		}
+		if response.Status != 0 || len(response.Content) != 0 {
+			t.Errorf("%s: /list %q = %+v, want empty failure", tc.name, tc.path, response)
+		}
+		checkOutsideUntouched(t, outside, tc.name)
+	}
+}
+
+func TestDeleteRejectsUnsafePaths(t *testing.T) {
+	outside := setupDataRoot(t)
+	for _, tc := range maliciousPaths {
+		body, _ := json.Marshal(DeleteRequest{Path: tc.path})
+		w := httptest.NewRecorder()
+		deleteHandler(w, httptest.NewRequest(http.MethodPost, "/delete", strings.NewReader(string(body))))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: /delete %q = %d, want %d", tc.name, tc.path, w.Code, http.StatusBadRequest)
+		}
+		checkOutsideUntouched(t, outside, tc.name)
+		// 符号链接本身也不能被删除
+		for _, link := range []string{"escape", "dangling"} {
+			_, err := os.Lstat(filepath.Join("data", link))
+			if err != nil {
+				t.Errorf("%s: 符号链接 %s 被删除", tc.name, link)
+			}
+		}
+	}
+}
+
+func TestRestoreRejectsUnsafePaths(t *testing.T) {
+	outside := setupDataRoot(t)
+	for _, tc := range maliciousPaths {
+		body, _ := json.Marshal(RestoreRequest{ID: "20240101T000000", Paths: []string{tc.path}})
+		w := httptest.NewRecorder()
+		restoreHandler(w, httptest.NewRequest(http.MethodPost, "/admin/restore", strings.NewReader(string(body))))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: /admin/restore %q = %d, want %d", tc.name, tc.path, w.Code, http.StatusBadRequest)
+		}
+		checkOutsideUntouched(t, outside, tc.name)
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 支持的存储类型
+const (
+	StorageStandard          = "STANDARD"
+	StorageReducedRedundancy = "REDUCED_REDUNDANCY"
+	StorageArchive           = "ARCHIVE"
+)
+
+// StorageClassConfig 结构用于配置存储类型，每个文件的存储类型决定副本数、存储层级和校验策略
+type StorageClassConfig struct {
+	Enabled bool `json:"enabled"`
+	// Default 未指定存储类型的文件使用的类型，默认 STANDARD
+	Default string `json:"default"`
+	// ReplicaDirs 副本目录，STANDARD 和 ARCHIVE 的文件在每个目录中各保存一份副本
+	ReplicaDirs []string `json:"replica_dirs"`
+	// ArchiveDir 归档层目录（如低成本的大容量磁盘），ARCHIVE 的文件从 data 目录移动到这里
+	ArchiveDir string `json:"archive_dir"`
+}
+
+// StoragePolicy 结构表示存储类型对应的策略
+type StoragePolicy struct {
+	// Replicas 为包括 data 目录在内的副本数
+	Replicas int `json:"replicas"`
+	// Tier 为存储层级，hot 为 data 目录，archive 为归档层目录
+	Tier string `json:"tier"`
+	// Checksum 为 true 时在层级之间移动和复制副本后校验 SHA-256
+	Checksum bool `json:"checksum"`
+}
+
+// StorageClasses 结构用于管理文件的存储类型，修改存储类型后由后台任务移动文件和同步副本
+type StorageClasses struct {
+	config StorageClassConfig
+
+	mu      sync.Mutex
+	pending map[string]bool
+	running string
+	wake    chan struct{}
+}
+
+// storageClasses 未启用存储类型时为 nil
+var storageClasses *StorageClasses
+
+// NewStorageClasses 创建存储类型管理，检查配置的默认类型和目录
+func NewStorageClasses(config StorageClassConfig) (*StorageClasses, error) {
+	config.Default = strings.ToUpper(config.Default)
+	if config.Default == "" {
+		config.Default = StorageStandard
+	}
+	if !validStorageClass(config.Default) {
+		return nil, fmt.Errorf("无效的默认存储类型 %q", config.Default)
+	}
+	if config.Default == StorageArchive && config.ArchiveDir == "" {
+		return nil, fmt.Errorf("默认存储类型为 ARCHIVE 时需要配置 archive_dir")
+	}
+	for _, dir := range append(append([]string(nil), config.ReplicaDirs...), config.ArchiveDir) {
+		if dir == "" {
+			continue
+		}
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &StorageClasses{
+		config:  config,
+		pending: map[string]bool{},
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+// validStorageClass 判断存储类型是否有效
+func validStorageClass(class string) bool {
+	switch class {
+	case StorageStandard, StorageReducedRedundancy, StorageArchive:
+		return true
+	}
+	return false
+}
+
+// ParseClass 解析客户端指定的存储类型，为空时返回空字符串表示使用默认类型
+func (s *StorageClasses) ParseClass(value string) (string, error) {
+	class := strings.ToUpper(strings.TrimSpace(value))
+	if class == "" {
+		return "", nil
+	}
+	if s == nil {
+		return "", fmt.Errorf("未启用存储类型")
+	}
+	if !validStorageClass(class) {
+		return "", fmt.Errorf("无效的存储类型 %q", value)
+	}
+	if class == StorageArchive && s.config.ArchiveDir == "" {
+		return "", fmt.Errorf("未配置归档层目录，不能使用 ARCHIVE")
+	}
+	return class, nil
+}
+
+// Policy 返回存储类型对应的策略
+func (s *StorageClasses) Policy(class string) StoragePolicy {
+	switch class {
+	case StorageReducedRedundancy:
+		return StoragePolicy{Replicas: 1, Tier: "hot", Checksum: false}
+	case StorageArchive:
+		return StoragePolicy{Replicas: 1 + len(s.config.ReplicaDirs), Tier: "archive", Checksum: true}
+	default:
+		return StoragePolicy{Replicas: 1 + len(s.config.ReplicaDirs), Tier: "hot", Checksum: true}
+	}
+}
+
+// Class 返回文件的存储类型：位于归档层的文件为 ARCHIVE，否则为索引中记录的类型或默认类型
+func (s *StorageClasses) Class(key string, fullPath string) string {
+	if s == nil {
+		return ""
+	}
+	if s.config.ArchiveDir != "" && fullPath == s.archivePath(key) {
+		return StorageArchive
+	}
+	if meta, ok := metaIndex.Get(key); ok && meta.StorageClass != "" {
+		return meta.StorageClass
+	}
+	return s.config.Default
+}
+
+// Pending 判断文件是否正在等待移动或同步副本
+func (s *StorageClasses) Pending(key string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending[key] || s.running == key
+}
+
+// archivePath 返回文件在归档层中的路径
+func (s *StorageClasses) archivePath(key string) string {
+	return filepath.Join(s.config.ArchiveDir, filepath.FromSlash(key))
+}
+
+// Enqueue 将文件加入后台任务队列，按文件当前的存储类型移动文件和同步副本
+func (s *StorageClasses) Enqueue(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.pending[key] = true
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next 从队列中取出一个文件
+func (s *StorageClasses) next() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = ""
+	for key := range s.pending {
+		delete(s.pending, key)
+		s.running = key
+		return key, true
+	}
+	return "", false
+}
+
+// Run 启动时为索引中指定了存储类型的文件同步一次，之后处理队列中的文件
+func (s *StorageClasses) Run() {
+	metaIndex.Range(func(key string, meta FileMeta) bool {
+		if meta.StorageClass != "" && !meta.IsDir {
+			s.Enqueue(key)
+		}
+		return true
+	})
+	for range s.wake {
+		for {
+			key, ok := s.next()
+			if !ok {
+				break
+			}
+			err := s.apply(key)
+			if err != nil {
+				slog.Error("应用存储类型失败", "key", key, "err", err)
+			}
+		}
+	}
+}
+
+// apply 按存储类型将文件移动到对应的层级，并在副本目录中添加或删除副本
+func (s *StorageClasses) apply(key string) error {
+	hotPath := filepath.Join("data", filepath.FromSlash(key))
+	hotInfo, err := os.Stat(hotPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	inHot := err == nil && !hotInfo.IsDir()
+
+	archivePath := ""
+	inArchive := false
+	if s.config.ArchiveDir != "" {
+		archivePath = s.archivePath(key)
+		_, err = os.Stat(archivePath)
+		inArchive = err == nil
+	}
+
+	// 索引中没有记录时，只存在于归档层的文件仍然视为 ARCHIVE
+	class := s.config.Default
+	if meta, ok := metaIndex.Get(key); ok && meta.StorageClass != "" {
+		class = meta.StorageClass
+	} else if !inHot && inArchive {
+		class = StorageArchive
+	}
+	policy := s.Policy(class)
+
+	source := hotPath
+	if archivePath != "" {
+		switch {
+		case policy.Tier == "archive" && inHot:
+			err = copyFileVerified(hotPath, archivePath, policy.Checksum)
+			if err != nil {
+				return err
+			}
+			// 复制期间文件被重新上传时保留新文件，等待下一次处理
+			if info, err := os.Stat(hotPath); err != nil || info.Size() != hotInfo.Size() || !info.ModTime().Equal(hotInfo.ModTime()) {
+				s.Enqueue(key)
+				return nil
+			}
+			err = removeDataPath(hotPath)
+			if err != nil {
+				return err
+			}
+			source = archivePath
+		case policy.Tier == "archive" && inArchive:
+			source = archivePath
+		case !inHot && inArchive:
+			// 从归档层移回 data 目录
+			err = copyFileVerified(archivePath, hotPath, policy.Checksum)
+			if err != nil {
+				return err
+			}
+			err = os.Remove(archivePath)
+			if err != nil {
+				return err
+			}
+			refreshIndexPath(key)
+		case inHot && inArchive:
+			// 覆盖上传后归档层中的旧内容已经过期
+			err = os.Remove(archivePath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := os.Stat(source); err != nil {
+		// 文件已被删除
+		s.removeReplicas(key)
+		return nil
+	}
+
+	for i, dir := range s.config.ReplicaDirs {
+		replica := filepath.Join(dir, filepath.FromSlash(key))
+		if i+1 >= policy.Replicas {
+			err = os.Remove(replica)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if sameFileInfo(source, replica) {
+			continue
+		}
+		err = copyFileVerified(source, replica, policy.Checksum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove 删除文件或目录在归档层和副本目录中的内容
+func (s *StorageClasses) Remove(key string) {
+	if s == nil || key == "" {
+		return
+	}
+	if s.config.ArchiveDir != "" {
+		err := os.RemoveAll(s.archivePath(key))
+		if err != nil {
+			slog.Error("删除归档层中的文件失败", "err", err)
+		}
+	}
+	s.removeReplicas(key)
+}
+
+// removeReplicas 删除所有副本目录中的内容
+func (s *StorageClasses) removeReplicas(key string) {
+	for _, dir := range s.config.ReplicaDirs {
+		err := os.RemoveAll(filepath.Join(dir, filepath.FromSlash(key)))
+		if err != nil {
+			slog.Error("删除副本失败", "err", err)
+		}
+	}
+}
+
+// ArchivedEntries 返回归档层中 dirKey 目录下不在 existing 中的文件
+func (s *StorageClasses) ArchivedEntries(dirKey string, existing []ListEntry) []ListEntry {
+	if s == nil || s.config.ArchiveDir == "" {
+		return nil
+	}
+	infos, err := os.ReadDir(s.archivePath(dirKey))
+	if err != nil {
+		return nil
+	}
+	names := map[string]bool{}
+	for _, entry := range existing {
+		names[entry.Name] = true
+	}
+	var entries []ListEntry
+	for _, dirEntry := range infos {
+		if dirEntry.IsDir() || names[dirEntry.Name()] || strings.HasPrefix(dirEntry.Name(), ".copy-") {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, ListEntry{
+			Name: info.Name(),
+			Size: info.Size(),
+			Date: info.ModTime(),
+		})
+	}
+	return entries
+}
+
+// sameFileInfo 判断两个文件的大小和修改时间是否相同
+func sameFileInfo(a string, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return aInfo.Size() == bInfo.Size() && aInfo.ModTime().Equal(bInfo.ModTime())
+}
+
+// copyFileVerified 将文件复制到 target，先写入临时文件再重命名，并保留修改时间以便 ETag 不变；
+// verify 为 true 时重新读取写入的内容并与源文件的 SHA-256 比较
+func copyFileVerified(source string, target string, verify bool) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func(src *os.File) {
+		err := src.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(src)
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmp, err := createTempFile(target, "copy-*")
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && verify {
+		var written ChecksumResult
+		written, err = fileChecksum(tmp.Name(), false)
+		if err == nil && written.SHA256 != hex.EncodeToString(hash.Sum(nil)) {
+			err = fmt.Errorf("复制 %s 后校验失败", source)
+		}
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// StorageClassRequest 结构用于修改文件的存储类型
+type StorageClassRequest struct {
+	Path         string `json:"path"`
+	StorageClass string `json:"storage_class"`
+}
+
+// StorageClassResult 结构表示修改后的存储类型
+type StorageClassResult struct {
+	Path         string        `json:"path"`
+	StorageClass string        `json:"storage_class"`
+	Policy       StoragePolicy `json:"policy"`
+	// Pending 为 true 表示文件正在后台移动或同步副本
+	Pending bool `json:"pending"`
+}
+
+// 修改文件的存储类型，文件由后台任务移动
+func storageClassHandler(w http.ResponseWriter, r *http.Request) {
+	if storageClasses == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用存储类型", nil, r.URL.Path)
+		return
+	}
+	var request StorageClassRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Path == "" || request.StorageClass == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	key := indexKey(request.Path)
+	if key == "" || isReservedPath(key) || isUnsafePath(request.Path) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的路径参数", nil, r.URL.Path)
+		return
+	}
+	class, err := storageClasses.ParseClass(request.StorageClass)
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的存储类型", err, r.URL.Path)
+		return
+	}
+
+	_, fileInfo, err := statReadPath(key)
+	if os.IsNotExist(err) {
+		sendJSONResponse(w, http.StatusNotFound, "文件不存在", err, r.URL.Path)
+		return
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	if fileInfo.IsDir() {
+		sendJSONResponse(w, http.StatusBadRequest, "只能修改文件的存储类型", nil, r.URL.Path)
+		return
+	}
+
+	metaIndex.Update(key, func(meta *FileMeta) {
+		meta.StorageClass = class
+	})
+	storageClasses.Enqueue(key)
+	sendContentResponse(w, http.StatusOK, "已修改存储类型，文件将在后台移动", StorageClassResult{
+		Path:         key,
+		StorageClass: class,
+		Policy:       storageClasses.Policy(class),
+		Pending:      true,
+	}, nil, r.URL.Path)
+}
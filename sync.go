@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syncStore 是同步的一端，可以是运行中的实例或本地的 data 目录
+type syncStore interface {
+	// Files 返回 prefix 下所有文件的路径
+	Files(prefix string) ([]string, error)
+	// Hash 返回文件内容的 SHA-256
+	Hash(key string) (string, error)
+	// Open 打开文件读取内容
+	Open(key string) (io.ReadCloser, error)
+}
+
+// localSyncStore 读取当前目录下的 data 目录，已加密或压缩的文件读取时透明解密和解压
+type localSyncStore struct{}
+
+func (localSyncStore) Files(prefix string) ([]string, error) {
+	var keys []string
+	root := filepath.Join("data", filepath.FromSlash(prefix))
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel("data", p)
+		if err != nil || rel == "." {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if isReservedPath(key) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+func (localSyncStore) Hash(key string) (string, error) {
+	file, err := openDataFile(filepath.Join("data", filepath.FromSlash(key)))
+	if err != nil {
+		return "", err
+	}
+	defer func(file io.ReadSeekCloser) {
+		_ = file.Close()
+	}(file)
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (localSyncStore) Open(key string) (io.ReadCloser, error) {
+	return openDataFile(filepath.Join("data", filepath.FromSlash(key)))
+}
+
+// remoteSyncStore 通过 HTTP 接口访问运行中的实例，其他命令和自动更新也通过它访问实例；
+// 可以通过 AddSigner 和 AddProgressObserver 加入签名和进度的钩子，统一各个服务访问实例的方式
+type remoteSyncStore struct {
+	url    string
+	client *http.Client
+	// signers 按加入的顺序在每次发送请求之前调用，第一个为 token 认证
+	signers []RequestSigner
+	// observers 接收上传和下载的进度
+	observers []ProgressObserver
+}
+
+// RequestSigner 在每次发送请求之前调用，用于添加认证或签名的请求头；重试时再次调用，可以使用新的时间戳
+type RequestSigner func(req *http.Request) error
+
+// TransferProgress 结构是一次上传或下载的进度
+type TransferProgress struct {
+	Key    string
+	Upload bool
+	// Bytes 为已传输的字节数，Total 为总字节数，未知时为 -1
+	Bytes int64
+	Total int64
+	// Done 为 true 时传输已结束，Err 为失败的原因
+	Done bool
+	Err  error
+}
+
+// ProgressObserver 接收上传和下载的进度，每次读取数据后调用，并发传输时可能在多个 goroutine 中同时调用
+type ProgressObserver func(progress TransferProgress)
+
+// remoteMaxAttempts 是实例返回 503 或 429 时每个请求最多发送的次数
+const remoteMaxAttempts = 5
+
+// newRemoteSyncStore 创建访问实例的客户端：地址以 unix: 开头时通过 unix socket 连接（与 listen 的写法相同），
+// 否则按 HTTPS_PROXY 等环境变量使用代理
+func newRemoteSyncStore(address string, token string, timeout time.Duration) *remoteSyncStore {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.HasPrefix(address, "unix:") {
+		socket := strings.TrimPrefix(address, "unix:")
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		address = "http://unix"
+	}
+	store := &remoteSyncStore{
+		url:    strings.TrimRight(address, "/"),
+		client: &http.Client{Timeout: timeout, Transport: transport},
+	}
+	store.AddSigner(func(req *http.Request) error {
+		req.Header.Set("Authorization", token)
+		return nil
+	})
+	return store
+}
+
+// AddSigner 加入一个请求签名的钩子，在 token 认证之后调用
+func (s *remoteSyncStore) AddSigner(signer RequestSigner) {
+	s.signers = append(s.signers, signer)
+}
+
+// AddProgressObserver 加入一个接收上传和下载进度的钩子
+func (s *remoteSyncStore) AddProgressObserver(observer ProgressObserver) {
+	s.observers = append(s.observers, observer)
+}
+
+// sign 依次调用签名的钩子
+func (s *remoteSyncStore) sign(req *http.Request) error {
+	for _, signer := range s.signers {
+		err := signer(req)
+		if err != nil {
+			return fmt.Errorf("签名请求失败: %w", err)
+		}
+	}
+	return nil
+}
+
+// observe 用 reader 包装传输的数据，没有进度的钩子时返回 nil
+func (s *remoteSyncStore) observe(reader io.Reader, key string, upload bool, total int64) *progressReader {
+	if len(s.observers) == 0 {
+		return nil
+	}
+	return &progressReader{reader: reader, observers: s.observers, progress: TransferProgress{Key: key, Upload: upload, Total: total}}
+}
+
+// progressReader 在每次读取后通知进度的钩子，读到结尾或出错时通知传输结束；
+// 上传读完内容后实例仍可能拒绝，由 finish 按响应通知结束
+type progressReader struct {
+	reader    io.Reader
+	observers []ProgressObserver
+	// untilFinish 为 true 时读到结尾不通知结束
+	untilFinish bool
+
+	mu       sync.Mutex
+	progress TransferProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.progress.Done {
+		return n, err
+	}
+	r.progress.Bytes += int64(n)
+	if err != nil && (err != io.EOF || !r.untilFinish) {
+		r.progress.Done = true
+		if err != io.EOF {
+			r.progress.Err = err
+		}
+	}
+	if n > 0 || r.progress.Done {
+		r.notify()
+	}
+	return n, err
+}
+
+// finish 通知传输结束，已经通知过时不再通知
+func (r *progressReader) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.progress.Done {
+		return
+	}
+	r.progress.Done = true
+	r.progress.Err = err
+	r.notify()
+}
+
+func (r *progressReader) notify() {
+	for _, observer := range r.observers {
+		observer(r.progress)
+	}
+}
+
+// send 签名并发送请求，实例因排队超时或限流返回 503 或 429 时按 Retry-After 等待后重试；
+// 请求体无法重新读取（如流式上传）时不重试
+func (s *remoteSyncStore) send(req *http.Request) (*http.Response, error) {
+	// 同步是批量传输，实例繁忙时排在交互请求之后
+	req.Header.Set("X-Priority", priorityBatch)
+	for attempt := 1; ; attempt++ {
+		err := s.sign(req)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		if attempt >= remoteMaxAttempts || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		wait := time.Duration(attempt) * time.Second
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s 返回 %s，%s 后重试\n", req.URL.Path, resp.Status, wait)
+		time.Sleep(wait)
+	}
+}
+
+// post 发送 JSON 请求并解析响应体
+func (s *remoteSyncStore) post(endpoint string, request any, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return s.do(req, response)
+}
+
+func (s *remoteSyncStore) do(req *http.Request, response any) error {
+	resp, err := s.send(req)
+	if err != nil {
+		return err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s 返回 %s %s", req.URL.Path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// Files 逐个目录列出，不受递归列出的条目数上限限制
+func (s *remoteSyncStore) Files(prefix string) ([]string, error) {
+	var keys []string
+	dirs := []string{prefix}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		var response ListResponse
+		err := s.post("/list", ListRequest{Path: dir}, &response)
+		if err != nil {
+			return nil, err
+		}
+		if response.Status != 1 {
+			// 起始目录不存在时没有文件
+			if dir == prefix && response.Message == "该目录不存在" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("列出 %s 失败：%s", dir, response.Message)
+		}
+		for _, entry := range response.Content {
+			key := path.Join(dir, entry.Name)
+			if entry.IsDir {
+				dirs = append(dirs, key)
+			} else {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Hash 通过 /stat 获取哈希，索引中的哈希有效时实例不需要读取整个文件
+func (s *remoteSyncStore) Hash(key string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url+"/stat?path="+url.QueryEscape(key), nil)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		Status  int       `json:"status"`
+		Message string    `json:"message"`
+		Content StatEntry `json:"content"`
+	}
+	err = s.do(req, &response)
+	if err != nil {
+		return "", err
+	}
+	if response.Status != 1 {
+		return "", errors.New(response.Message)
+	}
+	return response.Content.SHA256, nil
+}
+
+func (s *remoteSyncStore) Open(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url+"/get/"+escapeKey(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("下载 %s 返回 %s", key, resp.Status)
+	}
+	progress := s.observe(resp.Body, key, false, resp.ContentLength)
+	if progress == nil {
+		return resp.Body, nil
+	}
+	return &progressReadCloser{progressReader: progress, closer: resp.Body}, nil
+}
+
+// progressReadCloser 为下载的响应体，读取结束之前关闭时通知传输中止
+type progressReadCloser struct {
+	*progressReader
+	closer io.Closer
+}
+
+func (r *progressReadCloser) Close() error {
+	r.finish(io.ErrUnexpectedEOF)
+	return r.closer.Close()
+}
+
+// Upload 上传文件，带上源文件的哈希由目标实例校验
+func (s *remoteSyncStore) Upload(key string, content io.Reader, sum string) (err error) {
+	source := content
+	if progress := s.observe(content, key, true, -1); progress != nil {
+		progress.untilFinish = true
+		source = progress
+		defer func() {
+			progress.finish(err)
+		}()
+	}
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", path.Base(key))
+		if err == nil {
+			_, err = io.Copy(part, source)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		_ = writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, s.url+"/upload", body)
+	if err != nil {
+		_ = body.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-FormFile-Path", key)
+	req.Header.Set("X-Naming-Strategy", namingKeep)
+	req.Header.Set("X-Content-SHA256", sum)
+	var response struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	}
+	err = s.do(req, &response)
+	if err != nil {
+		_ = body.Close()
+		return err
+	}
+	if response.Status != 1 {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// Delete 删除文件，目标实例启用回收站时移入回收站
+func (s *remoteSyncStore) Delete(key string) error {
+	var response DeleteResponse
+	err := s.post("/delete", DeleteRequest{Path: key}, &response)
+	if err != nil {
+		return err
+	}
+	if response.Status != 1 {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// syncCommand 比较两端的文件路径和哈希，只复制目标缺少或内容不同的文件，用于迁移和定期镜像
+func syncCommand(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	from := flags.String("from", "local", "源实例地址，local 表示当前目录下的 data 目录")
+	to := flags.String("to", "", "目标实例地址")
+	fromToken := flags.String("from-token", "", "源实例的 token，为空时读取 config.json")
+	toToken := flags.String("to-token", "", "目标实例的 token，为空时读取 config.json")
+	prefix := flags.String("path", "", "只同步该目录，为空时同步全部文件")
+	deleteExtra := flags.Bool("delete", false, "删除目标上存在而源上不存在的文件")
+	dryRun := flags.Bool("dry-run", false, "只输出需要复制和删除的文件，不做修改")
+	concurrency := flags.Int("concurrency", 4, "并发数")
+	progress := flags.Bool("progress", false, "在标准错误输出中显示每个文件的传输进度")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *to == "" {
+		fmt.Fprintf(os.Stderr, "缺少 -to 参数\n")
+		return 2
+	}
+	if *concurrency <= 0 {
+		*concurrency = 1
+	}
+
+	// 从本地同步或未指定 token 时需要 config.json
+	local := *from == "local"
+	if local || *fromToken == "" || *toToken == "" {
+		config, err := LoadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %s\n", err)
+			return 1
+		}
+		if *fromToken == "" {
+			*fromToken = config.Token
+		}
+		if *toToken == "" {
+			*toToken = config.Token
+		}
+		if local && config.Encryption.Enabled {
+			encryptor, err = NewEncryptor(config.Encryption)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: 无法启用静态加密 %s\n", err)
+				return 1
+			}
+		}
+	}
+
+	var source syncStore = localSyncStore{}
+	if !local {
+		source = newRemoteSyncStore(*from, *fromToken, time.Hour)
+	}
+	target := newRemoteSyncStore(*to, *toToken, time.Hour)
+	if *progress {
+		target.AddProgressObserver(newProgressPrinter(os.Stderr, 2*time.Second))
+	}
+	root := indexKey(*prefix)
+
+	sourceKeys, err := source.Files(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 列出源文件失败 %s\n", err)
+		return 1
+	}
+	targetKeys, err := target.Files(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: 列出目标文件失败 %s\n", err)
+		return 1
+	}
+	existing := make(map[string]bool, len(targetKeys))
+	for _, key := range targetKeys {
+		existing[key] = true
+	}
+	fmt.Printf("源 %d 个文件，目标 %d 个文件\n", len(sourceKeys), len(targetKeys))
+
+	var copied, unchanged, deleted, failed atomic.Int64
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				ok, err := syncFile(source, target, key, existing[key], *dryRun)
+				if err != nil {
+					failed.Add(1)
+					fmt.Fprintf(os.Stderr, "Error: 同步 %s 失败 %s\n", key, err)
+				} else if ok {
+					copied.Add(1)
+				} else {
+					unchanged.Add(1)
+				}
+			}
+		}()
+	}
+	for _, key := range sourceKeys {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+
+	if *deleteExtra {
+		present := make(map[string]bool, len(sourceKeys))
+		for _, key := range sourceKeys {
+			present[key] = true
+		}
+		sort.Strings(targetKeys)
+		for _, key := range targetKeys {
+			if present[key] {
+				continue
+			}
+			fmt.Printf("删除 %s\n", key)
+			if *dryRun {
+				deleted.Add(1)
+				continue
+			}
+			err := target.Delete(key)
+			if err != nil {
+				failed.Add(1)
+				fmt.Fprintf(os.Stderr, "Error: 删除 %s 失败 %s\n", key, err)
+				continue
+			}
+			deleted.Add(1)
+		}
+	}
+
+	fmt.Printf("复制 %d，未变化 %d，删除 %d，失败 %d\n", copied.Load(), unchanged.Load(), deleted.Load(), failed.Load())
+	if failed.Load() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// newProgressPrinter 返回输出传输进度的钩子，每个文件最多每 interval 输出一次，传输结束时总是输出
+func newProgressPrinter(w io.Writer, interval time.Duration) ProgressObserver {
+	var mu sync.Mutex
+	last := map[string]time.Time{}
+	return func(progress TransferProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if !progress.Done && now.Sub(last[progress.Key]) < interval {
+			return
+		}
+		last[progress.Key] = now
+		action := "下载"
+		if progress.Upload {
+			action = "上传"
+		}
+		size := fmt.Sprintf("%.1f MB", float64(progress.Bytes)/(1<<20))
+		if progress.Total >= 0 {
+			size += fmt.Sprintf(" / %.1f MB", float64(progress.Total)/(1<<20))
+		}
+		switch {
+		case progress.Err != nil:
+			fmt.Fprintf(w, "%s %s 失败，已传输 %s\n", action, progress.Key, size)
+		case progress.Done:
+			fmt.Fprintf(w, "%s %s 完成，%s\n", action, progress.Key, size)
+		default:
+			fmt.Fprintf(w, "%s %s %s\n", action, progress.Key, size)
+		}
+		if progress.Done {
+			delete(last, progress.Key)
+		}
+	}
+}
+
+// syncFile 比较一个文件的哈希，目标缺少或内容不同时复制，返回是否需要复制
+func syncFile(source syncStore, target *remoteSyncStore, key string, exists bool, dryRun bool) (bool, error) {
+	sum, err := source.Hash(key)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		targetSum, err := target.Hash(key)
+		if err != nil {
+			return false, err
+		}
+		if targetSum == sum {
+			return false, nil
+		}
+	}
+	fmt.Printf("复制 %s\n", key)
+	if dryRun {
+		return true, nil
+	}
+	content, err := source.Open(key)
+	if err != nil {
+		return false, err
+	}
+	defer func(content io.ReadCloser) {
+		_ = content.Close()
+	}(content)
+	return true, target.Upload(key, content, sum)
+}
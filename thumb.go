@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // 注册 GIF 解码器
+	"image/jpeg"
+	_ "image/png" // 注册 PNG 解码器
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// thumbsDirName 是 data 目录下缓存缩略图的目录名
+const thumbsDirName = ".thumbs"
+
+// ThumbnailConfig 结构用于配置缩略图
+type ThumbnailConfig struct {
+	// MaxSize 缩略图宽高的上限，默认 1024
+	MaxSize int `json:"max_size"`
+	// MaxSourcePixels 允许生成缩略图的原图像素上限，默认 5000 万，防止解压炸弹耗尽内存
+	MaxSourcePixels int `json:"max_source_pixels"`
+}
+
+// 获取图片的缩略图，生成后缓存在 data/.thumbs 下，原图修改后重新生成
+func thumbHandler(w http.ResponseWriter, r *http.Request, thumbConfig ThumbnailConfig) {
+	filePath := r.URL.Path[len("/thumb/"):]
+	if isReservedPath(filePath) || isUnsafePath(filePath) {
+		sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", nil, r.URL.Path)
+		return
+	}
+	if !featureFlags.Enabled(featureThumbnail, indexKey(filePath), identityName(r)) {
+		sendJSONResponse(w, http.StatusNotFound, "该路径未启用缩略图", nil, r.URL.Path)
+		return
+	}
+
+	maxSize := thumbConfig.MaxSize
+	if maxSize <= 0 {
+		maxSize = 1024
+	}
+	width, _ := strconv.Atoi(r.URL.Query().Get("w"))
+	height, _ := strconv.Atoi(r.URL.Query().Get("h"))
+	if width <= 0 && height <= 0 {
+		width, height = 256, 256
+	}
+	if width < 0 || height < 0 || width > maxSize || height > maxSize {
+		sendJSONResponse(w, http.StatusBadRequest, fmt.Sprintf("缩略图尺寸不能超过 %d", maxSize), nil, r.URL.Path)
+		return
+	}
+
+	fullPath := filepath.Join("data", filePath)
+	fileInfo, err := os.Stat(fullPath)
+	if err != nil || fileInfo.IsDir() {
+		sendJSONResponse(w, http.StatusNotFound, "资源文件不存在", err, r.URL.Path)
+		return
+	}
+
+	key := indexKey(filePath)
+	thumbPath := filepath.Join("data", thumbsDirName, key, fmt.Sprintf("%dx%d.jpg", width, height))
+	thumbInfo, err := os.Stat(thumbPath)
+	if err != nil || thumbInfo.ModTime().Before(fileInfo.ModTime()) {
+		err = generateThumbnail(fullPath, thumbPath, width, height, thumbConfig)
+		if err == errNotImage {
+			sendJSONResponse(w, http.StatusUnsupportedMediaType, "不支持的图片格式", err, r.URL.Path)
+			return
+		} else if err == errImageTooLarge {
+			sendJSONResponse(w, http.StatusRequestEntityTooLarge, "图片尺寸过大", err, r.URL.Path)
+			return
+		} else if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "生成缩略图失败", err, r.URL.Path)
+			return
+		}
+	}
+
+	thumbFile, err := openDataFile(thumbPath)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	defer func(thumbFile io.ReadSeekCloser) {
+		err := thumbFile.Close()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "closing file", "err", err)
+		}
+	}(thumbFile)
+	thumbInfo, err = os.Stat(thumbPath)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, thumbPath, thumbInfo.ModTime(), thumbFile)
+}
+
+var (
+	errNotImage      = fmt.Errorf("not a supported image")
+	errImageTooLarge = fmt.Errorf("image too large")
+)
+
+// decodeImageFile 解码图片文件，解码前先检查像素数
+func decodeImageFile(fullPath string, maxPixels int) (image.Image, string, error) {
+	if maxPixels <= 0 {
+		maxPixels = 50000000
+	}
+	file, err := openDataFile(fullPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(file)
+
+	cfg, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, "", errNotImage
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, "", errImageTooLarge
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, "", errNotImage
+	}
+	return img, format, nil
+}
+
+// generateThumbnail 生成等比缩放到 width x height 以内的缩略图，宽或高为 0 时按另一边计算
+func generateThumbnail(fullPath string, thumbPath string, width int, height int, thumbConfig ThumbnailConfig) error {
+	img, _, err := decodeImageFile(fullPath, thumbConfig.MaxSourcePixels)
+	if err != nil {
+		return err
+	}
+	thumb := resizeImage(img, fitSize(img.Bounds(), width, height))
+
+	err = os.MkdirAll(filepath.Dir(thumbPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// 同一缩略图可能被并发生成，各自写入不同的临时文件
+	file, err := createTempFile(thumbPath, "thumb-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	// 启用静态加密时缩略图同样加密保存
+	var out io.WriteCloser = file
+	if encryptor != nil {
+		out, err = encryptor.Writer(file)
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(tmpPath)
+			return err
+		}
+	}
+	err = jpeg.Encode(out, flatten(thumb), &jpeg.Options{Quality: 85})
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, thumbPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// fitSize 计算在 width x height 以内保持宽高比的尺寸，不放大原图
+func fitSize(bounds image.Rectangle, width int, height int) image.Point {
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW == 0 || srcH == 0 {
+		return image.Point{X: 1, Y: 1}
+	}
+	scale := 1.0
+	if width > 0 {
+		scale = float64(width) / float64(srcW)
+	}
+	if height > 0 {
+		if s := float64(height) / float64(srcH); width <= 0 || s < scale {
+			scale = s
+		}
+	}
+	if scale > 1 {
+		scale = 1
+	}
+	w := int(float64(srcW)*scale + 0.5)
+	h := int(float64(srcH)*scale + 0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return image.Point{X: w, Y: h}
+}
+
+// resizeImage 使用区域平均法将图片缩放到指定尺寸，缩小时比最近邻插值效果更好
+func resizeImage(src image.Image, size image.Point) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	for y := 0; y < size.Y; y++ {
+		y0 := bounds.Min.Y + y*srcH/size.Y
+		y1 := bounds.Min.Y + (y+1)*srcH/size.Y
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < size.X; x++ {
+			x0 := bounds.Min.X + x*srcW/size.X
+			x1 := bounds.Min.X + (x+1)*srcW/size.X
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// flatten 将带透明通道的图片铺在白色背景上，JPEG 不支持透明
+func flatten(img image.Image) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+// removeThumbnails 删除文件或目录对应的缩略图缓存
+func removeThumbnails(key string) {
+	err := os.RemoveAll(filepath.Join("data", thumbsDirName, key))
+	if err != nil {
+		slog.Error("删除缩略图失败", "err", err)
+	}
+}
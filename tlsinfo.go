@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSConfig 结构用于配置公共 API 和管理接口的 TLS，客户端证书认证（auth.mtls）需要配置 client_ca_file
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile 校验客户端证书的 CA，配置后客户端可以出示证书
+	ClientCAFile string `json:"client_ca_file"`
+	// RequireClientCert 为 true 时没有有效客户端证书的连接在握手时被拒绝
+	RequireClientCert bool `json:"require_client_cert"`
+	// MinVersion 最低的 TLS 版本，1.2（默认）或 1.3
+	MinVersion string `json:"min_version"`
+	// CipherSuites TLS 1.2 允许的加密套件，如 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256，默认只允许 ECDHE 密钥交换的 AEAD 套件；
+	// TLS 1.3 的套件不可配置
+	CipherSuites []string `json:"cipher_suites"`
+	// RedirectListen 将明文 HTTP 请求重定向到 HTTPS 的监听地址，如 0.0.0.0:80，为空时不监听
+	RedirectListen string `json:"redirect_listen"`
+	// HSTSMaxAge 大于 0 时在 HTTPS 响应中添加 Strict-Transport-Security，单位秒
+	HSTSMaxAge int `json:"hsts_max_age"`
+}
+
+// defaultCipherSuites 是 TLS 1.2 默认允许的加密套件，均为前向安全的 AEAD 套件
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// parseCipherSuites 按名称查找加密套件，tls.InsecureCipherSuites 中的套件（如 RC4、3DES）和未知的名称返回错误
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return defaultCipherSuites, nil
+	}
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				suites = append(suites, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("不支持的加密套件 %s", name)
+		}
+	}
+	return suites, nil
+}
+
+// newServerTLSConfig 按配置加载证书，未配置证书时返回 nil
+func newServerTLSConfig(config TLSConfig) (*tls.Config, error) {
+	if config.CertFile == "" && config.KeyFile == "" {
+		if config.ClientCAFile != "" {
+			return nil, errors.New("配置 client_ca_file 时需要配置 cert_file 和 key_file")
+		}
+		if config.RedirectListen != "" {
+			return nil, errors.New("配置 redirect_listen 时需要配置 cert_file 和 key_file")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(config.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	// 自行创建的 TLS 监听器需要声明 h2，才能与客户端协商 HTTP/2
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		CipherSuites: suites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	switch config.MinVersion {
+	case "", "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("不支持的 min_version %s", config.MinVersion)
+	}
+	if config.ClientCAFile != "" {
+		data, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s 中没有有效的证书", config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if config.RequireClientCert {
+		return nil, errors.New("require_client_cert 需要配置 client_ca_file")
+	}
+	return tlsConfig, nil
+}
+
+// HSTSMiddleware 在 HTTPS 响应中添加 Strict-Transport-Security，浏览器之后直接使用 HTTPS 访问
+func HSTSMiddleware(next http.Handler, maxAge int) http.Handler {
+	value := fmt.Sprintf("max-age=%d", maxAge)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveRedirect 在明文 HTTP 的监听地址上将请求重定向到 HTTPS，httpsAddress 为公共 API 的监听地址，
+// 端口不是 443 时重定向的地址带上该端口；监听失败时返回 nil
+func serveRedirect(address string, httpsAddress string) *http.Server {
+	_, port, err := net.SplitHostPort(httpsAddress)
+	if err != nil {
+		slog.Error("HTTPS 重定向的目标地址无效", "listen", httpsAddress, "err", err)
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		slog.Error("HTTPS 重定向监听失败", "err", err)
+		return nil
+	}
+	slog.Info("HTTPS 重定向监听", "address", address)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		// GET 和 HEAD 以外的请求使用 308，客户端保持请求方法和请求体
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTPS 重定向服务失败", "err", err)
+		}
+	}()
+	return server
+}
+
+// TLSInfo 结构是请求所在连接协商的 TLS 参数，提供给策略引擎和审计日志
+type TLSInfo struct {
+	// Version 如 TLS 1.3，CipherSuite 如 TLS_AES_128_GCM_SHA256
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	ALPN        string `json:"alpn,omitempty"`
+	// ClientCert 为已通过校验的客户端证书，没有出示证书时为空
+	ClientCert *ClientCertInfo `json:"client_cert,omitempty"`
+}
+
+// ClientCertInfo 结构是客户端证书中用于识别设备的信息
+type ClientCertInfo struct {
+	Subject    string `json:"subject"`
+	CommonName string `json:"common_name"`
+	Issuer     string `json:"issuer"`
+	// SerialNumber 为十六进制，FingerprintSHA256 为证书 DER 编码的 SHA-256
+	SerialNumber      string    `json:"serial_number"`
+	FingerprintSHA256 string    `json:"fingerprint_sha256"`
+	DNSNames          []string  `json:"dns_names,omitempty"`
+	URIs              []string  `json:"uris,omitempty"`
+	NotAfter          time.Time `json:"not_after"`
+}
+
+// requestTLSInfo 返回请求所在连接的 TLS 参数，不是 TLS 连接时返回 nil
+func requestTLSInfo(r *http.Request) *TLSInfo {
+	if r.TLS == nil {
+		return nil
+	}
+	info := &TLSInfo{
+		Version:     tls.VersionName(r.TLS.Version),
+		CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+		ServerName:  r.TLS.ServerName,
+		ALPN:        r.TLS.NegotiatedProtocol,
+	}
+	// 只提供已通过校验的证书，未经校验的证书内容可以任意伪造
+	if len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		sum := sha256.Sum256(cert.Raw)
+		info.ClientCert = &ClientCertInfo{
+			Subject:           cert.Subject.String(),
+			CommonName:        cert.Subject.CommonName,
+			Issuer:            cert.Issuer.String(),
+			SerialNumber:      cert.SerialNumber.Text(16),
+			FingerprintSHA256: hex.EncodeToString(sum[:]),
+			DNSNames:          cert.DNSNames,
+			NotAfter:          cert.NotAfter,
+		}
+		for _, uri := range cert.URIs {
+			info.ClientCert.URIs = append(info.ClientCert.URIs, uri.String())
+		}
+	}
+	return info
+}
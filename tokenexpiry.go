@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenExpiryConfig 结构用于配置静态 token 的过期提醒
+type TokenExpiryConfig struct {
+	// WarnDays 过期前多少天开始在响应中添加 Warning 响应头，默认 14
+	WarnDays int `json:"warn_days"`
+	// GraceDays 过期后仍然允许使用的天数，期间响应中同样带有 Warning 响应头，默认 0
+	GraceDays int `json:"grace_days"`
+	// RemindDays 过期前多少天发送提醒，默认 [14, 7, 1]，过期时还会再发送一次
+	RemindDays []int `json:"remind_days"`
+	// WebhookURL 提醒以 JSON 格式 POST 到该地址
+	WebhookURL string `json:"webhook_url"`
+	// Email 提醒邮件
+	Email *AlertEmailConfig `json:"email"`
+}
+
+// TokenReminder 结构表示一次 token 过期提醒
+type TokenReminder struct {
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// DaysLeft 为剩余天数，已过期时为 0
+	DaysLeft int `json:"days_left"`
+	// GraceUntil 为宽限期结束的时间，未配置宽限期时与 ExpiresAt 相同
+	GraceUntil time.Time `json:"grace_until"`
+}
+
+// withDefaults 填充未配置的字段
+func (c TokenExpiryConfig) withDefaults() TokenExpiryConfig {
+	if c.WarnDays <= 0 {
+		c.WarnDays = 14
+	}
+	if len(c.RemindDays) == 0 {
+		c.RemindDays = []int{14, 7, 1}
+	}
+	return c
+}
+
+// grace 返回过期后的宽限期
+func (c TokenExpiryConfig) grace() time.Duration {
+	return time.Duration(c.GraceDays) * 24 * time.Hour
+}
+
+// expiryWarning 返回 token 即将过期或处于宽限期时的 Warning 响应头，token 已失效时返回 false
+func expiryWarning(expiresAt time.Time, config TokenExpiryConfig, now time.Time) (string, bool) {
+	if expiresAt.IsZero() {
+		return "", true
+	}
+	if now.After(expiresAt.Add(config.grace())) {
+		return "", false
+	}
+	expires := expiresAt.UTC().Format(time.RFC3339)
+	if now.After(expiresAt) {
+		graceUntil := expiresAt.Add(config.grace()).UTC().Format(time.RFC3339)
+		return fmt.Sprintf(`299 store "token expired at %s, grace period ends at %s"`, expires, graceUntil), true
+	}
+	if expiresAt.Sub(now) <= time.Duration(config.WarnDays)*24*time.Hour {
+		return fmt.Sprintf(`299 store "token expires at %s"`, expires), true
+	}
+	return "", true
+}
+
+// TokenReminders 结构用于在静态 token 过期前发送提醒，已发送的提醒保存在文件中，重启后不会重复发送
+type TokenReminders struct {
+	tokens []TokenConfig
+	config TokenExpiryConfig
+	file   string
+	client *http.Client
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+// anyTokenExpires 判断是否有 token 配置了过期时间，没有时不需要发送提醒
+func anyTokenExpires(tokens []TokenConfig) bool {
+	for _, token := range tokens {
+		if !token.ExpiresAt.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// NewTokenReminders 创建 token 过期提醒，加载已发送的记录
+func NewTokenReminders(tokens []TokenConfig, config TokenExpiryConfig, file string) (*TokenReminders, error) {
+	config = config.withDefaults()
+	remindDays := append([]int(nil), config.RemindDays...)
+	sort.Sort(sort.Reverse(sort.IntSlice(remindDays)))
+	config.RemindDays = remindDays
+	t := &TokenReminders{
+		tokens: tokens,
+		config: config,
+		file:   file,
+		client: &http.Client{Timeout: 10 * time.Second},
+		sent:   map[string]time.Time{},
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &t.sent)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Run 每小时检查一次即将过期的 token
+func (t *TokenReminders) Run() {
+	t.check(time.Now())
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		t.check(now)
+	}
+}
+
+// check 为到达提醒时间的 token 发送提醒，每个 token 的每个提醒时间只发送一次；
+// 记录的键包含过期时间，轮换 token 修改过期时间后会重新提醒
+func (t *TokenReminders) check(now time.Time) {
+	changed := false
+	for _, token := range t.tokens {
+		if token.ExpiresAt.IsZero() {
+			continue
+		}
+		name := token.Name
+		if name == "" {
+			name = tokenFingerprint(token.Token)
+		}
+		left := token.ExpiresAt.Sub(now)
+
+		reminder := TokenReminder{
+			Kind:       "token_expiring",
+			Name:       name,
+			ExpiresAt:  token.ExpiresAt,
+			DaysLeft:   int(math.Ceil(left.Hours() / 24)),
+			GraceUntil: token.ExpiresAt.Add(t.config.grace()),
+		}
+		var key string
+		if left <= 0 {
+			reminder.Kind = "token_expired"
+			reminder.DaysLeft = 0
+			key = fmt.Sprintf("%s|%d|expired", name, token.ExpiresAt.Unix())
+		} else {
+			// 只发送最近的一个提醒时间，长时间停机后启动不会一次发送多条提醒
+			days := -1
+			for _, d := range t.config.RemindDays {
+				if left <= time.Duration(d)*24*time.Hour {
+					days = d
+				}
+			}
+			if days < 0 {
+				continue
+			}
+			key = fmt.Sprintf("%s|%d|%d", name, token.ExpiresAt.Unix(), days)
+		}
+
+		t.mu.Lock()
+		_, sent := t.sent[key]
+		if !sent {
+			t.sent[key] = now
+		}
+		t.mu.Unlock()
+		if sent {
+			continue
+		}
+		changed = true
+		t.notify(reminder)
+	}
+
+	if changed {
+		err := t.save()
+		if err != nil {
+			slog.Error("保存 token 提醒记录失败", "err", err)
+		}
+	}
+}
+
+// notify 通过日志、webhook 和邮件发送提醒
+func (t *TokenReminders) notify(reminder TokenReminder) {
+	var text string
+	if reminder.Kind == "token_expired" {
+		text = fmt.Sprintf("token %s 已于 %s 过期，宽限期至 %s，请尽快轮换\r\n",
+			reminder.Name, reminder.ExpiresAt.Format(time.RFC3339), reminder.GraceUntil.Format(time.RFC3339))
+	} else {
+		text = fmt.Sprintf("token %s 将于 %s 过期（剩余 %d 天），请尽快轮换\r\n",
+			reminder.Name, reminder.ExpiresAt.Format(time.RFC3339), reminder.DaysLeft)
+	}
+	slog.Info(strings.TrimSpace(text))
+
+	if t.config.WebhookURL != "" {
+		err := postWebhook(t.client, t.config.WebhookURL, reminder)
+		if err != nil {
+			slog.Error("发送 token 提醒失败", "err", err)
+		}
+	}
+	err := sendAlertEmail(t.config.Email, "[store] token 过期提醒: "+reminder.Name, text)
+	if err != nil {
+		slog.Error("发送 token 提醒邮件失败", "err", err)
+	}
+}
+
+// save 保存已发送的提醒
+func (t *TokenReminders) save() error {
+	t.mu.Lock()
+	data, err := json.Marshal(t.sent)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(t.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := t.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, t.file)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceConfig 结构用于配置请求记录，用于排查偶发的客户端集成问题
+type TraceConfig struct {
+	Enabled bool `json:"enabled"`
+	// Size 环形缓冲区保留的请求数，默认 200
+	Size int `json:"size"`
+	// MaxBodyBytes 记录请求体和响应体的最大字节数，为 0 时不记录内容，multipart 上传内容不会被记录
+	MaxBodyBytes int `json:"max_body_bytes"`
+}
+
+// TraceRecord 结构用于表示一次被记录的请求，敏感信息已被脱敏
+type TraceRecord struct {
+	ID         uint64    `json:"id"`
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	// Country 和 ASN 在配置了 geoip 时记录客户端 IP 的国家和所属网络
+	Country string `json:"country,omitempty"`
+	ASN     uint64 `json:"asn,omitempty"`
+	// Identity 为通过认证的调用方，Actor 为代表其操作的调用方
+	Identity        string            `json:"identity,omitempty"`
+	Actor           string            `json:"actor,omitempty"`
+	RequestHeaders  map[string]string `json:"request_headers"`
+	RequestBody     string            `json:"request_body,omitempty"`
+	Status          int               `json:"status"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+	ResponseBytes   int64             `json:"response_bytes"`
+	ResponseBody    string            `json:"response_body,omitempty"`
+	DurationMs      float64           `json:"duration_ms"`
+}
+
+// TraceRecorder 将最近的请求保存在固定大小的环形缓冲区中
+type TraceRecorder struct {
+	mu      sync.Mutex
+	records []TraceRecord
+	next    int
+	seq     uint64
+	maxBody int
+}
+
+// NewTraceRecorder 创建请求记录器
+func NewTraceRecorder(cfg TraceConfig) *TraceRecorder {
+	size := cfg.Size
+	if size <= 0 {
+		size = 200
+	}
+	return &TraceRecorder{
+		records: make([]TraceRecord, 0, size),
+		maxBody: cfg.MaxBodyBytes,
+	}
+}
+
+// sensitiveNames 是需要脱敏的请求头和查询参数名称中包含的关键字
+var sensitiveNames = []string{"authorization", "token", "cookie", "secret", "password", "signature", "sig", "key"}
+
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitiveNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeHeaders 复制请求头并将敏感值替换为 ***
+func sanitizeHeaders(header http.Header) map[string]string {
+	result := map[string]string{}
+	for name, values := range header {
+		if isSensitive(name) {
+			result[name] = "***"
+			continue
+		}
+		result[name] = strings.Join(values, ", ")
+	}
+	return result
+}
+
+// sanitizeQuery 将查询参数中的敏感值替换为 ***
+func sanitizeQuery(r *http.Request) string {
+	query := r.URL.Query()
+	for name := range query {
+		if isSensitive(name) {
+			query.Set(name, "***")
+		}
+	}
+	return query.Encode()
+}
+
+// Middleware 记录经过的请求，管理接口本身不记录
+func (t *TraceRecorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		record := TraceRecord{
+			Time:           time.Now(),
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			Query:          sanitizeQuery(r),
+			RemoteAddr:     r.RemoteAddr,
+			RequestHeaders: sanitizeHeaders(r.Header),
+		}
+		geo := geoLocator.Lookup(r)
+		record.Country, record.ASN = geo.Country, geo.ASN
+
+		// 记录请求体的开头部分，上传的文件内容不记录
+		var requestBody bytes.Buffer
+		captureBody := t.maxBody > 0 && !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/")
+		if captureBody && r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, &limitedBuffer{buf: &requestBody, limit: t.maxBody}), r.Body}
+		}
+
+		bodyLimit := 0
+		if captureBody {
+			bodyLimit = t.maxBody
+		}
+		sw := newStatusWriter(w, bodyLimit)
+		ctx := context.WithValue(r.Context(), traceRecordKey{}, &record)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		record.DurationMs = float64(time.Since(record.Time).Microseconds()) / 1000
+		record.Status = sw.Status()
+		record.ResponseBytes = sw.bytes
+		record.ResponseHeaders = sanitizeHeaders(w.Header())
+		record.RequestBody = requestBody.String()
+		if strings.Contains(w.Header().Get("Content-Type"), "json") {
+			record.ResponseBody = sw.body.String()
+		}
+		t.add(record)
+	})
+}
+
+// traceRecordKey 是请求上下文中保存正在记录的请求的键
+type traceRecordKey struct{}
+
+// traceIdentity 在请求记录中标记通过认证的调用方
+func traceIdentity(r *http.Request, identity *Identity) {
+	if record, ok := r.Context().Value(traceRecordKey{}).(*TraceRecord); ok {
+		record.Identity = identity.Name
+		record.Actor = identity.Actor
+	}
+}
+
+// limitedBuffer 只保存写入内容的前 limit 个字节
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.buf.Len(); remaining > 0 {
+		if len(p) < remaining {
+			remaining = len(p)
+		}
+		b.buf.Write(p[:remaining])
+	}
+	return len(p), nil
+}
+
+func (t *TraceRecorder) add(record TraceRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seq++
+	record.ID = t.seq
+	if len(t.records) < cap(t.records) {
+		t.records = append(t.records, record)
+		return
+	}
+	t.records[t.next] = record
+	t.next = (t.next + 1) % len(t.records)
+}
+
+// Snapshot 按时间从旧到新返回缓冲区中的请求
+func (t *TraceRecorder) Snapshot() []TraceRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]TraceRecord, 0, len(t.records))
+	result = append(result, t.records[t.next:]...)
+	result = append(result, t.records[:t.next]...)
+	return result
+}
+
+// 查看最近记录的请求，可按路径前缀、状态码过滤
+func traceHandler(w http.ResponseWriter, r *http.Request, recorder *TraceRecorder) {
+	query := r.URL.Query()
+	prefix := query.Get("path")
+	minStatus, _ := strconv.Atoi(query.Get("min_status"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	records := []TraceRecord{}
+	for _, record := range recorder.Snapshot() {
+		if prefix != "" && !strings.HasPrefix(record.Path, prefix) {
+			continue
+		}
+		if record.Status < minStatus {
+			continue
+		}
+		records = append(records, record)
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+
+	sendContentResponse(w, http.StatusOK, "success", records, nil, r.URL.Path)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TracingConfig 结构用于配置分布式追踪，请求和各处理阶段以 span 的形式通过 OTLP/HTTP（JSON）导出
+type TracingConfig struct {
+	// Endpoint 为 OTLP/HTTP 的接收地址，如 http://localhost:4318/v1/traces，为空时不启用
+	Endpoint string `json:"endpoint"`
+	// Headers 为导出时附加的请求头，如接收端的认证信息
+	Headers map[string]string `json:"headers"`
+	// ServiceName 为 service.name 资源属性，默认 store
+	ServiceName string `json:"service_name"`
+	// SampleRatio 为请求没有带 traceparent 时的采样比例，0 到 1，默认 1 全部采样；带有 traceparent 时沿用上游的决定
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+const (
+	// tracingBatchSize 为一次导出的最大 span 数
+	tracingBatchSize = 512
+	// tracingQueueSize 为等待导出的最大 span 数，接收端不可用时超出的 span 被丢弃
+	tracingQueueSize = 4096
+	// tracingInterval 为未满一批时导出的间隔
+	tracingInterval = 5 * time.Second
+)
+
+// OTLP 中的 span 类型和状态
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpStatusError      = 2
+)
+
+// otlpAttribute 是 OTLP/JSON 中的属性，值为 {"stringValue": ...} 或 {"intValue": ...}，64 位整数按字符串编码
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func stringAttribute(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+func intAttribute(key string, value int64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+// otlpStatus 是 span 的状态，只在出错时设置
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpSpan 是 OTLP/JSON 中的 span，ID 为十六进制字符串
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// Tracer 结构为请求生成 span 并在后台批量导出
+type Tracer struct {
+	config TracingConfig
+	client *http.Client
+	queue  chan otlpSpan
+	// flush 用于停止服务时立即导出队列中的 span，导出后关闭传入的 channel
+	flush chan chan struct{}
+
+	exported atomic.Int64
+	dropped  atomic.Int64
+	failed   atomic.Int64
+}
+
+// tracer 未配置 tracing.endpoint 时为 nil
+var tracer *Tracer
+
+// NewTracer 创建追踪，未配置接收地址时返回 nil
+func NewTracer(config TracingConfig) (*Tracer, error) {
+	if config.Endpoint == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(config.Endpoint, "http://") && !strings.HasPrefix(config.Endpoint, "https://") {
+		return nil, fmt.Errorf("无效的 tracing.endpoint %s，应为 http:// 或 https:// 开头的地址", config.Endpoint)
+	}
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return nil, fmt.Errorf("无效的 tracing.sample_ratio %g，应在 0 到 1 之间", config.SampleRatio)
+	}
+	if config.SampleRatio == 0 {
+		config.SampleRatio = 1
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = "store"
+	}
+	return &Tracer{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan otlpSpan, tracingQueueSize),
+		flush:  make(chan chan struct{}),
+	}, nil
+}
+
+// traceContext 是 W3C traceparent 中的追踪 ID、父 span ID 和采样标志
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent 解析 traceparent 请求头，格式为 00-<32 位十六进制>-<16 位十六进制>-<2 位十六进制标志>
+func parseTraceparent(value string) (traceContext, bool) {
+	var tc traceContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return tc, false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 || parts[1] != strings.ToLower(parts[1]) {
+		return tc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 || parts[2] != strings.ToLower(parts[2]) {
+		return tc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return tc, false
+	}
+	copy(tc.traceID[:], traceID)
+	copy(tc.spanID[:], spanID)
+	// 全为 0 的 ID 无效
+	if tc.traceID == ([16]byte{}) || tc.spanID == ([8]byte{}) {
+		return tc, false
+	}
+	tc.sampled = flags[0]&1 == 1
+	return tc, true
+}
+
+// traceparent 返回传给下游的 traceparent，父 span 为当前 span
+func (tc traceContext) traceparent() string {
+	flags := "00"
+	if tc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(tc.traceID[:]) + "-" + hex.EncodeToString(tc.spanID[:]) + "-" + flags
+}
+
+// requestTrace 结构是一个请求的追踪状态，与 RequestDebug 一样只在处理请求的 goroutine 中修改
+type requestTrace struct {
+	traceContext
+	// parentID 为上游的 span ID，请求没有带 traceparent 时为空
+	parentID [8]byte
+	start    time.Time
+	// last 为上一个阶段结束的时间，阶段的 span 从这里开始
+	last   time.Time
+	stages []otlpSpan
+}
+
+// traceKey 是请求上下文中保存追踪状态的键
+type traceKey struct{}
+
+// requestTraceOf 返回请求的追踪状态，未启用追踪时返回 nil
+func requestTraceOf(ctx context.Context) *requestTrace {
+	t, _ := ctx.Value(traceKey{}).(*requestTrace)
+	return t
+}
+
+// traceStage 结束一个阶段，记录为请求 span 的子 span，由 debugStage 调用
+func traceStage(r *http.Request, name string) {
+	if t := requestTraceOf(r.Context()); t != nil && t.sampled {
+		t.stage(name)
+	}
+}
+
+// stage 记录从上一个阶段结束到现在的子 span
+func (t *requestTrace) stage(name string) {
+	now := time.Now()
+	t.stages = append(t.stages, otlpSpan{
+		TraceID:           hex.EncodeToString(t.traceID[:]),
+		SpanID:            newSpanID(),
+		ParentSpanID:      hex.EncodeToString(t.spanID[:]),
+		Name:              name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(t.last.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(now.UnixNano(), 10),
+	})
+	t.last = now
+}
+
+// injectTraceparent 在发往其他节点的请求中带上当前请求的 traceparent，使下游的 span 属于同一个追踪
+func injectTraceparent(ctx context.Context, req *http.Request) {
+	if t := requestTraceOf(ctx); t != nil {
+		req.Header.Set("traceparent", t.traceparent())
+	}
+}
+
+// newSpanID 生成随机的 span ID
+func newSpanID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// sample 按采样比例决定是否采样，与追踪 ID 的低 8 字节比较，同一个追踪的决定相同
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.config.SampleRatio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>11)/float64(1<<53) < t.config.SampleRatio
+}
+
+// Middleware 为每个请求生成一个 span，各阶段为其子 span；请求带有合法的 traceparent 时沿用其追踪 ID 和采样决定，
+// mux 用于确定请求对应的路由，作为 span 的名称
+func (t *Tracer) Middleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		rt := &requestTrace{start: now, last: now}
+		if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			rt.traceContext = parent
+			rt.parentID = parent.spanID
+		} else {
+			_, _ = rand.Read(rt.traceID[:])
+			rt.sampled = t.sample(rt.traceID)
+		}
+		_, _ = rand.Read(rt.spanID[:])
+		if fields, ok := r.Context().Value(requestLogKey{}).(*requestLogFields); ok && rt.sampled {
+			fields.TraceID = hex.EncodeToString(rt.traceID[:])
+		}
+
+		sw := newStatusWriter(w, 0)
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), traceKey{}, rt)))
+		if !rt.sampled {
+			return
+		}
+		// 最后一个阶段之后为发送响应的耗时，下载时即传输文件的耗时
+		rt.stage("response")
+		t.enqueue(rt.stages...)
+		t.enqueue(t.requestSpan(mux, r, rt, sw))
+	})
+}
+
+// requestSpan 生成请求本身的 span，属性按 OpenTelemetry 的 HTTP 语义约定命名
+func (t *Tracer) requestSpan(mux *http.ServeMux, r *http.Request, rt *requestTrace, sw *statusWriter) otlpSpan {
+	_, route := mux.Handler(r)
+	if route == "" {
+		route = "other"
+	}
+	status := sw.Status()
+	attributes := []otlpAttribute{
+		stringAttribute("http.request.method", r.Method),
+		stringAttribute("http.route", route),
+		stringAttribute("url.path", r.URL.Path),
+		intAttribute("http.response.status_code", int64(status)),
+		intAttribute("http.response.body.size", sw.bytes),
+	}
+	if r.ContentLength > 0 {
+		attributes = append(attributes, intAttribute("http.request.body.size", r.ContentLength))
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		attributes = append(attributes, stringAttribute("client.address", host))
+	}
+	if agent := r.UserAgent(); agent != "" {
+		attributes = append(attributes, stringAttribute("user_agent.original", agent))
+	}
+	if fields, ok := r.Context().Value(requestLogKey{}).(*requestLogFields); ok {
+		attributes = append(attributes, stringAttribute("request_id", fields.ID))
+		if fields.Identity != "" {
+			attributes = append(attributes, stringAttribute("enduser.id", fields.Identity))
+		}
+	}
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(rt.traceID[:]),
+		SpanID:            hex.EncodeToString(rt.spanID[:]),
+		Name:              r.Method + " " + route,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(rt.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        attributes,
+	}
+	if rt.parentID != ([8]byte{}) {
+		span.ParentSpanID = hex.EncodeToString(rt.parentID[:])
+	}
+	if status >= 500 {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: http.StatusText(status)}
+	}
+	return span
+}
+
+// enqueue 将 span 加入导出队列，队列已满时丢弃，不阻塞请求
+func (t *Tracer) enqueue(spans ...otlpSpan) {
+	for _, span := range spans {
+		select {
+		case t.queue <- span:
+		default:
+			t.dropped.Add(1)
+		}
+	}
+}
+
+// Run 批量导出 span，满一批或每隔 tracingInterval 导出一次
+func (t *Tracer) Run() {
+	ticker := time.NewTicker(tracingInterval)
+	defer ticker.Stop()
+	batch := make([]otlpSpan, 0, tracingBatchSize)
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < tracingBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-t.flush:
+			// 导出当前的一批和队列中剩余的 span
+			for drained := false; !drained; {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) == tracingBatchSize {
+						t.exportBatch(batch)
+						batch = batch[:0]
+					}
+				default:
+					drained = true
+				}
+			}
+			if len(batch) > 0 {
+				t.exportBatch(batch)
+				batch = batch[:0]
+			}
+			close(done)
+			continue
+		}
+		t.exportBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+// Flush 立即导出尚未导出的 span，停止服务时调用，最多等待一次导出的超时时间
+func (t *Tracer) Flush() error {
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+	case <-time.After(t.client.Timeout):
+		return errors.New("等待导出追踪数据超时")
+	}
+	<-done
+	return nil
+}
+
+// exportBatch 导出一批 span 并记录结果
+func (t *Tracer) exportBatch(batch []otlpSpan) {
+	err := t.export(batch)
+	if err != nil {
+		t.failed.Add(int64(len(batch)))
+		slog.Warn("导出追踪数据失败", "endpoint", t.config.Endpoint, "spans", len(batch), "err", err)
+	} else {
+		t.exported.Add(int64(len(batch)))
+	}
+}
+
+// export 将一批 span 发送到接收端，失败时不重试
+func (t *Tracer) export(batch []otlpSpan) error {
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{stringAttribute("service.name", t.config.ServiceName)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "store"},
+				"spans": batch,
+			}},
+		}},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.config.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.config.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// writeMetrics 输出已导出、丢弃和导出失败的 span 数
+func (t *Tracer) writeMetrics(w io.Writer) {
+	if t == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP store_tracing_spans_total Trace spans by export outcome.\n")
+	fmt.Fprintf(w, "# TYPE store_tracing_spans_total counter\n")
+	fmt.Fprintf(w, "store_tracing_spans_total{result=\"exported\"} %d\n", t.exported.Load())
+	fmt.Fprintf(w, "store_tracing_spans_total{result=\"dropped\"} %d\n", t.dropped.Load())
+	fmt.Fprintf(w, "store_tracing_spans_total{result=\"failed\"} %d\n", t.failed.Load())
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 传输的优先级，并发数已满时优先调度交互请求
+const (
+	priorityInteractive = "interactive"
+	priorityBatch       = "batch"
+)
+
+var transferPriorities = []string{priorityInteractive, priorityBatch}
+
+// TransferConfig 结构用于配置上传和下载的并发数
+type TransferConfig struct {
+	// MaxConcurrent 同时进行的上传和下载数，0 表示不限制
+	MaxConcurrent int `json:"max_concurrent"`
+	// ReservedInteractive 只给交互请求使用的并发数，批量请求最多同时进行 MaxConcurrent - ReservedInteractive 个
+	ReservedInteractive int `json:"reserved_interactive"`
+	// QueueTimeout 排队等待的最长时间，单位秒，默认 30，超时返回 503
+	QueueTimeout int `json:"queue_timeout"`
+}
+
+var errTransferQueueTimeout = errors.New("排队超时")
+
+// transferWaiter 是排队中的请求，被调度时关闭 ready
+type transferWaiter struct {
+	priority string
+	ready    chan struct{}
+}
+
+// TransferScheduler 结构用于限制上传和下载的并发数，并发数已满时请求按优先级排队，
+// 交互请求总是排在批量请求之前，夜间批量同步时界面的下载不会被堵住
+type TransferScheduler struct {
+	mu      sync.Mutex
+	config  TransferConfig
+	timeout time.Duration
+	active  map[string]int
+	queues  map[string]*list.List
+	// total 和 rejected 为按优先级统计的请求数和排队超时数
+	total    map[string]int64
+	rejected map[string]int64
+	// waited 为按优先级统计的排队时间总和
+	waited map[string]time.Duration
+}
+
+// transferScheduler 未配置并发数时为 nil
+var transferScheduler *TransferScheduler
+
+// NewTransferScheduler 创建传输调度，未配置并发数时返回 nil
+func NewTransferScheduler(config TransferConfig) (*TransferScheduler, error) {
+	if config.MaxConcurrent <= 0 {
+		return nil, nil
+	}
+	if config.ReservedInteractive < 0 || config.ReservedInteractive >= config.MaxConcurrent {
+		return nil, fmt.Errorf("reserved_interactive 应小于 max_concurrent")
+	}
+	timeout := time.Duration(config.QueueTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	s := &TransferScheduler{
+		config:   config,
+		timeout:  timeout,
+		active:   map[string]int{},
+		queues:   map[string]*list.List{},
+		total:    map[string]int64{},
+		rejected: map[string]int64{},
+		waited:   map[string]time.Duration{},
+	}
+	for _, priority := range transferPriorities {
+		s.queues[priority] = list.New()
+	}
+	return s, nil
+}
+
+// available 判断该优先级的请求现在能否开始，调用方需要持有锁
+func (s *TransferScheduler) available(priority string) bool {
+	running := s.active[priorityInteractive] + s.active[priorityBatch]
+	if running >= s.config.MaxConcurrent {
+		return false
+	}
+	if priority == priorityBatch {
+		return s.active[priorityBatch] < s.config.MaxConcurrent-s.config.ReservedInteractive
+	}
+	return true
+}
+
+// dispatch 在有空闲的并发数时按优先级调度排队的请求，调用方需要持有锁
+func (s *TransferScheduler) dispatch() {
+	for _, priority := range transferPriorities {
+		queue := s.queues[priority]
+		for queue.Len() > 0 && s.available(priority) {
+			waiter := queue.Remove(queue.Front()).(*transferWaiter)
+			s.active[priority]++
+			close(waiter.ready)
+		}
+	}
+}
+
+// Acquire 等待可以开始传输，返回传输结束时调用的函数；排队超时或请求取消时返回错误
+func (s *TransferScheduler) Acquire(ctx context.Context, priority string) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	release := func() {
+		s.mu.Lock()
+		s.active[priority]--
+		s.dispatch()
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	s.total[priority]++
+	// 前面有同等或更高优先级的请求在排队时不插队
+	queued := s.queues[priorityInteractive].Len()
+	if priority == priorityBatch {
+		queued += s.queues[priorityBatch].Len()
+	}
+	if queued == 0 && s.available(priority) {
+		s.active[priority]++
+		s.mu.Unlock()
+		return release, nil
+	}
+	waiter := &transferWaiter{priority: priority, ready: make(chan struct{})}
+	element := s.queues[priority].PushBack(waiter)
+	s.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter.ready:
+	case <-timer.C:
+		err = errTransferQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waited[priority] += time.Since(start)
+	if err == nil {
+		return release, nil
+	}
+	select {
+	case <-waiter.ready:
+		// 超时的同时已被调度，仍然可以开始
+		return release, nil
+	default:
+	}
+	s.queues[priority].Remove(element)
+	if err == errTransferQueueTimeout {
+		s.rejected[priority]++
+	}
+	return nil, err
+}
+
+// requestPriority 返回请求的优先级：token 配置为 batch 时总是 batch，否则可以通过 X-Priority 请求头降为 batch，
+// 未声明时为 interactive
+func requestPriority(r *http.Request) string {
+	if identity := identityFrom(r); identity != nil && identity.Priority == priorityBatch {
+		return priorityBatch
+	}
+	if strings.EqualFold(strings.TrimSpace(r.Header.Get("X-Priority")), priorityBatch) {
+		return priorityBatch
+	}
+	return priorityInteractive
+}
+
+// TransferMiddleware 在并发数已满时按优先级排队，需要放在认证之后以读取 token 的优先级
+func TransferMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if transferScheduler == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		priority := requestPriority(r)
+		release, err := transferScheduler.Acquire(r.Context(), priority)
+		if err == errTransferQueueTimeout {
+			w.Header().Set("Retry-After", strconv.Itoa(int(transferScheduler.timeout.Seconds())))
+			sendJSONResponse(w, http.StatusServiceUnavailable, "服务繁忙，请稍后重试", err, r.URL.Path)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "请求在排队时取消", "err", err)
+			return
+		}
+		defer release()
+		debugStage(r, "queue")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeMetrics 输出按优先级统计的进行中和排队中的传输数、排队超时数和排队时间
+func (s *TransferScheduler) writeMetrics(w http.ResponseWriter) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP store_transfers_active Number of uploads and downloads in progress.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_transfers_active gauge\n")
+	for _, priority := range transferPriorities {
+		_, _ = fmt.Fprintf(w, "store_transfers_active{priority=%q} %d\n", priority, s.active[priority])
+	}
+	_, _ = fmt.Fprintf(w, "# HELP store_transfers_queued Number of uploads and downloads waiting for a slot.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_transfers_queued gauge\n")
+	for _, priority := range transferPriorities {
+		_, _ = fmt.Fprintf(w, "store_transfers_queued{priority=%q} %d\n", priority, s.queues[priority].Len())
+	}
+	_, _ = fmt.Fprintf(w, "# HELP store_transfers_total Uploads and downloads admitted or queued.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_transfers_total counter\n")
+	for _, priority := range transferPriorities {
+		_, _ = fmt.Fprintf(w, "store_transfers_total{priority=%q} %d\n", priority, s.total[priority])
+	}
+	_, _ = fmt.Fprintf(w, "# HELP store_transfers_rejected_total Uploads and downloads rejected after the queue timeout.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_transfers_rejected_total counter\n")
+	for _, priority := range transferPriorities {
+		_, _ = fmt.Fprintf(w, "store_transfers_rejected_total{priority=%q} %d\n", priority, s.rejected[priority])
+	}
+	_, _ = fmt.Fprintf(w, "# HELP store_transfers_queue_seconds_total Total time spent waiting in the queue.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_transfers_queue_seconds_total counter\n")
+	for _, priority := range transferPriorities {
+		_, _ = fmt.Fprintf(w, "store_transfers_queue_seconds_total{priority=%q} %.3f\n", priority, s.waited[priority].Seconds())
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trashDirName 是 data 目录下保存已删除文件的目录名
+const trashDirName = ".trash"
+
+// TrashConfig 结构用于配置回收站，删除的文件先移入回收站，过期后自动清除
+type TrashConfig struct {
+	// Disabled 为 true 时删除的文件不进入回收站，直接删除
+	Disabled bool `json:"disabled"`
+	// RetentionDays 回收站中的文件保留的天数，默认 30
+	RetentionDays int `json:"retention_days"`
+}
+
+// TrashItem 结构表示回收站中的一项
+type TrashItem struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+}
+
+var (
+	errTrashNotFound = errors.New("回收站中不存在该项")
+	errRestoreExists = errors.New("恢复的目标路径已存在")
+)
+
+// Trash 结构用于管理回收站，被删除的文件移动到 data/.trash/<id>，原路径等信息保存在 data/.meta 目录下
+type Trash struct {
+	file      string
+	retention time.Duration
+
+	mu    sync.Mutex
+	items map[string]*TrashItem
+}
+
+// trash 禁用回收站时为 nil
+var trash *Trash
+
+// OpenTrash 打开回收站，记录文件不存在时返回空回收站
+func OpenTrash(file string, config TrashConfig) (*Trash, error) {
+	days := config.RetentionDays
+	if days <= 0 {
+		days = 30
+	}
+	t := &Trash{
+		file:      file,
+		retention: time.Duration(days) * 24 * time.Hour,
+		items:     map[string]*TrashItem{},
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &t.items)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// itemPath 返回回收站中一项的完整路径
+func (t *Trash) itemPath(id string) string {
+	return filepath.Join("data", trashDirName, id)
+}
+
+// treeSize 返回文件或目录中所有文件的大小之和
+func treeSize(fullPath string) int64 {
+	var size int64
+	_ = filepath.WalkDir(fullPath, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// Move 将文件或目录移入回收站
+func (t *Trash) Move(key string, deletedBy string) (TrashItem, error) {
+	fullPath := filepath.Join("data", filepath.FromSlash(key))
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return TrashItem{}, err
+	}
+
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	item := TrashItem{
+		ID:        hex.EncodeToString(id),
+		Path:      key,
+		IsDir:     info.IsDir(),
+		Size:      treeSize(fullPath),
+		DeletedAt: time.Now(),
+		DeletedBy: deletedBy,
+	}
+	err = os.MkdirAll(filepath.Join("data", trashDirName), os.ModePerm)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	err = renameDataPath(fullPath, t.itemPath(item.ID))
+	if err != nil {
+		return TrashItem{}, err
+	}
+
+	t.mu.Lock()
+	t.items[item.ID] = &item
+	t.mu.Unlock()
+	return item, t.save()
+}
+
+// List 返回原路径在 prefix 下的项，按删除时间从新到旧排列
+func (t *Trash) List(prefix string) []TrashItem {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	items := []TrashItem{}
+	for _, item := range t.items {
+		if prefix == "" || item.Path == prefix || strings.HasPrefix(item.Path, prefix+"/") {
+			items = append(items, *item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	return items
+}
+
+// Item 返回回收站中的一项
+func (t *Trash) Item(id string) (TrashItem, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	item, ok := t.items[id]
+	if !ok {
+		return TrashItem{}, false
+	}
+	return *item, true
+}
+
+// Restore 将回收站中的一项恢复到原路径或 target，目标路径已存在时返回 errRestoreExists
+func (t *Trash) Restore(id string, target string) (TrashItem, error) {
+	t.mu.Lock()
+	item, ok := t.items[id]
+	t.mu.Unlock()
+	if !ok {
+		return TrashItem{}, errTrashNotFound
+	}
+	restored := *item
+	if target != "" {
+		restored.Path = target
+	}
+
+	fullPath := filepath.Join("data", filepath.FromSlash(restored.Path))
+	if _, err := os.Stat(fullPath); err == nil {
+		return restored, errRestoreExists
+	}
+	err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+	if err != nil {
+		return restored, err
+	}
+	err = renameDataPath(t.itemPath(id), fullPath)
+	if err != nil {
+		return restored, err
+	}
+
+	t.mu.Lock()
+	delete(t.items, id)
+	t.mu.Unlock()
+	return restored, t.save()
+}
+
+// Purge 永久删除回收站中的一项
+func (t *Trash) Purge(id string) error {
+	t.mu.Lock()
+	_, ok := t.items[id]
+	t.mu.Unlock()
+	if !ok {
+		return errTrashNotFound
+	}
+	err := removeDataPath(t.itemPath(id))
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	delete(t.items, id)
+	t.mu.Unlock()
+	return t.save()
+}
+
+// PurgeBefore 永久删除在 cutoff 之前删除的项，返回删除的数量
+func (t *Trash) PurgeBefore(cutoff time.Time) int {
+	var ids []string
+	t.mu.Lock()
+	for id, item := range t.items {
+		if item.DeletedAt.Before(cutoff) {
+			ids = append(ids, id)
+		}
+	}
+	t.mu.Unlock()
+
+	purged := 0
+	for _, id := range ids {
+		err := t.Purge(id)
+		if err != nil {
+			slog.Error("清除回收站失败", "id", id, "err", err)
+			continue
+		}
+		purged++
+	}
+	return purged
+}
+
+// save 保存回收站记录
+func (t *Trash) save() error {
+	t.mu.Lock()
+	data, err := json.Marshal(t.items)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(t.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := t.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, t.file)
+}
+
+// Run 每小时清除超过保留时间的项
+func (t *Trash) Run() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if purged := t.PurgeBefore(time.Now().Add(-t.retention)); purged > 0 {
+			slog.Info("已清除回收站中过期的项", "purged", purged)
+		}
+		<-ticker.C
+	}
+}
+
+// reindexRestored 恢复文件或目录后重新建立索引
+func reindexRestored(key string) {
+	refreshIndexPath(key)
+	fullPath := filepath.Join("data", filepath.FromSlash(key))
+	if metaIndex != nil {
+		scanTree(metaIndex, key)
+	}
+	_ = filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(fullPath, p)
+		if err != nil {
+			return nil
+		}
+		fileKey := path.Join(key, filepath.ToSlash(rel))
+		existenceFilter.AddPath(fileKey)
+		if d.IsDir() {
+			return nil
+		}
+		err = contentIndex.IndexFile(fileKey, p)
+		if err != nil {
+			slog.Error("索引文件内容失败", "err", err)
+		}
+		return nil
+	})
+}
+
+// TrashRequest 结构用于恢复或清除回收站中的项
+type TrashRequest struct {
+	ID string `json:"id"`
+	// Path 恢复时可选的目标路径，为空时恢复到原路径
+	Path string `json:"path"`
+	// All 清除时为 true 表示清空回收站
+	All bool `json:"all"`
+}
+
+// 列出回收站中的项
+func trashListHandler(w http.ResponseWriter, r *http.Request) {
+	if trash == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用回收站", nil, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", trash.List(indexKey(r.URL.Query().Get("path"))), nil, r.URL.Path)
+}
+
+// 恢复回收站中的项
+func trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if trash == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用回收站", nil, r.URL.Path)
+		return
+	}
+	var request TrashRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.ID == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	target := ""
+	if request.Path != "" {
+		target = indexKey(request.Path)
+		if target == "" || isReservedPath(target) || isUnsafePath(request.Path) {
+			sendJSONResponse(w, http.StatusBadRequest, "非法的路径参数", nil, r.URL.Path)
+			return
+		}
+		if err := checkPathLength(target); err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, "目标路径过长", err, r.URL.Path)
+			return
+		}
+	}
+
+	// 恢复到原路径时按回收站中记录的路径加锁
+	lockKey := target
+	if lockKey == "" {
+		item, ok := trash.Item(request.ID)
+		if !ok {
+			sendJSONResponse(w, http.StatusNotFound, "回收站中不存在该项", errTrashNotFound, r.URL.Path)
+			return
+		}
+		lockKey = item.Path
+	}
+	release := lockWritePath(w, r, lockKey, "从回收站恢复", false)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	item, err := trash.Restore(request.ID, target)
+	switch {
+	case err == errTrashNotFound:
+		sendJSONResponse(w, http.StatusNotFound, "回收站中不存在该项", err, r.URL.Path)
+		return
+	case err == errRestoreExists:
+		sendContentResponse(w, http.StatusConflict, "目标路径已存在，请指定其他路径", item, err, r.URL.Path)
+		return
+	case err != nil:
+		sendJSONResponse(w, http.StatusInternalServerError, "恢复失败", err, r.URL.Path)
+		return
+	}
+	reindexRestored(item.Path)
+	replicator.PutTree(r, item.Path)
+	s3Mirror.PutTree(item.Path)
+	webhooks.EmitTree(r, item.Path, "trash_restore")
+	changeFeed.PublishTree(r, item.Path, "trash_restore")
+	eventBus.PublishTree(r, item.Path, "trash_restore")
+	sendContentResponse(w, http.StatusOK, "恢复成功", item, nil, r.URL.Path)
+}
+
+// 永久删除回收站中的项
+func trashPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if trash == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用回收站", nil, r.URL.Path)
+		return
+	}
+	var request TrashRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || (request.ID == "" && !request.All) {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+
+	if request.All {
+		purged := trash.PurgeBefore(time.Now().Add(time.Second))
+		sendContentResponse(w, http.StatusOK, "已清空回收站", map[string]int{"purged": purged}, nil, r.URL.Path)
+		return
+	}
+	err = trash.Purge(request.ID)
+	if err == errTrashNotFound {
+		sendJSONResponse(w, http.StatusNotFound, "回收站中不存在该项", err, r.URL.Path)
+		return
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "清除失败", err, r.URL.Path)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, "已永久删除", nil, r.URL.Path)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TTLConfig 结构用于配置文件的自动过期，过期的文件由后台任务删除
+type TTLConfig struct {
+	// SweepInterval 检查过期文件的间隔，单位秒，默认 60
+	SweepInterval int `json:"sweep_interval"`
+	// Rules 按路径前缀配置文件的保留时间，从文件的修改时间开始计算，匹配最长的前缀
+	Rules []TTLRule `json:"rules"`
+}
+
+// TTLRule 结构表示一条过期规则
+type TTLRule struct {
+	// Prefix 路径前缀，按目录匹配
+	Prefix string `json:"prefix"`
+	// TTL 保留时间，如 30m、72h、7d，为空或 0 表示不过期
+	TTL string `json:"ttl"`
+}
+
+// ttlRule 是解析后的过期规则
+type ttlRule struct {
+	prefix string
+	ttl    time.Duration
+}
+
+// parseTTL 解析保留时间，支持 Go 的时长格式、d（天）后缀和纯数字（秒）
+func parseTTL(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("无效的保留时间 %q", value)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("无效的保留时间 %q", value)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("无效的保留时间 %q", value)
+	}
+	return ttl, nil
+}
+
+// FileExpiry 结构用于保存通过 X-Expire-After 请求头设置的过期时间，并在后台删除过期的文件
+type FileExpiry struct {
+	file     string
+	interval time.Duration
+	// rules 按前缀长度从长到短排列
+	rules []ttlRule
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+	dirty   bool
+}
+
+// fileExpiry 在 OpenFileExpiry 之前为 nil
+var fileExpiry *FileExpiry
+
+// OpenFileExpiry 加载已设置的过期时间，文件不存在时返回空记录
+func OpenFileExpiry(file string, config TTLConfig) (*FileExpiry, error) {
+	e := &FileExpiry{
+		file:     file,
+		interval: time.Duration(config.SweepInterval) * time.Second,
+		expires:  map[string]time.Time{},
+	}
+	if e.interval <= 0 {
+		e.interval = time.Minute
+	}
+	for _, rule := range config.Rules {
+		ttl, err := parseTTL(rule.TTL)
+		if err != nil {
+			return nil, err
+		}
+		e.rules = append(e.rules, ttlRule{prefix: indexKey(rule.Prefix), ttl: ttl})
+	}
+	sort.SliceStable(e.rules, func(i, j int) bool {
+		return len(e.rules[i].prefix) > len(e.rules[j].prefix)
+	})
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &e.expires)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Set 设置文件的过期时间，为零值时清除之前设置的过期时间（如覆盖上传时未带请求头）
+func (e *FileExpiry) Set(key string, expiresAt time.Time) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.expires[key]; !ok && expiresAt.IsZero() {
+		return
+	}
+	if expiresAt.IsZero() {
+		delete(e.expires, key)
+	} else {
+		e.expires[key] = expiresAt
+	}
+	e.dirty = true
+}
+
+// Forget 删除指定路径及其下所有子路径的过期时间
+func (e *FileExpiry) Forget(key string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k := range e.expires {
+		if key == "" || k == key || strings.HasPrefix(k, key+"/") {
+			delete(e.expires, k)
+			e.dirty = true
+		}
+	}
+}
+
+// ExpiresAt 返回文件的过期时间，单独设置的过期时间优先于规则，不过期时返回零值
+func (e *FileExpiry) ExpiresAt(key string, modTime time.Time) time.Time {
+	if e == nil {
+		return time.Time{}
+	}
+	e.mu.Lock()
+	expiresAt, ok := e.expires[key]
+	e.mu.Unlock()
+	if ok {
+		return expiresAt
+	}
+	if rule, ok := e.rule(key); ok && rule.ttl > 0 {
+		return modTime.Add(rule.ttl)
+	}
+	return time.Time{}
+}
+
+// rule 返回匹配路径的最长前缀规则
+func (e *FileExpiry) rule(key string) (ttlRule, bool) {
+	for _, rule := range e.rules {
+		if rule.prefix == "" || key == rule.prefix || strings.HasPrefix(key, rule.prefix+"/") {
+			return rule, true
+		}
+	}
+	return ttlRule{}, false
+}
+
+// Sweep 删除所有已过期的文件
+func (e *FileExpiry) Sweep(now time.Time) {
+	var expired []string
+	e.mu.Lock()
+	for key, expiresAt := range e.expires {
+		if now.After(expiresAt) {
+			expired = append(expired, key)
+		}
+	}
+	e.mu.Unlock()
+	for _, key := range expired {
+		e.purge(key, now)
+	}
+
+	// 按规则过期的文件需要遍历规则覆盖的目录，前缀重叠时只遍历一次
+	for i, rule := range e.rules {
+		if rule.ttl <= 0 || e.coveredBy(i) {
+			continue
+		}
+		root := filepath.Join("data", filepath.FromSlash(rule.prefix))
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			key := indexKey(strings.TrimPrefix(filepath.ToSlash(path), "data"))
+			if d.IsDir() {
+				if isReservedPath(key) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			expiresAt := e.ExpiresAt(key, info.ModTime())
+			if !expiresAt.IsZero() && now.After(expiresAt) {
+				e.purge(key, now)
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("检查过期文件失败", "err", err)
+		}
+	}
+}
+
+// coveredBy 判断第 i 条规则的目录是否已被更短前缀的有效规则遍历
+func (e *FileExpiry) coveredBy(i int) bool {
+	prefix := e.rules[i].prefix
+	for _, rule := range e.rules[i+1:] {
+		if rule.ttl > 0 && (rule.prefix == "" || strings.HasPrefix(prefix, rule.prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// purge 删除过期的文件并清理相关记录
+func (e *FileExpiry) purge(key string, now time.Time) {
+	// 正在写入的文件留到下一次清理，重新上传后会清除过期时间
+	release, err := pathLocks.Lock(context.Background(), key, "删除过期文件", false)
+	if err != nil {
+		return
+	}
+	defer release()
+	// 保留期内的文件不删除，保留期满后的下一次清理再删除
+	if wormPolicy.Protected(key) != nil {
+		return
+	}
+	fullPath := filepath.Join("data", filepath.FromSlash(key))
+	info, err := os.Stat(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("删除过期文件失败", "err", err)
+		return
+	}
+	// 文件在检查之后被重新上传时不删除
+	if err == nil {
+		expiresAt := e.ExpiresAt(key, info.ModTime())
+		if expiresAt.IsZero() || !now.After(expiresAt) {
+			return
+		}
+		err = removeDataPath(fullPath)
+		if err != nil {
+			slog.Error("删除过期文件失败", "err", err)
+			return
+		}
+		slog.Info("已删除过期文件", "key", key, "size", info.Size(), "expires_at", expiresAt)
+	}
+	forgetDeletedPath(key, 1)
+	replicator.Delete(nil, key)
+	webhooks.Emit(nil, WebhookEvent{Event: webhookDelete, Path: key, Source: "expire"})
+	changeFeed.Publish(nil, ChangeEvent{Type: changeDeleted, Path: key, Source: "expire"})
+	eventBus.Publish(nil, BusEvent{Type: changeDeleted, Path: key, Source: "expire"})
+}
+
+// Save 将有修改的过期时间写回磁盘
+func (e *FileExpiry) Save() error {
+	e.mu.Lock()
+	if !e.dirty {
+		e.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(e.expires)
+	e.dirty = false
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(e.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := e.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, e.file)
+}
+
+// Run 定期删除过期的文件并保存过期时间
+func (e *FileExpiry) Run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		e.Sweep(now)
+		err := e.Save()
+		if err != nil {
+			slog.Error("保存过期时间失败", "err", err)
+		}
+	}
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TusConfig 结构用于配置 tus 断点续传协议（/tus/），浏览器中的 uppy、tus-js-client 等客户端可以直接使用
+type TusConfig struct {
+	Enabled bool `json:"enabled"`
+	// ExpireHours 未完成的上传在最后一次写入之后保留的时间，单位小时，默认 24
+	ExpireHours int `json:"expire_hours"`
+}
+
+// tus 协议的版本和支持的扩展
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,expiration,termination"
+	// tusContentType 是 PATCH 请求体的内容类型
+	tusContentType = "application/offset+octet-stream"
+)
+
+// TusUpload 结构是一个未完成的 tus 上传，已接收的内容保存在 data/.meta/tus 下以 ID 命名的文件中，
+// 已接收的字节数即该文件的大小
+type TusUpload struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	// Metadata 为 Upload-Metadata 中除路径之外的键值，完成后作为自定义元数据保存到索引
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedBy string            `json:"created_by,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+var (
+	errTusNotFound = errors.New("上传不存在、已完成或已过期")
+	errTusBusy     = errors.New("该上传正在被其他请求写入")
+)
+
+// TusUploads 结构保存未完成的 tus 上传，记录保存在 data/.meta/tus.json
+type TusUploads struct {
+	dir    string
+	file   string
+	expire time.Duration
+	// limits 为按路径前缀排列好的上传大小上限
+	limits UploadConfig
+
+	mu    sync.Mutex
+	items map[string]*TusUpload
+	// busy 为正在写入或完成的上传，同一上传同时只接受一个请求
+	busy map[string]bool
+	// saveMu 保证记录按修改的顺序写入，较早的快照不会覆盖较新的
+	saveMu sync.Mutex
+	// completed 和 expired 为已完成和过期删除的上传数，用于监控指标
+	completed int64
+	expired   int64
+}
+
+// tusUploads 未启用 tus 时为 nil
+var tusUploads *TusUploads
+
+// OpenTusUploads 加载未完成的 tus 上传，未启用时返回 nil
+func OpenTusUploads(dir string, file string, config UploadConfig) (*TusUploads, error) {
+	if !config.Tus.Enabled {
+		return nil, nil
+	}
+	expire := config.Tus.ExpireHours
+	if expire <= 0 {
+		expire = 24
+	}
+	t := &TusUploads{
+		dir:    dir,
+		file:   file,
+		expire: time.Duration(expire) * time.Hour,
+		limits: config.sortedLimits(),
+		items:  map[string]*TusUpload{},
+		busy:   map[string]bool{},
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &t.items)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// dataPath 返回上传已接收的内容在磁盘上的路径
+func (t *TusUploads) dataPath(id string) string {
+	return filepath.Join(t.dir, id)
+}
+
+// Create 登记一个新的上传并创建空的内容文件
+func (t *TusUploads) Create(item TusUpload) (TusUpload, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return item, err
+	}
+	item.ID = hex.EncodeToString(id)
+	item.CreatedAt = time.Now()
+	item.ExpiresAt = item.CreatedAt.Add(t.expire)
+	err = os.MkdirAll(t.dir, os.ModePerm)
+	if err != nil {
+		return item, err
+	}
+	file, err := os.OpenFile(t.dataPath(item.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return item, err
+	}
+	_ = file.Close()
+	t.mu.Lock()
+	t.items[item.ID] = &item
+	t.mu.Unlock()
+	return item, t.save()
+}
+
+// Get 返回 owner 创建的上传，其他调用方创建的上传视为不存在
+func (t *TusUploads) Get(id string, owner string) (TusUpload, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	item, ok := t.items[id]
+	if !ok || item.CreatedBy != owner {
+		return TusUpload{}, errTusNotFound
+	}
+	return *item, nil
+}
+
+// PathOf 返回上传的存储路径，上传不存在时返回空字符串
+func (t *TusUploads) PathOf(id string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if item, ok := t.items[id]; ok {
+		return item.Path
+	}
+	return ""
+}
+
+// Acquire 取得上传的写入权，返回的函数用于释放；同一上传已有请求在写入时返回 errTusBusy
+func (t *TusUploads) Acquire(id string, owner string) (TusUpload, func(), error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	item, ok := t.items[id]
+	if !ok || item.CreatedBy != owner {
+		return TusUpload{}, nil, errTusNotFound
+	}
+	if t.busy[id] {
+		return TusUpload{}, nil, errTusBusy
+	}
+	t.busy[id] = true
+	return *item, func() {
+		t.mu.Lock()
+		delete(t.busy, id)
+		t.mu.Unlock()
+	}, nil
+}
+
+// Offset 返回上传已接收的字节数
+func (t *TusUploads) Offset(id string) (int64, error) {
+	info, err := os.Stat(t.dataPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Append 在 offset 处追加请求体，最多写入到 Upload-Length；客户端中断时已写入的部分保留，返回新的偏移和延长后的记录
+func (t *TusUploads) Append(item TusUpload, offset int64, body io.Reader) (TusUpload, int64, error) {
+	file, err := os.OpenFile(t.dataPath(item.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return item, offset, err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err == nil {
+		var n int64
+		n, err = io.Copy(file, io.LimitReader(body, item.Length-offset))
+		offset += n
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return t.touch(item), offset, err
+}
+
+// touch 在写入之后重新计算过期时间
+func (t *TusUploads) touch(item TusUpload) TusUpload {
+	item.ExpiresAt = time.Now().Add(t.expire)
+	t.mu.Lock()
+	if stored, ok := t.items[item.ID]; ok {
+		stored.ExpiresAt = item.ExpiresAt
+	}
+	t.mu.Unlock()
+	err := t.save()
+	if err != nil {
+		slog.Error("保存 tus 上传记录失败", "err", err)
+	}
+	return item
+}
+
+// Remove 删除上传的内容和记录，completed 为 true 时上传已完成
+func (t *TusUploads) Remove(id string, completed bool) error {
+	err := os.Remove(t.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	t.mu.Lock()
+	delete(t.items, id)
+	if completed {
+		t.completed++
+	}
+	t.mu.Unlock()
+	return t.save()
+}
+
+// save 保存上传记录，同一时间只有一个保存，后开始的保存写入的是更新的内容
+func (t *TusUploads) save() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+	t.mu.Lock()
+	data, err := json.Marshal(t.items)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(t.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := t.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, t.file)
+}
+
+// Run 每 10 分钟删除过期的上传
+func (t *TusUploads) Run() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		t.expireBefore(time.Now())
+		<-ticker.C
+	}
+}
+
+// expireBefore 删除在 now 之前过期的上传，正在写入的上传留到下一次
+func (t *TusUploads) expireBefore(now time.Time) {
+	var expired []string
+	t.mu.Lock()
+	for id, item := range t.items {
+		if now.After(item.ExpiresAt) && !t.busy[id] {
+			expired = append(expired, id)
+			// 删除期间不接受写入
+			t.busy[id] = true
+		}
+	}
+	t.mu.Unlock()
+	for _, id := range expired {
+		err := t.Remove(id, false)
+		t.mu.Lock()
+		delete(t.busy, id)
+		if err == nil {
+			t.expired++
+		}
+		t.mu.Unlock()
+		if err != nil {
+			slog.Error("删除过期的 tus 上传失败", "id", id, "err", err)
+		} else {
+			slog.Info("已删除过期的 tus 上传", "id", id)
+		}
+	}
+}
+
+// writeMetrics 输出未完成、已完成和过期删除的上传数
+func (t *TusUploads) writeMetrics(w io.Writer) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(w, "# HELP store_tus_uploads_active Unfinished tus uploads.\n")
+	fmt.Fprintf(w, "# TYPE store_tus_uploads_active gauge\n")
+	fmt.Fprintf(w, "store_tus_uploads_active %d\n", len(t.items))
+	fmt.Fprintf(w, "# HELP store_tus_uploads_total Tus uploads by outcome.\n")
+	fmt.Fprintf(w, "# TYPE store_tus_uploads_total counter\n")
+	fmt.Fprintf(w, "store_tus_uploads_total{result=\"completed\"} %d\n", t.completed)
+	fmt.Fprintf(w, "store_tus_uploads_total{result=\"expired\"} %d\n", t.expired)
+}
+
+// parseTusMetadata 解析 Upload-Metadata，格式为逗号分隔的 "键 base64值"，值可以省略
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("无效的 Upload-Metadata %q", pair)
+		}
+		if _, ok := metadata[fields[0]]; ok {
+			return nil, fmt.Errorf("Upload-Metadata 中重复的键 %s", fields[0])
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("Upload-Metadata 中 %s 的值不是 base64", fields[0])
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, nil
+}
+
+// tusTargetPath 按 Upload-Metadata 确定存储路径：path 为完整的路径，否则为 dir 目录下的 filename（或 name）
+func tusTargetPath(metadata map[string]string) string {
+	if p := metadata["path"]; p != "" {
+		return p
+	}
+	name := metadata["filename"]
+	if name == "" {
+		name = metadata["name"]
+	}
+	if name == "" {
+		return ""
+	}
+	return path.Join(metadata["dir"], name)
+}
+
+// tusUploadID 返回 /tus/<id> 中的上传 ID，创建上传的 /tus/ 返回空字符串
+func tusUploadID(r *http.Request) string {
+	return strings.Trim(strings.TrimPrefix(r.URL.Path, "/tus"), "/")
+}
+
+// setTusHeaders 设置上传的偏移和过期时间
+func setTusHeaders(w http.ResponseWriter, item TusUpload, offset int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", item.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// TusMiddleware 在认证之前响应 tus 的 OPTIONS 请求，客户端用于查询支持的版本和扩展；
+// 其他请求按 Upload-Metadata 或已创建的上传设置 X-FormFile-Path，策略引擎和审计日志按存储路径处理
+func TusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tusUploads == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodOptions {
+			header := w.Header()
+			header.Set("Tus-Resumable", tusVersion)
+			header.Set("Tus-Version", tusVersion)
+			header.Set("Tus-Extension", tusExtensions)
+			if maxSize := tusUploads.limits.MaxSize; maxSize > 0 {
+				header.Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Del("X-FormFile-Path")
+		target := ""
+		if id := tusUploadID(r); id != "" {
+			target = tusUploads.PathOf(id)
+		} else if metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata")); err == nil {
+			target = tusTargetPath(metadata)
+		}
+		if target != "" {
+			r.Header.Set("X-FormFile-Path", target)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tusHandler 处理 tus 协议的请求：POST /tus/ 创建上传，HEAD 查询偏移，PATCH 追加内容，DELETE 取消上传；
+// 上传由创建它的调用方继续，接收满 Upload-Length 后与普通上传相同地保存
+func tusHandler(w http.ResponseWriter, r *http.Request, checksumConfig ChecksumConfig) {
+	if tusUploads == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用 tus 上传", nil, r.URL.Path)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		sendJSONResponse(w, http.StatusPreconditionFailed, "不支持的 Tus-Resumable 版本", nil, r.URL.Path)
+		return
+	}
+	// 不能发送 PATCH 和 DELETE 的环境中客户端通过 POST 和 X-HTTP-Method-Override 发送
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); method == http.MethodPost && override != "" {
+		method = strings.ToUpper(override)
+	}
+	id := tusUploadID(r)
+	switch {
+	case id == "" && method == http.MethodPost:
+		tusCreateHandler(w, r, checksumConfig)
+	case id != "" && method == http.MethodHead:
+		tusHeadHandler(w, r, id, checksumConfig)
+	case id != "" && method == http.MethodPatch:
+		tusPatchHandler(w, r, id, checksumConfig)
+	case id != "" && method == http.MethodDelete:
+		tusDeleteHandler(w, r, id)
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+	}
+}
+
+// tusCreateHandler 创建上传，在接收内容之前检查存储路径和大小，避免传完之后才被拒绝；
+// 请求体的内容类型为 application/offset+octet-stream 时为 creation-with-upload，同时写入第一部分内容
+func tusCreateHandler(w http.ResponseWriter, r *http.Request, checksumConfig ChecksumConfig) {
+	// 已接收的内容保存在本节点，其他节点无法继续
+	if cluster != nil {
+		sendJSONResponse(w, http.StatusNotImplemented, "集群模式下不支持 tus 上传", nil, r.URL.Path)
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		sendJSONResponse(w, http.StatusBadRequest, "不支持 Upload-Defer-Length，需要提供 Upload-Length", nil, r.URL.Path)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 Upload-Length", err, r.URL.Path)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 Upload-Metadata", err, r.URL.Path)
+		return
+	}
+	target := tusTargetPath(metadata)
+	if target == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少存储路径，Upload-Metadata 中需要 path 或 filename", nil, r.URL.Path)
+		return
+	}
+	if isReservedPath(target) || isUnsafePath(target) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的存储路径", nil, r.URL.Path)
+		return
+	}
+	key := indexKey(target)
+	// .part 文件按完成后的路径检查
+	final := partialUploads.Target(key)
+	if rejection := fileTypeFilter.CheckName(final); rejection != nil {
+		sendContentResponse(w, http.StatusUnsupportedMediaType, "不允许上传的文件类型", rejection, nil, r.URL.Path)
+		return
+	}
+	if !checkWORM(w, r, final) {
+		return
+	}
+	if limit := tusUploads.limits.uploadLimit(key); limit > 0 && length > limit {
+		sendJSONResponse(w, http.StatusRequestEntityTooLarge, "文件超过允许的大小", nil, r.URL.Path)
+		return
+	}
+	if !checkTusQuota(w, r, key, length) {
+		return
+	}
+	err = diskGuard.Check(length)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInsufficientStorage, "磁盘剩余空间不足", err, r.URL.Path)
+		return
+	}
+	delete(metadata, "path")
+	delete(metadata, "dir")
+
+	item, err := tusUploads.Create(TusUpload{Path: key, Length: length, Metadata: metadata, CreatedBy: identityName(r)})
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "创建上传失败", err, r.URL.Path)
+		return
+	}
+	slog.InfoContext(r.Context(), "已创建 tus 上传", "id", item.ID, "path", item.Path, "length", item.Length)
+	w.Header().Set("Location", "/tus/"+item.ID)
+
+	offset := int64(0)
+	if r.Header.Get("Content-Type") == tusContentType {
+		release, err := tusAcquire(w, r, item.ID)
+		if err != nil {
+			return
+		}
+		defer release()
+		item, offset, err = tusUploads.Append(item, 0, r.Body)
+		if err != nil {
+			// 已写入的部分保留，客户端通过 HEAD 查询偏移后继续
+			slog.WarnContext(r.Context(), "tus 上传中断", "id", item.ID, "offset", offset, "err", err)
+		}
+	}
+	if offset == item.Length {
+		tusComplete(w, r, item, http.StatusCreated, checksumConfig)
+		return
+	}
+	setTusHeaders(w, item, offset)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// checkTusQuota 在接收内容之前检查存储配额，超出时返回 507
+func checkTusQuota(w http.ResponseWriter, r *http.Request, key string, length int64) bool {
+	release, err := quotaTracker.Reserve(identityName(r), key, length)
+	if err != nil {
+		sendContentResponse(w, http.StatusInsufficientStorage, "超出存储配额", quotaTracker.Usage(identityName(r)), nil, r.URL.Path)
+		return false
+	}
+	release()
+	return true
+}
+
+// tusAcquire 取得上传的写入权，失败时返回响应
+func tusAcquire(w http.ResponseWriter, r *http.Request, id string) (func(), error) {
+	_, release, err := tusUploads.Acquire(id, identityName(r))
+	if err == errTusNotFound {
+		sendJSONResponse(w, http.StatusNotFound, "上传不存在、已完成或已过期", err, r.URL.Path)
+	} else if err == errTusBusy {
+		sendJSONResponse(w, http.StatusLocked, "该上传正在被其他请求写入，请稍后重试", err, r.URL.Path)
+	}
+	return release, err
+}
+
+// tusHeadHandler 返回上传已接收的字节数，客户端中断后据此继续；
+// 内容已经接收完、但上次保存因可以重试的原因失败时再次保存，成功之后才返回完整的偏移
+func tusHeadHandler(w http.ResponseWriter, r *http.Request, id string, checksumConfig ChecksumConfig) {
+	item, err := tusUploads.Get(id, identityName(r))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	offset, err := tusUploads.Offset(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Upload-Length", strconv.FormatInt(item.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if offset == item.Length {
+		release, err := tusAcquire(w, r, id)
+		if err != nil {
+			return
+		}
+		defer release()
+		tusComplete(w, r, item, http.StatusOK, checksumConfig)
+		return
+	}
+	setTusHeaders(w, item, offset)
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatchHandler 在 Upload-Offset 处追加内容，偏移与已接收的字节数不同时返回 409；
+// 接收满 Upload-Length 时保存文件，上次保存失败后重试时发送空的请求体即可
+func tusPatchHandler(w http.ResponseWriter, r *http.Request, id string, checksumConfig ChecksumConfig) {
+	if r.Header.Get("Content-Type") != tusContentType {
+		sendJSONResponse(w, http.StatusUnsupportedMediaType, "Content-Type 应为 "+tusContentType, nil, r.URL.Path)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 Upload-Offset", err, r.URL.Path)
+		return
+	}
+	release, err := tusAcquire(w, r, id)
+	if err != nil {
+		return
+	}
+	defer release()
+	item, err := tusUploads.Get(id, identityName(r))
+	if err != nil {
+		sendJSONResponse(w, http.StatusNotFound, "上传不存在、已完成或已过期", err, r.URL.Path)
+		return
+	}
+	current, err := tusUploads.Offset(id)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "读取上传失败", err, r.URL.Path)
+		return
+	}
+	if offset != current {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+		sendJSONResponse(w, http.StatusConflict, "Upload-Offset 与已接收的字节数不一致", nil, r.URL.Path)
+		return
+	}
+	if r.ContentLength > item.Length-offset {
+		sendJSONResponse(w, http.StatusRequestEntityTooLarge, "内容超过 Upload-Length", nil, r.URL.Path)
+		return
+	}
+	item, offset, err = tusUploads.Append(item, offset, r.Body)
+	if err != nil {
+		slog.WarnContext(r.Context(), "tus 上传中断", "id", id, "offset", offset, "err", err)
+		sendJSONResponse(w, http.StatusInternalServerError, "接收内容失败", err, r.URL.Path)
+		return
+	}
+	if offset == item.Length {
+		tusComplete(w, r, item, http.StatusNoContent, checksumConfig)
+		return
+	}
+	setTusHeaders(w, item, offset)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusDeleteHandler 取消上传并删除已接收的内容
+func tusDeleteHandler(w http.ResponseWriter, r *http.Request, id string) {
+	release, err := tusAcquire(w, r, id)
+	if err != nil {
+		return
+	}
+	defer release()
+	err = tusUploads.Remove(id, false)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "删除上传失败", err, r.URL.Path)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusResponseWriter 将保存成功的 JSON 响应改为 tus 的空响应，其他响应原样返回并记录状态码
+type tusResponseWriter struct {
+	http.ResponseWriter
+	item   TusUpload
+	status int
+	// code 为上传返回的状态码
+	code int
+}
+
+func (w *tusResponseWriter) WriteHeader(code int) {
+	w.code = code
+	if code != http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.Header().Del("Content-Type")
+	setTusHeaders(w.ResponseWriter, w.item, w.item.Length)
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *tusResponseWriter) Write(p []byte) (int, error) {
+	if w.code == http.StatusOK {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// tusRetryable 判断保存失败后能否重试：写入冲突、病毒扫描不可用、磁盘空间不足和读写错误可以重试，
+// 文件类型、一次写入、校验和等被拒绝的上传重试也不会通过
+func tusRetryable(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusLocked, http.StatusTooManyRequests:
+		return true
+	}
+	return code >= 500
+}
+
+// tusComplete 将接收完的内容与普通上传相同地保存，存储路径和校验和等请求头与 PUT 上传相同，
+// 自定义元数据取自 Upload-Metadata；保存成功时按 tus 返回 status。
+// 被拒绝时删除该上传，可以重试的失败保留已接收的内容，客户端再次发送 PATCH 或 HEAD 时重新保存
+func tusComplete(w http.ResponseWriter, r *http.Request, item TusUpload, status int, checksumConfig ChecksumConfig) {
+	file, err := os.Open(tusUploads.dataPath(item.ID))
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "读取上传失败", err, r.URL.Path)
+		return
+	}
+	upload := r.Clone(r.Context())
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	upload.Method = http.MethodPut
+	upload.Body = file
+	upload.ContentLength = item.Length
+	upload.Header.Set("X-FormFile-Path", item.Path)
+	for name := range upload.Header {
+		if strings.HasPrefix(name, "X-Meta-") {
+			upload.Header.Del(name)
+		}
+	}
+	for name, value := range item.Metadata {
+		upload.Header.Set("X-Meta-"+name, value)
+	}
+	response := &tusResponseWriter{ResponseWriter: w, item: item, status: status}
+	uploadHandler(response, upload, checksumConfig)
+
+	switch {
+	case response.code == http.StatusOK:
+		err = tusUploads.Remove(item.ID, true)
+	case tusRetryable(response.code):
+		slog.WarnContext(r.Context(), "保存 tus 上传失败，保留已接收的内容", "id", item.ID, "path", item.Path, "status", response.code)
+		return
+	default:
+		err = tusUploads.Remove(item.ID, false)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "删除 tus 上传失败", "id", item.ID, "err", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setupTusUploads 在临时目录中启用 tus 上传
+func setupTusUploads(t *testing.T) {
+	t.Helper()
+	setupDataRoot(t)
+	uploads, err := OpenTusUploads(filepath.Join("data", metaDirName, "tus"), filepath.Join("data", metaDirName, "tus.json"), UploadConfig{Tus: TusConfig{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := tusUploads
+	tusUploads = uploads
+	t.Cleanup(func() {
+		tusUploads = previous
+	})
+}
+
+// tusRequest 发送 tus 请求，body 不为空时作为 application/offset+octet-stream 内容
+func tusRequest(method string, target string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	if method == http.MethodPatch || body != "" {
+		r.Header.Set("Content-Type", tusContentType)
+	}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	tusHandler(w, r, ChecksumConfig{})
+	return w
+}
+
+// createTusUpload 创建上传并写入 first，返回上传地址
+func createTusUpload(t *testing.T, key string, length int, first string) string {
+	t.Helper()
+	w := tusRequest(http.MethodPost, "/tus/", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte(key)),
+	}, first)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /tus/ = %d, want %d: %s", w.Code, http.StatusCreated, w.Body.String())
+	}
+	if got := w.Header().Get("Upload-Offset"); got != strconv.Itoa(len(first)) {
+		t.Fatalf("POST /tus/ Upload-Offset = %q, want %d", got, len(first))
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/tus/") {
+		t.Fatalf("POST /tus/ Location = %q", location)
+	}
+	return location
+}
+
+func TestTusRoundTrip(t *testing.T) {
+	setupTusUploads(t)
+	location := createTusUpload(t, "docs/hello.txt", 11, "hello ")
+
+	w := tusRequest(http.MethodHead, location, nil, "")
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "6" || w.Header().Get("Upload-Length") != "11" {
+		t.Fatalf("HEAD = %d, Upload-Offset %q, Upload-Length %q", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	w = tusRequest(http.MethodPatch, location, map[string]string{"Upload-Offset": "0"}, "world")
+	if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("PATCH 偏移不一致 = %d, Upload-Offset %q, want %d", w.Code, w.Header().Get("Upload-Offset"), http.StatusConflict)
+	}
+	w = tusRequest(http.MethodPatch, location, map[string]string{"Upload-Offset": "6"}, "world")
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "11" {
+		t.Fatalf("PATCH = %d, Upload-Offset %q: %s", w.Code, w.Header().Get("Upload-Offset"), w.Body.String())
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("PATCH 响应体 = %q, want empty", w.Body.String())
+	}
+
+	content, err := os.ReadFile(filepath.Join("data", "docs", "hello.txt"))
+	if err != nil || string(content) != "hello world" {
+		t.Fatalf("保存的文件 = %q, %v", content, err)
+	}
+	w = tusRequest(http.MethodHead, location, nil, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("完成之后 HEAD = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestTusRejectedUploadIsRemoved(t *testing.T) {
+	setupTusUploads(t)
+	location := createTusUpload(t, "docs/bad.txt", 5, "")
+
+	w := tusRequest(http.MethodPatch, location, map[string]string{"Upload-Offset": "0", "X-Content-SHA256": strings.Repeat("0", 64)}, "hello")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("校验和不一致的 PATCH = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body.String())
+	}
+	w = tusRequest(http.MethodHead, location, nil, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("被拒绝之后 HEAD = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if _, err := os.Stat(filepath.Join("data", "docs", "bad.txt")); !os.IsNotExist(err) {
+		t.Errorf("被拒绝的文件已保存: %v", err)
+	}
+}
+
+func TestTusRetryableFailureKeepsUpload(t *testing.T) {
+	setupTusUploads(t)
+	previous := pathLocks
+	pathLocks = NewPathLocks(UploadConfig{ConcurrentWrites: concurrentWritesReject})
+	t.Cleanup(func() {
+		pathLocks = previous
+	})
+	location := createTusUpload(t, "docs/busy.txt", 5, "")
+
+	// 路径被其他写入占用时保存失败，已接收的内容保留
+	release, err := pathLocks.Lock(context.Background(), "docs/busy.txt", "上传", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := tusRequest(http.MethodPatch, location, map[string]string{"Upload-Offset": "0"}, "hello")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("路径被占用时 PATCH = %d, want %d: %s", w.Code, http.StatusConflict, w.Body.String())
+	}
+	release()
+
+	// 再次发送 HEAD 时重新保存
+	w = tusRequest(http.MethodHead, location, nil, "")
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("重试 HEAD = %d, Upload-Offset %q: %s", w.Code, w.Header().Get("Upload-Offset"), w.Body.String())
+	}
+	content, err := os.ReadFile(filepath.Join("data", "docs", "busy.txt"))
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("保存的文件 = %q, %v", content, err)
+	}
+	w = tusRequest(http.MethodHead, location, nil, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("完成之后 HEAD = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
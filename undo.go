@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UndoConfig 结构用于配置删除的撤销时间，/delete 立即返回，在撤销时间之后才执行，期间可以通过 /undo 撤销
+type UndoConfig struct {
+	// Window 删除在执行之前可以撤销的时间，单位分钟，默认 0 立即删除
+	Window int `json:"window"`
+}
+
+// PendingDelete 结构是一个等待执行的删除
+type PendingDelete struct {
+	// ID 用于撤销，列出时只返回给可以撤销该删除的调用方
+	ID          string    `json:"id,omitempty"`
+	Path        string    `json:"path"`
+	RequestedBy string    `json:"requested_by,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+	ExecuteAt   time.Time `json:"execute_at"`
+}
+
+var errUndoNotFound = errors.New("删除不存在或已执行")
+
+// DeferredDeletes 结构保存等待执行的删除，记录保存在 data/.meta 目录下，重启后继续等待
+type DeferredDeletes struct {
+	file   string
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*PendingDelete
+	// saveMu 保证记录按修改的顺序写入，较早的快照不会覆盖较新的
+	saveMu sync.Mutex
+	// executed 和 undone 为执行和撤销的删除数，用于监控指标
+	executed int64
+	undone   int64
+}
+
+// deferredDeletes 未配置撤销时间时为 nil，删除立即执行
+var deferredDeletes *DeferredDeletes
+
+// OpenDeferredDeletes 加载等待执行的删除，未配置撤销时间时返回 nil
+func OpenDeferredDeletes(file string, config UndoConfig) (*DeferredDeletes, error) {
+	if config.Window <= 0 {
+		return nil, nil
+	}
+	d := &DeferredDeletes{
+		file:    file,
+		window:  time.Duration(config.Window) * time.Minute,
+		pending: map[string]*PendingDelete{},
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &d.pending)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Schedule 登记路径的删除，同一路径已在等待时返回原来的记录，不推迟执行时间
+func (d *DeferredDeletes) Schedule(key string, requestedBy string) (PendingDelete, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return PendingDelete{}, err
+	}
+	now := time.Now()
+	item := PendingDelete{
+		ID:          hex.EncodeToString(id),
+		Path:        key,
+		RequestedBy: requestedBy,
+		RequestedAt: now,
+		ExecuteAt:   now.Add(d.window),
+	}
+	// 检查和登记在同一个临界区内，同时删除同一路径只登记一次
+	d.mu.Lock()
+	for _, existing := range d.pending {
+		if existing.Path == key {
+			d.mu.Unlock()
+			return *existing, nil
+		}
+	}
+	d.pending[item.ID] = &item
+	d.mu.Unlock()
+	return item, d.save()
+}
+
+// Get 返回等待执行的删除
+func (d *DeferredDeletes) Get(id string) (PendingDelete, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	item, ok := d.pending[id]
+	if !ok {
+		return PendingDelete{}, false
+	}
+	return *item, true
+}
+
+// Undo 撤销等待执行的删除
+func (d *DeferredDeletes) Undo(id string) (PendingDelete, error) {
+	d.mu.Lock()
+	item, ok := d.pending[id]
+	if ok {
+		delete(d.pending, id)
+		d.undone++
+	}
+	d.mu.Unlock()
+	if !ok {
+		return PendingDelete{}, errUndoNotFound
+	}
+	return *item, d.save()
+}
+
+// List 返回路径在 prefix 下的等待执行的删除，按执行时间排列
+func (d *DeferredDeletes) List(prefix string) []PendingDelete {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	items := []PendingDelete{}
+	for _, item := range d.pending {
+		if prefix == "" || item.Path == prefix || strings.HasPrefix(item.Path, prefix+"/") {
+			items = append(items, *item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ExecuteAt.Before(items[j].ExecuteAt)
+	})
+	return items
+}
+
+// save 保存等待执行的删除，同一时间只有一个保存，后开始的保存写入的是更新的内容
+func (d *DeferredDeletes) save() error {
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+	d.mu.Lock()
+	data, err := json.Marshal(d.pending)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(d.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := d.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, d.file)
+}
+
+// Run 每 10 秒执行到期的删除
+func (d *DeferredDeletes) Run() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		d.executeDue(time.Now())
+		<-ticker.C
+	}
+}
+
+// executeDue 执行到期的删除，执行失败的留到下一次
+func (d *DeferredDeletes) executeDue(now time.Time) {
+	var due []PendingDelete
+	d.mu.Lock()
+	for _, item := range d.pending {
+		if !now.Before(item.ExecuteAt) {
+			due = append(due, *item)
+		}
+	}
+	d.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+	for _, item := range due {
+		// 执行期间移出等待列表，撤销时返回已执行
+		d.mu.Lock()
+		_, ok := d.pending[item.ID]
+		delete(d.pending, item.ID)
+		d.mu.Unlock()
+		if !ok {
+			continue
+		}
+		done := d.execute(item)
+		d.mu.Lock()
+		if done {
+			d.executed++
+		} else {
+			d.pending[item.ID] = &item
+		}
+		d.mu.Unlock()
+	}
+	err := d.save()
+	if err != nil {
+		slog.Error("保存等待执行的删除失败", "err", err)
+	}
+}
+
+// execute 执行一个删除，返回是否可以移除该记录；删除请求之后被重新上传的文件不删除
+func (d *DeferredDeletes) execute(item PendingDelete) bool {
+	// 正在写入的路径留到下一次
+	release, err := pathLocks.Lock(context.Background(), item.Path, "执行延迟删除", false)
+	if err != nil {
+		return false
+	}
+	defer release()
+	if wormPolicy.Protected(item.Path) != nil {
+		slog.Warn("文件在保留期内，取消延迟删除", "path", item.Path, "id", item.ID)
+		return true
+	}
+	info, err := os.Stat(filepath.Join("data", filepath.FromSlash(item.Path)))
+	if os.IsNotExist(err) {
+		return true
+	} else if err != nil {
+		slog.Error("执行延迟删除失败", "path", item.Path, "err", err)
+		return false
+	}
+	if !info.IsDir() && info.ModTime().After(item.RequestedAt) {
+		slog.Info("文件在删除请求之后被修改，取消延迟删除", "path", item.Path, "id", item.ID)
+		return true
+	}
+	trashID, err := executeDelete(nil, item.Path, item.RequestedBy)
+	if err != nil {
+		slog.Error("执行延迟删除失败", "path", item.Path, "err", err)
+		return false
+	}
+	slog.Info("已执行延迟删除", "path", item.Path, "id", item.ID, "requested_by", item.RequestedBy, "trash_id", trashID)
+	return true
+}
+
+// writeMetrics 输出等待执行、已执行和已撤销的删除数
+func (d *DeferredDeletes) writeMetrics(w io.Writer) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(w, "# HELP store_deferred_deletes_pending Deletes waiting for the undo window to pass.\n")
+	fmt.Fprintf(w, "# TYPE store_deferred_deletes_pending gauge\n")
+	fmt.Fprintf(w, "store_deferred_deletes_pending %d\n", len(d.pending))
+	fmt.Fprintf(w, "# HELP store_deferred_deletes_total Deferred deletes by outcome.\n")
+	fmt.Fprintf(w, "# TYPE store_deferred_deletes_total counter\n")
+	fmt.Fprintf(w, "store_deferred_deletes_total{result=\"executed\"} %d\n", d.executed)
+	fmt.Fprintf(w, "store_deferred_deletes_total{result=\"undone\"} %d\n", d.undone)
+}
+
+// UndoRequest 结构用于撤销等待执行的删除
+type UndoRequest struct {
+	ID string `json:"id"`
+}
+
+// 列出等待执行的删除，只返回调用方可以读取的路径，撤销所需的 id 只返回给可以撤销的调用方
+func undoListHandler(w http.ResponseWriter, r *http.Request) {
+	if deferredDeletes == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未配置删除的撤销时间", nil, r.URL.Path)
+		return
+	}
+	identity := identityFrom(r)
+	canWrite := identity != nil && identity.HasScope(scopeWrite)
+	items := []PendingDelete{}
+	for _, item := range deferredDeletes.List(indexKey(r.URL.Query().Get("path"))) {
+		if !authorizePath(r, scopeRead, item.Path) {
+			continue
+		}
+		if !canWrite || !authorizePath(r, scopeWrite, item.Path) {
+			item.ID = ""
+		}
+		items = append(items, item)
+	}
+	sendContentResponse(w, http.StatusOK, "success", items, nil, r.URL.Path)
+}
+
+// 撤销等待执行的删除，调用方需要对被删除的路径有写权限
+func undoHandler(w http.ResponseWriter, r *http.Request) {
+	if deferredDeletes == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未配置删除的撤销时间", nil, r.URL.Path)
+		return
+	}
+	var request UndoRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.ID == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	pending, ok := deferredDeletes.Get(request.ID)
+	if !ok {
+		sendJSONResponse(w, http.StatusNotFound, "删除不存在或已执行", errUndoNotFound, r.URL.Path)
+		return
+	}
+	if !authorizePath(r, scopeWrite, pending.Path) {
+		sendJSONResponse(w, http.StatusForbidden, "无权撤销该删除", nil, r.URL.Path)
+		return
+	}
+	item, err := deferredDeletes.Undo(request.ID)
+	if err == errUndoNotFound {
+		sendJSONResponse(w, http.StatusNotFound, "删除不存在或已执行", err, r.URL.Path)
+		return
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "撤销失败", err, r.URL.Path)
+		return
+	}
+	slog.InfoContext(r.Context(), "已撤销删除", "path", item.Path, "id", item.ID)
+	sendContentResponse(w, http.StatusOK, "已撤销删除", item, nil, r.URL.Path)
+}
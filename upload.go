@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UploadConfig 结构用于配置上传文件的大小上限
+type UploadConfig struct {
+	// MaxSize 上传文件的大小上限，单位字节，0 表示不限制
+	MaxSize int64 `json:"max_size"`
+	// Rules 按存储路径前缀配置大小上限，匹配最长的前缀，优先于 MaxSize
+	Rules []UploadLimitRule `json:"rules"`
+	// Types 限制允许上传的文件类型
+	Types FileTypeConfig `json:"types"`
+	// Images 指定存放图片的目录，上传的文件必须是尺寸在上限之内的图片
+	Images []ImageUploadRule `json:"images"`
+	// Partial 为 .part 上传约定，写入 name.part 的文件完成之前不可见
+	Partial PartialConfig `json:"partial"`
+	// ConcurrentWrites 为同一路径已有写操作时上传的处理方式：wait（默认）排队依次执行，reject 返回 409
+	ConcurrentWrites string `json:"concurrent_writes"`
+	// LockTimeout 排队等待的最长时间，单位秒，默认 30，超时返回 409
+	LockTimeout int `json:"lock_timeout"`
+	// Tus 为 tus 断点续传协议，上传地址为 /tus/
+	Tus TusConfig `json:"tus"`
+}
+
+// UploadLimitRule 结构表示一条上传大小规则
+type UploadLimitRule struct {
+	// Prefix 路径前缀，按目录匹配，如 avatars 匹配 avatars/a.png，不匹配 avatars2/a.png
+	Prefix string `json:"prefix"`
+	// MaxSize 大小上限，单位字节，0 表示不限制
+	MaxSize int64 `json:"max_size"`
+}
+
+// PutUploadMiddleware 将 PUT /upload/<路径> 转换为 /upload 请求，请求体即为文件内容，供只能发送简单 PUT 请求的客户端使用；
+// 放在集群转发、审计日志等按 X-FormFile-Path 识别路径的处理之外，之后与普通上传相同
+func PutUploadMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || !strings.HasPrefix(r.URL.Path, "/upload/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set("X-FormFile-Path", strings.TrimPrefix(r.URL.Path, "/upload/"))
+		r.URL.Path = "/upload"
+		r.URL.RawPath = ""
+		next.ServeHTTP(w, r)
+	})
+}
+
+// multipartOverhead 是 multipart 的边界和表单头预留的空间
+const multipartOverhead = 64 << 10
+
+// uploadLimit 返回存储路径的上传大小上限，0 表示不限制，Rules 需要已按前缀长度从长到短排列
+func (c UploadConfig) uploadLimit(key string) int64 {
+	for _, rule := range c.Rules {
+		if rule.Prefix == "" || key == rule.Prefix || strings.HasPrefix(key, rule.Prefix+"/") {
+			return rule.MaxSize
+		}
+	}
+	return c.MaxSize
+}
+
+// sortedLimits 返回规则按前缀长度从长到短排列的配置，供 uploadLimit 使用
+func (c UploadConfig) sortedLimits() UploadConfig {
+	rules := make([]UploadLimitRule, 0, len(c.Rules))
+	for _, rule := range c.Rules {
+		rules = append(rules, UploadLimitRule{Prefix: indexKey(rule.Prefix), MaxSize: rule.MaxSize})
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+	c.Rules = rules
+	return c
+}
+
+// UploadLimitMiddleware 按存储路径限制上传请求体的大小，超过上限时返回 413，
+// 避免单个客户端占满磁盘或内存
+func UploadLimitMiddleware(next http.Handler, config UploadConfig) http.Handler {
+	config = config.sortedLimits()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := config.uploadLimit(indexKey(r.Header.Get("X-FormFile-Path")))
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// 请求头中声明的长度已经超过上限时不必读取请求体
+		if r.ContentLength > limit+multipartOverhead {
+			sendJSONResponse(w, http.StatusRequestEntityTooLarge, "文件超过允许的大小", nil, r.URL.Path)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit+multipartOverhead)
+		// 签名链接已经设置了更小的上限时以签名为准
+		if signed, ok := r.Context().Value(uploadLimitKey{}).(int64); ok && signed < limit {
+			limit = signed
+		}
+		ctx := context.WithValue(r.Context(), uploadLimitKey{}, limit)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UploadResult 结构用于返回上传成功后的文件信息
+type UploadResult struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5,omitempty"`
+	// ExpiresAt 为文件的过期时间，不过期时不返回
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Deduplicated 为 true 表示内容与已有文件相同，没有占用新的空间
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// ReusedBytes 为增量上传时从原文件复用的字节数
+	ReusedBytes int64 `json:"reused_bytes,omitempty"`
+	// Receipt 为签名的上传回执，启用上传回执并请求时返回
+	Receipt *UploadReceipt `json:"receipt,omitempty"`
+}
+
+// 获取上传的文件并存储
+func uploadHandler(w http.ResponseWriter, r *http.Request, checksumConfig ChecksumConfig) {
+	// 获取存储路径
+	path := r.Header.Get("X-FormFile-Path")
+	if path == "" {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少存储路径", nil, r.URL.Path)
+		return
+	}
+	if isReservedPath(path) || isUnsafePath(path) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的存储路径", nil, r.URL.Path)
+		return
+	}
+	// 按目录配置的命名策略决定保存的文件名，X-Naming-Strategy 可以指定其他策略；按内容哈希命名时接收文件之后才能确定
+	strategy := uploadNaming.Strategy(indexKey(path))
+	if requested := r.Header.Get("X-Naming-Strategy"); requested != "" {
+		if !validNamingStrategy(requested) {
+			sendJSONResponse(w, http.StatusBadRequest, "无效的 X-Naming-Strategy，应为 keep、uuid、timestamp 或 hash", nil, r.URL.Path)
+			return
+		}
+		strategy = requested
+	}
+	var err error
+	if strategy == namingUUID || strategy == namingTimestamp {
+		path, err = assignName(indexKey(path), strategy, time.Now(), "")
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "生成文件名失败", err, r.URL.Path)
+			return
+		}
+	}
+	// 超过文件系统限制的路径在接收文件之前拒绝
+	err = checkPathLength(indexKey(path))
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "存储路径过长", err, r.URL.Path)
+		return
+	}
+	// .part 文件和标记文件按完成后的路径检查
+	target := partialUploads.Target(indexKey(path))
+	// 不允许的扩展名在接收文件之前拒绝
+	if rejection := fileTypeFilter.CheckName(target); rejection != nil {
+		sendContentResponse(w, http.StatusUnsupportedMediaType, "不允许上传的文件类型", rejection, nil, r.URL.Path)
+		return
+	}
+	// 发布目录中的制品按坐标保存，已发布的版本不可覆盖
+	if !checkCatalogPublish(w, r, target) {
+		return
+	}
+	// 同一路径同时只有一个写操作，在接收文件之前按配置排队或拒绝
+	release := lockWritePath(w, r, indexKey(path), "上传", true)
+	if release == nil {
+		return
+	}
+	defer release()
+	// 一次写入的目录中已存在的文件不能覆盖
+	if !checkWORM(w, r, target) {
+		return
+	}
+
+	// X-Expire-After 设置文件的保留时间，过期后由后台任务删除
+	ttl, err := parseTTL(r.Header.Get("X-Expire-After"))
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 X-Expire-After", err, r.URL.Path)
+		return
+	}
+	// X-Storage-Class 设置文件的存储类型，未设置时使用默认类型
+	storageClass, err := storageClasses.ParseClass(r.Header.Get("X-Storage-Class"))
+	if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "无效的 X-Storage-Class", err, r.URL.Path)
+		return
+	}
+
+	// 先按请求长度检查剩余空间，避免写入一半时磁盘写满
+	err = diskGuard.Check(r.ContentLength)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInsufficientStorage, "磁盘剩余空间不足", err, r.URL.Path)
+		return
+	}
+
+	// 客户端提供的校验和
+	expectedSHA256 := strings.ToLower(r.Header.Get("X-Content-SHA256"))
+	expectedMD5 := strings.ToLower(r.Header.Get("X-Content-MD5"))
+
+	// 获取上传的文件，PUT 上传时请求体即为文件内容
+	var file io.ReadCloser = r.Body
+	var maxBytesErr *http.MaxBytesError
+	if r.Method != http.MethodPut {
+		file, _, err = r.FormFile("file")
+	}
+	if errors.As(err, &maxBytesErr) {
+		sendJSONResponse(w, http.StatusRequestEntityTooLarge, "文件超过允许的大小", err, r.URL.Path)
+		return
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusBadRequest, "接收文件失败", err, "")
+		return
+	}
+	defer func(file io.ReadCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "closing file", "err", err)
+		}
+	}(file)
+	debugStage(r, "parse")
+
+	// 根据文件名生成存储路径，目录在校验通过、保存文件之前才创建，被拒绝的上传不会留下空目录
+	newFilePath := filepath.Join("data", filepath.Dir(path), filepath.Base(path))
+
+	// 先写入临时文件，校验通过后再移动到目标位置，避免覆盖原文件后才发现内容有误
+	tmpFile, tmpPath, err := createTempDataFile(target, identityName(r))
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "创建文件失败", err, r.URL.Path)
+		return
+	}
+	defer func(tmpPath string) {
+		// 成功时临时文件已被重命名，这里只清理失败留下的文件
+		err := os.Remove(tmpPath)
+		if err != nil && !os.IsNotExist(err) {
+			slog.ErrorContext(r.Context(), "清理临时文件失败", "err", err)
+		}
+	}(tmpPath)
+
+	// 将上传的文件内容复制到临时文件，同时计算校验和
+	sha256Hash := sha256.New()
+	writers := []io.Writer{tmpFile, sha256Hash}
+	var md5Hash hash.Hash
+	if checksumConfig.MD5 || expectedMD5 != "" {
+		md5Hash = md5.New()
+		writers = append(writers, md5Hash)
+	}
+	// 配置了大小上限或通过签名链接上传时限制文件大小
+	var src io.Reader = file
+	limit, limited := r.Context().Value(uploadLimitKey{}).(int64)
+	if limited {
+		src = io.LimitReader(file, limit+1)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), src)
+	if errors.As(err, &maxBytesErr) {
+		_ = tmpFile.Close()
+		sendJSONResponse(w, http.StatusRequestEntityTooLarge, "文件超过允许的大小", err, r.URL.Path)
+		return
+	} else if err != nil {
+		_ = tmpFile.Close()
+		sendJSONResponse(w, http.StatusInternalServerError, "文件复制失败", err, r.URL.Path)
+		return
+	}
+	if limited && size > limit {
+		_ = tmpFile.Close()
+		sendJSONResponse(w, http.StatusRequestEntityTooLarge, "文件超过允许的大小", nil, r.URL.Path)
+		return
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "文件复制失败", err, r.URL.Path)
+		return
+	}
+
+	debugStage(r, "receive")
+
+	result := UploadResult{
+		Path:   indexKey(path),
+		Size:   size,
+		SHA256: hex.EncodeToString(sha256Hash.Sum(nil)),
+	}
+	if md5Hash != nil {
+		result.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	}
+
+	// 校验客户端提供的校验和
+	if expectedSHA256 != "" && expectedSHA256 != result.SHA256 {
+		sendContentResponse(w, http.StatusBadRequest, "SHA-256 校验失败", result, nil, r.URL.Path)
+		return
+	}
+	if expectedMD5 != "" && expectedMD5 != result.MD5 {
+		sendContentResponse(w, http.StatusBadRequest, "MD5 校验失败", result, nil, r.URL.Path)
+		return
+	}
+
+	// 按内容哈希命名时接收文件之后才确定路径，内容相同的文件已存在时不重复保存
+	if strategy == namingHash {
+		key, _ := assignName(indexKey(path), namingHash, time.Time{}, result.SHA256)
+		err = checkPathLength(key)
+		if err != nil {
+			sendJSONResponse(w, http.StatusBadRequest, "存储路径过长", err, r.URL.Path)
+			return
+		}
+		if key != indexKey(path) {
+			release := lockWritePath(w, r, key, "上传", true)
+			if release == nil {
+				return
+			}
+			defer release()
+		}
+		result.Path = key
+		newFilePath = filepath.Join("data", key)
+		if existing, err := fileChecksum(newFilePath, false); err == nil && existing.SHA256 == result.SHA256 {
+			if receiptSigner.Wanted(r) {
+				result.Receipt = receiptSigner.Sign(key, result.Size, result.SHA256, time.Now())
+			}
+			sendContentResponse(w, http.StatusOK, "内容相同的文件已存在", result, nil, r.URL.Path)
+			return
+		}
+		if !checkWORM(w, r, key) {
+			return
+		}
+	}
+
+	// 启用 .part 约定时暂存 name.part，上传空的标记文件时完成对应的暂存文件
+	if partialUploads.Staged(result.Path) {
+		stagePartialUpload(w, r, tmpPath, result)
+		return
+	}
+	if part, ok := partialUploads.Marker(result.Path); ok && result.Size == 0 {
+		release := lockWritePath(w, r, part, "完成上传", true)
+		if release == nil {
+			return
+		}
+		defer release()
+		finalizePartialUpload(w, r, part, ttl, storageClass)
+		return
+	}
+
+	storeUploadedFile(w, r, tmpPath, newFilePath, result, ttl, storageClass)
+}
+
+// storeUploadedFile 将已写完并通过校验和检查的临时文件保存到 newFilePath，扫描病毒、检查配额并保留历史版本，
+// 之后更新索引等记录并返回上传结果；普通上传和增量上传共用
+func storeUploadedFile(w http.ResponseWriter, r *http.Request, tmpPath string, newFilePath string, result UploadResult, ttl time.Duration, storageClass string) {
+	// 检查文件类型，扩展名和嗅探到的内容类型都需要允许
+	rejection := fileTypeFilter.CheckName(result.Path)
+	if rejection == nil {
+		var err error
+		rejection, err = fileTypeFilter.CheckContent(result.Path, tmpPath)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "检查文件类型失败", err, r.URL.Path)
+			return
+		}
+	}
+	if rejection != nil {
+		sendContentResponse(w, http.StatusUnsupportedMediaType, "不允许上传的文件类型", rejection, nil, r.URL.Path)
+		return
+	}
+	// 图片目录中的文件必须是可以解码的图片，并且尺寸不超过上限
+	imageRejection, err := imageUploadValidator.Check(result.Path, tmpPath)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "检查图片失败", err, r.URL.Path)
+		return
+	}
+	if imageRejection != nil {
+		code, msg := http.StatusUnsupportedMediaType, "不是允许上传的图片"
+		if imageRejection.Reason == "dimensions" || imageRejection.Reason == "pixels" {
+			code, msg = http.StatusUnprocessableEntity, "图片尺寸超过上限"
+		}
+		sendContentResponse(w, code, msg, imageRejection, nil, r.URL.Path)
+		return
+	}
+
+	// 扫描病毒，相同内容在病毒库未更新时复用之前的结果
+	verdict, err := virusScanner.ScanFile(tmpPath, result.SHA256)
+	if err != nil {
+		sendJSONResponse(w, http.StatusServiceUnavailable, "病毒扫描失败，请稍后重试", err, r.URL.Path)
+		return
+	}
+	if virusScanner != nil {
+		debugCache(r, "virus_scan", verdict.Cached)
+		debugStage(r, "scan")
+	}
+	if !verdict.Clean {
+		// 被拦截的文件移入隔离目录，不会出现在 data 目录中
+		verdict.QuarantineID, err = virusScanner.Quarantine(r, tmpPath, result, verdict.Signature)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "隔离文件失败，已直接删除", "err", err)
+		}
+		sendContentResponse(w, http.StatusUnprocessableEntity, "文件包含病毒", verdict, nil, r.URL.Path)
+		return
+	}
+
+	// 检查存储配额，写入索引之前预留本次上传的大小
+	key := result.Path
+	release, err := quotaTracker.Reserve(identityName(r), key, result.Size)
+	if err != nil {
+		sendContentResponse(w, http.StatusInsufficientStorage, "超出存储配额", quotaTracker.Usage(identityName(r)), nil, r.URL.Path)
+		return
+	}
+	defer release()
+
+	// 提交上传期间持有写操作的读锁，备份快照中的文件与索引一致
+	defer maintenanceGate.HoldWrites()()
+
+	changeType := changeModified
+	if _, err := os.Stat(newFilePath); os.IsNotExist(err) {
+		changeType = changeCreated
+	}
+
+	err = os.MkdirAll(filepath.Dir(newFilePath), os.ModePerm)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "创建目录失败", err, r.URL.Path)
+		return
+	}
+
+	// 启用历史版本时覆盖之前先保留当前内容
+	if featureFlags.Enabled(featureVersioning, key, identityName(r)) {
+		_, err = versioning.Keep(key)
+		if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "保存历史版本失败", err, r.URL.Path)
+			return
+		}
+	}
+
+	dedup := featureFlags.Enabled(featureDedup, key, identityName(r))
+	result.Deduplicated, err = placeDataFile(tmpPath, result.SHA256, newFilePath, dedup)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "创建文件失败", err, r.URL.Path)
+		return
+	}
+	if result.Deduplicated {
+		debugPath(r, "dedup", newFilePath)
+	} else {
+		debugPath(r, "data", newFilePath)
+	}
+	debugStage(r, "store")
+
+	// 双写迁移期间同时写入旧后端，以新后端为准，旧后端写入失败只记录日志
+	err = migration.Mirror(key, newFilePath)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "写入旧后端失败", "key", key, "err", err)
+	}
+
+	// 覆盖上传时未带 X-Expire-After 会清除之前设置的过期时间
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	fileExpiry.Set(key, expiresAt)
+	if info, err := os.Stat(newFilePath); err == nil {
+		if expiresAt := fileExpiry.ExpiresAt(key, info.ModTime()); !expiresAt.IsZero() {
+			result.ExpiresAt = &expiresAt
+		}
+	}
+
+	// 更新索引
+	refreshIndexPath(key)
+	metaIndex.Update(key, func(meta *FileMeta) {
+		meta.SHA256 = result.SHA256
+		meta.Uploader = identityName(r)
+		meta.Metadata = uploadMetadata(r.Header)
+		meta.StorageClass = storageClass
+	})
+	err = contentIndex.IndexFile(key, newFilePath)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "索引文件内容失败", "err", err)
+	}
+	// 按存储类型在后台移动文件和同步副本
+	storageClasses.Enqueue(key)
+	replicator.Put(r, key)
+	s3Mirror.Put(key)
+	source := "upload"
+	if r.URL.Path == "/delta/apply" {
+		source = "delta"
+	}
+	webhooks.Emit(r, WebhookEvent{Event: webhookUpload, Path: key, Source: source, Size: result.Size, SHA256: result.SHA256})
+	changeFeed.Publish(r, ChangeEvent{Type: changeType, Path: key, Source: source, Size: result.Size})
+	eventBus.Publish(r, BusEvent{Type: changeType, Path: key, Source: source, Size: result.Size, SHA256: result.SHA256})
+
+	if receiptSigner.Wanted(r) {
+		result.Receipt = receiptSigner.Sign(key, result.Size, result.SHA256, time.Now())
+	}
+	debugStage(r, "index")
+
+	sendContentResponse(w, http.StatusOK, "文件上传成功", result, nil, r.URL.Path)
+}
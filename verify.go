@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// VerifyConfig 结构用于配置读取时校验，从备份恢复后开启，每个文件在返回之前与索引中记录的 SHA-256 比较
+type VerifyConfig struct {
+	Enabled bool `json:"enabled"`
+	// Strict 为 true 时拒绝返回索引中没有哈希的文件，默认 false 时照常返回
+	Strict bool `json:"strict"`
+	// CacheSize 缓存的校验结果数量，文件大小和修改时间不变时复用，默认 100000
+	CacheSize int `json:"cache_size"`
+}
+
+var (
+	errVerifyMismatch  = errors.New("文件内容与索引中的 SHA-256 不一致")
+	errVerifyNoCatalog = errors.New("索引中没有文件的 SHA-256")
+)
+
+// verifyResult 是缓存的校验结果
+type verifyResult struct {
+	size    int64
+	modTime time.Time
+	err     error
+}
+
+// ReadVerifier 结构用于在返回文件之前校验文件内容
+type ReadVerifier struct {
+	config VerifyConfig
+
+	mu    sync.Mutex
+	cache map[string]verifyResult
+}
+
+// readVerifier 未启用读取时校验时为 nil
+var readVerifier *ReadVerifier
+
+// NewReadVerifier 创建读取时校验
+func NewReadVerifier(config VerifyConfig) *ReadVerifier {
+	if config.CacheSize <= 0 {
+		config.CacheSize = 100000
+	}
+	return &ReadVerifier{config: config, cache: map[string]verifyResult{}}
+}
+
+// Verify 校验文件内容与索引中的哈希是否一致，校验结果按文件大小和修改时间缓存
+func (v *ReadVerifier) Verify(key string, fullPath string, fileInfo os.FileInfo) error {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	cached, ok := v.cache[key]
+	v.mu.Unlock()
+	if ok && cached.size == fileInfo.Size() && cached.modTime.Equal(fileInfo.ModTime()) {
+		return cached.err
+	}
+
+	meta, ok := metaIndex.Get(key)
+	if !ok || meta.SHA256 == "" {
+		if v.config.Strict {
+			return errVerifyNoCatalog
+		}
+		return nil
+	}
+	var err error
+	if meta.Size != fileInfo.Size() {
+		err = errVerifyMismatch
+	} else {
+		result, checksumErr := fileChecksum(fullPath, false)
+		if checksumErr != nil {
+			// 读取失败可能是暂时的，不缓存
+			return checksumErr
+		}
+		if result.SHA256 != meta.SHA256 {
+			err = errVerifyMismatch
+		}
+	}
+	if err != nil {
+		slog.Error("校验失败", "key", key, "err", err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// 缓存已满时随机淘汰一条
+	if len(v.cache) >= v.config.CacheSize {
+		for k := range v.cache {
+			delete(v.cache, k)
+			break
+		}
+	}
+	v.cache[key] = verifyResult{size: fileInfo.Size(), modTime: fileInfo.ModTime(), err: err}
+	return err
+}
+
+// verifyServedFile 在返回文件之前校验内容，校验失败时返回错误响应并返回 false
+func verifyServedFile(w http.ResponseWriter, r *http.Request, key string, fullPath string, fileInfo os.FileInfo) bool {
+	err := readVerifier.Verify(key, fullPath, fileInfo)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errVerifyMismatch):
+		sendJSONResponse(w, http.StatusInternalServerError, "文件内容校验失败", err, r.URL.Path)
+	case errors.Is(err, errVerifyNoCatalog):
+		sendJSONResponse(w, http.StatusServiceUnavailable, "文件尚未校验，暂时无法下载", err, r.URL.Path)
+	default:
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+	}
+	return false
+}
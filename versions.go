@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// versionsDirName 是 data 目录下保存历史版本的目录名
+const versionsDirName = ".versions"
+
+// VersioningConfig 结构用于配置覆盖上传时保留历史版本
+type VersioningConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxVersions 每个文件最多保留的历史版本数，超过时删除最旧的版本，默认 10
+	MaxVersions int `json:"max_versions"`
+}
+
+// FileVersion 结构表示文件的一个历史版本
+type FileVersion struct {
+	Version int       `json:"version"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+var errVersionNotFound = errors.New("历史版本不存在")
+
+// Versioning 结构用于管理历史版本，文件 key 的第 n 个版本保存在 data/.versions/<key>@v<n>
+type Versioning struct {
+	maxVersions int
+
+	// mu 保证同时覆盖同一个文件时版本号不重复
+	mu sync.Mutex
+}
+
+// versioning 未启用历史版本时为 nil
+var versioning *Versioning
+
+// NewVersioning 创建历史版本管理
+func NewVersioning(config VersioningConfig) *Versioning {
+	if config.MaxVersions <= 0 {
+		config.MaxVersions = 10
+	}
+	return &Versioning{maxVersions: config.MaxVersions}
+}
+
+// versionPath 返回文件第 n 个版本的完整路径
+func versionPath(key string, n int) string {
+	return filepath.Join("data", versionsDirName, filepath.FromSlash(key)+"@v"+strconv.Itoa(n))
+}
+
+// versionNumbers 返回文件已有的版本号，从小到大排列
+func versionNumbers(key string) ([]int, error) {
+	dir := filepath.Dir(versionPath(key, 0))
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	prefix := path.Base(key) + "@v"
+	var numbers []int
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), prefix))
+		if err != nil || n <= 0 {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// Keep 将文件的当前内容保存为新的历史版本，文件不存在时不做任何处理，返回新的版本号
+func (v *Versioning) Keep(key string) (int, error) {
+	if v == nil {
+		return 0, nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fullPath := filepath.Join("data", filepath.FromSlash(key))
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if info.IsDir() {
+		return 0, nil
+	}
+
+	numbers, err := versionNumbers(key)
+	if err != nil {
+		return 0, err
+	}
+	next := 1
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	}
+	target := versionPath(key, next)
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+	// 覆盖上传通过重命名替换文件，硬链接保留的旧内容不会被修改，不需要复制
+	err = os.Link(fullPath, target)
+	if err != nil {
+		return 0, err
+	}
+
+	// 删除超出数量的最旧版本
+	numbers = append(numbers, next)
+	for len(numbers) > v.maxVersions {
+		err = os.Remove(versionPath(key, numbers[0]))
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("删除历史版本失败", "key", key, "err", err)
+		}
+		numbers = numbers[1:]
+	}
+	return next, nil
+}
+
+// List 返回文件的历史版本，从新到旧排列
+func (v *Versioning) List(key string) ([]FileVersion, error) {
+	numbers, err := versionNumbers(key)
+	if err != nil {
+		return nil, err
+	}
+	versions := []FileVersion{}
+	for i := len(numbers) - 1; i >= 0; i-- {
+		info, err := os.Stat(versionPath(key, numbers[i]))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, FileVersion{Version: numbers[i], Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return versions, nil
+}
+
+// Rollback 将文件恢复为第 n 个版本，当前内容先保存为新的历史版本，返回恢复后文件的校验和；tenant 为执行恢复的调用方
+func (v *Versioning) Rollback(key string, n int, tenant string) (ChecksumResult, error) {
+	src, err := openDataFile(versionPath(key, n))
+	if os.IsNotExist(err) {
+		return ChecksumResult{}, errVersionNotFound
+	} else if err != nil {
+		return ChecksumResult{}, err
+	}
+	defer func(src io.ReadSeekCloser) {
+		err := src.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(src)
+
+	// 先复制到临时文件，历史版本与当前文件是硬链接，不能直接重命名
+	tmpFile, tmpPath, err := createTempDataFile(key, tenant)
+	if err != nil {
+		return ChecksumResult{}, err
+	}
+	_, err = io.Copy(tmpFile, src)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return ChecksumResult{}, err
+	}
+	result, err := fileChecksum(tmpPath, false)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return ChecksumResult{}, err
+	}
+
+	fullPath := filepath.Join("data", filepath.FromSlash(key))
+	err = os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+	if err == nil {
+		_, err = v.Keep(key)
+	}
+	if err == nil {
+		_, err = placeDataFile(tmpPath, result.SHA256, fullPath, featureFlags.Enabled(featureDedup, key, tenant))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return ChecksumResult{}, err
+	}
+	return result, nil
+}
+
+// serveFileVersion 返回文件的历史版本，版本号无效或不存在时返回 404
+func serveFileVersion(w http.ResponseWriter, r *http.Request, key string, version string) {
+	n, err := strconv.Atoi(version)
+	if err != nil || n <= 0 || versioning == nil {
+		sendJSONResponse(w, http.StatusNotFound, "历史版本不存在", err, r.URL.Path)
+		return
+	}
+	fullPath := versionPath(key, n)
+	fileInfo, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			sendJSONResponse(w, http.StatusNotFound, "历史版本不存在", err, r.URL.Path)
+			return
+		}
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+
+	file, err := openDataFile(fullPath)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "closing file", "err", err)
+		}
+	}(file)
+
+	// 历史版本不在索引中，使用按大小和修改时间生成的弱 ETag
+	name := path.Base(key)
+	contentType, err := detectMimeType(name, file)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "1" || isActiveContent(contentType) {
+		disposition = "attachment"
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, fileInfo.Size(), fileInfo.ModTime().UnixNano()))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, name))
+	w.Header().Set("X-File-Version", strconv.Itoa(n))
+	sw := newStatusWriter(w, 0)
+	http.ServeContent(sw, r, name, fileInfo.ModTime(), file)
+	egressAccounting.Record(r, sw.bytes)
+}
+
+// 列出文件的历史版本
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	if versioning == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用历史版本", nil, r.URL.Path)
+		return
+	}
+	key := indexKey(r.URL.Query().Get("path"))
+	if key == "" || isReservedPath(key) || isUnsafePath(r.URL.Query().Get("path")) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的路径参数", nil, r.URL.Path)
+		return
+	}
+	versions, err := versioning.List(key)
+	if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "服务器错误，请稍后重试", err, r.URL.Path)
+		return
+	}
+	sendContentResponse(w, http.StatusOK, "success", versions, nil, r.URL.Path)
+}
+
+// RollbackRequest 结构用于将文件恢复为历史版本
+type RollbackRequest struct {
+	Path    string `json:"path"`
+	Version int    `json:"version"`
+}
+
+// 将文件恢复为历史版本
+func versionRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if versioning == nil {
+		sendJSONResponse(w, http.StatusNotFound, "未启用历史版本", nil, r.URL.Path)
+		return
+	}
+	var request RollbackRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Path == "" || request.Version <= 0 {
+		sendJSONResponse(w, http.StatusBadRequest, "缺少必要参数", err, r.URL.Path)
+		return
+	}
+	key := indexKey(request.Path)
+	if key == "" || isReservedPath(key) || isUnsafePath(request.Path) {
+		sendJSONResponse(w, http.StatusBadRequest, "非法的路径参数", nil, r.URL.Path)
+		return
+	}
+
+	release := lockWritePath(w, r, key, "恢复历史版本", false)
+	if release == nil {
+		return
+	}
+	defer release()
+	if !checkWORM(w, r, key) {
+		return
+	}
+
+	changeType := changeModified
+	if _, err := os.Stat(filepath.Join("data", filepath.FromSlash(key))); os.IsNotExist(err) {
+		changeType = changeCreated
+	}
+	result, err := versioning.Rollback(key, request.Version, identityName(r))
+	if err == errVersionNotFound {
+		sendJSONResponse(w, http.StatusNotFound, "历史版本不存在", err, r.URL.Path)
+		return
+	} else if err != nil {
+		sendJSONResponse(w, http.StatusInternalServerError, "恢复历史版本失败", err, r.URL.Path)
+		return
+	}
+	result.Path = key
+
+	// 更新索引
+	refreshIndexPath(key)
+	metaIndex.Update(key, func(meta *FileMeta) {
+		meta.SHA256 = result.SHA256
+	})
+	err = contentIndex.IndexFile(key, filepath.Join("data", filepath.FromSlash(key)))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "索引文件内容失败", "err", err)
+	}
+	removeThumbnails(key)
+	replicator.Put(r, key)
+	s3Mirror.Put(key)
+	webhooks.Emit(r, WebhookEvent{Event: webhookUpload, Path: key, Source: "rollback", SHA256: result.SHA256})
+	changeFeed.Publish(r, ChangeEvent{Type: changeType, Path: key, Source: "rollback"})
+	eventBus.Publish(r, BusEvent{Type: changeType, Path: key, Source: "rollback", SHA256: result.SHA256})
+	sendContentResponse(w, http.StatusOK, "已恢复历史版本", result, nil, r.URL.Path)
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// VirusScanConfig 结构用于配置上传文件的病毒扫描
+type VirusScanConfig struct {
+	Enabled bool `json:"enabled"`
+	// ClamdAddress clamd 的地址，如 127.0.0.1:3310，以 unix: 开头时使用 unix socket
+	ClamdAddress string `json:"clamd_address"`
+	// TimeoutSeconds 单次扫描的超时时间，默认 60 秒
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// FailOpen 为 true 时 clamd 不可用也允许上传，默认拒绝
+	FailOpen bool `json:"fail_open"`
+	// CacheSize 按内容哈希缓存的扫描结果数量，默认 10000，小于 0 时不缓存
+	CacheSize int `json:"cache_size"`
+	// QuarantineDir 保存被拦截文件的隔离目录，默认为 data 目录之外的 quarantine 目录，隔离的文件不会被下载或列出
+	QuarantineDir string `json:"quarantine_dir"`
+	// QuarantineDays 隔离文件的保留天数，默认 30，小于 0 时不隔离，被拦截的文件直接删除
+	QuarantineDays int `json:"quarantine_days"`
+}
+
+// ScanVerdict 结构表示一次扫描的结果
+type ScanVerdict struct {
+	Clean     bool   `json:"clean"`
+	Signature string `json:"signature,omitempty"`
+	// Cached 表示结果来自缓存，没有重新扫描
+	Cached bool `json:"cached,omitempty"`
+	// QuarantineID 为被拦截的文件在隔离目录中的 ID
+	QuarantineID string `json:"quarantine_id,omitempty"`
+}
+
+// VirusScanner 结构用于通过 clamd 扫描文件，并按内容哈希缓存结果
+type VirusScanner struct {
+	config  VirusScanConfig
+	timeout time.Duration
+
+	mu sync.Mutex
+	// version 是 clamd 病毒库的版本，版本变化后缓存的结果全部失效
+	version string
+	// checked 是上次查询病毒库版本的时间
+	checked time.Time
+	cache   map[string]ScanVerdict
+}
+
+// virusScanner 扫描上传的文件，未启用时不扫描
+var virusScanner *VirusScanner
+
+// NewVirusScanner 创建病毒扫描器
+func NewVirusScanner(config VirusScanConfig) (*VirusScanner, error) {
+	if config.ClamdAddress == "" {
+		return nil, fmt.Errorf("缺少 clamd_address")
+	}
+	if config.CacheSize == 0 {
+		config.CacheSize = 10000
+	}
+	if config.QuarantineDir == "" {
+		config.QuarantineDir = "quarantine"
+	}
+	if config.QuarantineDays == 0 {
+		config.QuarantineDays = 30
+	}
+	if config.QuarantineDays > 0 && inDataDir(config.QuarantineDir) {
+		return nil, fmt.Errorf("quarantine_dir 不能在 data 目录中")
+	}
+	timeout := time.Duration(config.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	return &VirusScanner{
+		config:  config,
+		timeout: timeout,
+		cache:   make(map[string]ScanVerdict),
+	}, nil
+}
+
+// ScanFile 扫描文件，sha256 相同的内容在病毒库未更新时直接返回缓存的结果。
+// 未启用扫描时总是返回干净；clamd 不可用时按 fail_open 决定是否放行
+func (s *VirusScanner) ScanFile(path string, sha256 string) (ScanVerdict, error) {
+	if s == nil {
+		return ScanVerdict{Clean: true}, nil
+	}
+
+	version := s.databaseVersion()
+	if verdict, ok := s.cached(sha256, version); ok {
+		verdict.Cached = true
+		return verdict, nil
+	}
+
+	verdict, err := s.scan(path)
+	if err != nil {
+		if s.config.FailOpen {
+			slog.Error("病毒扫描失败，按配置放行", "err", err)
+			return ScanVerdict{Clean: true}, nil
+		}
+		return verdict, err
+	}
+	// 无法获取病毒库版本时不缓存，避免病毒库更新后仍使用旧结果
+	if version != "" {
+		s.store(sha256, version, verdict)
+	}
+	return verdict, nil
+}
+
+// cached 获取缓存的扫描结果
+func (s *VirusScanner) cached(sha256 string, version string) (ScanVerdict, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version == "" || version != s.version {
+		return ScanVerdict{}, false
+	}
+	verdict, ok := s.cache[sha256]
+	return verdict, ok
+}
+
+// store 缓存扫描结果，病毒库版本变化时清空缓存
+func (s *VirusScanner) store(sha256 string, version string, verdict ScanVerdict) {
+	if s.config.CacheSize < 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version != s.version {
+		s.version = version
+		s.cache = make(map[string]ScanVerdict)
+	}
+	// 缓存满时整体清空，重复上传的内容很快会重新进入缓存
+	if len(s.cache) >= s.config.CacheSize {
+		s.cache = make(map[string]ScanVerdict)
+	}
+	s.cache[sha256] = verdict
+}
+
+// databaseVersion 获取 clamd 病毒库版本，每分钟最多查询一次
+func (s *VirusScanner) databaseVersion() string {
+	s.mu.Lock()
+	if time.Since(s.checked) < time.Minute {
+		version := s.version
+		s.mu.Unlock()
+		return version
+	}
+	s.mu.Unlock()
+
+	reply, err := s.command("zVERSION\x00", nil)
+	if err != nil {
+		slog.Error("获取病毒库版本失败", "err", err)
+		return ""
+	}
+	// 格式为 ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024，病毒库版本为中间部分
+	parts := strings.Split(reply, "/")
+	version := reply
+	if len(parts) >= 2 {
+		version = parts[1]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version != s.version {
+		if s.version != "" {
+			slog.Info("病毒库已更新，清空扫描结果缓存", "from", s.version, "to", version)
+		}
+		s.version = version
+		s.cache = make(map[string]ScanVerdict)
+	}
+	s.checked = time.Now()
+	return version
+}
+
+// scan 使用 INSTREAM 命令将文件内容发送给 clamd 扫描
+func (s *VirusScanner) scan(path string) (ScanVerdict, error) {
+	file, err := openDataFile(path)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	defer func(file io.ReadSeekCloser) {
+		err := file.Close()
+		if err != nil {
+			slog.Error("closing file", "err", err)
+		}
+	}(file)
+
+	reply, err := s.command("zINSTREAM\x00", file)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	// 回复格式为 stream: OK 或 stream: <病毒名> FOUND
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanVerdict{Clean: true}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanVerdict{Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return ScanVerdict{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// command 向 clamd 发送命令，body 不为空时按 INSTREAM 格式分块发送，返回去掉结尾 \0 的回复
+func (s *VirusScanner) command(command string, body io.Reader) (string, error) {
+	network, address := "tcp", s.config.ClamdAddress
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	conn, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			slog.Error("closing clamd connection", "err", err)
+		}
+	}(conn)
+	err = conn.SetDeadline(time.Now().Add(s.timeout))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.WriteString(conn, command)
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		buf := make([]byte, 64<<10)
+		var size [4]byte
+		for {
+			n, readErr := body.Read(buf)
+			if n > 0 {
+				binary.BigEndian.PutUint32(size[:], uint32(n))
+				_, err = conn.Write(size[:])
+				if err == nil {
+					_, err = conn.Write(buf[:n])
+				}
+				if err != nil {
+					return "", err
+				}
+			}
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				return "", readErr
+			}
+		}
+		binary.BigEndian.PutUint32(size[:], 0)
+		_, err = conn.Write(size[:])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+// QuarantineEntry 结构是被隔离文件的记录，与文件一起保存在隔离目录中
+type QuarantineEntry struct {
+	ID string `json:"id"`
+	// Path 为上传时的存储路径
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Signature string    `json:"signature"`
+	Actor     string    `json:"actor,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// quarantineIDPattern 限制隔离 ID 的格式，避免通过 ID 访问隔离目录之外的文件
+var quarantineIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Quarantine 将被拦截的临时文件移动到隔离目录并记录来源，返回隔离 ID；未启用隔离时返回空
+func (s *VirusScanner) Quarantine(r *http.Request, tmpPath string, result UploadResult, signature string) (string, error) {
+	if s.config.QuarantineDays < 0 {
+		return "", nil
+	}
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	entry := QuarantineEntry{
+		ID:        hex.EncodeToString(id),
+		Path:      result.Path,
+		Size:      result.Size,
+		SHA256:    result.SHA256,
+		Signature: signature,
+		Actor:     identityName(r),
+		Time:      time.Now().UTC(),
+	}
+	if ip := geoLocator.ClientIP(r); ip != nil {
+		entry.ClientIP = ip.String()
+	}
+	err = os.MkdirAll(s.config.QuarantineDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	// 隔离目录与 data 目录不在同一文件系统时复制
+	target := filepath.Join(s.config.QuarantineDir, entry.ID+".bin")
+	err = os.Rename(tmpPath, target)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyBackupFile(tmpPath, target)
+	}
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(s.config.QuarantineDir, entry.ID+".json"), data, 0600)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("已隔离包含病毒的上传", "signature", signature, "path", entry.Path, "id", entry.ID, "actor", entry.Actor, "client_ip", entry.ClientIP)
+	return entry.ID, nil
+}
+
+// QuarantineEntries 返回隔离目录中的所有记录，按时间从新到旧排列
+func (s *VirusScanner) QuarantineEntries() ([]QuarantineEntry, error) {
+	files, err := os.ReadDir(s.config.QuarantineDir)
+	if os.IsNotExist(err) {
+		return []QuarantineEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries := []QuarantineEntry{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.config.QuarantineDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		var entry QuarantineEntry
+		if json.Unmarshal(data, &entry) == nil && quarantineIDPattern.MatchString(entry.ID) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	return entries, nil
+}
+
+// RemoveQuarantined 删除隔离的文件和记录
+func (s *VirusScanner) RemoveQuarantined(id string) error {
+	err := os.Remove(filepath.Join(s.config.QuarantineDir, id+".bin"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(filepath.Join(s.config.QuarantineDir, id+".json"))
+}
+
+// RunQuarantineCleanup 每小时删除超过保留天数的隔离文件
+func (s *VirusScanner) RunQuarantineCleanup() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		entries, err := s.QuarantineEntries()
+		if err != nil {
+			slog.Error("读取隔离目录失败", "err", err)
+			continue
+		}
+		cutoff := time.Now().AddDate(0, 0, -s.config.QuarantineDays)
+		for _, entry := range entries {
+			if entry.Time.After(cutoff) {
+				continue
+			}
+			err := s.RemoveQuarantined(entry.ID)
+			if err != nil {
+				slog.Error("删除过期的隔离文件失败", "err", err)
+				continue
+			}
+			slog.Info("已删除过期的隔离文件", "id", entry.ID, "path", entry.Path)
+		}
+	}
+}
+
+// 管理隔离的文件：GET 列出记录，带 id 和 download=true 时下载文件内容供分析，POST 删除
+func quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	if virusScanner == nil || virusScanner.config.QuarantineDays < 0 {
+		sendJSONResponse(w, http.StatusNotFound, "未启用隔离", nil, r.URL.Path)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			entries, err := virusScanner.QuarantineEntries()
+			if err != nil {
+				sendJSONResponse(w, http.StatusInternalServerError, "读取隔离目录失败", err, r.URL.Path)
+				return
+			}
+			sendContentResponse(w, http.StatusOK, "success", entries, nil, r.URL.Path)
+			return
+		}
+		if !quarantineIDPattern.MatchString(id) {
+			sendJSONResponse(w, http.StatusBadRequest, "非法的隔离 ID", nil, r.URL.Path)
+			return
+		}
+		// 隔离的文件与 data 目录中的文件格式相同，读取时解密和解压
+		file, err := openDataFile(filepath.Join(virusScanner.config.QuarantineDir, id+".bin"))
+		if os.IsNotExist(err) {
+			sendJSONResponse(w, http.StatusNotFound, "隔离文件不存在", err, r.URL.Path)
+			return
+		} else if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "读取隔离文件失败", err, r.URL.Path)
+			return
+		}
+		defer func(file io.ReadSeekCloser) {
+			_ = file.Close()
+		}(file)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+id+".bin\"")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		_, err = io.Copy(w, file)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "下载隔离文件失败", "err", err)
+			return
+		}
+		slog.InfoContext(r.Context(), "下载了隔离文件", "id", id)
+	case http.MethodPost:
+		var request struct {
+			ID string `json:"id"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || !quarantineIDPattern.MatchString(request.ID) {
+			sendJSONResponse(w, http.StatusBadRequest, "非法的隔离 ID", err, r.URL.Path)
+			return
+		}
+		err = virusScanner.RemoveQuarantined(request.ID)
+		if os.IsNotExist(err) {
+			sendJSONResponse(w, http.StatusNotFound, "隔离文件不存在", err, r.URL.Path)
+			return
+		} else if err != nil {
+			sendJSONResponse(w, http.StatusInternalServerError, "删除隔离文件失败", err, r.URL.Path)
+			return
+		}
+		sendJSONResponse(w, http.StatusOK, "已删除", nil, r.URL.Path)
+		slog.InfoContext(r.Context(), "删除了隔离文件", "id", request.ID)
+	default:
+		sendJSONResponse(w, http.StatusMethodNotAllowed, "不支持的请求方法", nil, r.URL.Path)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VisibilityConfig 结构用于按路径配置 /get/ 和 /thumb/ 是否公开
+type VisibilityConfig struct {
+	// Default 未匹配任何规则时的可见性：public（默认）或 private
+	Default string `json:"default"`
+	// Rules 按路径前缀配置可见性，匹配最长的前缀
+	Rules []VisibilityRule `json:"rules"`
+}
+
+// VisibilityRule 结构表示一条可见性规则
+type VisibilityRule struct {
+	// Prefix 路径前缀，按目录匹配，如 public 匹配 public 和 public/a.txt，不匹配 public2
+	Prefix     string `json:"prefix"`
+	Visibility string `json:"visibility"`
+}
+
+// Visibility 结构用于判断文件是否可以公开下载
+type Visibility struct {
+	defaultPublic bool
+	// rules 按前缀长度从长到短排列
+	rules []visibilityRule
+}
+
+type visibilityRule struct {
+	prefix string
+	public bool
+}
+
+// parseVisibility 解析可见性
+func parseVisibility(value string) (bool, error) {
+	switch value {
+	case "public":
+		return true, nil
+	case "private":
+		return false, nil
+	}
+	return false, fmt.Errorf("无效的可见性 %q，应为 public 或 private", value)
+}
+
+// NewVisibility 根据配置创建可见性规则，private 为 true 时默认不公开（兼容 sign.private）
+func NewVisibility(config VisibilityConfig, private bool) (*Visibility, error) {
+	v := &Visibility{defaultPublic: !private}
+	if config.Default != "" {
+		public, err := parseVisibility(config.Default)
+		if err != nil {
+			return nil, err
+		}
+		v.defaultPublic = public
+	}
+	for _, rule := range config.Rules {
+		public, err := parseVisibility(rule.Visibility)
+		if err != nil {
+			return nil, err
+		}
+		v.rules = append(v.rules, visibilityRule{prefix: indexKey(rule.Prefix), public: public})
+	}
+	sort.SliceStable(v.rules, func(i, j int) bool {
+		return len(v.rules[i].prefix) > len(v.rules[j].prefix)
+	})
+	return v, nil
+}
+
+// IsPublic 判断文件是否可以不经认证下载
+func (v *Visibility) IsPublic(key string) bool {
+	for _, rule := range v.rules {
+		if rule.prefix == "" || key == rule.prefix || strings.HasPrefix(key, rule.prefix+"/") {
+			return rule.public
+		}
+	}
+	return v.defaultPublic
+}
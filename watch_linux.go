@@ -0,0 +1,156 @@
+//go:build linux
+
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask 是监听目录时关注的事件，使用 IN_CLOSE_WRITE 而不是 IN_MODIFY 以免每次写入都触发
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyWatcher 使用 inotify 递归监听 data 目录，实时更新索引
+type inotifyWatcher struct {
+	fd    int
+	index *MetaIndex
+	// dirs 记录监听描述符对应的目录
+	dirs map[int32]string
+}
+
+// watchIndex 在 Linux 上使用 inotify 保持索引与磁盘一致，失败时回退为定期扫描
+func watchIndex(index *MetaIndex, cfg IndexConfig) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		slog.Error("无法初始化 inotify，改为定期扫描", "err", err)
+		pollIndex(index, cfg)
+		return
+	}
+
+	w := &inotifyWatcher{
+		fd:    fd,
+		index: index,
+		dirs:  map[int32]string{},
+	}
+	err = w.addTree("", false)
+	if err != nil {
+		// 通常是超过了 fs.inotify.max_user_watches 的限制
+		slog.Error("无法监听 data 目录，改为定期扫描", "err", err)
+		_ = syscall.Close(fd)
+		pollIndex(index, cfg)
+		return
+	}
+	slog.Info("已通过 inotify 监听目录", "dirs", len(w.dirs))
+	w.run()
+}
+
+// addTree 为目录及其所有子目录添加监听，scan 为 true 时同时扫描新目录中已有的内容
+func (w *inotifyWatcher) addTree(dirKey string, scan bool) error {
+	return filepath.WalkDir(filepath.Join("data", dirKey), func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel("data", fullPath)
+		if err != nil {
+			return err
+		}
+		key := indexKey(rel)
+		if isReservedPath(key) {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, fullPath, inotifyMask)
+		if err != nil {
+			return err
+		}
+		w.dirs[int32(wd)] = key
+		if scan {
+			_, err = scanDirectory(w.index, key)
+			if err != nil {
+				slog.Error("扫描目录失败", "err", err)
+			}
+		}
+		return nil
+	})
+}
+
+// run 循环读取 inotify 事件
+func (w *inotifyWatcher) run() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			slog.Error("读取 inotify 事件失败", "err", err)
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+			w.handle(event.Wd, event.Mask, name)
+		}
+	}
+}
+
+// handle 根据单个事件更新索引
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// 事件队列溢出，无法知道丢失了哪些变化，只能全量扫描
+		slog.Error("inotify 事件队列溢出，重新扫描")
+		rescanTree(w.index)
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		return
+	}
+
+	dirKey, ok := w.dirs[wd]
+	if !ok || name == "" {
+		return
+	}
+	if dirKey == "" && reservedNames[name] {
+		return
+	}
+	key := path.Join(dirKey, name)
+
+	// 上级目录的修改时间随之变化
+	if dirKey != "" {
+		if info, err := os.Stat(filepath.Join("data", dirKey)); err == nil {
+			w.index.Record(dirKey, info)
+		}
+	}
+
+	if mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 {
+		w.index.RemoveTree(key)
+		return
+	}
+
+	info, err := os.Lstat(filepath.Join("data", key))
+	if err != nil {
+		return
+	}
+	w.index.Record(key, info)
+	if info.IsDir() && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		err = w.addTree(key, true)
+		if err != nil {
+			slog.Error("无法监听新目录", "err", err)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// watchIndex 在非 Linux 平台上通过定期扫描保持索引与磁盘一致
+func watchIndex(index *MetaIndex, cfg IndexConfig) {
+	pollIndex(index, cfg)
+}
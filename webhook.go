@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookConfig 结构用于配置文件变更的 webhook，下游服务不必轮询 /list 即可得知新的文件
+type WebhookConfig struct {
+	Endpoints []WebhookEndpoint `json:"endpoints"`
+	// RetryInterval 首次重试的间隔，单位秒，默认 10，之后每次失败翻倍，最长 1 小时
+	RetryInterval int `json:"retry_interval"`
+	// MaxAttempts 每个事件最多发送的次数，默认 10，仍然失败时丢弃该事件
+	MaxAttempts int `json:"max_attempts"`
+	// MaxPending 每个地址最多积压的事件数，默认 10000，超过时丢弃最早的事件
+	MaxPending int `json:"max_pending"`
+	// Timeout 每次发送的超时时间，单位秒，默认 10
+	Timeout int `json:"timeout"`
+}
+
+// WebhookEndpoint 结构表示一个接收事件的地址
+type WebhookEndpoint struct {
+	URL string `json:"url"`
+	// Secret 用于计算 X-Store-Signature 签名，支持 env:、file:、vault:// 引用，为空时不签名
+	Secret string `json:"secret"`
+	// Events 为需要发送的事件类型，为空时发送所有事件
+	Events []string `json:"events"`
+	// Prefixes 为需要发送的路径前缀，按目录匹配，为空时发送所有路径
+	Prefixes []string `json:"prefixes"`
+}
+
+// webhook 的事件类型
+const (
+	webhookUpload = "upload"
+	webhookDelete = "delete"
+)
+
+// WebhookEvent 结构是发送给 webhook 的事件
+type WebhookEvent struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Path  string `json:"path"`
+	// Source 为产生事件的操作：upload、delta、rollback、trash_restore、snapshot_restore、delete、expire
+	Source string `json:"source"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Actor 为执行操作的调用方，后台任务产生的事件为空
+	Actor string `json:"actor,omitempty"`
+	// TrashID 为删除时移入回收站的 ID
+	TrashID string    `json:"trash_id,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// webhookDelivery 结构表示一个等待发送的事件
+type webhookDelivery struct {
+	Event       WebhookEvent `json:"event"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	LastError   string       `json:"last_error,omitempty"`
+}
+
+// webhookState 结构表示一个地址的积压和统计，与积压一起持久化
+type webhookState struct {
+	Pending     []*webhookDelivery `json:"pending"`
+	Delivered   int64              `json:"delivered"`
+	Failures    int64              `json:"failures"`
+	Dropped     int64              `json:"dropped"`
+	LastError   string             `json:"last_error,omitempty"`
+	LastErrorAt time.Time          `json:"last_error_at"`
+}
+
+// Webhooks 结构用于将文件变更事件按顺序发送到配置的地址，失败时按指数退避重试，积压保存在 data/.meta 目录下，重启后继续发送
+type Webhooks struct {
+	file   string
+	config WebhookConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints map[string]*webhookState
+	wake      map[string]chan struct{}
+	dirty     bool
+}
+
+// webhooks 未配置 webhook 时为 nil
+var webhooks *Webhooks
+
+// OpenWebhooks 加载积压并为每个地址启动发送的 goroutine，未配置地址时返回 nil
+func OpenWebhooks(file string, config WebhookConfig) (*Webhooks, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, nil
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 10
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 10
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = 10000
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10
+	}
+	h := &Webhooks{
+		file:      file,
+		config:    config,
+		client:    &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		endpoints: map[string]*webhookState{},
+		wake:      map[string]chan struct{}{},
+	}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &h.endpoints)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, endpoint := range config.Endpoints {
+		for _, event := range endpoint.Events {
+			if event != webhookUpload && event != webhookDelete {
+				return nil, fmt.Errorf("webhook %s 的事件类型 %q 应为 upload 或 delete", endpoint.URL, event)
+			}
+		}
+		if _, ok := h.wake[endpoint.URL]; ok {
+			return nil, fmt.Errorf("webhook 地址 %s 重复", endpoint.URL)
+		}
+		if _, ok := h.endpoints[endpoint.URL]; !ok {
+			h.endpoints[endpoint.URL] = &webhookState{}
+		}
+		h.wake[endpoint.URL] = make(chan struct{}, 1)
+	}
+	// 已经从配置中移除的地址不再发送
+	for url := range h.endpoints {
+		if _, ok := h.wake[url]; !ok {
+			delete(h.endpoints, url)
+		}
+	}
+	for _, endpoint := range config.Endpoints {
+		go h.run(endpoint)
+	}
+	return h, nil
+}
+
+// matches 判断事件是否需要发送到该地址
+func (endpoint WebhookEndpoint) matches(event WebhookEvent) bool {
+	if len(endpoint.Events) > 0 {
+		found := false
+		for _, e := range endpoint.Events {
+			if e == event.Event {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(endpoint.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range endpoint.Prefixes {
+		prefix = indexKey(prefix)
+		// 删除上级目录时同样通知只关注其中子目录的地址
+		if prefix == "" || event.Path == prefix || strings.HasPrefix(event.Path, prefix+"/") ||
+			(event.Event == webhookDelete && strings.HasPrefix(prefix, event.Path+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Emit 在文件变更成功后排队发送事件，r 为产生变更的请求，后台任务产生的变更为 nil
+func (h *Webhooks) Emit(r *http.Request, event WebhookEvent) {
+	if h == nil {
+		return
+	}
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		slog.Error("生成 webhook 事件 ID 失败", "err", err)
+		return
+	}
+	event.ID = hex.EncodeToString(id)
+	event.Time = time.Now().UTC()
+	if r != nil {
+		event.Actor = identityName(r)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for _, endpoint := range h.config.Endpoints {
+		if !endpoint.matches(event) {
+			continue
+		}
+		state := h.endpoints[endpoint.URL]
+		if len(state.Pending) >= h.config.MaxPending {
+			slog.Error("webhook 积压已满，丢弃事件", "url", endpoint.URL, "event", state.Pending[0].Event.Event, "path", state.Pending[0].Event.Path)
+			state.Pending = state.Pending[1:]
+			state.Dropped++
+		}
+		state.Pending = append(state.Pending, &webhookDelivery{Event: event, NextAttempt: now})
+		select {
+		case h.wake[endpoint.URL] <- struct{}{}:
+		default:
+		}
+	}
+	h.dirty = true
+}
+
+// EmitTree 为路径下的每个文件排队发送 upload 事件，用于从回收站恢复目录；索引中有记录时带上大小和哈希
+func (h *Webhooks) EmitTree(r *http.Request, key string, source string) {
+	if h == nil {
+		return
+	}
+	walkDataFiles(key, func(fileKey string) {
+		event := WebhookEvent{Event: webhookUpload, Path: fileKey, Source: source}
+		if meta, ok := metaIndex.Get(event.Path); ok {
+			event.Size = meta.Size
+			event.SHA256 = meta.SHA256
+		}
+		h.Emit(r, event)
+	})
+}
+
+// next 返回地址下一个需要发送的事件，以及需要等待的时间；事件按顺序发送，前面的事件重试时后面的事件等待
+func (h *Webhooks) next(url string) (*webhookDelivery, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pending := h.endpoints[url].Pending
+	if len(pending) == 0 {
+		return nil, time.Hour
+	}
+	if wait := time.Until(pending[0].NextAttempt); wait > 0 {
+		return nil, wait
+	}
+	copied := *pending[0]
+	return &copied, 0
+}
+
+// run 按顺序发送事件，失败时按指数退避重试
+func (h *Webhooks) run(endpoint WebhookEndpoint) {
+	for {
+		delivery, wait := h.next(endpoint.URL)
+		if delivery == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-h.wake[endpoint.URL]:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		err := h.send(endpoint, delivery.Event)
+		h.finish(endpoint.URL, delivery.Event.ID, err)
+	}
+}
+
+// finish 记录发送结果，超过最大次数仍然失败时丢弃事件
+func (h *Webhooks) finish(url string, id string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := h.endpoints[url]
+	h.dirty = true
+	// 发送期间事件可能因积压已满被丢弃
+	if len(state.Pending) == 0 || state.Pending[0].Event.ID != id {
+		return
+	}
+	current := state.Pending[0]
+	if err == nil {
+		state.Delivered++
+		state.Pending = state.Pending[1:]
+		return
+	}
+
+	slog.Error("发送 webhook 失败", "url", url, "event", current.Event.Event, "path", current.Event.Path, "err", err)
+	state.Failures++
+	state.LastError = err.Error()
+	state.LastErrorAt = time.Now()
+	current.Attempts++
+	current.LastError = err.Error()
+	if current.Attempts >= h.config.MaxAttempts {
+		slog.Error("webhook 多次发送失败，丢弃事件", "url", url, "attempts", current.Attempts, "event", current.Event.Event, "path", current.Event.Path)
+		state.Pending = state.Pending[1:]
+		state.Dropped++
+		return
+	}
+	backoff := time.Duration(h.config.RetryInterval) * time.Second
+	for i := 1; i < current.Attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+	current.NextAttempt = time.Now().Add(backoff)
+}
+
+// send 将事件以 JSON 格式 POST 到地址，配置了 secret 时在 X-Store-Signature 中带上请求体的 HMAC-SHA256
+func (h *Webhooks) send(endpoint WebhookEndpoint, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Store-Event", event.Event)
+	req.Header.Set("X-Store-Delivery", event.ID)
+	if endpoint.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(endpoint.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Store-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook 返回 %s", resp.Status)
+	}
+	return nil
+}
+
+// Save 将有修改的积压写回磁盘
+func (h *Webhooks) Save() error {
+	h.mu.Lock()
+	if !h.dirty {
+		h.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(h.endpoints)
+	h.dirty = false
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(h.file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile := h.file + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, h.file)
+}
+
+// Run 定期保存积压
+func (h *Webhooks) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := h.Save()
+		if err != nil {
+			slog.Error("保存 webhook 积压失败", "err", err)
+		}
+	}
+}
+
+// writeMetrics 输出每个地址的积压、发送成功、失败和丢弃的事件数
+func (h *Webhooks) writeMetrics(w http.ResponseWriter) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP store_webhook_pending Number of events waiting to be delivered.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_webhook_pending gauge\n")
+	for _, endpoint := range h.config.Endpoints {
+		_, _ = fmt.Fprintf(w, "store_webhook_pending{url=%q} %d\n", endpoint.URL, len(h.endpoints[endpoint.URL].Pending))
+	}
+	_, _ = fmt.Fprintf(w, "# HELP store_webhook_deliveries_total Webhook delivery attempts by result.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_webhook_deliveries_total counter\n")
+	for _, endpoint := range h.config.Endpoints {
+		state := h.endpoints[endpoint.URL]
+		_, _ = fmt.Fprintf(w, "store_webhook_deliveries_total{url=%q,result=\"delivered\"} %d\n", endpoint.URL, state.Delivered)
+		_, _ = fmt.Fprintf(w, "store_webhook_deliveries_total{url=%q,result=\"failed\"} %d\n", endpoint.URL, state.Failures)
+	}
+	_, _ = fmt.Fprintf(w, "# HELP store_webhook_dropped_total Events dropped after max attempts or when the backlog was full.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE store_webhook_dropped_total counter\n")
+	for _, endpoint := range h.config.Endpoints {
+		_, _ = fmt.Fprintf(w, "store_webhook_dropped_total{url=%q} %d\n", endpoint.URL, h.endpoints[endpoint.URL].Dropped)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WORMConfig 结构用于配置一次写入的目录：目录中已存在的文件不能通过接口覆盖或删除，可以上传新文件
+type WORMConfig struct {
+	Rules []WORMRule `json:"rules"`
+}
+
+// WORMRule 结构是一个一次写入的目录
+type WORMRule struct {
+	// Prefix 按目录匹配，如 audit 匹配 audit/a.log，不匹配 audit2/a.log
+	Prefix string `json:"prefix"`
+	// RetentionDays 文件从写入（修改时间）起的保留天数，期满后可以覆盖和删除；0 表示永久保留
+	RetentionDays int `json:"retention_days"`
+}
+
+// WORMViolation 结构是文件受一次写入规则保护时返回的内容，同时作为错误
+type WORMViolation struct {
+	Path   string `json:"path"`
+	Prefix string `json:"prefix"`
+	// RetainUntil 为可以覆盖和删除的时间，永久保留时为空
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+}
+
+func (v *WORMViolation) Error() string {
+	if v.RetainUntil == nil {
+		return fmt.Sprintf("%s 位于一次写入的目录 %s 中，不能覆盖或删除", v.Path, v.Prefix)
+	}
+	return fmt.Sprintf("%s 位于一次写入的目录 %s 中，%s 之前不能覆盖或删除", v.Path, v.Prefix, v.RetainUntil.Format(time.RFC3339))
+}
+
+// WORMPolicy 结构按一次写入的规则检查覆盖和删除
+type WORMPolicy struct {
+	// rules 按前缀从长到短排列，匹配最长的前缀
+	rules []WORMRule
+}
+
+// wormPolicy 未配置一次写入的目录时为 nil
+var wormPolicy *WORMPolicy
+
+// NewWORMPolicy 检查一次写入的规则，未配置时返回 nil
+func NewWORMPolicy(config WORMConfig) (*WORMPolicy, error) {
+	if len(config.Rules) == 0 {
+		return nil, nil
+	}
+	rules := make([]WORMRule, 0, len(config.Rules))
+	for _, rule := range config.Rules {
+		if rule.RetentionDays < 0 {
+			return nil, fmt.Errorf("%s 的 retention_days 不能为负数", rule.Prefix)
+		}
+		rule.Prefix = indexKey(rule.Prefix)
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+	return &WORMPolicy{rules: rules}, nil
+}
+
+// rule 返回路径适用的规则
+func (p *WORMPolicy) rule(key string) (WORMRule, bool) {
+	for _, rule := range p.rules {
+		if rule.Prefix == "" || key == rule.Prefix || strings.HasPrefix(key, rule.Prefix+"/") {
+			return rule, true
+		}
+	}
+	return WORMRule{}, false
+}
+
+// check 判断修改时间为 modTime 的文件在 now 时是否受保护
+func (p *WORMPolicy) check(key string, modTime time.Time, now time.Time) *WORMViolation {
+	rule, ok := p.rule(key)
+	if !ok {
+		return nil
+	}
+	violation := &WORMViolation{Path: key, Prefix: rule.Prefix}
+	if rule.RetentionDays == 0 {
+		return violation
+	}
+	until := modTime.AddDate(0, 0, rule.RetentionDays)
+	if !now.Before(until) {
+		return nil
+	}
+	violation.RetainUntil = &until
+	return violation
+}
+
+// Protected 判断文件或目录能否被覆盖或删除：文件受保护，或目录中有受保护的文件时返回 *WORMViolation，
+// 不存在的路径不受保护；双写迁移期间只存在于旧后端、或已移动到归档层的文件同样检查
+func (p *WORMPolicy) Protected(key string) error {
+	if p == nil {
+		return nil
+	}
+	fullPath, info, err := statReadPath(key)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	now := time.Now()
+	if !info.IsDir() {
+		if violation := p.check(key, info.ModTime(), now); violation != nil {
+			return violation
+		}
+		return nil
+	}
+	// 目录本身不在一次写入的目录中、也不包含一次写入的目录时不需要遍历
+	covered := false
+	for _, rule := range p.rules {
+		if rule.Prefix == "" || key == rule.Prefix || strings.HasPrefix(key, rule.Prefix+"/") || strings.HasPrefix(rule.Prefix, key+"/") {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		return nil
+	}
+	var violation *WORMViolation
+	err = filepath.WalkDir(fullPath, func(entryPath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(fullPath, entryPath)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		violation = p.check(filepath.ToSlash(filepath.Join(key, rel)), info.ModTime(), now)
+		if violation != nil {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if violation != nil {
+		return violation
+	}
+	return nil
+}
+
+// checkWORM 检查路径能否被覆盖或删除，受保护时返回 403 并返回 false
+func checkWORM(w http.ResponseWriter, r *http.Request, key string) bool {
+	err := wormPolicy.Protected(key)
+	if err == nil {
+		return true
+	}
+	var violation *WORMViolation
+	if errors.As(err, &violation) {
+		sendContentResponse(w, http.StatusForbidden, "文件位于一次写入的目录中，不能覆盖或删除", violation, nil, r.URL.Path)
+		return false
+	}
+	sendJSONResponse(w, http.StatusInternalServerError, "无法获取文件信息", err, r.URL.Path)
+	return false
+}